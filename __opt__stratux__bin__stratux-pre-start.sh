@@ -10,6 +10,54 @@ function wLog () {
 }
 wLog "Running Stratux Updater Script."
 
+# Update trial and rollback, see main/updatemanager.go
+UPDATE_DIR="/boot/StratuxUpdates"
+TRIAL_FILE="$UPDATE_DIR/trial"
+ROLLBACK_FILE="$UPDATE_DIR/rollback"
+RESULT_FILE="$UPDATE_DIR/result"
+BACKUP_DIR="/opt/stratux.rollback"
+BACKUP_DIRS="bin lib www ogn"
+MAX_STARTS=3
+
+# Restores the backup of the previous version. The base of the overlay is written if it's active.
+function rollback () {
+	BASE=""
+	if [ -e /overlay/robase/overlay ]; then
+		BASE="/overlay/robase"
+		/sbin/overlayctl unlock
+	fi
+	if [ ! -e ${BASE}${BACKUP_DIR}/bin/gen_gdl90 ]; then
+		wLog "No backup to roll back to"
+		echo "rollback failed: no backup ($1)" > ${RESULT_FILE}
+		rm -f ${TRIAL_FILE} ${ROLLBACK_FILE}
+		return
+	fi
+	wLog "Rolling back to the previous version: $1"
+	for d in ${BACKUP_DIRS}; do
+		rm -rf ${BASE}/opt/stratux/$d
+		cp -a ${BASE}${BACKUP_DIR}/$d ${BASE}/opt/stratux/
+	done
+	sync
+	echo "rolled back: $1" > ${RESULT_FILE}
+	rm -f ${TRIAL_FILE} ${ROLLBACK_FILE}
+	wLog "Rolled back... Rebooting... Bye"
+	reboot
+	exit 1
+}
+
+if [ -e ${ROLLBACK_FILE} ]; then
+	rollback "$(cat ${ROLLBACK_FILE})"
+fi
+if [ -e ${TRIAL_FILE} ]; then
+	STARTS=$(( $(cat ${TRIAL_FILE}) + 1 ))
+	if [ ${STARTS} -gt ${MAX_STARTS} ]; then
+		rollback "stratux failed to start ${MAX_STARTS} times after the update"
+	else
+		wLog "Update trial, start ${STARTS} of ${MAX_STARTS}"
+		echo ${STARTS} > ${TRIAL_FILE}
+	fi
+fi
+
 SCRIPT_MASK="update*stratux*v*.sh"
 TEMP_LOCATION="/boot/StratuxUpdates/$SCRIPT_MASK"
 UPDATE_LOCATION="/root/$SCRIPT_MASK"
@@ -30,8 +78,17 @@ if [ -e ${UPDATE_LOCATION} ]; then
 	UPDATE_SCRIPT=`ls -1t ${UPDATE_LOCATION} | head -1`
 	if [ -n ${UPDATE_SCRIPT} ] ; then
 		# Execute the script, remove it, then reboot.
+		wLog "Backing up the current version to ${BACKUP_DIR}"
+		rm -rf ${BACKUP_DIR}
+		mkdir -p ${BACKUP_DIR}
+		for d in ${BACKUP_DIRS}; do
+			cp -a /opt/stratux/$d ${BACKUP_DIR}/
+		done
 		wLog "Running update script ${UPDATE_SCRIPT}..."
 		bash ${UPDATE_SCRIPT}
+		mkdir -p ${UPDATE_DIR}
+		echo 0 > ${TRIAL_FILE}
+		rm -f ${ROLLBACK_FILE} ${RESULT_FILE}
 		wLog "Removing Update SH"
 		rm -f ${UPDATE_SCRIPT}
 		wLog "Finished... Rebooting... Bye"
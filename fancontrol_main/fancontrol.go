@@ -4,16 +4,21 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/b3nn0/stratux/common"
 	"github.com/felixge/pidctrl"
+	"github.com/kidoman/embd"
+	_ "github.com/kidoman/embd/host/rpi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stianeikeland/go-rpio/v4"
@@ -34,6 +39,11 @@ var (
 		Help: "Current PWM Value",
 	})
 
+	currentRPM = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "current_rpm",
+		Help: "Current fan speed, -1 without tachometer.",
+	})
+
 	totalFanOnTime = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "total_fan_on_time",
@@ -71,6 +81,22 @@ const (
 	// start delay of the fan to start the fan to 80% to give the fan a kick to start spinning
 	PWMDuty80PStartDelay = 500
 
+	// duty cycle in % of the kick, the fan may not start spinning from a standstill below
+	defaultSpinUpDuty = 100
+
+	// "pid": hold TempTarget, "curve": duty cycle by temperature from FanCurve
+	fanModePID   = "pid"
+	fanModeCurve = "curve"
+
+	// degrees C the temperature has to fall before the curve lowers the duty cycle again
+	defaultHysteresis = 3.
+
+	// tachometer pulses per revolution, 2 for most PC fans
+	defaultTachPulses = 2
+
+	// consecutive measurements without rotation while the fan should be running until it is reported as failed
+	fanFailureCount = 3
+
 	// GPIO-1/BCM "18"/Pin 12 on a Rev 2 and 3,4 Raspberry Pi   
 	defaultPin = 18
 
@@ -85,6 +111,11 @@ const (
 	alwaysOn = true
 )
 
+type FanCurvePoint struct {
+	Temp float64 // degrees C
+	Duty float64 // %
+}
+
 type FanControl struct {
 	TempTarget           float64
 	TempCurrent          float64
@@ -93,8 +124,19 @@ type FanControl struct {
 	PWMDuty80PStartDelay uint32
 	PWMDutyCurrent       uint32
 	PWMPin               int
+	FanControlMode       string
+	FanCurve             []FanCurvePoint // sorted by Temp, linear in between
+	FanHysteresis        float64
+	FanSpinUpDuty        uint32
+	FanTachPin           int // BCM numbering, 0 = no tachometer
+	FanTachPulses        int
+	RPM                  int // -1 = no tachometer
+	FanFailure           bool
 }
 
+// Off up to 45 degrees C, full speed from 65 degrees C
+var defaultFanCurve = []FanCurvePoint{{45, 0}, {50, 30}, {60, 70}, {65, 100}}
+
 var myFanControl FanControl
 
 var configChan = make(chan bool, 1)
@@ -108,6 +150,7 @@ func updateStats() {
 		totalUptime.With(prometheus.Labels{"all": "all"}).Inc()
 		currentTemp.Set(float64(myFanControl.TempCurrent))
 		currentPWM.Set(float64(myFanControl.PWMDutyCurrent))
+		currentRPM.Set(float64(myFanControl.RPM))
 		if myFanControl.PWMDutyCurrent > 0 {
 			totalFanOnTime.With(prometheus.Labels{"all": "all"}).Inc()
 		}
@@ -119,12 +162,116 @@ func fmap( x, in_min, in_max, out_min, out_max float64) float64 {
 	return (x - in_min) * (out_max - out_min) / (in_max - in_min) + out_min;
 }
 
+// Duty cycle of the curve at temp, the first/last point below/above the curve
+func curveDuty(curve []FanCurvePoint, temp float64) float64 {
+	if len(curve) == 0 {
+		return 100.0
+	}
+	if temp <= curve[0].Temp {
+		return curve[0].Duty
+	}
+	for i := 1; i < len(curve); i++ {
+		if temp <= curve[i].Temp {
+			return fmap(temp, curve[i-1].Temp, curve[i].Temp, curve[i-1].Duty, curve[i].Duty)
+		}
+	}
+	return curve[len(curve)-1].Duty
+}
+
+// Duty cycle of the curve with hysteresis: it is only lowered once the temperature fell FanHysteresis below
+// the point of the current duty cycle. Non-zero values are at least PWMDutyMin, and at most pwmDutyMax.
+func curveFanDuty(current float64) float64 {
+	duty := curveDuty(myFanControl.FanCurve, myFanControl.TempCurrent)
+	if duty < current {
+		duty = math.Min(current, curveDuty(myFanControl.FanCurve, myFanControl.TempCurrent+myFanControl.FanHysteresis))
+	}
+	if duty > 0 && duty < float64(myFanControl.PWMDutyMin) {
+		duty = float64(myFanControl.PWMDutyMin)
+	}
+	return math.Min(duty, pwmDutyMax)
+}
+
+// Counts the falling edges of the tachometer with GPIO interrupts and updates the RPM every updateDelayMS.
+func tachMonitor() {
+	embd.SetHost(embd.HostRPi, 3)
+	var edges uint64
+	var tach embd.DigitalPin
+	tachPin := 0 // pin of tach, or the one that couldn't be set up
+	last := time.Now()
+	ticker := time.NewTicker(updateDelayMS * time.Millisecond)
+	for {
+		pinNumber, pulses := myFanControl.FanTachPin, myFanControl.FanTachPulses
+		if pinNumber == myFanControl.PWMPin {
+			pinNumber = 0
+		}
+		if pinNumber != tachPin {
+			if tach != nil {
+				tach.StopWatching()
+				tach.Close()
+				tach = nil
+			}
+			tachPin = pinNumber
+			if pinNumber > 0 {
+				pin := rpio.Pin(pinNumber)
+				pin.Input()
+				pin.PullUp() // open collector output
+				p, err := embd.NewDigitalPin(pinNumber)
+				if err == nil {
+					if err = p.SetDirection(embd.In); err == nil {
+						err = p.Watch(embd.EdgeFalling, func(embd.DigitalPin) { atomic.AddUint64(&edges, 1) })
+					}
+					if err != nil {
+						p.Close()
+					}
+				}
+				if err != nil {
+					log.Println("Can't watch tachometer pin", pinNumber, ":", err)
+				} else {
+					tach = p
+				}
+			}
+			atomic.StoreUint64(&edges, 0)
+			last = time.Now()
+		} else if tach != nil {
+			now := time.Now()
+			myFanControl.RPM = int(float64(atomic.SwapUint64(&edges, 0)) * 60000. / float64(now.Sub(last).Milliseconds()) / float64(pulses))
+			last = now
+		}
+		if tach == nil {
+			myFanControl.RPM = -1
+			myFanControl.FanFailure = false
+		}
+		<-ticker.C
+	}
+}
+
+// The fan failed if it doesn't turn for fanFailureCount measurements while it should
+func checkFanFailure(failures *int) {
+	if myFanControl.RPM < 0 || myFanControl.PWMDutyCurrent == 0 {
+		*failures = 0
+		return
+	}
+	if myFanControl.RPM > 0 {
+		if myFanControl.FanFailure {
+			log.Println("Fan is turning again:", myFanControl.RPM, "RPM")
+		}
+		*failures = 0
+		myFanControl.FanFailure = false
+		return
+	}
+	*failures++
+	if *failures >= fanFailureCount && !myFanControl.FanFailure {
+		log.Println("Fan failure: no tachometer pulses at", myFanControl.PWMDutyCurrent, "% duty cycle")
+		myFanControl.FanFailure = true
+	}
+}
 
 
 func fanControl() {
 	myFanControl.PWMDuty80PStartDelay = PWMDuty80PStartDelay
 	myFanControl.TempCurrent = 0
 	myFanControl.PWMDutyCurrent = 0
+	myFanControl.RPM = -1
 	updateControlDelay := time.NewTicker(updateDelayMS * time.Millisecond)
 
 	// Monitor Temperature
@@ -189,9 +336,11 @@ func fanControl() {
 	// Start Prometheus		
 	prometheus.MustRegister(currentTemp)
 	prometheus.MustRegister(currentPWM)
+	prometheus.MustRegister(currentRPM)
 	prometheus.MustRegister(totalFanOnTime)
 	prometheus.MustRegister(totalUptime)
 	go updateStats()
+	go tachMonitor()
 
 	// Create a PID controller
 	pidControl := pidctrl.NewPIDController(0.2, 0.2, 0.1)
@@ -199,31 +348,37 @@ func fanControl() {
 	pidControl.Set(myFanControl.TempTarget)
 
 	var lastPWMControlValue float64 = 0.0
+	fanFailures := 0
 	for {
-
-		// Update the PID controller.
-		pidValueOut := -pidControl.UpdateDuration(myFanControl.TempCurrent, updateDelayMS * time.Millisecond)
-
-		// If fan is starting up eg from 0 to some value, start it up for myFanControl.PWMDuty80PStartDelay at 80%
-		if (lastPWMControlValue <=5.0 && pidValueOut>5.0 && !alwaysOn) {
-//			log.Println("Starting up fan for" ,myFanControl.PWMDuty80PStartDelay, "ms")
-			setHWDutyCycle(100.0)
-			time.Sleep(time.Duration(myFanControl.PWMDuty80PStartDelay) * time.Millisecond)
-		}
+		checkFanFailure(&fanFailures)
 
 		var fanRequiredDuty float64 = 0 // The duty cycle required by the fan
-		if (pidValueOut > 5.0 || lastPWMControlValue != 0.0) {
-			lastPWMControlValue = pidValueOut
-			fanRequiredDuty = dutyCycleToFan(pidValueOut)
+		if (myFanControl.FanControlMode == fanModeCurve) {
+			fanRequiredDuty = curveFanDuty(float64(myFanControl.PWMDutyCurrent))
 		} else {
-			lastPWMControlValue = 0
-			if (alwaysOn) {
-				fanRequiredDuty = dutyCycleToFan(1)
+			// Update the PID controller.
+			pidValueOut := -pidControl.UpdateDuration(myFanControl.TempCurrent, updateDelayMS * time.Millisecond)
+
+			if (pidValueOut > 5.0 || lastPWMControlValue != 0.0) {
+				lastPWMControlValue = pidValueOut
+				fanRequiredDuty = dutyCycleToFan(pidValueOut)
 			} else {
-				fanRequiredDuty = 0.0
+				lastPWMControlValue = 0
+				if (alwaysOn) {
+					fanRequiredDuty = dutyCycleToFan(1)
+				} else {
+					fanRequiredDuty = 0.0
+				}
 			}
 		}
 
+		// If fan is starting up eg from 0 to some value, give it a kick at FanSpinUpDuty for PWMDuty80PStartDelay
+		if (myFanControl.PWMDutyCurrent == 0 && fanRequiredDuty > 0 && fanRequiredDuty < float64(myFanControl.FanSpinUpDuty)) {
+//			log.Println("Starting up fan for" ,myFanControl.PWMDuty80PStartDelay, "ms")
+			setHWDutyCycle(float64(myFanControl.FanSpinUpDuty))
+			time.Sleep(time.Duration(myFanControl.PWMDuty80PStartDelay) * time.Millisecond)
+		}
+
 		setHWDutyCycle(fanRequiredDuty)
 //		log.Println("Temp:", myFanControl.TempCurrent, 
 //		            "Current PWM:", myFanControl.PWMDutyCurrent)
@@ -317,21 +472,22 @@ func readSettings() {
 	myFanControl.PWMFrequency = defaultPwmFrequency
 	myFanControl.PWMPin = defaultPin
 	myFanControl.PWMDuty80PStartDelay = PWMDuty80PStartDelay
-
-	fd, err := os.Open(configLocation)
-	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
-		return
-	}
-	defer fd.Close()
-	buf := make([]byte, 4096)
-	count, err := fd.Read(buf)
+	myFanControl.FanControlMode = fanModePID
+	myFanControl.FanCurve = append([]FanCurvePoint(nil), defaultFanCurve...) // Unmarshal reuses the array
+	myFanControl.FanHysteresis = defaultHysteresis
+	myFanControl.FanSpinUpDuty = defaultSpinUpDuty
+	myFanControl.FanTachPin = 0
+	myFanControl.FanTachPulses = defaultTachPulses
+	defer validateSettings()
+
+	// the settings outgrew any fixed size buffer long ago
+	buf, err := ioutil.ReadFile(configLocation)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		return
 	}
 
-	err = json.Unmarshal(buf[0:count], &myFanControl)
+	err = json.Unmarshal(buf, &myFanControl)
 	if err != nil {
 		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
 		return
@@ -339,6 +495,28 @@ func readSettings() {
 	log.Printf("read in settings.\n")
 }
 
+func validateSettings() {
+	if (myFanControl.FanControlMode != fanModeCurve) {
+		myFanControl.FanControlMode = fanModePID
+	}
+	if (len(myFanControl.FanCurve) == 0) {
+		myFanControl.FanCurve = append([]FanCurvePoint(nil), defaultFanCurve...)
+	}
+	for i := range myFanControl.FanCurve {
+		myFanControl.FanCurve[i].Duty = math.Max(0, math.Min(pwmDutyMax, myFanControl.FanCurve[i].Duty))
+	}
+	sort.Slice(myFanControl.FanCurve, func(i, j int) bool { return myFanControl.FanCurve[i].Temp < myFanControl.FanCurve[j].Temp })
+	if (myFanControl.FanHysteresis < 0) {
+		myFanControl.FanHysteresis = 0
+	}
+	if (myFanControl.FanSpinUpDuty > pwmDutyMax) {
+		myFanControl.FanSpinUpDuty = pwmDutyMax
+	}
+	if (myFanControl.FanTachPulses < 1) {
+		myFanControl.FanTachPulses = defaultTachPulses
+	}
+}
+
 func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
 	statusJSON, _ := json.Marshal(&myFanControl)
 	w.Write(statusJSON)
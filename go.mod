@@ -3,12 +3,14 @@ module github.com/b3nn0/stratux
 go 1.16
 
 require (
-	github.com/BertoldVdb/go-ais v0.1.0 // indirect
+	github.com/BertoldVdb/go-ais v0.1.0
 	github.com/b3nn0/goflying v0.0.0-20210424141101-d83dac8fdc36
 	github.com/dustin/go-humanize v1.0.0
+	github.com/eclipse/paho.mqtt.golang v1.3.5
 	github.com/erikstmartin/go-testdb v0.0.0-20160219214506-8d10e4a1bae5 // indirect
 	github.com/felixge/pidctrl v0.0.0-20160307080219-7b13bcae7243
 	github.com/gansidui/geohash v0.0.0-20141019080235-ebe5ba447f34
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/jpoirier/gortlsdr v2.10.0+incompatible
 	github.com/kellydunn/golang-geo v0.7.0
 	github.com/kidoman/embd v0.0.0-20170508013040-d3d8c0c5c68d
@@ -24,7 +24,8 @@ apt update
 apt clean
 
 PATH=/root/fake:$PATH apt install --yes libjpeg62-turbo-dev libconfig9 rpi-update dnsmasq git cmake \
-    libusb-1.0-0-dev build-essential autoconf libtool i2c-tools libfftw3-dev libncurses-dev python3-serial jq ifplugd iptables
+    libusb-1.0-0-dev build-essential autoconf libtool i2c-tools libfftw3-dev libncurses-dev python3-serial jq ifplugd iptables wireguard-tools \
+    espeak-ng
 
 # Downgrade to older brcm wifi firmware - the new one seems to be buggy in AP+Client mode
 # see https://github.com/raspberrypi/firmware/issues/1463
@@ -192,11 +193,11 @@ sed -i /etc/hosts -e "s/raspberrypi/stratux/g"
 rm -r /root/stratux
 
 
-# Uninstall packages we don't need, clean up temp stuff
+# Uninstall packages we don't need, clean up temp stuff. alsa-utils and bluez stay for the audio traffic alerts
 rm -r /root/go /root/go_path /root/.cache
 
-PATH=/root/fake:$PATH apt remove --purge --yes alsa-utils alsa-ucm-conf alsa-topology-conf bluez bluez-firmware cifs-utils cmake cmake-data \
-    v4l-utils rsync pigz pi-bluetooth perl cpp cpp-10
+PATH=/root/fake:$PATH apt remove --purge --yes cifs-utils cmake cmake-data \
+    v4l-utils rsync pigz perl cpp cpp-10
 
 PATH=/root/fake:$PATH apt autoremove --purge --yes
 
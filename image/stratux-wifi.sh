@@ -17,7 +17,7 @@ function wLog () {
 wLog "Running Stratux WiFI Script."
 
 interface=$1 # for dhcp and wpa_supplicant
-mode=$2 # 0=ap, 1=wifi-direct, 2=ap+client
+mode=$2 # 0=ap, 1=wifi-direct, 2=ap+client (3=client starts the fallback ap0 with mode 0)
 pin=$3 # wifi-direct pin
 
 if [ "$1" == "0" ] || [ "$1" == "1" ] || [ "$1" == "2" ]; then
@@ -0,0 +1,317 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	adsbout.go: ADS-B Out self-monitoring. The 1090ES dongle receives the extended squitters of our own transponder
+		(globalSettings.OwnshipModeS) at close range. They are compared to the Stratux GPS and baro, similar to an
+		FAA Public ADS-B Performance Report (PAPR) but available offline right after the flight: the transmitted
+		NIC and NACp against the 14 CFR 91.227 minimums, the position error, the agreement of the pressure and
+		GNSS altitude and gaps in the position reports.
+			/getADSBOut                           ADSBOutReport
+			/resetADSBOut                         POST, starts a new report
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	ADSBOUT_MIN_NIC        = 7      // 14 CFR 91.227
+	ADSBOUT_MIN_NACP       = 8      // 14 CFR 91.227, EPU < 0.05 NM
+	ADSBOUT_POS_TOLERANCE  = 150.0  // m, allowed position error. NACp 8 plus our own GPS error
+	ADSBOUT_ALT_TOLERANCE  = 150.0  // ft, allowed difference of the transmitted to our baro and GNSS altitude
+	ADSBOUT_GAP            = 5.0    // s without position report that counts as gap. Nominal rate is 2 per second
+	ADSBOUT_ACQUIRE_DIST   = 3704.0 // m, a position within 2 NM picks one of several configured codes
+	ADSBOUT_ACTIVE_TIMEOUT = 10 * time.Second
+	ADSBOUT_ISSUE_PERCENT  = 2.0 // % of the samples out of tolerance that are reported as issue
+)
+
+type ADSBOutReport struct {
+	Address          string // hex, "" if nothing received yet
+	Active           bool   // received within ADSBOUT_ACTIVE_TIMEOUT
+	Start            time.Time
+	LastSeen         time.Time
+	Messages         uint64 // DF17 extended squitters
+	PositionMessages uint64
+	Callsign         string
+	Squawk           int // -1 if not received
+	EmitterCategory  uint8
+	OnGround         bool
+	NIC              int    // last transmitted
+	NACp             int    // last transmitted, -1 if no operational status received
+	NICLow           uint64 // position messages with NIC below ADSBOUT_MIN_NIC
+	NACpLow          uint64 // position messages while NACp was below ADSBOUT_MIN_NACP
+
+	PositionSamples   uint64  // compared to our GPS
+	PositionErrorMean float64 // m
+	PositionErrorMax  float64
+	PositionErrorHigh uint64 // beyond ADSBOUT_POS_TOLERANCE
+
+	BaroSamples  uint64  // compared to our baro sensor
+	BaroDiffMean float64 // ft, transmitted minus ours
+	BaroDiffMax  float64 // ft, absolute
+	BaroDiffHigh uint64  // beyond ADSBOUT_ALT_TOLERANCE
+
+	GNSSSamples  uint64 // transmitted GNSS height compared to our GPS height above the ellipsoid
+	GNSSDiffMean float64
+	GNSSDiffMax  float64
+	GNSSDiffHigh uint64
+
+	PositionGaps   uint64  // longer than ADSBOUT_GAP
+	PositionGapMax float64 // s
+
+	Issues []string
+}
+
+var adsbOut = ADSBOutReport{Squawk: -1, NACp: -1}
+var adsbOutAddress uint32
+var adsbOutLastSeen time.Time     // stratuxClock
+var adsbOutLastPosition time.Time // stratuxClock
+var adsbOutPositionSum, adsbOutBaroSum, adsbOutGNSSSum float64
+var adsbOutMutex sync.Mutex
+
+// Our configured Mode S codes, without the placeholder of an unconfigured Stratux.
+func adsbOutCodes() []uint32 {
+	codes := make([]uint32, 0)
+	for _, s := range strings.Split(globalSettings.OwnshipModeS, ",") {
+		s = strings.TrimSpace(s)
+		if c, err := strconv.ParseUint(s, 16, 32); err == nil && c != 0 && !strings.EqualFold(s, "F00000") {
+			codes = append(codes, uint32(c))
+		}
+	}
+	return codes
+}
+
+// Whether the message of icao is one of ours. With several codes, the first one transmitting a position near us is used.
+func isADSBOutAddress(icao uint32, newTi *dump1090Data) bool {
+	if adsbOutAddress != 0 {
+		return icao == adsbOutAddress
+	}
+	codes := adsbOutCodes()
+	for _, c := range codes {
+		if c != icao {
+			continue
+		}
+		if len(codes) > 1 {
+			if !newTi.Position_valid || newTi.Lat == nil || newTi.Lng == nil || !isGPSValid() {
+				return false
+			}
+			dist, _ := common.Distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(*newTi.Lat), float64(*newTi.Lng))
+			if dist > ADSBOUT_ACQUIRE_DIST {
+				return false
+			}
+		}
+		adsbOutAddress = icao
+		adsbOut.Address = fmt.Sprintf("%06X", icao)
+		adsbOut.Start = time.Now().UTC()
+		logInfof("adsbout", "receiving our ADS-B Out on %s", adsbOut.Address)
+		return true
+	}
+	return false
+}
+
+/*
+	checkADSBOut().
+		Called for every decoded 1090ES message by processDump1090Message() with the updated target, trafficMutex held.
+*/
+func checkADSBOut(newTi *dump1090Data, ti *TrafficInfo) {
+	adsbOutMutex.Lock()
+	defer adsbOutMutex.Unlock()
+	if !isADSBOutAddress(ti.Icao_addr, newTi) {
+		return
+	}
+	if newTi.Squawk != nil {
+		adsbOut.Squawk = ti.Squawk // also from surveillance replies
+	}
+	if newTi.DF != 17 {
+		return
+	}
+	adsbOut.Messages++
+	adsbOut.LastSeen = time.Now().UTC()
+	adsbOutLastSeen = stratuxClock.Time
+	adsbOut.Callsign = ti.Tail
+	adsbOut.EmitterCategory = ti.Emitter_category
+	adsbOut.OnGround = ti.OnGround
+	if newTi.NACp != nil {
+		adsbOut.NACp = *newTi.NACp
+	}
+
+	if newTi.TypeCode >= 5 && newTi.TypeCode <= 22 && newTi.TypeCode != 19 {
+		adsbOutCheckPosition(newTi, ti)
+	}
+	if newTi.Alt != nil && !newTi.AltIsGNSS && isTempPressValid() &&
+		mySituation.BaroSourceType != BARO_TYPE_TRANSPONDER && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
+		// Not against the transponder's own altitude or an estimate that might include ourselves.
+		diff := float64(*newTi.Alt) - float64(mySituation.BaroPressureAltitude)
+		adsbOut.BaroSamples++
+		adsbOutBaroSum += diff
+		adsbOut.BaroDiffMax = math.Max(adsbOut.BaroDiffMax, math.Abs(diff))
+		if math.Abs(diff) > ADSBOUT_ALT_TOLERANCE {
+			adsbOut.BaroDiffHigh++
+		}
+	}
+	if isGPSValid() {
+		hae := math.NaN()
+		if newTi.Alt != nil && newTi.AltIsGNSS {
+			hae = float64(*newTi.Alt)
+		} else if newTi.GnssDiffFromBaroAlt != nil && math.Abs(float64(*newTi.GnssDiffFromBaroAlt)) < 3125 && ti.Alt != 0 && !ti.AltIsGNSS {
+			hae = float64(ti.Alt) + float64(*newTi.GnssDiffFromBaroAlt)
+		}
+		if !math.IsNaN(hae) {
+			diff := hae - float64(mySituation.GPSHeightAboveEllipsoid)
+			adsbOut.GNSSSamples++
+			adsbOutGNSSSum += diff
+			adsbOut.GNSSDiffMax = math.Max(adsbOut.GNSSDiffMax, math.Abs(diff))
+			if math.Abs(diff) > ADSBOUT_ALT_TOLERANCE {
+				adsbOut.GNSSDiffHigh++
+			}
+		}
+	}
+}
+
+func adsbOutCheckPosition(newTi *dump1090Data, ti *TrafficInfo) {
+	adsbOut.PositionMessages++
+	adsbOut.NIC = ti.NIC
+	if ti.NIC < ADSBOUT_MIN_NIC {
+		adsbOut.NICLow++
+	}
+	if adsbOut.NACp >= 0 && adsbOut.NACp < ADSBOUT_MIN_NACP {
+		adsbOut.NACpLow++
+	}
+	// Surface positions are sent less often when not moving, only count gaps in the air.
+	if !adsbOutLastPosition.IsZero() && !ti.OnGround {
+		gap := stratuxClock.Since(adsbOutLastPosition).Seconds()
+		if gap > ADSBOUT_GAP {
+			adsbOut.PositionGaps++
+		}
+		adsbOut.PositionGapMax = math.Max(adsbOut.PositionGapMax, gap)
+	}
+	adsbOutLastPosition = time.Time{}
+	if !ti.OnGround {
+		adsbOutLastPosition = stratuxClock.Time
+	}
+
+	if !newTi.Position_valid || newTi.Lat == nil || newTi.Lng == nil || !isGPSValid() {
+		return
+	}
+	// Move our last fix to now, the transponder reports the position of the time of transmission.
+	lat, lng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+	age := stratuxClock.Since(mySituation.GPSLastFixLocalTime).Seconds()
+	if age > 0 && mySituation.GPSGroundSpeed > 5 {
+		lat, lng = calcLocationForBearingDistance(lat, lng, float64(mySituation.GPSTrueCourse), mySituation.GPSGroundSpeed*age/3600)
+	}
+	dist, _ := common.Distance(lat, lng, float64(*newTi.Lat), float64(*newTi.Lng))
+	adsbOut.PositionSamples++
+	adsbOutPositionSum += dist
+	adsbOut.PositionErrorMax = math.Max(adsbOut.PositionErrorMax, dist)
+	if dist > ADSBOUT_POS_TOLERANCE {
+		adsbOut.PositionErrorHigh++
+	}
+}
+
+func adsbOutPercent(count, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) * 100 / float64(total)
+}
+
+// Findings worth a look at the installation.
+func adsbOutIssues(r *ADSBOutReport) []string {
+	issues := make([]string, 0)
+	if r.Messages == 0 {
+		return issues
+	}
+	if p := adsbOutPercent(r.NICLow, r.PositionMessages); p > ADSBOUT_ISSUE_PERCENT {
+		issues = append(issues, fmt.Sprintf("NIC below %d in %.0f%% of the position reports", ADSBOUT_MIN_NIC, p))
+	}
+	if r.NACp < 0 {
+		issues = append(issues, "no NACp received (operational status messages missing)")
+	} else if p := adsbOutPercent(r.NACpLow, r.PositionMessages); p > ADSBOUT_ISSUE_PERCENT {
+		issues = append(issues, fmt.Sprintf("NACp below %d in %.0f%% of the position reports", ADSBOUT_MIN_NACP, p))
+	}
+	if p := adsbOutPercent(r.PositionErrorHigh, r.PositionSamples); p > ADSBOUT_ISSUE_PERCENT {
+		issues = append(issues, fmt.Sprintf("position more than %.0f m off our GPS in %.0f%% of the reports", ADSBOUT_POS_TOLERANCE, p))
+	}
+	if p := adsbOutPercent(r.BaroDiffHigh, r.BaroSamples); p > ADSBOUT_ISSUE_PERCENT {
+		issues = append(issues, fmt.Sprintf("pressure altitude more than %.0f ft off our baro sensor in %.0f%% of the reports", ADSBOUT_ALT_TOLERANCE, p))
+	}
+	if p := adsbOutPercent(r.GNSSDiffHigh, r.GNSSSamples); p > ADSBOUT_ISSUE_PERCENT {
+		issues = append(issues, fmt.Sprintf("GNSS height more than %.0f ft off our GPS in %.0f%% of the reports", ADSBOUT_ALT_TOLERANCE, p))
+	}
+	if r.PositionGaps > 0 {
+		issues = append(issues, fmt.Sprintf("%d gaps in the position reports, up to %.0f s", r.PositionGaps, r.PositionGapMax))
+	}
+	if len(r.Callsign) == 0 {
+		issues = append(issues, "no flight ID received")
+	}
+	if squawk := transponderSquawk(); squawk >= 0 && r.Squawk >= 0 && squawk != r.Squawk {
+		issues = append(issues, fmt.Sprintf("transmitted code %04d differs from the transponder's %04d", r.Squawk, squawk))
+	}
+	return issues
+}
+
+func getADSBOutReport() ADSBOutReport {
+	adsbOutMutex.Lock()
+	defer adsbOutMutex.Unlock()
+	r := adsbOut
+	r.Active = r.Messages > 0 && stratuxClock.Since(adsbOutLastSeen) < ADSBOUT_ACTIVE_TIMEOUT
+	if r.PositionSamples > 0 {
+		r.PositionErrorMean = math.Round(adsbOutPositionSum / float64(r.PositionSamples))
+	}
+	if r.BaroSamples > 0 {
+		r.BaroDiffMean = math.Round(adsbOutBaroSum / float64(r.BaroSamples))
+	}
+	if r.GNSSSamples > 0 {
+		r.GNSSDiffMean = math.Round(adsbOutGNSSSum / float64(r.GNSSSamples))
+	}
+	r.PositionErrorMax = math.Round(r.PositionErrorMax)
+	r.BaroDiffMax = math.Round(r.BaroDiffMax)
+	r.GNSSDiffMax = math.Round(r.GNSSDiffMax)
+	r.PositionGapMax = math.Round(r.PositionGapMax*10) / 10
+	r.Issues = adsbOutIssues(&r)
+	return r
+}
+
+func resetADSBOut() {
+	adsbOutMutex.Lock()
+	defer adsbOutMutex.Unlock()
+	adsbOut = ADSBOutReport{Squawk: -1, NACp: -1}
+	adsbOutAddress = 0
+	adsbOutLastPosition = time.Time{}
+	adsbOutPositionSum, adsbOutBaroSum, adsbOutGNSSSum = 0, 0, 0
+}
+
+// AJAX call - /getADSBOut.
+func handleADSBOutGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	reportJSON, err := json.Marshal(getADSBOutReport())
+	if err != nil {
+		logErrorf("adsbout", "Error sending ADS-B Out JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", reportJSON)
+}
+
+// AJAX call - /resetADSBOut. Returns the new, empty report.
+func handleADSBOutResetRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	resetADSBOut()
+	handleADSBOutGetRequest(w, r)
+}
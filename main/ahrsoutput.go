@@ -0,0 +1,157 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ahrsoutput.go: Per client AHRS output. By default every GDL90 AHRS output gets the Levil AHRS message (0x4C) at
+		the rate of the AHRS (~20 Hz) and the ForeFlight AHRS message (0x65) at 5 Hz. Some EFBs choke on that, others
+		interpolate poorly at low rates, so a client can get a single message flavor at its own rate instead
+		(NetworkClient.AHRS, see clientmanager.go):
+			AHRS_FORMAT_FOREFLIGHT  ForeFlight AHRS message (0x65 0x01)
+			AHRS_FORMAT_LEVIL       Levil/iLevil AHRS message (0x4C), as the default output
+			AHRS_FORMAT_DYNON       Dynon SkyView ADAHRS text ("!1", 74 characters), heading true, not magnetic
+		at AHRS_OUTPUT_RATE_MIN-AHRS_OUTPUT_RATE_MAX Hz, with or without heading. Rates above the AHRS rate repeat the
+		latest attitude.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	AHRS_FORMAT_FOREFLIGHT = "foreflight"
+	AHRS_FORMAT_LEVIL      = "levil"
+	AHRS_FORMAT_DYNON      = "dynon"
+
+	AHRS_OUTPUT_RATE_MIN = 5  // Hz
+	AHRS_OUTPUT_RATE_MAX = 50 // Hz, also the rate of ahrsOutputSender()
+)
+
+var ahrsFormats = map[string]bool{AHRS_FORMAT_FOREFLIGHT: true, AHRS_FORMAT_LEVIL: true, AHRS_FORMAT_DYNON: true}
+
+// Parses the AHRS entry of a NetworkClients setting, nil if it is missing or invalid.
+func parseNetworkClientAHRS(v interface{}) *NetworkClientAHRS {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	a := NetworkClientAHRS{}
+	rate, _ := m["Rate"].(float64)
+	a.Rate = int(math.Max(AHRS_OUTPUT_RATE_MIN, math.Min(AHRS_OUTPUT_RATE_MAX, math.Round(rate))))
+	a.Format, _ = m["Format"].(string)
+	a.Format = strings.ToLower(strings.TrimSpace(a.Format))
+	if !ahrsFormats[a.Format] {
+		return nil
+	}
+	a.Heading, _ = m["Heading"].(bool)
+	return &a
+}
+
+// AHRS output of the client, nil if it gets the default messages.
+func networkClientAHRS(ip string) *NetworkClientAHRS {
+	c, ok := globalSettings.NetworkClients[ip]
+	if !ok || c.AHRS == nil {
+		return nil
+	}
+	a := *c.AHRS
+	return &a
+}
+
+// Connections with their own AHRS output don't get the default messages, see sendTrafficMsg().
+func hasOwnAHRSOutput(conn connection) bool {
+	nc, ok := conn.(*networkConnection)
+	return ok && nc.ahrs != nil
+}
+
+/*
+	makeDynonADAHRSString().
+		Dynon SkyView ADAHRS data, fields not known to us are filled with 'X':
+		!1 1 HHMMSSFF pitch(+999) roll(+9999) heading(999) IAS(9999) palt(+99999) turn(+999) lat-g(+99) vert-g(+99)
+		AOA(99) VS(+999, 10 ft/min) OAT(+99) TAS(9999) baro(999) DA(+99999) wind dir(999) wind speed(99) checksum CR LF
+*/
+func makeDynonADAHRSString(withHeading bool, t time.Time) string {
+	if !isAHRSValid() {
+		return ""
+	}
+	field := func(valid bool, format string, width int, v float64) string {
+		if !valid {
+			return strings.Repeat("X", width)
+		}
+		return fmt.Sprintf(format, int(math.Round(v)))
+	}
+	t = t.UTC()
+	msg := fmt.Sprintf("!11%02d%02d%02d%02d", t.Hour(), t.Minute(), t.Second(), t.Nanosecond()*64/1e9)
+	msg += field(!isAHRSInvalidValue(mySituation.AHRSPitch), "%+04d", 4, mySituation.AHRSPitch*10)
+	msg += field(!isAHRSInvalidValue(mySituation.AHRSRoll), "%+05d", 5, mySituation.AHRSRoll*10)
+	msg += field(withHeading && !isAHRSInvalidValue(mySituation.AHRSGyroHeading), "%03d", 3,
+		math.Mod(mySituation.AHRSGyroHeading+360, 360))
+	msg += "XXXX" // IAS
+	msg += field(isTempPressValid(), "%+06d", 6, float64(mySituation.BaroPressureAltitude))
+	msg += field(!isAHRSInvalidValue(mySituation.AHRSTurnRate), "%+04d", 4, mySituation.AHRSTurnRate*10)
+	msg += "XXX" // lateral acceleration
+	msg += field(!isAHRSInvalidValue(mySituation.AHRSGLoad), "%+03d", 3, mySituation.AHRSGLoad*10)
+	msg += "XX" // AOA
+	msg += field(isTempPressValid(), "%+04d", 4, float64(mySituation.BaroVerticalSpeed)/10)
+	msg += "XXX" + "XXXX" + "XXX" + "XXXXXX" + "XXX" + "XX" // OAT, TAS, baro setting, density altitude, wind
+	var sum byte
+	for i := 0; i < len(msg); i++ {
+		sum += msg[i]
+	}
+	return fmt.Sprintf("%s%02X\r\n", msg, sum)
+}
+
+// AHRS message of the format, nil if there is nothing to send.
+func makeClientAHRSMessage(a *NetworkClientAHRS) []byte {
+	switch a.Format {
+	case AHRS_FORMAT_FOREFLIGHT:
+		return prepareMessage(makeFFAHRSMsg(a.Heading))
+	case AHRS_FORMAT_LEVIL:
+		return prepareMessage(makeAHRSGDL90Msg(a.Heading))
+	case AHRS_FORMAT_DYNON:
+		if s := makeDynonADAHRSString(a.Heading, time.Now()); len(s) > 0 {
+			return []byte(s)
+		}
+	}
+	return nil
+}
+
+// Sends the AHRS messages of the clients with their own AHRS output, each at its rate.
+func ahrsOutputSender() {
+	ticker := time.NewTicker(time.Second / AHRS_OUTPUT_RATE_MAX)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if !globalStatus.IMUConnected && !isGPSValid() {
+			continue
+		}
+		messages := make(map[NetworkClientAHRS][]byte) // the same message for all clients of a format
+		netMutex.Lock()
+		for _, conn := range clientConnections {
+			nc, ok := conn.(*networkConnection)
+			if !ok || nc.ahrs == nil || (nc.Capability&NETWORK_AHRS_GDL90) == 0 {
+				continue
+			}
+			nc.ahrsPhase += float64(nc.ahrs.Rate) / AHRS_OUTPUT_RATE_MAX
+			if nc.ahrsPhase < 1 {
+				continue
+			}
+			nc.ahrsPhase--
+			msg, ok := messages[*nc.ahrs]
+			if !ok {
+				msg = makeClientAHRSMessage(nc.ahrs)
+				messages[*nc.ahrs] = msg
+			}
+			if msg == nil || !isRateAllowed(conn, NETWORK_AHRS_GDL90, msg) {
+				continue
+			}
+			conn.MessageQueue().Put(MSGPRIO_AUX, 2*time.Second/time.Duration(nc.ahrs.Rate), msg)
+		}
+		netMutex.Unlock()
+	}
+}
@@ -13,7 +13,6 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net"
 	"strings"
 	"time"
@@ -43,7 +42,7 @@ func aisListen() {
 			time.Sleep(3 * time.Second)
 			continue
 		}
-		log.Printf("ais successfully connected")
+		logInfof("ais", "ais successfully connected")
 		aisReadWriter := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 		globalStatus.AIS_connected = true
 
@@ -58,7 +57,7 @@ func aisListen() {
 				aisIncomingMsgChan <- scanner.Text()
 			}
 			if scanner.Err() != nil {
-				log.Printf("ais-rx-eu connection lost: " + scanner.Err().Error())
+				logWarnf("ais", "ais-rx-eu connection lost: %s", scanner.Err().Error())
 			}
 			aisExitChan <- true
 		}()
@@ -67,22 +66,7 @@ func aisListen() {
 		for globalSettings.AIS_Enabled {
 			select {
 			case data := <-aisIncomingMsgChan:
-
-				var thisMsg msg
-				thisMsg.MessageClass = MSGCLASS_AIS
-				thisMsg.TimeReceived = stratuxClock.Time
-				thisMsg.Data = data
-				msgLogAppend(thisMsg)
-				logMsg(thisMsg) // writes to replay logs
-
-				msg, err := nm.ParseSentence(data)
-				if err == nil && msg != nil && msg.Packet != nil {
-					importAISTrafficMessage(msg)
-				} else if err != nil {
-					log.Printf("Invalid Data from AIS: " + err.Error())
-				} else {
-					// Multiline sentences will have msg as nill without err
-				}
+				processAISMessage(nm, data)
 			case <-aisExitChan:
 				break loop
 
@@ -94,6 +78,25 @@ func aisListen() {
 	}
 }
 
+// Handles one NMEA sentence from rtl_ais. Also used by the flight replay (flightreplay.go).
+func processAISMessage(nm *aisnmea.NMEACodec, data string) {
+	var thisMsg msg
+	thisMsg.MessageClass = MSGCLASS_AIS
+	thisMsg.TimeReceived = stratuxClock.Time
+	thisMsg.Data = data
+	msgLogAppend(thisMsg)
+	logMsg(thisMsg) // writes to replay logs
+
+	msg, err := nm.ParseSentence(data)
+	if err == nil && msg != nil && msg.Packet != nil {
+		importAISTrafficMessage(msg)
+	} else if err != nil {
+		logWarnf("ais", "Invalid Data from AIS: %s", err.Error())
+	} else {
+		// Multiline sentences will have msg as nill without err
+	}
+}
+
 // Datastructure for AIS parsing 
 // explanation can be found at https://www.navcen.uscg.gov/?pageName=AISMessages
 func importAISTrafficMessage(msg *aisnmea.VdmPacket) {
@@ -224,6 +227,6 @@ func importAISTrafficMessage(msg *aisnmea.VdmPacket) {
 
 	if globalSettings.DEBUG {
 		txt, _ := json.Marshal(ti)
-		log.Printf("AIS traffic imported: " + string(txt))
+		logDebugf("ais", "AIS traffic imported: %s", string(txt))
 	}
 }
@@ -0,0 +1,328 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	alertmanager.go: System alerts (not traffic alerts, see trafficalerts.go). Subsystems raise an alert with an ident,
+		severity and message and clear it once the condition is gone; raising an active alert again only updates it.
+		The system errors (addSingleSystemErrorf) are critical alerts. alertMonitor() watches for GPS loss,
+		disconnected SDRs and sensors, CPU temperature and free disk space. Alerts can be acknowledged, which hides them
+		from the status bar of the web UI while they stay active. The last ALERT_HISTORY alerts are kept in
+		ALERT_HISTORY_FILE, on the boot partition so they survive the read-only overlay and reboots.
+			/getAlerts                            active alerts and the history, newest first
+			/ackAlert?id=<ident>                  POST: acknowledge an alert, all alerts without id
+			/systemalerts                         WebSocket: every change of an alert, starts with the active ones
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	ALERT_INFO     = "info"
+	ALERT_WARNING  = "warning"
+	ALERT_CRITICAL = "critical"
+
+	ALERT_HISTORY       = 100
+	ALERT_HISTORY_FILE  = "/boot/stratux-alerts.json"
+	ALERT_SAVE_INTERVAL = 1 * time.Minute // the history is written at most this often
+	ALERT_MONITOR_TIME  = 5 * time.Second
+
+	ALERT_GPS_LOST_TIME   = 10 * time.Second
+	ALERT_CPU_TEMP_WARN   = 75.0 // °C
+	ALERT_CPU_TEMP_CRIT   = 80.0
+	ALERT_CPU_TEMP_CLEAR  = 70.0
+	ALERT_DISK_FREE_WARN  = 100 * 1024 * 1024
+	ALERT_DISK_FREE_CRIT  = 20 * 1024 * 1024
+	ALERT_DISK_FREE_CLEAR = 150 * 1024 * 1024
+)
+
+type SystemAlert struct {
+	ID           string
+	Severity     string // ALERT_*
+	Source       string // subsystem, e.g. "gps", "sdr", "system"
+	Message      string
+	Raised       time.Time
+	Updated      time.Time
+	Cleared      time.Time // zero while active
+	Active       bool
+	Acknowledged bool
+	Count        int // times raised while active
+}
+
+type SystemAlerts struct {
+	Active  []SystemAlert
+	History []SystemAlert // cleared alerts, newest first
+}
+
+var systemAlerts = make(map[string]*SystemAlert) // active, by ID
+var systemAlertHistory []SystemAlert
+var systemAlertsMutex sync.Mutex
+var systemAlertsDirty bool
+var systemAlertUpdate *uibroadcaster
+
+// Raises an alert, or updates the message and severity of the active alert with the same ident.
+func raiseAlert(ident, severity, source string, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	now := time.Now().UTC()
+	systemAlertsMutex.Lock()
+	alert, ok := systemAlerts[ident]
+	if !ok {
+		alert = &SystemAlert{ID: ident, Source: source, Raised: now, Active: true}
+		systemAlerts[ident] = alert
+	} else if alert.Severity == severity && alert.Message == msg {
+		alert.Count++
+		systemAlertsMutex.Unlock()
+		return
+	}
+	if ok && severity != alert.Severity {
+		// Escalated or downgraded, show it again
+		alert.Acknowledged = false
+	}
+	alert.Severity, alert.Message, alert.Updated = severity, msg, now
+	alert.Count++
+	copied := *alert
+	systemAlertsDirty = true
+	systemAlertsMutex.Unlock()
+
+	if !ok {
+		logWarnf("alerts", "%s %s (%s): %s", severity, ident, source, msg)
+		debriefAlert(copied)
+	}
+	publishSystemAlert(copied)
+}
+
+// Clears an active alert, it goes to the history.
+func clearAlert(ident string) {
+	systemAlertsMutex.Lock()
+	alert, ok := systemAlerts[ident]
+	if !ok {
+		systemAlertsMutex.Unlock()
+		return
+	}
+	delete(systemAlerts, ident)
+	alert.Active = false
+	alert.Cleared = time.Now().UTC()
+	systemAlertHistory = append([]SystemAlert{*alert}, systemAlertHistory...)
+	if len(systemAlertHistory) > ALERT_HISTORY {
+		systemAlertHistory = systemAlertHistory[:ALERT_HISTORY]
+	}
+	copied := *alert
+	systemAlertsDirty = true
+	systemAlertsMutex.Unlock()
+
+	logInfof("alerts", "cleared %s: %s", ident, copied.Message)
+	publishSystemAlert(copied)
+}
+
+// Acknowledges an active alert, all of them if ident is empty. False if there is no such alert.
+func acknowledgeAlert(ident string) bool {
+	acked := make([]SystemAlert, 0)
+	systemAlertsMutex.Lock()
+	for id, alert := range systemAlerts {
+		if (len(ident) == 0 || id == ident) && !alert.Acknowledged {
+			alert.Acknowledged = true
+			acked = append(acked, *alert)
+		}
+	}
+	_, found := systemAlerts[ident]
+	systemAlertsMutex.Unlock()
+	for _, alert := range acked {
+		publishSystemAlert(alert)
+	}
+	return len(ident) == 0 || found
+}
+
+func publishSystemAlert(alert SystemAlert) {
+	if systemAlertUpdate != nil {
+		systemAlertUpdate.SendJSON(alert)
+	}
+}
+
+func getSystemAlerts() SystemAlerts {
+	systemAlertsMutex.Lock()
+	defer systemAlertsMutex.Unlock()
+	alerts := SystemAlerts{Active: make([]SystemAlert, 0, len(systemAlerts)), History: append([]SystemAlert{}, systemAlertHistory...)}
+	for _, alert := range systemAlerts {
+		alerts.Active = append(alerts.Active, *alert)
+	}
+	sort.Slice(alerts.Active, func(i, j int) bool { return alerts.Active[i].Raised.After(alerts.Active[j].Raised) })
+	return alerts
+}
+
+func loadAlertHistory() {
+	data, err := ioutil.ReadFile(ALERT_HISTORY_FILE)
+	if err != nil {
+		return
+	}
+	var loaded []SystemAlert
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		logWarnf("alerts", "can't read %s: %s", ALERT_HISTORY_FILE, err.Error())
+		return
+	}
+	// Behind the alerts cleared since the start
+	systemAlertsMutex.Lock()
+	defer systemAlertsMutex.Unlock()
+	systemAlertHistory = append(systemAlertHistory, loaded...)
+	if len(systemAlertHistory) > ALERT_HISTORY {
+		systemAlertHistory = systemAlertHistory[:ALERT_HISTORY]
+	}
+}
+
+// Active alerts are saved as well, so a reboot doesn't lose them. They are cleared (marked as such) when loaded.
+func saveAlertHistory() {
+	systemAlertsMutex.Lock()
+	if !systemAlertsDirty {
+		systemAlertsMutex.Unlock()
+		return
+	}
+	systemAlertsDirty = false
+	now := time.Now().UTC()
+	saved := make([]SystemAlert, 0, len(systemAlerts)+len(systemAlertHistory))
+	for _, alert := range systemAlerts {
+		a := *alert
+		a.Active, a.Cleared = false, now
+		saved = append(saved, a)
+	}
+	saved = append(saved, systemAlertHistory...)
+	systemAlertsMutex.Unlock()
+
+	if len(saved) > ALERT_HISTORY {
+		saved = saved[:ALERT_HISTORY]
+	}
+	data, _ := json.Marshal(saved)
+	if err := ioutil.WriteFile(ALERT_HISTORY_FILE, data, 0644); err != nil {
+		logWarnf("alerts", "can't save %s: %s", ALERT_HISTORY_FILE, err.Error())
+	}
+}
+
+// Raises or clears an alert depending on a condition.
+func setAlert(active bool, ident, severity, source string, format string, a ...interface{}) {
+	if active {
+		raiseAlert(ident, severity, source, format, a...)
+	} else {
+		clearAlert(ident)
+	}
+}
+
+// Watches the conditions every subsystem has in common and saves the history.
+func alertMonitor() {
+	loadAlertHistory()
+	registerSubsystem("alerts", 3*ALERT_MONITOR_TIME)
+	ticker := time.NewTicker(ALERT_MONITOR_TIME)
+	lastSave := time.Now()
+	var gpsValidLast time.Time
+	var maxSDRs uint32
+	imuSeen, baroSeen := false, false
+	for {
+		<-ticker.C
+		subsystemAlive("alerts")
+
+		// GPS lost: had a position, none for ALERT_GPS_LOST_TIME
+		if isGPSValid() {
+			gpsValidLast = time.Now()
+		}
+		setAlert(globalSettings.GPS_Enabled && !gpsValidLast.IsZero() && time.Since(gpsValidLast) > ALERT_GPS_LOST_TIME,
+			"gps-lost", ALERT_WARNING, "gps", "GPS position lost")
+
+		// SDR disconnected: fewer than the most seen since the start
+		if globalStatus.Devices > maxSDRs {
+			maxSDRs = globalStatus.Devices
+		}
+		setAlert(globalStatus.Devices < maxSDRs, "sdr-disconnected", ALERT_WARNING, "sdr",
+			"SDR disconnected: %d of %d connected", globalStatus.Devices, maxSDRs)
+
+		// Sensors that were connected and are gone
+		imuSeen = imuSeen || globalStatus.IMUConnected
+		setAlert(globalSettings.IMU_Sensor_Enabled && imuSeen && !globalStatus.IMUConnected, "imu-failure",
+			ALERT_CRITICAL, "ahrs", "IMU failure: attitude unavailable")
+		baroSeen = baroSeen || globalStatus.BMPConnected
+		setAlert(globalSettings.BMP_Sensor_Enabled && baroSeen && !globalStatus.BMPConnected, "baro-failure",
+			ALERT_WARNING, "ahrs", "Pressure sensor failure: no pressure altitude")
+
+		// CPU temperature, with hysteresis
+		temp := float64(globalStatus.CPUTemp)
+		if temp >= ALERT_CPU_TEMP_CRIT {
+			raiseAlert("cpu-temp", ALERT_CRITICAL, "system", "CPU temperature %.0f°C", temp)
+		} else if temp >= ALERT_CPU_TEMP_WARN {
+			raiseAlert("cpu-temp", ALERT_WARNING, "system", "CPU temperature %.0f°C", temp)
+		} else if temp < ALERT_CPU_TEMP_CLEAR {
+			clearAlert("cpu-temp")
+		}
+
+		// Free disk space, with hysteresis. 0 = not measured yet
+		free := globalStatus.DiskBytesFree
+		if free > 0 && free < ALERT_DISK_FREE_CRIT {
+			raiseAlert("disk-low", ALERT_CRITICAL, "system", "Disk almost full: %d MiB free", free/1048576)
+		} else if free > 0 && free < ALERT_DISK_FREE_WARN {
+			raiseAlert("disk-low", ALERT_WARNING, "system", "Disk space low: %d MiB free", free/1048576)
+		} else if free >= ALERT_DISK_FREE_CLEAR {
+			clearAlert("disk-low")
+		}
+
+		// Stalled subsystems, see systemhealth.go
+		for _, s := range getSubsystemHealth() {
+			setAlert(!s.OK, "subsystem-"+s.Name, ALERT_WARNING, s.Name, "Subsystem %s stalled", s.Name)
+		}
+
+		if time.Since(lastSave) >= ALERT_SAVE_INTERVAL {
+			lastSave = time.Now()
+			saveAlertHistory()
+		}
+	}
+}
+
+// AJAX call - /getAlerts.
+func handleAlertsGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	alertsJSON, err := json.Marshal(getSystemAlerts())
+	if err != nil {
+		logErrorf("alerts", "Error sending alerts JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", alertsJSON)
+}
+
+// AJAX call - /ackAlert?id=<ident>. Without id all active alerts are acknowledged.
+func handleAlertAckRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if !acknowledgeAlert(r.URL.Query().Get("id")) {
+		http.Error(w, "no active alert with this id", http.StatusNotFound)
+		return
+	}
+	handleAlertsGetRequest(w, r)
+}
+
+// System alert changes. Starts off with the active alerts.
+func handleSystemAlertsWS(conn *websocket.Conn) {
+	for _, alert := range getSystemAlerts().Active {
+		alertJSON, _ := json.Marshal(&alert)
+		conn.Write(alertJSON)
+	}
+	systemAlertUpdate.AddSocket(conn)
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
+	for {
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,380 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	api.go: Versioned management API with optional token authentication. With globalSettings.APIAuthEnabled every
+		mutating request needs one of globalSettings.APITokens, as "Authorization: Bearer <token>" or
+		"X-API-Token: <token>". The legacy endpoints (/setSettings, /reboot, ...) stay unauthenticated as long as
+		globalSettings.APILegacyOpen is set, for apps that don't know the API yet.
+			GET    /api/v1                          API version, whether authentication is enabled, the routes
+			GET    /api/v1/status                   same as /getStatus
+			GET    /api/v1/situation                same as /getSituation
+			GET    /api/v1/system/health            same as /status/system
+			GET    /api/v1/clients                  same as /getNetworkClients
+			GET    /api/v1/settings                 same as /getSettings, without passwords and token hashes
+			POST   /api/v1/settings                 same as /setSettings, except for the API settings
+			POST   /api/v1/system/{reboot,shutdown,restart}
+			POST   /api/v1/ahrs/{calibrate,cage,orient,resetgmeter}
+			GET    /api/v1/alerts                   same as /getAlerts
+			POST   /api/v1/alerts/ack               same as /ackAlert, ?id=<ident>
+			GET    /api/v1/units                    same as /getUnits
+			GET    /api/v1/setup                    same as /getSetupWizard
+			POST   /api/v1/setup                    same as /setSetupWizard
+			GET    /api/v1/power                    same as /getPower
+			POST   /api/v1/power                    same as /setPower, ?action=cancel|suspend|resume
+			GET    /api/v1/flights                  same as /getFlights
+			GET    /api/v1/flights/download         same as /downloadFlight, ?id=<id>&format=gpx|kml|igc
+			POST   /api/v1/flights/delete           same as /deleteFlight, ?id=<id>
+			GET    /api/v1/flights/debrief          same as /getDebrief, ?id=<id>
+			GET    /api/v1/rfcapture                same as /getRFCapture
+			GET    /api/v1/transponder              same as /getTransponder
+			GET    /api/v1/adsbout                  same as /getADSBOut
+			POST   /api/v1/adsbout/reset            same as /resetADSBOut
+			GET    /api/v1/thermal                  same as /getThermal
+			GET    /api/v1/i2c                      same as /getI2CScan
+			GET    /api/v1/rfcapture/download       same as /downloadRFCapture, ?file=<name>
+			POST   /api/v1/rfcapture/delete         same as /deleteRFCapture, ?file=<name>
+			GET    /api/v1/logs/levels              same as /getLogLevels
+			POST   /api/v1/logs/levels              same as /setLogLevel
+			GET    /api/v1/logs/bundle              same as /downloadSupportBundle
+			GET    /api/v1/auth                     APIAuthEnabled, APILegacyOpen and the tokens (names only)
+			POST   /api/v1/auth                     {"Enabled": true, "LegacyOpen": false}
+			POST   /api/v1/auth/tokens              {"Name": "efb"}, returns the token, it can't be retrieved again
+			DELETE /api/v1/auth/tokens/<name>
+		Only hashes of the tokens are stored. The API settings can't be changed through /setSettings, otherwise an open
+		legacy endpoint could turn the authentication off.
+		Requests from the loopback interface (local helpers like pwrbtn) don't need a token.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	API_VERSION     = 1
+	API_PREFIX      = "/api/v1"
+	API_TOKEN_BYTES = 24
+)
+
+type APIToken struct {
+	Name    string
+	Hash    string // hex SHA-256 of the token
+	Created time.Time
+}
+
+type apiRoute struct {
+	Method   string
+	Path     string // below API_PREFIX
+	Mutating bool   // needs a token if APIAuthEnabled
+	handler  http.HandlerFunc
+}
+
+var apiRoutes []apiRoute
+
+func init() {
+	// Set here, the handlers refer to apiRoutes
+	apiRoutes = []apiRoute{
+		{"GET", "", false, handleAPIInfoRequest},
+		{"GET", "/status", false, handleStatusRequest},
+		{"GET", "/situation", false, handleSituationRequest},
+		{"GET", "/system/health", false, handleSystemHealthRequest},
+		{"GET", "/clients", false, handleNetworkClientsGetRequest},
+		{"GET", "/settings", false, handleSettingsGetRequest},
+		{"POST", "/settings", true, handleSettingsSetRequest},
+		{"POST", "/system/reboot", true, handleRebootRequest},
+		{"POST", "/system/shutdown", true, handleShutdownRequest},
+		{"POST", "/system/restart", true, handleRestartRequest},
+		{"POST", "/ahrs/calibrate", true, handleCalibrateAHRS},
+		{"POST", "/ahrs/cage", true, handleCageAHRS},
+		{"POST", "/ahrs/orient", true, handleOrientAHRS},
+		{"POST", "/ahrs/resetgmeter", true, handleAPIResetGMeterRequest},
+		{"GET", "/alerts", false, handleAlertsGetRequest},
+		{"POST", "/alerts/ack", true, handleAlertAckRequest},
+		{"GET", "/units", false, handleUnitsRequest},
+		{"GET", "/setup", false, handleSetupWizardGetRequest},
+		{"POST", "/setup", true, handleSetupWizardSetRequest},
+		{"GET", "/power", false, handlePowerGetRequest},
+		{"POST", "/power", true, handlePowerSetRequest},
+		{"GET", "/flights", false, handleFlightsRequest},
+		{"GET", "/flights/download", false, handleFlightDownloadRequest},
+		{"POST", "/flights/delete", true, handleFlightDeleteRequest},
+		{"GET", "/flights/debrief", false, handleDebriefRequest},
+		{"GET", "/rfcapture", false, handleRFCaptureGetRequest},
+		{"GET", "/rfcapture/download", false, handleRFCaptureDownloadRequest},
+		{"POST", "/rfcapture/delete", true, handleRFCaptureDeleteRequest},
+		{"GET", "/transponder", false, handleTransponderGetRequest},
+		{"GET", "/adsbout", false, handleADSBOutGetRequest},
+		{"POST", "/adsbout/reset", true, handleADSBOutResetRequest},
+		{"GET", "/thermal", false, handleThermalGetRequest},
+		{"GET", "/i2c", false, handleI2CScanRequest},
+		{"GET", "/logs/levels", false, handleLogLevelsGetRequest},
+		{"POST", "/logs/levels", true, handleLogLevelSetRequest},
+		{"GET", "/logs/bundle", false, handleSupportBundleRequest},
+		{"GET", "/auth", true, handleAPIAuthGetRequest},
+		{"POST", "/auth", true, handleAPIAuthSetRequest},
+		{"POST", "/auth/tokens", true, handleAPITokenCreateRequest},
+		{"DELETE", "/auth/tokens/", true, handleAPITokenDeleteRequest},
+	}
+}
+
+func apiTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Token of the request, empty if there is none.
+func apiRequestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Token"))
+}
+
+// Whether the request carries one of the API tokens.
+func apiTokenValid(r *http.Request) bool {
+	token := apiRequestToken(r)
+	if len(token) == 0 {
+		return false
+	}
+	hash := []byte(apiTokenHash(token))
+	valid := false
+	for _, t := range globalSettings.APITokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="stratux"`)
+	}
+	w.WriteHeader(status)
+	errJSON, _ := json.Marshal(map[string]string{"Error": msg})
+	fmt.Fprintf(w, "%s\n", errJSON)
+}
+
+// Whether the request comes from stratux itself.
+func apiRequestFromLoopback(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Checks the token of a mutating request. Responds with 401 and returns false if it's missing or wrong.
+func apiAuthorize(w http.ResponseWriter, r *http.Request) bool {
+	if !globalSettings.APIAuthEnabled || apiRequestFromLoopback(r) || apiTokenValid(r) {
+		return true
+	}
+	logWarnf("api", "unauthorized %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	apiError(w, http.StatusUnauthorized, "missing or invalid API token")
+	return false
+}
+
+// Wraps a legacy mutating endpoint: open while APILegacyOpen is set, otherwise it needs a token like the API.
+func legacyEndpoint(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			handler(w, r)
+			return
+		}
+		if !globalSettings.APILegacyOpen && !apiAuthorize(w, r) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// /api/v1/... Dispatches to the route of the path and method.
+func handleAPIRequest(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/")
+	if r.Method == "OPTIONS" {
+		// CORS preflight, the token header isn't a simple header
+		setNoCache(w)
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept, Authorization, X-API-Token")
+		return
+	}
+	pathFound := false
+	for _, route := range apiRoutes {
+		matches := path == route.Path || (strings.HasSuffix(route.Path, "/") && strings.HasPrefix(path, route.Path) && len(path) > len(route.Path))
+		if !matches {
+			continue
+		}
+		pathFound = true
+		if route.Method != r.Method {
+			continue
+		}
+		if route.Mutating && !apiAuthorize(w, r) {
+			return
+		}
+		route.handler(w, r)
+		return
+	}
+	if pathFound {
+		apiError(w, http.StatusMethodNotAllowed, "method not allowed")
+	} else {
+		apiError(w, http.StatusNotFound, "unknown API endpoint")
+	}
+}
+
+// /api/v1. What the API offers.
+func handleAPIInfoRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	routes := make([]string, len(apiRoutes))
+	for i, route := range apiRoutes {
+		routes[i] = route.Method + " " + API_PREFIX + route.Path
+		if strings.HasSuffix(route.Path, "/") {
+			routes[i] += "<name>"
+		}
+		if route.Mutating {
+			routes[i] += " (token)"
+		}
+	}
+	info := map[string]interface{}{
+		"Version":        API_VERSION,
+		"StratuxVersion": stratuxVersion,
+		"AuthEnabled":    globalSettings.APIAuthEnabled,
+		"Routes":         routes,
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		logErrorf("api", "Error sending API info JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", infoJSON)
+}
+
+// /api/v1/ahrs/resetgmeter. Unlike /resetGMeter no reboot.
+func handleAPIResetGMeterRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	ResetAHRSGLoad()
+	fmt.Fprintf(w, "{}\n")
+}
+
+func handleAPIAuthGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	type tokenInfo struct {
+		Name    string
+		Created time.Time
+	}
+	tokens := make([]tokenInfo, len(globalSettings.APITokens))
+	for i, t := range globalSettings.APITokens {
+		tokens[i] = tokenInfo{t.Name, t.Created}
+	}
+	authJSON, err := json.Marshal(map[string]interface{}{
+		"Enabled":    globalSettings.APIAuthEnabled,
+		"LegacyOpen": globalSettings.APILegacyOpen,
+		"Tokens":     tokens,
+	})
+	if err != nil {
+		logErrorf("api", "Error sending API auth JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", authJSON)
+}
+
+func handleAPIAuthSetRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Enabled    *bool
+		LegacyOpen *bool
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Enabled != nil && *req.Enabled && len(globalSettings.APITokens) == 0 {
+		// Nobody could use the API anymore
+		apiError(w, http.StatusConflict, "create a token before enabling the authentication")
+		return
+	}
+	if req.Enabled != nil {
+		globalSettings.APIAuthEnabled = *req.Enabled
+	}
+	if req.LegacyOpen != nil {
+		globalSettings.APILegacyOpen = *req.LegacyOpen
+	}
+	saveSettings()
+	logInfof("api", "authentication %t, legacy endpoints open %t (%s)", globalSettings.APIAuthEnabled, globalSettings.APILegacyOpen, r.RemoteAddr)
+	handleAPIAuthGetRequest(w, r)
+}
+
+func handleAPITokenCreateRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if len(req.Name) == 0 || strings.Contains(req.Name, "/") {
+		apiError(w, http.StatusBadRequest, "invalid token name")
+		return
+	}
+	for _, t := range globalSettings.APITokens {
+		if t.Name == req.Name {
+			apiError(w, http.StatusConflict, "a token with this name exists")
+			return
+		}
+	}
+	raw := make([]byte, API_TOKEN_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	created := time.Now().UTC()
+	globalSettings.APITokens = append(globalSettings.APITokens, APIToken{req.Name, apiTokenHash(token), created})
+	saveSettings()
+	logInfof("api", "token '%s' created (%s)", req.Name, r.RemoteAddr)
+
+	setNoCache(w)
+	setJSONHeaders(w)
+	tokenJSON, _ := json.Marshal(map[string]interface{}{"Name": req.Name, "Token": token, "Created": created})
+	fmt.Fprintf(w, "%s\n", tokenJSON)
+}
+
+func handleAPITokenDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, API_PREFIX), "/"), "/auth/tokens/")
+	tokens := make([]APIToken, 0, len(globalSettings.APITokens))
+	for _, t := range globalSettings.APITokens {
+		if t.Name != name {
+			tokens = append(tokens, t)
+		}
+	}
+	if len(tokens) == len(globalSettings.APITokens) {
+		apiError(w, http.StatusNotFound, "no token with this name")
+		return
+	}
+	if len(tokens) == 0 && globalSettings.APIAuthEnabled {
+		apiError(w, http.StatusConflict, "disable the authentication before deleting the last token")
+		return
+	}
+	globalSettings.APITokens = tokens
+	saveSettings()
+	logInfof("api", "token '%s' deleted (%s)", name, r.RemoteAddr)
+	handleAPIAuthGetRequest(w, r)
+}
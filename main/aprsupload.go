@@ -0,0 +1,251 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	aprsupload.go: Forwarding of the OGN/FLARM traffic received by ogn-rx-eu to the OGN APRS network (glidernet), so a
+		Stratux at a gliderport works as OGN ground station (globalSettings.APRSUpload). Uses the APRS-IS connection
+		of ogn-aprs.go, logged in as globalSettings.APRSStationName (default "Stx" and the end of the CPU serial).
+		OGN ground stations are fixed receivers, so nothing is uploaded unless the Stratux is at rest on the ground
+		(see isAprsStationFixed()), not in flight or while taxiing.
+		The station sends its position and status every APRS_UPLOAD_BEACON_INTERVAL. Aircraft are sent at most every
+		APRS_UPLOAD_MIN_INTERVAL, aircraft with no-track in the OGN DDB never, and our own tracker only without the
+		no-track setting. Stealth is left to the servers, which know the flag from the DDB as well.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	APRS_UPLOAD_MIN_INTERVAL    = 5 * time.Second // per aircraft
+	APRS_UPLOAD_BEACON_INTERVAL = 5 * time.Minute // station position and status
+	APRS_UPLOAD_MAX_SPEED       = 2.0             // kt, GPS ground speed of a station at rest ...
+	APRS_UPLOAD_STATION_RADIUS  = 50.0            // m, ... that stays this close to the same position ...
+	APRS_UPLOAD_STATION_TIME    = 2 * time.Minute // ... for this long
+)
+
+var aprsStationNameRegex = regexp.MustCompile(`^[A-Za-z0-9]{3,9}$`)
+
+// APRS symbol (table and code) of the OGN aircraft types 0-15.
+var aprsAircraftSymbols = []string{"/z", "/'", "/'", "/X", "/g", "\\^", "/g", "/g", "\\^", "\\^", "/z", "/O", "/O", "\\^", "/z", "\\n"}
+
+// Address type to the APRS source prefix.
+var aprsAddressPrefixes = []string{"RND", "ICA", "FLR", "OGN"}
+
+var aprsUploadLast = make(map[string]time.Time) // stratuxClock, by source
+var aprsUploadLoggedIn string                   // station name of the current login, "" = read only
+var aprsStationLat, aprsStationLng float64      // position the station came to rest at ...
+var aprsStationSince time.Time                  // ... at this stratuxClock time, zero = moving
+var aprsStationWasFixed bool
+var aprsUploadMutex sync.Mutex
+
+// Station name to log in with, "" if uploading is off or there is no valid name.
+func aprsStationName() string {
+	if !globalSettings.APRSUpload {
+		return ""
+	}
+	name := strings.TrimSpace(globalSettings.APRSStationName)
+	if len(name) == 0 {
+		if serial := foreFlightSerial(); serial != FF_SERIAL_INVALID {
+			name = fmt.Sprintf("Stx%06X", serial&0xFFFFFF)
+		}
+	}
+	if !aprsStationNameRegex.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// APRS-IS passcode of a callsign, the usual hash of the upper case call without SSID.
+func aprsPasscode(call string) int {
+	call = strings.ToUpper(strings.SplitN(call, "-", 2)[0])
+	hash := 0x73e2
+	for i := 0; i < len(call); i += 2 {
+		hash ^= int(call[i]) << 8
+		if i+1 < len(call) {
+			hash ^= int(call[i+1])
+		}
+	}
+	return hash & 0x7fff
+}
+
+func isAprsUploading() bool {
+	aprsUploadMutex.Lock()
+	defer aprsUploadMutex.Unlock()
+	return globalStatus.APRS_connected && len(aprsUploadLoggedIn) > 0 && aprsUploadLoggedIn == aprsStationName()
+}
+
+/*
+	isAprsStationFixed().
+		The station has been within APRS_UPLOAD_STATION_RADIUS of the same position, slower than APRS_UPLOAD_MAX_SPEED,
+		for APRS_UPLOAD_STATION_TIME. Requires aprsUploadMutex.
+*/
+func isAprsStationFixed() bool {
+	fixed := false
+	if isGPSValid() && mySituation.GPSGroundSpeed < APRS_UPLOAD_MAX_SPEED {
+		lat, lng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+		if !aprsStationSince.IsZero() {
+			if dist, _, _, _ := common.DistRect(aprsStationLat, aprsStationLng, lat, lng); dist > APRS_UPLOAD_STATION_RADIUS {
+				aprsStationSince = time.Time{}
+			}
+		}
+		if aprsStationSince.IsZero() {
+			aprsStationLat, aprsStationLng, aprsStationSince = lat, lng, stratuxClock.Time
+		}
+		fixed = stratuxClock.Since(aprsStationSince) >= APRS_UPLOAD_STATION_TIME
+	} else {
+		aprsStationSince = time.Time{}
+	}
+	if fixed != aprsStationWasFixed {
+		aprsStationWasFixed = fixed
+		if fixed {
+			logInfof("aprs", "station at rest, uploading to the OGN network")
+		} else {
+			logInfof("aprs", "station moving or no GPS fix, OGN upload paused")
+		}
+	}
+	return fixed
+}
+
+// "hhmmssh" of t.
+func aprsTimestamp(t time.Time) string {
+	return t.UTC().Format("150405") + "h"
+}
+
+// APRS latitude/longitude with 2 decimals of minutes, plus the third decimal digits for the !Wxy! extension.
+func aprsPosition(lat, lng float64) (latStr, lngStr string, latDigit, lngDigit int) {
+	ns, ew := "N", "E"
+	if lat < 0 {
+		lat, ns = -lat, "S"
+	}
+	if lng < 0 {
+		lng, ew = -lng, "W"
+	}
+	latMin := math.Round((lat-math.Floor(lat))*60*1000) / 1000
+	lngMin := math.Round((lng-math.Floor(lng))*60*1000) / 1000
+	latDeg, lngDeg := math.Floor(lat), math.Floor(lng)
+	if latMin >= 60 {
+		latDeg, latMin = latDeg+1, latMin-60
+	}
+	if lngMin >= 60 {
+		lngDeg, lngMin = lngDeg+1, lngMin-60
+	}
+	latDigit = int(math.Round(latMin*1000)) % 10
+	lngDigit = int(math.Round(lngMin*1000)) % 10
+	latStr = fmt.Sprintf("%02.0f%05.2f%s", latDeg, math.Floor(latMin*100)/100, ns)
+	lngStr = fmt.Sprintf("%03.0f%05.2f%s", lngDeg, math.Floor(lngMin*100)/100, ew)
+	return
+}
+
+// OGN aircraft type of ogn-rx-eu's acft_type, 0 (unknown) if it can't be parsed.
+func ognAircraftType(s string) int {
+	t, err := strconv.ParseUint(s, 16, 8)
+	if err != nil || t > 15 {
+		t, err = strconv.ParseUint(s, 10, 8)
+	}
+	if err != nil || t > 15 {
+		return 0
+	}
+	return int(t)
+}
+
+/*
+	makeAprsAircraftBeacon().
+		FLRDDA5BA>APRS,qAS,Station:/074548h5111.32N/00102.04W'086/007/A=000607 !W80! id0ADDA5BA +020fpm +0.0rot 5.5dB
+*/
+func makeAprsAircraftBeacon(msg OgnMessage, station string) string {
+	acftType := ognAircraftType(msg.Acft_type)
+	addrType := int(msg.Addr_type) & 0x03
+	symbol := aprsAircraftSymbols[acftType]
+	lat, lng, latDigit, lngDigit := aprsPosition(float64(msg.Lat_deg), float64(msg.Lon_deg))
+	ts := time.Now()
+	if msg.Time > 0 {
+		ts = time.Unix(msg.Time, 0)
+	}
+	id := acftType<<2 | addrType
+	return fmt.Sprintf("%s%s>APRS,qAS,%s:/%s%s%c%s%c%03d/%03d/A=%06d !W%d%d! id%02X%s %+04.0ffpm %+.1frot %.1fdB\r\n",
+		aprsAddressPrefixes[addrType], strings.ToUpper(msg.Addr), station, aprsTimestamp(ts), lat, symbol[0], lng, symbol[1],
+		int(math.Round(msg.Track_deg))%360, int(math.Round(msg.Speed_mps/0.514444)), int(math.Round(float64(msg.Alt_msl_m)*3.28084)),
+		latDigit, lngDigit, id, strings.ToUpper(msg.Addr), msg.Climb_mps*196.85, msg.Turn_dps/3, msg.SNR_dB)
+}
+
+// Position and status of the station, "" without GPS fix.
+func makeAprsReceiverBeacons(station string) string {
+	if !isGPSValid() {
+		return ""
+	}
+	now := time.Now()
+	lat, lng, _, _ := aprsPosition(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude))
+	return fmt.Sprintf("%s>OGNSDR,TCPIP*:/%s%sI%s&/A=%06d\r\n", station, aprsTimestamp(now), lat, lng, int(mySituation.GPSAltitudeMSL)) +
+		fmt.Sprintf("%s>OGNSDR,TCPIP*:>%s %s.stratux\r\n", station, aprsTimestamp(now), globalStatus.Version)
+}
+
+/*
+	uploadOgnAprs().
+		Called for every aircraft received by ogn-rx-eu, see processOgnMessage().
+*/
+func uploadOgnAprs(msg OgnMessage) {
+	if !isAprsUploading() || isFlightReplayRunning() || (msg.Lat_deg == 0 && msg.Lon_deg == 0) || len(msg.Addr) != 6 {
+		return
+	}
+	if isOgnNoTrack(msg.Addr) {
+		return // owner opted out of tracking in the OGN DDB
+	}
+	if strings.EqualFold(msg.Addr, globalSettings.OGNAddr) && globalSettings.OGNNoTrack {
+		return // our own tracker
+	}
+	key := fmt.Sprintf("%d%s", msg.Addr_type, strings.ToUpper(msg.Addr))
+	aprsUploadMutex.Lock()
+	if !isAprsStationFixed() {
+		aprsUploadMutex.Unlock()
+		return
+	}
+	if last, ok := aprsUploadLast[key]; ok && stratuxClock.Since(last) < APRS_UPLOAD_MIN_INTERVAL {
+		aprsUploadMutex.Unlock()
+		return // the same packet via several paths, or a fast sender
+	}
+	aprsUploadLast[key] = stratuxClock.Time
+	station := aprsUploadLoggedIn
+	aprsUploadMutex.Unlock()
+
+	select {
+	case aprsOutgoingMsgChan <- makeAprsAircraftBeacon(msg, station):
+		globalStatus.APRS_uploaded++
+	default:
+		logWarnf("aprs", "upload queue full, dropping %s", key)
+	}
+}
+
+// Sends the station beacons and forgets aircraft not heard for a while. Called from aprsListen().
+func sendAprsReceiverBeacons() {
+	aprsUploadMutex.Lock()
+	for key, last := range aprsUploadLast {
+		if stratuxClock.Since(last) > time.Minute {
+			delete(aprsUploadLast, key)
+		}
+	}
+	station := aprsUploadLoggedIn
+	fixed := isAprsStationFixed()
+	aprsUploadMutex.Unlock()
+	if !fixed {
+		return
+	}
+	if beacons := makeAprsReceiverBeacons(station); len(beacons) > 0 {
+		select {
+		case aprsOutgoingMsgChan <- beacons:
+		default:
+		}
+	}
+}
@@ -0,0 +1,239 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	audio.go: Audio traffic alerts for flying without an EFB display. Alert escalations (see trafficalerts.go) of
+		at least globalSettings.AudioAlertLevel are announced as speech, e.g. "traffic, two o'clock, high, two miles"
+		(espeak-ng), or as chimes (one to three beeps by alert level). The sound is played with aplay on
+		globalSettings.AudioDevice: any ALSA device, e.g. "plughw:1,0" for a USB sound card or
+		"bluealsa:DEV=<MAC>,PROFILE=a2dp" for a paired Bluetooth headset/speaker (bluez-alsa).
+		Announcements are muted while the switch on GPIO globalSettings.AudioMutePin (BCM, to ground) is closed.
+		The ALSA playback is in audio_alsa.go, builds with -tags nohw use the silent stub in audio_nohw.go.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIO_VERBOSITY_SHORT = 0 // "traffic"
+	AUDIO_VERBOSITY_CLOCK = 1 // "traffic, two o'clock"
+	AUDIO_VERBOSITY_FULL  = 2 // "traffic, two o'clock, high, two miles"
+
+	AUDIO_REPEAT_HOLD  = 20 * time.Second // same target and level are not announced again within this time
+	AUDIO_MAX_DELAY    = 5 * time.Second  // alerts that waited longer for the speaker are dropped
+	AUDIO_VERTICAL_FT  = 300              // ft, "high"/"low" beyond this vertical separation
+	AUDIO_SAMPLE_RATE  = 22050
+	AUDIO_CHIME_LENGTH = 150 * time.Millisecond
+)
+
+var audioNumbers = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+	"eleven", "twelve"}
+
+type audioAlert struct {
+	alert    TrafficAlert
+	received time.Time
+}
+
+var audioQueue = make(chan audioAlert, 8)
+var audioMutex = &sync.Mutex{} // one sound at a time
+
+// Queues an alert level change for announcement if it is an escalation to an announced level. Never blocks.
+func queueAudioAlert(alert TrafficAlert) {
+	if !globalSettings.AudioAlerts || alert.Level <= alert.PrevLevel || int(alert.Level) < globalSettings.AudioAlertLevel {
+		return
+	}
+	select {
+	case audioQueue <- audioAlert{alert, stratuxClock.Time}:
+	default:
+	}
+}
+
+func audioNumber(n int) string {
+	if n >= 0 && n < len(audioNumbers) {
+		return audioNumbers[n]
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// Text of the announcement of an alert.
+func trafficCallout(a TrafficAlert, verbosity int) string {
+	parts := []string{"traffic"}
+	if a.Level >= TRAFFIC_ALERT_WARNING {
+		parts = append(parts, "traffic")
+	}
+	if verbosity >= AUDIO_VERBOSITY_CLOCK && a.BearingDist_valid && isGPSGroundTrackValid() {
+		rel := math.Mod(a.Bearing-float64(mySituation.GPSTrueCourse)+720, 360)
+		clock := int(rel/30+0.5) % 12
+		if clock == 0 {
+			clock = 12
+		}
+		parts = append(parts, audioNumber(clock)+" o'clock")
+	}
+	if verbosity >= AUDIO_VERBOSITY_FULL {
+		relVert := float64(a.RelativeVertical) / 0.3048
+		if relVert > AUDIO_VERTICAL_FT {
+			parts = append(parts, "high")
+		} else if relVert < -AUDIO_VERTICAL_FT {
+			parts = append(parts, "low")
+		} else {
+			parts = append(parts, "same altitude")
+		}
+		nm := int(a.Distance/1852 + 0.5)
+		switch {
+		case a.Distance < 1852:
+			parts = append(parts, "less than a mile")
+		case nm == 1:
+			parts = append(parts, "one mile")
+		default:
+			parts = append(parts, audioNumber(nm)+" miles")
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Canonical 16 bit mono PCM WAV header.
+func makeWavHeader(dataLen int) []byte {
+	h := make([]byte, 44)
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+dataLen))
+	copy(h[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 1) // mono
+	binary.LittleEndian.PutUint32(h[24:], AUDIO_SAMPLE_RATE)
+	binary.LittleEndian.PutUint32(h[28:], AUDIO_SAMPLE_RATE*2)
+	binary.LittleEndian.PutUint16(h[32:], 2)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(dataLen))
+	return h
+}
+
+// One beep per alert level, higher pitched for warnings.
+func chimeWav(level uint8) []byte {
+	freq := 880.0
+	if level >= TRAFFIC_ALERT_WARNING {
+		freq = 1320.0
+	}
+	tone := int(AUDIO_CHIME_LENGTH.Seconds() * AUDIO_SAMPLE_RATE)
+	pcm := make([]byte, 0, int(level)*tone*4)
+	for b := 0; b < int(level); b++ {
+		for i := 0; i < 2*tone; i++ {
+			var v int16
+			if i < tone {
+				fade := math.Min(1, math.Min(float64(i), float64(tone-i))/200) // no clicks
+				v = int16(math.Sin(2*math.Pi*freq*float64(i)/AUDIO_SAMPLE_RATE) * fade * 16000)
+			}
+			pcm = append(pcm, byte(v), byte(uint16(v)>>8))
+		}
+	}
+	return append(makeWavHeader(len(pcm)), pcm...)
+}
+
+func speechWav(text string) ([]byte, error) {
+	for _, tts := range []string{"espeak-ng", "espeak"} {
+		if path, err := exec.LookPath(tts); err == nil {
+			return exec.Command(path, "--stdout", "-s", "160", text).Output()
+		}
+	}
+	return nil, errors.New("espeak-ng not installed")
+}
+
+// Scales the samples of a 16 bit PCM WAV in place. espeak streams with an unknown data length, so the data chunk is
+// cut at the end of the buffer.
+func setWavVolume(wav []byte, percent int) {
+	bits := 0
+	for pos := 12; pos+8 <= len(wav); {
+		id := string(wav[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(wav[pos+4:]))
+		if size < 0 {
+			size = len(wav) // unknown length (int is 32 bit on the Pi)
+		}
+		body := pos + 8
+		if id == "fmt " && body+16 <= len(wav) {
+			bits = int(binary.LittleEndian.Uint16(wav[body+14:]))
+		}
+		if id == "data" {
+			if bits != 16 {
+				return
+			}
+			end := len(wav)
+			if body+size < end {
+				end = body + size
+			}
+			for i := body; i+1 < end; i += 2 {
+				v := float64(int16(binary.LittleEndian.Uint16(wav[i:]))) * float64(percent) / 100
+				v = math.Max(math.Min(v, math.MaxInt16), math.MinInt16)
+				binary.LittleEndian.PutUint16(wav[i:], uint16(int16(v)))
+			}
+			return
+		}
+		pos = body + size + size%2
+	}
+}
+
+// Plays an announcement, text is spoken unless chimes are configured.
+func playAnnouncement(text string, level uint8) {
+	audioMutex.Lock()
+	defer audioMutex.Unlock()
+	var wav []byte
+	var err error
+	if globalSettings.AudioChimes {
+		wav = chimeWav(level)
+	} else {
+		wav, err = speechWav(text)
+	}
+	if err == nil {
+		err = playWav(wav)
+	}
+	if err != nil {
+		logInfof("audio", "Audio alert: %s", err)
+		addSingleSystemErrorf("audio", "Audio alerts: %s", err)
+		return
+	}
+	removeSingleSystemError("audio")
+}
+
+func audioAnnouncer() {
+	announced := make(map[uint32]audioAlert)
+	for {
+		a := <-audioQueue
+		// Catch up: only the most severe of the pending alerts is announced
+		for pending := true; pending; {
+			select {
+			case b := <-audioQueue:
+				if b.alert.Level >= a.alert.Level {
+					a = b
+				}
+			default:
+				pending = false
+			}
+		}
+		if stratuxClock.Since(a.received) > AUDIO_MAX_DELAY || gpioSwitchClosed(globalSettings.AudioMutePin) {
+			continue
+		}
+		if last, ok := announced[a.alert.Icao_addr]; ok && last.alert.Level >= a.alert.Level &&
+			stratuxClock.Since(last.received) < AUDIO_REPEAT_HOLD {
+			continue
+		}
+		for addr, last := range announced {
+			if stratuxClock.Since(last.received) >= AUDIO_REPEAT_HOLD {
+				delete(announced, addr)
+			}
+		}
+		announced[a.alert.Icao_addr] = a
+		playAnnouncement(trafficCallout(a.alert, globalSettings.AudioVerbosity), a.alert.Level)
+	}
+}
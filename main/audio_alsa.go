@@ -0,0 +1,39 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	audio_alsa.go: Plays the audio alert and vario sounds on the ALSA device globalSettings.AudioDevice (aplay).
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func playWav(wav []byte) error {
+	aplay, err := exec.LookPath("aplay")
+	if err != nil {
+		return errors.New("aplay not installed")
+	}
+	setWavVolume(wav, globalSettings.AudioVolume)
+	args := []string{"-q"}
+	if len(globalSettings.AudioDevice) > 0 {
+		args = append(args, "-D", globalSettings.AudioDevice)
+	}
+	cmd := exec.Command(aplay, append(args, "-")...)
+	cmd.Stdin = bytes.NewReader(wav)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
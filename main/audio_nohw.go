@@ -0,0 +1,21 @@
+//go:build nohw
+// +build nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	audio_nohw.go: Audio stub for builds without hardware support (-tags nohw), no ALSA playback.
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+func playWav(wav []byte) error {
+	return errors.New("built without audio support (nohw)")
+}
@@ -0,0 +1,103 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	autopilot.go: EXPERIMENTAL attitude and track error output for experimental autopilot projects (e.g. homebuilt
+		wing levelers). NOT certified, NOT for use as a primary means of control.
+
+		Sent 10 times per second to serial outputs with the NETWORK_AUTOPILOT capability (/dev/serialout_ap*), as
+			$PSTXA,<roll>,<pitch>,<track error>,<track>,<desired track>,<valid>*CS
+		roll/pitch in degrees (right wing down / nose up positive), track values in degrees true, track error in
+		-180..180 (positive = turn right to correct), valid = A (attitude and track valid), T (attitude only) or V.
+
+		Safety interlock: nothing is sent unless globalSettings.AutopilotOutput is on AND the physical enable switch on
+		GPIO globalSettings.AutopilotEnablePin (BCM numbering, switch to ground) is closed. The desired track is the
+		GPS track at the time the switch was closed. Opening the switch stops the output immediately, and the
+		receiving side has to treat missing sentences as disengage.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	AUTOPILOT_RATE     = 100 * time.Millisecond
+	AUTOPILOT_DEBOUNCE = 3 // consecutive closed readings before the switch counts as closed
+)
+
+func autopilotSwitchClosed() bool {
+	return gpioSwitchClosed(globalSettings.AutopilotEnablePin)
+}
+
+// Track error (deg, -180..180) from the current to the desired track. Positive = turn right.
+func trackError(track, desired float64) float64 {
+	return math.Mod(desired-track+540, 360) - 180
+}
+
+func makeAutopilotSentence(desiredTrack float64) string {
+	mySituation.muAttitude.Lock()
+	roll, pitch := mySituation.AHRSRoll, mySituation.AHRSPitch
+	mySituation.muAttitude.Unlock()
+	mySituation.muGPS.Lock()
+	track := float64(mySituation.GPSTrueCourse)
+	mySituation.muGPS.Unlock()
+
+	trackValid := isGPSGroundTrackValid() && mySituation.GPSGroundSpeed >= 30
+	valid := "V"
+	if isAHRSValid() {
+		valid = "T"
+		if trackValid {
+			valid = "A"
+		}
+	}
+	if valid == "V" {
+		return appendNmeaChecksum("$PSTXA,,,,,,V")
+	}
+	if !trackValid {
+		return appendNmeaChecksum(fmt.Sprintf("$PSTXA,%.1f,%.1f,,,,%s", roll, pitch, valid))
+	}
+	return appendNmeaChecksum(fmt.Sprintf("$PSTXA,%.1f,%.1f,%.1f,%.1f,%.1f,%s", roll, pitch,
+		trackError(track, desiredTrack), track, desiredTrack, valid))
+}
+
+func autopilotSender() {
+	ticker := time.NewTicker(AUTOPILOT_RATE)
+	closedCount := 0
+	engaged := false
+	desiredTrack := 0.0
+	for {
+		<-ticker.C
+		if !globalSettings.AutopilotOutput {
+			closedCount = 0
+			engaged = false
+			globalStatus.Autopilot_status = ""
+			continue
+		}
+		if autopilotSwitchClosed() {
+			closedCount++
+		} else {
+			closedCount = 0
+		}
+		if closedCount < AUTOPILOT_DEBOUNCE {
+			if engaged {
+				logInfof("autopilot", "autopilot output: enable switch opened, output stopped")
+			}
+			engaged = false
+			globalStatus.Autopilot_status = "interlock open"
+			continue
+		}
+		if !engaged {
+			engaged = true
+			desiredTrack = float64(mySituation.GPSTrueCourse)
+			logInfof("autopilot", "autopilot output: enable switch closed, desired track %.0f", desiredTrack)
+		}
+		globalStatus.Autopilot_status = fmt.Sprintf("active, desired track %.0f", desiredTrack)
+		sendMsg([]byte(makeAutopilotSentence(desiredTrack)+"\r\n"), NETWORK_AUTOPILOT, AUTOPILOT_RATE, MSGPRIO_AUX)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	beastoutput.go: Beast binary output of all received 1090 frames on TCP port globalSettings.BeastOutputPort
+		(default 30005, 0 = disabled), for FlightAware/adsbexchange/... feed clients and MLAT.
+		The frames come from the Beast outputs of our dump1090 instances (local or remote dongle, network input, see
+		esinput.go) and keep dump1090's 12MHz timestamps and signal levels. They are sent as whole frames to the clients
+		(NETWORK_BEAST capability), so frames of different sources never get mixed up. The raw RF capture of 1090
+		(rfcapture.go) reads its frames here as well.
+*/
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	ES_BEAST_PORT       = 30105 // Beast output of the dump1090 of the 1090 dongle, local only
+	ES_INPUT_BEAST_OUT  = 30115 // same for the network input
+	BEAST_ESCAPE        = 0x1a
+	BEAST_FRAME_MAX_AGE = 2 * time.Second
+)
+
+// Reads the next Beast frame from r, as it was on the wire (escaped, starting with 0x1a).
+func readBeastFrame(r *bufio.Reader) ([]byte, error) {
+	started := false // 0x1a of the frame start already read
+	for {
+		if !started {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if b != BEAST_ESCAPE {
+				continue // resync
+			}
+		}
+		started = false
+		t, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		var msgLen int
+		switch t {
+		case '1': // Mode A/C
+			msgLen = 2
+		case '2': // Mode S short
+			msgLen = 7
+		case '3': // Mode S long
+			msgLen = 14
+		default:
+			continue
+		}
+
+		frame := make([]byte, 2, 2+2*(6+1+msgLen))
+		frame[0], frame[1] = BEAST_ESCAPE, t
+		complete := true
+		for i := 0; i < 6+1+msgLen; i++ { // timestamp, signal level, message
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			frame = append(frame, b)
+			if b == BEAST_ESCAPE {
+				next, err := r.ReadByte()
+				if err != nil {
+					return nil, err
+				}
+				if next != BEAST_ESCAPE { // start of the next frame, this one is broken
+					complete, started = false, true
+					r.UnreadByte()
+					break
+				}
+				frame = append(frame, BEAST_ESCAPE)
+			}
+		}
+		if complete {
+			return frame, nil
+		}
+	}
+}
+
+// Relays the frames of the dump1090 Beast output on port to the clients and the RF capture while either is enabled.
+func beastSource(port int) {
+	addr := "127.0.0.1:" + strconv.Itoa(port)
+	for {
+		time.Sleep(1 * time.Second)
+		if globalSettings.BeastOutputPort == 0 && !globalSettings.RFCaptureES {
+			continue
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			continue // dump1090 not running
+		}
+		rdr := bufio.NewReader(conn)
+		for globalSettings.BeastOutputPort != 0 || globalSettings.RFCaptureES {
+			frame, err := readBeastFrame(rdr)
+			if err != nil {
+				break
+			}
+			if globalSettings.BeastOutputPort != 0 {
+				sendMsg(frame, NETWORK_BEAST, BEAST_FRAME_MAX_AGE, MSGPRIO_FEED)
+			}
+			if avr, rssi := beastFrameAVR(frame); len(avr) > 0 {
+				captureRF(RF_CAPTURE_ES, rssi, avr)
+			}
+		}
+		conn.Close()
+	}
+}
+
+// Beast output on globalSettings.BeastOutputPort, fed by the dump1090 Beast outputs.
+func beastOutputListener() {
+	go beastSource(ES_BEAST_PORT)
+	go beastSource(ES_INPUT_BEAST_OUT)
+	tcpOutputListener("Beast output", func() int { return globalSettings.BeastOutputPort }, NETWORK_BEAST, 4096)
+}
@@ -0,0 +1,302 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	benchmark_test.go: Benchmarks of the decode -> traffic -> output pipeline, run with
+			go test -tags nohw -run '^$' -bench . -benchmem ./main/ [-args -bench-uat <file> -bench-es <file>]
+		or "make bench". Recorded messages are pushed through the pipeline as fast as possible, without any
+		hardware or network clients, so it runs on the target hardware as well as on a development machine.
+
+		-bench-uat: UAT replay log ("<tick>,<message>" lines, .gz ok), default the one in test-data/.
+		-bench-es:  1090ES replay log, default the one in test-data/. Either "<tick>,MSG,..." SBS lines as in
+		            test-data/ or dump1090 port 30006 messages, one JSON object per line, e.g. exported with
+		            sqlite3 /var/log/stratux.sqlite "SELECT Data FROM es_messages" > es.log
+
+		The traffic-output benchmark (one sendTrafficUpdates() cycle over the traffic table built from both logs)
+		is reported per update.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var benchUATFilename = flag.String("bench-uat", "../test-data/cyoung-09062015-noproblem-stratux-uat.log", "UAT replay log for the benchmarks")
+var benchESFilename = flag.String("bench-es", "../test-data/cyoung-09062015-noproblem-stratux-es.log", "1090ES replay log for the benchmarks")
+
+var benchmarkInit sync.Once
+
+// Reads the UAT messages of a replay log in the format parseInput() expects.
+func readBenchmarkUATLog(b *testing.B, fn string) []string {
+	f := openReplayFile(fn)
+	defer f.Close()
+	msgs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		linesplit := strings.Split(scanner.Text(), ",")
+		if len(linesplit) < 2 || linesplit[0] == "START" {
+			continue
+		}
+		msgs = append(msgs, strings.Trim(linesplit[1], " ;\r\n")+";\n")
+	}
+	if len(msgs) == 0 {
+		b.Skipf("%s: no UAT messages", fn)
+	}
+	return msgs
+}
+
+// Reads the 1090ES messages of a replay log in the format processDump1090Message() expects.
+func readBenchmarkESLog(b *testing.B, fn string) []string {
+	f := openReplayFile(fn)
+	defer f.Close()
+	msgs := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "{") {
+			msgs = append(msgs, line)
+		} else if msg, ok := sbsToDump1090(line); ok {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) == 0 {
+		b.Skipf("%s: no 1090ES messages", fn)
+	}
+	return msgs
+}
+
+/*
+sbsToDump1090().
+
+	"<tick>,MSG,<type>,,,<hex>,,,,,,<callsign>,<alt>,<speed>,<track>,<lat>,<lng>,<vvel>,<squawk>,,,,<ground>" of the
+	old replay logs to the JSON of dump1090 port 30006.
+*/
+func sbsToDump1090(line string) (string, bool) {
+	f := strings.Split(line, ",")
+	if len(f) < 18 || f[1] != "MSG" {
+		return "", false
+	}
+	icao, err := strconv.ParseUint(f[5], 16, 32)
+	if err != nil {
+		return "", false
+	}
+	var d dump1090Data
+	d.Icao_addr = uint32(icao)
+	d.DF = 17
+	d.SBS_MsgType, _ = strconv.Atoi(f[2])
+	if callsign := strings.TrimSpace(f[11]); len(callsign) > 0 {
+		d.Tail = &callsign
+	}
+	if alt, err := strconv.Atoi(f[12]); err == nil {
+		d.Alt = &alt
+	}
+	speed, errSpeed := strconv.ParseUint(f[13], 10, 16)
+	track, errTrack := strconv.ParseUint(f[14], 10, 16)
+	if errSpeed == nil && errTrack == nil {
+		s, t := uint16(speed), uint16(track)
+		d.Speed, d.Track, d.Speed_valid = &s, &t, true
+	}
+	lat, errLat := strconv.ParseFloat(f[15], 32)
+	lng, errLng := strconv.ParseFloat(f[16], 32)
+	if errLat == nil && errLng == nil {
+		la, ln := float32(lat), float32(lng)
+		d.Lat, d.Lng, d.Position_valid = &la, &ln, true
+	}
+	if vvel, err := strconv.ParseInt(f[17], 10, 16); err == nil {
+		v := int16(vvel)
+		d.Vvel = &v
+	}
+	if len(f) > 18 {
+		if squawk, err := strconv.Atoi(f[18]); err == nil {
+			d.Squawk = &squawk
+		}
+	}
+	if len(f) > 22 && len(f[22]) > 0 {
+		onGround := f[22] != "0"
+		d.OnGround = &onGround
+	}
+	buf, err := json.Marshal(&d)
+	return string(buf), err == nil
+}
+
+// Minimal state for the pipeline: default settings, traffic table, one UDP client on the loopback interface.
+func initBenchmark() {
+	benchmarkInit.Do(func() {
+		stratuxClock = NewMonotonic()
+		mySituation.muGPS = &sync.Mutex{}
+		mySituation.muGPSPerformance = &sync.Mutex{}
+		mySituation.muAttitude = &sync.Mutex{}
+		mySituation.muBaro = &sync.Mutex{}
+		mySituation.muSatellite = &sync.Mutex{}
+		systemErrsMutex = &sync.Mutex{}
+		systemErrs = make(map[string]string)
+		defaultSettings()
+		globalSettings.ReplayLog = false
+		globalSettings.DEBUG = false
+		globalSettings.NoSleep = true
+		globalSettings.LogLevel = "error"
+		applyLogLevels()
+
+		ADSBTowers = make(map[string]ADSBTower)
+		ADSBTowerMutex = &sync.Mutex{}
+		msgLog = make([]msg, 0)
+		crcInit()
+
+		traffic = make(map[uint32]TrafficInfo)
+		seenTraffic = make(map[uint32]bool)
+		trafficMutex = &sync.Mutex{}
+
+		netMutex = &sync.Mutex{}
+		networkGDL90Chan = make(chan []byte, 1024)
+		clientConnections = make(map[string]connection)
+		go func() {
+			for range networkGDL90Chan {
+			}
+		}()
+		addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:4000")
+		if conn, err := net.DialUDP("udp", nil, addr); err == nil {
+			client := &networkConnection{Conn: conn, Ip: "127.0.0.1", Port: 4000,
+				Capability: NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90, Queue: NewMessageQueue(1024)}
+			clientConnections[client.GetConnectionKey()] = client
+			go connectionWriter(client)
+		}
+	})
+}
+
+// Runs fn for every message, cycling through msgs. msgLog is trimmed like updateMessageStats() would.
+func benchmarkMessages(b *testing.B, msgs []string, fn func(string)) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fn(msgs[i%len(msgs)])
+		if i%10000 == 9999 {
+			msgLogMutex.Lock()
+			msgLog = msgLog[:0]
+			msgLogMutex.Unlock()
+		}
+	}
+}
+
+func relayUATMessage(m string) {
+	if o, msgtype := parseInput(m); o != nil && msgtype != 0 {
+		relayMessage(msgtype, o)
+	}
+}
+
+// Number of targets in the traffic table last received from the given source.
+func countTrafficBySource(source uint8) int {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	n := 0
+	for _, ti := range traffic {
+		if ti.Last_source == source {
+			n++
+		}
+	}
+	return n
+}
+
+// Every uplink ('+') must decode as an uplink and every downlink ('-') as a basic or long report.
+func checkUATDecode(b *testing.B, msgs []string) {
+	for _, m := range msgs {
+		o, msgtype := parseInput(m)
+		want := uint16(MSGTYPE_UPLINK)
+		if m[0] == '-' {
+			want = MSGTYPE_LONG_REPORT
+			if msgtype == MSGTYPE_BASIC_REPORT {
+				want = MSGTYPE_BASIC_REPORT
+			}
+		} else if m[0] != '+' {
+			continue
+		}
+		if o == nil || msgtype != want {
+			b.Fatalf("%s: decoded as type %#x, want %#x", strings.TrimSpace(m), msgtype, want)
+		}
+	}
+}
+
+// After one pass over the log, every target must be in the traffic table at the last position the log reported.
+func checkESTraffic(b *testing.B, msgs []string) {
+	last := make(map[uint32][2]float32)
+	for _, m := range msgs {
+		processDump1090Message(m)
+		var d dump1090Data
+		if json.Unmarshal([]byte(m), &d) == nil && d.Position_valid && d.Lat != nil && d.Lng != nil {
+			last[d.Icao_addr] = [2]float32{*d.Lat, *d.Lng}
+		}
+	}
+	if len(last) == 0 {
+		b.Skip("no 1090ES positions in the replay log")
+	}
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	for icao, pos := range last {
+		ti, ok := traffic[icao]
+		if !ok {
+			b.Fatalf("%06X: not in the traffic table", icao)
+		}
+		if !ti.Position_valid || ti.Lat != pos[0] || ti.Lng != pos[1] {
+			b.Fatalf("%06X: position %f,%f (valid %t), want %f,%f", icao, ti.Lat, ti.Lng, ti.Position_valid, pos[0], pos[1])
+		}
+	}
+}
+
+func BenchmarkUATDecode(b *testing.B) {
+	initBenchmark()
+	msgs := readBenchmarkUATLog(b, *benchUATFilename)
+	checkUATDecode(b, msgs)
+	benchmarkMessages(b, msgs, func(m string) {
+		parseInput(m)
+	})
+}
+
+func BenchmarkUATPipeline(b *testing.B) {
+	initBenchmark()
+	msgs := readBenchmarkUATLog(b, *benchUATFilename)
+	benchmarkMessages(b, msgs, relayUATMessage)
+	b.StopTimer()
+	if b.N >= len(msgs) && countTrafficBySource(TRAFFIC_SOURCE_UAT) == 0 {
+		b.Fatalf("no UAT traffic after %d messages", b.N)
+	}
+}
+
+func BenchmarkESPipeline(b *testing.B) {
+	initBenchmark()
+	msgs := readBenchmarkESLog(b, *benchESFilename)
+	checkESTraffic(b, msgs)
+	benchmarkMessages(b, msgs, processDump1090Message)
+}
+
+// Output stage, with the traffic table built from both logs.
+func BenchmarkTrafficOutput(b *testing.B) {
+	initBenchmark()
+	for _, m := range readBenchmarkUATLog(b, *benchUATFilename) {
+		relayUATMessage(m)
+	}
+	for _, m := range readBenchmarkESLog(b, *benchESFilename) {
+		processDump1090Message(m)
+	}
+	trafficMutex.Lock()
+	targets := len(traffic)
+	trafficMutex.Unlock()
+	if targets == 0 {
+		b.Skip("no traffic in the replay logs")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sendTrafficUpdates()
+	}
+	b.ReportMetric(float64(targets), "targets")
+}
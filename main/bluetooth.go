@@ -0,0 +1,153 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bluetooth.go: GDL90 / FLARM NMEA output over Bluetooth, through BlueZ on the system D-Bus (godbus).
+		BLE:  GATT service 0xFFE0 with the characteristic 0xFFE1 (notify), as used by the SkyEcho/Sentry-like
+		      devices and the HM-10 serial modules. The stream is sent as notifications of up to the ATT MTU - 3
+		      bytes (20 until the client negotiated a larger MTU). Advertised with globalSettings.BluetoothName.
+		SPP:  Serial Port Profile (RFCOMM channel BLUETOOTH_SPP_CHANNEL) for Android apps, one output per device.
+		Both are outputs like the serial ones: rate limited per message class with a nominal baud rate
+		(serialoutput.go), NMEA sentences / traffic filters keyed "BLE" and "SPP".
+		Pairing: the agent accepts new devices (Just Works) only while pairing is allowed from the web UI
+		(BLUETOOTH_PAIRING_TIME), they are trusted after pairing. Paired devices can be removed in the web UI.
+			/getBluetooth                         status and known devices
+			/setBluetooth?action=pair             allow pairing (discoverable) for BLUETOOTH_PAIRING_TIME
+			/setBluetooth?action=remove&address=  remove a paired device
+		Needs a Bluetooth adapter: the onboard one of the Pi is disabled on the image (dtoverlay=disable-bt, the
+		UART is used for the GPS), so a USB dongle is required.
+		The BlueZ/D-Bus side is in bluetooth_bluez.go, builds with -tags nohw use the stub in bluetooth_nohw.go.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type BluetoothDevice struct {
+	Address   string
+	Name      string
+	Paired    bool
+	Trusted   bool
+	Connected bool
+	Output    string // "SPP" if connected to the SPP output
+}
+
+type BluetoothStatus struct {
+	Enabled      bool
+	Running      bool // registered with BlueZ
+	Adapter      string
+	Address      string
+	Error        string
+	BLEConnected bool // a client subscribed to the BLE characteristic
+	PairingUntil time.Time
+	Devices      []BluetoothDevice
+}
+
+/*
+bluetoothConnection.
+
+	Output to a BLE client (key "BLE", there is only one notifying characteristic) or an SPP device
+	(key "SPP:<address>").
+*/
+type bluetoothConnection struct {
+	Key         string
+	Type        string // "BLE" or "SPP"
+	Capability  uint16
+	Queue       *MessageQueue
+	writer      io.Writer
+	closer      func()
+	baud        int
+	rateBuckets map[string]*serialRateBucket
+	closed      bool
+}
+
+func (conn *bluetoothConnection) MessageQueue() *MessageQueue {
+	if conn.Queue == nil {
+		conn.Queue = NewMessageQueue(1024)
+	}
+	return conn.Queue
+}
+func (conn *bluetoothConnection) Writer() io.Writer {
+	return conn.writer
+}
+func (conn *bluetoothConnection) IsThrottled() bool {
+	return false
+}
+func (conn *bluetoothConnection) IsSleeping() bool {
+	return false
+}
+func (conn *bluetoothConnection) Capabilities() uint16 {
+	return conn.Capability
+}
+func (conn *bluetoothConnection) GetDesiredPacketSize() int {
+	return 128
+}
+func (conn *bluetoothConnection) OnError(err error) {
+	logInfof("bluetooth", "Bluetooth connection %s closed: %s", conn.Key, err.Error())
+	conn.Close()
+}
+func (conn *bluetoothConnection) Close() {
+	bluetoothMutex.Lock()
+	closed := conn.closed
+	conn.closed = true
+	bluetoothMutex.Unlock()
+	if closed {
+		return
+	}
+	if conn.closer != nil {
+		conn.closer()
+	}
+	conn.Queue.Close()
+	onConnectionClosed(conn)
+}
+func (conn *bluetoothConnection) GetConnectionKey() string {
+	return conn.Key
+}
+
+var bluetoothMutex = &sync.Mutex{}
+var bluetoothStatus BluetoothStatus
+
+// AJAX call - /getBluetooth. Status and paired/connected devices.
+func handleBluetoothGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, err := json.Marshal(getBluetoothStatus())
+	if err != nil {
+		logErrorf("bluetooth", "Error sending Bluetooth JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /setBluetooth?action=pair or /setBluetooth?action=remove&address=<address>.
+func handleBluetoothSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	switch q := r.URL.Query(); q.Get("action") {
+	case "pair":
+		err = allowBluetoothPairing()
+	case "remove":
+		err = removeBluetoothDevice(q.Get("address"))
+	default:
+		err = errors.New("unknown action")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleBluetoothGetRequest(w, r)
+}
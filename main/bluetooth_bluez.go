@@ -0,0 +1,617 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bluetooth_bluez.go: BlueZ side of the Bluetooth output (see bluetooth.go), on the system D-Bus (godbus).
+		Build with -tags nohw to use the stub in bluetooth_nohw.go instead.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const (
+	BLUETOOTH_RETRY_INTERVAL = 30 * time.Second
+	BLUETOOTH_PAIRING_TIME   = 120 * time.Second
+	BLUETOOTH_SPP_CHANNEL    = 1
+	BLUETOOTH_BLE_BAUD       = 57600 // nominal rates for the message class limits, see serialoutput.go
+	BLUETOOTH_SPP_BAUD       = 115200
+
+	BLUETOOTH_SERVICE_UUID = "0000ffe0-0000-1000-8000-00805f9b34fb"
+	BLUETOOTH_CHAR_UUID    = "0000ffe1-0000-1000-8000-00805f9b34fb"
+	BLUETOOTH_SPP_UUID     = "00001101-0000-1000-8000-00805f9b34fb"
+
+	BLUETOOTH_PATH         = dbus.ObjectPath("/org/stratux/bluetooth")
+	BLUETOOTH_AGENT_PATH   = BLUETOOTH_PATH + "/agent"
+	BLUETOOTH_SPP_PATH     = BLUETOOTH_PATH + "/spp"
+	BLUETOOTH_ADV_PATH     = BLUETOOTH_PATH + "/advertisement"
+	BLUETOOTH_GATT_PATH    = BLUETOOTH_PATH + "/gatt"
+	BLUETOOTH_SERVICE_PATH = BLUETOOTH_GATT_PATH + "/service0"
+	BLUETOOTH_CHAR_PATH    = BLUETOOTH_SERVICE_PATH + "/char0"
+
+	BLUEZ           = "org.bluez"
+	DBUS_PROPERTIES = "org.freedesktop.DBus.Properties"
+	BLUEZ_REJECTED  = "org.bluez.Error.Rejected"
+)
+
+// Sends the stream as notifications (PropertiesChanged of the characteristic value) of at most mtu - 3 bytes.
+type bleNotifier struct {
+	bus *dbus.Conn
+}
+
+func (w bleNotifier) Write(p []byte) (int, error) {
+	bluetoothMutex.Lock()
+	size := bluetoothMTU - 3
+	bluetoothMutex.Unlock()
+	for i := 0; i < len(p); i += size {
+		end := i + size
+		if end > len(p) {
+			end = len(p)
+		}
+		err := w.bus.Emit(BLUETOOTH_CHAR_PATH, DBUS_PROPERTIES+".PropertiesChanged", "org.bluez.GattCharacteristic1",
+			map[string]dbus.Variant{"Value": dbus.MakeVariant(p[i:end])}, []string{})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+var bluetoothBus *dbus.Conn
+var bluetoothAdapter dbus.ObjectPath
+var bluetoothMTU = 23
+var bluetoothBLE *bluetoothConnection
+var bluetoothSPP = make(map[string]*bluetoothConnection) // device object path -> connection
+
+// Settings the registration with BlueZ depends on, re-registered if they change.
+func bluetoothConfig() string {
+	return fmt.Sprintf("%s/%d/%d", globalSettings.BluetoothName, globalSettings.BluetoothBLEOutput, globalSettings.BluetoothSPPOutput)
+}
+
+func setBluetoothError(err error) {
+	bluetoothMutex.Lock()
+	defer bluetoothMutex.Unlock()
+	if err != nil {
+		bluetoothStatus.Error = err.Error()
+	} else {
+		bluetoothStatus.Error = ""
+	}
+}
+
+// Registers with BlueZ while globalSettings.BluetoothEnabled, retries every BLUETOOTH_RETRY_INTERVAL.
+func bluetoothManager() {
+	for {
+		if !globalSettings.BluetoothEnabled {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		config := bluetoothConfig()
+		bus, err := startBluetooth()
+		setBluetoothError(err)
+		if err != nil {
+			logErrorf("bluetooth", "%s", err.Error())
+			time.Sleep(BLUETOOTH_RETRY_INTERVAL)
+			continue
+		}
+		logInfof("bluetooth", "serving on %s as \"%s\"", bluetoothAdapter, globalSettings.BluetoothName)
+		for globalSettings.BluetoothEnabled && bluetoothConfig() == config {
+			select {
+			case <-bus.Context().Done():
+				setBluetoothError(errors.New("lost connection to the D-Bus"))
+			case <-time.After(5 * time.Second):
+				continue
+			}
+			break
+		}
+		stopBluetooth(bus)
+	}
+}
+
+// Connects to the system bus and registers the agent, the GATT application, the advertisement and the SPP profile.
+func startBluetooth() (*dbus.Conn, error) {
+	bus, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to the D-Bus: %s", err.Error())
+	}
+	adapter, address, err := findBluetoothAdapter(bus)
+	if err != nil {
+		bus.Close()
+		return nil, err
+	}
+	bluetoothMutex.Lock()
+	bluetoothBus = bus
+	bluetoothAdapter = adapter
+	bluetoothStatus.Adapter = string(adapter)
+	bluetoothStatus.Address = address
+	bluetoothMutex.Unlock()
+
+	setProp := func(name string, value interface{}) error {
+		return bus.Object(BLUEZ, adapter).SetProperty("org.bluez.Adapter1."+name, dbus.MakeVariant(value))
+	}
+	if err = setProp("Powered", true); err == nil {
+		err = setProp("Alias", globalSettings.BluetoothName)
+	}
+	bluez := bus.Object(BLUEZ, "/org/bluez")
+
+	if err == nil {
+		err = bus.Export(bluetoothAgent{}, BLUETOOTH_AGENT_PATH, "org.bluez.Agent1")
+	}
+	if err == nil {
+		err = bluez.Call("org.bluez.AgentManager1.RegisterAgent", 0, BLUETOOTH_AGENT_PATH, "NoInputNoOutput").Err
+	}
+	if err == nil {
+		err = bluez.Call("org.bluez.AgentManager1.RequestDefaultAgent", 0, BLUETOOTH_AGENT_PATH).Err
+	}
+
+	if err == nil && globalSettings.BluetoothBLEOutput != 0 {
+		err = exportBluetoothGatt(bus)
+		if err == nil {
+			err = bus.Object(BLUEZ, adapter).Call("org.bluez.GattManager1.RegisterApplication", 0, BLUETOOTH_GATT_PATH,
+				map[string]dbus.Variant{}).Err
+		}
+		if err == nil {
+			err = bus.Object(BLUEZ, adapter).Call("org.bluez.LEAdvertisingManager1.RegisterAdvertisement", 0,
+				BLUETOOTH_ADV_PATH, map[string]dbus.Variant{}).Err
+		}
+	}
+
+	if err == nil && globalSettings.BluetoothSPPOutput != 0 {
+		err = bus.Export(bluetoothSPPProfile{}, BLUETOOTH_SPP_PATH, "org.bluez.Profile1")
+		if err == nil {
+			err = bluez.Call("org.bluez.ProfileManager1.RegisterProfile", 0, BLUETOOTH_SPP_PATH,
+				BLUETOOTH_SPP_UUID, map[string]dbus.Variant{
+					"Name":                  dbus.MakeVariant("Stratux"),
+					"Role":                  dbus.MakeVariant("server"),
+					"Channel":               dbus.MakeVariant(uint16(BLUETOOTH_SPP_CHANNEL)),
+					"RequireAuthentication": dbus.MakeVariant(false),
+					"RequireAuthorization":  dbus.MakeVariant(false),
+				}).Err
+		}
+	}
+
+	if err != nil {
+		stopBluetooth(bus)
+		return nil, err
+	}
+	bluetoothMutex.Lock()
+	bluetoothStatus.Running = true
+	bluetoothMutex.Unlock()
+	return bus, nil
+}
+
+// Closes the outputs and the bus connection, BlueZ drops the registrations of a client leaving the bus.
+func stopBluetooth(bus *dbus.Conn) {
+	bluetoothMutex.Lock()
+	conns := make([]*bluetoothConnection, 0)
+	if bluetoothBLE != nil {
+		conns = append(conns, bluetoothBLE)
+	}
+	for _, c := range bluetoothSPP {
+		conns = append(conns, c)
+	}
+	bluetoothBLE = nil
+	bluetoothSPP = make(map[string]*bluetoothConnection)
+	bluetoothBus = nil
+	bluetoothStatus.Running = false
+	bluetoothStatus.BLEConnected = false
+	bluetoothMutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	bus.Close()
+}
+
+type bluezObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+func bluezManagedObjects(bus *dbus.Conn) (bluezObjects, error) {
+	var objects bluezObjects
+	err := bus.Object(BLUEZ, "/").Call("org.freedesktop.DBus.ObjectManager.GetManagedObjects", 0).Store(&objects)
+	return objects, err
+}
+
+func bluezString(props map[string]dbus.Variant, name string) string {
+	s, _ := props[name].Value().(string)
+	return s
+}
+
+func bluezBool(props map[string]dbus.Variant, name string) bool {
+	b, _ := props[name].Value().(bool)
+	return b
+}
+
+// First adapter with LE advertising support, otherwise the first one.
+func findBluetoothAdapter(bus *dbus.Conn) (dbus.ObjectPath, string, error) {
+	objects, err := bluezManagedObjects(bus)
+	if err != nil {
+		return "", "", fmt.Errorf("BlueZ not available: %s", err.Error())
+	}
+	paths := make([]string, 0)
+	for path, object := range objects {
+		if object["org.bluez.Adapter1"] != nil {
+			paths = append(paths, string(path))
+		}
+	}
+	if len(paths) == 0 {
+		return "", "", errors.New("no Bluetooth adapter found (the onboard one is disabled, a USB adapter is required)")
+	}
+	sort.Strings(paths)
+	best := dbus.ObjectPath(paths[0])
+	for _, path := range paths {
+		if objects[dbus.ObjectPath(path)]["org.bluez.LEAdvertisingManager1"] != nil {
+			best = dbus.ObjectPath(path)
+			break
+		}
+	}
+	return best, bluezString(objects[best]["org.bluez.Adapter1"], "Address"), nil
+}
+
+// Device object path -> address, e.g. /org/bluez/hci0/dev_AA_BB_CC_DD_EE_FF -> AA:BB:CC:DD:EE:FF.
+func bluetoothDeviceAddress(path dbus.ObjectPath) string {
+	i := strings.LastIndex(string(path), "/dev_")
+	if i < 0 {
+		return string(path)
+	}
+	return strings.Replace(string(path)[i+5:], "_", ":", -1)
+}
+
+func isBluetoothPairingAllowed() bool {
+	bluetoothMutex.Lock()
+	defer bluetoothMutex.Unlock()
+	return time.Now().Before(bluetoothStatus.PairingUntil)
+}
+
+// org.bluez.Agent1, NoInputNoOutput: pairing requests are only accepted while pairing is allowed. Methods that need
+// input (RequestPinCode, RequestPasskey) aren't exported, BlueZ takes the error as rejection.
+type bluetoothAgent struct{}
+
+func (bluetoothAgent) accept(method string, device dbus.ObjectPath) *dbus.Error {
+	if !isBluetoothPairingAllowed() {
+		logInfof("bluetooth", "rejected %s of %s, pairing not allowed", method, bluetoothDeviceAddress(device))
+		return dbus.NewError(BLUEZ_REJECTED, []interface{}{"pairing not allowed"})
+	}
+	logInfof("bluetooth", "accepted %s of %s", method, bluetoothDeviceAddress(device))
+	go trustBluetoothDevice(device)
+	return nil
+}
+
+func (a bluetoothAgent) RequestConfirmation(device dbus.ObjectPath, passkey uint32) *dbus.Error {
+	return a.accept("RequestConfirmation", device)
+}
+
+func (a bluetoothAgent) RequestAuthorization(device dbus.ObjectPath) *dbus.Error {
+	return a.accept("RequestAuthorization", device)
+}
+
+func (a bluetoothAgent) AuthorizeService(device dbus.ObjectPath, uuid string) *dbus.Error {
+	return a.accept("AuthorizeService", device)
+}
+
+func (bluetoothAgent) DisplayPinCode(device dbus.ObjectPath, pincode string) *dbus.Error { return nil }
+
+func (bluetoothAgent) DisplayPasskey(device dbus.ObjectPath, passkey uint32, entered uint16) *dbus.Error {
+	return nil
+}
+
+func (bluetoothAgent) Release() *dbus.Error { return nil }
+
+func (bluetoothAgent) Cancel() *dbus.Error { return nil }
+
+func trustBluetoothDevice(device dbus.ObjectPath) {
+	bluetoothMutex.Lock()
+	bus := bluetoothBus
+	bluetoothMutex.Unlock()
+	if bus == nil || len(device) == 0 {
+		return
+	}
+	if err := bus.Object(BLUEZ, device).SetProperty("org.bluez.Device1.Trusted", dbus.MakeVariant(true)); err != nil {
+		logErrorf("bluetooth", "can't trust %s: %s", bluetoothDeviceAddress(device), err.Error())
+	}
+}
+
+// org.bluez.LEAdvertisement1
+type bluetoothAdvertisement struct{}
+
+func (bluetoothAdvertisement) Release() *dbus.Error { return nil }
+
+func bluetoothAdvertisementProperties() map[string]*prop.Prop {
+	return map[string]*prop.Prop{
+		"Type":         {Value: "peripheral", Emit: prop.EmitFalse},
+		"ServiceUUIDs": {Value: []string{BLUETOOTH_SERVICE_UUID}, Emit: prop.EmitFalse},
+		"LocalName":    {Value: globalSettings.BluetoothName, Emit: prop.EmitFalse},
+	}
+}
+
+func bluetoothServiceProperties() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"UUID":    dbus.MakeVariant(BLUETOOTH_SERVICE_UUID),
+		"Primary": dbus.MakeVariant(true),
+	}
+}
+
+func bluetoothCharProperties() map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"UUID":    dbus.MakeVariant(BLUETOOTH_CHAR_UUID),
+		"Service": dbus.MakeVariant(BLUETOOTH_SERVICE_PATH),
+		"Flags":   dbus.MakeVariant([]string{"read", "write-without-response", "notify"}),
+	}
+}
+
+// Read-only org.freedesktop.DBus.Properties of an exported object.
+func bluetoothPropMap(props map[string]dbus.Variant) map[string]*prop.Prop {
+	m := make(map[string]*prop.Prop)
+	for name, v := range props {
+		m[name] = &prop.Prop{Value: v.Value(), Emit: prop.EmitFalse}
+	}
+	return m
+}
+
+// org.freedesktop.DBus.ObjectManager of the GATT application.
+type bluetoothGattApp struct{}
+
+func (bluetoothGattApp) GetManagedObjects() (bluezObjects, *dbus.Error) {
+	return bluezObjects{
+		BLUETOOTH_SERVICE_PATH: {"org.bluez.GattService1": bluetoothServiceProperties()},
+		BLUETOOTH_CHAR_PATH:    {"org.bluez.GattCharacteristic1": bluetoothCharProperties()},
+	}, nil
+}
+
+// Takes the negotiated ATT MTU from the options of ReadValue/WriteValue (BlueZ >= 5.50).
+func updateBluetoothMTU(options map[string]dbus.Variant) {
+	if mtu, ok := options["mtu"].Value().(uint16); ok && mtu >= 23 {
+		bluetoothMutex.Lock()
+		bluetoothMTU = int(mtu)
+		bluetoothMutex.Unlock()
+	}
+}
+
+// org.bluez.GattCharacteristic1 0xFFE1: the output stream as notifications. Written data is ignored.
+type bluetoothGattChar struct{}
+
+func (bluetoothGattChar) ReadValue(options map[string]dbus.Variant) ([]byte, *dbus.Error) {
+	updateBluetoothMTU(options)
+	return []byte{}, nil
+}
+
+func (bluetoothGattChar) WriteValue(value []byte, options map[string]dbus.Variant) *dbus.Error {
+	updateBluetoothMTU(options)
+	return nil
+}
+
+func (bluetoothGattChar) StartNotify() *dbus.Error {
+	startBluetoothBLE()
+	return nil
+}
+
+func (bluetoothGattChar) StopNotify() *dbus.Error {
+	bluetoothMutex.Lock()
+	conn := bluetoothBLE
+	bluetoothMutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// Exports the GATT application (service 0xFFE0, characteristic 0xFFE1) and the advertisement.
+func exportBluetoothGatt(bus *dbus.Conn) error {
+	if err := bus.Export(bluetoothGattApp{}, BLUETOOTH_GATT_PATH, "org.freedesktop.DBus.ObjectManager"); err != nil {
+		return err
+	}
+	if _, err := prop.Export(bus, BLUETOOTH_SERVICE_PATH, prop.Map{
+		"org.bluez.GattService1": bluetoothPropMap(bluetoothServiceProperties()),
+	}); err != nil {
+		return err
+	}
+	if err := bus.Export(bluetoothGattChar{}, BLUETOOTH_CHAR_PATH, "org.bluez.GattCharacteristic1"); err != nil {
+		return err
+	}
+	if _, err := prop.Export(bus, BLUETOOTH_CHAR_PATH, prop.Map{
+		"org.bluez.GattCharacteristic1": bluetoothPropMap(bluetoothCharProperties()),
+	}); err != nil {
+		return err
+	}
+	if err := bus.Export(bluetoothAdvertisement{}, BLUETOOTH_ADV_PATH, "org.bluez.LEAdvertisement1"); err != nil {
+		return err
+	}
+	_, err := prop.Export(bus, BLUETOOTH_ADV_PATH, prop.Map{"org.bluez.LEAdvertisement1": bluetoothAdvertisementProperties()})
+	return err
+}
+
+func startBluetoothBLE() {
+	bluetoothMutex.Lock()
+	if bluetoothBLE != nil || bluetoothBus == nil {
+		bluetoothMutex.Unlock()
+		return
+	}
+	conn := &bluetoothConnection{
+		Key:         "BLE",
+		Type:        "BLE",
+		Capability:  uint16(globalSettings.BluetoothBLEOutput),
+		Queue:       NewMessageQueue(1024),
+		writer:      bleNotifier{bluetoothBus},
+		baud:        BLUETOOTH_BLE_BAUD,
+		rateBuckets: make(map[string]*serialRateBucket),
+	}
+	conn.closer = func() {
+		bluetoothMutex.Lock()
+		if bluetoothBLE == conn {
+			bluetoothBLE = nil
+			bluetoothStatus.BLEConnected = false
+			bluetoothMTU = 23
+		}
+		bluetoothMutex.Unlock()
+		logInfof("bluetooth", "BLE client unsubscribed")
+	}
+	bluetoothBLE = conn
+	bluetoothStatus.BLEConnected = true
+	bluetoothMutex.Unlock()
+	logInfof("bluetooth", "BLE client subscribed")
+	addBluetoothConnection(conn)
+}
+
+func addBluetoothConnection(conn *bluetoothConnection) {
+	netMutex.Lock()
+	clientConnections[conn.Key] = conn
+	netMutex.Unlock()
+	go connectionWriter(conn)
+}
+
+// org.bluez.Profile1 of the SPP output: NewConnection passes the RFCOMM socket of a device.
+type bluetoothSPPProfile struct{}
+
+func (bluetoothSPPProfile) Release() *dbus.Error { return nil }
+
+func (bluetoothSPPProfile) NewConnection(device dbus.ObjectPath, fd dbus.UnixFD, props map[string]dbus.Variant) *dbus.Error {
+	// Non-blocking, so os.File uses the poller and Close() interrupts the reader
+	syscall.SetNonblock(int(fd), true)
+	startBluetoothSPP(device, os.NewFile(uintptr(fd), "rfcomm"))
+	return nil
+}
+
+func (bluetoothSPPProfile) RequestDisconnection(device dbus.ObjectPath) *dbus.Error {
+	bluetoothMutex.Lock()
+	conn := bluetoothSPP[string(device)]
+	bluetoothMutex.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+func startBluetoothSPP(device dbus.ObjectPath, f *os.File) {
+	address := bluetoothDeviceAddress(device)
+	conn := &bluetoothConnection{
+		Key:         "SPP:" + address,
+		Type:        "SPP",
+		Capability:  uint16(globalSettings.BluetoothSPPOutput),
+		Queue:       NewMessageQueue(1024),
+		writer:      f,
+		baud:        BLUETOOTH_SPP_BAUD,
+		rateBuckets: make(map[string]*serialRateBucket),
+	}
+	conn.closer = func() {
+		f.Close()
+		bluetoothMutex.Lock()
+		if bluetoothSPP[string(device)] == conn {
+			delete(bluetoothSPP, string(device))
+		}
+		bluetoothMutex.Unlock()
+		logInfof("bluetooth", "SPP connection of %s closed", address)
+	}
+	bluetoothMutex.Lock()
+	old := bluetoothSPP[string(device)]
+	bluetoothSPP[string(device)] = conn
+	bluetoothMutex.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	logInfof("bluetooth", "SPP connection of %s", address)
+	addBluetoothConnection(conn)
+	// Data from the device is ignored, but reading detects the disconnect.
+	go func() {
+		io.Copy(io.Discard, f)
+		conn.Close()
+	}()
+}
+
+func getBluetoothStatus() BluetoothStatus {
+	bluetoothMutex.Lock()
+	status := bluetoothStatus
+	bus := bluetoothBus
+	adapter := bluetoothAdapter
+	spp := make(map[string]bool)
+	for path := range bluetoothSPP {
+		spp[path] = true
+	}
+	bluetoothMutex.Unlock()
+	status.Enabled = globalSettings.BluetoothEnabled
+	status.Devices = make([]BluetoothDevice, 0)
+	if bus == nil {
+		return status
+	}
+	objects, err := bluezManagedObjects(bus)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	for path, object := range objects {
+		props := object["org.bluez.Device1"]
+		if props == nil || !strings.HasPrefix(string(path), string(adapter)+"/") {
+			continue
+		}
+		dev := BluetoothDevice{
+			Address:   bluezString(props, "Address"),
+			Name:      bluezString(props, "Alias"),
+			Paired:    bluezBool(props, "Paired"),
+			Trusted:   bluezBool(props, "Trusted"),
+			Connected: bluezBool(props, "Connected"),
+		}
+		if spp[string(path)] {
+			dev.Output = "SPP"
+		}
+		// Only the relevant ones, not every device that was seen around
+		if dev.Paired || dev.Trusted || dev.Connected {
+			status.Devices = append(status.Devices, dev)
+		}
+	}
+	sort.Slice(status.Devices, func(i, j int) bool { return status.Devices[i].Address < status.Devices[j].Address })
+	return status
+}
+
+// Makes the adapter discoverable and pairable for BLUETOOTH_PAIRING_TIME.
+func allowBluetoothPairing() error {
+	bluetoothMutex.Lock()
+	bus := bluetoothBus
+	adapter := bluetoothAdapter
+	bluetoothMutex.Unlock()
+	if bus == nil {
+		return errors.New("Bluetooth not running")
+	}
+	timeout := uint32(BLUETOOTH_PAIRING_TIME / time.Second)
+	for _, p := range []struct {
+		name  string
+		value interface{}
+	}{{"PairableTimeout", timeout}, {"DiscoverableTimeout", timeout}, {"Pairable", true}, {"Discoverable", true}} {
+		if err := bus.Object(BLUEZ, adapter).SetProperty("org.bluez.Adapter1."+p.name, dbus.MakeVariant(p.value)); err != nil {
+			return err
+		}
+	}
+	bluetoothMutex.Lock()
+	bluetoothStatus.PairingUntil = time.Now().Add(BLUETOOTH_PAIRING_TIME)
+	bluetoothMutex.Unlock()
+	logInfof("bluetooth", "pairing allowed for %s", BLUETOOTH_PAIRING_TIME)
+	return nil
+}
+
+func removeBluetoothDevice(address string) error {
+	bluetoothMutex.Lock()
+	bus := bluetoothBus
+	adapter := bluetoothAdapter
+	bluetoothMutex.Unlock()
+	if bus == nil {
+		return errors.New("Bluetooth not running")
+	}
+	device := adapter + dbus.ObjectPath("/dev_"+strings.Replace(strings.ToUpper(address), ":", "_", -1))
+	if err := bus.Object(BLUEZ, adapter).Call("org.bluez.Adapter1.RemoveDevice", 0, device).Err; err != nil {
+		return err
+	}
+	logInfof("bluetooth", "removed %s", address)
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build nohw
+// +build nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	bluetooth_nohw.go: Bluetooth stubs for builds without hardware support (-tags nohw), no BlueZ/D-Bus.
+*/
+
+package main
+
+import (
+	"errors"
+)
+
+var errBluetoothNoHW = errors.New("built without Bluetooth support (nohw)")
+
+func bluetoothManager() {
+	bluetoothMutex.Lock()
+	bluetoothStatus.Error = errBluetoothNoHW.Error()
+	bluetoothMutex.Unlock()
+	logInfof("bluetooth", "%s", errBluetoothNoHW.Error())
+}
+
+func getBluetoothStatus() BluetoothStatus {
+	bluetoothMutex.Lock()
+	status := bluetoothStatus
+	bluetoothMutex.Unlock()
+	status.Enabled = globalSettings.BluetoothEnabled
+	status.Devices = make([]BluetoothDevice, 0)
+	return status
+}
+
+func allowBluetoothPairing() error {
+	return errBluetoothNoHW
+}
+
+func removeBluetoothDevice(address string) error {
+	return errBluetoothNoHW
+}
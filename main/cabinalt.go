@@ -0,0 +1,64 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	cabinalt.go: Cabin altitude alerting as a simple hypoxia safeguard. The onboard baro sensor measures the
+		pressure inside the cabin, so its pressure altitude is the cabin altitude, also in pressurized aircraft.
+		globalSettings.CabinAltitudeAlerts holds the alert thresholds (ft). The highest exceeded threshold is
+		reported in globalStatus.CabinAltitudeAlert, where the web interface picks it up for audio alerts.
+*/
+
+package main
+
+import (
+	"time"
+)
+
+const (
+	CABIN_ALTITUDE_HYSTERESIS = 300.0 // ft below a threshold before its alert is cleared
+)
+
+// Returns true if the current baro source measures the pressure inside the aircraft.
+func isCabinPressureSource() bool {
+	return isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_NONE && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE &&
+		mySituation.BaroSourceType != BARO_TYPE_TRANSPONDER // static pressure
+}
+
+func updateCabinAltitudeAlert() {
+	if !isCabinPressureSource() {
+		globalStatus.CabinAltitude = 0
+		globalStatus.CabinAltitudeAlert = 0
+		return
+	}
+	alt := float64(mySituation.BaroPressureAltitude)
+	globalStatus.CabinAltitude = int(alt)
+
+	alert := 0
+	for _, threshold := range globalSettings.CabinAltitudeAlerts {
+		if threshold <= 0 || threshold <= alert {
+			continue
+		}
+		// An active alert stays active until we are below threshold - hysteresis.
+		if alt >= float64(threshold) || (threshold <= globalStatus.CabinAltitudeAlert && alt >= float64(threshold)-CABIN_ALTITUDE_HYSTERESIS) {
+			alert = threshold
+		}
+	}
+	if alert != globalStatus.CabinAltitudeAlert {
+		if alert > 0 {
+			logInfof("cabinalt", "Cabin altitude alert: %d ft (threshold %d ft)", int(alt), alert)
+		} else {
+			logInfof("cabinalt", "Cabin altitude alert cleared: %d ft", int(alt))
+		}
+		globalStatus.CabinAltitudeAlert = alert
+	}
+}
+
+func cabinAltitudeWatcher() {
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		updateCabinAltitudeAlert()
+	}
+}
@@ -11,7 +11,6 @@ package main
 
 import (
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
@@ -27,7 +26,7 @@ type connection interface {
 	Writer()       io.Writer
 	IsThrottled()  bool
 	IsSleeping()   bool
-	Capabilities() uint8
+	Capabilities() uint16
 	GetDesiredPacketSize() int
 	OnError(error)
 	Close()
@@ -37,16 +36,29 @@ type networkConnection struct {
 	Conn            *net.UDPConn
 	Ip              string
 	Port            uint32
-	Capability      uint8
+	Capability      uint16
+	Interface       string // interface name (e.g. "eth0") or local IP the output is bound to. Empty = all interfaces
+	Broadcast       bool   // send to the broadcast address of the interface(s) instead of each client
 	Queue           *MessageQueue `json:"-"` // don't store in settings
 
 	LastPingResponse time.Time // last time the client responded
 	LastUnreachable time.Time // Last time the device sent an ICMP Unreachable packet.
-	/*
-		Sleep mode/throttle variables. "sleep mode" is actually now just a very reduced packet rate, since we don't know positively
-		 when a client is ready to accept packets - we just assume so if we don't receive ICMP Unreachable packets in 5 secs.
-	*/
-	SleepFlag       bool      // Whether or not this client has been marked as sleeping - only used for debugging
+
+	// Keep-alive state, see keepalive.go
+	lastReachable   time.Time // last time the neighbor table had the device as reachable
+	lastAck         time.Time // last announcement of an app on this port
+	ackApp          string
+	state           string    // CLIENT_STATE_*, updated by keepAliveMonitor()
+	stateSince      time.Time
+
+	// Per client settings and statistics, see clientmanager.go
+	rateLimits      map[string]float64
+	rateBuckets     map[string]*serialRateBucket
+	rateLimited     uint64 // messages not queued because of rateLimits
+	ahrs            *NetworkClientAHRS // own AHRS output, see ahrsoutput.go
+	ahrsPhase       float64            // fraction of the next AHRS message, see ahrsOutputSender()
+	messagesSent    uint64 // atomic
+	bytesSent       uint64 // atomic
 }
 
 func (conn *networkConnection) MessageQueue() *MessageQueue {
@@ -65,30 +77,21 @@ func (conn *networkConnection) Writer() io.Writer {
 	 Throttling means that we only send important packets for first 15 seconds (location, status, very close traffic).
 */
 func (conn *networkConnection) IsThrottled() bool {
-	return (rand.Int()%1000 != 0) && stratuxClock.Since(conn.LastUnreachable) < (15*time.Second)
+	state, _ := conn.clientState()
+	return (rand.Int()%1000 != 0) && state == CLIENT_STATE_STARTING
 }
 
 /*
 	isSleeping().
-	 Check if a client identifier 'ip:port' is in either a sleep or active state.
+	 Check if a client identifier 'ip:port' is in either a sleep or active state, see keepalive.go.
+	 The queue of a sleeping client is paused, only heartbeats are sent to detect it waking up.
 */
 func (conn *networkConnection) IsSleeping() bool {
-	// Unable to listen to ICMP without root - send to everything. Just for debugging.
-	if isX86DebugMode() || globalSettings.NoSleep == true {
-		return false
-	}
-	// No ping response. Assume disconnected/sleeping device.
-	if conn.LastPingResponse.IsZero() || stratuxClock.Since(conn.LastPingResponse) > (10*time.Second) {
-		conn.SleepFlag = true
-	} else if stratuxClock.Since(conn.LastUnreachable) < (5 * time.Second) {
-		conn.SleepFlag = true
-	} else {
-		conn.SleepFlag = false
-	}
-	return conn.SleepFlag
+	state, _ := conn.clientState()
+	return state != CLIENT_STATE_AWAKE && state != CLIENT_STATE_STARTING
 }
 
-func (conn *networkConnection) Capabilities() uint8 {
+func (conn *networkConnection) Capabilities() uint16 {
 	return conn.Capability
 }
 
@@ -106,7 +109,7 @@ func (conn *networkConnection) Close() {
 }
 
 func (conn *networkConnection) GetConnectionKey() string {
-	return conn.Ip + ":" + strconv.Itoa(int(conn.Port))
+	return net.JoinHostPort(conn.Ip, strconv.Itoa(int(conn.Port)))
 }
 
 
@@ -114,9 +117,11 @@ func (conn *networkConnection) GetConnectionKey() string {
 type serialConnection struct {
 	DeviceString string
 	Baud         int
-	Capability   uint8
+	Capability   uint16
+	RateLimits   map[string]float64 // message class -> messages per second, see serialoutput.go
 	serialPort   *serial.Port
 	Queue        *MessageQueue `json:"-"` // don't store in settings
+	rateBuckets  map[string]*serialRateBucket
 }
 
 func (conn *serialConnection) MessageQueue() *MessageQueue {
@@ -136,7 +141,7 @@ func (conn *serialConnection) IsSleeping() bool {
 	return conn.serialPort == nil
 }
 
-func (conn *serialConnection) Capabilities() uint8 {
+func (conn *serialConnection) Capabilities() uint16 {
 	return conn.Capability
 }
 
@@ -146,14 +151,14 @@ func (conn *serialConnection) GetDesiredPacketSize() int {
 
 func (conn *serialConnection) OnError(err error) {
 	// Close connection and queue
-	log.Printf("Serial connection %s closed: %s", conn.DeviceString, err.Error())
+	logInfof("network", "Serial connection %s closed: %s", conn.DeviceString, err.Error())
 	conn.Close()
 }
 
 func (conn *serialConnection) Close() {
 	if conn.serialPort != nil {
 		conn.serialPort.Close()
-		log.Printf("Closed serial port %s", conn.DeviceString)
+		logInfof("network", "Closed serial port %s", conn.DeviceString)
 		conn.Queue.Close()
 		onConnectionClosed(conn)
 	}
@@ -163,11 +168,43 @@ func (conn *serialConnection) GetConnectionKey() string {
 	return conn.DeviceString
 }
 
+const (
+	TCP_OUTPUT_WRITE_TIMEOUT = 10 * time.Second // a client that doesn't take data for this long is disconnected
+	TCP_OUTPUT_SLOW_WRITE    = 500 * time.Millisecond
+	TCP_OUTPUT_THROTTLE_TIME = 5 * time.Second
+)
+
 type tcpConnection struct {
 	Conn         *net.TCPConn
 	Queue        *MessageQueue `json:"-"`
-	Capability   uint8
+	Capability   uint16
 	Key          string
+
+	lastSlowWrite time.Time // stratuxClock, last write that blocked for TCP_OUTPUT_SLOW_WRITE or longer
+}
+
+/*
+	tcpWriter.
+	 Backpressure for TCP clients: a write blocks when the socket buffer is full because the client (or its link)
+	 can't keep up. Such a client is throttled for TCP_OUTPUT_THROTTLE_TIME, so only important messages are sent
+	 and the rest of its queue expires, and disconnected if a write doesn't complete within TCP_OUTPUT_WRITE_TIMEOUT.
+*/
+type tcpWriter struct {
+	conn *tcpConnection
+}
+
+func (w tcpWriter) Write(p []byte) (int, error) {
+	c := w.conn.Conn
+	if c == nil {
+		return 0, io.ErrClosedPipe
+	}
+	c.SetWriteDeadline(time.Now().Add(TCP_OUTPUT_WRITE_TIMEOUT))
+	start := time.Now()
+	n, err := c.Write(p)
+	if time.Since(start) >= TCP_OUTPUT_SLOW_WRITE {
+		w.conn.lastSlowWrite = stratuxClock.Time
+	}
+	return n, err
 }
 
 func (conn *tcpConnection) MessageQueue() *MessageQueue {
@@ -178,15 +215,15 @@ func (conn *tcpConnection) MessageQueue() *MessageQueue {
 }
 
 func (conn *tcpConnection) Writer() io.Writer {
-	return conn.Conn
+	return tcpWriter{conn}
 }
 func (conn *tcpConnection) IsThrottled() bool {
-	return false
+	return !conn.lastSlowWrite.IsZero() && stratuxClock.Since(conn.lastSlowWrite) < TCP_OUTPUT_THROTTLE_TIME
 }
 func (conn *tcpConnection) IsSleeping() bool {
 	return conn.Conn == nil
 }
-func (conn *tcpConnection) Capabilities() uint8 {
+func (conn *tcpConnection) Capabilities() uint16 {
 	return conn.Capability
 }
 func (conn *tcpConnection) GetDesiredPacketSize() int {
@@ -196,7 +233,7 @@ func (conn *tcpConnection) GetDesiredPacketSize() int {
 func (conn *tcpConnection) OnError(err error) {
 	// Close connection and queue
 	if conn.Conn != nil {
-		log.Printf("TCP connection %s closed: %s", conn.Conn.RemoteAddr(), err.Error())
+		logInfof("network", "TCP connection %s closed: %s", conn.Conn.RemoteAddr(), err.Error())
 		conn.Close()
 	}
 }
@@ -0,0 +1,266 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	clientmanager.go: Per client protocol selection and statistics of the UDP outputs.
+		Clients are discovered from the DHCP leases, the ARP table and the static hosts (see getDHCPLeases()), the IPv6
+		neighbor table (see networkipv6.go) or added manually. By default a client gets all
+		globalSettings.NetworkOutputs; globalSettings.NetworkClients assigns a client (by IP) its own outputs (port +
+		protocol, none = nothing is sent to it), per class rate limits (messages per second, classes as the serial
+		outputs, see serialoutput.go) and its own AHRS rate and format (see ahrsoutput.go).
+			/getNetworkClients                    clients with live statistics per output (queue depth, messages/bytes
+			                                      sent, dropped and rate limited messages, sleep state)
+		Changed with /setSettings {"NetworkClients": {"<ip>": {...}}}, null removes the entry of a client.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+type NetworkClientOutput struct {
+	Port       uint32
+	Capability uint16 // NETWORK_GDL90_STANDARD, NETWORK_FLARM_NMEA, ...
+}
+
+// Own AHRS rate and format of a client, see ahrsoutput.go.
+type NetworkClientAHRS struct {
+	Rate    int    // Hz, AHRS_OUTPUT_RATE_MIN-AHRS_OUTPUT_RATE_MAX
+	Format  string // AHRS_FORMAT_*
+	Heading bool   // send the heading, invalid otherwise
+}
+
+type NetworkClient struct {
+	Name       string
+	Manual     bool                  // added by hand, connected even without DHCP lease / ARP entry
+	Profile    string                // canned outputs for an app, replaces Outputs, see outputprofiles.go
+	Outputs    []NetworkClientOutput // nil = globalSettings.NetworkOutputs, empty = none
+	RateLimits map[string]float64    // message class -> messages per second, see serialoutput.go
+	AHRS       *NetworkClientAHRS    // nil = the default AHRS messages
+}
+
+type NetworkClientOutputStatus struct {
+	Port         uint32
+	Capability   uint16
+	Sleeping     bool
+	Throttled    bool
+	State        string // CLIENT_STATE_*, see keepalive.go
+	StateReason  string
+	StateSince   float64 // s in the current state
+	LastAck      float64 // s since the last app announcement, -1 = never
+	AckApp       string
+	QueueDepth   int
+	Dropped      uint64 // discarded from the queue unsent (outdated or queue full)
+	RateLimited  uint64
+	MessagesSent uint64 // network packets
+	BytesSent    uint64
+	Classes      []MessageQueueClassStats // queue depth, sent and dropped messages per priority class, see messagequeue.go
+}
+
+type NetworkClientStatus struct {
+	IP         string
+	Hostname   string
+	Name       string
+	Manual     bool
+	Profile    string
+	Configured bool    // has an entry in globalSettings.NetworkClients
+	Default    bool    // gets globalSettings.NetworkOutputs
+	LastPing   float64 // s since the last ping response, -1 = never
+	Outputs    []NetworkClientOutputStatus
+}
+
+// Adds the manually added clients to the discovered ones. Requires netMutex.
+func addManualNetworkClients(clients map[string]string) {
+	for ip, c := range globalSettings.NetworkClients {
+		if _, ok := clients[ip]; c.Manual && !ok {
+			clients[ip] = c.Name
+		}
+	}
+}
+
+// Outputs assigned to the client (by its profile or custom), false if it gets globalSettings.NetworkOutputs.
+func networkClientOutputs(ip string) ([]networkConnection, bool) {
+	c, ok := globalSettings.NetworkClients[ip]
+	if !ok {
+		return nil, false
+	}
+	assigned := c.Outputs
+	if p, ok := networkClientProfile(ip); ok {
+		assigned = p.Outputs
+	}
+	if assigned == nil {
+		return nil, false
+	}
+	outputs := make([]networkConnection, 0, len(assigned))
+	for _, o := range assigned {
+		if o.Port > 0 && o.Capability != 0 {
+			outputs = append(outputs, networkConnection{Port: o.Port, Capability: o.Capability})
+		}
+	}
+	return outputs, true
+}
+
+func networkClientRateLimits(ip string) map[string]float64 {
+	limits := make(map[string]float64)
+	if p, ok := networkClientProfile(ip); ok {
+		for class, l := range p.RateLimits {
+			limits[class] = l
+		}
+	}
+	if c, ok := globalSettings.NetworkClients[ip]; ok {
+		for class, l := range c.RateLimits {
+			limits[class] = l
+		}
+	}
+	if len(limits) == 0 {
+		return nil
+	}
+	return limits
+}
+
+// Parses the value of the NetworkClients setting into globalSettings.NetworkClients, see handleSettingsSetRequest().
+func setNetworkClients(val map[string]interface{}) {
+	if globalSettings.NetworkClients == nil {
+		globalSettings.NetworkClients = make(map[string]NetworkClient)
+	}
+	for ip, v := range val {
+		ip = strings.TrimSpace(ip)
+		if parseClientIP(ip) == nil {
+			logWarnf("network", "NetworkClients: invalid IP '%s'", ip)
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			delete(globalSettings.NetworkClients, ip)
+			continue
+		}
+		c := NetworkClient{}
+		c.Name, _ = m["Name"].(string)
+		c.Name = strings.TrimSpace(c.Name)
+		c.Manual, _ = m["Manual"].(bool)
+		if profile, _ := m["Profile"].(string); len(profile) > 0 {
+			if _, ok := outputProfiles[profile]; ok {
+				c.Profile = profile
+			} else {
+				logInfof("network", "NetworkClients: unknown profile '%s'", profile)
+			}
+		}
+		if outputs, ok := m["Outputs"].([]interface{}); ok {
+			c.Outputs = make([]NetworkClientOutput, 0)
+			for _, o := range outputs {
+				output, _ := o.(map[string]interface{})
+				port, _ := output["Port"].(float64)
+				capability, _ := output["Capability"].(float64)
+				if port > 0 && port < 65536 && capability > 0 {
+					c.Outputs = append(c.Outputs, NetworkClientOutput{uint32(port), uint16(capability)})
+				}
+			}
+		}
+		if limits, ok := m["RateLimits"].(map[string]interface{}); ok {
+			c.RateLimits = make(map[string]float64)
+			for class, l := range limits {
+				if l, ok := l.(float64); ok {
+					c.RateLimits[strings.ToUpper(strings.TrimSpace(class))] = l
+				}
+			}
+		}
+		c.AHRS = parseNetworkClientAHRS(m["AHRS"])
+		globalSettings.NetworkClients[ip] = c
+	}
+}
+
+func getNetworkClients() []NetworkClientStatus {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	clients := make(map[string]*NetworkClientStatus)
+	client := func(ip string) *NetworkClientStatus {
+		c, ok := clients[ip]
+		if !ok {
+			config, configured := globalSettings.NetworkClients[ip]
+			c = &NetworkClientStatus{IP: ip, Hostname: dhcpLeases[ip], Name: config.Name, Manual: config.Manual,
+				Profile: config.Profile, Configured: configured, Default: config.Outputs == nil && len(config.Profile) == 0, LastPing: -1,
+				Outputs: make([]NetworkClientOutputStatus, 0)}
+			clients[ip] = c
+		}
+		return c
+	}
+	for ip := range dhcpLeases {
+		client(ip)
+	}
+	for ip := range globalSettings.NetworkClients {
+		client(ip)
+	}
+	for _, conn := range clientConnections {
+		nc, ok := conn.(*networkConnection)
+		if !ok || nc.Broadcast {
+			continue
+		}
+		c := client(nc.Ip)
+		if !nc.LastPingResponse.IsZero() {
+			age := stratuxClock.Since(nc.LastPingResponse).Seconds()
+			if c.LastPing < 0 || age < c.LastPing {
+				c.LastPing = age
+			}
+		}
+		depth, dropped := nc.Queue.Stats()
+		state, reason := nc.clientState()
+		lastAck := -1.0
+		if !nc.lastAck.IsZero() {
+			lastAck = stratuxClock.Since(nc.lastAck).Seconds()
+		}
+		c.Outputs = append(c.Outputs, NetworkClientOutputStatus{
+			Port:         nc.Port,
+			Capability:   nc.Capability,
+			Sleeping:     nc.IsSleeping(),
+			Throttled:    nc.IsThrottled(),
+			State:        state,
+			StateReason:  reason,
+			StateSince:   stratuxClock.Since(nc.stateSince).Seconds(),
+			LastAck:      lastAck,
+			AckApp:       nc.ackApp,
+			QueueDepth:   depth,
+			Dropped:      dropped,
+			RateLimited:  nc.rateLimited,
+			MessagesSent: atomic.LoadUint64(&nc.messagesSent),
+			BytesSent:    atomic.LoadUint64(&nc.bytesSent),
+			Classes:      nc.Queue.ClassStats(),
+		})
+	}
+
+	result := make([]NetworkClientStatus, 0, len(clients))
+	for _, c := range clients {
+		sort.Slice(c.Outputs, func(i, j int) bool { return c.Outputs[i].Port < c.Outputs[j].Port })
+		result = append(result, *c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		// IPv4 first
+		a, b := parseClientIP(result[i].IP), parseClientIP(result[j].IP)
+		if a == nil || b == nil {
+			return result[i].IP < result[j].IP
+		}
+		if (a.To4() == nil) != (b.To4() == nil) {
+			return a.To4() != nil
+		}
+		return string(a.To16()) < string(b.To16())
+	})
+	return result
+}
+
+// AJAX call - /getNetworkClients. Known clients with their outputs and statistics.
+func handleNetworkClientsGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	clientsJSON, err := json.Marshal(getNetworkClients())
+	if err != nil {
+		logErrorf("network", "Error sending network clients JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", clientsJSON)
+}
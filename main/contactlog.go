@@ -0,0 +1,385 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	contactlog.go: Persistent log of every aircraft received, per flight session (one startup of stratux, see the
+		"startup" table of the flight database): first/last seen, closest and farthest distance, strongest signal and
+		the sources it was received from. Kept in memory for the current session and written to the
+		"traffic_contacts" table every TRAFFIC_CONTACT_FLUSH while the replay log (globalSettings.ReplayLog) is
+		enabled. Useful for range testing and for reviewing near encounters after a flight.
+
+		/getTrafficContacts lists the contacts of a session as JSON, or as CSV with "format=csv".
+		/getTrafficSessions summarizes all sessions.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TRAFFIC_CONTACT_FLUSH = 30 * time.Second
+)
+
+type TrafficContact struct {
+	StartupID      int64 // flight session, 0 for the current one before it is logged
+	Icao_addr      uint32
+	Addr_type      uint8
+	Reg            string
+	Tail           string
+	Sources        uint8 // TRAFFIC_SOURCE_* bit mask
+	TargetType     uint8 // last TARGET_TYPE_*
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	MinDistance    float64 // m, -1 if the distance was never known
+	MinDistAltDiff int32   // ft, target minus ownship at MinDistance, 0 if unknown
+	MaxDistance    float64 // m, -1 if the distance was never known
+	MaxSignal      float64 // dB
+	dirty          bool
+}
+
+// Response of /getTrafficSessions.
+type TrafficSession struct {
+	StartupID   int64
+	Current     bool
+	FirstSeen   time.Time
+	LastSeen    time.Time
+	Contacts    int
+	MinDistance float64 // m, closest approach of any contact, -1 if unknown
+	MaxDistance float64 // m, farthest reception
+}
+
+var trafficContacts = make(map[uint32]*TrafficContact) // current session
+var trafficContactsMutex sync.Mutex
+
+func openTrafficContactDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dataLogFilef)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS traffic_contacts (StartupID INTEGER NOT NULL, Icao_addr INTEGER NOT NULL, Addr_type INTEGER, Reg TEXT, Tail TEXT, Sources INTEGER, TargetType INTEGER, FirstSeen TEXT, LastSeen TEXT, MinDistance REAL, MinDistAltDiff INTEGER, MaxDistance REAL, MaxSignal REAL, PRIMARY KEY (StartupID, Icao_addr))")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Called from sendTrafficUpdates() for every current target that isn't ourselves.
+func updateTrafficContact(ti *TrafficInfo) {
+	trafficContactsMutex.Lock()
+	defer trafficContactsMutex.Unlock()
+	now := trafficEncounterTime()
+	c, ok := trafficContacts[ti.Icao_addr]
+	if !ok {
+		c = &TrafficContact{Icao_addr: ti.Icao_addr, FirstSeen: now, MinDistance: -1, MaxDistance: -1, MaxSignal: ti.SignalLevel}
+		trafficContacts[ti.Icao_addr] = c
+	}
+	c.LastSeen = now
+	c.Addr_type = ti.Addr_type
+	c.Sources |= ti.Last_source
+	c.TargetType = ti.TargetType
+	if len(ti.Reg) > 0 {
+		c.Reg = ti.Reg
+	}
+	if len(ti.Tail) > 0 {
+		c.Tail = ti.Tail
+	}
+	if ti.SignalLevel > c.MaxSignal {
+		c.MaxSignal = ti.SignalLevel
+	}
+	dist := -1.0
+	if ti.BearingDist_valid {
+		dist = ti.Distance
+	} else if ti.DistanceEstimated > 0 {
+		dist = ti.DistanceEstimated
+	}
+	if dist >= 0 {
+		if c.MinDistance < 0 || dist < c.MinDistance {
+			c.MinDistance = dist
+			c.MinDistAltDiff = 0
+			if ti.Alt != 0 && isGPSValid() {
+				c.MinDistAltDiff = int32(math.Round(float64(computeRelativeVertical(*ti)) / 0.3048))
+			}
+		}
+		if ti.BearingDist_valid && dist > c.MaxDistance { // estimated distances are useless for range tests
+			c.MaxDistance = dist
+		}
+	}
+	c.dirty = true
+}
+
+func flushTrafficContacts() (err error) {
+	startupID := stratuxStartupID
+	trafficContactsMutex.Lock()
+	dirty := make([]TrafficContact, 0)
+	for _, c := range trafficContacts {
+		if c.dirty {
+			c.StartupID = startupID
+			dirty = append(dirty, *c)
+			c.dirty = false
+		}
+	}
+	trafficContactsMutex.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	defer func() {
+		if err != nil { // try again with the next flush
+			trafficContactsMutex.Lock()
+			for _, c := range dirty {
+				trafficContacts[c.Icao_addr].dirty = true
+			}
+			trafficContactsMutex.Unlock()
+		}
+	}()
+
+	db, err := openTrafficContactDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, c := range dirty {
+		_, err = tx.Exec("INSERT OR REPLACE INTO traffic_contacts (StartupID, Icao_addr, Addr_type, Reg, Tail, Sources, TargetType, FirstSeen, LastSeen, MinDistance, MinDistAltDiff, MaxDistance, MaxSignal) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			c.StartupID, c.Icao_addr, c.Addr_type, c.Reg, c.Tail, c.Sources, c.TargetType, c.FirstSeen.Format(time.RFC3339),
+			c.LastSeen.Format(time.RFC3339), c.MinDistance, c.MinDistAltDiff, c.MaxDistance, c.MaxSignal)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func trafficContactWatcher() {
+	ticker := time.NewTicker(TRAFFIC_CONTACT_FLUSH)
+	for {
+		<-ticker.C
+		if !globalSettings.ReplayLog || !isDataLogReady() {
+			continue
+		}
+		if err := flushTrafficContacts(); err != nil {
+			logErrorf("contacts", "%s", err.Error())
+		}
+	}
+}
+
+func currentTrafficContacts() []TrafficContact {
+	trafficContactsMutex.Lock()
+	defer trafficContactsMutex.Unlock()
+	result := make([]TrafficContact, 0, len(trafficContacts))
+	for _, c := range trafficContacts {
+		r := *c
+		r.StartupID = stratuxStartupID
+		result = append(result, r)
+	}
+	return result
+}
+
+func loadTrafficContacts(startupID int64) ([]TrafficContact, error) {
+	result := make([]TrafficContact, 0)
+	if _, err := os.Stat(dataLogFilef); os.IsNotExist(err) {
+		return result, nil
+	}
+	db, err := openTrafficContactDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT StartupID, Icao_addr, Addr_type, Reg, Tail, Sources, TargetType, FirstSeen, LastSeen, MinDistance, MinDistAltDiff, MaxDistance, MaxSignal FROM traffic_contacts WHERE StartupID = ?", startupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TrafficContact
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&c.StartupID, &c.Icao_addr, &c.Addr_type, &c.Reg, &c.Tail, &c.Sources, &c.TargetType, &firstSeen, &lastSeen,
+			&c.MinDistance, &c.MinDistAltDiff, &c.MaxDistance, &c.MaxSignal); err != nil {
+			return nil, err
+		}
+		c.FirstSeen, _ = time.Parse(time.RFC3339, firstSeen)
+		c.LastSeen, _ = time.Parse(time.RFC3339, lastSeen)
+		result = append(result, c)
+	}
+	return result, rows.Err()
+}
+
+// Session summaries from the database, plus the current session from memory.
+func loadTrafficSessions() ([]TrafficSession, error) {
+	result := make([]TrafficSession, 0)
+	if _, err := os.Stat(dataLogFilef); err == nil {
+		db, err := openTrafficContactDB()
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+		rows, err := db.Query("SELECT StartupID, MIN(FirstSeen), MAX(LastSeen), COUNT(*), IFNULL(MIN(CASE WHEN MinDistance >= 0 THEN MinDistance END), -1), MAX(MaxDistance) FROM traffic_contacts WHERE StartupID != ? GROUP BY StartupID ORDER BY StartupID DESC", stratuxStartupID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var s TrafficSession
+			var firstSeen, lastSeen string
+			if err := rows.Scan(&s.StartupID, &firstSeen, &lastSeen, &s.Contacts, &s.MinDistance, &s.MaxDistance); err != nil {
+				return nil, err
+			}
+			s.FirstSeen, _ = time.Parse(time.RFC3339, firstSeen)
+			s.LastSeen, _ = time.Parse(time.RFC3339, lastSeen)
+			result = append(result, s)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	cur := TrafficSession{StartupID: stratuxStartupID, Current: true, MinDistance: -1, MaxDistance: -1}
+	for _, c := range currentTrafficContacts() {
+		if cur.Contacts == 0 || c.FirstSeen.Before(cur.FirstSeen) {
+			cur.FirstSeen = c.FirstSeen
+		}
+		if c.LastSeen.After(cur.LastSeen) {
+			cur.LastSeen = c.LastSeen
+		}
+		if c.MinDistance >= 0 && (cur.MinDistance < 0 || c.MinDistance < cur.MinDistance) {
+			cur.MinDistance = c.MinDistance
+		}
+		cur.MaxDistance = math.Max(cur.MaxDistance, c.MaxDistance)
+		cur.Contacts++
+	}
+	return append([]TrafficSession{cur}, result...), nil
+}
+
+func trafficSourceNames(sources uint8) string {
+	names := ""
+	for _, s := range []struct {
+		bit  uint8
+		name string
+	}{{TRAFFIC_SOURCE_1090ES, "1090ES"}, {TRAFFIC_SOURCE_UAT, "UAT"}, {TRAFFIC_SOURCE_OGN, "OGN"}, {TRAFFIC_SOURCE_AIS, "AIS"}} {
+		if sources&s.bit != 0 {
+			if len(names) > 0 {
+				names += "+"
+			}
+			names += s.name
+		}
+	}
+	return names
+}
+
+func writeTrafficContactsCSV(w http.ResponseWriter, contacts []TrafficContact) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", "attachment; filename=traffic_contacts.csv")
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"session", "icao", "addr_type", "reg", "tail", "sources", "target_type", "first_seen", "last_seen",
+		"min_distance_m", "min_dist_alt_diff_ft", "max_distance_m", "max_signal_db"})
+	for _, c := range contacts {
+		cw.Write([]string{
+			strconv.FormatInt(c.StartupID, 10),
+			fmt.Sprintf("%06X", c.Icao_addr),
+			strconv.Itoa(int(c.Addr_type)),
+			c.Reg,
+			c.Tail,
+			trafficSourceNames(c.Sources),
+			strconv.Itoa(int(c.TargetType)),
+			c.FirstSeen.Format(time.RFC3339),
+			c.LastSeen.Format(time.RFC3339),
+			fmt.Sprintf("%.0f", c.MinDistance),
+			strconv.Itoa(int(c.MinDistAltDiff)),
+			fmt.Sprintf("%.0f", c.MaxDistance),
+			fmt.Sprintf("%.1f", c.MaxSignal),
+		})
+	}
+	cw.Flush()
+}
+
+/*
+	handleTrafficContactsRequest().
+		Returns the contacts of a flight session, closest first. Optional parameters: "session" (startup ID, default
+		the current one), "icao" (hex address), "maxdist" (m, only contacts that came closer), "format=csv".
+*/
+func handleTrafficContactsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	q := r.URL.Query()
+
+	session := stratuxStartupID
+	if s := q.Get("session"); len(s) > 0 {
+		var err error
+		if session, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid session '%s'", s), http.StatusBadRequest)
+			return
+		}
+	}
+	var icao uint64
+	if s := q.Get("icao"); len(s) > 0 {
+		var err error
+		if icao, err = strconv.ParseUint(s, 16, 32); err != nil {
+			http.Error(w, fmt.Sprintf("invalid icao address '%s'", s), http.StatusBadRequest)
+			return
+		}
+	}
+	maxDist, _ := strconv.ParseFloat(q.Get("maxdist"), 64)
+
+	var contacts []TrafficContact
+	if session == stratuxStartupID {
+		contacts = currentTrafficContacts()
+	} else {
+		var err error
+		if contacts, err = loadTrafficContacts(session); err != nil {
+			logErrorf("contacts", "%s", err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	result := make([]TrafficContact, 0, len(contacts))
+	for _, c := range contacts {
+		if (icao == 0 || uint64(c.Icao_addr) == icao) && (maxDist <= 0 || (c.MinDistance >= 0 && c.MinDistance <= maxDist)) {
+			result = append(result, c)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if (result[i].MinDistance < 0) != (result[j].MinDistance < 0) {
+			return result[j].MinDistance < 0
+		}
+		return result[i].MinDistance < result[j].MinDistance
+	})
+
+	if q.Get("format") == "csv" {
+		writeTrafficContactsCSV(w, result)
+		return
+	}
+	setJSONHeaders(w)
+	resJSON, _ := json.Marshal(&result)
+	fmt.Fprintf(w, "%s\n", resJSON)
+}
+
+// AJAX call - /getTrafficSessions. Summary of all flight sessions with contacts, current first.
+func handleTrafficSessionsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	sessions, err := loadTrafficSessions()
+	if err != nil {
+		logErrorf("contacts", "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	resJSON, _ := json.Marshal(&sessions)
+	fmt.Fprintf(w, "%s\n", resJSON)
+}
@@ -5,6 +5,10 @@
 	as part of this header.
 
 	datalog.go: Log stratux data as it is received. Bucket data into timestamp time slots.
+		Rows are queued and written in one transaction every globalSettings.ReplayLogWriteInterval seconds. The WAL is
+		checkpointed every DATALOG_CHECKPOINT_INTERVAL instead of every few MB, to keep the writes to the SD card few
+		and large. With globalSettings.ReplayLogBufferFlight the rows stay in RAM while airborne (see
+		flightSmootherWatcher()) and are written after landing, unless there are more than DATALOG_BUFFER_MAX_ROWS.
 
 */
 
@@ -14,7 +18,6 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"os"
 	"reflect"
 	"strconv"
@@ -25,9 +28,16 @@ import (
 )
 
 const (
-	LOG_TIMESTAMP_RESOLUTION = 250 * time.Millisecond
+	LOG_TIMESTAMP_RESOLUTION    = 250 * time.Millisecond
+	DATALOG_CHECKPOINT_INTERVAL = 5 * time.Minute
+	DATALOG_BUFFER_MAX_ROWS     = 200000 // written while airborne anyway, to bound the RAM use
 )
 
+// *sql.DB or *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
 type StratuxTimestamp struct {
 	id                   int64
 	Time_type_preference int // 0 = stratuxClock, 1 = gpsClock, 2 = gpsClock extrapolated via stratuxClock.
@@ -222,7 +232,7 @@ func makeTable(i interface{}, tbl string, db *sql.DB) {
 		Reads insertBatch and insertBatchIfs. This is called after a group of insertData() calls.
 */
 
-func bulkInsert(tbl string, db *sql.DB) (res sql.Result, err error) {
+func bulkInsert(tbl string, db sqlExecer) (res sql.Result, err error) {
 	if _, ok := insertString[tbl]; !ok {
 		return nil, errors.New("no insert statement")
 	}
@@ -259,7 +269,7 @@ func bulkInsert(tbl string, db *sql.DB) (res sql.Result, err error) {
 		//      timeBatch := time.Since(timeInit)                                                                                                                     // debug
 		//      log.Printf("SQLite: bulkInserted %d rows to %s. Took %f msec to build and insert query. querySize=%d\n", i, tbl, 1000*timeBatch.Seconds(), querySize) // debug
 		if err != nil {
-			log.Printf("sqlite INSERT error: '%s'\n", err.Error())
+			logErrorf("datalog", "sqlite INSERT error: '%s'", err.Error())
 			return
 		}
 	}
@@ -282,7 +292,7 @@ func bulkInsert(tbl string, db *sql.DB) (res sql.Result, err error) {
 var insertString map[string]string // INSERT INTO tbl (col1, col2, ...) VALUES(?, ?, ...). Only for one value.
 var insertBatchIfs map[string][][]interface{}
 
-func insertData(i interface{}, tbl string, db *sql.DB, ts_num int64) int64 {
+func insertData(i interface{}, tbl string, db sqlExecer, ts_num int64) int64 {
 	val := reflect.ValueOf(i)
 
 	keys := make([]string, 0)
@@ -357,70 +367,138 @@ var shutdownDataLog chan bool
 var shutdownDataLogWriter chan bool
 
 var dataLogWriteChan chan DataLogRow
+var dataLogFlushChan chan chan bool // closes the channel once the queued rows are written, see flushDataLog()
+
+/*
+	writeDataLogRows().
+		Writes the queued rows in one transaction. Returns false if the transaction failed, the caller keeps the rows
+		for the next try.
+*/
+
+func writeDataLogRows(db *sql.DB, rows []DataLogRow) bool {
+	if len(rows) == 0 {
+		return true
+	}
+	timeStart := stratuxClock.Time
+	nRows := len(rows)
+	if globalSettings.DEBUG {
+		logDebugf("datalog", "Writing %d rows", nRows)
+	}
+	// Write the buffered rows. This will block while it is writing.
+	// Save the names of the tables affected so that we can run bulkInsert() on after the insertData() calls.
+	tblsAffected := make(map[string]bool)
+	// Start transaction.
+	tx, err := db.Begin()
+	if err != nil {
+		logErrorf("datalog", "db.Begin() error: %s", err.Error())
+		return false
+	}
+	for _, r := range rows {
+		tblsAffected[r.tbl] = true
+		insertData(r.data, r.tbl, tx, r.ts_num)
+	}
+	// Do the bulk inserts.
+	for tbl, _ := range tblsAffected {
+		bulkInsert(tbl, tx)
+	}
+	// Close the transaction.
+	if err := tx.Commit(); err != nil {
+		logErrorf("datalog", "tx.Commit() error, keeping %d rows for the next write: %s", nRows, err.Error())
+		return false
+	}
+	timeElapsed := stratuxClock.Since(timeStart)
+	if globalSettings.DEBUG {
+		rowsPerSecond := float64(nRows) / float64(timeElapsed.Seconds())
+		logDebugf("datalog", "Writing finished. %d rows in %.2f seconds (%.1f rows per second).", nRows, float64(timeElapsed.Seconds()), rowsPerSecond)
+	}
+	if timeElapsed.Seconds() > 10.0 && nRows < DATALOG_BUFFER_MAX_ROWS/10 { // a flight buffered in RAM takes its time
+		logWarnf("datalog", "WARNING! SQLite logging is behind. Last write took %.1f seconds.", float64(timeElapsed.Seconds()))
+		dataLogCriticalErr := fmt.Errorf("WARNING! SQLite logging is behind. Last write took %.1f seconds.\n", float64(timeElapsed.Seconds()))
+		addSystemError(dataLogCriticalErr)
+	}
+	return true
+}
+
+func checkpointDataLog(db *sql.DB) {
+	if _, err := db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		logInfof("datalog", "db.Exec('PRAGMA wal_checkpoint') err: %s", err.Error())
+	}
+}
 
 func dataLogWriter(db *sql.DB) {
 	dataLogWriteChan = make(chan DataLogRow, 10240)
+	dataLogFlushChan = make(chan chan bool)
 	shutdownDataLogWriter = make(chan bool)
 	// The write queue. As data comes in via dataLogChan, it is timestamped and stored.
-	//  When writeTicker comes up, the queue is emptied.
-	writeTicker := time.NewTicker(10 * time.Second)
+	//  It is emptied every ReplayLogWriteInterval, after landing if the flight is buffered, or on request.
+	writeTicker := time.NewTicker(1 * time.Second)
 	rowsQueuedForWrite := make([]DataLogRow, 0)
+	lastWrite := stratuxClock.Time
+	lastCheckpoint := stratuxClock.Time
 	for {
 		select {
 		case r := <-dataLogWriteChan:
 			// Accept timestamped row.
 			rowsQueuedForWrite = append(rowsQueuedForWrite, r)
 		case <-writeTicker.C:
-			//			for i := 0; i < 1000; i++ {
-			//				logSituation()
-			//			}
-			timeStart := stratuxClock.Time
-			nRows := len(rowsQueuedForWrite)
-			if globalSettings.DEBUG {
-				log.Printf("Writing %d rows\n", nRows)
+			buffering := globalSettings.ReplayLogBufferFlight && flightAirborne && len(rowsQueuedForWrite) < DATALOG_BUFFER_MAX_ROWS
+			if buffering || stratuxClock.Since(lastWrite) < time.Duration(globalSettings.ReplayLogWriteInterval)*time.Second {
+				break
 			}
-			// Write the buffered rows. This will block while it is writing.
-			// Save the names of the tables affected so that we can run bulkInsert() on after the insertData() calls.
-			tblsAffected := make(map[string]bool)
-			// Start transaction.
-			tx, err := db.Begin()
-			if err != nil {
-				log.Printf("db.Begin() error: %s\n", err.Error())
+			lastWrite = stratuxClock.Time
+			if !writeDataLogRows(db, rowsQueuedForWrite) {
+				// Retried at the next interval. Drop the oldest rows if the database stays unwritable.
+				if n := len(rowsQueuedForWrite); n > DATALOG_BUFFER_MAX_ROWS {
+					logWarnf("datalog", "dropping %d unwritten rows", n-DATALOG_BUFFER_MAX_ROWS)
+					rowsQueuedForWrite = rowsQueuedForWrite[n-DATALOG_BUFFER_MAX_ROWS:]
+				}
 				break // from select {}
 			}
-			for _, r := range rowsQueuedForWrite {
-				tblsAffected[r.tbl] = true
-				insertData(r.data, r.tbl, db, r.ts_num)
-			}
-			// Do the bulk inserts.
-			for tbl, _ := range tblsAffected {
-				bulkInsert(tbl, db)
-			}
-			// Close the transaction.
-			tx.Commit()
 			rowsQueuedForWrite = make([]DataLogRow, 0) // Zero the queue.
-			timeElapsed := stratuxClock.Since(timeStart)
-			if globalSettings.DEBUG {
-				rowsPerSecond := float64(nRows) / float64(timeElapsed.Seconds())
-				log.Printf("Writing finished. %d rows in %.2f seconds (%.1f rows per second).\n", nRows, float64(timeElapsed.Seconds()), rowsPerSecond)
+			if stratuxClock.Since(lastCheckpoint) >= DATALOG_CHECKPOINT_INTERVAL {
+				checkpointDataLog(db)
+				lastCheckpoint = stratuxClock.Time
 			}
-			if timeElapsed.Seconds() > 10.0 {
-				log.Printf("WARNING! SQLite logging is behind. Last write took %.1f seconds.\n", float64(timeElapsed.Seconds()))
-				dataLogCriticalErr := fmt.Errorf("WARNING! SQLite logging is behind. Last write took %.1f seconds.\n", float64(timeElapsed.Seconds()))
-				addSystemError(dataLogCriticalErr)
+		case done := <-dataLogFlushChan:
+			if writeDataLogRows(db, rowsQueuedForWrite) {
+				rowsQueuedForWrite = make([]DataLogRow, 0)
+				lastWrite = stratuxClock.Time
+				checkpointDataLog(db)
+				lastCheckpoint = stratuxClock.Time
 			}
+			close(done)
 		case <-shutdownDataLogWriter: // Received a message on the channel to initiate a graceful shutdown, and to command dataLog() to shut down
-			log.Printf("datalog.go: dataLogWriter() received shutdown message with rowsQueuedForWrite = %d\n", len(rowsQueuedForWrite))
+			logInfof("datalog", "datalog.go: dataLogWriter() received shutdown message with rowsQueuedForWrite = %d", len(rowsQueuedForWrite))
+			writeDataLogRows(db, rowsQueuedForWrite)
 			shutdownDataLog <- true
 			return
 		}
 	}
-	log.Printf("datalog.go: dataLogWriter() shutting down\n")
+	logInfof("datalog", "datalog.go: dataLogWriter() shutting down")
+}
+
+/*
+	flushDataLog().
+		Writes the queued rows now and waits until they are. Returns false if the data log isn't running.
+*/
+
+func flushDataLog() bool {
+	if !dataLogStarted {
+		return false
+	}
+	done := make(chan bool)
+	select {
+	case dataLogFlushChan <- done:
+	case <-time.After(5 * time.Second):
+		return false
+	}
+	<-done
+	return true
 }
 
 func dataLog() {
 	dataLogStarted = true
-	log.Printf("datalog.go: dataLog() started\n")
+	logInfof("datalog", "datalog.go: dataLog() started")
 	dataLogChan = make(chan DataLogRow, 10240)
 	shutdownDataLog = make(chan bool)
 	dataLogTimestamps = make([]StratuxTimestamp, 0)
@@ -438,28 +516,33 @@ func dataLog() {
 
 	if _, err := os.Stat(dataLogFilef); os.IsNotExist(err) {
 		createDatabase = true
-		log.Printf("creating new database '%s'.\n", dataLogFilef)
+		logInfof("datalog", "creating new database '%s'.", dataLogFilef)
 	}
 
 	db, err := sql.Open("sqlite3", dataLogFilef)
 	if err != nil {
-		log.Printf("sql.Open(): %s\n", err.Error())
+		logInfof("datalog", "sql.Open(): %s", err.Error())
 	}
 
 	defer func() {
 		db.Close()
 		dataLogStarted = false
 		//close(dataLogChan)
-		log.Printf("datalog.go: dataLog() has closed DB in %s\n", dataLogFilef)
+		logInfof("datalog", "datalog.go: dataLog() has closed DB in %s", dataLogFilef)
 	}()
 
 	_, err = db.Exec("PRAGMA journal_mode=WAL")
 	if err != nil {
-		log.Printf("db.Exec('PRAGMA journal_mode=WAL') err: %s\n", err.Error())
+		logInfof("datalog", "db.Exec('PRAGMA journal_mode=WAL') err: %s", err.Error())
 	}
 	_, err = db.Exec("PRAGMA synchronous=OFF")
 	if err != nil {
-		log.Printf("db.Exec('PRAGMA journal_mode=WAL') err: %s\n", err.Error())
+		logInfof("datalog", "db.Exec('PRAGMA journal_mode=WAL') err: %s", err.Error())
+	}
+	// Checkpoints are done by dataLogWriter().
+	_, err = db.Exec("PRAGMA wal_autocheckpoint=0")
+	if err != nil {
+		logInfof("datalog", "db.Exec('PRAGMA wal_autocheckpoint=0') err: %s", err.Error())
 	}
 
 	//log.Printf("Starting dataLogWriter\n") // REMOVE -- DEBUG
@@ -495,11 +578,11 @@ func dataLog() {
 			// Queue it for the scheduled write.
 			dataLogWriteChan <- r
 		case <-shutdownDataLog: // Received a message on the channel to complete a graceful shutdown (see the 'defer func()...' statement above).
-			log.Printf("datalog.go: dataLog() received shutdown message\n")
+			logInfof("datalog", "datalog.go: dataLog() received shutdown message")
 			return
 		}
 	}
-	log.Printf("datalog.go: dataLog() shutting down\n")
+	logInfof("datalog", "datalog.go: dataLog() shutting down")
 	close(shutdownDataLog)
 }
 
@@ -530,7 +613,7 @@ func setDataLogTimeWithGPS(sit SituationData) {
 */
 
 func isDataLogReady() bool {
-	return dataLogReadyToWrite
+	return dataLogReadyToWrite && !isFlightReplayRunning() // don't log a replayed flight again
 }
 
 func logSituation() {
@@ -607,11 +690,12 @@ func initDataLog() {
 
 func dataLogWatchdog() {
 	for {
-		if !dataLogStarted && globalSettings.ReplayLog { // case 1: sqlite logging isn't running, and we want to start it
-			log.Printf("datalog.go: Watchdog wants to START logging.\n")
+		wantLog := globalSettings.ReplayLog && !isUSBExportActive() // the log files are exported via USB, keep them closed
+		if !dataLogStarted && wantLog { // case 1: sqlite logging isn't running, and we want to start it
+			logInfof("datalog", "datalog.go: Watchdog wants to START logging.")
 			go dataLog()
-		} else if dataLogStarted && !globalSettings.ReplayLog { // case 2:  sqlite logging is running, and we want to shut it down
-			log.Printf("datalog.go: Watchdog wants to STOP logging.\n")
+		} else if dataLogStarted && !wantLog { // case 2:  sqlite logging is running, and we want to shut it down
+			logInfof("datalog", "datalog.go: Watchdog wants to STOP logging.")
 			closeDataLog()
 		}
 		//log.Printf("Watchdog iterated.\n") //REMOVE -- DEBUG
@@ -637,13 +721,13 @@ func dataLogWatchdog() {
 func closeDataLog() {
 	//log.Printf("closeDataLog(): dataLogStarted = %t\n", dataLogStarted) //REMOVE -- DEBUG
 	dataLogReadyToWrite = false // prevent any new messages from being sent down the channels
-	log.Printf("datalog.go: Starting data log shutdown\n")
+	logInfof("datalog", "datalog.go: Starting data log shutdown")
 	shutdownDataLogWriter <- true      //
 	defer close(shutdownDataLogWriter) // ... and close the channel so subsequent accidental writes don't stall execution
-	log.Printf("datalog.go: Waiting for shutdown signal from dataLog()")
+	logInfof("datalog", "datalog.go: Waiting for shutdown signal from dataLog()")
 	for dataLogStarted {
 		//log.Printf("closeDataLog(): dataLogStarted = %t\n", dataLogStarted) //REMOVE -- DEBUG
 		time.Sleep(50 * time.Millisecond)
 	}
-	log.Printf("datalog.go: Data log shutdown successful.\n")
+	logInfof("datalog", "datalog.go: Data log shutdown successful.")
 }
@@ -0,0 +1,363 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	debrief.go: Post-flight debrief. While the flight recorder (flightrecorder.go) records a flight, the debrief
+		collects the traffic encounters (targets within globalSettings.DebriefEncounterDistance and
+		DebriefEncounterAltitude, with their closest approach), the system alerts raised, the GPS and AHRS dropouts,
+		the undervoltage/throttling events (undervoltage.go) and a reception range polar per band (farthest target per
+		DEBRIEF_RANGE_SECTOR of true bearing). It is stored with the flight when the flight ends.
+			/getDebrief?id=<id>                   FlightDebrief of a recorded flight, the current one is live
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DEBRIEF_RANGE_SECTOR   = 10.0             // deg
+	DEBRIEF_ENCOUNTER_GAP  = 60 * time.Second // outside the thresholds this long ends an encounter
+	DEBRIEF_MAX_ENCOUNTERS = 500
+	DEBRIEF_MAX_ALERTS     = 200
+	DEBRIEF_MAX_DROPOUTS   = 200
+	DEBRIEF_MAX_POWER      = 200
+)
+
+type DebriefEncounter struct {
+	Icao_addr         uint32
+	Addr_type         uint8
+	Reg               string
+	Tail              string
+	TargetType        uint8
+	Sources           uint8 // TRAFFIC_SOURCE_* bits
+	Start             time.Time
+	End               time.Time
+	ClosestTime       time.Time
+	ClosestDistance   float64 // m, horizontal
+	DistanceEstimated bool    // from the signal strength, the target had no position
+	RelativeAltitude  int32   // ft at the closest approach, target minus ownship, only if AltitudeValid
+	AltitudeValid     bool
+	MaxAlertLevel     uint8   // TRAFFIC_ALERT_*
+	Lat               float32 // ownship at the closest approach
+	Lng               float32
+	Alt               float32 // ft MSL
+}
+
+type DebriefDropout struct {
+	Start   time.Time
+	End     time.Time
+	Seconds float64
+}
+
+type DebriefRange struct {
+	Band        string    // see trafficSourceNames()
+	Targets     int       // with a position
+	MaxDistance []float64 // m, per DEBRIEF_RANGE_SECTOR of true bearing from ownship starting north, 0 = nothing received
+}
+
+type FlightDebrief struct {
+	FlightID          int64
+	Start             time.Time
+	End               time.Time
+	Live              bool    // the current flight, not complete yet
+	EncounterDistance float64 // NM, the thresholds of the encounters
+	EncounterAltitude int     // ft
+	Encounters        []DebriefEncounter
+	Alerts            []SystemAlert // as raised
+	GPSDropouts       []DebriefDropout
+	AHRSDropouts      []DebriefDropout
+	PowerEvents       []PowerEvent
+	Range             []DebriefRange
+}
+
+type debriefState struct {
+	active     bool
+	debrief    FlightDebrief
+	encounters map[uint32]int // index of the open encounter of a target
+	ranges     map[uint8]*DebriefRange
+	targets    map[uint8]map[uint32]bool
+	gpsLost    time.Time // start of the current dropout, zero if none
+	ahrsLost   time.Time
+	ahrsSeen   bool // AHRS dropouts only count once it was valid
+}
+
+var debrief debriefState
+var debriefMutex sync.Mutex
+
+// Called from startFlight().
+func startDebrief(now time.Time) {
+	debriefMutex.Lock()
+	defer debriefMutex.Unlock()
+	debrief = debriefState{
+		active: true,
+		debrief: FlightDebrief{
+			Start:             now.UTC(),
+			End:               now.UTC(),
+			EncounterDistance: globalSettings.DebriefEncounterDistance,
+			EncounterAltitude: globalSettings.DebriefEncounterAltitude,
+			Encounters:        make([]DebriefEncounter, 0),
+			Alerts:            make([]SystemAlert, 0),
+			GPSDropouts:       make([]DebriefDropout, 0),
+			AHRSDropouts:      make([]DebriefDropout, 0),
+			PowerEvents:       make([]PowerEvent, 0),
+		},
+		encounters: make(map[uint32]int),
+		ranges:     make(map[uint8]*DebriefRange),
+		targets:    make(map[uint8]map[uint32]bool),
+	}
+}
+
+func addDebriefDropout(dropouts []DebriefDropout, start, end time.Time) []DebriefDropout {
+	if len(dropouts) >= DEBRIEF_MAX_DROPOUTS {
+		return dropouts
+	}
+	return append(dropouts, DebriefDropout{Start: start, End: end, Seconds: end.Sub(start).Seconds()})
+}
+
+// Checks for GPS and AHRS dropouts and ends the encounters. Called every second from flightRecorderWatcher().
+func updateDebrief(now time.Time) {
+	debriefMutex.Lock()
+	defer debriefMutex.Unlock()
+	if !debrief.active {
+		return
+	}
+	now = now.UTC()
+	d := &debrief.debrief
+	d.End = now
+	if !isGPSValid() && debrief.gpsLost.IsZero() {
+		debrief.gpsLost = now
+	} else if isGPSValid() && !debrief.gpsLost.IsZero() {
+		d.GPSDropouts = addDebriefDropout(d.GPSDropouts, debrief.gpsLost, now)
+		debrief.gpsLost = time.Time{}
+	}
+	ahrsValid := isAHRSValid()
+	debrief.ahrsSeen = debrief.ahrsSeen || ahrsValid
+	if debrief.ahrsSeen && !ahrsValid && debrief.ahrsLost.IsZero() {
+		debrief.ahrsLost = now
+	} else if ahrsValid && !debrief.ahrsLost.IsZero() {
+		d.AHRSDropouts = addDebriefDropout(d.AHRSDropouts, debrief.ahrsLost, now)
+		debrief.ahrsLost = time.Time{}
+	}
+	for addr, i := range debrief.encounters {
+		if now.Sub(d.Encounters[i].End) > DEBRIEF_ENCOUNTER_GAP {
+			delete(debrief.encounters, addr)
+		}
+	}
+}
+
+// Called from sendTrafficUpdates() for every current target that isn't ourselves.
+func updateDebriefTraffic(ti *TrafficInfo) {
+	debriefMutex.Lock()
+	defer debriefMutex.Unlock()
+	if !debrief.active {
+		return
+	}
+	now := time.Now().UTC()
+	d := &debrief.debrief
+
+	if ti.BearingDist_valid {
+		r, ok := debrief.ranges[ti.Last_source]
+		if !ok {
+			r = &DebriefRange{Band: trafficSourceNames(ti.Last_source), MaxDistance: make([]float64, int(360/DEBRIEF_RANGE_SECTOR))}
+			debrief.ranges[ti.Last_source] = r
+			debrief.targets[ti.Last_source] = make(map[uint32]bool)
+		}
+		if !debrief.targets[ti.Last_source][ti.Icao_addr] {
+			debrief.targets[ti.Last_source][ti.Icao_addr] = true
+			r.Targets++
+		}
+		sector := int(math.Mod(ti.Bearing+360, 360)/DEBRIEF_RANGE_SECTOR) % len(r.MaxDistance)
+		r.MaxDistance[sector] = math.Max(r.MaxDistance[sector], ti.Distance)
+	}
+
+	if ti.Duplicate {
+		return
+	}
+	dist, estimated := ti.Distance, false
+	if !ti.BearingDist_valid {
+		if ti.DistanceEstimated <= 0 {
+			return
+		}
+		dist, estimated = ti.DistanceEstimated, true
+	}
+	var relAlt int32
+	altValid := ti.Alt != 0 && isGPSValid()
+	if altValid {
+		relAlt = int32(math.Round(float64(computeRelativeVertical(*ti)) / 0.3048))
+	}
+	if dist > d.EncounterDistance*1852 || (altValid && math.Abs(float64(relAlt)) > float64(d.EncounterAltitude)) {
+		return
+	}
+
+	i, ok := debrief.encounters[ti.Icao_addr]
+	if !ok {
+		if len(d.Encounters) >= DEBRIEF_MAX_ENCOUNTERS {
+			return
+		}
+		d.Encounters = append(d.Encounters, DebriefEncounter{Icao_addr: ti.Icao_addr, Start: now, ClosestDistance: -1})
+		i = len(d.Encounters) - 1
+		debrief.encounters[ti.Icao_addr] = i
+	}
+	e := &d.Encounters[i]
+	e.End = now
+	e.Addr_type = ti.Addr_type
+	e.TargetType = ti.TargetType
+	e.Sources |= ti.Last_source
+	if len(ti.Reg) > 0 {
+		e.Reg = ti.Reg
+	}
+	if len(ti.Tail) > 0 {
+		e.Tail = ti.Tail
+	}
+	if ti.AlertLevel > e.MaxAlertLevel {
+		e.MaxAlertLevel = ti.AlertLevel
+	}
+	// A distance from the position beats an estimated one
+	if e.ClosestDistance < 0 || (e.DistanceEstimated && !estimated) || (e.DistanceEstimated == estimated && dist < e.ClosestDistance) {
+		e.ClosestTime = now
+		e.ClosestDistance = dist
+		e.DistanceEstimated = estimated
+		e.RelativeAltitude = relAlt
+		e.AltitudeValid = altValid
+		e.Lat = mySituation.GPSLatitude
+		e.Lng = mySituation.GPSLongitude
+		e.Alt = mySituation.GPSAltitudeMSL
+	}
+}
+
+// Called from raiseAlert() for every new alert.
+func debriefAlert(alert SystemAlert) {
+	debriefMutex.Lock()
+	defer debriefMutex.Unlock()
+	if !debrief.active || len(debrief.debrief.Alerts) >= DEBRIEF_MAX_ALERTS {
+		return
+	}
+	debrief.debrief.Alerts = append(debrief.debrief.Alerts, alert)
+}
+
+// Called from recordPowerEvent() for every change of the throttling flags.
+func debriefPowerEvent(e PowerEvent) {
+	debriefMutex.Lock()
+	defer debriefMutex.Unlock()
+	if !debrief.active || len(debrief.debrief.PowerEvents) >= DEBRIEF_MAX_POWER {
+		return
+	}
+	debrief.debrief.PowerEvents = append(debrief.debrief.PowerEvents, e)
+}
+
+// debriefMutex must be held.
+func currentDebrief() FlightDebrief {
+	d := debrief.debrief
+	d.Live = true
+	d.Encounters = append([]DebriefEncounter{}, d.Encounters...)
+	d.Alerts = append([]SystemAlert{}, d.Alerts...)
+	d.GPSDropouts = append([]DebriefDropout{}, d.GPSDropouts...)
+	d.AHRSDropouts = append([]DebriefDropout{}, d.AHRSDropouts...)
+	d.PowerEvents = append([]PowerEvent{}, d.PowerEvents...)
+	if !debrief.gpsLost.IsZero() {
+		d.GPSDropouts = addDebriefDropout(d.GPSDropouts, debrief.gpsLost, d.End)
+	}
+	if !debrief.ahrsLost.IsZero() {
+		d.AHRSDropouts = addDebriefDropout(d.AHRSDropouts, debrief.ahrsLost, d.End)
+	}
+	d.Range = make([]DebriefRange, 0, len(debrief.ranges))
+	for _, src := range []uint8{TRAFFIC_SOURCE_UAT, TRAFFIC_SOURCE_1090ES, TRAFFIC_SOURCE_OGN, TRAFFIC_SOURCE_AIS} {
+		if r, ok := debrief.ranges[src]; ok {
+			rc := *r
+			rc.MaxDistance = append([]float64{}, r.MaxDistance...)
+			d.Range = append(d.Range, rc)
+		}
+	}
+	return d
+}
+
+// Stores the debrief with the flight, called from endFlight() after the flight is written.
+func finishDebrief(f *RecordedFlight) error {
+	debriefMutex.Lock()
+	if !debrief.active {
+		debriefMutex.Unlock()
+		return nil
+	}
+	d := currentDebrief()
+	debrief = debriefState{}
+	debriefMutex.Unlock()
+
+	if f.ID == 0 {
+		return fmt.Errorf("debrief: flight was not written")
+	}
+	d.FlightID = f.ID
+	d.Live = false
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	_, err = db.Exec("INSERT OR REPLACE INTO flight_debriefs (FlightID, Debrief) VALUES(?, ?)", f.ID, string(data))
+	return err
+}
+
+// The debrief of a flight, the live one of the current flight. sql.ErrNoRows if there is none.
+func loadFlightDebrief(id int64) (FlightDebrief, error) {
+	flightRecorderMutex.Lock()
+	if flightRecorder.flight != nil && flightRecorder.flight.ID == id {
+		debriefMutex.Lock()
+		d := currentDebrief()
+		debriefMutex.Unlock()
+		flightRecorderMutex.Unlock()
+		d.FlightID = id
+		return d, nil
+	}
+	flightRecorderMutex.Unlock()
+
+	var d FlightDebrief
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return d, err
+	}
+	defer db.Close()
+	var data string
+	if err := db.QueryRow("SELECT Debrief FROM flight_debriefs WHERE FlightID = ?", id).Scan(&data); err != nil {
+		return d, err
+	}
+	err = json.Unmarshal([]byte(data), &d)
+	return d, err
+}
+
+// AJAX call - /getDebrief?id=<id>.
+func handleDebriefRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "id required", http.StatusBadRequest)
+		return
+	}
+	d, err := loadFlightDebrief(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, fmt.Sprintf("no debrief for flight %d", id), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debriefJSON, err := json.Marshal(d)
+	if err != nil {
+		logErrorf("debrief", "Error sending debrief JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", debriefJSON)
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	debugprof.go: Remote profiling endpoints for chasing performance problems on users' devices:
+		/debug/pprof/                    list of the available profiles
+		/debug/pprof/profile?seconds=N   CPU profile
+		/debug/pprof/trace?seconds=N     execution trace
+		/debug/pprof/<name>?debug=N      heap, allocs, goroutine, block, mutex, threadcreate
+		The output is compatible with "go tool pprof" and "go tool trace".
+
+		Only available while debug mode (globalSettings.DEBUG) is on and a password is set ("DebugProfPassword" in
+		/setSettings, only its hash is kept in globalSecrets).
+		Requests need HTTP basic auth with user "stratux" and that password, e.g.
+			go tool pprof http://stratux:<password>@192.168.10.1/debug/pprof/heap
+
+		net/http/pprof is not used on purpose: it registers unauthenticated handlers on the default mux.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEBUG_PROF_USER        = "stratux"
+	DEBUG_PROF_MAX_SECONDS = 120
+)
+
+// Only one CPU profile or trace can run at a time.
+var debugProfMutex sync.Mutex
+
+// Checks debug mode and the credentials. Writes the error response and returns false if access is denied.
+func debugProfAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if !globalSettings.DEBUG || len(globalSecrets.DebugProfPasswordHash) == 0 {
+		http.Error(w, "profiling is disabled", http.StatusForbidden)
+		return false
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != DEBUG_PROF_USER || !secretHashMatches(globalSecrets.DebugProfPasswordHash, pass) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="stratux profiling"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func debugProfSeconds(r *http.Request, def int) time.Duration {
+	sec, err := strconv.Atoi(r.URL.Query().Get("seconds"))
+	if err != nil || sec <= 0 {
+		sec = def
+	}
+	if sec > DEBUG_PROF_MAX_SECONDS {
+		sec = DEBUG_PROF_MAX_SECONDS
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// Write-only, an empty password disables profiling.
+func setDebugProfPassword(password string) {
+	if len(password) == 0 {
+		globalSecrets.DebugProfPasswordHash = ""
+	} else {
+		globalSecrets.DebugProfPasswordHash = secretHash(password)
+	}
+	saveSecrets()
+}
+
+func setDebugProfDownloadHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+	setNoCache(w)
+}
+
+// AJAX call - /debug/pprof/. Serves the profile index and the named profiles.
+func handleDebugProfRequest(w http.ResponseWriter, r *http.Request) {
+	if !debugProfAuthorized(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/debug/pprof/")
+	switch name {
+	case "":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "profile?seconds=N\ntrace?seconds=N\n")
+		for _, p := range pprof.Profiles() {
+			fmt.Fprintf(w, "%s (%d)\n", p.Name(), p.Count())
+		}
+	case "profile":
+		debugProfMutex.Lock()
+		defer debugProfMutex.Unlock()
+		setDebugProfDownloadHeaders(w, "profile")
+		if err := pprof.StartCPUProfile(w); err != nil { // fails if -cpuprofile is in use
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logInfof("debugprof", "CPU profile requested by %s", r.RemoteAddr)
+		time.Sleep(debugProfSeconds(r, 30))
+		pprof.StopCPUProfile()
+	case "trace":
+		debugProfMutex.Lock()
+		defer debugProfMutex.Unlock()
+		setDebugProfDownloadHeaders(w, "trace")
+		if err := trace.Start(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logInfof("debugprof", "execution trace requested by %s", r.RemoteAddr)
+		time.Sleep(debugProfSeconds(r, 5))
+		trace.Stop()
+	default:
+		p := pprof.Lookup(name)
+		if p == nil {
+			http.Error(w, fmt.Sprintf("unknown profile '%s'", name), http.StatusNotFound)
+			return
+		}
+		debug, _ := strconv.Atoi(r.URL.Query().Get("debug"))
+		if debug > 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			setNoCache(w)
+		} else {
+			setDebugProfDownloadHeaders(w, name)
+		}
+		p.WriteTo(w, debug)
+	}
+}
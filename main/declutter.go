@@ -0,0 +1,149 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	declutter.go: Label declutter hints for dense traffic scenes, sent along with every target on the traffic
+		and radar websockets, so simple clients don't need their own threat logic:
+		 - ThreatScore:   higher is more relevant. Based on distance, time/distance to closest point of approach and
+		                  relevance of the altitude band (globalSettings.TrafficPrio*). Also used to prioritize the
+		                  traffic output, see computeTrafficPriority().
+		 - LabelPriority: rank of the target by ThreatScore, 1 = most relevant. 0 if the target can't be ranked.
+		 - LabelShow:     true if the label should be drawn. At most TRAFFIC_LABEL_MAX labels are shown, and labels of
+		                  targets right next to a more relevant one are hidden.
+		 - LabelAngle:    suggested direction (deg, 0 = up/north) to place the label, away from the closest more
+		                  relevant target.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	TRAFFIC_LABEL_MAX          = 10     // max number of labels to show
+	TRAFFIC_LABEL_OVERLAP_DIST = 926.0  // m (0.5nm). Labels of less relevant targets closer than this to a shown one are hidden...
+	TRAFFIC_LABEL_OVERLAP_ALT  = 500.0  // ft ... if they are also vertically this close.
+)
+
+type labelCandidate struct {
+	key        uint32
+	score      float64
+	north      float64 // m from ownship
+	east       float64
+	alt        float64
+	shown      bool
+	labelAngle float64
+}
+
+// Cheap check if addr is one of our configured ownship addresses. Unlike isOwnshipTrafficInfo() this doesn't verify the position.
+func isOwnshipAddress(addr uint32) bool {
+	for _, code := range append(strings.Split(globalSettings.OwnshipModeS, ","), globalSettings.OGNAddr) {
+		if c, err := strconv.ParseUint(strings.TrimSpace(code), 16, 32); err == nil && uint32(c) == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Vertical relevance of a target, 1.0 within TrafficPrioAltBand down to 0.0 at TrafficPrioAltMax.
+func altitudeBandRelevance(ti *TrafficInfo, myAlt float32, myAltValid bool) float64 {
+	if ti.Alt == 0 || !myAltValid {
+		return 0.5 // unknown
+	}
+	altDiff := math.Abs(float64(ti.Alt) - float64(myAlt))
+	band, max := float64(globalSettings.TrafficPrioAltBand), float64(globalSettings.TrafficPrioAltMax)
+	if altDiff <= band {
+		return 1.0
+	}
+	if altDiff >= max {
+		return 0
+	}
+	return 1 - (altDiff-band)/(max-band)
+}
+
+// Ownship altitude for the threat assessment: pressure altitude, GPS altitude without a baro sensor.
+func threatOwnshipAltitude() (float32, bool) {
+	if isTempPressValid() {
+		return mySituation.BaroPressureAltitude, true
+	}
+	if isGPSValid() {
+		return mySituation.GPSAltitudeMSL, true
+	}
+	return 0, false
+}
+
+/*
+	computeThreatScore().
+		north/east is the target position relative to ownship (m).
+		Proximity contributes 1/(1+dist in nm), a predicted closest approach within TrafficPrioCPATime contributes up to 2.
+*/
+func computeThreatScore(ti *TrafficInfo, north, east float64, altRelevance float64) float64 {
+	dist := math.Sqrt(north*north + east*east)
+	score := 1.0 / (1.0 + dist/1852.0)
+
+	horizon := float64(globalSettings.TrafficPrioCPATime)
+	if tcpa, dcpa, ok := computeCPA(ti, north, east); ok && tcpa < horizon {
+		score += 2.0 * (1 - tcpa/horizon) / (1.0 + dcpa/1852.0)
+	}
+	return score * altRelevance
+}
+
+/*
+	updateTrafficLabelHints().
+		Called from sendTrafficUpdates() with trafficMutex held, before the targets are sent out.
+*/
+func updateTrafficLabelHints() {
+	myAlt, myAltValid := threatOwnshipAltitude()
+
+	candidates := make([]*labelCandidate, 0, len(traffic))
+	for key, ti := range traffic {
+		ti.ThreatScore, ti.LabelPriority, ti.LabelShow, ti.LabelAngle = 0, 0, false, 45
+		age := stratuxClock.Since(ti.Last_seen).Seconds()
+		isCurrent := isTrafficCurrent(&ti, age)
+		if isGPSValid() && ti.Position_valid && isCurrent && !ti.Duplicate && !ti.OwnshipShadow && !isOwnshipAddress(ti.Icao_addr) {
+			_, _, north, east := common.DistRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+			ti.ThreatScore = computeThreatScore(&ti, north, east, altitudeBandRelevance(&ti, myAlt, myAltValid))
+			candidates = append(candidates, &labelCandidate{key: key, score: ti.ThreatScore, north: north, east: east, alt: float64(ti.Alt)})
+		}
+		traffic[key] = ti
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	numShown := 0
+	for i, c := range candidates {
+		c.shown = numShown < TRAFFIC_LABEL_MAX
+		c.labelAngle = 45
+		closest := math.MaxFloat64
+		for _, other := range candidates[:i] {
+			dn, de := c.north-other.north, c.east-other.east
+			dist := math.Sqrt(dn*dn + de*de)
+			if dist < closest {
+				closest = dist
+				c.labelAngle = common.DegreesHdg(math.Atan2(de, dn)) // point away from the more relevant target
+			}
+			if other.shown && dist < TRAFFIC_LABEL_OVERLAP_DIST && math.Abs(c.alt-other.alt) < TRAFFIC_LABEL_OVERLAP_ALT {
+				c.shown = false
+			}
+		}
+		if c.shown {
+			numShown++
+		}
+
+		ti := traffic[c.key]
+		ti.LabelPriority = i + 1
+		ti.LabelShow = c.shown
+		ti.LabelAngle = int(c.labelAngle + 0.5) % 360
+		traffic[c.key] = ti
+	}
+}
@@ -0,0 +1,145 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	emittercategory.go: Emitter category (GDL90 numbering, as TrafficInfo.Emitter_category) symbology hints and
+		per-category traffic rules.
+		Every target gets a Symbol hint for displays ("light", "heavy", "helicopter", "glider", "balloon", "parachutist",
+		"hangglider", "uav", "space", "vehicle", "obstacle", "vessel" or "unknown").
+		globalSettings.TrafficCategoryRules is a list of rules, e.g.
+			[{"Categories": [3, 4, 5], "Action": "hide", "MinAlt": 18000},
+			 {"Categories": [14], "Action": "alert"}]
+		hides airliners above FL180 and always alerts on UAVs. Actions:
+			"hide":      the target is not sent to the EFB outputs and doesn't alert. The web UI still shows it.
+			"highlight": the GDL90 traffic alert bit is set and the target is always sent, even above TrafficMaxTargets.
+			"alert":     as highlight, and the target alerts (at least advisory) within TRAFFIC_CATEGORY_ALERT_DIST.
+		MinAlt/MaxAlt (ft, pressure or GNSS altitude as reported, 0 = no limit) restrict a rule to an altitude band.
+		The first matching rule applies.
+*/
+
+package main
+
+import (
+	"math"
+	"strconv"
+)
+
+const (
+	TRAFFIC_CATEGORY_ALERT_DIST = 3704.0 // m (2nm), "alert" targets closer than this alert ...
+	TRAFFIC_CATEGORY_ALERT_VERT = 1000.0 // ft, ... if within this vertical separation (or without altitude)
+)
+
+type TrafficCategoryRule struct {
+	Categories []uint8 // GDL90 emitter categories
+	Action     string  // "hide", "highlight" or "alert"
+	MinAlt     int     // ft, 0 = no lower limit
+	MaxAlt     int     // ft, 0 = no upper limit
+}
+
+var emitterCategorySymbols = map[uint8]string{
+	1:  "light",
+	2:  "light", // small
+	3:  "heavy", // large
+	4:  "heavy", // high vortex large
+	5:  "heavy",
+	6:  "light", // highly maneuverable
+	7:  "helicopter",
+	9:  "glider",
+	10: "balloon",
+	11: "parachutist",
+	12: "hangglider", // ultralight, hang glider, paraglider
+	14: "uav",
+	15: "space",
+	17: "vehicle", // surface emergency vehicle
+	18: "vehicle", // surface service vehicle
+	19: "obstacle",
+	20: "obstacle", // cluster obstacle
+	21: "obstacle", // line obstacle
+}
+
+// Emitter category from its ADS-B notation ("A7", "B1", ...) or as two hex digits in GDL90 numbering ("07", "09").
+func parseEmitterCategory(s string) (uint8, bool) {
+	if len(s) != 2 {
+		return 0, false
+	}
+	if s[0] >= 'A' && s[0] <= 'D' && s[1] >= '0' && s[1] <= '7' {
+		return (s[0]-'A')*8 + (s[1] - '0'), true // set A-D, category 0-7
+	}
+	v, err := strconv.ParseUint(s, 16, 8)
+	if err != nil || v >= 40 {
+		return 0, false
+	}
+	return uint8(v), true
+}
+
+// Symbology hint of a target, see file header.
+func emitterCategorySymbol(ti *TrafficInfo) string {
+	if ti.TargetType == TARGET_TYPE_AIS {
+		return "vessel"
+	}
+	if s, ok := emitterCategorySymbols[ti.Emitter_category]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// First rule of globalSettings.TrafficCategoryRules that applies to ti, nil if none.
+func matchTrafficCategoryRule(ti *TrafficInfo) *TrafficCategoryRule {
+	for i := range globalSettings.TrafficCategoryRules {
+		rule := &globalSettings.TrafficCategoryRules[i]
+		if (rule.MinAlt != 0 || rule.MaxAlt != 0) && ti.Alt == 0 {
+			continue // altitude unknown
+		}
+		if (rule.MinAlt != 0 && int(ti.Alt) < rule.MinAlt) || (rule.MaxAlt != 0 && int(ti.Alt) > rule.MaxAlt) {
+			continue
+		}
+		for _, cat := range rule.Categories {
+			if cat == ti.Emitter_category {
+				return rule
+			}
+		}
+	}
+	return nil
+}
+
+// Sets Symbol, Hidden and Highlight of a target. Called from sendTrafficUpdates() with trafficMutex held.
+func updateTrafficCategory(ti *TrafficInfo) {
+	ti.Symbol = emitterCategorySymbol(ti)
+	ti.Hidden, ti.Highlight, ti.categoryAlert = false, false, false
+	if rule := matchTrafficCategoryRule(ti); rule != nil {
+		switch rule.Action {
+		case "hide":
+			ti.Hidden = true
+		case "highlight":
+			ti.Highlight = true
+		case "alert":
+			ti.Highlight = true
+			ti.categoryAlert = true
+		}
+	}
+}
+
+// Raises the alert level of a close target with an "alert" rule to at least advisory, after updateTrafficAlert().
+func updateTrafficCategoryAlert(ti *TrafficInfo, relevant bool) {
+	if !relevant || !ti.categoryAlert || ti.AlertLevel >= TRAFFIC_ALERT_ADVISORY || !isGPSValid() {
+		return
+	}
+	dist := ti.DistanceEstimated
+	if ti.Position_valid {
+		if !ti.BearingDist_valid || !isTrafficCurrent(ti, ti.Age) {
+			return
+		}
+		dist = ti.Distance
+	} else if ti.Age >= TRAFFIC_BEARINGLESS_MAX_AGE {
+		return
+	}
+	if dist <= 0 || dist > TRAFFIC_CATEGORY_ALERT_DIST {
+		return
+	}
+	if ti.Alt != 0 && math.Abs(float64(computeRelativeVertical(*ti))/0.3048) > TRAFFIC_CATEGORY_ALERT_VERT {
+		return
+	}
+	ti.AlertLevel = TRAFFIC_ALERT_ADVISORY
+}
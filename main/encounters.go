@@ -0,0 +1,234 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	encounters.go: Per-target encounter statistics (first seen, last seen, number of encounters, closest distance),
+		kept across flights in the "traffic_encounters" table of the flight database. A target seen again after
+		more than TRAFFIC_ENCOUNTER_GAP without reception counts as a new encounter.
+
+		The statistics are loaded from the database on first use and written back every TRAFFIC_ENCOUNTER_FLUSH
+		while the replay log (globalSettings.ReplayLog) is enabled. Query with /getTrafficEncounters.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	TRAFFIC_ENCOUNTER_GAP   = 10 * time.Minute
+	TRAFFIC_ENCOUNTER_FLUSH = 30 * time.Second
+)
+
+type TrafficEncounter struct {
+	Icao_addr       uint32
+	Addr_type       uint8
+	Reg             string
+	Tail            string
+	FirstSeen       time.Time
+	LastSeen        time.Time
+	Encounters      int
+	ClosestDistance float64 // meters, 0 if the distance was never known
+	dirty           bool
+}
+
+var trafficEncounters map[uint32]*TrafficEncounter
+var trafficEncountersLoaded bool
+var trafficEncountersMutex sync.Mutex
+
+// Current time for encounter bookkeeping. GPS time if available, since the system clock may be unset.
+func trafficEncounterTime() time.Time {
+	if isGPSClockValid() {
+		return mySituation.GPSTime.UTC()
+	}
+	return time.Now().UTC()
+}
+
+func openTrafficEncounterDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", dataLogFilef)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS traffic_encounters (Icao_addr INTEGER NOT NULL PRIMARY KEY, Addr_type INTEGER, Reg TEXT, Tail TEXT, FirstSeen TEXT, LastSeen TEXT, Encounters INTEGER, ClosestDistance REAL)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Loads the stored statistics. Must be called with trafficEncountersMutex held.
+func loadTrafficEncounters() {
+	if trafficEncountersLoaded {
+		return
+	}
+	trafficEncounters = make(map[uint32]*TrafficEncounter)
+	if _, err := os.Stat(dataLogFilef); os.IsNotExist(err) {
+		trafficEncountersLoaded = true
+		return
+	}
+	db, err := openTrafficEncounterDB()
+	if err != nil {
+		logErrorf("encounters", "can't open %s: %s", dataLogFilef, err.Error())
+		return
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT Icao_addr, Addr_type, Reg, Tail, FirstSeen, LastSeen, Encounters, ClosestDistance FROM traffic_encounters")
+	if err != nil {
+		logErrorf("encounters", "%s", err.Error())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e TrafficEncounter
+		var firstSeen, lastSeen string
+		if err := rows.Scan(&e.Icao_addr, &e.Addr_type, &e.Reg, &e.Tail, &firstSeen, &lastSeen, &e.Encounters, &e.ClosestDistance); err != nil {
+			logErrorf("encounters", "%s", err.Error())
+			continue
+		}
+		e.FirstSeen, _ = time.Parse(time.RFC3339, firstSeen)
+		e.LastSeen, _ = time.Parse(time.RFC3339, lastSeen)
+		trafficEncounters[e.Icao_addr] = &e
+	}
+	trafficEncountersLoaded = true
+	logInfof("encounters", "loaded statistics for %d targets", len(trafficEncounters))
+}
+
+// Called from sendTrafficUpdates() for every current, non-ownship target.
+func updateTrafficEncounter(ti *TrafficInfo) {
+	trafficEncountersMutex.Lock()
+	defer trafficEncountersMutex.Unlock()
+	if !trafficEncountersLoaded {
+		return
+	}
+	now := trafficEncounterTime()
+	e, ok := trafficEncounters[ti.Icao_addr]
+	if !ok {
+		e = &TrafficEncounter{Icao_addr: ti.Icao_addr, FirstSeen: now}
+		trafficEncounters[ti.Icao_addr] = e
+	}
+	if !ok || now.Sub(e.LastSeen) > TRAFFIC_ENCOUNTER_GAP {
+		e.Encounters++
+	}
+	e.LastSeen = now
+	e.Addr_type = ti.Addr_type
+	if len(ti.Reg) > 0 {
+		e.Reg = ti.Reg
+	}
+	if len(ti.Tail) > 0 {
+		e.Tail = ti.Tail
+	}
+	if ti.BearingDist_valid && (e.ClosestDistance == 0 || ti.Distance < e.ClosestDistance) {
+		e.ClosestDistance = ti.Distance
+	}
+	e.dirty = true
+}
+
+func flushTrafficEncounters() (err error) {
+	trafficEncountersMutex.Lock()
+	dirty := make([]TrafficEncounter, 0)
+	for _, e := range trafficEncounters {
+		if e.dirty {
+			dirty = append(dirty, *e)
+			e.dirty = false
+		}
+	}
+	trafficEncountersMutex.Unlock()
+	if len(dirty) == 0 {
+		return nil
+	}
+	defer func() {
+		if err != nil { // try again with the next flush
+			trafficEncountersMutex.Lock()
+			for _, e := range dirty {
+				trafficEncounters[e.Icao_addr].dirty = true
+			}
+			trafficEncountersMutex.Unlock()
+		}
+	}()
+
+	db, err := openTrafficEncounterDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, e := range dirty {
+		_, err = tx.Exec("INSERT OR REPLACE INTO traffic_encounters (Icao_addr, Addr_type, Reg, Tail, FirstSeen, LastSeen, Encounters, ClosestDistance) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+			e.Icao_addr, e.Addr_type, e.Reg, e.Tail, e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), e.Encounters, e.ClosestDistance)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func trafficEncounterWatcher() {
+	ticker := time.NewTicker(TRAFFIC_ENCOUNTER_FLUSH)
+	for {
+		<-ticker.C
+		if !globalSettings.ReplayLog || !isDataLogReady() {
+			continue
+		}
+		trafficEncountersMutex.Lock()
+		loadTrafficEncounters()
+		trafficEncountersMutex.Unlock()
+		if err := flushTrafficEncounters(); err != nil {
+			logErrorf("encounters", "%s", err.Error())
+		}
+	}
+}
+
+/*
+	handleTrafficEncountersRequest().
+		Returns the encounter statistics as JSON, most frequently seen targets first.
+		Optional parameters: "icao" (hex address) to select a single target, "min" for the minimum number of encounters.
+*/
+func handleTrafficEncountersRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+
+	var icao uint64
+	if s := r.URL.Query().Get("icao"); len(s) > 0 {
+		var err error
+		if icao, err = strconv.ParseUint(s, 16, 32); err != nil {
+			http.Error(w, fmt.Sprintf("invalid icao address '%s'", s), http.StatusBadRequest)
+			return
+		}
+	}
+	minEncounters, _ := strconv.Atoi(r.URL.Query().Get("min"))
+
+	trafficEncountersMutex.Lock()
+	loadTrafficEncounters()
+	result := make([]TrafficEncounter, 0)
+	for _, e := range trafficEncounters {
+		if (icao == 0 || uint64(e.Icao_addr) == icao) && e.Encounters >= minEncounters {
+			result = append(result, *e)
+		}
+	}
+	trafficEncountersMutex.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Encounters != result[j].Encounters {
+			return result[i].Encounters > result[j].Encounters
+		}
+		return result[i].LastSeen.After(result[j].LastSeen)
+	})
+	resJSON, _ := json.Marshal(&result)
+	fmt.Fprintf(w, "%s\n", resJSON)
+}
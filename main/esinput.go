@@ -0,0 +1,162 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	esinput.go: 1090ES input from an external decoder or receiver (dump1090/readsb, Mode-S Beast, AirSquitter, ...),
+		configured as "host:port" in globalSettings.ES_NetInput, format in ES_NetInputFormat:
+			beast: Beast binary (dump1090/readsb port 30005, Mode-S Beast), with signal level and 12MHz timestamps
+			avr:   AVR text, "*8D4840D6202CC371C32CE0576098;" or with timestamp "@...", (dump1090/readsb port 30002)
+		The frames are relayed to a dump1090 of our own in --net-only mode, which decodes them exactly like the frames
+		of a local dongle (signal level and timestamps included) and hands them to the traffic pipeline on its stratux
+		port, and to the Beast output (beastoutput.go). Works with or without a local 1090 dongle.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const (
+	ES_INPUT_BEAST_PORT   = 30114 // dump1090 inputs, local only
+	ES_INPUT_AVR_PORT     = 30111
+	ES_INPUT_STRATUX_PORT = 30016
+	ES_INPUT_TIMEOUT      = 5 * time.Second
+	ES_INPUT_MAX_BACKOFF  = 30 * time.Second
+	ES_INPUT_FORMAT_BEAST = "beast"
+	ES_INPUT_FORMAT_AVR   = "avr"
+)
+
+func esNetworkInputEnabled() bool {
+	return len(globalSettings.ES_NetInput) > 0
+}
+
+func esNetworkInput() {
+	go dump1090Listen("127.0.0.1:"+strconv.Itoa(ES_INPUT_STRATUX_PORT), esNetworkInputEnabled)
+	for {
+		if !esNetworkInputEnabled() {
+			removeSingleSystemError("esinput")
+			time.Sleep(1 * time.Second)
+			continue
+		}
+		runESNetworkInput(globalSettings.ES_NetInput, globalSettings.ES_NetInputFormat)
+	}
+}
+
+/*
+	runESNetworkInput().
+		Runs the decoder and relays the frames from addr until the settings change or the decoder dies.
+		Connection problems are shown as system error "esinput", reconnecting with increasing delays.
+*/
+func runESNetworkInput(addr, format string) {
+	changed := func() bool {
+		return globalSettings.ES_NetInput != addr || globalSettings.ES_NetInputFormat != format
+	}
+
+	cmd := exec.Command(STRATUX_HOME+"/bin/dump1090", "--net-only", "--net-bind-address", "127.0.0.1",
+		"--net-bi-port", strconv.Itoa(ES_INPUT_BEAST_PORT), "--net-ri-port", strconv.Itoa(ES_INPUT_AVR_PORT),
+		"--net-ro-port", "0", "--net-bo-port", strconv.Itoa(ES_INPUT_BEAST_OUT), "--net-sbs-port", "0",
+		"--net-stratux-port", strconv.Itoa(ES_INPUT_STRATUX_PORT))
+	if err := cmd.Start(); err != nil {
+		logErrorf("esinput", "Error executing %s/bin/dump1090: %s", STRATUX_HOME, err)
+		addSingleSystemErrorf("esinput", "1090ES network input: can't start dump1090: %s", err)
+		time.Sleep(ES_INPUT_MAX_BACKOFF)
+		return
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	decoderPort := ES_INPUT_BEAST_PORT
+	if format == ES_INPUT_FORMAT_AVR {
+		decoderPort = ES_INPUT_AVR_PORT
+	}
+	var decoder net.Conn
+	var err error
+	for i := 0; i < 10; i++ { // give dump1090 some time to open its ports
+		time.Sleep(500 * time.Millisecond)
+		if decoder, err = net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(decoderPort)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		logInfof("esinput", "1090ES network input: dump1090 input port: %s", err)
+		return
+	}
+	defer decoder.Close()
+
+	backoff := time.Second
+	for !changed() {
+		src, err := net.DialTimeout("tcp", addr, ES_INPUT_TIMEOUT)
+		if err != nil {
+			logInfof("esinput", "1090ES network input %s: %s, retrying in %s", addr, err, backoff)
+			addSingleSystemErrorf("esinput", "1090ES network input %s not reachable: %s", addr, err)
+			for t := time.Duration(0); t < backoff && !changed(); t += time.Second {
+				time.Sleep(time.Second)
+			}
+			if backoff *= 2; backoff > ES_INPUT_MAX_BACKOFF {
+				backoff = ES_INPUT_MAX_BACKOFF
+			}
+			continue
+		}
+		logInfof("esinput", "1090ES network input: connected to %s (%s)", addr, format)
+		removeSingleSystemError("esinput")
+		backoff = time.Second
+
+		done := make(chan bool)
+		go func() { // interrupt the blocking read when the settings change
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(time.Second):
+					if changed() {
+						src.Close()
+						return
+					}
+				}
+			}
+		}()
+		err = relayESInput(src, decoder)
+		close(done)
+		src.Close()
+		if decoderErr, ok := err.(esDecoderError); ok {
+			logWarnf("esinput", "1090ES network input: dump1090: %s, restarting", decoderErr.err)
+			return
+		}
+		if !changed() {
+			logInfof("esinput", "1090ES network input %s: %s, reconnecting", addr, err)
+		}
+	}
+}
+
+type esDecoderError struct {
+	err error
+}
+
+func (e esDecoderError) Error() string {
+	return fmt.Sprintf("decoder: %s", e.err)
+}
+
+// Copies everything from src to the decoder. A failing write is returned as esDecoderError.
+func relayESInput(src, decoder net.Conn) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := decoder.Write(buf[:n]); werr != nil {
+				return esDecoderError{werr}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	fanstatus.go: Settings and status of the fan control daemon (fancontrol_main). The daemon reads its settings from
+		the same configuration file, gets SIGUSR1 when they change and serves its state as JSON on FAN_STATUS_URL.
+		The duty cycle, the tachometer RPM and fan failures are reported in the system health (/status/system).
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	FAN_MODE_PID   = "pid"
+	FAN_MODE_CURVE = "curve"
+
+	FAN_STATUS_URL     = "http://localhost:9977/"
+	FAN_STATUS_TIMEOUT = 2 * time.Second
+	FAN_CURVE_POINTS   = 8 // at most
+)
+
+type FanCurvePoint struct {
+	Temp float64 // deg C
+	Duty float64 // %
+}
+
+// The same as the daemon's defaults.
+var defaultFanCurve = []FanCurvePoint{{45, 0}, {50, 30}, {60, 70}, {65, 100}}
+
+type FanStatus struct {
+	Mode       string
+	TempTarget float64 // deg C, "pid" mode
+	Duty       int     // %
+	RPM        int     // -1 = no tachometer
+	Failure    bool    // no tachometer pulses while the fan should be running
+}
+
+var fanStatus *FanStatus // nil if the daemon isn't running
+var fanStatusMutex sync.Mutex
+
+// Duty cycle points of the FanCurve setting, sorted by temperature. nil if there is no valid point.
+func parseFanCurve(v interface{}) []FanCurvePoint {
+	points, _ := v.([]interface{})
+	curve := make([]FanCurvePoint, 0, len(points))
+	for _, p := range points {
+		m, _ := p.(map[string]interface{})
+		temp, okTemp := m["Temp"].(float64)
+		duty, okDuty := m["Duty"].(float64)
+		if !okTemp || !okDuty || temp < 0 || temp > 100 {
+			continue
+		}
+		curve = append(curve, FanCurvePoint{temp, math.Max(0, math.Min(100, math.Round(duty)))})
+		if len(curve) == FAN_CURVE_POINTS {
+			break
+		}
+	}
+	if len(curve) == 0 {
+		return nil
+	}
+	sort.Slice(curve, func(i, j int) bool { return curve[i].Temp < curve[j].Temp })
+	return curve
+}
+
+// Asks the daemon for its state, nil if it isn't running (no fan configured, or not a Pi).
+func readFanStatus() *FanStatus {
+	client := &http.Client{Timeout: FAN_STATUS_TIMEOUT}
+	resp, err := client.Get(FAN_STATUS_URL)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	var daemon struct {
+		FanControlMode string
+		TempTarget     float64
+		PWMDutyCurrent int
+		RPM            int
+		FanFailure     bool
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&daemon); err != nil {
+		return nil
+	}
+	return &FanStatus{
+		Mode:       daemon.FanControlMode,
+		TempTarget: daemon.TempTarget,
+		Duty:       daemon.PWMDutyCurrent,
+		RPM:        daemon.RPM,
+		Failure:    daemon.FanFailure,
+	}
+}
+
+// Called from systemHealthMonitor(). A failed fan is raised as alert.
+func updateFanStatus() {
+	status := readFanStatus()
+	fanStatusMutex.Lock()
+	fanStatus = status
+	fanStatusMutex.Unlock()
+	if status == nil {
+		clearAlert("fan-failure")
+		return
+	}
+	setAlert(status.Failure, "fan-failure", ALERT_WARNING, "system", "Cooling fan failure: not turning at %d%% duty cycle",
+		status.Duty)
+}
+
+func getFanStatus() *FanStatus {
+	fanStatusMutex.Lock()
+	defer fanStatusMutex.Unlock()
+	if fanStatus == nil {
+		return nil
+	}
+	s := *fanStatus
+	return &s
+}
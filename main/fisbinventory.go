@@ -0,0 +1,275 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	fisbinventory.go: Inventory of the FIS-B products received from every ground station, and their completeness.
+		Every product is uplinked completely within its look-back period (fisbProducts, fisbTextProducts). A product is
+		"acquiring" during its first look-back period, "stale" when nothing was received for two periods, otherwise
+		"complete". For NEXRAD, every block (including the empty ones) is sent once per period. The blocks received
+		in the last period are compared with those received in the last FISB_NEXRAD_EXPECTED periods, missing blocks
+		make the product "incomplete" and Completeness tells how much of the mosaic is current.
+		/getFISBStatus returns the products per ground station and a summary per product over all of them, with the
+		NEXRAD blocks of all ground stations combined.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+const (
+	FISB_NEXRAD_EXPECTED = 3                // look-back periods a NEXRAD block is expected again
+	FISB_TOWER_MAX_AGE   = 30 * time.Minute // ground stations not received for this long are dropped
+
+	FISB_STATUS_COMPLETE   = "complete"
+	FISB_STATUS_INCOMPLETE = "incomplete"
+	FISB_STATUS_ACQUIRING  = "acquiring"
+	FISB_STATUS_STALE      = "stale"
+)
+
+type fisbProductInfo struct {
+	name     string
+	lookBack time.Duration
+}
+
+// Look-back periods of the products, DO-358.
+var fisbProducts = map[uint32]fisbProductInfo{
+	8:   {"NOTAM", 10 * time.Minute},
+	11:  {"AIRMET", 5 * time.Minute},
+	12:  {"SIGMET", 5 * time.Minute},
+	13:  {"SUA", 10 * time.Minute},
+	14:  {"G-AIRMET", 5 * time.Minute},
+	15:  {"CWA", 5 * time.Minute},
+	63:  {"NEXRAD Regional", 150 * time.Second},
+	64:  {"NEXRAD CONUS", 15 * time.Minute},
+	70:  {"Icing", 15 * time.Minute},
+	71:  {"Icing", 15 * time.Minute},
+	84:  {"Cloud Tops", 15 * time.Minute},
+	90:  {"Turbulence", 15 * time.Minute},
+	91:  {"Turbulence", 15 * time.Minute},
+	103: {"Lightning", 5 * time.Minute},
+}
+
+// Text reports (product 413) by their type.
+var fisbTextProducts = map[string]fisbProductInfo{
+	"METAR": {"METAR", 5 * time.Minute},
+	"SPECI": {"METAR", 5 * time.Minute},
+	"TAF":   {"TAF", 10 * time.Minute},
+	"WINDS": {"Winds Aloft", 10 * time.Minute},
+	"PIREP": {"PIREP", 10 * time.Minute},
+}
+
+type fisbBlockKey struct {
+	scale    int
+	latNorth float64
+	lonWest  float64
+}
+
+type fisbProduct struct {
+	info     fisbProductInfo
+	first    time.Time // stratuxClock
+	last     time.Time
+	messages uint64
+	blocks   map[fisbBlockKey]time.Time // NEXRAD, last reception of every block
+}
+
+type fisbTower struct {
+	lat, lng float64
+	lastSeen time.Time
+	products map[string]*fisbProduct
+}
+
+type FISBProductStatus struct {
+	Product        string
+	LookBack       float64 // s
+	Age            float64 // s since the last reception
+	Messages       uint64
+	Blocks         int `json:",omitempty"` // NEXRAD: blocks received in the last look-back period ...
+	BlocksExpected int `json:",omitempty"` // ... of the blocks received in the last FISB_NEXRAD_EXPECTED periods
+	Completeness   int // %
+	Status         string
+}
+
+type FISBTowerStatus struct {
+	Lat      float64
+	Lng      float64
+	Products []FISBProductStatus
+}
+
+// Response of /getFISBStatus.
+type FISBStatus struct {
+	Towers   map[string]FISBTowerStatus // same keys as /getTowers
+	Products []FISBProductStatus        // best of all ground stations
+}
+
+var fisbTowers = make(map[string]*fisbTower)
+var fisbInventoryMutex = &sync.Mutex{}
+
+func registerFISBProduct(t *fisbTower, info fisbProductInfo) *fisbProduct {
+	p, ok := t.products[info.name]
+	if !ok {
+		p = &fisbProduct{info: info, first: stratuxClock.Time}
+		t.products[info.name] = p
+	}
+	p.last = stratuxClock.Time
+	p.messages++
+	return p
+}
+
+// Called for every decoded FIS-B frame from parseInput().
+func updateFISBInventory(towerid string, lat, lng float64, f *uatparse.UATFrame) {
+	fisbInventoryMutex.Lock()
+	defer fisbInventoryMutex.Unlock()
+	t, ok := fisbTowers[towerid]
+	if !ok {
+		t = &fisbTower{lat: lat, lng: lng, products: make(map[string]*fisbProduct)}
+		fisbTowers[towerid] = t
+	}
+	t.lastSeen = stratuxClock.Time
+
+	if f.Product_id == 413 {
+		for _, text := range f.Text_data {
+			if info, ok := fisbTextProducts[strings.SplitN(text, " ", 2)[0]]; ok {
+				registerFISBProduct(t, info)
+			}
+		}
+	} else if info, ok := fisbProducts[f.Product_id]; ok && f.Frame_type == 0 {
+		p := registerFISBProduct(t, info)
+		if len(f.NEXRAD) > 0 {
+			if p.blocks == nil {
+				p.blocks = make(map[fisbBlockKey]time.Time)
+			}
+			for _, b := range f.NEXRAD {
+				p.blocks[fisbBlockKey{b.Scale, b.LatNorth, b.LonWest}] = stratuxClock.Time
+			}
+			for key, last := range p.blocks {
+				if stratuxClock.Since(last) > FISB_NEXRAD_EXPECTED*p.info.lookBack {
+					delete(p.blocks, key)
+				}
+			}
+		}
+	}
+
+	for id, old := range fisbTowers {
+		if stratuxClock.Since(old.lastSeen) > FISB_TOWER_MAX_AGE {
+			delete(fisbTowers, id)
+		}
+	}
+}
+
+// Whether any ground station was received within d.
+func isFISBReceived(d time.Duration) bool {
+	fisbInventoryMutex.Lock()
+	defer fisbInventoryMutex.Unlock()
+	for _, t := range fisbTowers {
+		if stratuxClock.Since(t.lastSeen) < d {
+			return true
+		}
+	}
+	return false
+}
+
+// Status of a product from its reception times and (NEXRAD) blocks.
+func makeFISBProductStatus(info fisbProductInfo, first, last time.Time, messages uint64, blocks map[fisbBlockKey]time.Time) FISBProductStatus {
+	s := FISBProductStatus{Product: info.name, LookBack: info.lookBack.Seconds(), Age: stratuxClock.Since(last).Seconds(),
+		Messages: messages, Completeness: 100, Status: FISB_STATUS_COMPLETE}
+	if blocks != nil {
+		for _, t := range blocks {
+			if stratuxClock.Since(t) <= FISB_NEXRAD_EXPECTED*info.lookBack {
+				s.BlocksExpected++
+				if stratuxClock.Since(t) <= info.lookBack {
+					s.Blocks++
+				}
+			}
+		}
+		if s.BlocksExpected > 0 {
+			s.Completeness = 100 * s.Blocks / s.BlocksExpected
+		}
+		if s.Blocks < s.BlocksExpected {
+			s.Status = FISB_STATUS_INCOMPLETE
+		}
+	}
+	if stratuxClock.Since(last) > 2*info.lookBack {
+		s.Status, s.Completeness = FISB_STATUS_STALE, 0
+	} else if stratuxClock.Since(first) < info.lookBack {
+		s.Status = FISB_STATUS_ACQUIRING
+	}
+	return s
+}
+
+// Status of all ground stations and the summary per product. Requires fisbInventoryMutex.
+func getFISBStatus() FISBStatus {
+	status := FISBStatus{Towers: make(map[string]FISBTowerStatus), Products: make([]FISBProductStatus, 0)}
+	type combined struct {
+		info        fisbProductInfo
+		first, last time.Time
+		messages    uint64
+		blocks      map[fisbBlockKey]time.Time
+	}
+	products := make(map[string]*combined)
+	for id, t := range fisbTowers {
+		ts := FISBTowerStatus{Lat: t.lat, Lng: t.lng, Products: make([]FISBProductStatus, 0)}
+		for name, p := range t.products {
+			ts.Products = append(ts.Products, makeFISBProductStatus(p.info, p.first, p.last, p.messages, p.blocks))
+
+			c, ok := products[name]
+			if !ok {
+				c = &combined{info: p.info, first: p.first, last: p.last}
+				products[name] = c
+			}
+			if p.first.Before(c.first) {
+				c.first = p.first
+			}
+			if p.last.After(c.last) {
+				c.last = p.last
+			}
+			c.messages += p.messages
+			if p.blocks != nil {
+				if c.blocks == nil {
+					c.blocks = make(map[fisbBlockKey]time.Time)
+				}
+				for key, last := range p.blocks {
+					if last.After(c.blocks[key]) {
+						c.blocks[key] = last
+					}
+				}
+			}
+		}
+		sort.Slice(ts.Products, func(i, j int) bool { return ts.Products[i].Product < ts.Products[j].Product })
+		status.Towers[id] = ts
+	}
+
+	for _, c := range products {
+		// Reception times of the best ground station, NEXRAD blocks of all of them
+		s := makeFISBProductStatus(c.info, c.first, c.last, c.messages, c.blocks)
+		status.Products = append(status.Products, s)
+	}
+	sort.Slice(status.Products, func(i, j int) bool { return status.Products[i].Product < status.Products[j].Product })
+	return status
+}
+
+// AJAX call - /getFISBStatus. FIS-B products per ground station and their completeness.
+func handleFISBStatusRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	fisbInventoryMutex.Lock()
+	status := getFISBStatus()
+	fisbInventoryMutex.Unlock()
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("fisb", "Error sending FIS-B status JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
@@ -15,7 +15,6 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"math"
 	"strconv"
 	"strings"
@@ -51,8 +50,11 @@ func makeFlarmPFLAUString(ti TrafficInfo) (msg string) {
 	}
 
 	dist, bearing, _, _ := common.DistRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	if !ti.Position_valid && ti.DistanceEstimated > 0 {
+		dist = ti.DistanceEstimated
+	}
 	relativeVertical := computeRelativeVertical(ti)
-	alarmLevel := computeAlarmLevel(dist, relativeVertical)
+	alarmLevel := ti.AlertLevel
 
 	// make bearing relative to ground track, with +-180deg
 	bearing = bearing - float64(mySituation.GPSTrueCourse)
@@ -73,7 +75,10 @@ func makeFlarmPFLAUString(ti TrafficInfo) (msg string) {
 		idstr += "!" + ti.Tail
 	}
 	// TODO: we are always airbourne for now
-	if alarmLevel > 0 {
+	if alarmLevel > 0 && !ti.Position_valid && ti.DistanceEstimated > 0 {
+		// bearingless target: relative bearing empty, distance estimated
+		msg = fmt.Sprintf("$PFLAU,%d,1,%d,1,%d,,%d,%d,%d,%s", len(traffic), gpsStatus, alarmLevel, alarmType, relativeVertical, int32(math.Abs(dist)), idstr)
+	} else if alarmLevel > 0 {
 		msg = fmt.Sprintf("$PFLAU,%d,1,%d,1,%d,%d,%d,%d,%d,%s", len(traffic), gpsStatus, alarmLevel, int32(bearing), alarmType, relativeVertical, int32(math.Abs(dist)), idstr)
 	} else {
 		msg = fmt.Sprintf("$PFLAU,%d,1,%d,1,0,,0,,,", len(traffic), gpsStatus)
@@ -83,7 +88,7 @@ func makeFlarmPFLAUString(ti TrafficInfo) (msg string) {
 	return
 }
 
-// TODO: only very simplistic implementation
+// Alarm level from the current proximity only, see updateTrafficAlert() for the CPA based level.
 func computeAlarmLevel(dist float64, relativeVertical int32) (alarmLevel uint8) {
 	if (dist < 926) && (relativeVertical < 152) && (relativeVertical > -152) { // 926 m = 0.5 NM; 152m = 500'
 		alarmLevel = 3
@@ -112,7 +117,7 @@ func gdl90EmitterCatToNMEA(emitterCat uint8) string {
 	acType := "0"
 	switch emitterCat {
 		case 1, 6: acType = "8" // light/"highly maneuverable > 56" = piston
-		case 2, 3, 4, 5: acType = "9" // small/large/heavy = jet
+		case 2, 3, 4, 5: acType = "9" // small/large/high vortex/heavy = jet
 		case 7: acType = "3" // helicopter = helicopter
 		case 9: acType = "1" // glider = glider
 		case 10: acType = "B" // lighter than air = balloon
@@ -120,7 +125,7 @@ func gdl90EmitterCatToNMEA(emitterCat uint8) string {
 		case 12: acType = "7" // paraglider, hanglider
 		case 14: acType = "D" // UAV
 		case 17, 18: acType = "E" // Surface vehicle->Ground support (not in dataport spec, but OGN extension?)
-		case 19: acType = "F" // static object / point obstacle
+		case 19, 20, 21: acType = "F" // static object / point, cluster and line obstacle
 	}
 	return acType
 }
@@ -210,7 +215,7 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool, alarmLevel ui
 		distN = ti.DistanceEstimated
 	}
 	if globalSettings.DEBUG {
-		log.Printf("FLARM - ICAO target %X (%s) is %.1f meters away at %.1f degrees\n", ti.Icao_addr, ti.Tail, dist, bearing)
+		logDebugf("flarm", "FLARM - ICAO target %X (%s) is %.1f meters away at %.1f degrees", ti.Icao_addr, ti.Tail, dist, bearing)
 	}
 
 	// TODO: Estimate distance for bearingless / distanceless Mode S (1090) aircraft targets
@@ -225,7 +230,7 @@ func makeFlarmPFLAAString(ti TrafficInfo) (msg string, valid bool, alarmLevel ui
 	//}
 
 	relativeVertical = computeRelativeVertical(ti)
-	alarmLevel = computeAlarmLevel(dist, relativeVertical)
+	alarmLevel = ti.AlertLevel // see updateTrafficAlert()
 
 	if ti.Speed_valid {
 		groundSpeed = int32(float32(ti.Speed) * 0.5144) // convert to m/s
@@ -422,7 +427,38 @@ func makeGPGGAString() string {
 }
 
 func makePGRMZString() string {
-	msg := fmt.Sprintf("$PGRMZ,%d,f,3", int(mySituation.BaroPressureAltitude))
+	unit := "f"
+	if globalSettings.UnitAltitude == "m" {
+		unit = "m"
+	}
+	msg := fmt.Sprintf("$PGRMZ,%d,%s,3", int(unitAltitude(float64(mySituation.BaroPressureAltitude))), unit)
+	msg = appendNmeaChecksum(msg)
+	msg += "\r\n"
+	return msg
+}
+
+/*
+	makeLXWP0String() creates an LX Navigation LXWP0 sentence with baro altitude, vario and heading, as used by some
+		legacy vario/glide computers:
+		$LXWP0,<logger>,<IAS kph>,<baro alt m>,<vario m/s>,,,,,,<heading>,<wind dir>,<wind speed kph>
+		The wind is the downloaded forecast at ownship's position and altitude (see windforecast.go), empty if there
+		is none. The vario is the blended climb rate of vario.go.
+*/
+func makeLXWP0String() string {
+	heading := float64(mySituation.GPSTrueCourse)
+	if isAHRSValid() && !isAHRSInvalidValue(mySituation.AHRSGyroHeading) {
+		heading = mySituation.AHRSGyroHeading
+	}
+	windDir, windSpeed := "", ""
+	if wind := getOwnshipWindForecast(); wind != nil {
+		windDir, windSpeed = fmt.Sprintf("%.0f", wind.Dir), fmt.Sprintf("%.1f", wind.Speed*1.852)
+	}
+	vario := float64(mySituation.BaroVerticalSpeed) * 0.00508
+	if climb, ok := varioClimb(); ok {
+		vario = climb
+	}
+	msg := fmt.Sprintf("$LXWP0,N,,%.1f,%.2f,,,,,,%.0f,%s,%s", mySituation.BaroPressureAltitude*0.3048, vario, heading,
+		windDir, windSpeed)
 	msg = appendNmeaChecksum(msg)
 	msg += "\r\n"
 	return msg
@@ -460,7 +496,7 @@ func makeAHRSLevilReport() {
 
 	msg := fmt.Sprintf("$RPYL,%d,%d,%d,%d,%d,%d,0", roll, pitch, hdg, slip_skid, yaw_rate, g)
 	appendNmeaChecksum(msg)
-	sendNetFLARM(msg + "\r\n", 100 * time.Millisecond, 4)
+	sendNetFLARM(msg + "\r\n", 100 * time.Millisecond, MSGPRIO_AUX)
 }
 
 func atof32(val string) float32 {
@@ -472,7 +508,7 @@ func atof32(val string) float32 {
 func parseFlarmNmeaMessage(message []string) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Error parsing NMEA " + strings.Join(message, ","))
+			logWarnf("flarm", "Error parsing NMEA %s", strings.Join(message, ","))
 		}
 	}()
 
@@ -519,7 +555,7 @@ func getIdTail(idReceived string) (idStr string, tail string, address uint32) {
 func parseFlarmPFLAU(message []string) {
 	// $PFLAU,<RX>,<TX>,<GPS>,<Power>,<AlarmLevel>,<RelativeBearing>,<AlarmType>,<RelativeVertical>,<RelativeDistance>,<ID>
 	if len(message) < 11 {
-		log.Printf("Discarding invalid NMEA: " + strings.Join(message, ","))
+		logWarnf("flarm", "Discarding invalid NMEA: %s", strings.Join(message, ","))
 		return
 	}
 	if len(message[10]) == 0 || len(message[9]) == 0 || len(message[8]) == 0 || len(message[6]) == 0 {
@@ -555,9 +591,9 @@ func parseFlarmPFLAU(message []string) {
 		existingTi, ok = traffic[key]
 	}
 	if ok {
-		if existingTi.Last_source == TRAFFIC_SOURCE_1090ES && existingTi.Age < 5 {
-			// traffic has FLARM and 1090ES and was seen via 1090ES recently?
-			// -> ignore the flarm message. 1090ES has much less delay, so we prefer that.
+		if isLowerQualityUpdate(&existingTi, TRAFFIC_SOURCE_OGN, existingTi.TargetType) {
+			// traffic has FLARM and ADS-B and was seen via ADS-B recently?
+			// -> ignore the flarm message. ADS-B has much less delay, so we prefer that.
 			return
 		}
 		ti = existingTi
@@ -572,6 +608,7 @@ func parseFlarmPFLAU(message []string) {
 			ti.Tail = getTailNumber(ognID, "FLR") // Might have better tail from ADS-B. Don't overwrite.
 		}
 	}
+	applyOgnDevice(&ti, ognID)
 	ti.Timestamp = time.Now().UTC()
 	ti.Last_source = TRAFFIC_SOURCE_OGN
 	ti.Alt, ti.AltIsGNSS = relativeGpsAltToBaro(relVertical)
@@ -600,7 +637,7 @@ func parseFlarmPFLAA(message []string) {
 	// $PFLAA,<AlarmLevel>,<RelativeNorth>,<RelativeEast>,<RelativeVertical>,<IDType>,<ID>,<Track>,<TurnRate>,<GroundSpeed>, <ClimbRate>,<AcftType>
 	// Append flarm message to message log
 	if len(message) < 12 {
-		log.Printf("Discarding invalid NMEA: " + strings.Join(message, ","))
+		logWarnf("flarm", "Discarding invalid NMEA: %s", strings.Join(message, ","))
 		return
 	}
 	var thisMsg msg
@@ -635,9 +672,9 @@ func parseFlarmPFLAA(message []string) {
 	// check if traffic is already known
 	key := uint32(idType) << 24 | address
 	if existingTi, ok := traffic[key]; ok {
-		if existingTi.Last_source == TRAFFIC_SOURCE_1090ES && existingTi.Age < 5 {
-			// traffic has FLARM and 1090ES and was seen via 1090ES recently?
-			// -> ignore the flarm message. 1090ES has much less delay, so we prefer that.
+		if isLowerQualityUpdate(&existingTi, TRAFFIC_SOURCE_OGN, existingTi.TargetType) {
+			// traffic has FLARM and ADS-B and was seen via ADS-B recently?
+			// -> ignore the flarm message. ADS-B has much less delay, so we prefer that.
 			return 
 		}
 
@@ -657,6 +694,7 @@ func parseFlarmPFLAA(message []string) {
 			ti.Tail = getTailNumber(ognID, "FLR") // Might have better tail from ADS-B. Don't overwrite.
 		}
 	}
+	applyOgnDevice(&ti, ognID)
 	ti.Timestamp = time.Now().UTC()
 	ti.Last_source = TRAFFIC_SOURCE_OGN
 	ti.Alt, ti.AltIsGNSS = relativeGpsAltToBaro(relVert)
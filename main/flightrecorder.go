@@ -0,0 +1,570 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flightrecorder.go: Flight data recorder. Records the ownship track (position, GPS and pressure altitude, ground
+		speed, course, vertical speed and attitude) every globalSettings.FlightRecorderInterval seconds while flying.
+		Takeoff and landing are detected by the flightDetector of flightsmoother.go, only
+		valid fixes count, so a GPS outage doesn't end a flight. Flights are stored in their own database
+		(flightRecorderFilef, independent of the replay log), the points are written every FLIGHT_RECORDER_FLUSH to
+		spare the SD card. The post-flight debrief of every flight is collected in debrief.go.
+			/getFlights                           recorded flights, newest first
+			/downloadFlight?id=<id>&format=gpx|kml|igc
+			/deleteFlight?id=<id>                 POST
+		IGC files carry the pressure altitude if a baro sensor is connected. They aren't signed, so they aren't valid
+		for badge or record claims, but are accepted by the usual flight analysis tools and online contests.
+*/
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	FLIGHT_RECORDER_FLUSH       = 30 * time.Second
+	FLIGHT_RECORDER_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+)
+
+type RecordedFlight struct {
+	ID          int64
+	StartupID   int64 // stratux session the flight was recorded in
+	Start       time.Time
+	End         time.Time
+	Points      int
+	MaxAltitude float32 // ft MSL
+	MaxSpeed    float64 // kt
+	Distance    float64 // m, along the track
+	Recording   bool    // the current flight
+}
+
+type FlightPoint struct {
+	Time          time.Time
+	Lat           float32
+	Lng           float32
+	AltMSL        float32 // ft
+	PressureAlt   float32 // ft, only if PressureValid
+	PressureValid bool
+	GroundSpeed   float64 // kt
+	TrueCourse    float32
+	VerticalSpeed float32 // ft/min
+	Pitch         float64 // deg, attitude only if AttitudeValid
+	Roll          float64
+	Heading       float64
+	AttitudeValid bool
+}
+
+type flightRecorderState struct {
+	flight     *RecordedFlight // nil if not flying
+	pending    []FlightPoint   // not yet written
+	last       *FlightPoint
+	detector   flightDetector
+	lastPoint  time.Time
+	lastFlush  time.Time
+	lastErrLog time.Time
+}
+
+var flightRecorderFilef string // Set according to OS config.
+var flightRecorder flightRecorderState
+var flightRecorderMutex sync.Mutex
+
+func openFlightRecorderDB() (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", flightRecorderFilef)
+	if err != nil {
+		return nil, err
+	}
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS flights (ID INTEGER PRIMARY KEY AUTOINCREMENT, StartupID INTEGER, Start TEXT, End TEXT, Points INTEGER, MaxAltitude REAL, MaxSpeed REAL, Distance REAL)",
+		"CREATE TABLE IF NOT EXISTS flight_points (FlightID INTEGER NOT NULL, Time TEXT, Lat REAL, Lng REAL, AltMSL REAL, PressureAlt REAL, GroundSpeed REAL, TrueCourse REAL, VerticalSpeed REAL, Pitch REAL, Roll REAL, Heading REAL)",
+		"CREATE INDEX IF NOT EXISTS flight_points_flight ON flight_points (FlightID)",
+		"CREATE TABLE IF NOT EXISTS flight_debriefs (FlightID INTEGER NOT NULL PRIMARY KEY, Debrief TEXT)", // see debrief.go
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func currentFlightPoint(now time.Time) FlightPoint {
+	p := FlightPoint{
+		Time:          now.UTC(),
+		Lat:           mySituation.GPSLatitude,
+		Lng:           mySituation.GPSLongitude,
+		AltMSL:        mySituation.GPSAltitudeMSL,
+		GroundSpeed:   mySituation.GPSGroundSpeed,
+		TrueCourse:    mySituation.GPSTrueCourse,
+		VerticalSpeed: mySituation.GPSVerticalSpeed * 60,
+	}
+	if isCabinPressureSource() {
+		p.PressureAlt = mySituation.BaroPressureAltitude
+		p.PressureValid = true
+	}
+	if isAHRSValid() {
+		p.Pitch = mySituation.AHRSPitch
+		p.Roll = mySituation.AHRSRoll
+		p.Heading = mySituation.AHRSGyroHeading
+		p.AttitudeValid = true
+	}
+	return p
+}
+
+// flightRecorderMutex must be held.
+func addFlightPoint(p FlightPoint) {
+	f := flightRecorder.flight
+	if flightRecorder.last != nil {
+		dist, _ := common.Distance(float64(flightRecorder.last.Lat), float64(flightRecorder.last.Lng), float64(p.Lat), float64(p.Lng))
+		f.Distance += dist
+	}
+	if f.Points == 0 || p.AltMSL > f.MaxAltitude {
+		f.MaxAltitude = p.AltMSL
+	}
+	f.MaxSpeed = math.Max(f.MaxSpeed, p.GroundSpeed)
+	f.End = p.Time
+	f.Points++
+	flightRecorder.pending = append(flightRecorder.pending, p)
+	flightRecorder.last = &p
+	flightRecorder.lastPoint = p.Time
+}
+
+// Writes the pending points and the flight summary. A new flight is inserted first to get its ID.
+// flightRecorderMutex must be held.
+func flushFlightRecorder() error {
+	f := flightRecorder.flight
+	if f == nil {
+		return nil
+	}
+	flightRecorder.lastFlush = time.Now()
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	id := f.ID // only set in f once it's committed
+	if id == 0 {
+		res, err := tx.Exec("INSERT INTO flights (StartupID, Start, End, Points, MaxAltitude, MaxSpeed, Distance) VALUES(?, ?, ?, 0, 0, 0, 0)",
+			f.StartupID, f.Start.Format(FLIGHT_RECORDER_TIME_FORMAT), f.End.Format(FLIGHT_RECORDER_TIME_FORMAT))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if id, err = res.LastInsertId(); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	for _, p := range flightRecorder.pending {
+		var pressureAlt, pitch, roll, heading interface{}
+		if p.PressureValid {
+			pressureAlt = p.PressureAlt
+		}
+		if p.AttitudeValid {
+			pitch, roll, heading = p.Pitch, p.Roll, p.Heading
+		}
+		_, err = tx.Exec("INSERT INTO flight_points (FlightID, Time, Lat, Lng, AltMSL, PressureAlt, GroundSpeed, TrueCourse, VerticalSpeed, Pitch, Roll, Heading) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			id, p.Time.Format(FLIGHT_RECORDER_TIME_FORMAT), p.Lat, p.Lng, p.AltMSL, pressureAlt, p.GroundSpeed, p.TrueCourse,
+			p.VerticalSpeed, pitch, roll, heading)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE flights SET End = ?, Points = ?, MaxAltitude = ?, MaxSpeed = ?, Distance = ? WHERE ID = ?",
+		f.End.Format(FLIGHT_RECORDER_TIME_FORMAT), f.Points, f.MaxAltitude, f.MaxSpeed, f.Distance, id)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	f.ID = id
+	flightRecorder.pending = flightRecorder.pending[:0]
+	return nil
+}
+
+// flightRecorderMutex must be held.
+func startFlight(now time.Time) {
+	flightRecorder.flight = &RecordedFlight{StartupID: stratuxStartupID, Start: now.UTC(), End: now.UTC(), Recording: true}
+	flightRecorder.pending = nil
+	flightRecorder.last = nil
+	flightRecorder.lastFlush = now
+	startDebrief(now)
+	logInfof("flightrecorder", "flight started")
+}
+
+// flightRecorderMutex must be held.
+func endFlight() {
+	f := flightRecorder.flight
+	if f == nil {
+		return
+	}
+	if err := flushFlightRecorder(); err != nil {
+		logErrorf("flightrecorder", "%s", err.Error())
+	}
+	if err := finishDebrief(f); err != nil {
+		logErrorf("flightrecorder", "%s", err.Error())
+	}
+	logInfof("flightrecorder", "flight %d ended: %s, %d points, %.1f km", f.ID, f.End.Sub(f.Start).Round(time.Second),
+		f.Points, f.Distance/1000)
+	flightRecorder.flight = nil
+	flightRecorder.pending = nil
+	flightRecorder.last = nil
+}
+
+// Detects take-off and landing every second, records and flushes the points.
+func flightRecorderWatcher() {
+	registerSubsystem("flightrecorder", 10*time.Second)
+	ticker := time.NewTicker(time.Second)
+	for {
+		<-ticker.C
+		subsystemAlive("flightrecorder")
+		now := time.Now()
+
+		flightRecorderMutex.Lock()
+		if !globalSettings.FlightRecorder_Enabled || isFlightReplayRunning() {
+			endFlight()
+			flightRecorder.detector = flightDetector{}
+			flightRecorderMutex.Unlock()
+			continue
+		}
+
+		if isGPSValid() {
+			event := flightRecorder.detector.update(mySituation.GPSGroundSpeed, now)
+			if event == FLIGHT_EVENT_TAKEOFF && flightRecorder.flight == nil {
+				startFlight(now)
+			}
+			interval := time.Duration(globalSettings.FlightRecorderInterval) * time.Second
+			if flightRecorder.flight != nil && now.Sub(flightRecorder.lastPoint) >= interval {
+				addFlightPoint(currentFlightPoint(now))
+			}
+			if event == FLIGHT_EVENT_LANDING {
+				endFlight()
+			}
+		}
+
+		if flightRecorder.flight != nil {
+			updateDebrief(now)
+		}
+		if flightRecorder.flight != nil && now.Sub(flightRecorder.lastFlush) >= FLIGHT_RECORDER_FLUSH {
+			if err := flushFlightRecorder(); err != nil && now.Sub(flightRecorder.lastErrLog) > 10*time.Minute {
+				flightRecorder.lastErrLog = now
+				logErrorf("flightrecorder", "%s", err.Error())
+			}
+		}
+		flightRecorderMutex.Unlock()
+	}
+}
+
+// Writes the current flight, called on shutdown.
+func closeFlightRecorder() {
+	flightRecorderMutex.Lock()
+	defer flightRecorderMutex.Unlock()
+	endFlight()
+}
+
+func scanRecordedFlight(rows *sql.Rows) (RecordedFlight, error) {
+	var f RecordedFlight
+	var start, end string
+	err := rows.Scan(&f.ID, &f.StartupID, &start, &end, &f.Points, &f.MaxAltitude, &f.MaxSpeed, &f.Distance)
+	f.Start, _ = time.Parse(FLIGHT_RECORDER_TIME_FORMAT, start)
+	f.End, _ = time.Parse(FLIGHT_RECORDER_TIME_FORMAT, end)
+	return f, err
+}
+
+// All flights, newest first. The current flight is flushed before, so it's complete.
+func loadRecordedFlights() ([]RecordedFlight, error) {
+	result := make([]RecordedFlight, 0)
+	flightRecorderMutex.Lock()
+	current := int64(0)
+	if flightRecorder.flight != nil {
+		if err := flushFlightRecorder(); err != nil {
+			flightRecorderMutex.Unlock()
+			return nil, err
+		}
+		current = flightRecorder.flight.ID
+	}
+	flightRecorderMutex.Unlock()
+	if _, err := os.Stat(flightRecorderFilef); os.IsNotExist(err) {
+		return result, nil
+	}
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT ID, StartupID, Start, End, Points, MaxAltitude, MaxSpeed, Distance FROM flights ORDER BY ID DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		f, err := scanRecordedFlight(rows)
+		if err != nil {
+			return nil, err
+		}
+		f.Recording = f.ID == current
+		result = append(result, f)
+	}
+	return result, rows.Err()
+}
+
+func loadRecordedFlight(id int64) (RecordedFlight, []FlightPoint, error) {
+	var f RecordedFlight
+	flights, err := loadRecordedFlights()
+	if err != nil {
+		return f, nil, err
+	}
+	found := false
+	for _, fl := range flights {
+		if fl.ID == id {
+			f, found = fl, true
+		}
+	}
+	if !found {
+		return f, nil, fmt.Errorf("unknown flight %d", id)
+	}
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return f, nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT Time, Lat, Lng, AltMSL, PressureAlt, GroundSpeed, TrueCourse, VerticalSpeed, Pitch, Roll, Heading FROM flight_points WHERE FlightID = ? ORDER BY Time", id)
+	if err != nil {
+		return f, nil, err
+	}
+	defer rows.Close()
+	points := make([]FlightPoint, 0, f.Points)
+	for rows.Next() {
+		var p FlightPoint
+		var t string
+		var pressureAlt, pitch, roll, heading sql.NullFloat64
+		if err := rows.Scan(&t, &p.Lat, &p.Lng, &p.AltMSL, &pressureAlt, &p.GroundSpeed, &p.TrueCourse, &p.VerticalSpeed,
+			&pitch, &roll, &heading); err != nil {
+			return f, nil, err
+		}
+		p.Time, _ = time.Parse(FLIGHT_RECORDER_TIME_FORMAT, t)
+		p.PressureAlt, p.PressureValid = float32(pressureAlt.Float64), pressureAlt.Valid
+		p.Pitch, p.Roll, p.Heading, p.AttitudeValid = pitch.Float64, roll.Float64, heading.Float64, pitch.Valid
+		points = append(points, p)
+	}
+	return f, points, rows.Err()
+}
+
+func deleteRecordedFlight(id int64) error {
+	flightRecorderMutex.Lock()
+	recording := flightRecorder.flight != nil && flightRecorder.flight.ID == id
+	flightRecorderMutex.Unlock()
+	if recording {
+		return fmt.Errorf("flight %d is being recorded", id)
+	}
+	db, err := openFlightRecorderDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if _, err := db.Exec("DELETE FROM flight_points WHERE FlightID = ?", id); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM flight_debriefs WHERE FlightID = ?", id); err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM flights WHERE ID = ?", id)
+	return err
+}
+
+func flightName(f RecordedFlight) string {
+	return "stratux_" + f.Start.Format("2006-01-02_1504")
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func writeFlightGPX(w *bufio.Writer, f RecordedFlight, points []FlightPoint) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<gpx version=\"1.1\" creator=\"Stratux %s\" xmlns=\"http://www.topografix.com/GPX/1/1\">\n", xmlEscape(stratuxVersion))
+	fmt.Fprintf(w, "<metadata><name>%s</name><time>%s</time></metadata>\n", flightName(f), f.Start.Format(time.RFC3339))
+	fmt.Fprintf(w, "<trk><name>%s</name><trkseg>\n", flightName(f))
+	for _, p := range points {
+		fmt.Fprintf(w, "<trkpt lat=\"%.6f\" lon=\"%.6f\"><ele>%.1f</ele><time>%s</time><course>%.0f</course></trkpt>\n",
+			p.Lat, p.Lng, p.AltMSL*0.3048, p.Time.Format(FLIGHT_RECORDER_TIME_FORMAT), p.TrueCourse)
+	}
+	fmt.Fprintf(w, "</trkseg></trk>\n</gpx>\n")
+}
+
+func writeFlightKML(w *bufio.Writer, f RecordedFlight, points []FlightPoint) {
+	fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n")
+	fmt.Fprintf(w, "<kml xmlns=\"http://www.opengis.net/kml/2.2\" xmlns:gx=\"http://www.google.com/kml/ext/2.2\">\n<Document>\n")
+	fmt.Fprintf(w, "<name>%s</name>\n", flightName(f))
+	fmt.Fprintf(w, "<Style id=\"track\"><LineStyle><color>ff0000ff</color><width>3</width></LineStyle></Style>\n")
+	fmt.Fprintf(w, "<Placemark><name>%s</name><styleUrl>#track</styleUrl>\n", flightName(f))
+	fmt.Fprintf(w, "<gx:Track><altitudeMode>absolute</altitudeMode>\n")
+	for _, p := range points {
+		fmt.Fprintf(w, "<when>%s</when>\n", p.Time.Format(FLIGHT_RECORDER_TIME_FORMAT))
+	}
+	for _, p := range points {
+		fmt.Fprintf(w, "<gx:coord>%.6f %.6f %.1f</gx:coord>\n", p.Lng, p.Lat, p.AltMSL*0.3048)
+	}
+	for _, p := range points {
+		// heading, tilt (pitch) and roll of the model, if there is attitude
+		if p.AttitudeValid {
+			fmt.Fprintf(w, "<gx:angles>%.0f %.1f %.1f</gx:angles>\n", p.Heading, p.Pitch, p.Roll)
+		} else {
+			fmt.Fprintf(w, "<gx:angles>%.0f 0 0</gx:angles>\n", p.TrueCourse)
+		}
+	}
+	fmt.Fprintf(w, "</gx:Track></Placemark>\n</Document>\n</kml>\n")
+}
+
+// IGC coordinate: DDMMmmm[NS] or DDDMMmmm[EW], thousandths of minutes.
+func igcCoordinate(deg float32, digits int, pos, neg byte) string {
+	hemisphere := pos
+	if deg < 0 {
+		hemisphere = neg
+		deg = -deg
+	}
+	thousandths := int(math.Round(float64(deg) * 60000))
+	return fmt.Sprintf("%0*d%05d%c", digits, thousandths/60000, thousandths%60000, hemisphere)
+}
+
+func igcBaroSensor() string {
+	switch mySituation.BaroSourceType {
+	case BARO_TYPE_BMP280:
+		return "BMP280"
+	case BARO_TYPE_OGNTRACKER:
+		return "OGN Tracker"
+	case BARO_TYPE_NMEA:
+		return "NMEA"
+	}
+	return ""
+}
+
+// IGC altitude in m: 5 characters, negative values as -dddd.
+func igcAltitude(ft float32) string {
+	m := int(math.Round(float64(ft) * 0.3048))
+	if m < 0 {
+		return fmt.Sprintf("-%04d", -m)
+	}
+	return fmt.Sprintf("%05d", m)
+}
+
+func writeFlightIGC(w *bufio.Writer, f RecordedFlight, points []FlightPoint) {
+	crlf := func(format string, a ...interface{}) {
+		fmt.Fprintf(w, format+"\r\n", a...)
+	}
+	reg := globalSettings.OwnshipCallsign
+	crlf("AXXXSTX Stratux")
+	crlf("HFDTEDATE:%s,%02d", f.Start.Format("020106"), 1)
+	crlf("HFPLTPILOTINCHARGE:")
+	crlf("HFGTYGLIDERTYPE:")
+	crlf("HFGIDGLIDERID:%s", reg)
+	crlf("HFDTMGPSDATUM:WGS84")
+	crlf("HFRFWFIRMWAREVERSION:%s", stratuxVersion)
+	crlf("HFRHWHARDWAREVERSION:%s", globalStatus.HardwareBuild)
+	crlf("HFFTYFRTYPE:Stratux")
+	crlf("HFGPSRECEIVER:%s", gpsTypeName(globalStatus.GPS_detected_type))
+	crlf("HFPRSPRESSALTSENSOR:%s", igcBaroSensor())
+	crlf("HFALGALTGPS:GEO")
+	crlf("HFALPALTPRESSURE:ISA")
+	for _, p := range points {
+		pressureAlt := "00000"
+		if p.PressureValid {
+			pressureAlt = igcAltitude(p.PressureAlt)
+		}
+		crlf("B%s%s%sA%s%s", p.Time.Format("150405"), igcCoordinate(p.Lat, 2, 'N', 'S'), igcCoordinate(p.Lng, 3, 'E', 'W'),
+			pressureAlt, igcAltitude(p.AltMSL))
+	}
+}
+
+// AJAX call - /getFlights.
+func handleFlightsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	flights, err := loadRecordedFlights()
+	if err != nil {
+		logErrorf("flightrecorder", "%s", err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flightsJSON, err := json.Marshal(&flights)
+	if err != nil {
+		logErrorf("flightrecorder", "Error sending flights JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", flightsJSON)
+}
+
+// AJAX call - /downloadFlight?id=<id>&format=gpx|kml|igc.
+func handleFlightDownloadRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid flight id '%s'", r.URL.Query().Get("id")), http.StatusBadRequest)
+		return
+	}
+	var write func(*bufio.Writer, RecordedFlight, []FlightPoint)
+	var contentType string
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "gpx":
+		write, contentType = writeFlightGPX, "application/gpx+xml"
+	case "kml":
+		write, contentType = writeFlightKML, "application/vnd.google-earth.kml+xml"
+	case "igc":
+		write, contentType = writeFlightIGC, "text/plain"
+	default:
+		http.Error(w, fmt.Sprintf("unknown format '%s'", format), http.StatusBadRequest)
+		return
+	}
+	f, points, err := loadRecordedFlight(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.%s", flightName(f), format))
+	bw := bufio.NewWriter(w)
+	write(bw, f, points)
+	bw.Flush()
+}
+
+// AJAX call - /deleteFlight?id=<id>.
+func handleFlightDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid flight id '%s'", r.URL.Query().Get("id")), http.StatusBadRequest)
+		return
+	}
+	if err := deleteRecordedFlight(id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleFlightsRequest(w, r)
+}
@@ -0,0 +1,448 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flightreplay.go: Replay of a recorded flight through the live pipeline. The raw UAT, 1090ES, OGN and AIS messages
+		of one flight session (startup) in the replay log are fed into the same functions as received messages, with
+		their original timing (optionally faster), so traffic, alerts and all GDL90/FLARM outputs behave as in flight.
+		If no GPS is connected, the recorded ownship position is replayed as well, as NMEA sentences of a network GPS.
+		Without AHRS and baro sensors, the recorded attitude and pressure altitude are replayed in their place.
+		Data logging is paused while a replay runs, so the replayed flight doesn't end up in the log again.
+		Controlled in the Logs page (/getFlightReplay, /setFlightReplay). The replayed traffic ends up on the EFB
+		outputs, so like the traffic simulation this needs developer mode and only runs on the ground, see
+		syntheticTrafficAllowed(). With a GPS connected the replay stops as soon as the aircraft moves.
+
+		Replay mode: started with -replaydb <stratux.sqlite> [-session <startup id>] [-speed <factor>], stratux runs
+		without SDRs, GPS and sensors and replays the session (the latest by default) from that log instead. All
+		outputs and the web UI work as in flight, other sessions of the log can be replayed from the Logs page.
+		Nothing live is received in this mode, so the developer mode and ground checks don't apply.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BertoldVdb/go-ais"
+	"github.com/BertoldVdb/go-ais/aisnmea"
+)
+
+const (
+	FLIGHT_REPLAY_MAX_GAP          = 2 * time.Minute // longer gaps in the recording are skipped
+	FLIGHT_REPLAY_MSGCLASS_GPS     = -1              // pseudo message class of the recorded ownship positions
+	FLIGHT_REPLAY_MSGCLASS_SENSORS = -2              // pseudo message class of the recorded baro and attitude
+)
+
+type FlightReplaySession struct {
+	StartupID int64
+	Start     time.Time // time of the first and last recorded message (GPS time if it was available)
+	End       time.Time
+	UAT       int // number of recorded messages
+	ES        int
+	OGN       int
+	AIS       int
+}
+
+// Response of /getFlightReplay.
+type FlightReplayStatus struct {
+	Running   bool
+	StartupID int64
+	Speed     float64
+	Ownship   bool      // the recorded GPS position is replayed
+	Sensors   bool      // the recorded baro and attitude are replayed
+	Progress  float64   // 0..1
+	Time      time.Time // recorded time of the current position in the replay
+	Sessions  []FlightReplaySession
+}
+
+var flightReplay FlightReplayStatus
+var flightReplayDBFilef string // replay log the flights are replayed from, dataLogFilef unless in replay mode
+var flightReplayStop chan bool
+var flightReplayMutex = &sync.Mutex{}
+var flightReplayMode bool // started with -replaydb
+
+func isFlightReplayRunning() bool {
+	flightReplayMutex.Lock()
+	defer flightReplayMutex.Unlock()
+	return flightReplay.Running
+}
+
+// Times in the log are stored as time.Time.String().
+func parseLogTime(s string) time.Time {
+	if i := strings.Index(s, " m="); i > 0 {
+		s = s[:i]
+	}
+	t, _ := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s)
+	return t
+}
+
+func openFlightReplayDB() (*sql.DB, error) {
+	if _, err := os.Stat(flightReplayDBFilef); err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", flightReplayDBFilef)
+}
+
+// The session currently being logged can't be replayed, -1 if the replay log isn't our own (replay mode).
+func flightReplayCurrentSession() int64 {
+	if flightReplayDBFilef != dataLogFilef {
+		return -1
+	}
+	return stratuxStartupID
+}
+
+// Recorded sessions with traffic messages, most recent first. The current session can't be replayed.
+func loadFlightReplaySessions() ([]FlightReplaySession, error) {
+	db, err := openFlightReplayDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query(`SELECT t.StartupID, MIN(t.PreferredTime_value), MAX(t.PreferredTime_value), c.MessageClass, COUNT(*) FROM
+		(SELECT timestamp_id, MessageClass FROM messages UNION ALL SELECT timestamp_id, ? FROM es_messages) c
+		JOIN timestamp t ON t.id = c.timestamp_id WHERE t.StartupID != ? GROUP BY t.StartupID, c.MessageClass
+		ORDER BY t.StartupID DESC`, MSGCLASS_ES, flightReplayCurrentSession())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]FlightReplaySession, 0)
+	for rows.Next() {
+		var id int64
+		var start, end string
+		var class, count int
+		if err := rows.Scan(&id, &start, &end, &class, &count); err != nil {
+			return nil, err
+		}
+		if len(result) == 0 || result[len(result)-1].StartupID != id {
+			result = append(result, FlightReplaySession{StartupID: id, Start: parseLogTime(start), End: parseLogTime(end)})
+		}
+		s := &result[len(result)-1]
+		if t := parseLogTime(start); t.Before(s.Start) {
+			s.Start = t
+		}
+		if t := parseLogTime(end); t.After(s.End) {
+			s.End = t
+		}
+		switch class {
+		case MSGCLASS_UAT:
+			s.UAT = count
+		case MSGCLASS_ES:
+			s.ES = count
+		case MSGCLASS_OGN:
+			s.OGN = count
+		case MSGCLASS_AIS:
+			s.AIS = count
+		}
+	}
+	return result, rows.Err()
+}
+
+// GPRMC and GPGGA sentences for a recorded position, "lat,lng,altMSL,geoidSep,gs,track,quality,sats,sinceMidnight".
+func makeFlightReplayNMEA(rec string) []string {
+	f := strings.Split(rec, ",")
+	if len(f) < 9 {
+		return nil
+	}
+	v := make([]float64, len(f))
+	for i := range f {
+		v[i], _ = strconv.ParseFloat(f[i], 64)
+	}
+	if v[6] == 0 {
+		return nil // no fix at that time
+	}
+	nmeaDeg := func(deg float64, pos, neg string) (float64, string) {
+		hemi := pos
+		if deg < 0 {
+			deg, hemi = -deg, neg
+		}
+		d := math.Floor(deg)
+		return d*100 + (deg-d)*60, hemi
+	}
+	lat, ns := nmeaDeg(v[0], "N", "S")
+	lng, ew := nmeaDeg(v[1], "E", "W")
+	sec := v[8]
+	hr := math.Floor(sec / 3600)
+	min := math.Floor((sec - hr*3600) / 60)
+	sec -= hr*3600 + min*60
+	yy, mm, dd := time.Now().UTC().Date()
+
+	rmc := fmt.Sprintf("$GPRMC,%02.f%02.f%05.2f,A,%010.5f,%s,%011.5f,%s,%.1f,%.1f,%02d%02d%02d,,,A",
+		hr, min, sec, lat, ns, lng, ew, v[4], v[5], dd, mm, yy%100)
+	gga := fmt.Sprintf("$GPGGA,%02.f%02.f%05.2f,%010.5f,%s,%011.5f,%s,%d,%d,1.0,%.1f,M,%.1f,M,,",
+		hr, min, sec, lat, ns, lng, ew, int(v[6]), int(v[7]), v[2]/3.28084, v[3]/3.28084)
+	return []string{appendNmeaChecksum(rmc), appendNmeaChecksum(gga)}
+}
+
+// Sets the recorded baro and attitude, "baroAlt,baroVS,baroTemp,baroType,pitch,roll,gyroHeading,magHeading,slipSkid,
+// turnRate,gLoad,ahrsStatus". Like the sensors, every attitude update is sent to the AHRS outputs.
+func replayFlightSensors(rec string) {
+	f := strings.Split(rec, ",")
+	if len(f) < 12 {
+		return
+	}
+	v := make([]float64, len(f))
+	for i := range f {
+		v[i], _ = strconv.ParseFloat(f[i], 64)
+	}
+	if baroType := uint8(v[3]); baroType != BARO_TYPE_NONE && baroType != BARO_TYPE_ADSBESTIMATE {
+		mySituation.muBaro.Lock()
+		mySituation.BaroLastMeasurementTime = stratuxClock.Time
+		mySituation.BaroPressureAltitude = float32(v[0])
+		mySituation.BaroVerticalSpeed = float32(v[1])
+		mySituation.BaroTemperature = float32(v[2])
+		mySituation.BaroSourceType = baroType
+		mySituation.muBaro.Unlock()
+		globalStatus.BMPConnected = baroType == BARO_TYPE_BMP280
+	}
+	if int(v[11])&(1<<1) == 0 || isAHRSInvalidValue(v[4]) {
+		return // no IMU or no valid attitude at that time
+	}
+	globalStatus.IMUConnected = true
+	mySituation.muAttitude.Lock()
+	mySituation.AHRSPitch = v[4]
+	mySituation.AHRSRoll = v[5]
+	mySituation.AHRSGyroHeading = v[6]
+	mySituation.AHRSMagHeading = v[7]
+	mySituation.AHRSSlipSkid = v[8]
+	mySituation.AHRSTurnRate = v[9]
+	mySituation.AHRSGLoad = v[10]
+	if mySituation.AHRSGLoad < mySituation.AHRSGLoadMin || mySituation.AHRSGLoadMin == 0 {
+		mySituation.AHRSGLoadMin = mySituation.AHRSGLoad
+	}
+	if mySituation.AHRSGLoad > mySituation.AHRSGLoadMax {
+		mySituation.AHRSGLoadMax = mySituation.AHRSGLoad
+	}
+	mySituation.AHRSLastAttitudeTime = stratuxClock.Time
+	mySituation.muAttitude.Unlock()
+	makeAHRSGDL90Report()
+	makeAHRSSimReport()
+	makeAHRSLevilReport()
+}
+
+func replayFlight(startupID int64, speed float64, ownship, sensors bool, stop chan bool) {
+	defer func() {
+		flightReplayMutex.Lock()
+		flightReplay.Running = false
+		flightReplayMutex.Unlock()
+		if ownship {
+			globalStatus.GPS_connected = false
+			globalStatus.GPS_detected_type = 0
+		}
+		if sensors {
+			globalStatus.IMUConnected = false
+			globalStatus.BMPConnected = false
+		}
+		logInfof("flightreplay", "Flight replay of session %d finished", startupID)
+	}()
+
+	db, err := openFlightReplayDB()
+	if err != nil {
+		logInfof("flightreplay", "Flight replay: %s", err.Error())
+		return
+	}
+	defer db.Close()
+	var firstTs, lastTs int64
+	if err := db.QueryRow("SELECT MIN(id), MAX(id) FROM timestamp WHERE StartupID = ?", startupID).Scan(&firstTs, &lastTs); err != nil {
+		logInfof("flightreplay", "Flight replay: %s", err.Error())
+		return
+	}
+	rows, err := db.Query(`SELECT t.id, t.StratuxClock_value, t.PreferredTime_value, c.MessageClass, c.Data FROM
+		(SELECT timestamp_id, MessageClass, Data FROM messages
+		 UNION ALL SELECT timestamp_id, ?, Data FROM es_messages
+		 UNION ALL SELECT timestamp_id, ?, printf('%.7f,%.7f,%.1f,%.1f,%.1f,%.1f,%d,%d,%.2f', GPSLatitude, GPSLongitude,
+			GPSAltitudeMSL, GPSGeoidSep, GPSGroundSpeed, GPSTrueCourse, GPSFixQuality, GPSSatellites, GPSLastFixSinceMidnightUTC)
+			FROM mySituation
+		 UNION ALL SELECT timestamp_id, ?, printf('%.1f,%.1f,%.1f,%d,%.2f,%.2f,%.2f,%.2f,%.3f,%.3f,%.3f,%d', BaroPressureAltitude,
+			BaroVerticalSpeed, BaroTemperature, BaroSourceType, AHRSPitch, AHRSRoll, AHRSGyroHeading, AHRSMagHeading,
+			AHRSSlipSkid, AHRSTurnRate, AHRSGLoad, AHRSStatus)
+			FROM mySituation) c
+		JOIN timestamp t ON t.id = c.timestamp_id WHERE t.StartupID = ? ORDER BY t.id`, MSGCLASS_ES, FLIGHT_REPLAY_MSGCLASS_GPS,
+		FLIGHT_REPLAY_MSGCLASS_SENSORS, startupID)
+	if err != nil {
+		logInfof("flightreplay", "Flight replay: %s", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	nm := aisnmea.NMEACodecNew(ais.CodecNew(false, false))
+	var prev time.Time
+	for rows.Next() {
+		var tsID int64
+		var clock, preferred, data string
+		var class int
+		if err := rows.Scan(&tsID, &clock, &preferred, &class, &data); err != nil {
+			logInfof("flightreplay", "Flight replay: %s", err.Error())
+			return
+		}
+
+		// Original timing
+		t := parseLogTime(clock)
+		if wait := t.Sub(prev); !prev.IsZero() && wait > 0 {
+			if wait > FLIGHT_REPLAY_MAX_GAP {
+				logInfof("flightreplay", "Flight replay: skipping %s without messages", wait.String())
+			} else {
+				select {
+				case <-stop:
+					return
+				case <-time.After(time.Duration(float64(wait) / speed)):
+				}
+			}
+		}
+		prev = t
+		// The replayed ownship has the recorded ground speed, only a real GPS tells whether we are moving
+		if !ownship && !flightReplayMode {
+			if err := syntheticTrafficAllowed(); err != nil {
+				logInfof("flightreplay", "Flight replay: %s", err.Error())
+				return
+			}
+		}
+		flightReplayMutex.Lock()
+		if lastTs > firstTs {
+			flightReplay.Progress = float64(tsID-firstTs) / float64(lastTs-firstTs)
+		}
+		flightReplay.Time = parseLogTime(preferred)
+		flightReplayMutex.Unlock()
+
+		switch class {
+		case MSGCLASS_UAT:
+			if o, msgtype := parseInput(strings.Trim(data, " ;\r\n") + ";\n"); o != nil && msgtype != 0 {
+				relayMessage(msgtype, o)
+			}
+		case MSGCLASS_ES:
+			processDump1090Message(data)
+		case MSGCLASS_OGN:
+			processOgnMessage(data)
+		case MSGCLASS_AIS:
+			processAISMessage(nm, data)
+		case FLIGHT_REPLAY_MSGCLASS_GPS:
+			if !ownship {
+				continue
+			}
+			// Same as a network GPS, see handleNmeaInConnection()
+			globalStatus.GPS_connected = true
+			globalStatus.GPS_detected_type = GPS_TYPE_NETWORK
+			for _, sentence := range makeFlightReplayNMEA(data) {
+				processNMEALine(sentence)
+			}
+		case FLIGHT_REPLAY_MSGCLASS_SENSORS:
+			if sensors {
+				replayFlightSensors(data)
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logInfof("flightreplay", "Flight replay: %s", err.Error())
+	}
+}
+
+func startFlightReplay(startupID int64, speed float64) error {
+	flightReplayMutex.Lock()
+	defer flightReplayMutex.Unlock()
+	if flightReplay.Running {
+		return errors.New("a replay is already running")
+	}
+	if startupID == flightReplayCurrentSession() {
+		return errors.New("the current session can't be replayed")
+	}
+	if !flightReplayMode {
+		if err := syntheticTrafficAllowed(); err != nil {
+			return err
+		}
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	flightReplay = FlightReplayStatus{Running: true, StartupID: startupID, Speed: speed, Ownship: !globalStatus.GPS_connected,
+		Sensors: !globalStatus.IMUConnected && !globalStatus.BMPConnected}
+	flightReplayStop = make(chan bool, 1)
+	logInfof("flightreplay", "Starting flight replay of session %d at %.1fx speed, ownship %t, sensors %t", startupID, speed,
+		flightReplay.Ownship, flightReplay.Sensors)
+	go replayFlight(startupID, speed, flightReplay.Ownship, flightReplay.Sensors, flightReplayStop)
+	return nil
+}
+
+// Replay mode (-replaydb): replays the session, the latest one of the log if startupID is 0.
+func startReplayMode(startupID int64, speed float64) {
+	flightReplayMode = true
+	if startupID == 0 {
+		sessions, err := loadFlightReplaySessions()
+		if err != nil {
+			logInfof("flightreplay", "Replay mode: %s", err.Error())
+			return
+		}
+		if len(sessions) == 0 {
+			logInfof("flightreplay", "Replay mode: no sessions with messages in %s", flightReplayDBFilef)
+			return
+		}
+		startupID = sessions[0].StartupID
+	}
+	if err := startFlightReplay(startupID, speed); err != nil {
+		logInfof("flightreplay", "Replay mode: %s", err.Error())
+	}
+}
+
+func stopFlightReplay() {
+	flightReplayMutex.Lock()
+	defer flightReplayMutex.Unlock()
+	if flightReplay.Running {
+		flightReplayStop <- true
+	}
+}
+
+// AJAX call - /getFlightReplay. State of the replay and the sessions that can be replayed.
+func handleFlightReplayGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	sessions, err := loadFlightReplaySessions()
+	if err != nil && !os.IsNotExist(err) {
+		logInfof("flightreplay", "Flight replay: %s", err.Error())
+	}
+	flightReplayMutex.Lock()
+	status := flightReplay
+	flightReplayMutex.Unlock()
+	status.Sessions = sessions
+	if status.Sessions == nil {
+		status.Sessions = make([]FlightReplaySession, 0)
+	}
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("flightreplay", "Error sending flight replay JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /setFlightReplay?session=<startup id>&speed=<factor>. Starts the replay, stops it without session.
+func handleFlightReplaySetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	if id, err := strconv.ParseInt(q.Get("session"), 10, 64); err == nil && id > 0 {
+		speed, _ := strconv.ParseFloat(q.Get("speed"), 64)
+		if err := startFlightReplay(id, speed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		stopFlightReplay()
+	}
+	handleFlightReplayGetRequest(w, r)
+}
@@ -0,0 +1,359 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	flightsmoother.go: Offline post-processing of the replay log. A simple ground speed based detector finds
+		takeoff and landing. After landing, the mySituation rows logged during the flight are run through a
+		forward-backward (Rauch-Tung-Striebel) Kalman smoother and the refined track and attitude history is
+		written to the "smoothed_track" table of the same database, next to the raw data.
+
+		Only active while the replay log (globalSettings.ReplayLog) is enabled. flightAirborne is used by the data
+		log to buffer the flight (globalSettings.ReplayLogBufferFlight).
+*/
+
+package main
+
+import (
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	FLIGHT_TAKEOFF_SPEED = 40.0             // kts
+	FLIGHT_TAKEOFF_TIME  = 10 * time.Second // ground speed needs to be above FLIGHT_TAKEOFF_SPEED for this long
+	FLIGHT_LANDING_SPEED = 15.0             // kts
+	FLIGHT_LANDING_TIME  = 60 * time.Second // ground speed needs to be below FLIGHT_LANDING_SPEED for this long
+)
+
+var flightAirborne bool // between takeoff and landing, see flightSmootherWatcher()
+
+// Ground speed based takeoff and landing detection, shared by the smoother and the flight recorder (flightrecorder.go).
+type flightDetector struct {
+	airborne  bool
+	fastSince time.Time // zero if not above FLIGHT_TAKEOFF_SPEED
+	slowSince time.Time // zero if not below FLIGHT_LANDING_SPEED
+}
+
+const (
+	FLIGHT_EVENT_NONE = iota
+	FLIGHT_EVENT_TAKEOFF
+	FLIGHT_EVENT_LANDING
+)
+
+// Feeds the ground speed (kt) of a valid fix, returns FLIGHT_EVENT_TAKEOFF or FLIGHT_EVENT_LANDING on a change.
+func (d *flightDetector) update(gs float64, now time.Time) int {
+	if !d.airborne {
+		if gs < FLIGHT_TAKEOFF_SPEED {
+			d.fastSince = time.Time{}
+		} else if d.fastSince.IsZero() {
+			d.fastSince = now
+		} else if now.Sub(d.fastSince) > FLIGHT_TAKEOFF_TIME {
+			d.airborne = true
+			d.slowSince = time.Time{}
+			return FLIGHT_EVENT_TAKEOFF
+		}
+	} else {
+		if gs > FLIGHT_LANDING_SPEED {
+			d.slowSince = time.Time{}
+		} else if d.slowSince.IsZero() {
+			d.slowSince = now
+		} else if now.Sub(d.slowSince) > FLIGHT_LANDING_TIME {
+			d.airborne = false
+			d.fastSince = time.Time{}
+			return FLIGHT_EVENT_LANDING
+		}
+	}
+	return FLIGHT_EVENT_NONE
+}
+
+// Forgets the pending takeoff or landing, e.g. without a valid fix.
+func (d *flightDetector) reset() {
+	d.fastSince, d.slowSince = time.Time{}, time.Time{}
+}
+
+type smootherSample struct {
+	id        int64
+	t         float64 // seconds since midnight UTC, unwrapped
+	lat, lng  float64
+	alt       float64 // ft MSL
+	accuracy  float64 // m, 95%
+	pitch     float64
+	roll      float64
+	heading   float64
+	ahrsValid bool
+}
+
+// 2-state (value, rate) constant velocity model, as flat arrays: P = [p00, p01, p10, p11].
+type cvState struct {
+	x [2]float64
+	P [4]float64
+}
+
+/*
+	rtsSmoothCV().
+		Forward Kalman filter + backward RTS pass over the measurements z (variance r) at times t,
+		using a constant velocity model with white acceleration noise of spectral density q.
+*/
+func rtsSmoothCV(t, z, r []float64, q float64) []float64 {
+	n := len(z)
+	if n == 0 {
+		return nil
+	}
+	filtered := make([]cvState, n)
+	predicted := make([]cvState, n)
+
+	s := cvState{x: [2]float64{z[0], 0}, P: [4]float64{r[0], 0, 0, 100}}
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dt := t[i] - t[i-1]
+			p := filtered[i-1]
+			s.x = [2]float64{p.x[0] + dt*p.x[1], p.x[1]}
+			// P = F P F' + Q
+			p00 := p.P[0] + dt*(p.P[1]+p.P[2]) + dt*dt*p.P[3]
+			p01 := p.P[1] + dt*p.P[3]
+			p11 := p.P[3]
+			s.P = [4]float64{
+				p00 + q*dt*dt*dt/3, p01 + q*dt*dt/2,
+				p01 + q*dt*dt/2, p11 + q*dt,
+			}
+		}
+		predicted[i] = s
+		// Update with H = [1 0].
+		sk := s.P[0] + r[i]
+		k0, k1 := s.P[0]/sk, s.P[2]/sk
+		innov := z[i] - s.x[0]
+		s.x = [2]float64{s.x[0] + k0*innov, s.x[1] + k1*innov}
+		s.P = [4]float64{
+			(1 - k0) * s.P[0], (1 - k0) * s.P[1],
+			s.P[2] - k1*s.P[0], s.P[3] - k1*s.P[1],
+		}
+		filtered[i] = s
+	}
+
+	out := make([]float64, n)
+	smoothed := filtered[n-1]
+	out[n-1] = smoothed.x[0]
+	for i := n - 2; i >= 0; i-- {
+		f := filtered[i]
+		pp := predicted[i+1]
+		dt := t[i+1] - t[i]
+		// C = Pf F' inv(Pp)
+		pf00, pf01, pf10, pf11 := f.P[0], f.P[1], f.P[2], f.P[3]
+		a00, a01 := pf00+dt*pf01, pf01
+		a10, a11 := pf10+dt*pf11, pf11
+		det := pp.P[0]*pp.P[3] - pp.P[1]*pp.P[2]
+		if math.Abs(det) < 1e-12 {
+			smoothed = f
+			out[i] = f.x[0]
+			continue
+		}
+		i00, i01, i10, i11 := pp.P[3]/det, -pp.P[1]/det, -pp.P[2]/det, pp.P[0]/det
+		c00, c01 := a00*i00+a01*i10, a00*i01+a01*i11
+		c10, c11 := a10*i00+a11*i10, a10*i01+a11*i11
+
+		d0, d1 := smoothed.x[0]-pp.x[0], smoothed.x[1]-pp.x[1]
+		x := [2]float64{f.x[0] + c00*d0 + c01*d1, f.x[1] + c10*d0 + c11*d1}
+		// Ps = Pf + C (Ps_next - Pp) C'
+		e00, e01 := smoothed.P[0]-pp.P[0], smoothed.P[1]-pp.P[1]
+		e10, e11 := smoothed.P[2]-pp.P[2], smoothed.P[3]-pp.P[3]
+		g00, g01 := c00*e00+c01*e10, c00*e01+c01*e11
+		g10, g11 := c10*e00+c11*e10, c10*e01+c11*e11
+		P := [4]float64{
+			pf00 + g00*c00 + g01*c01, pf01 + g00*c10 + g01*c11,
+			pf10 + g10*c00 + g11*c01, pf11 + g10*c10 + g11*c11,
+		}
+		smoothed = cvState{x: x, P: P}
+		out[i] = x[0]
+	}
+	return out
+}
+
+func loadFlightSamples(db *sql.DB, fromID, toID int64) ([]smootherSample, error) {
+	rows, err := db.Query(`SELECT id, GPSLastFixSinceMidnightUTC, GPSLatitude, GPSLongitude, GPSAltitudeMSL, GPSHorizontalAccuracy,
+		AHRSPitch, AHRSRoll, AHRSGyroHeading, AHRSStatus FROM mySituation WHERE id > ? AND id <= ? AND GPSFixQuality > 0 ORDER BY id`, fromID, toID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]smootherSample, 0)
+	dayOffset := 0.0
+	for rows.Next() {
+		var s smootherSample
+		var ahrsStatus int
+		if err := rows.Scan(&s.id, &s.t, &s.lat, &s.lng, &s.alt, &s.accuracy, &s.pitch, &s.roll, &s.heading, &ahrsStatus); err != nil {
+			return nil, err
+		}
+		s.ahrsValid = !isAHRSInvalidValue(s.pitch) && !isAHRSInvalidValue(s.roll) && !isAHRSInvalidValue(s.heading)
+		if len(samples) > 0 {
+			last := samples[len(samples)-1]
+			if s.t+dayOffset < last.t-43200 { // midnight UTC passed
+				dayOffset += 86400
+			}
+			s.t += dayOffset
+			if s.t <= last.t { // same fix logged several times (one row per NMEA sentence). Keep the latest.
+				s.t = last.t
+				samples[len(samples)-1] = s
+				continue
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, rows.Err()
+}
+
+/*
+	smoothFlight().
+		Runs the smoother over all mySituation rows with fromID < id <= toID and stores the result.
+*/
+func smoothFlight(fromID, toID int64) {
+	db, err := sql.Open("sqlite3", dataLogFilef)
+	if err != nil {
+		logErrorf("flightsmoother", "sql.Open(): %s", err.Error())
+		return
+	}
+	defer db.Close()
+
+	samples, err := loadFlightSamples(db, fromID, toID)
+	if err != nil {
+		logErrorf("flightsmoother", "reading flight: %s", err.Error())
+		return
+	}
+	if len(samples) < 10 {
+		logInfof("flightsmoother", "only %d samples, not smoothing", len(samples))
+		return
+	}
+
+	n := len(samples)
+	t := make([]float64, n)
+	north, east, alt := make([]float64, n), make([]float64, n), make([]float64, n)
+	rPos, rAlt := make([]float64, n), make([]float64, n)
+	pitch, roll, heading, rAtt := make([]float64, n), make([]float64, n), make([]float64, n), make([]float64, n)
+	lat0, lng0 := samples[0].lat, samples[0].lng
+	for i, s := range samples {
+		t[i] = s.t
+		_, _, north[i], east[i] = common.DistRect(lat0, lng0, s.lat, s.lng)
+		alt[i] = s.alt
+		sigma := math.Max(s.accuracy, 1) / 2 // 95% -> 1 sigma
+		rPos[i] = sigma * sigma
+		rAlt[i] = (sigma * 1.5 * 3.28084) * (sigma * 1.5 * 3.28084) // vertical is worse than horizontal, in ft
+		rAtt[i] = 1
+		if !s.ahrsValid {
+			rAtt[i] = 1e6 // effectively ignore this attitude measurement
+			if i > 0 {
+				samples[i].pitch, samples[i].roll, samples[i].heading = samples[i-1].pitch, samples[i-1].roll, samples[i-1].heading
+			}
+		}
+		pitch[i] = samples[i].pitch
+		roll[i] = samples[i].roll
+		heading[i] = samples[i].heading
+		if i > 0 { // unwrap heading
+			for heading[i]-heading[i-1] > 180 {
+				heading[i] -= 360
+			}
+			for heading[i]-heading[i-1] < -180 {
+				heading[i] += 360
+			}
+		}
+	}
+
+	northS := rtsSmoothCV(t, north, rPos, 4)
+	eastS := rtsSmoothCV(t, east, rPos, 4)
+	altS := rtsSmoothCV(t, alt, rAlt, 40)
+	pitchS := rtsSmoothCV(t, pitch, rAtt, 10)
+	rollS := rtsSmoothCV(t, roll, rAtt, 50)
+	headingS := rtsSmoothCV(t, heading, rAtt, 50)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS smoothed_track (id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT, flight_start_id INTEGER,
+		situation_id INTEGER, SecondsSinceMidnightUTC REAL, Lat REAL, Lng REAL, AltitudeMSL REAL, Pitch REAL, Roll REAL, Heading REAL)`)
+	if err != nil {
+		logErrorf("flightsmoother", "creating table: %s", err.Error())
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		logErrorf("flightsmoother", "db.Begin(): %s", err.Error())
+		return
+	}
+	stmt, err := tx.Prepare(`INSERT INTO smoothed_track (flight_start_id, situation_id, SecondsSinceMidnightUTC, Lat, Lng, AltitudeMSL, Pitch, Roll, Heading)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		logErrorf("flightsmoother", "prepare: %s", err.Error())
+		return
+	}
+	defer stmt.Close()
+	mPerDegLat := 111132.954
+	mPerDegLng := mPerDegLat * math.Cos(common.Radians(lat0))
+	for i, s := range samples {
+		lat := lat0 + northS[i]/mPerDegLat
+		lng := lng0 + eastS[i]/mPerDegLng
+		hdg := math.Mod(headingS[i], 360)
+		if hdg < 0 {
+			hdg += 360
+		}
+		if _, err := stmt.Exec(fromID, s.id, math.Mod(s.t, 86400), lat, lng, altS[i], pitchS[i], rollS[i], hdg); err != nil {
+			tx.Rollback()
+			logErrorf("flightsmoother", "insert: %s", err.Error())
+			return
+		}
+	}
+	tx.Commit()
+	logInfof("flightsmoother", "stored %d smoothed samples for flight starting after situation id %d", n, fromID)
+}
+
+func maxSituationLogID() (int64, error) {
+	db, err := sql.Open("sqlite3", dataLogFilef)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	var id int64
+	err = db.QueryRow("SELECT IFNULL(MAX(id), 0) FROM mySituation").Scan(&id)
+	return id, err
+}
+
+// Detects takeoff and landing from GPS ground speed and triggers smoothing of the logged flight after landing.
+func flightSmootherWatcher() {
+	var detector flightDetector
+	var flightStartID int64
+
+	ticker := time.NewTicker(1 * time.Second)
+	for {
+		<-ticker.C
+		if !globalSettings.ReplayLog || !isDataLogReady() || !isGPSValid() {
+			detector.reset()
+			continue
+		}
+		switch detector.update(mySituation.GPSGroundSpeed, stratuxClock.Time) {
+		case FLIGHT_EVENT_TAKEOFF:
+			id, err := maxSituationLogID()
+			if err != nil {
+				logErrorf("flightsmoother", "%s", err.Error())
+				detector.airborne = false // takeoff again on the next fix
+				continue
+			}
+			logInfof("flightsmoother", "takeoff detected")
+			flightAirborne = true
+			flightStartID = id
+		case FLIGHT_EVENT_LANDING:
+			logInfof("flightsmoother", "landing detected")
+			flightAirborne = false
+			startID := flightStartID
+			go func() {
+				flushDataLog() // write the rows of the flight, they may be buffered in RAM
+				endID, err := maxSituationLogID()
+				if err != nil {
+					logErrorf("flightsmoother", "%s", err.Error())
+					return
+				}
+				smoothFlight(startID, endID)
+			}()
+		}
+	}
+}
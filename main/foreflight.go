@@ -0,0 +1,207 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	foreflight.go: Device identification for ForeFlight and apps using its GDL90 extensions, so the app labels the
+		device, picks the right options and shows the connection status:
+			GDL90 0x65 0x00 (ID message)          every second with the heartbeat: serial number, short and long name,
+			                                      capabilities (MSL altitude datum, internet policy)
+			UDP broadcast to KEEPALIVE_ACK_PORT   every FF_ANNOUNCE_INTERVAL, JSON like the app announcements (see
+			                                      keepalive.go) plus the device, its capabilities and AHRS availability
+		Enabled by globalSettings.ForeFlightAnnounce, the ID message is always sent.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FF_ANNOUNCE_INTERVAL = 5 * time.Second
+	FF_SHORT_NAME_LEN    = 8
+	FF_LONG_NAME_LEN     = 16
+	FF_SERIAL_INVALID    = 0xFFFFFFFFFFFFFFFF
+
+	// Internet policy of the ID message: may the app use the internet while connected to the device's WiFi
+	FF_INTERNET_UNRESTRICTED = 0
+	FF_INTERNET_EXPENSIVE    = 1
+	FF_INTERNET_DISALLOWED   = 2
+)
+
+var ffInternetPolicyNames = []string{"unrestricted", "expensive", "disallowed"}
+
+type foreFlightCapabilities struct {
+	AHRS           bool // attitude is valid and sent (0x65 0x01 and 0x4C)
+	GPS            bool
+	PressureAlt    bool
+	MSLAltitude    bool   // ownship geometric altitude is MSL instead of HAE
+	InternetPolicy string // unrestricted, expensive, disallowed
+}
+
+type foreFlightDevice struct {
+	Name         string
+	LongName     string
+	Serial       string // hex, empty if unknown
+	Version      string
+	Capabilities foreFlightCapabilities
+}
+
+// Announcement broadcast by stratux. App, GDL90 as in the announcements of the apps, so they can parse both.
+type foreFlightAnnouncement struct {
+	App   string
+	GDL90 struct {
+		Port int `json:"port"`
+	}
+	Device *foreFlightDevice
+}
+
+var ffSerialOnce sync.Once
+var ffSerial uint64 = FF_SERIAL_INVALID
+
+// Serial number of the device: the one of the Raspberry Pi's CPU, FF_SERIAL_INVALID if there is none.
+func foreFlightSerial() uint64 {
+	ffSerialOnce.Do(func() {
+		cpuinfo, err := ioutil.ReadFile("/proc/cpuinfo")
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(cpuinfo), "\n") {
+			// Serial		: 00000000a1b2c3d4
+			fields := strings.SplitN(line, ":", 2)
+			if len(fields) != 2 || strings.TrimSpace(fields[0]) != "Serial" {
+				continue
+			}
+			if serial, err := strconv.ParseUint(strings.TrimSpace(fields[1]), 16, 64); err == nil && serial != 0 {
+				ffSerial = serial
+			}
+		}
+	})
+	return ffSerial
+}
+
+// Short name (8 characters) and long name (16 characters) of the device.
+func foreFlightNames() (string, string) {
+	name := strings.TrimSpace(globalSettings.ForeFlightName)
+	if len(name) == 0 {
+		name = "Stratux"
+	}
+	if len(name) > FF_SHORT_NAME_LEN {
+		name = name[:FF_SHORT_NAME_LEN]
+	}
+	longName := fmt.Sprintf("%s-%s", stratuxVersion, stratuxBuild)
+	if len(longName) > FF_LONG_NAME_LEN {
+		longName = longName[:FF_LONG_NAME_LEN]
+	}
+	return name, longName
+}
+
+func foreFlightInternetPolicy() int {
+	if globalSettings.ForeFlightInternetPolicy < FF_INTERNET_UNRESTRICTED || globalSettings.ForeFlightInternetPolicy > FF_INTERNET_DISALLOWED {
+		return FF_INTERNET_UNRESTRICTED
+	}
+	return globalSettings.ForeFlightInternetPolicy
+}
+
+// ForeFlight "ID Message". Sends device information to ForeFlight.
+func makeFFIDMessage() []byte {
+	msg := make([]byte, 39)
+	msg[0] = 0x65 // Message type "ForeFlight".
+	msg[1] = 0    // ID message identifier.
+	msg[2] = 1    // Message version.
+	// Serial number, big endian. All 0xFF = invalid.
+	serial := foreFlightSerial()
+	for i := 0; i < 8; i++ {
+		msg[3+i] = byte(serial >> uint(56-8*i))
+	}
+	name, longName := foreFlightNames()
+	copy(msg[11:], name)
+	copy(msg[19:], longName)
+
+	// Capabilities mask, bytes 35-38. Bit 0: Ownship Geometric report is MSL instead of HAE as in spec.
+	// Bits 1-2: internet policy.
+	capabilities := uint32(foreFlightInternetPolicy()) << 1
+	if globalSettings.GDL90MSLAlt_Enabled {
+		capabilities |= 0x01
+	}
+	msg[35] = byte(capabilities >> 24)
+	msg[36] = byte(capabilities >> 16)
+	msg[37] = byte(capabilities >> 8)
+	msg[38] = byte(capabilities)
+
+	return prepareMessage(msg)
+}
+
+func makeFFAnnouncement() ([]byte, error) {
+	name, longName := foreFlightNames()
+	device := &foreFlightDevice{
+		Name:     name,
+		LongName: longName,
+		Version:  stratuxVersion,
+		Capabilities: foreFlightCapabilities{
+			AHRS:           isAHRSValid(),
+			GPS:            isGPSValid(),
+			PressureAlt:    isTempPressValid(),
+			MSLAltitude:    globalSettings.GDL90MSLAlt_Enabled,
+			InternetPolicy: ffInternetPolicyNames[foreFlightInternetPolicy()],
+		},
+	}
+	if serial := foreFlightSerial(); serial != FF_SERIAL_INVALID {
+		device.Serial = strconv.FormatUint(serial, 16)
+	}
+	announcement := foreFlightAnnouncement{App: "Stratux", Device: device}
+	for _, o := range globalSettings.NetworkOutputs {
+		if o.Capability&NETWORK_GDL90_STANDARD != 0 {
+			announcement.GDL90.Port = int(o.Port)
+			break
+		}
+	}
+	return json.Marshal(announcement)
+}
+
+// Broadcasts the announcement to every IPv4 network every FF_ANNOUNCE_INTERVAL.
+func foreFlightAnnouncer() {
+	// Go enables SO_BROADCAST on UDP sockets
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		logErrorf("foreflight", "can't open announcement socket: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	registerSubsystem("foreflight", 3*FF_ANNOUNCE_INTERVAL)
+	ticker := time.NewTicker(FF_ANNOUNCE_INTERVAL)
+	for {
+		<-ticker.C
+		subsystemAlive("foreflight")
+		if !globalSettings.ForeFlightAnnounce {
+			continue
+		}
+		msg, err := makeFFAnnouncement()
+		if err != nil {
+			logErrorf("foreflight", "%s", err.Error())
+			continue
+		}
+		nets, err := outputInterfaceNets("")
+		if err != nil {
+			continue
+		}
+		for _, n := range nets {
+			bcast := broadcastAddr(n)
+			if bcast == nil {
+				continue
+			}
+			if _, err := conn.WriteToUDP(msg, &net.UDPAddr{IP: bcast, Port: KEEPALIVE_ACK_PORT}); err != nil && globalSettings.DEBUG {
+				logDebugf("foreflight", "announcement to %s: %s", bcast.String(), err.Error())
+			}
+		}
+	}
+}
@@ -53,6 +53,7 @@ const (
 	logDir         = "/var/log/"
 	debugLogFile   = "stratux.log"
 	dataLogFile    = "stratux.sqlite"
+	flightRecorderFile = "stratux-flights.sqlite"
 	//FlightBox: log to /root.
 	logDir_FB           = "/root/"
 	maxDatagramSize     = 8192
@@ -353,14 +354,13 @@ func makeOwnshipReport() bool {
 	} else if isTempPressValid() {
 		altf = float64(mySituation.BaroPressureAltitude)
 		validAltf = true
-	} else if isGPSValid() {
+	} else if isGPSValid() && globalSettings.GDL90PressureAltFromGPS {
 		altf = float64(mySituation.GPSAltitudeMSL)
 		validAltf = true
 	}
 
 	if validAltf {
-		altf = (altf + 1000) / 25
-		alt = uint16(altf) & 0xFFF // Should fit in 12 bits.
+		alt = encodeGDL90PressureAltitude(altf)
 	}
 
 	msg[11] = byte((alt & 0xFF0) >> 4) // Altitude.
@@ -369,9 +369,10 @@ func makeOwnshipReport() bool {
 		msg[12] = msg[12] | 0x09 // "Airborne" + "True Track"
 	}
 
-	msg[13] = byte(0x80 | (mySituation.GPSNACp & 0x0F)) //Set NIC = 8 and use NACp from gps.go.
+	nic, nacp := getGPSIntegrity() // NIC = 8 and NACp from gps.go, unless gpsintegrity.go detected a problem
+	msg[13] = byte(((nic & 0x0F) << 4) | (nacp & 0x0F))
 
-	gdSpeed := uint16(0) // 1kt resolution.
+	gdSpeed := uint16(0xFFF) // 1kt resolution. 0xFFF = no information available.
 	if selfOwnshipValid && curOwnship.Speed_valid {
 		gdSpeed = curOwnship.Speed
 	} else if isGPSGroundTrackValid() {
@@ -427,7 +428,9 @@ func makeOwnshipReport() bool {
 
 	myReg := "Stratux" // Default callsign.
 	// Use icao2reg() results for ownship tail number, if available.
-	if len(code) == 3 {
+	if len(globalSettings.OwnshipCallsign) > 0 {
+		myReg = globalSettings.OwnshipCallsign
+	} else if len(code) == 3 {
 		uintIcao := uint32(code[0])<<16 | uint32(code[1])<<8 | uint32(code[2])
 		regFromIcao, regFromIcaoValid := icao2reg(uintIcao)
 		if regFromIcaoValid {
@@ -446,12 +449,26 @@ func makeOwnshipReport() bool {
 		msg[19+i] = myReg[i]
 	}
 
-	sendGDL90(prepareMessage(msg), time.Second, -1)
-	sendXPlane(createXPlaneGpsMsg(lat, lon, mySituation.GPSAltitudeMSL, groundTrack, float32(gdSpeed)), time.Second, -1)
+	msg[27] = transponderEmergencyCode() << 4 // Emergency/priority code from the squawk.
+
+	sendGDL90(prepareMessage(msg), time.Second, MSGPRIO_OWNSHIP)
+	xplaneSpeed := float32(0)
+	if gdSpeed != 0xFFF {
+		xplaneSpeed = float32(gdSpeed)
+	}
+	sendXPlane(createXPlaneGpsMsg(lat, lon, mySituation.GPSAltitudeMSL, groundTrack, xplaneSpeed), time.Second, MSGPRIO_OWNSHIP)
 
 	return true
 }
 
+// Encodes a pressure altitude (ft) in 25ft steps with -1000ft offset, 0xFFF if out of range. See p.20.
+func encodeGDL90PressureAltitude(altf float64) uint16 {
+	if altf < -1000 || altf > 101350 {
+		return 0xFFF
+	}
+	return uint16((altf+1000)/25) & 0xFFF
+}
+
 func makeOwnshipGeometricAltitudeReport() bool {
 	if !isGPSValid() {
 		return false
@@ -461,16 +478,26 @@ func makeOwnshipGeometricAltitudeReport() bool {
 	msg[0] = 0x0B // Message type "Ownship Geo Alt".
 
 	var GPSalt float32
-	GPSalt = mySituation.GPSHeightAboveEllipsoid
+	GPSalt = mySituation.GPSHeightAboveEllipsoid // GDL90 specifies HAE, but some EFBs expect MSL
+	if globalSettings.GDL90MSLAlt_Enabled {
+		GPSalt = mySituation.GPSAltitudeMSL
+	}
 	encodedAlt := int16(GPSalt / 5)    // GPS Altitude, encoded to 16-bit int using 5-foot resolution
+	if GPSalt/5 > math.MaxInt16 || GPSalt/5 < math.MinInt16 {
+		encodedAlt = 0 // out of range, shouldn't happen with a valid fix
+	}
 	msg[1] = byte(encodedAlt >> 8)     // Altitude.
 	msg[2] = byte(encodedAlt & 0x00FF) // Altitude.
 
-	//TODO: "Figure of Merit". 0x7FFF "Not available".
-	msg[3] = 0x00
-	msg[4] = 0x0A
+	// Vertical Figure of Merit, meters. 0x7FFF "Not available", 0x7FFE "> 32766m".
+	vfom := uint16(0x7FFF)
+	if mySituation.GPSVerticalAccuracy > 0 {
+		vfom = uint16(math.Min(float64(mySituation.GPSVerticalAccuracy), 0x7FFE))
+	}
+	msg[3] = byte((vfom & 0x7F00) >> 8) // Vertical warning bit not set.
+	msg[4] = byte(vfom & 0x00FF)
 
-	sendGDL90(prepareMessage(msg), time.Second, -1)
+	sendGDL90(prepareMessage(msg), time.Second, MSGPRIO_OWNSHIP)
 	return true
 }
 
@@ -579,6 +606,11 @@ func makeStratuxStatus() []byte {
 		msg[12] = 1 << 0
 	}
 
+	// Power degraded: undervoltage now or recently.
+	if isPowerDegraded() {
+		msg[12] = msg[12] | (1 << 1)
+	}
+
 	// Valid/Enabled: last bit unused.
 
 	// Connected hardware: number of radios.
@@ -664,41 +696,6 @@ func makeStratuxHeartbeat() []byte {
 	return prepareMessage(msg)
 }
 
-/*
-
-	ForeFlight "ID Message".
-
-	Sends device information to ForeFlight.
-
-*/
-func makeFFIDMessage() []byte {
-	msg := make([]byte, 39)
-	msg[0] = 0x65 // Message type "ForeFlight".
-	msg[1] = 0    // ID message identifier.
-	msg[2] = 1    // Message version.
-	// Serial number. Set to "invalid" for now.
-	for i := 3; i <= 10; i++ {
-		msg[i] = 0xFF
-	}
-	devShortName := "Stratux" // Temporary. Will be populated in the future with other names.
-	if len(devShortName) > 8 {
-		devShortName = devShortName[:8] // 8 chars.
-	}
-	copy(msg[11:], devShortName)
-
-	devLongName := fmt.Sprintf("%s-%s", stratuxVersion, stratuxBuild)
-	if len(devLongName) > 16 {
-		devLongName = devLongName[:16] // 16 chars.
-	}
-	copy(msg[19:], devLongName)
-
-	//if globalSettings.GDL90MSLAlt_Enabled {
-		msg[38] = 0x00 // Capabilities mask. MSL altitude for Ownship Geometric report. We only support HAE as in spec.
-	//}
-
-	return prepareMessage(msg)
-}
-
 func makeHeartbeat() []byte {
 	msg := make([]byte, 7)
 	// See p.10.
@@ -709,8 +706,8 @@ func makeHeartbeat() []byte {
 	}
 	msg[1] = msg[1] | 0x10 //FIXME: Addr talkback.
 
-	// "Maintenance Req'd". Add flag if there are any current critical system errors.
-	if len(globalStatus.Errors) > 0 {
+	// "Maintenance Req'd". Add flag if there are any current critical system errors or the power is degraded.
+	if len(globalStatus.Errors) > 0 || isPowerDegraded() {
 		msg[1] = msg[1] | 0x40
 	}
 
@@ -730,7 +727,8 @@ func makeHeartbeat() []byte {
 	return prepareMessage(msg)
 }
 
-func relayMessage(msgtype uint16, msg []byte) {
+// GDL90 message relaying a UAT message.
+func makeRelayMessage(msgtype uint16, msg []byte) []byte {
 	ret := make([]byte, len(msg)+4)
 	// See p.15.
 	ret[0] = byte(msgtype) // Uplink message ID.
@@ -741,12 +739,15 @@ func relayMessage(msgtype uint16, msg []byte) {
 	for i := 0; i < len(msg); i++ {
 		ret[i+4] = msg[i]
 	}
+	return prepareMessage(ret)
+}
 
-	durability := 1 * time.Second
+func relayMessage(msgtype uint16, msg []byte) {
 	if msgtype == MSGTYPE_UPLINK {
-		durability = 15 * time.Minute // queue weather messages
+		sendUplinkMsg(msg, 15*time.Minute, MSGPRIO_UPLINK) // queue weather messages
+		return
 	}
-	sendGDL90(prepareMessage(ret), durability, 4)
+	sendGDL90(makeRelayMessage(msgtype, msg), 1*time.Second, MSGPRIO_FEED)
 }
 
 func blinkStatusLED() {
@@ -770,21 +771,23 @@ func blinkStatusLED() {
 
 func sendAllOwnshipInfo() {
 	//log.Printf("Sending ownship info")
-	sendGDL90(makeHeartbeat(), time.Second, -20) // Highest priority, always needs to be send because we use it to detect when a client becomes available
-	sendGDL90(makeStratuxHeartbeat(), time.Second, 0)
-	sendGDL90(makeStratuxStatus(), time.Second, 0)
-	sendGDL90(makeFFIDMessage(), time.Second, 0)
+	sendGDL90(makeHeartbeat(), time.Second, MSGPRIO_HEARTBEAT) // Highest priority, always needs to be send because we use it to detect when a client becomes available
+	sendGDL90(makeStratuxHeartbeat(), time.Second, MSGPRIO_STATUS)
+	sendGDL90(makeStratuxStatus(), time.Second, MSGPRIO_STATUS)
+	sendGDL90(makeFFIDMessage(), time.Second, MSGPRIO_STATUS)
 	makeOwnshipReport()
 	makeOwnshipGeometricAltitudeReport()
 }
 
 func heartBeatSender() {
+	registerSubsystem("heartbeat", 5*time.Second)
 	timer := time.NewTicker(1 * time.Second)
 	timerMessageStats := time.NewTicker(2 * time.Second)
 	ledBlinking := false
 	for {
 		select {
 		case <-timer.C:
+			subsystemAlive("heartbeat")
 			// Green LED - always on during normal operation.
 			//  Blinking when there is a critical system error (and Stratux is still running).
 
@@ -801,12 +804,16 @@ func heartBeatSender() {
 
 			sendAllOwnshipInfo()
 
-			sendNetFLARM(makeGPRMCString(), time.Second, -1)
-			sendNetFLARM(makeGPGGAString(), time.Second, 0)
+			sendNetFLARM(makeGPRMCString(), time.Second, MSGPRIO_OWNSHIP)
+			sendNetFLARM(makeGPGGAString(), time.Second, MSGPRIO_OWNSHIP)
 			if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_NONE && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
-				sendNetFLARM(makePGRMZString(), time.Second, 0)
+				sendNetFLARM(makePGRMZString(), time.Second, MSGPRIO_OWNSHIP)
 			}
-			sendNetFLARM("$GPGSA,A,3,,,,,,,,,,,,,1.0,1.0,1.0*33\r\n", time.Second, 1)
+			sendNetFLARM("$GPGSA,A,3,,,,,,,,,,,,,1.0,1.0,1.0*33\r\n", time.Second, MSGPRIO_AUX)
+			if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_NONE && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
+				sendNetFLARM(makeLXWP0String(), time.Second, MSGPRIO_AUX)
+			}
+			sendCustomNMEASentences()
 
 			// --- debug code: traffic demo ---
 			// Uncomment and compile to display large number of artificial traffic targets
@@ -826,7 +833,10 @@ func heartBeatSender() {
 			*/
 
 			// ---end traffic demo code ---
+			updateTrafficSimulation()
 			sendTrafficUpdates()
+			updateTFRAlerts()
+			updateWxAdvisoryAlerts()
 			updateStatus()
 		case <-timerMessageStats.C:
 			// Save a bit of CPU by not pruning the message log every 1 second.
@@ -839,6 +849,7 @@ func msgLogAppend(m msg) {
 	msgLogMutex.Lock()
 	defer msgLogMutex.Unlock()
 	msgLog = append(msgLog, m)
+	metricsMessageDecoded(m.MessageClass)
 }
 
 func updateMessageStats() {
@@ -988,6 +999,7 @@ type WeatherMessage struct {
 	Time              string
 	Data              string
 	LocaltimeReceived time.Time
+	Source            string // WX_SOURCE_FISB or WX_SOURCE_INTERNET
 }
 
 // Send update to connected websockets.
@@ -1016,9 +1028,14 @@ func registerADSBTextMessageReceived(msg string, uatMsg *uatparse.UATMsg) {
 	wm.Time = x[2]
 	wm.Data = strings.Join(x[3:], " ")
 	wm.LocaltimeReceived = stratuxClock.Time
+	wm.Source = WX_SOURCE_FISB
 
 	// Send to weatherUpdate channel for any connected clients.
 	weatherUpdate.SendJSON(wm)
+
+	if uatMsg != nil {
+		registerWxReport(msg, uatMsg.Lat, uatMsg.Lon)
+	}
 }
 
 func UpdateUATStats(ProductID uint32) {
@@ -1077,6 +1094,12 @@ func parseInput(buf string) ([]byte, uint16) {
 		}
 	}
 
+	if thisSignalStrength > 0 {
+		captureRF(RF_CAPTURE_UAT, 20*math.Log10(float64(thisSignalStrength)/1000), strings.TrimSpace(buf))
+	} else {
+		captureRF(RF_CAPTURE_UAT, -999, strings.TrimSpace(buf))
+	}
+
 	if s[0] == '-' {
 		parseDownlinkReport(s, int(thisSignalStrength))
 	}
@@ -1102,7 +1125,10 @@ func parseInput(buf string) ([]byte, uint16) {
 	}
 
 	if msgtype == 0 {
-		log.Printf("UNKNOWN MESSAGE TYPE: %s - msglen=%d\n", s, msglen)
+		logInfof("main", "UNKNOWN MESSAGE TYPE: %s - msglen=%d", s, msglen)
+	}
+	if msgtype != 0 && globalSettings.UATRawOutputPort > 0 {
+		sendMsg([]byte(strings.TrimSpace(buf)+"\n"), NETWORK_UAT_RAW, time.Second, MSGPRIO_FEED)
 	}
 
 	// Now, begin converting the string into a byte array.
@@ -1131,6 +1157,11 @@ func parseInput(buf string) ([]byte, uint16) {
 			for _, f := range uatMsg.Frames {
 				thisMsg.Products = append(thisMsg.Products, f.Product_id)
 				UpdateUATStats(f.Product_id)
+				updateNexradBlocks(f)
+				updateNotams(f)
+				updateWxAdvisories(f)
+				updateLightning(f)
+				updateFISBInventory(towerid, uatMsg.Lat, uatMsg.Lon, f)
 				weatherRawUpdate.SendJSON(f)
 			}
 			// Get all of the text reports.
@@ -1167,26 +1198,47 @@ type settings struct {
 	ES_Enabled           bool
 	OGN_Enabled        bool
 	APRS_Enabled        bool
+	APRSUpload          bool   // forward received OGN traffic to glidernet as ground station, see aprsupload.go
+	APRSStationName     string // "" = generated from the CPU serial
 	AIS_Enabled        bool
 	Ping_Enabled         bool
 	GPS_Enabled          bool
 	BMP_Sensor_Enabled   bool
 	IMU_Sensor_Enabled   bool
 	NetworkOutputs       []networkConnection
+	NetworkClients       map[string]NetworkClient // client IP -> outputs/rate limits, see clientmanager.go
 	SerialOutputs        map[string]serialConnection
 	DisplayTrafficSource bool
 	DEBUG                bool
 	ReplayLog            bool
+	ReplayLogWriteInterval int  // s between the writes of the replay log, see datalog.go
+	ReplayLogBufferFlight  bool // keep the replay log in RAM while airborne, it is written after landing
 	AHRSLog              bool
 	PersistentLogging    bool
 	IMUMapping           [2]int     // Map from aircraft axis to sensor axis: accelerometer
 	SensorQuaternion     [4]float64 // Quaternion mapping from sensor frame to aircraft frame
 	C, D                 [3]float64 // IMU Accel, Gyro zero bias
 	PPM                  int
+	UAT_RemoteSDR        string            // host:port of an rtl_tcp server used instead of a local 978 dongle, see sdr_remote.go
+	ES_RemoteSDR         string            // same for 1090
+	ES_NetInput          string            // host:port of an external 1090 decoder, see esinput.go
+	ES_NetInputFormat    string            // ES_INPUT_FORMAT_BEAST or ES_INPUT_FORMAT_AVR
+	SDRAutoGain          bool              // closed-loop tuner gain optimization, see sdr_autogain.go
+	SDRGains             map[string]int    // learned tuner gain per dongle serial, tenths of dB
+	SDRPPMAutoCal        bool              // automatic frequency correction, see sdr_ppm.go
+	SDRPPMs              map[string]int    // learned PPM correction per dongle serial
+	SDRRoles             map[string]string // dongle serial -> role (SDR_ROLE_*), overrides the stx:<freq> serial tag
+	UAT_BiasTee          bool              // enable the dongle's bias tee (LNA power) on (re)initialization
+	ES_BiasTee           bool
+	OGN_BiasTee          bool
+	AIS_BiasTee          bool
 	AltitudeOffset       int
 	OwnshipModeS         string
+	OwnshipCallsign      string // callsign of the ownship report, "" = from the ICAO address or "Stratux"
+	OwnshipShadowFilter  bool // suppress TIS-B/ADS-R rebroadcasts of ourselves, see ownshipfilter.go
 	WatchList            string
 	DeveloperMode        bool
+	SetupCompleted       bool // first-run setup wizard done or skipped, see setupwizard.go
 	GLimits              string
 	StaticIps            []string
 	WiFiCountry          string
@@ -1206,6 +1258,18 @@ type settings struct {
 	RadarLimits          int
 	RadarRange           int
 
+	TrafficCoastTime     int // seconds a target with known track and speed is dead-reckoned after its last update, 0 = off
+	ES_TrafficTimeout    int // seconds a target is shown without update (if not coasted)
+	UAT_TrafficTimeout   int
+	OGN_TrafficTimeout   int
+
+	TrafficMaxTargets       int     // max targets sent per update, the most threatening ones, 0 = all. See computeTrafficPriority()
+	TrafficPrioAltBand      int     // ft, targets within this altitude band are fully relevant, see declutter.go
+	TrafficPrioAltMax       int     // ft, targets further away vertically are not relevant at all
+	TrafficPrioCPATime      int     // s, closest approaches further in the future don't add to the threat score
+	TrafficPrioCritical     float64 // threat score from which traffic is sent even to throttled clients
+	TrafficPrioCriticalDist float64 // nm, traffic this close and within TrafficPrioAltBand is sent even to throttled clients
+
 	OGNI2CTXEnabled      bool
 	OGNAddr              string
 	OGNAddrType          int            // 0=random, 1=ICAO, 2=Flarm, 3=OGN
@@ -1213,8 +1277,131 @@ type settings struct {
 	OGNPilot             string
 	OGNReg               string
 	OGNTxPower           int
+	OGNStealth           bool   // other trackers don't show our exact position
+	OGNNoTrack           bool   // ground stations don't publish our track
+	OGNTrackerDevice     string // OGN tracker on its own serial port, "" = none. See ogntracker.go
+	OGNTrackerBaud       int
+	OGNDDBAutoUpdate     bool // download OGN DDB/FlarmNet when outdated, see ognddb.go
+	OGNDDBShowCN         bool // show the competition ID of gliders instead of the registration
+
+	InternetWeather      bool // fetch weather from the internet without FIS-B reception, see internetweather.go
+	InternetWeatherRange int  // nm around ownship
+
+	WindForecast         bool   // download the Open-Meteo wind/thermal forecast, see windforecast.go
+	WindForecastRegion   string // "south,west,north,east" in deg, "" = around ownship
 
 	PWMDutyMin           int
+	FanControlMode       string          // "pid" (hold the target temperature) or "curve", see fancontrol_main
+	FanCurve             []FanCurvePoint // duty cycle by CPU temperature in "curve" mode
+	FanHysteresis        float64         // deg C the temperature has to fall before the curve lowers the duty cycle
+	FanSpinUpDuty        int             // % to start the fan from a standstill with
+	FanTachPin           int             // BCM GPIO of the fan tachometer, 0 = none
+	FanTachPulses        int             // tachometer pulses per revolution
+
+	NMEAOutputSentences  map[string]string // output ("UDP:2000", "TCP", "/dev/serialout_nmea0") -> comma separated sentence types. See nmeaoutput.go
+	NMEACustomSentences  []string          // text/template NMEA sentences, see nmeaoutput.go
+
+	TrafficOutputFilters map[string]TrafficOutputFilter // client IP or output (as NMEAOutputSentences) -> filter. See trafficoutputfilter.go
+	UplinkOutputFilters  map[string]string              // client IP or output -> comma separated FIS-B product classes. See uplinkoutputfilter.go
+	TrafficCategoryRules []TrafficCategoryRule          // hide/highlight/alert by emitter category. See emittercategory.go
+
+	GDL90TCPPort          int // TCP port serving the GDL90 stream, 0 = disabled
+	FLARMNMEAPort         int // TCP port serving the FLARM NMEA stream (PFLAA/PFLAU/GPRMC/...), 0 = disabled
+	NMEASerialBaud        int // baud rate of the /dev/serialout_nmea* outputs
+	GPSPassthroughTCPPort int // TCP port serving the raw GPS NMEA stream, 0 = disabled
+	BeastOutputPort       int // TCP port serving the 1090 frames in Beast format, 0 = disabled, see beastoutput.go
+	UATRawOutputPort      int // TCP port serving the raw UAT frames in dump978 format, 0 = disabled
+	SBSOutputPort         int // TCP port serving traffic as SBS-1 BaseStation CSV, 0 = disabled, see surveillanceoutput.go
+
+	BluetoothEnabled     bool   // GDL90/FLARM NMEA output over Bluetooth (BlueZ), see bluetooth.go
+	BluetoothName        string // advertised name / adapter alias
+	BluetoothBLEOutput   uint16 // capability of the BLE output (NETWORK_GDL90_STANDARD, NETWORK_FLARM_NMEA, ...), 0 = disabled
+	BluetoothSPPOutput   uint16 // capability of the SPP output, 0 = disabled
+
+	MDNSEnabled          bool // advertise the outputs and the web UI via mDNS/DNS-SD, see mdns.go
+
+	ForeFlightAnnounce       bool   // broadcast the device announcement on UDP 63093, see foreflight.go
+	ForeFlightName           string // short name in the ForeFlight ID message, max. 8 characters
+	ForeFlightInternetPolicy int    // FF_INTERNET_*: may apps use the internet while connected to stratux
+
+	APIAuthEnabled       bool       // mutating management API requests need a token, see api.go
+	APILegacyOpen        bool       // legacy endpoints (/setSettings, /reboot, ...) stay unauthenticated
+	APITokens            []APIToken // set through /api/v1/auth/tokens only
+
+	LogLevel             string            // debug, info, warn, error. See logging.go
+	LogLevels            map[string]string // subsystem -> level, overrides LogLevel
+
+	WireGuardEnabled     bool            // remote access tunnel wg0, see wireguard.go
+	WireGuardAddress     string          // address of wg0 in the tunnel network, CIDR, e.g. "10.99.0.2/24"
+	WireGuardListenPort  int             // UDP port, 0 = random (stratux connects to the peers)
+	WireGuardPeers       []WireGuardPeer
+
+	MQTTEnabled          bool           // telemetry publisher, see mqtt.go
+	MQTTBroker           string         // broker URL, e.g. "tcp://hangar.local:1883" or "ssl://broker:8883"
+	MQTTClientID         string         // empty = host name
+	MQTTUsername         string
+	MQTTTopicPrefix      string
+	MQTTQoS              int            // 0 or 1
+	MQTTTLSInsecure      bool           // don't verify the broker certificate
+	MQTTIntervals        map[string]int // topic class (situation, traffic, status) -> s, 0 = not published
+
+	GNSS_GPS             bool // u-blox constellation and rate configuration, pushed to the receiver on connect. See gnssconfig.go
+	GNSS_GLONASS         bool
+	GNSS_Galileo         bool
+	GNSS_BeiDou          bool
+	GNSS_SBAS            bool
+	GNSS_NavRate         int  // Hz, 1-10
+	GPSMovingBase        bool    // u-blox F9P moving base heading, see gnssheading.go
+	GPSMovingBaseHeadingOffset float32 // deg, direction of the aircraft nose relative to the base->rover baseline
+
+	AutopilotOutput      bool // EXPERIMENTAL attitude/track error output to /dev/serialout_ap*, see autopilot.go
+	AutopilotEnablePin   int  // BCM GPIO of the physical enable switch (to ground). 0 = none, output never enabled
+
+	AudioAlerts          bool   // spoken traffic alerts, see audio.go
+	AudioDevice          string // ALSA device, "" = default. "bluealsa:DEV=<MAC>,PROFILE=a2dp" for Bluetooth
+	AudioAlertLevel      int    // lowest TRAFFIC_ALERT_* level announced
+	AudioVerbosity       int    // AUDIO_VERBOSITY_*
+	AudioVolume          int    // percent
+	AudioChimes          bool   // chimes instead of speech
+	AudioMutePin         int    // BCM GPIO of a mute switch (to ground), 0 = none
+
+	AudioVario             bool    // vario tone of the blended climb rate, see vario.go
+	AudioVarioDeadBandLow  float64 // m/s, sink tone below
+	AudioVarioDeadBandHigh float64 // m/s, climb beeps above
+
+	CabinAltitudeAlerts  []int // cabin (baro sensor) altitude alert thresholds, ft. See cabinalt.go
+
+	GeoidSource             string  // "receiver" or "model", see geoid.go
+	GeoidModelFile          string  // GeographicLib .pgm geoid grid
+	GeoidFallbackSep        float32 // m, geoid separation used if neither the receiver nor the model provide one
+	GDL90MSLAlt_Enabled     bool    // send MSL instead of HAE (GDL90 spec) in the ownship geometric altitude report
+	GDL90PressureAltFromGPS bool    // use GPS MSL altitude as ownship pressure altitude if there is no baro source
+
+	UnitAltitude         string // "ft" or "m", see units.go
+	UnitSpeed            string // "kt", "km/h" or "mph"
+	UnitPressure         string // "hPa" or "inHg"
+	UnitTime             string // UNIT_TIME_UTC or UNIT_TIME_LOCAL
+	TimeZone             string // IANA time zone of the local time, "" = system time zone
+
+	AutoShutdownMinutes  int    // idle time (no motion, no clients) until the automatic shutdown, 0 = off. See powermanager.go
+	AutoShutdownAction   string // POWER_ACTION_SHUTDOWN or POWER_ACTION_SUSPEND (radios only)
+	AutoShutdownAt       string // "hh:mm" in the display time zone, daily shutdown if not moving. "" = off
+
+	FlightRecorder_Enabled bool // record the ownship track of every flight, see flightrecorder.go
+	FlightRecorderInterval int  // s between two recorded points
+
+	TransponderDevice   string // serial device of the transponder, "" = none. See transponder.go
+	TransponderBaud     int
+	TransponderProtocol string // TRANSPONDER_PROTOCOL_*
+
+	DebriefEncounterDistance float64 // NM, traffic closer than this (and DebriefEncounterAltitude) is a debrief encounter, see debrief.go
+	DebriefEncounterAltitude int     // ft
+
+	RFCaptureUAT         bool // capture the raw frames of the band, see rfcapture.go
+	RFCaptureES          bool
+	RFCaptureOGN         bool
+	RFCaptureMaxMB       int // total size of the capture files, the oldest are deleted. 0 = no limit
+	RFCaptureMaxAge      int // h, older capture files are deleted. 0 = no limit
 }
 
 type status struct {
@@ -1223,6 +1410,7 @@ type status struct {
 	HardwareBuild                              string
 	Devices                                    uint32
 	Connected_Users                            uint
+	ClientStateChanges                         []ClientStateChange // recent keep-alive state changes of the UDP clients, see keepalive.go
 	DiskBytesFree                              uint64
 	UAT_messages_last_minute                   uint
 	UAT_messages_max                           uint
@@ -1232,6 +1420,7 @@ type status struct {
 	OGN_messages_max                           uint
 	OGN_connected                              bool
 	APRS_connected                              bool
+	APRS_uploaded                               uint64 // aircraft beacons forwarded, see aprsupload.go
 	AIS_messages_last_minute                   uint
 	AIS_messages_max                           uint
 	AIS_connected                              bool
@@ -1247,6 +1436,21 @@ type status struct {
 	GPS_solution                               string
 	GPS_detected_type                          uint
 	GPS_NetworkRemoteIp                        string // for NMEA via TCP from OGN tracker: display remote IP to configure the OGN tracker
+	GPS_degraded                               bool   // position integrity is suspicious, see gpsintegrity.go
+	GPS_degraded_reason                        string
+	GPS_geoid_source                           string // where the geoid separation comes from: "receiver", "model" or "fixed"
+	GPS_config_status                          string // result of the GNSS configuration read-back: "verified", "unverified" or the mismatch. See gnssconfig.go
+	Autopilot_status                           string // experimental autopilot output: "" (off), "interlock open" or "active, ...". See autopilot.go
+	SystemTimeSource                           string // where the system time came from: "RTC", "NTP", "GPS" or "" if unknown
+	CabinAltitude                              int    // ft, pressure altitude of the onboard baro sensor. 0 if unavailable
+	CabinAltitudeAlert                         int    // highest exceeded cabin altitude alert threshold (ft), 0 = no alert
+	USBExportActive                            bool   // log files are exported as USB mass storage, see usbexport.go
+	PowerCountdown                             int    // s until the automatic shutdown, 0 = none pending. See powermanager.go
+	PowerDegraded                              bool   // undervoltage now or within the last minute. See undervoltage.go
+	RadiosSuspended                            bool   // the SDRs are closed by the power management
+	Transponder_connected                      bool   // status received from the transponder, see transponder.go
+	TransponderSquawk                          string // Mode 3/A code, "" if unknown
+	TransponderIdent                           bool
 	Uptime                                     int64
 	UptimeClock                                time.Time
 	CPUTemp                                    float32
@@ -1273,6 +1477,7 @@ type status struct {
 	OGN_gain_db                                float32
 	OGN_tx_enabled                             bool // If ogn-rx-eu uses a local tx module for transmission
 
+	OGNTracker_connected                       bool      // OGN tracker on globalSettings.OGNTrackerDevice, see ogntracker.go
 	OGNPrevRandomAddr                          string    // when OGN is in random stealth mode, it's ID changes randomly - keep the previous one so we can filter properly
 }
 
@@ -1297,10 +1502,12 @@ func defaultSettings() {
 	globalSettings.DEBUG = false
 	globalSettings.DisplayTrafficSource = false
 	globalSettings.ReplayLog = false //TODO: 'true' for debug builds.
+	globalSettings.ReplayLogWriteInterval = 10
 	globalSettings.AHRSLog = false
 	globalSettings.IMUMapping = [2]int{-1, 0}
 	globalSettings.OwnshipModeS = "F00000"
 	globalSettings.DeveloperMode = true
+	globalSettings.SetupCompleted = false
 	globalSettings.StaticIps = make([]string, 0)
 	globalSettings.NoSleep = false
 	globalSettings.EstimateBearinglessDist = false
@@ -1314,34 +1521,113 @@ func defaultSettings() {
 
 	globalSettings.RadarLimits = 2000
 	globalSettings.RadarRange = 10
+	globalSettings.TrafficCoastTime = 25
+	globalSettings.ES_TrafficTimeout = 6
+	globalSettings.UAT_TrafficTimeout = 6
+	globalSettings.OGN_TrafficTimeout = 6
+	globalSettings.TrafficPrioAltBand = 1000
+	globalSettings.TrafficPrioAltMax = 5000
+	globalSettings.TrafficPrioCPATime = 120
+	globalSettings.TrafficPrioCritical = 1.0
+	globalSettings.TrafficPrioCriticalDist = 2.0
+	globalSettings.OwnshipShadowFilter = true
+	globalSettings.OGNDDBAutoUpdate = true
+	globalSettings.OGNDDBShowCN = true
+	globalSettings.InternetWeatherRange = 100
+	globalSettings.AudioAlertLevel = TRAFFIC_ALERT_CAUTION
+	globalSettings.AudioVerbosity = AUDIO_VERBOSITY_FULL
+	globalSettings.AudioVolume = 80
+	globalSettings.AudioVarioDeadBandLow = -2.0
+	globalSettings.AudioVarioDeadBandHigh = 0.2
 	globalSettings.AltitudeOffset = 0
 
 	globalSettings.PWMDutyMin = 0
+	globalSettings.FanControlMode = FAN_MODE_PID
+	globalSettings.FanCurve = append([]FanCurvePoint(nil), defaultFanCurve...)
+	globalSettings.FanHysteresis = 3
+	globalSettings.FanSpinUpDuty = 100
+	globalSettings.FanTachPulses = 2
+
+	globalSettings.NMEAOutputSentences = make(map[string]string)
+	globalSettings.NMEACustomSentences = make([]string, 0)
+	globalSettings.TrafficOutputFilters = make(map[string]TrafficOutputFilter)
+	globalSettings.UplinkOutputFilters = make(map[string]string)
+	globalSettings.TrafficCategoryRules = make([]TrafficCategoryRule, 0)
+
+	globalSettings.GNSS_GPS = true
+	globalSettings.GNSS_GLONASS = true
+	globalSettings.GNSS_Galileo = true
+	globalSettings.GNSS_BeiDou = true
+	globalSettings.GNSS_SBAS = true
+	globalSettings.GNSS_NavRate = 10
+
+	globalSettings.CabinAltitudeAlerts = []int{10000, 12500}
+
+	globalSettings.GeoidSource = GEOID_SOURCE_RECEIVER
+	globalSettings.GeoidModelFile = GEOID_DEFAULT_MODEL_FILE
+	globalSettings.GDL90PressureAltFromGPS = true
+	globalSettings.UnitAltitude = "ft"
+	globalSettings.UnitSpeed = "kt"
+	globalSettings.UnitPressure = "hPa"
+	globalSettings.UnitTime = UNIT_TIME_UTC
+	globalSettings.AutoShutdownAction = POWER_ACTION_SHUTDOWN
+	globalSettings.FlightRecorder_Enabled = true
+	globalSettings.FlightRecorderInterval = 2
+	globalSettings.TransponderBaud = 9600
+	globalSettings.OGNTrackerBaud = 115200
+	globalSettings.TransponderProtocol = TRANSPONDER_PROTOCOL_UCP
+	globalSettings.DebriefEncounterDistance = 1.0
+	globalSettings.DebriefEncounterAltitude = 1000
+	globalSettings.RFCaptureMaxMB = 50
+	globalSettings.RFCaptureMaxAge = 72
+	globalSettings.ES_NetInputFormat = ES_INPUT_FORMAT_BEAST
+	globalSettings.BeastOutputPort = 30005
+	globalSettings.SBSOutputPort = 30003
+	globalSettings.FLARMNMEAPort = 2000
+	globalSettings.NMEASerialBaud = 38400
+	globalSettings.BluetoothName = "Stratux"
+	globalSettings.BluetoothBLEOutput = NETWORK_GDL90_STANDARD | NETWORK_AHRS_GDL90
+	globalSettings.BluetoothSPPOutput = NETWORK_FLARM_NMEA
+	globalSettings.MDNSEnabled = true
+	globalSettings.ForeFlightAnnounce = true
+	globalSettings.ForeFlightName = "Stratux"
+	globalSettings.APILegacyOpen = true
+	globalSettings.APITokens = make([]APIToken, 0)
+	globalSettings.LogLevel = "info"
+	globalSettings.LogLevels = make(map[string]string)
+	globalSettings.WireGuardAddress = "10.99.0.2/24"
+	globalSettings.WireGuardPeers = make([]WireGuardPeer, 0)
+	globalSettings.MQTTTopicPrefix = "stratux"
+	globalSettings.MQTTIntervals = map[string]int{"situation": 1, "traffic": 5, "status": 30}
 
 	globalSettings.OGNI2CTXEnabled = true
 }
 
 func readSettings() {
 	defaultSettings()
+	readSecrets()
 
 	fd, err := os.Open(configLocation)
 	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
+		logWarnf("settings", "can't read settings %s: %s", configLocation, err.Error())
 		return
 	}
 	defer fd.Close()
 	buf := make([]byte, 10000)
 	count, err := fd.Read(buf)
 	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
+		logWarnf("settings", "can't read settings %s: %s", configLocation, err.Error())
 		return
 	}
+	// Settings written before the setup wizard existed are from a device that has been set up
+	globalSettings.SetupCompleted = true
 	err = json.Unmarshal(buf[0:count], &globalSettings)
 	if err != nil {
-		log.Printf("can't read settings %s: %s\n", configLocation, err.Error())
+		logWarnf("settings", "can't read settings %s: %s", configLocation, err.Error())
 		return
 	}
-	log.Printf("read in settings.\n")
+	migrateSettingsSecrets(buf[0:count])
+	logInfof("settings", "read in settings.")
 }
 
 func addSystemError(err error) {
@@ -1363,6 +1649,7 @@ func removeSingleSystemError(ident string) {
 	}
 	delete(systemErrs, ident)
 	systemErrsMutex.Unlock()
+	clearAlert("error-" + ident)
 }
 
 func addSingleSystemErrorf(ident string, format string, a ...interface{}) {
@@ -1371,18 +1658,20 @@ func addSingleSystemErrorf(ident string, format string, a ...interface{}) {
 		// Error hasn't been thrown yet.
 		systemErrs[ident] = fmt.Sprintf(format, a...)
 		globalStatus.Errors = append(globalStatus.Errors, systemErrs[ident])
-		log.Printf("Added critical system error: %s\n", systemErrs[ident])
+		logErrorf("main", "Added critical system error: %s", systemErrs[ident])
 	}
 	// Do nothing on this call if the error has already been thrown.
+	msg := systemErrs[ident]
 	systemErrsMutex.Unlock()
+	raiseAlert("error-"+ident, ALERT_CRITICAL, "system", "%s", msg)
 }
 
 func overlayctl(cmd string) {
 	out, err := exec.Command("/bin/sh", "/sbin/overlayctl", cmd).Output()
 	if err != nil {
-		log.Printf("overlayctl error: %s\n%s", err.Error(), out)
+		logErrorf("overlayctl", "overlayctl error: %s\n%s", err.Error(), out)
 	} else {
-		log.Printf("overlayctl: %s\n", out)
+		logInfof("overlayctl", "%s", out)
 	}
 }
 
@@ -1396,14 +1685,14 @@ func saveSettings() {
 	jsonSettings, _ := json.Marshal(&globalSettings)
 	fd.Write(jsonSettings)
 	fd.Sync()
-	log.Printf("wrote settings.\n")
+	logInfof("settings", "wrote settings.")
 }
 
 func openReplay(fn string, compressed bool) (WriteCloser, error) {
 	fp, err := os.OpenFile(fn, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 
 	if err != nil {
-		log.Printf("Failed to open log file '%s': %s\n", fn, err.Error())
+		logErrorf("logging", "Failed to open log file '%s': %s", fn, err.Error())
 		return nil, err
 	}
 
@@ -1444,16 +1733,16 @@ func printStats() {
 		runtime.ReadMemStats(&memstats)
 		usage := du.NewDiskUsage("/")
 
-		log.Printf("stats [started: %s]\n", humanize.RelTime(time.Time{}, stratuxClock.Time, "ago", "from now"))
-		log.Printf(" - Disk bytes used = %s (%.1f %%), Disk bytes free = %s (%.1f %%)\n", humanize.Bytes(usage.Used()), 100*usage.Usage(), humanize.Bytes(usage.Free()), 100*(1-usage.Usage()))
-		log.Printf(" - CPUTemp=%.02f [%.02f - %.02f] deg C, MemStats.Alloc=%s, MemStats.Sys=%s, totalNetworkMessagesSent=%s\n", globalStatus.CPUTemp, globalStatus.CPUTempMin, globalStatus.CPUTempMax, humanize.Bytes(uint64(memstats.Alloc)), humanize.Bytes(uint64(memstats.Sys)), humanize.Comma(int64(totalNetworkMessagesSent)))
-		log.Printf(" - UAT/min %s/%s [maxSS=%.02f%%], ES/min %s/%s, Total traffic targets tracked=%s", humanize.Comma(int64(globalStatus.UAT_messages_last_minute)), humanize.Comma(int64(globalStatus.UAT_messages_max)), float64(maxSignalStrength)/10.0, humanize.Comma(int64(globalStatus.ES_messages_last_minute)), humanize.Comma(int64(globalStatus.ES_messages_max)), humanize.Comma(int64(len(seenTraffic))))
-		log.Printf(" - Network data messages sent: %d total.  Network data bytes sent: %d total.\n", globalStatus.NetworkDataMessagesSent, globalStatus.NetworkDataBytesSent)
+		logInfof("main", "stats [started: %s]", humanize.RelTime(time.Time{}, stratuxClock.Time, "ago", "from now"))
+		logInfof("main", " - Disk bytes used = %s (%.1f %%), Disk bytes free = %s (%.1f %%)", humanize.Bytes(usage.Used()), 100*usage.Usage(), humanize.Bytes(usage.Free()), 100*(1-usage.Usage()))
+		logInfof("main", " - CPUTemp=%.02f [%.02f - %.02f] deg C, MemStats.Alloc=%s, MemStats.Sys=%s, totalNetworkMessagesSent=%s", globalStatus.CPUTemp, globalStatus.CPUTempMin, globalStatus.CPUTempMax, humanize.Bytes(uint64(memstats.Alloc)), humanize.Bytes(uint64(memstats.Sys)), humanize.Comma(int64(totalNetworkMessagesSent)))
+		logInfof("main", " - UAT/min %s/%s [maxSS=%.02f%%], ES/min %s/%s, Total traffic targets tracked=%s", humanize.Comma(int64(globalStatus.UAT_messages_last_minute)), humanize.Comma(int64(globalStatus.UAT_messages_max)), float64(maxSignalStrength)/10.0, humanize.Comma(int64(globalStatus.ES_messages_last_minute)), humanize.Comma(int64(globalStatus.ES_messages_max)), humanize.Comma(int64(len(seenTraffic))))
+		logInfof("main", " - Network data messages sent: %d total.  Network data bytes sent: %d total.", globalStatus.NetworkDataMessagesSent, globalStatus.NetworkDataBytesSent)
 		if globalSettings.GPS_Enabled {
-			log.Printf(" - Last GPS fix: %s, GPS solution type: %d using %d satellites (%d/%d seen/tracked), NACp: %d, est accuracy %.02f m\n", stratuxClock.HumanizeTime(mySituation.GPSLastFixLocalTime), mySituation.GPSFixQuality, mySituation.GPSSatellites, mySituation.GPSSatellitesSeen, mySituation.GPSSatellitesTracked, mySituation.GPSNACp, mySituation.GPSHorizontalAccuracy)
-			log.Printf(" - GPS vertical velocity: %.02f ft/sec; GPS vertical accuracy: %v m\n", mySituation.GPSVerticalSpeed, mySituation.GPSVerticalAccuracy)
+			logInfof("main", " - Last GPS fix: %s, GPS solution type: %d using %d satellites (%d/%d seen/tracked), NACp: %d, est accuracy %.02f m", stratuxClock.HumanizeTime(mySituation.GPSLastFixLocalTime), mySituation.GPSFixQuality, mySituation.GPSSatellites, mySituation.GPSSatellitesSeen, mySituation.GPSSatellitesTracked, mySituation.GPSNACp, mySituation.GPSHorizontalAccuracy)
+			logInfof("main", " - GPS vertical velocity: %.02f ft/sec; GPS vertical accuracy: %v m", mySituation.GPSVerticalSpeed, mySituation.GPSVerticalAccuracy)
 		}
-		log.Printf(" - Mode-S Distance factors (<5000, <10000, >10000): %f, %f, %f", estimatedDistFactors[0], estimatedDistFactors[1], estimatedDistFactors[2])
+		logInfof("main", " - Mode-S Distance factors (<5000, <10000, >10000): %f, %f, %f", estimatedDistFactors[0], estimatedDistFactors[1], estimatedDistFactors[2])
 		sensorsOutput := make([]string, 0)
 		if globalSettings.IMU_Sensor_Enabled {
 			sensorsOutput = append(sensorsOutput, fmt.Sprintf("Last IMU read: %s", stratuxClock.HumanizeTime(mySituation.AHRSLastAttitudeTime)))
@@ -1462,7 +1751,7 @@ func printStats() {
 			sensorsOutput = append(sensorsOutput, fmt.Sprintf("Last BMP read: %s", stratuxClock.HumanizeTime(mySituation.BaroLastMeasurementTime)))
 		}
 		if len(sensorsOutput) > 0 {
-			log.Printf("- " + strings.Join(sensorsOutput, ", ") + "\n")
+			logInfof("main", "- %s", strings.Join(sensorsOutput, ", "))
 		}
 		// Check if we're using more than 95% of the free space. If so, throw a warning (only once).
 		if usage.Usage() > 0.95 {
@@ -1492,13 +1781,13 @@ func uatReplay(f ReadCloser, replaySpeed uint64) {
 		} else { // If it's not "START", then it's a tick count.
 			i, err := strconv.ParseInt(linesplit[0], 10, 64)
 			if err != nil {
-				log.Printf("invalid tick: '%s'\n", linesplit[0])
+				logWarnf("replay", "invalid tick: '%s'", linesplit[0])
 				continue
 			}
 			thisWait := (i - curTick) / int64(replaySpeed)
 
 			if thisWait >= 120000000000 { // More than 2 minutes wait, skip ahead.
-				log.Printf("UAT skipahead - %d seconds.\n", thisWait/1000000000)
+				logInfof("replay", "UAT skipahead - %d seconds.", thisWait/1000000000)
 			} else {
 				time.Sleep(time.Duration(thisWait) * time.Nanosecond) // Just in case the units change.
 			}
@@ -1518,7 +1807,7 @@ func uatReplay(f ReadCloser, replaySpeed uint64) {
 func openReplayFile(fn string) ReadCloser {
 	fp, err := os.Open(fn)
 	if err != nil {
-		log.Printf("error opening '%s': %s\n", fn, err.Error())
+		logErrorf("replay", "error opening '%s': %s", fn, err.Error())
 		os.Exit(1)
 		return nil
 	}
@@ -1527,7 +1816,7 @@ func openReplayFile(fn string) ReadCloser {
 	if strings.HasSuffix(fn, ".gz") { // Open as a compressed replay log, depending on the suffix.
 		ret, err = gzip.NewReader(fp)
 		if err != nil {
-			log.Printf("error opening compressed log '%s': %s\n", fn, err.Error())
+			logErrorf("replay", "error opening compressed log '%s': %s", fn, err.Error())
 			os.Exit(1)
 			return nil
 		}
@@ -1551,9 +1840,14 @@ func gracefulShutdown() {
 	if dataLogStarted {
 		closeDataLog()
 	}
+	closeFlightRecorder()
+	closeRFCapture()
 
 	pprof.StopCPUProfile()
 
+	// Keep the active alerts in the history.
+	saveAlertHistory()
+
 	//TODO: Any other graceful shutdown functions.
 
 	// Turn off green ACT LED on the Pi.
@@ -1562,17 +1856,10 @@ func gracefulShutdown() {
 
 // Close log file handle, open new one.
 func handleSIGHUP() {
-	logFileHandle.Close()
-	fp, err := os.OpenFile(debugLogf, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
+	if err := logger.open(debugLogf); err != nil {
 		addSingleSystemErrorf(debugLogf, "Failed to open '%s': %s", debugLogf, err.Error())
-	} else {
-		// Keep the logfile handle for later use
-		logFileHandle = fp
-		mfp := io.MultiWriter(fp, os.Stdout)
-		log.SetOutput(mfp)
 	}
-	log.Printf("signal caught: SIGHUP, handled.\n")
+	logInfof("main", "signal caught: SIGHUP, handled.")
 }
 
 func signalWatcher() {
@@ -1581,7 +1868,7 @@ func signalWatcher() {
 		if sig == syscall.SIGHUP {
 			handleSIGHUP()
 		} else {
-			log.Printf("signal caught: %s - shutting down.\n", sig.String())
+			logInfof("main", "signal caught: %s - shutting down.", sig.String())
 			gracefulShutdown()
 			os.Exit(1)
 		}
@@ -1589,20 +1876,11 @@ func signalWatcher() {
 }
 
 func clearDebugLogFile() {
-	if logFileHandle != nil {
-		_, err := logFileHandle.Seek(0, 0)
-		if err != nil {
-			log.Printf("Could not seek to the beginning of the logfile\n")
-			return
-		} else {
-			err2 := logFileHandle.Truncate(0)
-			if err2 != nil {
-				log.Printf("Could not truncate the logfile\n")
-				return
-			}
-			log.Printf("Logfile truncated\n")
-		}
+	if err := logger.truncate(); err != nil {
+		logWarnf("logging", "Could not truncate the logfile: %s", err.Error())
+		return
 	}
+	logInfof("logging", "Logfile truncated")
 }
 
 func isX86DebugMode() bool {
@@ -1644,12 +1922,17 @@ func main() {
 	}
 	debugLogf = filepath.Join(logDirf, debugLogFile)
 	dataLogFilef = filepath.Join(logDirf, dataLogFile)
+	flightRecorderFilef = filepath.Join(logDirf, flightRecorderFile)
+	flightReplayDBFilef = dataLogFilef
+	rfCaptureDirf = filepath.Join(logDirf, RF_CAPTURE_DIR)
 
 	//	replayESFilename := flag.String("eslog", "none", "ES Log filename")
 	replayUATFilename := flag.String("uatlog", "none", "UAT Log filename")
 	replayFlag := flag.Bool("replay", false, "Replay file flag")
 	replaySpeed := flag.Int("speed", 1, "Replay speed multiplier")
 	stdinFlag := flag.Bool("uatin", false, "Process UAT messages piped to stdin")
+	replayDBFilename := flag.String("replaydb", "", "Replay mode: run against this replay log (stratux.sqlite) instead of the hardware, see flightreplay.go")
+	replaySession := flag.Int64("session", 0, "Session (startup ID) to replay with -replaydb, 0 = the latest")
 	writeNetworkConfig := flag.Bool("write-network-config", false, "Only write network configuration files as configured in stratux.conf and exit")
 
 	cpuprofile := flag.String("cpuprofile", "", "write cpu profile to file")
@@ -1665,31 +1948,22 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Printf("Writing CPU profile to: %s\n", *cpuprofile)
+		logInfof("main", "Writing CPU profile to: %s", *cpuprofile)
 		pprof.StartCPUProfile(f)
 	}
 
-	// Duplicate log.* output to debugLog.
-	fp, err := os.OpenFile(debugLogf, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
+	// Leveled, size-rotated debugLog, log.* output goes there as well. Crash dumps too (stderr). See logging.go
+	if err := initLogging(debugLogf); err != nil {
 		addSingleSystemErrorf(debugLogf, "Failed to open '%s': %s", debugLogf, err.Error())
-	} else {
-		defer fp.Close()
-		// Keep the logfile handle for later use
-		logFileHandle = fp
-		mfp := io.MultiWriter(fp, os.Stdout)
-		log.SetOutput(mfp)
-
-		// Make sure crash dumps are written to the log as well
-		syscall.Dup3(int(fp.Fd()), 2, 0)
 	}
 
 	// Read settings.
 	readSettings()
+	applyLogLevels()
 
-	log.Printf("Stratux %s (%s) starting.\n", stratuxVersion, stratuxBuild)
+	logInfof("main", "Stratux %s (%s) starting.", stratuxVersion, stratuxBuild)
 	if *writeNetworkConfig {
-		log.Printf("Only writing network settings...")
+		logInfof("main", "Only writing network settings...")
 		applyNetworkSettings(true, true)
 		return
 	}
@@ -1703,31 +1977,69 @@ func main() {
 
 	crcInit() // Initialize CRC16 table.
 
-	sdrInit()
-	pingInit()
+	replayMode := len(*replayDBFilename) > 0
+	if replayMode {
+		flightReplayDBFilef = *replayDBFilename
+	} else {
+		sdrInit()
+		pingInit()
+	}
 	initTraffic()
 
 
 	// Disable replay logs when replaying - so that messages replay data isn't copied into the logs.
 	// Override after reading in the settings.
 	if *replayFlag == true {
-		log.Printf("Replay file %s\n", *replayUATFilename)
+		logInfof("replay", "Replay file %s", *replayUATFilename)
+		globalSettings.ReplayLog = false
+	}
+	if replayMode {
+		logInfof("replay", "Replay mode: %s", *replayDBFilename)
 		globalSettings.ReplayLog = false
 	}
 
 	if globalSettings.DeveloperMode == true {
-		log.Printf("Developer mode set\n")
+		logInfof("main", "Developer mode set")
 	}
 
 	//FIXME: Only do this if data logging is enabled.
 	initDataLog()
 
+	// Smooth logged flights after landing.
+	go flightSmootherWatcher()
+
+	// Persist per-target encounter statistics.
+	go trafficEncounterWatcher()
+	go trafficContactWatcher()
+
+	// Ownship track of every flight for GPX/KML/IGC export.
+	go flightRecorderWatcher()
+
+	// Raw frames of the selected bands for decoder bug reports.
+	go rfCaptureWriterLoop()
+
+	// Alert on high cabin altitude.
+	go cabinAltitudeWatcher()
+
 	// Start the AHRS sensor monitoring.
-	initI2CSensors()
+	if replayMode {
+		go updateAHRSStatus()
+	} else {
+		initI2CSensors()
+	}
 
-	// Start the GPS external sensor monitoring.
+	// Track the system time source. Also steps the clock from GPS if there is no NTP.
+	go systemTimeWatcher()
+
+	// Start the GPS external sensor monitoring. In replay mode the replayed GPS takes its place, see replayFlight().
 	initGPS()
 
+	// Squawk, ident and pressure altitude of the transponder, OGN tracker on its own serial port.
+	if !replayMode {
+		go transponderWatcher()
+		go ognTrackerWatcher()
+	}
+
 	// Start the heartbeat message loop in the background, once per second.
 	go heartBeatSender()
 
@@ -1737,11 +2049,70 @@ func main() {
 	// Start printing stats periodically to the logfiles.
 	go printStats()
 
+	// Record per band reception statistics for /getRadioStats.
+	go radioStatsCollector()
+
 	// Extrapolate traffic when no signal is received.
 	go trafficInfoExtrapolator()
 
 	// Guesses barometric altitude if we don't have our own baro source by using GnssBaroDiff from other traffic at similar altitude
 	go baroAltGuesser()
+	go qnhEstimator()
+
+	// Experimental autopilot output, only active with the physical enable switch closed.
+	go autopilotSender()
+
+	// Audio traffic alerts.
+	go audioAnnouncer()
+
+	// Blended vario, audio vario and thermal assistant.
+	go varioUpdater()
+	go audioVario()
+
+	// OGN DDB/FlarmNet device databases for FLARM/OGN registrations.
+	go ognDDBUpdater()
+
+	// METAR/TAF/NEXRAD from the internet when there is no FIS-B reception.
+	go internetWeatherUpdater()
+
+	// Wind/thermal forecast for glide computers, downloaded before the flight.
+	go windForecastUpdater()
+
+	// GDL90/FLARM NMEA output over Bluetooth LE and SPP.
+	go bluetoothManager()
+
+	// Zeroconf advertisement of the outputs, so apps don't have to assume 192.168.10.1.
+	go mdnsResponder()
+
+	// ForeFlight device announcement, so the apps label the device and show its capabilities.
+	go foreFlightAnnouncer()
+
+	// WiFi client mode: fall back to the access point if no client network is in range.
+	go wifiClientWatchdog()
+
+	// WireGuard tunnel for remote access to the web UI.
+	go wireguardManager()
+
+	// Telemetry for MQTT brokers (hangar dashboards, Home Assistant, fleet monitoring).
+	go mqttManager()
+
+	// Confirms a freshly installed update, or rolls it back if stratux isn't healthy. See updatemanager.go
+	go updateHealthMonitor()
+
+	// Hardware and subsystem health for /status/system.
+	go systemHealthMonitor()
+
+	// Undervoltage and brownout events, degraded power flag.
+	go undervoltageMonitor()
+
+	// System alerts (GPS lost, SDR disconnected, CPU temperature, ...) for the status bar of the web UI.
+	go alertMonitor()
+
+	// Automatic shutdown of units left running after a flight.
+	go powerManager()
+
+	// Export situation data to shared memory for co-resident applications.
+	go situationShmExporter()
 
 	// Monitor RPi CPU temp.
 	globalStatus.CPUTempMin = common.InvalidCpuTemp
@@ -1757,7 +2128,11 @@ func main() {
 	})
 
 	// Start reading from serial UAT radio.
-	initUATRadioSerial()
+	if replayMode {
+		startReplayMode(*replaySession, float64(*replaySpeed))
+	} else {
+		initUATRadioSerial()
+	}
 
 	reader := bufio.NewReader(os.Stdin)
 
@@ -1765,7 +2140,7 @@ func main() {
 		fp := openReplayFile(*replayUATFilename)
 
 		playSpeed := uint64(*replaySpeed)
-		log.Printf("Replay speed: %dx\n", playSpeed)
+		logInfof("replay", "Replay speed: %dx", playSpeed)
 		go uatReplay(fp, playSpeed)
 
 		for {
@@ -1780,7 +2155,7 @@ func main() {
 		for {
 			buf, err := reader.ReadString('\n')
 			if err != nil {
-				log.Printf("lost stdin.\n")
+				logWarnf("replay", "lost stdin.")
 				break
 			}
 			o, msgtype := parseInput(buf)
@@ -0,0 +1,186 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	geoid.go: Geoid separation (N = HAE - MSL) handling.
+
+		Most receivers report MSL altitude and the geoid separation in $GPGGA. Some don't have a geoid model
+		and report an empty or zero separation - in that case the altitude field is actually the height above
+		the WGS84 ellipsoid. If that happens (or if globalSettings.GeoidSource is "model"), the separation is taken
+		from a geoid model instead:
+		 - a GeographicLib geoid grid (e.g. egm96-5.pgm) at globalSettings.GeoidModelFile, if available
+		 - otherwise the fixed globalSettings.GeoidFallbackSep (m).
+		globalStatus.GPS_geoid_source shows where the separation currently comes from.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	GEOID_SOURCE_RECEIVER = "receiver" // use the receiver's separation, fall back to the model if it doesn't report one
+	GEOID_SOURCE_MODEL    = "model"    // always use the model, the altitude reported by the receiver is treated as HAE
+
+	GEOID_DEFAULT_MODEL_FILE = "/usr/share/GeographicLib/geoids/egm96-5.pgm"
+)
+
+// GeographicLib geoid grid, see https://geographiclib.sourceforge.io/html/geoid.html#geoidformat
+type geoidGrid struct {
+	file          *os.File
+	path          string
+	width, height int
+	offset, scale float64
+	dataStart     int64
+}
+
+var geoidModel *geoidGrid
+var geoidModelTried string // path we last tried to load, to avoid retrying on every GGA sentence
+
+func loadGeoidGrid(path string) (*geoidGrid, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &geoidGrid{file: f, path: path, scale: 1.0}
+	r := bufio.NewReader(f)
+	var pos int64
+	readLine := func() (string, error) {
+		line, err := r.ReadString('\n')
+		pos += int64(len(line))
+		return strings.TrimSpace(line), err
+	}
+
+	magic, err := readLine()
+	if err != nil || magic != "P5" {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a PGM geoid file", path)
+	}
+	// Comments with Offset/Scale, then "width height", then max value.
+	header := make([]string, 0)
+	for len(header) < 3 {
+		line, err := readLine()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: truncated header", path)
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line[1:])
+			if len(fields) == 2 && fields[0] == "Offset" {
+				g.offset, _ = strconv.ParseFloat(fields[1], 64)
+			} else if len(fields) == 2 && fields[0] == "Scale" {
+				g.scale, _ = strconv.ParseFloat(fields[1], 64)
+			}
+			continue
+		}
+		header = append(header, strings.Fields(line)...)
+	}
+	g.width, _ = strconv.Atoi(header[0])
+	g.height, _ = strconv.Atoi(header[1])
+	if g.width < 2 || g.height < 2 || header[2] != "65535" {
+		f.Close()
+		return nil, fmt.Errorf("%s: unsupported PGM format", path)
+	}
+	g.dataStart = pos
+	return g, nil
+}
+
+func (g *geoidGrid) value(x, y int) (float64, error) {
+	x = ((x % g.width) + g.width) % g.width
+	if y >= g.height {
+		y = g.height - 1
+	}
+	var buf [2]byte
+	if _, err := g.file.ReadAt(buf[:], g.dataStart+int64(2*(y*g.width+x))); err != nil {
+		return 0, err
+	}
+	return g.offset + g.scale*float64(binary.BigEndian.Uint16(buf[:])), nil
+}
+
+// Bilinear interpolation of the geoid height (m) at the given position. The grid starts at 90N, 0E.
+func (g *geoidGrid) separation(lat, lon float64) (float64, error) {
+	if lon < 0 {
+		lon += 360
+	}
+	fx := lon * float64(g.width) / 360.0
+	fy := (90 - lat) * float64(g.height-1) / 180.0
+	x, y := int(math.Floor(fx)), int(math.Floor(fy))
+	dx, dy := fx-float64(x), fy-float64(y)
+
+	var v [4]float64
+	for i, p := range [][2]int{{x, y}, {x + 1, y}, {x, y + 1}, {x + 1, y + 1}} {
+		val, err := g.value(p[0], p[1])
+		if err != nil {
+			return 0, err
+		}
+		v[i] = val
+	}
+	return (1-dy)*((1-dx)*v[0]+dx*v[1]) + dy*((1-dx)*v[2]+dx*v[3]), nil
+}
+
+// Returns the geoid separation from the model (m) and a short description of its source.
+func modelGeoidSeparation(lat, lon float64) (float64, string) {
+	path := globalSettings.GeoidModelFile
+	if geoidModel != nil && geoidModel.path != path {
+		geoidModel.file.Close()
+		geoidModel = nil
+	}
+	if geoidModel == nil && len(path) > 0 && geoidModelTried != path {
+		geoidModelTried = path
+		g, err := loadGeoidGrid(path)
+		if err != nil {
+			logErrorf("geoid", "can't load model: %s. Using fixed geoid separation of %.1fm", err.Error(), globalSettings.GeoidFallbackSep)
+		} else {
+			logInfof("geoid", "loaded %dx%d model from %s", g.width, g.height, path)
+			geoidModel = g
+		}
+	}
+	if geoidModel != nil {
+		if sep, err := geoidModel.separation(lat, lon); err == nil {
+			return sep, "model"
+		}
+	}
+	return float64(globalSettings.GeoidFallbackSep), "fixed"
+}
+
+/*
+	setGPSAltitudes().
+		Sets MSL altitude, HAE and geoid separation (all ft) of sit from the GGA altitude and separation fields (m).
+		An empty or zero separation means the receiver has no geoid model and reports HAE.
+*/
+func setGPSAltitudes(sit *SituationData, altField, sepField string) error {
+	alt, err := strconv.ParseFloat(altField, 32)
+	if err != nil {
+		return err
+	}
+	sep, err := strconv.ParseFloat(sepField, 32)
+	receiverSep := err == nil && sep != 0
+
+	var msl, hae float64
+	if receiverSep && globalSettings.GeoidSource != GEOID_SOURCE_MODEL {
+		msl = alt
+		hae = alt + sep
+		globalStatus.GPS_geoid_source = "receiver"
+	} else {
+		hae = alt
+		if receiverSep {
+			hae = alt + sep // the model overrides the receiver's separation, but its MSL altitude is still based on it
+		}
+		sep, globalStatus.GPS_geoid_source = modelGeoidSeparation(float64(sit.GPSLatitude), float64(sit.GPSLongitude))
+		msl = hae - sep
+	}
+
+	sit.GPSAltitudeMSL = float32(msl * 3.28084) // Convert to feet.
+	sit.GPSGeoidSep = float32(sep * 3.28084)
+	sit.GPSHeightAboveEllipsoid = float32(hae * 3.28084)
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gnssconfig.go: u-blox constellation (UBX-CFG-GNSS), SBAS and navigation rate configuration from
+		globalSettings.GNSS_*. The configuration is written by initGPSSerial() whenever the receiver is (re)connected,
+		and read back afterwards. The result of the read-back is shown in globalStatus.GPS_config_status.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+type ubloxGNSSBlock struct {
+	gnssId  byte
+	name    string
+	resTrk  byte // reserved (minimum) tracking channels
+	maxTrk  byte // maximum tracking channels
+	sigCfg  byte // signal configuration mask
+	enabled bool
+}
+
+func (b ubloxGNSSBlock) bytes() []byte {
+	flags := byte(0x00)
+	if b.enabled {
+		flags = 0x01
+	}
+	return []byte{b.gnssId, b.resTrk, b.maxTrk, 0x00, flags, 0x00, b.sigCfg, 0x01}
+}
+
+func isUbloxGPS() bool {
+	t := globalStatus.GPS_detected_type & 0x0f
+	return t == GPS_TYPE_UBX6 || t == GPS_TYPE_UBX7 || t == GPS_TYPE_UBX8 || t == GPS_TYPE_UBX9
+}
+
+// Configured navigation rate (Hz), limited to what the u-blox receivers support.
+func ubloxNavRate() uint16 {
+	rate := globalSettings.GNSS_NavRate
+	if rate < 1 || rate > 10 {
+		rate = 10
+	}
+	return uint16(rate)
+}
+
+/*
+	ubloxGNSSBlocks().
+		Returns the CFG-GNSS configuration blocks for the given receiver type from the settings. Channel numbers are
+		the u-blox defaults or slightly above. QZSS follows GPS, as it is only an augmentation of GPS.
+*/
+func ubloxGNSSBlocks(gpsType uint) []ubloxGNSSBlock {
+	gps, glonass, galileo, beidou := globalSettings.GNSS_GPS, globalSettings.GNSS_GLONASS, globalSettings.GNSS_Galileo, globalSettings.GNSS_BeiDou
+	if !gps && !glonass && !galileo && !beidou {
+		logInfof("gps", "GNSS config: no constellation enabled, using GPS")
+		gps = true
+	}
+	sbas := globalSettings.GNSS_SBAS
+
+	switch gpsType {
+	case GPS_TYPE_UBX9:
+		return []ubloxGNSSBlock{
+			{0x00, "GPS", 8, 16, 0x01, gps},
+			{0x01, "SBAS", 3, 3, 0x01, sbas},
+			{0x03, "BeiDou", 8, 16, 0x01, beidou},
+			{0x05, "QZSS", 3, 4, 0x05, gps}, // L1C/A & L1S
+			{0x06, "GLONASS", 8, 16, 0x01, glonass},
+			{0x02, "Galileo", 8, 16, 0x01, galileo},
+		}
+	case GPS_TYPE_UBX6, GPS_TYPE_UBX7:
+		// u-blox 7 can't track GPS and GLONASS at the same time, GPS wins.
+		if gps && glonass {
+			logWarnf("gps", "GNSS config: u-blox 6/7 can't use GPS and GLONASS concurrently, GLONASS disabled")
+		}
+		return []ubloxGNSSBlock{
+			{0x00, "GPS", 4, 255, 0x01, gps},
+			{0x01, "SBAS", 1, 3, 0x01, sbas},
+			{0x05, "QZSS", 0, 3, 0x01, gps},
+			{0x06, "GLONASS", 8, 255, 0x01, glonass && !gps},
+		}
+	default:
+		// u-blox 8 tracks at most 3 major constellations concurrently. Drop BeiDou first, then Galileo.
+		major := 0
+		for _, enabled := range []bool{gps, glonass, galileo, beidou} {
+			if enabled {
+				major++
+			}
+		}
+		if major > 3 && beidou {
+			logInfof("gps", "GNSS config: u-blox 8 supports at most 3 concurrent constellations, BeiDou disabled")
+			beidou = false
+		}
+		return []ubloxGNSSBlock{
+			{0x00, "GPS", 8, 16, 0x01, gps},
+			{0x01, "SBAS", 1, 3, 0x01, sbas},
+			{0x03, "BeiDou", 8, 16, 0x01, beidou},
+			{0x05, "QZSS", 1, 3, 0x01, gps}, // L1C/A
+			{0x06, "GLONASS", 8, 16, 0x01, glonass},
+			{0x02, "Galileo", 8, 8, 0x01, galileo}, // must be last, see writeUblox8ConfigCommands()
+		}
+	}
+}
+
+// UBX-CFG-GNSS message for the given blocks.
+func makeUbloxCfgGnss(blocks []ubloxGNSSBlock) []byte {
+	cfgGnss := []byte{0x00, 0x00, 0xFF, byte(len(blocks))} // numTrkChUse=0xFF: number of tracking channels to use will be set to number of tracking channels available in hardware
+	for _, b := range blocks {
+		cfgGnss = append(cfgGnss, b.bytes()...)
+	}
+	return makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss)
+}
+
+// Returns the payload of the first valid UBX message with the given class and id in buf.
+func findUBXMessage(buf []byte, class, id byte) ([]byte, bool) {
+	for i := bytes.Index(buf, []byte{0xB5, 0x62}); i >= 0 && i+8 <= len(buf); {
+		msglen := int(buf[i+4]) | int(buf[i+5])<<8
+		end := i + 6 + msglen + 2
+		if end <= len(buf) && buf[i+2] == class && buf[i+3] == id {
+			chk := chksumUBX(buf[i+2 : end-2])
+			if chk[0] == buf[end-2] && chk[1] == buf[end-1] {
+				return buf[i+6 : end-2], true
+			}
+		}
+		next := bytes.Index(buf[i+2:], []byte{0xB5, 0x62})
+		if next < 0 {
+			break
+		}
+		i += 2 + next
+	}
+	return nil, false
+}
+
+/*
+	verifyUbloxConfig().
+		Polls UBX-CFG-RATE and UBX-CFG-GNSS and compares them to what was written. Called from initGPSSerial() on the
+		configuration port, before UBX-CFG-PRT turns the UBX output off. NMEA data received in the meantime is dropped.
+*/
+func verifyUbloxConfig(p *serial.Port, gpsType uint) {
+	p.Write(makeUBXCFG(0x06, 0x08, 0, nil))
+	p.Write(makeUBXCFG(0x06, 0x3E, 0, nil))
+
+	var rate, gnss []byte
+	buf := make([]byte, 0, 16384)
+	readBuf := make([]byte, 1024)
+	deadline := time.Now().Add(3 * time.Second)
+	for (rate == nil || gnss == nil) && time.Now().Before(deadline) && len(buf) < cap(buf)-len(readBuf) {
+		n, err := p.Read(readBuf)
+		if err != nil {
+			break
+		}
+		buf = append(buf, readBuf[:n]...)
+		if rate == nil {
+			rate, _ = findUBXMessage(buf, 0x06, 0x08)
+		}
+		if gnss == nil {
+			gnss, _ = findUBXMessage(buf, 0x06, 0x3E)
+		}
+	}
+	if len(rate) < 2 || len(gnss) < 4 {
+		logInfof("gps", "GNSS config: no response from receiver, configuration not verified")
+		globalStatus.GPS_config_status = "unverified"
+		return
+	}
+
+	mismatches := make([]string, 0)
+	unsupported := make([]string, 0)
+	wantRate := ubloxNavRate()
+	if measRate := uint16(rate[0]) | uint16(rate[1])<<8; measRate != 1000/wantRate {
+		mismatches = append(mismatches, fmt.Sprintf("rate %dms (requested %dms)", measRate, 1000/wantRate))
+	}
+
+	enabled := make(map[byte]bool)
+	for i := 0; i < int(gnss[3]) && 4+8*i+8 <= len(gnss); i++ {
+		block := gnss[4+8*i:]
+		enabled[block[0]] = block[4]&0x01 != 0
+	}
+	for _, b := range ubloxGNSSBlocks(gpsType) {
+		if b.name == "QZSS" {
+			continue
+		}
+		if en, ok := enabled[b.gnssId]; !ok && b.enabled {
+			unsupported = append(unsupported, b.name) // e.g. u-blox 8 with firmware < 3.01 has no Galileo
+		} else if ok && en != b.enabled {
+			mismatches = append(mismatches, fmt.Sprintf("%s enabled=%t (requested %t)", b.name, en, b.enabled))
+		}
+	}
+
+	if len(mismatches) > 0 {
+		globalStatus.GPS_config_status = strings.Join(mismatches, ", ")
+		addSingleSystemErrorf("gnss-config", "GPS configuration not applied by the receiver: %s", globalStatus.GPS_config_status)
+	} else {
+		globalStatus.GPS_config_status = "verified"
+		if len(unsupported) > 0 {
+			globalStatus.GPS_config_status += " (not supported: " + strings.Join(unsupported, ", ") + ")"
+		}
+		removeSingleSystemError("gnss-config")
+	}
+	logInfof("gps", "GNSS config: %s", globalStatus.GPS_config_status)
+}
@@ -0,0 +1,151 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gnssheading.go: True heading and pitch from a dual-antenna GNSS setup. Immune to magnetic interference, and
+		available when stationary, unlike the ground track.
+
+		u-blox F9P moving base: two F9P receivers, the "moving base" sends RTCM corrections to the "rover" (UART2 to
+		UART2), the rover is connected to the Stratux. Both have to be configured for moving base operation with
+		u-center. With globalSettings.GPSMovingBase, we enable UBX-NAV-RELPOSNED output on the rover and derive
+		heading and pitch from the base->rover baseline.
+		Other dual-antenna receivers can provide the heading with $GNHDT/$GPHDT.
+
+		globalSettings.GPSMovingBaseHeadingOffset is the direction of the aircraft nose relative to the baseline
+		(0 = rover antenna ahead of the base antenna, 90 = rover on the left wing and base on the right wing).
+		Pitch can only be derived for baselines along the longitudinal axis (offset 0 or 180).
+
+		While the heading is valid, the AHRS uses it instead of the GPS track as its
+		reference. Below the AHRS minimum ground speed the AHRS runs in static mode without a heading reference, the
+		GNSS heading is then reported as the AHRS heading as is. $GNHDT/$GPHDT carry no accuracy, so they show up in
+		the situation but are not used by the AHRS.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/b3nn0/goflying/ahrs"
+)
+
+const (
+	GNSS_HEADING_MAX_AGE = 2 * time.Second
+	GNSS_HEADING_MAX_ACC = 5.0  // deg, less accurate headings (or unknown accuracy) are not used
+	UBX_MAX_PAYLOAD      = 1024 // larger lengths are treated as garbage
+)
+
+var ubxSync = []byte{0xB5, 0x62}
+
+/*
+	splitNMEAAndUBX().
+		bufio.SplitFunc for gpsSerialReader(). Returns NMEA lines like bufio.ScanLines, and complete UBX messages
+		(including sync chars and checksum) as separate tokens.
+*/
+func splitNMEAAndUBX(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	ubx := bytes.Index(data, ubxSync)
+	nl := bytes.IndexByte(data, '\n')
+	if ubx < 0 || (nl >= 0 && nl < ubx) {
+		return bufio.ScanLines(data, atEOF)
+	}
+	if ubx > 0 {
+		return ubx, data[:ubx], nil // text in front of the UBX message
+	}
+	if len(data) < 6 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	msglen := int(binary.LittleEndian.Uint16(data[4:6]))
+	if msglen > UBX_MAX_PAYLOAD {
+		return len(ubxSync), nil, nil // not a UBX message, skip the sync chars
+	}
+	if len(data) < 6+msglen+2 {
+		if atEOF {
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+	return 6 + msglen + 2, data[:6+msglen+2], nil
+}
+
+func isUBXMessage(msg []byte) bool {
+	return len(msg) >= 8 && bytes.HasPrefix(msg, ubxSync)
+}
+
+// Handles a UBX message received by gpsSerialReader(). Unknown messages (e.g. ACK-ACK) are ignored.
+func processUBXMessage(msg []byte) {
+	chk := chksumUBX(msg[2 : len(msg)-2])
+	if chk[0] != msg[len(msg)-2] || chk[1] != msg[len(msg)-1] {
+		if globalSettings.DEBUG {
+			logDebugf("gps", "UBX checksum error: % X", msg)
+		}
+		return
+	}
+	class, id, payload := msg[2], msg[3], msg[6:len(msg)-2]
+	if class == 0x01 && id == 0x3C {
+		processUBXRelPosNED(payload)
+	}
+}
+
+// UBX-NAV-RELPOSNED (version 1, F9P), see u-blox ZED-F9P Interface Description.
+func processUBXRelPosNED(payload []byte) {
+	if len(payload) < 64 || payload[0] != 0x01 {
+		return
+	}
+	flags := binary.LittleEndian.Uint32(payload[60:64])
+	gnssFixOK := flags&0x01 != 0
+	relPosValid := flags&0x04 != 0
+	carrSoln := (flags >> 3) & 0x03 // 0 = none, 1 = float, 2 = fixed
+	headingValid := flags&0x100 != 0
+	if !gnssFixOK || !relPosValid || !headingValid || carrSoln == 0 {
+		return
+	}
+
+	// cm + 0.1mm high precision part
+	relPos := func(i, hp int) float64 {
+		return float64(int32(binary.LittleEndian.Uint32(payload[i:i+4]))) + float64(int8(payload[hp]))/100
+	}
+	n, e, d := relPos(8, 32), relPos(12, 33), relPos(16, 34)
+	heading := float64(int32(binary.LittleEndian.Uint32(payload[24:28]))) * 1e-5
+	accHeading := float64(binary.LittleEndian.Uint32(payload[52:56])) * 1e-5
+	pitch := math.Atan2(-d, math.Hypot(n, e)) * 180 / math.Pi
+
+	mySituation.muGPS.Lock()
+	setGNSSHeading(heading, pitch, accHeading)
+	mySituation.muGPS.Unlock()
+}
+
+/*
+	setGNSSHeading().
+		Heading and pitch (deg, NaN if unknown) of the baseline and the heading accuracy (deg, ahrs.Invalid if
+		unknown). Applies globalSettings.GPSMovingBaseHeadingOffset. Must be called with mySituation.muGPS held.
+*/
+func setGNSSHeading(baselineHeading, baselinePitch, accuracy float64) {
+	offset := math.Mod(float64(globalSettings.GPSMovingBaseHeadingOffset)+360, 360)
+	heading := math.Mod(baselineHeading+offset+360, 360)
+	pitch := ahrs.Invalid
+	if !math.IsNaN(baselinePitch) {
+		if offset == 0 {
+			pitch = baselinePitch
+		} else if offset == 180 {
+			pitch = -baselinePitch
+		}
+	}
+	mySituation.GPSTrueHeading = float32(heading)
+	mySituation.GPSPitch = float32(pitch)
+	mySituation.GPSHeadingAccuracy = float32(accuracy)
+	mySituation.GPSLastHeadingTime = stratuxClock.Time
+}
+
+func isGNSSHeadingValid() bool {
+	return !mySituation.GPSLastHeadingTime.IsZero() && stratuxClock.Since(mySituation.GPSLastHeadingTime) < GNSS_HEADING_MAX_AGE &&
+		mySituation.GPSHeadingAccuracy < GNSS_HEADING_MAX_ACC
+}
@@ -0,0 +1,37 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpio.go: GPIO switch inputs (autopilot enable, audio mute) through /dev/gpiomem (go-rpio).
+		Build with -tags nohw to use the stub in gpio_nohw.go instead.
+*/
+
+package main
+
+import (
+	"github.com/stianeikeland/go-rpio/v4"
+)
+
+var gpioOpen bool
+
+// Reads a switch to ground on a BCM GPIO. Any problem reading it counts as open. Also used for the audio mute input.
+func gpioSwitchClosed(pin int) bool {
+	if pin <= 0 || pin > 27 {
+		return false
+	}
+	if !gpioOpen {
+		if err := rpio.Open(); err != nil {
+			return false
+		}
+		gpioOpen = true
+	}
+	p := rpio.Pin(pin)
+	p.Input()
+	p.PullUp()
+	return p.Read() == rpio.Low
+}
@@ -0,0 +1,18 @@
+//go:build nohw
+// +build nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpio_nohw.go: GPIO stub for builds without hardware support (-tags nohw).
+*/
+
+package main
+
+// Without GPIO access every switch reads open: the autopilot output stays disengaged and audio is never muted.
+func gpioSwitchClosed(pin int) bool {
+	return false
+}
@@ -12,7 +12,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math"
 	"strconv"
 	"strings"
@@ -24,8 +23,8 @@ import (
 	"github.com/tarm/serial"
 
 	"os"
-	"os/exec"
 
+	"github.com/b3nn0/goflying/ahrs"
 	"github.com/b3nn0/stratux/common"
 )
 
@@ -45,6 +44,7 @@ const (
 	BARO_TYPE_OGNTRACKER   = 2 // OGN Tracker with baro pressure
 	BARO_TYPE_NMEA         = 3 // Other NMEA provider that reports $PGRMZ (SoftRF)
 	BARO_TYPE_ADSBESTIMATE = 4 // If we have no baro, we will try to estimate baro pressure from ADS-B targets reporting GnssDiffFromBaroAlt (HAE<->Baro difference)
+	BARO_TYPE_TRANSPONDER  = 5 // Pressure altitude of the aircraft's transponder, see transponder.go
 )
 
 type SatelliteInfo struct {
@@ -54,6 +54,7 @@ type SatelliteInfo struct {
 	Azimuth          int16     // Bearing (degrees true), 0-359
 	Signal           int8      // Signal strength, 0 - 99; -99 indicates no reception
 	Type             uint8     // Type of satellite (GPS, GLONASS, Galileo, SBAS)
+	Constellation    string    // Human readable name of Type, e.g. "GPS" or "GLONASS"
 	TimeLastSolution time.Time // Time (system ticker) a solution was last calculated using this satellite
 	TimeLastSeen     time.Time // Time (system ticker) a signal was last received from this satellite
 	TimeLastTracked  time.Time // Time (system ticker) this satellite was tracked (almanac data)
@@ -70,7 +71,7 @@ type SituationData struct {
 	GPSLongitude                float32
 	GPSFixQuality               uint8
 	GPSHeightAboveEllipsoid     float32 // GPS height above WGS84 ellipsoid, ft. This is specified by the GDL90 protocol, but most EFBs use MSL altitude instead. HAE is about 70-100 ft below GPS MSL altitude over most of the US.
-	GPSGeoidSep                 float32 // geoid separation, ft, MSL minus HAE (used in altitude calculation)
+	GPSGeoidSep                 float32 // geoid separation, ft, HAE minus MSL (used in altitude calculation)
 	GPSSatellites               uint16  // satellites used in solution
 	GPSSatellitesTracked        uint16  // satellites tracked (almanac data received)
 	GPSSatellitesSeen           uint16  // satellites seen (signal received)
@@ -89,6 +90,10 @@ type SituationData struct {
 	GPSLastValidNMEAMessageTime time.Time // time valid NMEA message last seen
 	GPSLastValidNMEAMessage     string    // last NMEA message processed.
 	GPSPositionSampleRate       float64   // calculated sample rate of GPS positions
+	GPSTrueHeading              float32   // true heading from a dual-antenna setup, deg. See gnssheading.go
+	GPSPitch                    float32   // pitch from a dual-antenna setup, deg. ahrs.Invalid if unknown
+	GPSHeadingAccuracy          float32   // deg, ahrs.Invalid if unknown
+	GPSLastHeadingTime          time.Time // stratuxClock time of the last heading
 
 	// From pressure sensor.
 	muBaro                  *sync.Mutex
@@ -98,6 +103,17 @@ type SituationData struct {
 	BaroLastMeasurementTime time.Time
 	BaroSourceType          uint8
 
+	// Estimated from ADS-B traffic, see qnhestimate.go. Guarded by muBaro.
+	QNHEstimate             float32 // hPa, 0 if there is no estimate
+	QNHEstimateConfidence   float32 // 0-1
+	QNHEstimateSamples      uint16  // number of targets the estimate is based on
+
+	// Ownship vertical trend, see verticaltrend.go. Guarded by muBaro.
+	OwnshipVerticalSpeed    float32 // ft/min, from baro if available, GPS otherwise
+	PredictedAlt30s         float32 // ft, predicted altitude in 30 and 60 seconds
+	PredictedAlt60s         float32
+	PredictedAlt_valid      bool
+
 	// From AHRS source.
 	muAttitude           *sync.Mutex
 	AHRSPitch            float64
@@ -252,24 +268,24 @@ func initGPSSerial() bool {
 		globalStatus.GPS_detected_type = GPS_TYPE_UART
 	} else {
 		if globalSettings.DEBUG {
-			log.Printf("No GPS device found.\n")
+			logDebugf("gps", "No GPS device found.")
 		}
 		return false
 	}
 	if globalSettings.DEBUG {
-		log.Printf("Using %s for GPS\n", device)
+		logDebugf("gps", "Using %s for GPS", device)
 	}
 
 	// Open port at default baud for config.
-	serialConfig = &serial.Config{Name: device, Baud: baudrates[0]}
+	serialConfig = &serial.Config{Name: device, Baud: baudrates[0], ReadTimeout: time.Millisecond * 2500}
 	p, err := serial.OpenPort(serialConfig)
 	if err != nil {
-		log.Printf("serial port err: %s\n", err.Error())
+		logInfof("gps", "serial port err: %s", err.Error())
 		return false
 	}
 
 	if isSirfIV {
-		log.Printf("Using SiRFIV config.\n")
+		logInfof("gps", "Using SiRFIV config.")
 
 		// Enable 5Hz. (To switch back to 1Hz: $PSRF103,00,7,00,0*22)
 		p.Write(makeNMEACmd("PSRF103,00,6,00,0"))
@@ -287,7 +303,7 @@ func initGPSSerial() bool {
 		p.Write(makeNMEACmd("PSRF100,1,38400,8,1,0"))
 
 		if globalSettings.DEBUG {
-			log.Printf("Finished writing SiRF GPS config to %s. Opening port to test connection.\n", device)
+			logDebugf("gps", "Finished writing SiRF GPS config to %s. Opening port to test connection.", device)
 		}
 	} else if globalStatus.GPS_detected_type == GPS_TYPE_UBX6 || globalStatus.GPS_detected_type == GPS_TYPE_UBX7 ||
 	          globalStatus.GPS_detected_type == GPS_TYPE_UBX8 || globalStatus.GPS_detected_type == GPS_TYPE_UBX9 {
@@ -310,34 +326,26 @@ func initGPSSerial() bool {
 
 		if globalStatus.GPS_detected_type == GPS_TYPE_UBX9 {
 			if globalSettings.DEBUG {
-				log.Printf("ublox 9 detected\n")
+				logDebugf("gps", "ublox 9 detected")
 			}
 			// ublox 9
 			writeUblox9ConfigCommands(p)		
 		} else if (globalStatus.GPS_detected_type == GPS_TYPE_UBX8) || (globalStatus.GPS_detected_type == GPS_TYPE_UART) { // assume that any GPS connected to serial GPIO is ublox8 (RY835/6AI)
 			if globalSettings.DEBUG {
-				log.Printf("ublox 8 detected\n")
+				logDebugf("gps", "ublox 8 detected")
 			}
 			// ublox 8
 			writeUblox8ConfigCommands(p)
 		} else if (globalStatus.GPS_detected_type == GPS_TYPE_UBX7) || (globalStatus.GPS_detected_type == GPS_TYPE_UBX6) {
 			if globalSettings.DEBUG {
-				log.Printf("ublox 6 or 7 detected\n")
+				logDebugf("gps", "ublox 6 or 7 detected")
 			}
 			// ublox 6,7
-			cfgGnss := []byte{0x00, 0x00, 0xFF, 0x04} // numTrkChUse=0xFF: number of tracking channels to use will be set to number of tracking channels available in hardware
-			gps     := []byte{0x00, 0x04, 0xFF, 0x00, 0x01, 0x00, 0x01, 0x01} // enable GPS with 4-255 channels (ublox default)
-			sbas    := []byte{0x01, 0x01, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS with 1-3 channels (ublox default)
-			qzss    := []byte{0x05, 0x00, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable QZSS with 0-3 channel (ublox default)
-			glonass := []byte{0x06, 0x08, 0xFF, 0x00, 0x00, 0x00, 0x01, 0x01} // disable GLONASS (ublox default)
-			cfgGnss = append(cfgGnss, gps...)
-			cfgGnss = append(cfgGnss, sbas...)
-			cfgGnss = append(cfgGnss, qzss...)
-			cfgGnss = append(cfgGnss, glonass...)
-			p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss))
+			p.Write(makeUbloxCfgGnss(ubloxGNSSBlocks(globalStatus.GPS_detected_type)))
 		}
 
-		writeUbloxGenericCommands(10, p)
+		writeUbloxGenericCommands(ubloxNavRate(), p)
+		verifyUbloxConfig(p, globalStatus.GPS_detected_type)
 
 		// Reconfigure serial port.
 		cfg := make([]byte, 20)
@@ -384,7 +392,7 @@ func initGPSSerial() bool {
 		baudrates[0] = int(bdrt)
 
 		if globalSettings.DEBUG {
-			log.Printf("Finished writing u-blox GPS config to %s. Opening port to test connection.\n", device)
+			logDebugf("gps", "Finished writing u-blox GPS config to %s. Opening port to test connection.", device)
 		}
 	} else if globalStatus.GPS_detected_type == GPS_TYPE_SOFTRF_DONGLE {
 		p.Write([]byte("@GNS 0x7\r\n")) // enable SBAS
@@ -402,11 +410,12 @@ func initGPSSerial() bool {
 	// serial.OpenPort(serialConfig)
 	p, err = detectOpenSerialPort(device, baudrates)
 	if err != nil {
-		log.Printf("serial port err: %s\n", err.Error())
+		logInfof("gps", "serial port err: %s", err.Error())
 		return false
 	}
 
 	serialPort = p
+	setGPSDevice(device)
 	return true
 }
 
@@ -430,7 +439,7 @@ func detectOpenSerialPort(device string, baudrates []int) (*(serial.Port), error
 				_, validNMEAcs := validateNMEAChecksum(line)
 				if validNMEAcs {
 					// looks a lot like NMEA.. use it
-					log.Printf("Detected serial port %s with baud %d", device, baud)
+					logInfof("gps", "Detected serial port %s with baud %d", device, baud)
 					// Make sure the NMEA is immediately parsed once, so updateStatus() doesn't see the GPS as disconnected before
 					// first msg arrives
 					processNMEALine(line)
@@ -445,42 +454,20 @@ func detectOpenSerialPort(device string, baudrates []int) (*(serial.Port), error
 }
 
 func writeUblox8ConfigCommands(p *serial.Port) {
-	cfgGnss := []byte{0x00, 0x00, 0xFF, 0x05} // numTrkChUse=0xFF: number of tracking channels to use will be set to number of tracking channels available in hardware
-	gps     := []byte{0x00, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable GPS with 8-16 channels (ublox default)
-	sbas    := []byte{0x01, 0x01, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS with 1-3 channels (ublox default)
-	galileo := []byte{0x02, 0x08, 0x08, 0x00, 0x01, 0x00, 0x01, 0x01} // enable Galileo with 8-8 channels (ublox default: disabled and 4-8 channels)
-	beidou  := []byte{0x03, 0x08, 0x10, 0x00, 0x00, 0x00, 0x01, 0x01} // disable BEIDOU
-	qzss    := []byte{0x05, 0x01, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable QZSS 1-3 channels, L1C/A (ublox default: 0-3 channels)
-	glonass := []byte{0x06, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable GLONASS with 8-16 channels (ublox default: 8-14 channels)
-	
-	cfgGnss = append(cfgGnss, gps...)
-	cfgGnss = append(cfgGnss, sbas...)
-	cfgGnss = append(cfgGnss, beidou...)
-	cfgGnss = append(cfgGnss, qzss...)
-	cfgGnss = append(cfgGnss, glonass...)
-	p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss)) // Succeeds on all chips supporting GPS+GLO
-
-	cfgGnss[3] = 0x06
-	cfgGnss = append(cfgGnss, galileo...)
-	p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss)) // Succeeds only on chips that support GPS+GLO+GAL
+	blocks := ubloxGNSSBlocks(GPS_TYPE_UBX8)
+	p.Write(makeUbloxCfgGnss(blocks[:len(blocks)-1])) // Succeeds on all chips supporting GPS+GLO
+	p.Write(makeUbloxCfgGnss(blocks))                 // Succeeds only on chips that support GPS+GLO+GAL
 }
 
 func writeUblox9ConfigCommands(p *serial.Port) {
-	cfgGnss := []byte{0x00, 0x00, 0xFF, 0x06} // numTrkChUse=0xFF: number of tracking channels to use will be set to number of tracking channels available in hardware
-	gps     := []byte{0x00, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable GPS with 8-16 channels (ublox default)
-	sbas    := []byte{0x01, 0x03, 0x03, 0x00, 0x01, 0x00, 0x01, 0x01} // enable SBAS with 3-3 channels (ublox default)
-	galileo := []byte{0x02, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable Galileo with 8-16 channels (ublox default: 8-12 channels)
-	beidou  := []byte{0x03, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable BEIDOU with 8-16 channels (ublox default: 2-5 channels)
-	qzss    := []byte{0x05, 0x03, 0x04, 0x00, 0x01, 0x00, 0x05, 0x01} // enable QZSS 3-4 channels, L1C/A & L1S (ublox default)
-	glonass := []byte{0x06, 0x08, 0x10, 0x00, 0x01, 0x00, 0x01, 0x01} // enable GLONASS with 8-16 tracking channels (ublox default: 8-12 channels)
-	
-	cfgGnss = append(cfgGnss, gps...)
-	cfgGnss = append(cfgGnss, sbas...)
-	cfgGnss = append(cfgGnss, beidou...)
-	cfgGnss = append(cfgGnss, qzss...)
-	cfgGnss = append(cfgGnss, glonass...)
-	cfgGnss = append(cfgGnss, galileo...)
-	p.Write(makeUBXCFG(0x06, 0x3E, uint16(len(cfgGnss)), cfgGnss))
+	p.Write(makeUbloxCfgGnss(ubloxGNSSBlocks(GPS_TYPE_UBX9)))
+
+	// UBX-CFG-MSG (UBX-NAV-RELPOSNED on UART1 and USB for moving base heading, see gnssheading.go)
+	relPosRate := byte(0x00)
+	if globalSettings.GPSMovingBase {
+		relPosRate = 0x01
+	}
+	p.Write(makeUBXCFG(0x06, 0x01, 8, []byte{0x01, 0x3C, 0x00, relPosRate, 0x00, relPosRate, 0x00, 0x00}))
 }
 
 func writeUbloxGenericCommands(navrate uint16, p *serial.Port) {
@@ -506,8 +493,12 @@ func writeUbloxGenericCommands(navrate uint16, p *serial.Port) {
 	// UBX-CFG-NAV5                           |mask1...|  dyn
 	p.Write(makeUBXCFG(0x06, 0x24, 36, []byte{0x01, 0x00, 0x07, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})) // Dynamic platform model: airborne with <2g acceleration
 
-	// UBX-CFG-SBAS (disable integrity, enable auto-scan)
-	p.Write(makeUBXCFG(0x06, 0x16, 8, []byte{0x01, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}))
+	// UBX-CFG-SBAS (enable/disable SBAS, disable integrity, enable auto-scan)
+	sbasMode := byte(0x00)
+	if globalSettings.GNSS_SBAS {
+		sbasMode = 0x01
+	}
+	p.Write(makeUBXCFG(0x06, 0x16, 8, []byte{sbasMode, 0x03, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00}))
 
 	// UBX-CFG-MSG (NMEA Standard Messages)  msg   msg   Ports 1-6 (every 10th message over UART1, every message over USB)
 	//                                       Class ID    I2C   UART1 UART2 USB   SPI   Res
@@ -534,17 +525,10 @@ func writeUbloxGenericCommands(navrate uint16, p *serial.Port) {
 
 
 
-	if navrate == 10 {
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0x64, 0x00, 0x01, 0x00, 0x01, 0x00})) // 100ms & 1 cycle -> 10Hz (UBX-CFG-RATE payload bytes: little endian!)
-	} else if navrate == 5 {
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xC8, 0x00, 0x01, 0x00, 0x01, 0x00})) // 200ms & 1 cycle -> 5Hz (UBX-CFG-RATE payload bytes: little endian!)
-	} else if navrate == 2 {
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xF4, 0x01, 0x01, 0x00, 0x01, 0x00})) // 500ms & 1 cycle -> 2Hz (UBX-CFG-RATE payload bytes: little endian!)
-	} else if navrate == 1 {
-		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{0xE8, 0x03, 0x01, 0x00, 0x01, 0x00})) // 1000ms & 1 cycle -> 1Hz (UBX-CFG-RATE payload bytes: little endian!)
+	if navrate >= 1 && navrate <= 10 {
+		measRate := 1000 / navrate
+		p.Write(makeUBXCFG(0x06, 0x08, 6, []byte{byte(measRate & 0xFF), byte(measRate >> 8), 0x01, 0x00, 0x01, 0x00})) // measRate ms & 1 cycle (UBX-CFG-RATE payload bytes: little endian!)
 	}
-
-
 }
 
 
@@ -640,7 +624,7 @@ func calcGPSAttitude() bool {
 	index := length - 1
 
 	if length == 0 {
-		log.Printf("GPS attitude: No data received yet. Not calculating attitude.\n")
+		logInfof("gps", "GPS attitude: No data received yet. Not calculating attitude.")
 		return false
 	} else if length == 1 {
 		//log.Printf("myGPSPerfStats has one data point. Setting statistics to zero.\n")
@@ -655,7 +639,7 @@ func calcGPSAttitude() bool {
 		myGPSPerfStats[index].gpsTurnRate = 0
 		myGPSPerfStats[index].gpsPitch = 0
 		myGPSPerfStats[index].gpsRoll = 0
-		log.Printf("GPS attitude: GPS data is more than three seconds old. Setting attitude to zero.\n")
+		logInfof("gps", "GPS attitude: GPS data is more than three seconds old. Setting attitude to zero.")
 		return false
 	}
 
@@ -666,7 +650,7 @@ func calcGPSAttitude() bool {
 
 	// first time error case: index is more than three seconds ahead of index-1
 	if dt > 3 {
-		log.Printf("GPS attitude: Can't calculate GPS attitude. Reference data is old. dt = %v\n", dt)
+		logWarnf("gps", "GPS attitude: Can't calculate GPS attitude. Reference data is old. dt = %v", dt)
 		return false
 	}
 
@@ -674,12 +658,12 @@ func calcGPSAttitude() bool {
 	// we rebase to the previous day, and will re-rebase the entire slice forward to the current day once all values roll over.
 	//TODO: Validate by testing at 0000Z
 	if dt < 0 {
-		log.Printf("GPS attitude: Current GPS time (%.2f) is older than last GPS time (%.2f). Checking for 0000Z rollover.\n", t1, t0)
+		logInfof("gps", "GPS attitude: Current GPS time (%.2f) is older than last GPS time (%.2f). Checking for 0000Z rollover.", t1, t0)
 		if myGPSPerfStats[index-1].nmeaTime > 86300 && myGPSPerfStats[index].nmeaTime < 100 { // be generous with the time window at rollover
 			myGPSPerfStats[index].nmeaTime += 86400
 		} else {
 			// time decreased, but not due to a recent rollover. Something odd is going on.
-			log.Printf("GPS attitude: Time isn't near 0000Z. Unknown reason for offset. Can't calculate GPS attitude.\n")
+			logWarnf("gps", "GPS attitude: Time isn't near 0000Z. Unknown reason for offset. Can't calculate GPS attitude.")
 			return false
 		}
 
@@ -691,7 +675,7 @@ func calcGPSAttitude() bool {
 		}
 		minTime, _ := common.ArrayMin(tempTime)
 		if minTime > 86401.0 {
-			log.Printf("GPS attitude: Rebasing GPS time since midnight to current day.\n")
+			logInfof("gps", "GPS attitude: Rebasing GPS time since midnight to current day.")
 			for i := 0; i < length; i++ {
 				myGPSPerfStats[i].nmeaTime -= 86400
 			}
@@ -699,12 +683,12 @@ func calcGPSAttitude() bool {
 
 		// Verify adjustment
 		dt = myGPSPerfStats[index].nmeaTime - myGPSPerfStats[index-1].nmeaTime
-		log.Printf("GPS attitude: New dt = %f\n", dt)
+		logInfof("gps", "GPS attitude: New dt = %f", dt)
 		if dt > 3 {
-			log.Printf("GPS attitude: Can't calculate GPS attitude. Reference data is old. dt = %v\n", dt)
+			logWarnf("gps", "GPS attitude: Can't calculate GPS attitude. Reference data is old. dt = %v", dt)
 			return false
 		} else if dt < 0 {
-			log.Printf("GPS attitude: Something went wrong rebasing the time.\n")
+			logWarnf("gps", "GPS attitude: Something went wrong rebasing the time.")
 			return false
 		}
 
@@ -733,13 +717,13 @@ func calcGPSAttitude() bool {
 	dt_avg, valid = mean(tempSpeedTime)
 	if valid && dt_avg > 0 {
 		if globalSettings.DEBUG {
-			log.Printf("GPS attitude: Average delta time is %.2f s (%.1f Hz)\n", dt_avg, 1/dt_avg)
+			logDebugf("gps", "GPS attitude: Average delta time is %.2f s (%.1f Hz)", dt_avg, 1/dt_avg)
 		}
 		halfwidth = 9 * dt_avg
 		mySituation.GPSPositionSampleRate = 1 / dt_avg
 	} else {
 		if globalSettings.DEBUG {
-			log.Printf("GPS attitude: Couldn't determine sample rate\n")
+			logDebugf("gps", "GPS attitude: Couldn't determine sample rate")
 		}
 		halfwidth = 3.5
 		mySituation.GPSPositionSampleRate = 0
@@ -770,14 +754,14 @@ func calcGPSAttitude() bool {
 	}
 	lengthSpeed = len(tempSpeed)
 	if lengthSpeed == 0 {
-		log.Printf("GPS Attitude: No groundspeed data could be parsed from NMEA RMC messages\n")
+		logInfof("gps", "GPS Attitude: No groundspeed data could be parsed from NMEA RMC messages")
 		return false
 	} else if lengthSpeed == 1 {
 		v_x = tempSpeed[0] * 1.687810
 	} else {
 		slope, intercept, valid = common.LinRegWeighted(tempSpeedTime, tempSpeed, tempRegWeights)
 		if !valid {
-			log.Printf("GPS attitude: Error calculating speed regression from NMEA RMC position messages")
+			logErrorf("gps", "GPS attitude: Error calculating speed regression from NMEA RMC position messages")
 			return false
 		} else {
 			v_x = (slope*float64(myGPSPerfStats[index].nmeaTime) + intercept) * 1.687810 // units are knots, converted to feet/sec
@@ -799,12 +783,12 @@ func calcGPSAttitude() bool {
 	}
 	lengthSpeed = len(tempVV)
 	if lengthSpeed < 2 {
-		log.Printf("GPS Attitude: Not enough points to calculate vertical speed from NMEA GGA messages\n")
+		logInfof("gps", "GPS Attitude: Not enough points to calculate vertical speed from NMEA GGA messages")
 		return false
 	} else {
 		slope, _, valid = common.LinRegWeighted(tempSpeedTime, tempVV, tempRegWeights)
 		if !valid {
-			log.Printf("GPS attitude: Error calculating vertical speed regression from NMEA GGA messages")
+			logErrorf("gps", "GPS attitude: Error calculating vertical speed regression from NMEA GGA messages")
 			return false
 		} else {
 			v_z = slope // units are feet/sec
@@ -826,7 +810,7 @@ func calcGPSAttitude() bool {
 		// Output format:GPSAtttiude,seconds,nmeaTime,msg_type,GS,Course,Alt,VV,filtered_GS,filtered_course,turn rate,filtered_vv,pitch, roll,load_factor
 		buf := fmt.Sprintf("GPSAttitude,%.1f,%.2f,%s,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f\n", float64(stratuxClock.Milliseconds)/1000, myGPSPerfStats[index].nmeaTime, myGPSPerfStats[index].msgType, myGPSPerfStats[index].gsf, myGPSPerfStats[index].coursef, myGPSPerfStats[index].alt, myGPSPerfStats[index].vv, v_x/1.687810, headingAvg, myGPSPerfStats[index].gpsTurnRate, v_z, myGPSPerfStats[index].gpsPitch, myGPSPerfStats[index].gpsRoll, myGPSPerfStats[index].gpsLoadFactor)
 		if globalSettings.DEBUG {
-			log.Printf("%s", buf) // FIXME. Send to sqlite log or other file?
+			logDebugf("gps", "%s", buf) // FIXME. Send to sqlite log or other file?
 		}
 		logGPSAttitude(myGPSPerfStats[index])
 		//replayLog(buf, MSGCLASS_AHRS)
@@ -867,7 +851,7 @@ func calcGPSAttitude() bool {
 		}
 	} else { //
 		if globalSettings.DEBUG {
-			log.Printf("GPS attitude: Can't calculate turn rate with less than two points.\n")
+			logDebugf("gps", "GPS attitude: Can't calculate turn rate with less than two points.")
 		}
 		return false
 	}
@@ -876,7 +860,7 @@ func calcGPSAttitude() bool {
 	slope, intercept, valid = common.LinRegWeighted(tempHdgTime, tempHdgUnwrapped, tempRegWeights)
 
 	if !valid {
-		log.Printf("GPS attitude: Regression error calculating turn rate")
+		logErrorf("gps", "GPS attitude: Regression error calculating turn rate")
 		return false
 	} else {
 		headingAvg = slope*float64(myGPSPerfStats[index].nmeaTime) + intercept
@@ -939,7 +923,7 @@ func calcGPSAttitude() bool {
 	if globalSettings.DEBUG {
 		// Output format:GPSAtttiude,seconds,nmeaTime,msg_type,GS,Course,Alt,VV,filtered_GS,filtered_course,turn rate,filtered_vv,pitch, roll,load_factor
 		buf := fmt.Sprintf("GPSAttitude,%.1f,%.2f,%s,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f,%0.3f\n", float64(stratuxClock.Milliseconds)/1000, myGPSPerfStats[index].nmeaTime, myGPSPerfStats[index].msgType, myGPSPerfStats[index].gsf, myGPSPerfStats[index].coursef, myGPSPerfStats[index].alt, myGPSPerfStats[index].vv, v_x/1.687810, headingAvg, myGPSPerfStats[index].gpsTurnRate, v_z, myGPSPerfStats[index].gpsPitch, myGPSPerfStats[index].gpsRoll, myGPSPerfStats[index].gpsLoadFactor)
-		log.Printf("%s", buf) // FIXME. Send to sqlite log or other file?
+		logDebugf("gps", "%s", buf) // FIXME. Send to sqlite log or other file?
 	}
 
 	logGPSAttitude(myGPSPerfStats[index])
@@ -991,13 +975,13 @@ func calculateNavRate() float64 {
  	dt_avg, valid := common.Mean(tempSpeedTime)
  	if valid && dt_avg > 0 {
  		if globalSettings.DEBUG {
- 			log.Printf("GPS attitude: Average delta time is %.2f s (%.1f Hz)\n", dt_avg, 1/dt_avg)
+ 			logDebugf("gps", "GPS attitude: Average delta time is %.2f s (%.1f Hz)", dt_avg, 1/dt_avg)
  		}
  		halfwidth = 9 * dt_avg
  		mySituation.GPSPositionSampleRate = 1 / dt_avg
  	} else {
  		if globalSettings.DEBUG {
- 			log.Printf("GPS attitude: Couldn't determine sample rate\n")
+ 			logDebugf("gps", "GPS attitude: Couldn't determine sample rate")
  		}
  		halfwidth = 3.5
  		mySituation.GPSPositionSampleRate = 0
@@ -1055,13 +1039,18 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	l_valid, validNMEAcs := validateNMEAChecksum(l)
 	if !validNMEAcs {
 		if len(l_valid) > 0 {
-			log.Printf("GPS error. Invalid NMEA string: %s\n", l_valid) // remove log message once validation complete
+			logWarnf("gps", "GPS error. Invalid NMEA string: %s", l_valid) // remove log message once validation complete
 		}
 		return false
 	}
 	ognPublishNmea(l)
 	x := strings.Split(l_valid, ",")
 
+	// Pass standard (non-proprietary) sentences through unmodified to the GPS passthrough outputs
+	if len(x[0]) > 0 && x[0][0] != 'P' {
+		sendMsg([]byte(strings.TrimSpace(l)+"\r\n"), NETWORK_GPS_NMEA_RAW, time.Second, MSGPRIO_FEED)
+	}
+
 	mySituation.GPSLastValidNMEAMessageTime = stratuxClock.Time
 	mySituation.GPSLastValidNMEAMessage = l
 
@@ -1160,22 +1149,20 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			tmpSituation.GPSLongitude = -tmpSituation.GPSLongitude
 		}
 
-		// Altitude.
-		alt, err1 := strconv.ParseFloat(x[9], 32)
-		if err1 != nil {
+		// Altitude and geoid separation (Sep = HAE - MSL). See geoid.go.
+		if err1 := setGPSAltitudes(&tmpSituation, x[9], x[11]); err1 != nil {
 			return false
 		}
-		tmpSituation.GPSAltitudeMSL = float32(alt * 3.28084) // Convert to feet.
 		thisGpsPerf.alt = float32(tmpSituation.GPSAltitudeMSL)
 
-		// Geoid separation (Sep = HAE - MSL)
-
-		geoidSep, err1 := strconv.ParseFloat(x[11], 32)
-		if err1 != nil {
-			return false
+		// Vertical velocity from consecutive fixes, lightly filtered. NMEA has no vertical velocity sentence.
+		dt := tmpSituation.GPSLastFixSinceMidnightUTC - mySituation.GPSLastFixSinceMidnightUTC
+		if mySituation.GPSFixQuality > 0 && dt > 0 && dt <= 2 && stratuxClock.Since(mySituation.GPSLastFixLocalTime) < 3*time.Second {
+			vv := (tmpSituation.GPSAltitudeMSL - mySituation.GPSAltitudeMSL) / dt
+			tmpSituation.GPSVerticalSpeed = 0.7*mySituation.GPSVerticalSpeed + 0.3*vv
+		} else {
+			tmpSituation.GPSVerticalSpeed = 0
 		}
-		tmpSituation.GPSGeoidSep = float32(geoidSep * 3.28084) // Convert to feet.
-		tmpSituation.GPSHeightAboveEllipsoid = tmpSituation.GPSGeoidSep + tmpSituation.GPSAltitudeMSL
 
 		// Timestamp.
 		tmpSituation.GPSLastFixLocalTime = stratuxClock.Time
@@ -1183,6 +1170,8 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		updateGPSPerf = true
 		thisGpsPerf.msgType = x[0]
 
+		checkGPSIntegrity(&tmpSituation)
+
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
 		mySituation = tmpSituation
 
@@ -1253,15 +1242,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				tmpSituation.GPSLastGPSTimeStratuxTime = stratuxClock.Time
 				tmpSituation.GPSTime = gpsTime
 				stratuxClock.SetRealTimeReference(gpsTime)
-				if time.Since(gpsTime) > 300*time.Millisecond || time.Since(gpsTime) < -300*time.Millisecond {
-					setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
-					log.Printf("setting system time from %s to: '%s'\n", time.Now().Format("20060102 15:04:05.000"), setStr)
-					if err := exec.Command("date", "-s", setStr).Run(); err != nil {
-						log.Printf("Set Date failure: %s error\n", err)
-					} else {
-						log.Printf("Time set from GPS. Current time is %v\n", time.Now())
-					}
-				}
+				setSystemTimeFromGPS(gpsTime)
 			}
 		}
 
@@ -1322,6 +1303,8 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		thisGpsPerf.msgType = x[0]
 		tmpSituation.GPSLastGroundTrackTime = stratuxClock.Time
 
+		checkGPSIntegrity(&tmpSituation)
+
 		// We've made it this far, so that means we've processed "everything" and can now make the change to mySituation.
 		mySituation = tmpSituation
 
@@ -1410,6 +1393,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 					thisSatellite.SatelliteID = svStr
 					thisSatellite.SatelliteNMEA = uint8(sv)
 					thisSatellite.Type = uint8(svType)
+					thisSatellite.Constellation = satelliteConstellationName(uint8(svType))
 					//log.Printf("Creating new satellite %s from GSA message\n", svStr) // DEBUG
 				}
 				thisSatellite.InSolution = true
@@ -1464,6 +1448,18 @@ func processNMEALine(l string) (sentenceUsed bool) {
 
 	}
 
+	if (x[0] == "GNHDT") || (x[0] == "GPHDT") { // True heading from dual-antenna receivers, see gnssheading.go
+		if len(x) < 3 || x[2] != "T" {
+			return false
+		}
+		hdg, err := strconv.ParseFloat(x[1], 64)
+		if err != nil {
+			return false
+		}
+		setGNSSHeading(hdg, math.NaN(), ahrs.Invalid)
+		return true
+	}
+
 	if (x[0] == "GPGSV") || (x[0] == "GLGSV") || (x[0] == "GAGSV") || (x[0] == "GBGSV") { // GPS + SBAS or GLONASS or Galileo or Beidou satellites in view message.
 		if len(x) < 4 {
 			return false
@@ -1498,7 +1494,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		satsThisMsg := (lenGSV - 4) / 4
 
 		if globalSettings.DEBUG {
-			log.Printf("%s message [%d of %d] is %v fields long and describes %v satellites\n", x[0], msgIndex, msgNum, lenGSV, satsThisMsg)
+			logDebugf("gps", "%s message [%d of %d] is %v fields long and describes %v satellites", x[0], msgIndex, msgNum, lenGSV, satsThisMsg)
 		}
 
 		var sv, elev, az, cno int
@@ -1551,6 +1547,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				thisSatellite.SatelliteID = svStr
 				thisSatellite.SatelliteNMEA = uint8(sv)
 				thisSatellite.Type = uint8(svType)
+				thisSatellite.Constellation = satelliteConstellationName(uint8(svType))
 				//log.Printf("Creating new satellite %s\n", svStr) // DEBUG
 			}
 			thisSatellite.TimeLastTracked = stratuxClock.Time
@@ -1599,7 +1596,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 				if thisSatellite.InSolution {
 					inSolnStr = "+"
 				}
-				log.Printf("GSV: Satellite %s%s at index %d. Type = %d, NMEA-ID = %d, Elev = %d, Azimuth = %d, Cno = %d\n", inSolnStr, svStr, i, svType, sv, elev, az, cno) // remove later?
+				logDebugf("gps", "GSV: Satellite %s%s at index %d. Type = %d, NMEA-ID = %d, Elev = %d, Azimuth = %d, Cno = %d", inSolnStr, svStr, i, svType, sv, elev, az, cno) // remove later?
 			}
 
 			Satellites[thisSatellite.SatelliteID] = thisSatellite // Update constellation with this satellite
@@ -1614,30 +1611,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	// OGN Tracker pressure data:
 	// $POGNB,22.0,+29.1,100972.3,3.8,+29.4,+87.2,-0.04,+32.6,*6B
 	if x[0] == "POGNB" {
-		if len(x) < 5 {
-			return false
-		}
-		var vspeed float64
-
-		pressureAlt, err := strconv.ParseFloat(x[5], 32)
-		if err != nil {
-			return false
-		}
-		
-		vspeed, err = strconv.ParseFloat(x[7], 32)
-		if err != nil {
-			return false
-		}
-
-		if !isTempPressValid() || mySituation.BaroSourceType != BARO_TYPE_BMP280 {
-			mySituation.muBaro.Lock()
-			mySituation.BaroPressureAltitude = float32(pressureAlt * 3.28084) // meters to feet
-			mySituation.BaroVerticalSpeed = float32(vspeed * 196.85) // m/s in ft/min
-			mySituation.BaroLastMeasurementTime = stratuxClock.Time
-			mySituation.BaroSourceType = BARO_TYPE_OGNTRACKER
-			mySituation.muBaro.Unlock()
-		}
-		return true
+		return parseOgnTrackerPOGNB(x)
 	}
 
 	// Only sent by OGN tracker. We use this to detect that OGN tracker is connected and configure it as needed
@@ -1659,42 +1633,7 @@ func processNMEALine(l string) (sentenceUsed bool) {
 			ognTrackerConfigured = false
 			return true
 		}
-		// OGN tracker sent us its configuration
-		log.Printf("Received OGN Tracker configuration: " + strings.Join(x, ","))
-		oldAddr := globalSettings.OGNAddr
-		for i := 1; i < len(x); i++ {
-			kv := strings.SplitN(x[i], "=", 2);
-			if len(kv) < 2 {
-				continue
-			}
-
-			if kv[0] == "Address" {
-				addr, _ :=  strconv.ParseUint(kv[1], 0, 32)
-				globalSettings.OGNAddr = strings.ToUpper(fmt.Sprintf("%x", addr))
-			} else if kv[0] == "AddrType" {
-				addrtype, _ :=  strconv.ParseInt(kv[1], 0, 8)
-				globalSettings.OGNAddrType = int(addrtype)
-			} else if kv[0] == "AcftType" {
-				acfttype, _ :=  strconv.ParseInt(kv[1], 0, 8)
-				globalSettings.OGNAcftType = int(acfttype)
-			} else if kv[0] == "Pilot" {
-				globalSettings.OGNPilot = kv[1]
-			} else if kv[0] == "Reg" {
-				globalSettings.OGNReg = kv[1]
-			} else if kv[0] == "TxPower" {
-				pwr, _ := strconv.ParseInt(kv[1], 10, 16)
-				globalSettings.OGNTxPower = int(pwr)
-			}
-		}
-		// OGN Tracker can change its address arbitrarily. However, if it does,
-		// ownship detection would fail for the old target. Therefore we remove the old one from the traffic list
-		if oldAddr != globalSettings.OGNAddr && globalSettings.OGNAddrType == 0 {
-			globalStatus.OGNPrevRandomAddr = oldAddr
-			oldAddrInt, _ := strconv.ParseUint(oldAddr, 16, 32)
-			removeTarget(uint32(oldAddrInt))
-			// potentially other address type before
-			removeTarget(uint32((1 << 24) | oldAddrInt))
-		}
+		parseOgnTrackerPOGNS(x)
 	}
 
 	// Only evaluate PGRMZ for SoftRF/Flarm, where we know that it is standard barometric pressure.
@@ -1713,8 +1652,9 @@ func processNMEALine(l string) (sentenceUsed bool) {
 		if unit == "m" {
 			pressureAlt *= 3.28084
 		}
-		// Prefer internal sensor and OGN tracker over this...
-		if !isTempPressValid() || (mySituation.BaroSourceType != BARO_TYPE_BMP280 && mySituation.BaroSourceType != BARO_TYPE_OGNTRACKER) {
+		// Prefer internal sensor, transponder and OGN tracker over this...
+		if !isTempPressValid() || (mySituation.BaroSourceType != BARO_TYPE_BMP280 && mySituation.BaroSourceType != BARO_TYPE_OGNTRACKER &&
+			mySituation.BaroSourceType != BARO_TYPE_TRANSPONDER) {
 			mySituation.muBaro.Lock()
 			mySituation.BaroPressureAltitude = float32(pressureAlt) // meters to feet
 			mySituation.BaroLastMeasurementTime = stratuxClock.Time
@@ -1734,9 +1674,88 @@ func processNMEALine(l string) (sentenceUsed bool) {
 	return false
 }
 
+// OGN tracker pressure data: $POGNB,22.0,+29.1,100972.3,3.8,+29.4,+87.2,-0.04,+32.6,*6B
+func parseOgnTrackerPOGNB(x []string) bool {
+	if len(x) < 8 {
+		return false
+	}
+	var vspeed float64
+
+	pressureAlt, err := strconv.ParseFloat(x[5], 32)
+	if err != nil {
+		return false
+	}
+
+	vspeed, err = strconv.ParseFloat(x[7], 32)
+	if err != nil {
+		return false
+	}
+
+	if !isTempPressValid() || (mySituation.BaroSourceType != BARO_TYPE_BMP280 && mySituation.BaroSourceType != BARO_TYPE_TRANSPONDER) {
+		mySituation.muBaro.Lock()
+		mySituation.BaroPressureAltitude = float32(pressureAlt * 3.28084) // meters to feet
+		mySituation.BaroVerticalSpeed = float32(vspeed * 196.85) // m/s in ft/min
+		mySituation.BaroLastMeasurementTime = stratuxClock.Time
+		mySituation.BaroSourceType = BARO_TYPE_OGNTRACKER
+		mySituation.muBaro.Unlock()
+	}
+	return true
+}
+
+// OGN tracker sent us its configuration: $POGNS,Address=0x...,AddrType=...
+func parseOgnTrackerPOGNS(x []string) {
+	logInfof("gps", "Received OGN Tracker configuration: %s", strings.Join(x, ","))
+	oldAddr := globalSettings.OGNAddr
+	for i := 1; i < len(x); i++ {
+		kv := strings.SplitN(x[i], "=", 2);
+		if len(kv) < 2 {
+			continue
+		}
+
+		if kv[0] == "Address" {
+			addr, _ :=  strconv.ParseUint(kv[1], 0, 32)
+			globalSettings.OGNAddr = strings.ToUpper(fmt.Sprintf("%x", addr))
+		} else if kv[0] == "AddrType" {
+			addrtype, _ :=  strconv.ParseInt(kv[1], 0, 8)
+			globalSettings.OGNAddrType = int(addrtype)
+		} else if kv[0] == "AcftType" {
+			acfttype, _ :=  strconv.ParseInt(kv[1], 0, 8)
+			globalSettings.OGNAcftType = int(acfttype)
+		} else if kv[0] == "Pilot" {
+			globalSettings.OGNPilot = kv[1]
+		} else if kv[0] == "Reg" {
+			globalSettings.OGNReg = kv[1]
+		} else if kv[0] == "TxPower" {
+			pwr, _ := strconv.ParseInt(kv[1], 10, 16)
+			globalSettings.OGNTxPower = int(pwr)
+		} else if kv[0] == "Stealth" {
+			globalSettings.OGNStealth = kv[1] == "1"
+		} else if kv[0] == "NoTrack" {
+			globalSettings.OGNNoTrack = kv[1] == "1"
+		}
+	}
+	// OGN Tracker can change its address arbitrarily. However, if it does,
+	// ownship detection would fail for the old target. Therefore we remove the old one from the traffic list
+	if oldAddr != globalSettings.OGNAddr && globalSettings.OGNAddrType == 0 {
+		globalStatus.OGNPrevRandomAddr = oldAddr
+		oldAddrInt, _ := strconv.ParseUint(oldAddr, 16, 32)
+		removeTarget(uint32(oldAddrInt))
+		// potentially other address type before
+		removeTarget(uint32((1 << 24) | oldAddrInt))
+	}
+}
+
+func boolToOgnFlag(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 func getOgnTrackerConfigString() string {
-	msg := fmt.Sprintf("$POGNS,Address=0x%s,AddrType=%d,AcftType=%d,Pilot=%s,Reg=%s,TxPower=%d,Hard=STX,Soft=%s",
-		globalSettings.OGNAddr, globalSettings.OGNAddrType, globalSettings.OGNAcftType, globalSettings.OGNPilot, globalSettings.OGNReg, globalSettings.OGNTxPower, stratuxVersion[1:])
+	msg := fmt.Sprintf("$POGNS,Address=0x%s,AddrType=%d,AcftType=%d,Pilot=%s,Reg=%s,TxPower=%d,Stealth=%d,NoTrack=%d,Hard=STX,Soft=%s",
+		globalSettings.OGNAddr, globalSettings.OGNAddrType, globalSettings.OGNAcftType, globalSettings.OGNPilot, globalSettings.OGNReg, globalSettings.OGNTxPower,
+		boolToOgnFlag(globalSettings.OGNStealth), boolToOgnFlag(globalSettings.OGNNoTrack), stratuxVersion[1:])
 	msg = appendNmeaChecksum(msg)
 	return msg + "\r\n"
 }
@@ -1746,12 +1765,13 @@ func getOgnTrackerConfigQueryString() string {
 }
 
 func configureOgnTrackerFromSettings() {
+	writeOgnTrackerDevice(getOgnTrackerConfigString() + getOgnTrackerConfigQueryString()) // tracker on its own port, see ogntracker.go
 	if serialPort == nil {
 		return
 	}
 
 	cfg := getOgnTrackerConfigString()
-	log.Printf("Configuring OGN Tracker: " + cfg)
+	logInfof("gps", "Configuring OGN Tracker: %s", cfg)
 
 	serialPort.Write([]byte(getOgnTrackerConfigString()))
 	serialPort.Write([]byte(getOgnTrackerConfigQueryString())) // re-read settings from tracker
@@ -1875,10 +1895,16 @@ func gpsSerialReader() {
 
 	i := 0 //debug monitor
 	scanner := bufio.NewScanner(serialPort)
+	scanner.Split(splitNMEAAndUBX)
 	for scanner.Scan() && globalStatus.GPS_connected && globalSettings.GPS_Enabled {
 		i++
 		if globalSettings.DEBUG && i%100 == 0 {
-			log.Printf("gpsSerialReader() scanner loop iteration i=%d\n", i) // debug monitor
+			logDebugf("gps", "gpsSerialReader() scanner loop iteration i=%d", i) // debug monitor
+		}
+
+		if isUBXMessage(scanner.Bytes()) {
+			processUBXMessage(scanner.Bytes())
+			continue
 		}
 
 		s := scanner.Text()
@@ -1895,11 +1921,11 @@ func gpsSerialReader() {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		log.Printf("reading standard input: %s\n", err.Error())
+		logInfof("gps", "reading standard input: %s", err.Error())
 	}
 
 	if globalSettings.DEBUG {
-		log.Printf("Exiting gpsSerialReader() after i=%d loops\n", i) // debug monitor
+		logDebugf("gps", "Exiting gpsSerialReader() after i=%d loops", i) // debug monitor
 	}
 	globalStatus.GPS_connected = false
 	readyToInitGPS = true //TODO: replace with channel control to terminate goroutine when complete
@@ -1908,7 +1934,7 @@ func gpsSerialReader() {
 
 func makeAHRSSimReport() {
 	msg := createXPlaneAttitudeMsg(float32(mySituation.AHRSGyroHeading), float32(mySituation.AHRSPitch), float32(mySituation.AHRSRoll))
-	sendXPlane(msg, 100 * time.Millisecond, 1)
+	sendXPlane(msg, 100 * time.Millisecond, MSGPRIO_AUX)
 }
 
 /*
@@ -1920,6 +1946,11 @@ func makeAHRSSimReport() {
 */
 
 func makeFFAHRSMessage() {
+	sendMsg(prepareMessage(makeFFAHRSMsg(false)), NETWORK_AHRS_GDL90, 200 * time.Millisecond, MSGPRIO_AUX)
+}
+
+// ForeFlight AHRS message, unframed. The heading (true) only if withHeading, ForeFlight shows it as is.
+func makeFFAHRSMsg(withHeading bool) []byte {
 	msg := make([]byte, 12)
 	msg[0] = 0x65 // Message type "ForeFlight".
 	msg[1] = 0x01 // AHRS message identifier.
@@ -1938,6 +1969,9 @@ func makeFFAHRSMessage() {
 		if !isAHRSInvalidValue(mySituation.AHRSRoll) {
 			roll = common.RoundToInt16(mySituation.AHRSRoll * 10)
 		}
+		if withHeading && !isAHRSInvalidValue(mySituation.AHRSGyroHeading) {
+			hdg = uint16(common.RoundToInt16(mySituation.AHRSGyroHeading*10)) & 0x7FFF // MSB 0 = true heading
+		}
 	}
 
 	// Roll.
@@ -1960,7 +1994,7 @@ func makeFFAHRSMessage() {
 	msg[10] = byte((tas >> 8) & 0xFF)
 	msg[11] = byte(tas & 0xFF)
 
-	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, 200 * time.Millisecond, 3)
+	return msg
 }
 
 /*
@@ -1977,6 +2011,11 @@ func ffAttitudeSender() {
 }
 
 func makeAHRSGDL90Report() {
+	sendMsg(prepareMessage(makeAHRSGDL90Msg(true)), NETWORK_AHRS_GDL90, 100 * time.Millisecond, MSGPRIO_AUX)
+}
+
+// Levil/Stratux AHRS message (0x4C), unframed. Heading invalid unless withHeading.
+func makeAHRSGDL90Msg(withHeading bool) []byte {
 	msg := make([]byte, 24)
 	msg[0] = 0x4c
 	msg[1] = 0x45
@@ -2000,7 +2039,7 @@ func makeAHRSGDL90Report() {
 		if !isAHRSInvalidValue(mySituation.AHRSRoll) {
 			roll = common.RoundToInt16(mySituation.AHRSRoll * 10)
 		}
-		if !isAHRSInvalidValue(mySituation.AHRSGyroHeading) {
+		if withHeading && !isAHRSInvalidValue(mySituation.AHRSGyroHeading) {
 			hdg = common.RoundToInt16(mySituation.AHRSGyroHeading * 10)
 		}
 		if !isAHRSInvalidValue(mySituation.AHRSSlipSkid) {
@@ -2058,7 +2097,7 @@ func makeAHRSGDL90Report() {
 	msg[22] = 0x7F
 	msg[23] = 0xFF
 
-	sendMsg(prepareMessage(msg), NETWORK_AHRS_GDL90, 100 * time.Millisecond, 3)
+	return msg
 }
 
 func gpsAttitudeSender() {
@@ -2078,7 +2117,7 @@ func gpsAttitudeSender() {
 
 			if !isGPSValid() || !calcGPSAttitude() {
 				if globalSettings.DEBUG {
-					log.Printf("Couldn't calculate GPS-based attitude statistics\n")
+					logDebugf("gps", "Couldn't calculate GPS-based attitude statistics")
 				}
 			} else {
 				mySituation.muGPSPerformance.Lock()
@@ -2099,6 +2138,24 @@ func gpsAttitudeSender() {
 	}
 }
 
+func satelliteConstellationName(svType uint8) string {
+	switch svType {
+	case SAT_TYPE_GPS:
+		return "GPS"
+	case SAT_TYPE_GLONASS:
+		return "GLONASS"
+	case SAT_TYPE_GALILEO:
+		return "Galileo"
+	case SAT_TYPE_BEIDOU:
+		return "BeiDou"
+	case SAT_TYPE_QZSS:
+		return "QZSS"
+	case SAT_TYPE_SBAS:
+		return "SBAS"
+	}
+	return "Unknown"
+}
+
 /*
 	updateConstellation(): Periodic cleanup and statistics calculation for 'Satellites'
 		data structure. Calling functions must protect this in a mySituation.muSatellite.
@@ -2131,6 +2188,18 @@ func updateConstellation() {
 	mySituation.GPSSatellitesSeen = uint16(seen)
 }
 
+// Copy of mySituation taken under the GPS, baro and attitude locks, for readers that need a consistent set of values.
+func getSituationSnapshot() SituationData {
+	mySituation.muGPS.Lock()
+	mySituation.muBaro.Lock()
+	mySituation.muAttitude.Lock()
+	situation := mySituation
+	mySituation.muAttitude.Unlock()
+	mySituation.muBaro.Unlock()
+	mySituation.muGPS.Unlock()
+	return situation
+}
+
 func isGPSConnected() bool {
 	return stratuxClock.Since(mySituation.GPSLastValidNMEAMessageTime) < 5*time.Second
 }
@@ -2185,6 +2254,8 @@ func pollGPS() {
 	timer := time.NewTicker(4 * time.Second)
 	go gpsAttitudeSender()
 	go ffAttitudeSender()
+	go ahrsOutputSender()
+	go gpsHotplugWatcher()
 	for {
 		<-timer.C
 		// GPS enabled, was not connected previously?
@@ -0,0 +1,101 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpshotplug.go: Watches the GPS device nodes (udev symlinks, see image/10-stratux.rules) so that unplugging,
+		re-plugging or re-enumeration of a USB GPS (e.g. after a brownout) is noticed even if the serial read
+		doesn't fail, and the GPS is re-detected by pollGPS(). A newly plugged GPS that is preferred over the one
+		in use (e.g. a USB receiver while using the UART) also triggers a re-detection.
+*/
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// GPS device nodes in the order initGPSSerial() prefers them.
+var gpsDevices = []string{"/dev/ublox9", "/dev/ublox8", "/dev/ublox7", "/dev/ublox6", "/dev/prolific0", "/dev/serialin", "/dev/softrf_dongle", "/dev/ttyAMA0"}
+
+var gpsDevice string          // device node currently used for the GPS
+var gpsDeviceInfo os.FileInfo // identifies the underlying tty, to detect re-enumeration
+
+// Called by initGPSSerial() once the port is open.
+func setGPSDevice(device string) {
+	gpsDevice = device
+	gpsDeviceInfo, _ = os.Stat(device)
+	logInfof("gps", "GPS connected on %s", device)
+}
+
+func gpsDevicePriority(device string) int {
+	for i, d := range gpsDevices {
+		if d == device {
+			return i
+		}
+	}
+	return len(gpsDevices)
+}
+
+// Makes gpsSerialReader() exit, so pollGPS() re-runs the detection.
+func resetGPSConnection() {
+	globalStatus.GPS_connected = false
+	if serialPort != nil {
+		serialPort.Close() // unblocks the reader
+	}
+}
+
+func gpsHotplugWatcher() {
+	present := make(map[string]os.FileInfo)
+	for _, dev := range gpsDevices {
+		if fi, err := os.Stat(dev); err == nil {
+			present[dev] = fi
+		}
+	}
+
+	ticker := time.NewTicker(2 * time.Second)
+	for {
+		<-ticker.C
+		plugged := make([]string, 0)
+		for _, dev := range gpsDevices {
+			fi, err := os.Stat(dev)
+			prev, wasPresent := present[dev]
+			if err != nil {
+				if wasPresent {
+					logInfof("gps", "GPS device %s unplugged", dev)
+					delete(present, dev)
+				}
+				continue
+			}
+			if !wasPresent {
+				logInfof("gps", "GPS device %s plugged in", dev)
+				plugged = append(plugged, dev)
+			} else if !os.SameFile(prev, fi) {
+				logInfof("gps", "GPS device %s re-enumerated", dev)
+				plugged = append(plugged, dev)
+			}
+			present[dev] = fi
+		}
+
+		if !globalStatus.GPS_connected || len(gpsDevice) == 0 || (globalStatus.GPS_detected_type&0x0f) == GPS_TYPE_NETWORK {
+			continue
+		}
+		if fi, ok := present[gpsDevice]; !ok {
+			logInfof("gps", "GPS device %s in use was removed, waiting for a GPS to reappear", gpsDevice)
+			resetGPSConnection()
+		} else if gpsDeviceInfo != nil && !os.SameFile(fi, gpsDeviceInfo) {
+			logInfof("gps", "GPS device %s in use was re-enumerated, re-initializing", gpsDevice)
+			resetGPSConnection()
+		} else {
+			for _, dev := range plugged {
+				if gpsDevicePriority(dev) < gpsDevicePriority(gpsDevice) {
+					logInfof("gps", "Preferred GPS device %s plugged in, switching from %s", dev, gpsDevice)
+					resetGPSConnection()
+					break
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	gpsintegrity.go: Simple RAIM-style plausibility checks on GPS fixes. We don't have pseudorange residuals
+		from NMEA, so a fix is considered suspicious if it jumps further than the aircraft could have moved,
+		or if too few satellites are used for the receiver to detect a faulty one. While suspicious, the NIC/NACp
+		advertised in the GDL90 ownship report is downgraded and the status shows the GPS as degraded.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	GPS_INTEGRITY_MIN_SATS    = 5                // RAIM fault detection needs at least 5 satellites
+	GPS_INTEGRITY_HOLD_TIME   = 10 * time.Second // how long a detected problem keeps the GPS degraded
+	GPS_INTEGRITY_SPEED_SLACK = 100.0            // kts, allowed on top of the reported ground speed for position jumps
+)
+
+var gpsIntegrityLastLat, gpsIntegrityLastLng float64
+var gpsIntegrityLastTime time.Time
+var gpsIntegrityLastGroundSpeed float64
+var gpsIntegrityDegradedTime time.Time
+var gpsIntegrityJumpDistance float64 // meters, size of the last implausible position jump
+
+/*
+	checkGPSIntegrity().
+		Called with every new position fix before it is committed to mySituation.
+*/
+func checkGPSIntegrity(sit *SituationData) {
+	lat, lng := float64(sit.GPSLatitude), float64(sit.GPSLongitude)
+	reason := ""
+
+	if !gpsIntegrityLastTime.IsZero() {
+		dt := stratuxClock.Since(gpsIntegrityLastTime).Seconds()
+		if dt > 0 && dt < 5 {
+			dist, _ := common.Distance(gpsIntegrityLastLat, gpsIntegrityLastLng, lat, lng)
+			speed := gpsIntegrityLastGroundSpeed
+			if sit.GPSGroundSpeed > speed {
+				speed = sit.GPSGroundSpeed
+			}
+			maxDist := (speed+GPS_INTEGRITY_SPEED_SLACK)*0.514444*dt*1.5 + float64(sit.GPSHorizontalAccuracy)
+			if dist > maxDist {
+				reason = "position jump"
+				gpsIntegrityJumpDistance = dist
+			}
+		}
+	}
+	if sit.GPSFixQuality > 0 && sit.GPSSatellites > 0 && sit.GPSSatellites < GPS_INTEGRITY_MIN_SATS {
+		reason = "too few satellites"
+	}
+
+	gpsIntegrityLastLat, gpsIntegrityLastLng = lat, lng
+	gpsIntegrityLastTime = stratuxClock.Time
+	gpsIntegrityLastGroundSpeed = sit.GPSGroundSpeed
+
+	if reason != "" {
+		if !globalStatus.GPS_degraded {
+			logInfof("gps", "GPS integrity degraded: %s", reason)
+		}
+		gpsIntegrityDegradedTime = stratuxClock.Time
+		globalStatus.GPS_degraded = true
+		globalStatus.GPS_degraded_reason = reason
+	} else if globalStatus.GPS_degraded && stratuxClock.Since(gpsIntegrityDegradedTime) > GPS_INTEGRITY_HOLD_TIME {
+		logInfof("gps", "GPS integrity restored")
+		globalStatus.GPS_degraded = false
+		globalStatus.GPS_degraded_reason = ""
+		gpsIntegrityJumpDistance = 0
+	}
+}
+
+/*
+	getGPSIntegrity().
+		Returns the NIC and NACp to advertise for our own position. Without a detected problem this is NIC 8
+		with the NACp derived from the receiver's accuracy estimate. When degraded, NIC is set to 0 (unknown
+		containment) and the NACp also accounts for the last position jump.
+*/
+func getGPSIntegrity() (nic uint8, nacp uint8) {
+	if !globalStatus.GPS_degraded {
+		return 8, mySituation.GPSNACp
+	}
+	accuracy := float64(mySituation.GPSHorizontalAccuracy)
+	if gpsIntegrityJumpDistance > accuracy {
+		accuracy = gpsIntegrityJumpDistance
+	}
+	nacp = calculateNACp(float32(accuracy))
+	if nacp > mySituation.GPSNACp {
+		nacp = mySituation.GPSNACp
+	}
+	return 0, nacp
+}
@@ -0,0 +1,267 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	i2cscan.go: I2C bus scanner and hardware inventory for "my AHRS doesn't work" support. Probes the addresses
+		0x03-0x77 of every /dev/i2c-* bus, identifies the known chips (IMUs, baro sensors, fuel gauges, displays) by
+		their ID register where they have one, by address otherwise, and compares the result with the configured
+		sensors. The sensor bus is shared with the running sensor drivers, embd serializes the accesses.
+			/getI2CScan                           I2CScanReport, at most every I2C_SCAN_MIN_INTERVAL, cached otherwise
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	I2C_SCAN_MIN_INTERVAL = 5 * time.Second
+	I2C_SENSOR_BUS        = 1 // bus of the AHRS and baro sensors, see openI2CBus()
+	I2C_IMU_ADDRESS       = 0x68
+
+	I2C_TYPE_IMU     = "imu"
+	I2C_TYPE_MAG     = "magnetometer"
+	I2C_TYPE_BARO    = "baro"
+	I2C_TYPE_POWER   = "power"
+	I2C_TYPE_DISPLAY = "display"
+	I2C_TYPE_RTC     = "rtc"
+	I2C_TYPE_UNKNOWN = "unknown"
+)
+
+// Access to a bus for the scanner, see openI2CScanBus().
+type i2cScanBus interface {
+	probe(addr byte) error // nil if a device ACKs the address
+	readReg(addr, reg byte) (byte, error)
+}
+
+type I2CDevice struct {
+	Address    string // e.g. "0x68"
+	Chip       string // "" if unknown
+	Type       string // I2C_TYPE_*
+	Identified bool   // by its ID register, by the address only otherwise
+	ID         string // value of the ID register, e.g. "0xEA"
+	Supported  bool   // Stratux uses it (at this address)
+	Note       string
+}
+
+type I2CBusScan struct {
+	Bus     int
+	Device  string
+	Error   string
+	Devices []I2CDevice
+}
+
+// Configured sensor versus what was found.
+type I2CSensorCheck struct {
+	Sensor    string // "AHRS" or "Baro"
+	Enabled   bool
+	Connected bool
+	Found     string // chip found on I2C_SENSOR_BUS, "" if none
+	Issue     string // "" if everything is as expected
+}
+
+type I2CScanReport struct {
+	Time    time.Time
+	Buses   []I2CBusScan
+	Sensors []I2CSensorCheck
+}
+
+type i2cChip struct {
+	name      string
+	kind      string
+	reg       byte
+	ids       []byte // ID register values, nil = known by address only
+	supported bool
+	note      string
+}
+
+var i2cKnownChips = map[byte][]i2cChip{
+	0x0C: {{"AK8963 magnetometer", I2C_TYPE_MAG, 0x00, []byte{0x48}, true, "magnetometer of the MPU-9250, visible in bypass mode"}},
+	0x36: {{"MAX17043/MAX17048 fuel gauge", I2C_TYPE_POWER, 0, nil, false, "battery monitor, e.g. UPS-Lite or X728"}},
+	0x3C: {{"SSD1306 OLED display", I2C_TYPE_DISPLAY, 0, nil, false, ""}},
+	0x55: {{"BQ27441 fuel gauge", I2C_TYPE_POWER, 0, nil, false, ""}},
+	0x57: {{"PiSugar 3 power manager", I2C_TYPE_POWER, 0, nil, false, ""}},
+	0x75: {{"IP5209 power manager (PiSugar 2)", I2C_TYPE_POWER, 0, nil, false, ""}},
+}
+
+func init() {
+	for addr := byte(0x40); addr <= 0x45; addr++ {
+		i2cKnownChips[addr] = []i2cChip{{"INA219 current monitor", I2C_TYPE_POWER, 0, nil, false, "e.g. UPS HAT"}}
+	}
+	for _, addr := range []byte{0x68, 0x69} {
+		supported, note := addr == I2C_IMU_ADDRESS, ""
+		if !supported {
+			note = "Stratux expects the IMU at 0x68: connect AD0/SDO to ground"
+		}
+		i2cKnownChips[addr] = []i2cChip{
+			{"ICM-20948", I2C_TYPE_IMU, ICMREG_WHO_AM_I, []byte{ICMREG_WHO_AM_I_VAL}, supported, note},
+			{"MPU-9250", I2C_TYPE_IMU, MPUREG_WHO_AM_I, []byte{MPUREG_WHO_AM_I_VAL, MPUREG_WHO_AM_I_VAL_9250}, supported, note},
+			{"MPU-9255", I2C_TYPE_IMU, MPUREG_WHO_AM_I, []byte{MPUREG_WHO_AM_I_VAL_9255}, supported, note},
+			{"MPU-6500", I2C_TYPE_IMU, MPUREG_WHO_AM_I, []byte{MPUREG_WHO_AM_I_VAL_6500}, supported, note},
+			{"MPU-6000/6050", I2C_TYPE_IMU, MPUREG_WHO_AM_I, []byte{MPUREG_WHO_AM_I_VAL_60X0}, supported, note},
+			{"MPU (GY-91)", I2C_TYPE_IMU, MPUREG_WHO_AM_I, []byte{MPUREG_WHO_AM_I_VAL_UNKNOWN}, supported, note},
+			{"DS3231/DS1307 RTC", I2C_TYPE_RTC, 0, nil, false, "real time clock, occupies the IMU address"},
+		}
+	}
+	for _, addr := range []byte{0x76, 0x77} {
+		i2cKnownChips[addr] = []i2cChip{
+			{"BMP280", I2C_TYPE_BARO, 0xD0, []byte{0x56, 0x57, 0x58}, true, ""},
+			{"BME280", I2C_TYPE_BARO, 0xD0, []byte{0x60}, true, ""},
+			{"BMP180", I2C_TYPE_BARO, 0xD0, []byte{0x55}, false, "not supported, use a BMP280"},
+			{"BMP388", I2C_TYPE_BARO, 0x00, []byte{0x50}, false, "not supported, use a BMP280"},
+			{"BMP390", I2C_TYPE_BARO, 0x00, []byte{0x60}, false, "not supported, use a BMP280"},
+			{"DPS310", I2C_TYPE_BARO, 0x0D, []byte{0x10}, false, "not supported, use a BMP280"},
+		}
+	}
+}
+
+var i2cScanLast I2CScanReport
+var i2cScanMutex sync.Mutex
+
+// Identifies the device at addr: the first chip whose ID register matches, or the first one known by address only.
+func identifyI2CDevice(bus i2cScanBus, addr byte) I2CDevice {
+	dev := I2CDevice{Address: fmt.Sprintf("0x%02X", addr), Type: I2C_TYPE_UNKNOWN}
+	var byAddress *i2cChip
+	for i, chip := range i2cKnownChips[addr] {
+		if chip.ids == nil {
+			if byAddress == nil {
+				byAddress = &i2cKnownChips[addr][i]
+			}
+			continue
+		}
+		v, err := bus.readReg(addr, chip.reg)
+		if err != nil {
+			continue
+		}
+		for _, id := range chip.ids {
+			if v == id {
+				dev.Chip, dev.Type, dev.Supported, dev.Note = chip.name, chip.kind, chip.supported, chip.note
+				dev.Identified, dev.ID = true, fmt.Sprintf("0x%02X", v)
+				return dev
+			}
+		}
+	}
+	if byAddress != nil {
+		dev.Chip, dev.Type, dev.Supported, dev.Note = byAddress.name, byAddress.kind, byAddress.supported, byAddress.note
+	}
+	return dev
+}
+
+// Probes the addresses of one bus. Panics of the I2C host (e.g. not a Pi) become the bus error.
+func scanI2CBus(n int) (scan I2CBusScan) {
+	scan = I2CBusScan{Bus: n, Device: fmt.Sprintf("/dev/i2c-%d", n), Devices: make([]I2CDevice, 0)}
+	defer func() {
+		if r := recover(); r != nil {
+			scan.Error = fmt.Sprintf("%v", r)
+		}
+	}()
+	bus, err := openI2CScanBus(n)
+	if err != nil {
+		scan.Error = err.Error()
+		return
+	}
+	for addr := byte(0x03); addr <= 0x77; addr++ {
+		if err := bus.probe(addr); err != nil {
+			continue // no ACK
+		}
+		scan.Devices = append(scan.Devices, identifyI2CDevice(bus, addr))
+	}
+	return
+}
+
+// Bus numbers of the /dev/i2c-* devices, the sensor bus even if it doesn't exist (to report it).
+func i2cBusNumbers() []int {
+	buses := []int{I2C_SENSOR_BUS}
+	files, _ := filepath.Glob("/dev/i2c-*")
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimPrefix(f, "/dev/i2c-"))
+		if err == nil && n != I2C_SENSOR_BUS {
+			buses = append(buses, n)
+		}
+	}
+	sort.Ints(buses)
+	return buses
+}
+
+// Compares a configured sensor with the chips of the given type found on the sensor bus.
+func checkI2CSensor(name, kind string, enabled, connected bool, sensorBus *I2CBusScan) I2CSensorCheck {
+	check := I2CSensorCheck{Sensor: name, Enabled: enabled, Connected: connected}
+	var found *I2CDevice
+	if sensorBus != nil {
+		for i, dev := range sensorBus.Devices {
+			if dev.Type == kind && (found == nil || (dev.Supported && !found.Supported)) {
+				found = &sensorBus.Devices[i]
+			}
+		}
+	}
+	if found != nil {
+		check.Found = found.Chip + " at " + found.Address
+	}
+	switch {
+	case sensorBus == nil || len(sensorBus.Error) > 0:
+		if enabled && !connected {
+			check.Issue = "I2C bus not available, is I2C enabled in /boot/config.txt?"
+		}
+	case found == nil && enabled:
+		check.Issue = "no " + strings.ToLower(name) + " sensor found: check the wiring and the board orientation on the header"
+	case found == nil:
+	case !found.Supported:
+		check.Issue = found.Chip + " found at " + found.Address + ": " + found.Note
+	case !enabled:
+		check.Issue = found.Chip + " found, but the " + name + " sensor is disabled in the settings"
+	case !connected:
+		check.Issue = found.Chip + " found, but the driver couldn't initialize it, see the log"
+	}
+	return check
+}
+
+func scanI2C() I2CScanReport {
+	i2cScanMutex.Lock()
+	defer i2cScanMutex.Unlock()
+	if !i2cScanLast.Time.IsZero() && time.Since(i2cScanLast.Time) < I2C_SCAN_MIN_INTERVAL {
+		return i2cScanLast
+	}
+	report := I2CScanReport{Time: time.Now().UTC(), Buses: make([]I2CBusScan, 0)}
+	var sensorBus *I2CBusScan
+	for _, n := range i2cBusNumbers() {
+		report.Buses = append(report.Buses, scanI2CBus(n))
+	}
+	for i := range report.Buses {
+		if report.Buses[i].Bus == I2C_SENSOR_BUS {
+			sensorBus = &report.Buses[i]
+		}
+	}
+	report.Sensors = []I2CSensorCheck{
+		checkI2CSensor("AHRS", I2C_TYPE_IMU, globalSettings.IMU_Sensor_Enabled, globalStatus.IMUConnected, sensorBus),
+		checkI2CSensor("Baro", I2C_TYPE_BARO, globalSettings.BMP_Sensor_Enabled, globalStatus.BMPConnected, sensorBus),
+	}
+	for _, s := range report.Sensors {
+		if len(s.Issue) > 0 {
+			logInfof("i2c", "%s: %s", s.Sensor, s.Issue)
+		}
+	}
+	i2cScanLast = report
+	return report
+}
+
+// AJAX call - /getI2CScan.
+func handleI2CScanRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	scanJSON, err := json.Marshal(scanI2C())
+	if err != nil {
+		logErrorf("i2c", "Error sending I2C scan JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", scanJSON)
+}
@@ -0,0 +1,397 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	internetweather.go: Weather from the internet when the unit has an internet connection (home WiFi, onboard LTE)
+		but no FIS-B reception, e.g. before departure or outside of the UAT coverage.
+		With InternetWeather enabled and no ground station received for INTERNET_WX_FISB_TIMEOUT, METARs and TAFs
+		within InternetWeatherRange of ownship are fetched from aviationweather.gov every INTERNET_WX_FETCH_INTERVAL,
+		and NEXRAD base reflectivity (US only) from the Iowa Environmental Mesonet as a WMS image with one pixel per
+		bin of the FIS-B block grid. The pixel colors are matched to the closest color of the NWS reflectivity scale
+		and converted to the FIS-B intensity levels.
+		Reports go into the same store as the FIS-B text reports (wxreports.go) and to the /weather websocket, NEXRAD
+		blocks into the regional NEXRAD product (nexradtiles.go), all with Source WX_SOURCE_INTERNET. Blocks uplinked
+		by FIS-B within INTERNET_WX_FISB_PRIORITY are not replaced.
+		For EFB apps, the data of the last fetch is sent every INTERNET_WX_UPLINK_INTERVAL as GDL90 uplink messages,
+		encoded like a ground station at ownship's position would (see uatparse/encode.go).
+		/getInternetWeather returns the state of the fallback.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+const (
+	WX_SOURCE_FISB     = "FIS-B"
+	WX_SOURCE_INTERNET = "internet"
+
+	INTERNET_WX_FETCH_INTERVAL  = 5 * time.Minute
+	INTERNET_WX_UPLINK_INTERVAL = 1 * time.Minute
+	INTERNET_WX_FISB_TIMEOUT    = 5 * time.Minute  // no ground station received for this long: fallback active
+	INTERNET_WX_FISB_PRIORITY   = 10 * time.Minute // FIS-B NEXRAD blocks younger than this are kept
+	INTERNET_WX_MAX_AGE         = 15 * time.Minute // data of the last fetch is uplinked for this long
+	INTERNET_WX_MAX_RANGE       = 300              // nm
+	INTERNET_WX_MAX_SIZE        = 4 * 1024 * 1024
+	INTERNET_WX_NEXRAD_MAX_LAT  = 60 // blocks are twice as wide beyond
+
+	INTERNET_WX_METAR_URL  = "https://aviationweather.gov/api/data/metar?format=json&bbox=%.2f,%.2f,%.2f,%.2f"
+	INTERNET_WX_TAF_URL    = "https://aviationweather.gov/api/data/taf?format=json&bbox=%.2f,%.2f,%.2f,%.2f"
+	INTERNET_WX_NEXRAD_URL = "https://mesonet.agron.iastate.edu/cgi-bin/wms/nexrad/n0q.cgi?SERVICE=WMS&VERSION=1.1.1" +
+		"&REQUEST=GetMap&LAYERS=nexrad-n0q-900913&STYLES=&SRS=EPSG:4326&BBOX=%f,%f,%f,%f&WIDTH=%d&HEIGHT=%d" +
+		"&FORMAT=image/png&TRANSPARENT=true"
+)
+
+// aviationweather.gov data API, the fields used.
+type awcMetar struct {
+	IcaoId    string  `json:"icaoId"`
+	RawOb     string  `json:"rawOb"`
+	MetarType string  `json:"metarType"`
+	Lat       float64 `json:"lat"`
+	Lon       float64 `json:"lon"`
+}
+
+type awcTaf struct {
+	IcaoId string  `json:"icaoId"`
+	RawTAF string  `json:"rawTAF"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+}
+
+// Response of /getInternetWeather.
+type InternetWeatherStatus struct {
+	Enabled      bool
+	Active       bool // enabled, GPS position and no FIS-B reception
+	LastFetch    time.Time
+	LastError    string
+	Metars       int
+	Tafs         int
+	NexradBlocks int // with reflectivity
+	Uplinks      uint64
+}
+
+// dBZ of the colors of the NWS reflectivity scale.
+var internetWxNexradColors = []struct {
+	dbz int
+	c   color.NRGBA
+}{
+	{5, color.NRGBA{0x04, 0xe9, 0xe7, 0xff}},
+	{10, color.NRGBA{0x01, 0x9f, 0xf4, 0xff}},
+	{15, color.NRGBA{0x03, 0x00, 0xf4, 0xff}},
+	{20, color.NRGBA{0x02, 0xfd, 0x02, 0xff}},
+	{25, color.NRGBA{0x01, 0xc5, 0x01, 0xff}},
+	{30, color.NRGBA{0x00, 0x8e, 0x00, 0xff}},
+	{35, color.NRGBA{0xfd, 0xf8, 0x02, 0xff}},
+	{40, color.NRGBA{0xe5, 0xbc, 0x00, 0xff}},
+	{45, color.NRGBA{0xfd, 0x95, 0x00, 0xff}},
+	{50, color.NRGBA{0xfd, 0x00, 0x00, 0xff}},
+	{55, color.NRGBA{0xd4, 0x00, 0x00, 0xff}},
+	{60, color.NRGBA{0xbc, 0x00, 0x00, 0xff}},
+	{65, color.NRGBA{0xf8, 0x00, 0xfd, 0xff}},
+	{70, color.NRGBA{0x98, 0x54, 0xc6, 0xff}},
+	{75, color.NRGBA{0xfd, 0xfd, 0xfd, 0xff}},
+}
+
+var internetWxStatus InternetWeatherStatus
+var internetWxReports []string // raw reports of the last fetch, for the uplinks
+var internetWxNexrad []uatparse.NEXRADBlock
+var internetWxLastAttempt time.Time // stratuxClock
+var internetWxLastFetch time.Time   // stratuxClock
+var internetWxMutex = &sync.Mutex{}
+
+func internetWxGet(url string) ([]byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, INTERNET_WX_MAX_SIZE))
+}
+
+// Area within rangeNm of a position.
+func internetWxBBox(lat, lng float64, rangeNm int) (minLat, minLng, maxLat, maxLng float64) {
+	dLat := float64(rangeNm) / 60
+	dLng := dLat / math.Max(math.Cos(lat*math.Pi/180), 0.1)
+	return math.Max(lat-dLat, -90), lng - dLng, math.Min(lat+dLat, 90), lng + dLng
+}
+
+// METAR in the FIS-B text format, "METAR KOSH 011345Z ...".
+func internetWxMetarText(m awcMetar) string {
+	raw := strings.Join(strings.Fields(m.RawOb), " ")
+	if strings.HasPrefix(raw, "METAR ") || strings.HasPrefix(raw, "SPECI ") {
+		return raw
+	}
+	if m.MetarType == "SPECI" {
+		return "SPECI " + raw
+	}
+	return "METAR " + raw
+}
+
+// TAF in the FIS-B text format, "TAF KOSH 011130Z ..." or "TAF.AMD KOSH 011130Z ...".
+func internetWxTafText(t awcTaf) string {
+	fields := strings.Fields(t.RawTAF)
+	typ := "TAF"
+	if len(fields) > 0 && fields[0] == "TAF" {
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && (fields[0] == "AMD" || fields[0] == "COR") {
+		if fields[0] == "AMD" {
+			typ = "TAF.AMD"
+		}
+		fields = fields[1:]
+	}
+	return typ + " " + strings.Join(fields, " ")
+}
+
+// Stores a report like registerWxReport() and sends it on the /weather websocket. Returns false if it can't be
+// decoded.
+func registerInternetWxReport(msg string, lat, lng float64) bool {
+	now := time.Now().UTC()
+	r := decodeWxReport(msg, now)
+	if r == nil {
+		return false
+	}
+	x := strings.Split(r.Raw, " ")
+	weatherUpdate.SendJSON(WeatherMessage{Type: x[0], Location: x[1], Time: x[2], Data: strings.Join(x[3:], " "),
+		LocaltimeReceived: stratuxClock.Time, Source: WX_SOURCE_INTERNET})
+
+	wxReportsMutex.Lock()
+	defer wxReportsMutex.Unlock()
+	loadWxStations()
+	r.Lat, r.Lng, r.LocationSource = lat, lng, "station"
+	if pos, ok := wxStations[r.Station]; ok {
+		r.Lat, r.Lng = pos[0], pos[1]
+	}
+	r.Source = WX_SOURCE_INTERNET
+	storeWxReport(r, now)
+	return true
+}
+
+// METARs and TAFs in the area. Returns the reports in the FIS-B text format.
+func fetchInternetWxReports(minLat, minLng, maxLat, maxLng float64) (metars, tafs []string, err error) {
+	data, err := internetWxGet(fmt.Sprintf(INTERNET_WX_METAR_URL, minLat, minLng, maxLat, maxLng))
+	if err != nil {
+		return nil, nil, err
+	}
+	var awcMetars []awcMetar
+	if err := json.Unmarshal(data, &awcMetars); err != nil {
+		return nil, nil, fmt.Errorf("METAR: %s", err.Error())
+	}
+	for _, m := range awcMetars {
+		text := internetWxMetarText(m)
+		if registerInternetWxReport(text, m.Lat, m.Lon) {
+			metars = append(metars, text)
+		}
+	}
+
+	data, err = internetWxGet(fmt.Sprintf(INTERNET_WX_TAF_URL, minLat, minLng, maxLat, maxLng))
+	if err != nil {
+		return metars, nil, err
+	}
+	var awcTafs []awcTaf
+	if err := json.Unmarshal(data, &awcTafs); err != nil {
+		return metars, nil, fmt.Errorf("TAF: %s", err.Error())
+	}
+	for _, t := range awcTafs {
+		text := internetWxTafText(t)
+		if registerInternetWxReport(text, t.Lat, t.Lon) {
+			tafs = append(tafs, text)
+		}
+	}
+	return metars, tafs, nil
+}
+
+// FIS-B intensity level of a reflectivity image pixel.
+func internetWxNexradIntensity(c color.Color) uint16 {
+	p := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if p.A < 0x80 {
+		return 0
+	}
+	dbz, best := 0, math.MaxFloat64
+	for _, n := range internetWxNexradColors {
+		dr, dg, db := float64(p.R)-float64(n.c.R), float64(p.G)-float64(n.c.G), float64(p.B)-float64(n.c.B)
+		if d := dr*dr + dg*dg + db*db; d < best {
+			dbz, best = n.dbz, d
+		}
+	}
+	switch {
+	case dbz < 5:
+		return 0
+	case dbz < 20:
+		return 1
+	case dbz < 30:
+		return 2
+	case dbz < 40:
+		return 3
+	case dbz < 45:
+		return 4
+	case dbz < 50:
+		return 5
+	case dbz < 55:
+		return 6
+	}
+	return 7
+}
+
+// Regional NEXRAD blocks (scale 0, northern hemisphere) covering the area.
+func fetchInternetWxNexrad(minLat, minLng, maxLat, maxLng float64) ([]uatparse.NEXRADBlock, error) {
+	ringS := int(math.Floor(math.Max(minLat, 0) / uatparse.BLOCK_HEIGHT))
+	ringN := int(math.Ceil(math.Min(maxLat, INTERNET_WX_NEXRAD_MAX_LAT) / uatparse.BLOCK_HEIGHT))
+	colW := int(math.Floor(minLng / uatparse.BLOCK_WIDTH))
+	colE := int(math.Ceil(maxLng / uatparse.BLOCK_WIDTH))
+	if ringN <= ringS || colE <= colW {
+		return nil, nil
+	}
+	width, height := (colE-colW)*NEXRAD_BLOCK_COLS, (ringN-ringS)*NEXRAD_BLOCK_ROWS
+	url := fmt.Sprintf(INTERNET_WX_NEXRAD_URL, float64(colW)*uatparse.BLOCK_WIDTH, float64(ringS)*uatparse.BLOCK_HEIGHT,
+		float64(colE)*uatparse.BLOCK_WIDTH, float64(ringN)*uatparse.BLOCK_HEIGHT, width, height)
+	data, err := internetWxGet(url)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("NEXRAD: %s", err.Error())
+	}
+	bounds := img.Bounds()
+	if bounds.Dx() != width || bounds.Dy() != height {
+		return nil, fmt.Errorf("NEXRAD: image is %dx%d instead of %dx%d", bounds.Dx(), bounds.Dy(), width, height)
+	}
+
+	blocks := make([]uatparse.NEXRADBlock, 0)
+	for ring := ringS; ring < ringN; ring++ {
+		for col := colW; col < colE; col++ {
+			blockNum := ring*uatparse.BLOCKS_PER_RING + (col%uatparse.BLOCKS_PER_RING+uatparse.BLOCKS_PER_RING)%uatparse.BLOCKS_PER_RING
+			lat, lon, h, w := uatparse.NexradBlockLocation(blockNum, false, 0)
+			b := uatparse.NEXRADBlock{Radar_Type: NEXRAD_PRODUCT_REGIONAL, LatNorth: lat, LonWest: lon, Height: h, Width: w,
+				Intensity: make([]uint16, NEXRAD_BLOCK_COLS*NEXRAD_BLOCK_ROWS)}
+			for i := range b.Intensity {
+				x := (col-colW)*NEXRAD_BLOCK_COLS + i%NEXRAD_BLOCK_COLS
+				y := (ringN-1-ring)*NEXRAD_BLOCK_ROWS + i/NEXRAD_BLOCK_COLS
+				b.Intensity[i] = internetWxNexradIntensity(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+			}
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks, nil
+}
+
+// Fetches everything around ownship and updates the stores.
+func fetchInternetWeather() {
+	minLat, minLng, maxLat, maxLng := internetWxBBox(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude),
+		int(math.Min(float64(globalSettings.InternetWeatherRange), INTERNET_WX_MAX_RANGE)))
+	metars, tafs, errReports := fetchInternetWxReports(minLat, minLng, maxLat, maxLng)
+	blocks, errNexrad := fetchInternetWxNexrad(minLat, minLng, maxLat, maxLng)
+	if errNexrad == nil && len(blocks) > 0 {
+		updateInternetNexradBlocks(blocks)
+	}
+
+	internetWxMutex.Lock()
+	defer internetWxMutex.Unlock()
+	internetWxStatus.LastError = ""
+	for _, err := range []error{errReports, errNexrad} {
+		if err != nil {
+			internetWxStatus.LastError = err.Error()
+			if globalSettings.DEBUG {
+				logDebugf("weather", "Internet weather: %s", err.Error())
+			}
+		}
+	}
+	if errReports != nil && errNexrad != nil {
+		return // no internet most of the time
+	}
+	internetWxReports = append(metars, tafs...)
+	internetWxNexrad = blocks
+	internetWxLastFetch = stratuxClock.Time
+	internetWxStatus.LastFetch = time.Now().UTC()
+	internetWxStatus.Metars, internetWxStatus.Tafs, internetWxStatus.NexradBlocks = len(metars), len(tafs), 0
+	for _, b := range blocks {
+		for _, intensity := range b.Intensity {
+			if intensity > 1 {
+				internetWxStatus.NexradBlocks++
+				break
+			}
+		}
+	}
+}
+
+// Sends the data of the last fetch as FIS-B uplinks from ownship's position.
+func sendInternetWeatherUplinks() {
+	internetWxMutex.Lock()
+	if stratuxClock.Since(internetWxLastFetch) > INTERNET_WX_MAX_AGE {
+		internetWxMutex.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	frames := uatparse.EncodeTextFrames(internetWxReports, now)
+	for _, b := range internetWxNexrad {
+		if f, ok := uatparse.EncodeNexradFrame(NEXRAD_PRODUCT_REGIONAL, b, now); ok {
+			frames = append(frames, f)
+		}
+	}
+	uplinks := uatparse.EncodeUplinks(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), frames)
+	internetWxStatus.Uplinks += uint64(len(uplinks))
+	internetWxMutex.Unlock()
+
+	for _, u := range uplinks {
+		relayMessage(MSGTYPE_UPLINK, u)
+	}
+}
+
+func internetWeatherUpdater() {
+	ticker := time.NewTicker(INTERNET_WX_UPLINK_INTERVAL)
+	for {
+		active := globalSettings.InternetWeather && isGPSValid() && !isFISBReceived(INTERNET_WX_FISB_TIMEOUT)
+		internetWxMutex.Lock()
+		internetWxStatus.Active = active
+		fetch := active && (internetWxLastAttempt.IsZero() || stratuxClock.Since(internetWxLastAttempt) >= INTERNET_WX_FETCH_INTERVAL)
+		if fetch {
+			internetWxLastAttempt = stratuxClock.Time
+		}
+		internetWxMutex.Unlock()
+
+		if fetch {
+			fetchInternetWeather()
+		}
+		if active {
+			sendInternetWeatherUplinks()
+		}
+		<-ticker.C
+	}
+}
+
+// AJAX call - /getInternetWeather. State of the internet weather fallback.
+func handleInternetWeatherRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	internetWxMutex.Lock()
+	status := internetWxStatus
+	internetWxMutex.Unlock()
+	status.Enabled = globalSettings.InternetWeather
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("weather", "Error sending internet weather JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
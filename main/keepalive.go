@@ -0,0 +1,227 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	keepalive.go: Keep-alive and sleep detection of the UDP clients. The state of each connection follows from:
+			ICMP echo replies                     device reachable (pinged every 5 s, see icmpEchoSender())
+			ARP / NDP neighbor state REACHABLE    device reachable, for devices that don't answer pings while dozing
+			ICMP port unreachable                 device awake, but the app isn't listening (see icmpMonitor())
+			app announcement (ACK)                the app is listening: UDP to KEEPALIVE_ACK_PORT in the ForeFlight
+			                                      format {"App":"ForeFlight","GDL90":{"port":4000}}, any app may send it
+		States:
+			unknown                               nothing received yet, queue paused
+			away                                  not reachable for KEEPALIVE_REACH_TIMEOUT, queue paused
+			sleeping                              port unreachable, queue paused (only heartbeats are sent)
+			starting                              port reachable again, only important messages for a while
+			awake                                 everything is sent
+		Recent state changes are in globalStatus.ClientStateChanges (status stream).
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	KEEPALIVE_ACK_PORT       = 63093
+	KEEPALIVE_ACK_TIMEOUT    = 15 * time.Second
+	KEEPALIVE_REACH_TIMEOUT  = 10 * time.Second
+	KEEPALIVE_SLEEP_TIME     = 5 * time.Second  // sleeping for this long after a port unreachable
+	KEEPALIVE_STARTUP_TIME   = 15 * time.Second // throttled for this long after a port unreachable
+	KEEPALIVE_STATE_CHANGES  = 20               // kept in globalStatus.ClientStateChanges
+	KEEPALIVE_NEIGH_INTERVAL = 5 * time.Second
+
+	CLIENT_STATE_UNKNOWN  = "unknown"
+	CLIENT_STATE_AWAY     = "away"
+	CLIENT_STATE_SLEEPING = "sleeping"
+	CLIENT_STATE_STARTING = "starting"
+	CLIENT_STATE_AWAKE    = "awake"
+)
+
+type ClientStateChange struct {
+	Time   time.Time
+	Client string // ip:port
+	From   string
+	To     string
+	Reason string
+}
+
+// Announcement of an app, ForeFlight format.
+type keepAliveAck struct {
+	App   string
+	GDL90 struct {
+		Port int `json:"port"`
+	}
+	Device *foreFlightDevice // set in device announcements (ours, see foreflight.go, or of another stratux)
+}
+
+func latestTime(times ...time.Time) time.Time {
+	var latest time.Time
+	for _, t := range times {
+		if t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// State of the connection and why.
+func (conn *networkConnection) clientState() (string, string) {
+	// Unable to listen to ICMP without root - send to everything. Just for debugging.
+	// Broadcast receivers can't be pinged.
+	if isX86DebugMode() || globalSettings.NoSleep || conn.Broadcast {
+		return CLIENT_STATE_AWAKE, "not monitored"
+	}
+	if !conn.lastAck.IsZero() && stratuxClock.Since(conn.lastAck) < KEEPALIVE_ACK_TIMEOUT {
+		return CLIENT_STATE_AWAKE, "acknowledged by " + conn.ackApp
+	}
+	lastSeen := latestTime(conn.LastPingResponse, conn.lastReachable, conn.lastAck)
+	if lastSeen.IsZero() {
+		return CLIENT_STATE_UNKNOWN, "no response yet"
+	}
+	if stratuxClock.Since(lastSeen) > KEEPALIVE_REACH_TIMEOUT {
+		return CLIENT_STATE_AWAY, "no ping, ARP or app response"
+	}
+	if stratuxClock.Since(conn.LastUnreachable) < KEEPALIVE_SLEEP_TIME {
+		return CLIENT_STATE_SLEEPING, "port unreachable"
+	}
+	if stratuxClock.Since(conn.LastUnreachable) < KEEPALIVE_STARTUP_TIME {
+		return CLIENT_STATE_STARTING, "port reachable again"
+	}
+	return CLIENT_STATE_AWAKE, "reachable"
+}
+
+func recordClientStateChange(change ClientStateChange) {
+	if globalSettings.DEBUG {
+		logDebugf("keep-alive", "client %s: %s -> %s (%s)", change.Client, change.From, change.To, change.Reason)
+	}
+	changes := append(globalStatus.ClientStateChanges, change)
+	if len(changes) > KEEPALIVE_STATE_CHANGES {
+		changes = changes[len(changes)-KEEPALIVE_STATE_CHANGES:]
+	}
+	// Replaced, not modified, the status may be marshalled at the same time
+	globalStatus.ClientStateChanges = append([]ClientStateChange{}, changes...)
+}
+
+// Parses "ip neigh show" into the addresses in state REACHABLE or PERMANENT, link-local IPv6 ones with their zone.
+func parseReachableNeighbors(out string) map[string]bool {
+	reachable := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		// 192.168.10.20 dev wlan0 lladdr 1e:2b:3d:4e:5f:60 REACHABLE
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		state := fields[len(fields)-1]
+		if state != "REACHABLE" && state != "PERMANENT" {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			continue
+		}
+		addr := ip.String()
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			for i := 1; i+1 < len(fields); i++ {
+				if fields[i] == "dev" {
+					addr += "%" + fields[i+1]
+				}
+			}
+		}
+		reachable[addr] = true
+	}
+	return reachable
+}
+
+// Updates the state of the UDP connections every second, and their neighbor reachability every
+// KEEPALIVE_NEIGH_INTERVAL.
+func keepAliveMonitor() {
+	registerSubsystem("keepalive", 5*time.Second)
+	ticker := time.NewTicker(time.Second)
+	lastNeigh := time.Time{}
+	for {
+		<-ticker.C
+		subsystemAlive("keepalive")
+		var reachable map[string]bool
+		if time.Since(lastNeigh) >= KEEPALIVE_NEIGH_INTERVAL {
+			lastNeigh = time.Now()
+			if out, err := exec.Command("ip", "neigh", "show").Output(); err == nil {
+				reachable = parseReachableNeighbors(string(out))
+			}
+		}
+
+		netMutex.Lock()
+		for _, c := range clientConnections {
+			conn, ok := c.(*networkConnection)
+			if !ok {
+				continue
+			}
+			if reachable[conn.Ip] {
+				conn.lastReachable = stratuxClock.Time
+			}
+			state, reason := conn.clientState()
+			if state == conn.state {
+				continue
+			}
+			from := conn.state
+			if len(from) == 0 {
+				from = CLIENT_STATE_UNKNOWN
+			}
+			conn.state, conn.stateSince = state, stratuxClock.Time
+			if from != state {
+				recordClientStateChange(ClientStateChange{stratuxClock.Time, conn.GetConnectionKey(), from, state, reason})
+			}
+			if state == CLIENT_STATE_AWAKE || state == CLIENT_STATE_STARTING {
+				// Resume right away with what was queued while paused
+				conn.Queue.notifyData()
+			}
+		}
+		netMutex.Unlock()
+	}
+}
+
+// Receives the app announcements on KEEPALIVE_ACK_PORT.
+func keepAliveAckListener() {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: KEEPALIVE_ACK_PORT})
+	if err != nil {
+		logErrorf("keep-alive", "can't listen on UDP port %d: %s", KEEPALIVE_ACK_PORT, err.Error())
+		return
+	}
+	defer conn.Close()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logErrorf("keep-alive", "%s", err.Error())
+			time.Sleep(time.Second)
+			continue
+		}
+		var ack keepAliveAck
+		if err := json.Unmarshal(buf[:n], &ack); err != nil || ack.Device != nil {
+			continue
+		}
+		ip := addr.IP.String()
+		if addr.IP.To4() == nil && addr.IP.IsLinkLocalUnicast() && len(addr.Zone) > 0 {
+			ip += "%" + addr.Zone
+		}
+		netMutex.Lock()
+		for _, c := range getNetworkConnsByIp(ip) {
+			// Without port the app takes everything sent to the device
+			if ack.GDL90.Port == 0 || uint32(ack.GDL90.Port) == c.Port {
+				c.lastAck = stratuxClock.Time
+				c.ackApp = ack.App
+				if len(c.ackApp) == 0 {
+					c.ackApp = "app"
+				}
+			}
+		}
+		netMutex.Unlock()
+	}
+}
@@ -0,0 +1,164 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	lightning.go: FIS-B lightning (product 103) as timestamped strikes, for the EFBs that ignore the product.
+		Every bin with strikes (see uatparse/lightning.go) is a strike at the center of the bin with the time of the
+		product. A bin uplinked again with the same time updates the strike, strikes are dropped LIGHTNING_MAX_AGE
+		after their time. Strikes are aged in LIGHTNING_AGE_STEP steps.
+			/getLightning                         all current strikes
+			/lightning/<z>/<x>/<y>.png            the strikes as slippy map tiles (as /nexrad/), colored by age
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+const (
+	LIGHTNING_PRODUCT    = 103
+	LIGHTNING_MAX_AGE    = 15 * time.Minute
+	LIGHTNING_AGE_STEP   = 5 * time.Minute
+	LIGHTNING_MARKER_MIN = 4 // px, smallest marker on a tile
+)
+
+// Colors of the age steps.
+var lightningColors = []color.NRGBA{
+	{0xff, 0xff, 0x00, 0xff}, // newest
+	{0xff, 0xa0, 0x00, 0xe0},
+	{0xa0, 0xa0, 0xa0, 0xc0},
+}
+
+type LightningStrike struct {
+	Lat      float64
+	Lng      float64
+	Strikes  int // at least, see uatparse.LIGHTNING_STRIKES
+	Positive bool
+	Time     time.Time
+	Age      float64 // s, set in /getLightning
+	AgeStep  int     // 0 = newest, LIGHTNING_AGE_STEP steps
+	Received time.Time
+}
+
+type lightningKey struct {
+	lat, lng float64
+	t        time.Time
+}
+
+var lightningStrikes = make(map[lightningKey]*LightningStrike)
+var lightningMutex = &sync.RWMutex{}
+
+// Called for every decoded FIS-B frame from parseInput().
+func updateLightning(f *uatparse.UATFrame) {
+	if f.Product_id != LIGHTNING_PRODUCT || len(f.Lightning) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	t := fisbTimeOfDay(int(f.FISB_hours), int(f.FISB_minutes), now)
+	lightningMutex.Lock()
+	defer lightningMutex.Unlock()
+	for _, s := range f.Lightning {
+		key := lightningKey{s.Lat, s.Lon, t}
+		lightningStrikes[key] = &LightningStrike{Lat: s.Lat, Lng: s.Lon, Strikes: uatparse.LIGHTNING_STRIKES[s.Count&0x07],
+			Positive: s.Positive, Time: t, Received: now}
+	}
+	for key, s := range lightningStrikes {
+		if now.Sub(s.Time) > LIGHTNING_MAX_AGE {
+			delete(lightningStrikes, key)
+		}
+	}
+}
+
+// Current strikes, oldest first. Requires lightningMutex.
+func getLightningStrikes(now time.Time) []LightningStrike {
+	strikes := make([]LightningStrike, 0)
+	for _, s := range lightningStrikes {
+		age := now.Sub(s.Time)
+		if age > LIGHTNING_MAX_AGE {
+			continue
+		}
+		strike := *s
+		strike.Age = math.Max(age.Seconds(), 0)
+		strike.AgeStep = int(math.Max(float64(age/LIGHTNING_AGE_STEP), 0))
+		if strike.AgeStep >= len(lightningColors) {
+			strike.AgeStep = len(lightningColors) - 1
+		}
+		strikes = append(strikes, strike)
+	}
+	sort.Slice(strikes, func(i, j int) bool { return strikes[i].Time.Before(strikes[j].Time) })
+	return strikes
+}
+
+// AJAX call - /getLightning. All current strikes.
+func handleLightningRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	lightningMutex.RLock()
+	strikes := getLightningStrikes(time.Now().UTC())
+	lightningMutex.RUnlock()
+
+	strikesJSON, err := json.Marshal(strikes)
+	if err != nil {
+		logErrorf("lightning", "Error sending lightning JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", strikesJSON)
+}
+
+// /lightning/<z>/<x>/<y>.png, newer strikes drawn over older ones.
+func handleLightningTileRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/lightning/"), "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".png") {
+		http.Error(w, "expected /lightning/<z>/<x>/<y>.png", http.StatusNotFound)
+		return
+	}
+	z, errZ := strconv.Atoi(parts[0])
+	x, errX := strconv.Atoi(parts[1])
+	y, errY := strconv.Atoi(strings.TrimSuffix(parts[2], ".png"))
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > NEXRAD_MAX_ZOOM || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		http.Error(w, "invalid tile", http.StatusNotFound)
+		return
+	}
+
+	lightningMutex.RLock()
+	strikes := getLightningStrikes(time.Now().UTC())
+	lightningMutex.RUnlock()
+	w.Header().Set("Content-Type", "image/png")
+	var img *image.NRGBA
+	for i := range strikes {
+		s := &strikes[i]
+		px, py := nexradTilePixel(s.Lat, s.Lng, z, x, y)
+		// Bin size: 1 minute of latitude
+		_, py1 := nexradTilePixel(s.Lat-1.0/60, s.Lng, z, x, y)
+		size := math.Max(py1-py, LIGHTNING_MARKER_MIN)
+		if px+size < 0 || py+size < 0 || px-size >= NEXRAD_TILE_SIZE || py-size >= NEXRAD_TILE_SIZE {
+			continue
+		}
+		if img == nil {
+			img = image.NewNRGBA(image.Rect(0, 0, NEXRAD_TILE_SIZE, NEXRAD_TILE_SIZE))
+		}
+		fillNexradRect(img, px-size/2, py-size/2, px+size/2, py+size/2, lightningColors[s.AgeStep])
+	}
+	if img == nil {
+		w.Write(nexradEmptyTile)
+		return
+	}
+	png.Encode(w, img)
+}
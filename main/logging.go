@@ -0,0 +1,360 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	logging.go: Leveled logger writing stratux.log, rotated by size (LOG_MAX_SIZE, LOG_ROTATE_KEEP files). Lines are
+			2021/06/01 12:00:00.000000 WARN  mqtt: connection to tcp://hangar.local:1883 lost: EOF
+		Everything logs with logDebugf/logInfof/logWarnf/logErrorf and a subsystem. Output of the log package (only
+		left in libraries) goes to the logger as well, as "main" with level info. The level can be set globally
+		(globalSettings.LogLevel, debug with globalSettings.DEBUG) and per subsystem (globalSettings.LogLevels), at
+		runtime:
+			/getLogLevels                         default level, levels per subsystem, subsystems seen so far
+			/setLogLevel                          POST {"Subsystem": "mqtt", "Level": "debug"}. Without subsystem the
+			                                      default level, an empty level removes the one of the subsystem
+			/downloadSupportBundle                zip with the logs, version, settings (without passwords), status and
+			                                      system health, to attach to bug reports
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+
+	LOG_MAX_SIZE       = 5 * 1024 * 1024
+	LOG_ROTATE_KEEP    = 5 // stratux.log.1 ... stratux.log.5
+	LOG_SUBSYSTEM_MAIN = "main"
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+type stratuxLogger struct {
+	mu         sync.Mutex
+	path       string
+	file       *os.File
+	size       int64
+	levels     map[string]int // subsystem -> level
+	level      int            // default
+	subsystems map[string]bool
+}
+
+var logger = &stratuxLogger{levels: make(map[string]int), level: LOG_INFO, subsystems: make(map[string]bool)}
+
+func parseLogLevel(name string) (int, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Takes over globalSettings.LogLevel and LogLevels.
+func applyLogLevels() {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.level = LOG_INFO
+	if level, err := parseLogLevel(globalSettings.LogLevel); err == nil {
+		logger.level = level
+	}
+	if globalSettings.DEBUG {
+		logger.level = LOG_DEBUG // the messages that are only logged in debug mode
+	}
+	logger.levels = make(map[string]int)
+	for sub, name := range globalSettings.LogLevels {
+		if level, err := parseLogLevel(name); err == nil {
+			logger.levels[strings.ToLower(sub)] = level
+		}
+	}
+}
+
+// Opens (or reopens, after SIGHUP) the log file. The process' stderr goes there too, for crash dumps.
+func (l *stratuxLogger) open(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fp, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.path, l.file, l.size = path, fp, 0
+	if fi, err := fp.Stat(); err == nil {
+		l.size = fi.Size()
+	}
+	logFileHandle = fp
+	syscall.Dup3(int(fp.Fd()), 2, 0)
+	return nil
+}
+
+// stratux.log -> stratux.log.1 -> ... -> stratux.log.LOG_ROTATE_KEEP. Called with l.mu held.
+func (l *stratuxLogger) rotate() {
+	l.file.Close()
+	for i := LOG_ROTATE_KEEP - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	os.Rename(l.path, l.path+".1")
+	fp, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		l.file = nil
+		fmt.Fprintf(os.Stdout, "can't reopen %s after rotation: %s\n", l.path, err.Error())
+		return
+	}
+	l.file, l.size = fp, 0
+	logFileHandle = fp
+	syscall.Dup3(int(fp.Fd()), 2, 0)
+}
+
+func (l *stratuxLogger) truncate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("no log file")
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	l.size = 0
+	return nil
+}
+
+func (l *stratuxLogger) enabled(level int, subsystem string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.subsystems[subsystem] = true
+	if sublevel, ok := l.levels[subsystem]; ok {
+		return level >= sublevel
+	}
+	return level >= l.level
+}
+
+func (l *stratuxLogger) write(level int, subsystem, msg string) {
+	line := fmt.Sprintf("%s %-5s %s: %s\n", time.Now().Format("2006/01/02 15:04:05.000000"),
+		strings.ToUpper(logLevelNames[level]), subsystem, strings.TrimRight(msg, "\n"))
+	os.Stdout.WriteString(line)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if l.size+int64(len(line)) > LOG_MAX_SIZE {
+		l.rotate()
+		if l.file == nil {
+			return
+		}
+	}
+	n, _ := l.file.WriteString(line)
+	l.size += int64(n)
+}
+
+// Output of the log package. Every call is one message.
+func (l *stratuxLogger) Write(p []byte) (int, error) {
+	if l.enabled(LOG_INFO, LOG_SUBSYSTEM_MAIN) {
+		l.write(LOG_INFO, LOG_SUBSYSTEM_MAIN, string(p))
+	}
+	return len(p), nil
+}
+
+func logf(level int, subsystem string, format string, a ...interface{}) {
+	if logger.enabled(level, subsystem) {
+		logger.write(level, subsystem, fmt.Sprintf(format, a...))
+	}
+}
+
+func logDebugf(subsystem string, format string, a ...interface{}) {
+	logf(LOG_DEBUG, subsystem, format, a...)
+}
+
+func logInfof(subsystem string, format string, a ...interface{}) {
+	logf(LOG_INFO, subsystem, format, a...)
+}
+
+func logWarnf(subsystem string, format string, a ...interface{}) {
+	logf(LOG_WARN, subsystem, format, a...)
+}
+
+func logErrorf(subsystem string, format string, a ...interface{}) {
+	logf(LOG_ERROR, subsystem, format, a...)
+}
+
+// Sends the output of the log package to the logger, and the logger to path.
+func initLogging(path string) error {
+	applyLogLevels()
+	log.SetFlags(0)
+	log.SetOutput(logger)
+	return logger.open(path)
+}
+
+type logLevelsStatus struct {
+	Default    string
+	Levels     map[string]string
+	Subsystems []string
+}
+
+func getLogLevels() logLevelsStatus {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	status := logLevelsStatus{Default: logLevelNames[logger.level], Levels: make(map[string]string)}
+	for sub, level := range logger.levels {
+		status.Levels[sub] = logLevelNames[level]
+	}
+	for sub := range logger.subsystems {
+		status.Subsystems = append(status.Subsystems, sub)
+	}
+	sort.Strings(status.Subsystems)
+	return status
+}
+
+// AJAX call - /getLogLevels.
+func handleLogLevelsGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	levelsJSON, err := json.Marshal(getLogLevels())
+	if err != nil {
+		logErrorf("logging", "Error sending log levels JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", levelsJSON)
+}
+
+// AJAX call - /setLogLevel. Persisted in the settings.
+func handleLogLevelSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		Subsystem string
+		Level     string
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub := strings.ToLower(strings.TrimSpace(req.Subsystem))
+	if len(sub) == 0 || len(req.Level) > 0 {
+		if _, err := parseLogLevel(req.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(sub) == 0 {
+		globalSettings.LogLevel = strings.ToLower(req.Level)
+	} else if len(req.Level) == 0 {
+		delete(globalSettings.LogLevels, sub)
+	} else {
+		if globalSettings.LogLevels == nil {
+			globalSettings.LogLevels = make(map[string]string)
+		}
+		globalSettings.LogLevels[sub] = strings.ToLower(req.Level)
+	}
+	applyLogLevels()
+	saveSettings()
+	logInfof("logging", "level of '%s' set to '%s' (%s)", sub, req.Level, r.RemoteAddr)
+	handleLogLevelsGetRequest(w, r)
+}
+
+// Settings as JSON, passwords, keys and tokens blanked.
+func redactedSettings() ([]byte, error) {
+	settingsJSON, err := json.Marshal(&globalSettings)
+	if err != nil {
+		return nil, err
+	}
+	var settings interface{}
+	if err := json.Unmarshal(settingsJSON, &settings); err != nil {
+		return nil, err
+	}
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, val := range v {
+				lower := strings.ToLower(key)
+				if strings.Contains(lower, "password") || strings.Contains(lower, "passphrase") || strings.Contains(lower, "key") ||
+					strings.Contains(lower, "token") || strings.Contains(lower, "secret") {
+					if s, ok := val.(string); !ok || len(s) > 0 {
+						v[key] = "<redacted>"
+						continue
+					}
+				}
+				redact(val)
+			}
+		case []interface{}:
+			for _, val := range v {
+				redact(val)
+			}
+		}
+	}
+	redact(settings)
+	return json.MarshalIndent(settings, "", "  ")
+}
+
+// AJAX call - /downloadSupportBundle.
+func handleSupportBundleRequest(w http.ResponseWriter, r *http.Request) {
+	name := fmt.Sprintf("stratux-support-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename="+name)
+	z := zip.NewWriter(w)
+	defer z.Close()
+
+	addFile := func(name string, data []byte) {
+		if f, err := z.Create(name); err == nil {
+			f.Write(data)
+		}
+	}
+	addJSON := func(name string, v interface{}) {
+		if data, err := json.MarshalIndent(v, "", "  "); err == nil {
+			addFile(name, data)
+		}
+	}
+
+	addFile("version.txt", []byte(fmt.Sprintf("Version: %s\nBuild: %s\nHardware: %s\nUptime: %s\nCreated: %s\n",
+		stratuxVersion, stratuxBuild, globalStatus.HardwareBuild, time.Since(timeStarted).Round(time.Second),
+		time.Now().UTC().Format(time.RFC3339))))
+	if settings, err := redactedSettings(); err == nil {
+		addFile("settings.json", settings)
+	}
+	addJSON("status.json", globalStatus)
+	addJSON("system.json", getSystemHealth(true))
+	addJSON("loglevels.json", getLogLevels())
+	if out, err := exec.Command("dmesg").Output(); err == nil {
+		addFile("dmesg.txt", out)
+	}
+
+	logs, _ := filepath.Glob(debugLogf + "*")
+	for _, fn := range logs {
+		fp, err := os.Open(fn)
+		if err != nil {
+			continue
+		}
+		if f, err := z.Create("logs/" + filepath.Base(fn)); err == nil {
+			io.Copy(f, fp)
+		}
+		fp.Close()
+	}
+	logInfof("logging", "support bundle downloaded by %s", r.RemoteAddr)
+}
@@ -1,9 +1,11 @@
+//go:build !nohw
+// +build !nohw
+
 package main
 
 import (
 	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"time"
 	"unsafe"
@@ -40,17 +42,17 @@ func initUATRadioSerial() error {
 				// Device not connected.
 				continue
 			}
-			log.Printf("===== UAT Device Name  : UATRadio v1.0 =====\n")
+			logInfof("uatradio", "===== UAT Device Name  : UATRadio v1.0 =====")
 
 			// Initialize port at 2Mbaud.
 			radioSerialConfig = &serial.Config{Name: "/dev/uatradio", Baud: 2000000}
 			p, err := serial.OpenPort(radioSerialConfig)
 			if err != nil {
-				log.Printf("\tUAT Open Failed: %s\n", err.Error())
+				logErrorf("uatradio", "\tUAT Open Failed: %s", err.Error())
 				continue
 			}
 
-			log.Printf("\tUATRadio init success.\n")
+			logInfof("uatradio", "\tUATRadio init success.")
 
 			radioSerialPort = p
 			globalStatus.UATRadio_connected = true
@@ -78,7 +80,7 @@ func radioSerialPortReader(serialPort *serial.Port) {
 	for {
 		n, err := serialPort.Read(tmpBuf)
 		if err != nil {
-			log.Printf("serial port err, shutting down radio: %s\n", err.Error())
+			logInfof("uatradio", "serial port err, shutting down radio: %s", err.Error())
 			return
 		}
 		buf = append(buf, tmpBuf[:n]...)
@@ -144,7 +146,7 @@ func processRadioMessage(msg []byte) {
 			toRelay = fmt.Sprintf("-%s;ss=%d;", hex.EncodeToString(to[:34]), rssiDump978)
 		}
 	default:
-		log.Printf("processRadioMessage(): unhandled message size %d\n", len(msg))
+		logInfof("uatradio", "processRadioMessage(): unhandled message size %d", len(msg))
 	}
 
 	if len(toRelay) > 0 && rs_errors != 9999 {
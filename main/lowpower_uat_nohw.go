@@ -0,0 +1,10 @@
+//go:build nohw
+// +build nohw
+
+package main
+
+// The UATRadio needs the dump978 FEC routines, which aren't available in builds without hardware support.
+func initUATRadioSerial() error {
+	logInfof("uatradio", "built without hardware support (nohw), not watching for /dev/uatradio")
+	return nil
+}
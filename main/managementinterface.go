@@ -18,8 +18,8 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -160,19 +160,48 @@ func handleJsonIo(conn *websocket.Conn) {
 	}
 }
 
-// Works just as weather updates do.
+// Starts off with a keyframe of all targets, then sends the changes. See trafficstream.go.
+// /traffic?format=full sends the full target on every update instead, as older versions did.
 
 func handleTrafficWS(conn *websocket.Conn) {
-	trafficMutex.Lock()
-	for _, traf := range traffic {
-		if !traf.Position_valid { // Don't send unless a valid position exists.
+	if conn.Request().URL.Query().Get("format") == "full" {
+		trafficMutex.Lock()
+		for _, traf := range traffic {
+			if !traf.Position_valid { // Don't send unless a valid position exists.
+				continue
+			}
+			trafficJSON, _ := json.Marshal(&traf)
+			conn.Write(trafficJSON)
+		}
+		// Subscribe the socket to receive updates.
+		trafficUpdate.AddSocket(conn)
+		trafficMutex.Unlock()
+	} else {
+		addTrafficStreamSocket(conn)
+	}
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
+	for {
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if buf[0] != 0 { // Dummy.
 			continue
 		}
-		trafficJSON, _ := json.Marshal(&traf)
-		conn.Write(trafficJSON)
+		time.Sleep(1 * time.Second)
 	}
-	// Subscribe the socket to receive updates.
-	trafficUpdate.AddSocket(conn)
+}
+
+// Traffic alert level changes, see trafficalerts.go. Starts off with the currently active alerts.
+func handleAlertsWS(conn *websocket.Conn) {
+	trafficMutex.Lock()
+	for _, alert := range getActiveTrafficAlerts() {
+		alertJSON, _ := json.Marshal(&alert)
+		conn.Write(alertJSON)
+	}
+	alertUpdate.AddSocket(conn)
 	trafficMutex.Unlock()
 
 	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
@@ -195,7 +224,7 @@ func handleRadarWS(conn *websocket.Conn) {
 	radarUpdate.AddSocket(conn)
 	trafficMutex.Unlock()
 
-	radarUpdate.SendJSON(globalSettings);
+	radarUpdate.SendJSON(clientSettings())
 
 	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
 	for {
@@ -223,7 +252,7 @@ func handleStatusWS(conn *websocket.Conn) {
 				if err == io.EOF {
 					break
 				} else if err != nil {
-					log.Printf("handleStatusWS: %s\n", err.Error())
+					logInfof("web", "handleStatusWS: %s", err.Error())
 				} else {
 					// Use 'msg'.
 				}
@@ -256,6 +285,38 @@ func handleSituationWS(conn *websocket.Conn) {
 
 }
 
+// Sends the satellite list (sky view with elevation, azimuth, signal and solution state) once per second.
+func handleSatellitesWS(conn *websocket.Conn) {
+	timer := time.NewTicker(1 * time.Second)
+	defer timer.Stop()
+	// We don't expect anything from the client, a read only fails once it is gone.
+	gone := make(chan struct{})
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(gone)
+				return
+			}
+		}
+	}()
+	for {
+		mySituation.muSatellite.Lock()
+		satellitesJSON, _ := json.Marshal(&Satellites)
+		mySituation.muSatellite.Unlock()
+		_, err := conn.Write(satellitesJSON)
+
+		if err != nil {
+			break
+		}
+		select {
+		case <-timer.C:
+		case <-gone:
+			return
+		}
+	}
+}
+
 // AJAX call - /getStatus. Responds with current global status
 // a webservice call for the same data available on the websocket but when only a single update is needed
 func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
@@ -281,7 +342,7 @@ func handleTowersRequest(w http.ResponseWriter, r *http.Request) {
 	ADSBTowerMutex.Lock()
 	towersJSON, err := json.Marshal(&ADSBTowers)
 	if err != nil {
-		log.Printf("Error sending tower JSON data: %s\n", err.Error())
+		logErrorf("web", "Error sending tower JSON data: %s", err.Error())
 	}
 	// for testing purposes, we can return a fixed reply
 	// towersJSON = []byte(`{"(38.490880,-76.135554)":{"Lat":38.49087953567505,"Lng":-76.13555431365967,"Signal_strength_last_minute":100,"Signal_strength_max":67,"Messages_last_minute":1,"Messages_total":1059},"(38.978698,-76.309276)":{"Lat":38.97869825363159,"Lng":-76.30927562713623,"Signal_strength_last_minute":495,"Signal_strength_max":32,"Messages_last_minute":45,"Messages_total":83},"(39.179285,-76.668413)":{"Lat":39.17928457260132,"Lng":-76.66841268539429,"Signal_strength_last_minute":50,"Signal_strength_max":24,"Messages_last_minute":1,"Messages_total":16},"(39.666309,-74.315300)":{"Lat":39.66630935668945,"Lng":-74.31529998779297,"Signal_strength_last_minute":9884,"Signal_strength_max":35,"Messages_last_minute":4,"Messages_total":134}}`)
@@ -289,6 +350,77 @@ func handleTowersRequest(w http.ResponseWriter, r *http.Request) {
 	ADSBTowerMutex.Unlock()
 }
 
+// AJAX call - /getSDRs. Responds with the connected dongles and their roles, see SDRDongle.
+func handleSDRsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	sdrsJSON, err := json.Marshal(getSDRDongles())
+	if err != nil {
+		logErrorf("web", "Error sending SDR JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", sdrsJSON)
+}
+
+/*
+	handleSpectrumRequest().
+		AJAX call - /getSpectrum?start=<MHz>&stop=<MHz>&bin=<kHz>&gain=<dB>&serial=<dongle>, all optional.
+		Sweeps the band with an idle dongle and responds with a SpectrumScan. Takes a few seconds.
+*/
+func handleSpectrumRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	param := func(name string, def float64) float64 {
+		if v, err := strconv.ParseFloat(r.URL.Query().Get(name), 64); err == nil {
+			return v
+		}
+		return def
+	}
+	scan, err := scanSpectrum(r.URL.Query().Get("serial"), param("start", 960)*1e6, param("stop", 1100)*1e6,
+		param("bin", 50)*1e3, int(param("gain", 40)*10))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("spectrum scan: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+	setJSONHeaders(w)
+	scanJSON, err := json.Marshal(scan)
+	if err != nil {
+		logErrorf("web", "Error sending spectrum JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", scanJSON)
+}
+
+/*
+	handleCalibrateSDRRequest().
+		AJAX call - /calibrateSDR?serial=<dongle> (POST). Starts a GSM scan for the PPM correction of an idle dongle,
+		the outcome shows up in /getSDRs (SDRDongle.Calibration) after a few minutes.
+*/
+func handleCalibrateSDRRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	w.Header().Set("Access-Control-Allow-Method", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	if r.Method != "POST" {
+		return
+	}
+	if err := startPPMCalibration(r.URL.Query().Get("serial")); err != nil {
+		http.Error(w, fmt.Sprintf("PPM calibration: %s", err), http.StatusServiceUnavailable)
+	}
+}
+
+// AJAX call - /getRadioStats?hours=<n> (default 24). Responds with the per band reception statistics, see RadioStatsHistory.
+func handleRadioStatsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	hours, err := strconv.ParseFloat(r.URL.Query().Get("hours"), 64)
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	statsJSON, err := json.Marshal(getRadioStats(time.Duration(hours * float64(time.Hour))))
+	if err != nil {
+		logErrorf("web", "Error sending radio stats JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statsJSON)
+}
+
 // AJAX call - /getSatellites. Responds with all GNSS satellites that are being tracked, along with status information.
 func handleSatellitesRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
@@ -296,19 +428,41 @@ func handleSatellitesRequest(w http.ResponseWriter, r *http.Request) {
 	mySituation.muSatellite.Lock()
 	satellitesJSON, err := json.Marshal(&Satellites)
 	if err != nil {
-		log.Printf("Error sending GNSS satellite JSON data: %s\n", err.Error())
+		logErrorf("web", "Error sending GNSS satellite JSON data: %s", err.Error())
 	}
 	fmt.Fprintf(w, "%s\n", satellitesJSON)
 	mySituation.muSatellite.Unlock()
 }
 
+// Settings as handed to the clients (/getSettings, /api/v1/settings, the websockets), readable by everybody on the
+// WiFi. Of the write-only settings (see secrets.go) and the WiFi client passwords only whether they are set, the
+// API token hashes not at all.
+func clientSettings() map[string]interface{} {
+	var settings map[string]interface{}
+	settingsJSON, _ := json.Marshal(&globalSettings)
+	json.Unmarshal(settingsJSON, &settings)
+	settings["DebugProfPasswordSet"] = len(globalSecrets.DebugProfPasswordHash) > 0
+	settings["MQTTPasswordSet"] = len(globalSecrets.MQTTPassword) > 0
+	if networks, ok := settings["WiFiClientNetworks"].([]interface{}); ok {
+		for _, n := range networks {
+			if network, ok := n.(map[string]interface{}); ok {
+				password, _ := network["Password"].(string)
+				network["PasswordSet"] = len(password) > 0
+				delete(network, "Password") // parseWifiClientNetworks() keeps the stored one
+			}
+		}
+	}
+	delete(settings, "APITokens")
+	return settings
+}
+
 // AJAX call - /getSettings. Responds with all stratux.conf data.
 func handleSettingsGetRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
 	setJSONHeaders(w)
-	settingsJSON, err := json.Marshal(&globalSettings)
+	settingsJSON, err := json.Marshal(clientSettings())
 	if err != nil {
-		log.Printf("%s", err)
+		logInfof("web", "%s", err)
 	}
 	fmt.Fprintf(w, "%s\n", settingsJSON)
 }
@@ -335,10 +489,12 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 			if err == io.EOF {
 				break
 			} else if err != nil {
-				log.Printf("handleSettingsSetRequest:error: %s\n", err.Error())
+				logErrorf("web", "handleSettingsSetRequest:error: %s", err.Error())
 			} else {
 				reconfigureOgnTracker := false
 				reconfigureFancontrol := false
+				reconfigureGNSS := false
+				reconfigureNetworkOutputs := false
 				for key, val := range msg {
 					// log.Printf("handleSettingsSetRequest:json: testing for key:%s of type %s\n", key, reflect.TypeOf(val))
 					switch key {
@@ -372,6 +528,56 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						}
 					case "DEBUG":
 						globalSettings.DEBUG = val.(bool)
+						applyLogLevels()
+					case "DebugProfPassword":
+						setDebugProfPassword(val.(string))
+					case "AutopilotOutput":
+						globalSettings.AutopilotOutput = val.(bool)
+					case "AutopilotEnablePin":
+						globalSettings.AutopilotEnablePin = int(val.(float64))
+					case "AudioAlerts":
+						globalSettings.AudioAlerts = val.(bool)
+					case "AudioDevice":
+						globalSettings.AudioDevice = val.(string)
+					case "AudioAlertLevel":
+						globalSettings.AudioAlertLevel = int(val.(float64))
+					case "AudioVerbosity":
+						globalSettings.AudioVerbosity = int(val.(float64))
+					case "AudioVolume":
+						globalSettings.AudioVolume = int(val.(float64))
+					case "AudioChimes":
+						globalSettings.AudioChimes = val.(bool)
+					case "AudioMutePin":
+						globalSettings.AudioMutePin = int(val.(float64))
+					case "AudioVario":
+						globalSettings.AudioVario = val.(bool)
+					case "AudioVarioDeadBandLow":
+						globalSettings.AudioVarioDeadBandLow = math.Min(val.(float64), 0)
+					case "AudioVarioDeadBandHigh":
+						globalSettings.AudioVarioDeadBandHigh = math.Max(val.(float64), 0)
+					case "OGNDDBAutoUpdate":
+						globalSettings.OGNDDBAutoUpdate = val.(bool)
+					case "OGNDDBShowCN":
+						globalSettings.OGNDDBShowCN = val.(bool)
+					case "APRSUpload":
+						globalSettings.APRSUpload = val.(bool)
+					case "APRSStationName":
+						name := strings.TrimSpace(val.(string))
+						if len(name) > 0 && !aprsStationNameRegex.MatchString(name) {
+							logWarnf("web", "handleSettingsSetRequest:APRSStationName: invalid name %s", name)
+							break
+						}
+						globalSettings.APRSStationName = name
+					case "InternetWeather":
+						globalSettings.InternetWeather = val.(bool)
+					case "InternetWeatherRange":
+						globalSettings.InternetWeatherRange = int(val.(float64))
+					case "WindForecast":
+						globalSettings.WindForecast = val.(bool)
+					case "WindForecastRegion":
+						globalSettings.WindForecastRegion = strings.TrimSpace(val.(string))
+					case "OwnshipShadowFilter":
+						globalSettings.OwnshipShadowFilter = val.(bool)
 					case "DisplayTrafficSource":
 						globalSettings.DisplayTrafficSource = val.(bool)
 					case "ReplayLog":
@@ -379,6 +585,12 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						if v != globalSettings.ReplayLog { // Don't mark the files unless there is a change.
 							globalSettings.ReplayLog = v
 						}
+					case "ReplayLogWriteInterval":
+						if interval := int(val.(float64)); interval >= 1 && interval <= 600 {
+							globalSettings.ReplayLogWriteInterval = interval
+						}
+					case "ReplayLogBufferFlight":
+						globalSettings.ReplayLogBufferFlight = val.(bool)
 					case "AHRSLog":
 						globalSettings.AHRSLog = val.(bool)
 					case "PersistentLogging":
@@ -392,27 +604,138 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						}
 					case "PPM":
 						globalSettings.PPM = int(val.(float64))
+					case "UAT_BiasTee":
+						globalSettings.UAT_BiasTee = val.(bool)
+					case "ES_BiasTee":
+						globalSettings.ES_BiasTee = val.(bool)
+					case "OGN_BiasTee":
+						globalSettings.OGN_BiasTee = val.(bool)
+					case "AIS_BiasTee":
+						globalSettings.AIS_BiasTee = val.(bool)
+					case "SDRAutoGain":
+						globalSettings.SDRAutoGain = val.(bool)
+					case "SDRPPMAutoCal":
+						globalSettings.SDRPPMAutoCal = val.(bool)
+					case "SDRRoles":
+						// Serial -> role, the dongles are reconfigured by sdrWatcher(). Empty role = from the serial tag / automatic.
+						roles := make(map[string]string)
+						for serial, role := range val.(map[string]interface{}) {
+							if r, ok := role.(string); ok && isValidSDRRole(r) {
+								roles[serial] = r
+							}
+						}
+						globalSettings.SDRRoles = roles
+					case "ES_NetInput":
+						addr := strings.TrimSpace(val.(string))
+						if len(addr) > 0 {
+							if _, _, err := net.SplitHostPort(addr); err != nil {
+								logWarnf("web", "handleSettingsSetRequest:%s: invalid address '%s': %s", key, addr, err)
+								continue
+							}
+						}
+						globalSettings.ES_NetInput = addr
+					case "ES_NetInputFormat":
+						if format := val.(string); format == ES_INPUT_FORMAT_BEAST || format == ES_INPUT_FORMAT_AVR {
+							globalSettings.ES_NetInputFormat = format
+						}
+					case "UAT_RemoteSDR", "ES_RemoteSDR":
+						addr := strings.TrimSpace(val.(string))
+						if len(addr) > 0 {
+							if _, _, err := net.SplitHostPort(addr); err != nil {
+								logWarnf("web", "handleSettingsSetRequest:%s: invalid address '%s': %s", key, addr, err)
+								continue
+							}
+						}
+						if key == "UAT_RemoteSDR" {
+							globalSettings.UAT_RemoteSDR = addr
+						} else {
+							globalSettings.ES_RemoteSDR = addr
+						}
 					case "AltitudeOffset":
 						globalSettings.AltitudeOffset = int(val.(float64))
 					case "RadarLimits":
 						globalSettings.RadarLimits = int(val.(float64))
-						radarUpdate.SendJSON(globalSettings)
+						radarUpdate.SendJSON(clientSettings())
 					case "RadarRange":
 						globalSettings.RadarRange = int(val.(float64))
-						radarUpdate.SendJSON(globalSettings)
-					case "Baud":
+						radarUpdate.SendJSON(clientSettings())
+					case "TrafficCoastTime":
+						globalSettings.TrafficCoastTime = int(val.(float64))
+					case "ES_TrafficTimeout":
+						globalSettings.ES_TrafficTimeout = int(val.(float64))
+					case "UAT_TrafficTimeout":
+						globalSettings.UAT_TrafficTimeout = int(val.(float64))
+					case "OGN_TrafficTimeout":
+						globalSettings.OGN_TrafficTimeout = int(val.(float64))
+					case "TrafficMaxTargets":
+						globalSettings.TrafficMaxTargets = int(val.(float64))
+					case "TrafficPrioAltBand":
+						globalSettings.TrafficPrioAltBand = int(val.(float64))
+					case "TrafficPrioAltMax":
+						globalSettings.TrafficPrioAltMax = int(val.(float64))
+					case "TrafficPrioCPATime":
+						globalSettings.TrafficPrioCPATime = int(val.(float64))
+					case "TrafficPrioCritical":
+						globalSettings.TrafficPrioCritical = val.(float64)
+					case "TrafficPrioCriticalDist":
+						globalSettings.TrafficPrioCriticalDist = val.(float64)
+					case "Baud", "NMEASerialBaud":
+						newBaud := int(val.(float64))
+						nmea := key == "NMEASerialBaud" // only the FLARM NMEA outputs, "Baud" is all of them
+						if nmea {
+							globalSettings.NMEASerialBaud = newBaud
+						}
 						if globalSettings.SerialOutputs != nil {
 							for dev, serialOut := range globalSettings.SerialOutputs {
-								newBaud := int(val.(float64))
+								if nmea && serialOut.Capability != NETWORK_FLARM_NMEA {
+									continue
+								}
 								if newBaud == serialOut.Baud { // Same baud rate. No change.
 									continue
 								}
-								log.Printf("changing %s baud rate from %d to %d.\n", dev, serialOut.Baud, newBaud)
+								logInfof("web", "changing %s baud rate from %d to %d.", dev, serialOut.Baud, newBaud)
 								serialOut.Baud = newBaud
 								globalSettings.SerialOutputs[dev] = serialOut
 								closeSerial(dev)
 							}
 						}
+					case "SerialOutputs":
+						// device -> {Baud, Capability, RateLimits}, null removes the device. Reopened with the new configuration.
+						if globalSettings.SerialOutputs == nil {
+							globalSettings.SerialOutputs = make(map[string]serialConnection)
+						}
+						for dev, v := range val.(map[string]interface{}) {
+							dev = strings.TrimSpace(dev)
+							if !strings.HasPrefix(dev, "/dev/") {
+								continue
+							}
+							m, ok := v.(map[string]interface{})
+							if !ok {
+								delete(globalSettings.SerialOutputs, dev)
+								closeSerial(dev)
+								continue
+							}
+							serialOut, exists := globalSettings.SerialOutputs[dev]
+							if !exists {
+								serialOut = serialConnection{DeviceString: dev, Baud: 38400, Capability: NETWORK_GDL90_STANDARD}
+							}
+							if b, ok := m["Baud"].(float64); ok && b > 0 {
+								serialOut.Baud = int(b)
+							}
+							if c, ok := m["Capability"].(float64); ok && c > 0 {
+								serialOut.Capability = uint16(c)
+							}
+							if limits, ok := m["RateLimits"].(map[string]interface{}); ok {
+								serialOut.RateLimits = make(map[string]float64)
+								for class, l := range limits {
+									if l, ok := l.(float64); ok {
+										serialOut.RateLimits[strings.ToUpper(strings.TrimSpace(class))] = l
+									}
+								}
+							}
+							globalSettings.SerialOutputs[dev] = serialOut
+							closeSerial(dev)
+						}
 					case "WatchList":
 						globalSettings.WatchList = val.(string)
 					case "GLimits":
@@ -433,12 +756,19 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 							}
 							hexn, err := hex.DecodeString(vals)
 							if err != nil { // Number not valid.
-								log.Printf("handleSettingsSetRequest:OwnshipModeS: %s\n", err.Error())
+								logInfof("web", "handleSettingsSetRequest:OwnshipModeS: %s", err.Error())
 								continue
 							}
 							codesFinal = append(codesFinal, fmt.Sprintf("%02X%02X%02X", hexn[0], hexn[1], hexn[2]))
 						}
 						globalSettings.OwnshipModeS = strings.Join(codesFinal, ",")
+					case "OwnshipCallsign":
+						callsign, err := parseOwnshipCallsign(val.(string))
+						if err != nil {
+							logInfof("web", "handleSettingsSetRequest:OwnshipCallsign: %s", err.Error())
+							continue
+						}
+						globalSettings.OwnshipCallsign = callsign
 					case "StaticIps":
 						ipsStr := val.(string)
 						ips := strings.Split(ipsStr, " ")
@@ -450,12 +780,12 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 						err := ""
 						for _, ip := range ips {
 							// Verify IP format
-							if !re.MatchString(ip) {
+							if !re.MatchString(ip) && (!strings.Contains(ip, ":") || parseClientIP(ip) == nil) {
 								err = err + "Invalid IP: " + ip + ". "
 							}
 						}
 						if err != "" {
-							log.Printf("handleSettingsSetRequest:StaticIps: %s\n", err)
+							logInfof("web", "handleSettingsSetRequest:StaticIps: %s", err)
 							continue
 						}
 						globalSettings.StaticIps = ips
@@ -476,16 +806,122 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 					case "WiFiDirectPin":
 						setWifiDirectPin(val.(string))
 					case "WiFiClientNetworks":
-						var networks = make([]wifiClientNetwork, 0)
-						for _, rawNetwork := range val.([]interface{}) {
-							network := rawNetwork.(map[string]interface{})
-							networks = append(networks, wifiClientNetwork{network["SSID"].(string), network["Password"].(string)})
-						}
-						setWifiClientNetworks(networks)
+						setWifiClientNetworks(parseWifiClientNetworks(val.([]interface{})))
 					case "WiFiInternetPassThroughEnabled":
 						setWifiInternetPassthroughEnabled(val.(bool))
+					case "NetworkOutputs":
+						outputs := make([]networkConnection, 0)
+						for _, rawOutput := range val.([]interface{}) {
+							output := rawOutput.(map[string]interface{})
+							port := uint32(output["Port"].(float64))
+							if port == 0 || port > 65535 {
+								continue
+							}
+							iface, _ := output["Interface"].(string)
+							broadcast, _ := output["Broadcast"].(bool)
+							outputs = append(outputs, networkConnection{
+								Port: port,
+								Capability: uint16(output["Capability"].(float64)),
+								Interface: strings.TrimSpace(iface),
+								Broadcast: broadcast,
+							})
+						}
+						globalSettings.NetworkOutputs = outputs
+						reconfigureNetworkOutputs = true
+					case "NetworkClients":
+						// ip -> {Name, Manual, Outputs, RateLimits, AHRS}, null removes the client's entry
+						setNetworkClients(val.(map[string]interface{}))
+						reconfigureNetworkOutputs = true
 					case "EstimateBearinglessDist":
 						globalSettings.EstimateBearinglessDist = val.(bool)
+					case "GDL90MSLAlt_Enabled":
+						globalSettings.GDL90MSLAlt_Enabled = val.(bool)
+					case "GDL90PressureAltFromGPS":
+						globalSettings.GDL90PressureAltFromGPS = val.(bool)
+					case "GeoidSource":
+						if src := val.(string); src == GEOID_SOURCE_RECEIVER || src == GEOID_SOURCE_MODEL {
+							globalSettings.GeoidSource = src
+						}
+					case "GeoidModelFile":
+						globalSettings.GeoidModelFile = strings.TrimSpace(val.(string))
+					case "GeoidFallbackSep":
+						globalSettings.GeoidFallbackSep = float32(val.(float64))
+					case "UnitAltitude":
+						if unit := val.(string); isValidUnit(unitsAltitude, unit) {
+							globalSettings.UnitAltitude = unit
+						}
+					case "UnitSpeed":
+						if unit := val.(string); isValidUnit(unitsSpeed, unit) {
+							globalSettings.UnitSpeed = unit
+						}
+					case "UnitPressure":
+						if unit := val.(string); isValidUnit(unitsPressure, unit) {
+							globalSettings.UnitPressure = unit
+						}
+					case "UnitTime":
+						if unit := val.(string); unit == UNIT_TIME_UTC || unit == UNIT_TIME_LOCAL {
+							globalSettings.UnitTime = unit
+						}
+					case "TimeZone":
+						tz := strings.TrimSpace(val.(string))
+						if _, err := time.LoadLocation(tz); err != nil {
+							logInfof("web", "handleSettingsSetRequest:TimeZone: %s", err.Error())
+							continue
+						}
+						globalSettings.TimeZone = tz
+					case "AutoShutdownMinutes":
+						if minutes := int(val.(float64)); minutes >= 0 {
+							globalSettings.AutoShutdownMinutes = minutes
+						}
+					case "AutoShutdownAction":
+						if action := val.(string); action == POWER_ACTION_SHUTDOWN || action == POWER_ACTION_SUSPEND {
+							globalSettings.AutoShutdownAction = action
+						}
+					case "AutoShutdownAt":
+						at := strings.TrimSpace(val.(string))
+						if _, err := time.Parse("15:04", at); len(at) > 0 && err != nil {
+							logInfof("web", "handleSettingsSetRequest:AutoShutdownAt: %s", err.Error())
+							continue
+						}
+						globalSettings.AutoShutdownAt = at
+					case "FlightRecorder_Enabled":
+						globalSettings.FlightRecorder_Enabled = val.(bool)
+					case "FlightRecorderInterval":
+						if interval := int(val.(float64)); interval >= 1 && interval <= 60 {
+							globalSettings.FlightRecorderInterval = interval
+						}
+					case "RFCaptureUAT":
+						globalSettings.RFCaptureUAT = val.(bool)
+					case "RFCaptureES":
+						globalSettings.RFCaptureES = val.(bool)
+					case "RFCaptureOGN":
+						globalSettings.RFCaptureOGN = val.(bool)
+					case "TransponderDevice":
+						globalSettings.TransponderDevice = strings.TrimSpace(val.(string))
+					case "TransponderBaud":
+						if baud := int(val.(float64)); baud > 0 {
+							globalSettings.TransponderBaud = baud
+						}
+					case "TransponderProtocol":
+						if p := val.(string); p == TRANSPONDER_PROTOCOL_UCP || p == TRANSPONDER_PROTOCOL_ICARUS {
+							globalSettings.TransponderProtocol = p
+						}
+					case "DebriefEncounterDistance":
+						if nm := val.(float64); nm >= 0.1 && nm <= 10 {
+							globalSettings.DebriefEncounterDistance = nm
+						}
+					case "DebriefEncounterAltitude":
+						if ft := int(val.(float64)); ft >= 100 && ft <= 5000 {
+							globalSettings.DebriefEncounterAltitude = ft
+						}
+					case "RFCaptureMaxMB":
+						if mb := int(val.(float64)); mb >= 0 {
+							globalSettings.RFCaptureMaxMB = mb
+						}
+					case "RFCaptureMaxAge":
+						if hours := int(val.(float64)); hours >= 0 {
+							globalSettings.RFCaptureMaxAge = hours
+						}
 
 					case "OGNAddrType":
 						globalSettings.OGNAddrType = int(val.(float64))
@@ -505,12 +941,218 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 					case "OGNTxPower":
 						globalSettings.OGNTxPower = int(val.(float64))
 						reconfigureOgnTracker = true
+					case "OGNStealth":
+						globalSettings.OGNStealth = val.(bool)
+						reconfigureOgnTracker = true
+					case "OGNNoTrack":
+						globalSettings.OGNNoTrack = val.(bool)
+						reconfigureOgnTracker = true
+					case "OGNTrackerDevice":
+						globalSettings.OGNTrackerDevice = strings.TrimSpace(val.(string))
+					case "OGNTrackerBaud":
+						if baud := int(val.(float64)); baud > 0 {
+							globalSettings.OGNTrackerBaud = baud
+						}
 					case "PWMDutyMin":
 						globalSettings.PWMDutyMin = int(val.(float64))
 						reconfigureFancontrol = true
+					case "FanControlMode":
+						if mode := val.(string); mode == FAN_MODE_PID || mode == FAN_MODE_CURVE {
+							globalSettings.FanControlMode = mode
+							reconfigureFancontrol = true
+						}
+					case "FanCurve":
+						if curve := parseFanCurve(val); curve != nil {
+							globalSettings.FanCurve = curve
+							reconfigureFancontrol = true
+						}
+					case "FanHysteresis":
+						globalSettings.FanHysteresis = math.Max(0, math.Min(20, val.(float64)))
+						reconfigureFancontrol = true
+					case "FanSpinUpDuty":
+						globalSettings.FanSpinUpDuty = int(math.Max(0, math.Min(100, val.(float64))))
+						reconfigureFancontrol = true
+					case "FanTachPin":
+						globalSettings.FanTachPin = int(math.Max(0, math.Min(27, val.(float64))))
+						reconfigureFancontrol = true
+					case "FanTachPulses":
+						globalSettings.FanTachPulses = int(math.Max(1, math.Min(8, val.(float64))))
+						reconfigureFancontrol = true
+					case "NMEAOutputSentences":
+						sentences := make(map[string]string)
+						for output, sel := range val.(map[string]interface{}) {
+							sentences[output] = strings.ToUpper(strings.Replace(sel.(string), " ", "", -1))
+						}
+						globalSettings.NMEAOutputSentences = sentences
+					case "TrafficOutputFilters":
+						filters := make(map[string]TrafficOutputFilter)
+						for output, f := range val.(map[string]interface{}) {
+							var filter TrafficOutputFilter
+							m, _ := f.(map[string]interface{})
+							if v, ok := m["MaxDistance"].(float64); ok {
+								filter.MaxDistance = v
+							}
+							if v, ok := m["MaxAltDiff"].(float64); ok {
+								filter.MaxAltDiff = int(v)
+							}
+							if filter.MaxDistance > 0 || filter.MaxAltDiff > 0 {
+								filters[strings.TrimSpace(output)] = filter
+							}
+						}
+						globalSettings.TrafficOutputFilters = filters
+					case "UplinkOutputFilters":
+						filters := make(map[string]string)
+						for output, sel := range val.(map[string]interface{}) {
+							filters[strings.TrimSpace(output)] = strings.ToUpper(strings.Replace(sel.(string), " ", "", -1))
+						}
+						globalSettings.UplinkOutputFilters = filters
+					case "TrafficCategoryRules":
+						rules := make([]TrafficCategoryRule, 0)
+						for _, r := range val.([]interface{}) {
+							var rule TrafficCategoryRule
+							m, _ := r.(map[string]interface{})
+							cats, _ := m["Categories"].([]interface{})
+							for _, c := range cats {
+								if v, ok := c.(float64); ok && v >= 0 && v < 40 {
+									rule.Categories = append(rule.Categories, uint8(v))
+								}
+							}
+							rule.Action, _ = m["Action"].(string)
+							if v, ok := m["MinAlt"].(float64); ok {
+								rule.MinAlt = int(v)
+							}
+							if v, ok := m["MaxAlt"].(float64); ok {
+								rule.MaxAlt = int(v)
+							}
+							switch rule.Action {
+							case "hide", "highlight", "alert":
+								if len(rule.Categories) > 0 {
+									rules = append(rules, rule)
+								}
+							default:
+								logWarnf("web", "TrafficCategoryRules: invalid action '%s'", rule.Action)
+							}
+						}
+						globalSettings.TrafficCategoryRules = rules
+					case "NMEACustomSentences":
+						templates := make([]string, 0)
+						for _, t := range val.([]interface{}) {
+							if str := strings.TrimSpace(t.(string)); len(str) > 0 {
+								templates = append(templates, str)
+							}
+						}
+						removeSingleSystemError("nmea-template")
+						globalSettings.NMEACustomSentences = templates
+					case "GDL90TCPPort":
+						globalSettings.GDL90TCPPort = int(val.(float64))
+					case "FLARMNMEAPort":
+						globalSettings.FLARMNMEAPort = int(val.(float64))
+					case "GPSPassthroughTCPPort":
+						globalSettings.GPSPassthroughTCPPort = int(val.(float64))
+					case "BeastOutputPort":
+						globalSettings.BeastOutputPort = int(val.(float64))
+					case "UATRawOutputPort":
+						globalSettings.UATRawOutputPort = int(val.(float64))
+					case "SBSOutputPort":
+						globalSettings.SBSOutputPort = int(val.(float64))
+					case "MDNSEnabled":
+						globalSettings.MDNSEnabled = val.(bool)
+					case "ForeFlightAnnounce":
+						globalSettings.ForeFlightAnnounce = val.(bool)
+					case "ForeFlightName":
+						if name := strings.TrimSpace(val.(string)); len(name) > 0 && len(name) <= FF_SHORT_NAME_LEN {
+							globalSettings.ForeFlightName = name
+						} else {
+							logInfof("web", "handleSettingsSetRequest:ForeFlightName: '%s' must be 1-%d characters", val.(string), FF_SHORT_NAME_LEN)
+						}
+					case "ForeFlightInternetPolicy":
+						if policy := int(val.(float64)); policy >= FF_INTERNET_UNRESTRICTED && policy <= FF_INTERNET_DISALLOWED {
+							globalSettings.ForeFlightInternetPolicy = policy
+						} else {
+							logWarnf("web", "handleSettingsSetRequest:ForeFlightInternetPolicy: invalid value %d", policy)
+						}
+					case "WireGuardEnabled":
+						globalSettings.WireGuardEnabled = val.(bool)
+					case "WireGuardAddress":
+						if _, _, err := net.ParseCIDR(strings.TrimSpace(val.(string))); err == nil {
+							globalSettings.WireGuardAddress = strings.TrimSpace(val.(string))
+						} else {
+							logInfof("web", "handleSettingsSetRequest:WireGuardAddress: %s", err.Error())
+						}
+					case "WireGuardListenPort":
+						globalSettings.WireGuardListenPort = int(val.(float64))
+					case "WireGuardPeers":
+						globalSettings.WireGuardPeers = parseWireGuardPeers(val.([]interface{}))
+					case "MQTTEnabled":
+						globalSettings.MQTTEnabled = val.(bool)
+					case "MQTTBroker":
+						globalSettings.MQTTBroker = strings.TrimSpace(val.(string))
+					case "MQTTClientID":
+						globalSettings.MQTTClientID = strings.TrimSpace(val.(string))
+					case "MQTTUsername":
+						globalSettings.MQTTUsername = val.(string)
+					case "MQTTPassword":
+						globalSecrets.MQTTPassword = val.(string)
+						saveSecrets()
+					case "MQTTTopicPrefix":
+						if prefix := strings.Trim(strings.TrimSpace(val.(string)), "/"); len(prefix) > 0 {
+							globalSettings.MQTTTopicPrefix = prefix
+						}
+					case "MQTTQoS":
+						globalSettings.MQTTQoS = int(val.(float64))
+					case "MQTTTLSInsecure":
+						globalSettings.MQTTTLSInsecure = val.(bool)
+					case "MQTTIntervals":
+						setMQTTIntervals(val.(map[string]interface{}))
+					case "BluetoothEnabled":
+						globalSettings.BluetoothEnabled = val.(bool)
+					case "BluetoothName":
+						if name := strings.TrimSpace(val.(string)); len(name) > 0 {
+							globalSettings.BluetoothName = name
+						}
+					case "BluetoothBLEOutput":
+						globalSettings.BluetoothBLEOutput = uint16(val.(float64))
+					case "BluetoothSPPOutput":
+						globalSettings.BluetoothSPPOutput = uint16(val.(float64))
+					case "ASTERIXOutputPort":
+						setASTERIXOutputPort(uint32(val.(float64)))
+						reconfigureNetworkOutputs = true
+					case "GNSS_GPS":
+						globalSettings.GNSS_GPS = val.(bool)
+						reconfigureGNSS = true
+					case "GNSS_GLONASS":
+						globalSettings.GNSS_GLONASS = val.(bool)
+						reconfigureGNSS = true
+					case "GNSS_Galileo":
+						globalSettings.GNSS_Galileo = val.(bool)
+						reconfigureGNSS = true
+					case "GNSS_BeiDou":
+						globalSettings.GNSS_BeiDou = val.(bool)
+						reconfigureGNSS = true
+					case "GNSS_SBAS":
+						globalSettings.GNSS_SBAS = val.(bool)
+						reconfigureGNSS = true
+					case "GPSMovingBase":
+						globalSettings.GPSMovingBase = val.(bool)
+						reconfigureGNSS = true
+					case "GPSMovingBaseHeadingOffset":
+						globalSettings.GPSMovingBaseHeadingOffset = float32(val.(float64))
+					case "GNSS_NavRate":
+						if rate := int(val.(float64)); rate >= 1 && rate <= 10 {
+							globalSettings.GNSS_NavRate = rate
+							reconfigureGNSS = true
+						}
+					case "CabinAltitudeAlerts":
+						thresholds := make([]int, 0)
+						for _, t := range val.([]interface{}) {
+							if ft := int(t.(float64)); ft > 0 {
+								thresholds = append(thresholds, ft)
+							}
+						}
+						globalSettings.CabinAltitudeAlerts = thresholds
 
 					default:
-						log.Printf("handleSettingsSetRequest:json: unrecognized key:%s\n", key)
+						logInfof("web", "handleSettingsSetRequest:json: unrecognized key:%s", key)
 					}
 				}
 				saveSettings()
@@ -521,11 +1163,17 @@ func handleSettingsSetRequest(w http.ResponseWriter, r *http.Request) {
 				if reconfigureFancontrol {
 					exec.Command("killall", "-SIGUSR1", "fancontrol").Run();
 				}
+				if reconfigureGNSS && isUbloxGPS() {
+					resetGPSConnection() // the GNSS configuration is written on (re)connect
+				}
+				if reconfigureNetworkOutputs {
+					go resetNetworkOutputs()
+				}
 			}
 		}
 
 		// while it may be redundant, we return the latest settings
-		settingsJSON, _ := json.Marshal(&globalSettings)
+		settingsJSON, _ := json.Marshal(clientSettings())
 		fmt.Fprintf(w, "%s\n", settingsJSON)
 	}
 }
@@ -540,6 +1188,10 @@ func setPersistentLogging(persistent bool) {
 
 
 func handleShutdownRequest(w http.ResponseWriter, r *http.Request) {
+	doShutdown()
+}
+
+func doShutdown() {
 	syscall.Sync()
 	exec.Command("systemctl", "poweroff").Run()
 }
@@ -550,7 +1202,7 @@ func doReboot() {
 }
 
 func handleDeleteLogFile(w http.ResponseWriter, r *http.Request) {
-	log.Println("handleDeleteLogFile called!!!")
+	logInfof("web", "handleDeleteLogFile called!!!")
 	clearDebugLogFile()
 }
 
@@ -566,23 +1218,34 @@ func handleDeleteAHRSLogFiles(w http.ResponseWriter, r *http.Request) {
 		fn = f.Name()
 		if v, _ := filepath.Match("sensors_*.csv", fn); v {
 			os.Remove("/var/log/" + fn)
-			log.Printf("Deleting AHRS log file %s\n", fn)
+			logInfof("web", "Deleting AHRS log file %s", fn)
 		}
 		analysisLogger = nil
 	}
 }
 
 func handleDevelModeToggle(w http.ResponseWriter, r *http.Request) {
-	log.Printf("handleDevelModeToggle called!!!\n")
+	logInfof("web", "handleDevelModeToggle called!!!")
 	globalSettings.DeveloperMode = true
 	saveSettings()
 }
 
 func handleRestartRequest(w http.ResponseWriter, r *http.Request) {
-	log.Printf("handleRestartRequest called\n")
+	logInfof("web", "handleRestartRequest called")
 	go doRestartApp()
 }
 
+// Plays a test announcement on the configured audio output, see audio.go.
+func handleAudioTestRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	w.Header().Set("Access-Control-Allow-Method", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Origin, X-Requested-With, Content-Type, Accept")
+	if r.Method == "POST" {
+		go playAnnouncement("traffic, twelve o'clock, same altitude, two miles", TRAFFIC_ALERT_CAUTION)
+	}
+}
+
 func handleRebootRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
 	setJSONHeaders(w)
@@ -608,7 +1271,7 @@ func handleOrientAHRS(w http.ResponseWriter, r *http.Request) {
 		)
 
 		if _, err = r.Body.Read(action); err != nil {
-			log.Println("AHRS Error: handleOrientAHRS received invalid request")
+			logWarnf("web", "AHRS Error: handleOrientAHRS received invalid request")
 			http.Error(w, "orientation received invalid request", http.StatusBadRequest)
 		}
 
@@ -616,11 +1279,11 @@ func handleOrientAHRS(w http.ResponseWriter, r *http.Request) {
 		case 'f': // Set sensor "forward" direction (toward nose of airplane).
 			f, err := getMinAccelDirection()
 			if err != nil {
-				log.Printf("AHRS Error: sensor orientation: couldn't read accelerometer: %s\n", err)
+				logErrorf("web", "AHRS Error: sensor orientation: couldn't read accelerometer: %s", err)
 				http.Error(w, fmt.Sprintf("couldn't read accelerometer: %s\n", err), http.StatusBadRequest)
 				return
 			}
-			log.Printf("AHRS Info: sensor orientation success! forward axis is %d\n", f)
+			logInfof("web", "AHRS Info: sensor orientation success! forward axis is %d", f)
 			globalSettings.IMUMapping = [2]int{f, 0}
 		case 'd': // Set sensor "up" direction (toward top of airplane).
 			globalSettings.SensorQuaternion = [4]float64{0, 0, 0, 0}
@@ -683,9 +1346,9 @@ func doRestartApp() {
 	syscall.Sync()
 	out, err := exec.Command("/bin/systemctl", "restart", "stratux").Output()
 	if err != nil {
-		log.Printf("restart error: %s\n%s", err.Error(), out)
+		logErrorf("web", "restart error: %s\n%s", err.Error(), out)
 	} else {
-		log.Printf("restart: %s\n", out)
+		logInfof("web", "restart: %s", out)
 	}
 }
 
@@ -770,16 +1433,17 @@ func handleDownloadDBRequest(w http.ResponseWriter, r *http.Request) {
 func handleUpdatePostRequest(w http.ResponseWriter, r *http.Request) {
 	setNoCache(w)
 	setJSONHeaders(w)
-	overlayctl("unlock")
 	reader, err := r.MultipartReader()
 	if err != nil {
-		log.Printf("Update failed from %s (%s).\n", r.RemoteAddr, err.Error())
+		logErrorf("web", "Update failed from %s (%s).", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	for {
 		part, err := reader.NextPart();
 		if err != nil {
-			log.Printf("Update failed from %s (%s).\n", r.RemoteAddr, err.Error())
+			logErrorf("web", "Update failed from %s (%s).", r.RemoteAddr, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 		if part == nil {
@@ -790,27 +1454,13 @@ func handleUpdatePostRequest(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		fi, err := os.OpenFile("/overlay/robase/root/TMP_update-stratux-v.sh", os.O_WRONLY | os.O_CREATE | os.O_TRUNC, 0666)
-		if err != nil {
-			log.Printf("Update failed from %s (%s).\n", r.RemoteAddr, err.Error())
-			return
-		}
-		defer fi.Close()
-		_, err = io.Copy(fi, part)
-		if err != nil {
-			log.Printf("Update failed from %s (%s).\n", r.RemoteAddr, err.Error())
-			return
+		// Signed bundle, or a plain update script as long as there are no trusted keys. See updatemanager.go
+		if err := installUpdate(part, strings.HasSuffix(part.FileName(), ".sh"), r.RemoteAddr); err != nil {
+			logErrorf("web", "Update failed from %s (%s).", r.RemoteAddr, err.Error())
+			http.Error(w, err.Error(), http.StatusBadRequest)
 		}
-
-		break
+		return
 	}
-
-	
-	os.Rename("/overlay/robase/root/TMP_update-stratux-v.sh", "/overlay/robase/root/update-stratux-v.sh")
-	log.Printf("%s uploaded %s for update.\n", r.RemoteAddr, "/overlay/robase/root/update-stratux-v.sh")
-	overlayctl("disable")
-	// Successful update upload. Now reboot.
-	go delayReboot()
 }
 
 func setNoCache(w http.ResponseWriter) {
@@ -924,7 +1574,7 @@ func viewLogs(w http.ResponseWriter, r *http.Request) {
 
 	err = tpl.Execute(w, data)
 	if err != nil {
-		log.Printf("viewLogs() error: %s\n", err.Error())
+		logErrorf("web", "viewLogs() error: %s", err.Error())
 	}
 
 }
@@ -936,7 +1586,7 @@ func connectMbTilesArchive(path string) (*sql.DB, map[string]string, error) {
 		if !conn.IsOutdated() {
 			return conn.Conn, conn.Metadata, nil
 		}
-		log.Printf("Reloading MBTiles " + path)
+		logInfof("web", "Reloading MBTiles %s", path)
 	}
 
 	conn, err := sql.Open("sqlite3", "file:" + path + "?mode=ro")
@@ -965,7 +1615,7 @@ func readMbTilesMetadata(fname string, db *sql.DB) map[string]string {
 		UNION SELECT 'minzoom', min(zoom_level) FROM tiles WHERE NOT EXISTS (SELECT * FROM metadata WHERE name='minzoom' and value is not null and value != '')
 		UNION SELECT 'maxzoom', max(zoom_level) FROM tiles WHERE NOT EXISTS (SELECT * FROM metadata WHERE name='maxzoom' and value is not null and value != '')`);
 	if err != nil {
-		log.Printf("SQLite read error %s: %s", fname, err.Error())
+		logErrorf("web", "SQLite read error %s: %s", fname, err.Error())
 		return nil
 	}
 	defer rows.Close()
@@ -983,7 +1633,7 @@ func readMbTilesMetadata(fname string, db *sql.DB) map[string]string {
 		maxZoomInt, _ := strconv.ParseInt(meta["maxzoom"], 10, 32)
 		rows, err = db.Query("SELECT min(tile_column), min(tile_row), max(tile_column), max(tile_row) FROM tiles WHERE zoom_level=?", maxZoomInt)
 		if err != nil {
-			log.Printf("SQLite read error %s: %s", fname, err.Error())
+			logErrorf("web", "SQLite read error %s: %s", fname, err.Error())
 			return nil
 		}
 		rows.Next()
@@ -1010,7 +1660,7 @@ func readMbTilesMetadata(fname string, db *sql.DB) map[string]string {
 func handleTilesets(w http.ResponseWriter, r *http.Request) {
 	files, err := ioutil.ReadDir(STRATUX_HOME + "/mapdata/");
 	if err != nil {
-		log.Printf("handleTilesets() error: %s\n", err.Error())
+		logErrorf("web", "handleTilesets() error: %s", err.Error())
 		http.Error(w, err.Error(), 500)
 	}
 	result := make(map[string]map[string]string, 0)
@@ -1021,7 +1671,7 @@ func handleTilesets(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(f.Name(), ".mbtiles") || strings.HasSuffix(f.Name(), ".db") {
 			_, meta, err := connectMbTilesArchive(STRATUX_HOME + "/mapdata/" + f.Name())
 			if err != nil {
-				log.Printf("SQLite open " + f.Name() + " failed: %s", err.Error())
+				logErrorf("web", "SQLite open %s failed: %s", f.Name(), err.Error())
 				continue
 			}
 			result[f.Name()] = meta
@@ -1038,7 +1688,7 @@ func loadTile(fname string, z, x, y int) ([]byte, error) {
 	}
 	rows, err := db.Query("SELECT tile_data FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?", z, x, y)
 	if err != nil {
-		log.Printf("Failed to query mbtiles: %s", err.Error())
+		logErrorf("web", "Failed to query mbtiles: %s", err.Error())
 		return nil, nil
 	}
 	
@@ -1052,7 +1702,7 @@ func loadTile(fname string, z, x, y int) ([]byte, error) {
 			gzreader, _ := gzip.NewReader(reader)
 			unzipped, err := ioutil.ReadAll(gzreader)
 			if err != nil {
-				log.Printf("Failed to unzip gzipped PBF data")
+				logErrorf("web", "Failed to unzip gzipped PBF data")
 				return nil, nil
 			}
 			res = unzipped
@@ -1092,10 +1742,16 @@ func handleTile(w http.ResponseWriter, r *http.Request) {
 func managementInterface() {
 	weatherUpdate = NewUIBroadcaster()
 	trafficUpdate = NewUIBroadcaster()
+	trafficStreamUpdate = NewUIBroadcaster()
+	go trafficStreamSender()
 	radarUpdate = NewUIBroadcaster()
+	alertUpdate = NewUIBroadcaster()
 	situationUpdate = NewUIBroadcaster()
 	weatherRawUpdate = NewUIBroadcaster()
+	wxReportUpdate = NewUIBroadcaster()
+	tfrAlertUpdate = NewUIBroadcaster()
 	gdl90Update = NewUIBroadcaster()
+	systemAlertUpdate = NewUIBroadcaster()
 
 	http.HandleFunc("/", defaultServer)
 	http.Handle("/logs/", http.StripPrefix("/logs/", http.FileServer(http.Dir("/var/log"))))
@@ -1120,12 +1776,30 @@ func managementInterface() {
 				Handler: websocket.Handler(handleSituationWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/satellites",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleSatellitesWS)}
+			s.ServeHTTP(w, req)
+		})
 	http.HandleFunc("/weather",
 		func(w http.ResponseWriter, req *http.Request) {
 			s := websocket.Server{
 				Handler: websocket.Handler(handleWeatherWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/wxreports",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleWxReportsWS)}
+			s.ServeHTTP(w, req)
+		})
+	http.HandleFunc("/tfralerts",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleTFRAlertsWS)}
+			s.ServeHTTP(w, req)
+		})
 	http.HandleFunc("/traffic",
 		func(w http.ResponseWriter, req *http.Request) {
 			s := websocket.Server{
@@ -1138,6 +1812,18 @@ func managementInterface() {
 				Handler: websocket.Handler(handleRadarWS)}
 			s.ServeHTTP(w, req)
 		})
+	http.HandleFunc("/alerts",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleAlertsWS)}
+			s.ServeHTTP(w, req)
+		})
+	http.HandleFunc("/systemalerts",
+		func(w http.ResponseWriter, req *http.Request) {
+			s := websocket.Server{
+				Handler: websocket.Handler(handleSystemAlertsWS)}
+			s.ServeHTTP(w, req)
+		})
 
 
 	http.HandleFunc("/jsonio",
@@ -1147,30 +1833,96 @@ func managementInterface() {
 			s.ServeHTTP(w, req)
 		})
 
+	http.HandleFunc(API_PREFIX, handleAPIRequest)
+	http.HandleFunc(API_PREFIX+"/", handleAPIRequest)
 	http.HandleFunc("/getStatus", handleStatusRequest)
 	http.HandleFunc("/getSituation", handleSituationRequest)
+	http.HandleFunc("/status/system", handleSystemHealthRequest)
+	http.Handle("/metrics", handleMetricsRequest)
+	http.HandleFunc("/getAlerts", handleAlertsGetRequest)
+	http.HandleFunc("/ackAlert", legacyEndpoint(handleAlertAckRequest))
+	http.HandleFunc("/getUnits", handleUnitsRequest)
+	http.HandleFunc("/getPower", handlePowerGetRequest)
+	http.HandleFunc("/setPower", legacyEndpoint(handlePowerSetRequest))
+	http.HandleFunc("/getSetupWizard", handleSetupWizardGetRequest)
+	http.HandleFunc("/setSetupWizard", legacyEndpoint(handleSetupWizardSetRequest))
 	http.HandleFunc("/getTowers", handleTowersRequest)
+	http.HandleFunc("/getFISBStatus", handleFISBStatusRequest)
+	http.HandleFunc("/getWeatherReports", handleWeatherReportsRequest)
+	http.HandleFunc("/getWindsAloft", handleWindsAloftRequest)
+	http.HandleFunc("/getNotams", handleNotamsRequest)
+	http.HandleFunc("/getWxAdvisories", handleWxAdvisoriesRequest)
 	http.HandleFunc("/getSatellites", handleSatellitesRequest)
+	http.HandleFunc("/getSDRs", handleSDRsRequest)
+	http.HandleFunc("/getSpectrum", handleSpectrumRequest)
+	http.HandleFunc("/calibrateSDR", legacyEndpoint(handleCalibrateSDRRequest))
+	http.HandleFunc("/getRadioStats", handleRadioStatsRequest)
+	http.HandleFunc("/getTrafficEncounters", handleTrafficEncountersRequest)
+	http.HandleFunc("/getTrafficContacts", handleTrafficContactsRequest)
+	http.HandleFunc("/getTrafficSessions", handleTrafficSessionsRequest)
+	http.HandleFunc("/getOwnshipSuppressed", handleOwnshipSuppressedRequest)
+	http.HandleFunc("/getOgnDDB", handleOgnDDBGetRequest)
+	http.HandleFunc("/getInternetWeather", handleInternetWeatherRequest)
+	http.HandleFunc("/getWindForecast", handleWindForecastGetRequest)
+	http.HandleFunc("/updateWindForecast", legacyEndpoint(handleWindForecastUpdateRequest))
+	http.HandleFunc("/windforecast.json", handleWindForecastDataRequest)
+	http.HandleFunc("/windforecast.csv", handleWindForecastDataRequest)
+	http.HandleFunc("/getWireGuard", handleWireGuardGetRequest)
+	http.HandleFunc("/setWireGuard", legacyEndpoint(handleWireGuardSetRequest))
+	http.HandleFunc("/getMQTT", handleMQTTGetRequest)
+	http.HandleFunc("/getBluetooth", handleBluetoothGetRequest)
+	http.HandleFunc("/setBluetooth", legacyEndpoint(handleBluetoothSetRequest))
+	http.HandleFunc("/uploadOgnDDB", legacyEndpoint(handleOgnDDBUploadRequest))
+	http.HandleFunc("/getTrafficSimulation", handleTrafficSimulationGetRequest)
+	http.HandleFunc("/setTrafficSimulation", legacyEndpoint(handleTrafficSimulationSetRequest))
+	http.HandleFunc("/getFlights", handleFlightsRequest)
+	http.HandleFunc("/downloadFlight", handleFlightDownloadRequest)
+	http.HandleFunc("/deleteFlight", legacyEndpoint(handleFlightDeleteRequest))
+	http.HandleFunc("/getDebrief", handleDebriefRequest)
+	http.HandleFunc("/getTransponder", handleTransponderGetRequest)
+	http.HandleFunc("/getADSBOut", handleADSBOutGetRequest)
+	http.HandleFunc("/getThermal", handleThermalGetRequest)
+	http.HandleFunc("/getI2CScan", handleI2CScanRequest)
+	http.HandleFunc("/resetADSBOut", legacyEndpoint(handleADSBOutResetRequest))
+	http.HandleFunc("/getRFCapture", handleRFCaptureGetRequest)
+	http.HandleFunc("/downloadRFCapture", handleRFCaptureDownloadRequest)
+	http.HandleFunc("/deleteRFCapture", legacyEndpoint(handleRFCaptureDeleteRequest))
+	http.HandleFunc("/getFlightReplay", handleFlightReplayGetRequest)
+	http.HandleFunc("/setFlightReplay", legacyEndpoint(handleFlightReplaySetRequest))
 	http.HandleFunc("/getSettings", handleSettingsGetRequest)
-	http.HandleFunc("/setSettings", handleSettingsSetRequest)
-	http.HandleFunc("/restart", handleRestartRequest)
-	http.HandleFunc("/shutdown", handleShutdownRequest)
-	http.HandleFunc("/reboot", handleRebootRequest)
+	http.HandleFunc("/setSettings", legacyEndpoint(handleSettingsSetRequest))
+	http.HandleFunc("/restart", legacyEndpoint(handleRestartRequest))
+	http.HandleFunc("/testAudio", legacyEndpoint(handleAudioTestRequest))
+	http.HandleFunc("/shutdown", legacyEndpoint(handleShutdownRequest))
+	http.HandleFunc("/reboot", legacyEndpoint(handleRebootRequest))
 	http.HandleFunc("/getClients", handleClientsGetRequest)
-	http.HandleFunc("/updateUpload", handleUpdatePostRequest)
-	http.HandleFunc("/roPartitionRebuild", handleroPartitionRebuild)
-	http.HandleFunc("/develmodetoggle", handleDevelModeToggle)
-	http.HandleFunc("/orientAHRS", handleOrientAHRS)
-	http.HandleFunc("/calibrateAHRS", handleCalibrateAHRS)
-	http.HandleFunc("/cageAHRS", handleCageAHRS)
-	http.HandleFunc("/resetGMeter", handleResetGMeter)
-	http.HandleFunc("/deletelogfile", handleDeleteLogFile)
+	http.HandleFunc("/getNetworkClients", handleNetworkClientsGetRequest)
+	http.HandleFunc("/getOutputProfiles", handleOutputProfilesGetRequest)
+	http.HandleFunc("/getWiFiStatus", handleWiFiStatusGetRequest)
+	http.HandleFunc("/updateUpload", legacyEndpoint(handleUpdatePostRequest))
+	http.HandleFunc("/getUpdate", handleUpdateGetRequest)
+	http.HandleFunc("/setUpdate", legacyEndpoint(handleUpdateSetRequest))
+	http.HandleFunc("/roPartitionRebuild", legacyEndpoint(handleroPartitionRebuild))
+	http.HandleFunc("/develmodetoggle", legacyEndpoint(handleDevelModeToggle))
+	http.HandleFunc("/orientAHRS", legacyEndpoint(handleOrientAHRS))
+	http.HandleFunc("/calibrateAHRS", legacyEndpoint(handleCalibrateAHRS))
+	http.HandleFunc("/cageAHRS", legacyEndpoint(handleCageAHRS))
+	http.HandleFunc("/resetGMeter", legacyEndpoint(handleResetGMeter))
+	http.HandleFunc("/deletelogfile", legacyEndpoint(handleDeleteLogFile))
 	http.HandleFunc("/downloadlog", handleDownloadLogRequest)
-	http.HandleFunc("/deleteahrslogfiles", handleDeleteAHRSLogFiles)
+	http.HandleFunc("/downloadSupportBundle", handleSupportBundleRequest)
+	http.HandleFunc("/getLogLevels", handleLogLevelsGetRequest)
+	http.HandleFunc("/setLogLevel", legacyEndpoint(handleLogLevelSetRequest))
+	http.HandleFunc("/deleteahrslogfiles", legacyEndpoint(handleDeleteAHRSLogFiles))
 	http.HandleFunc("/downloadahrslogs", handleDownloadAHRSLogsRequest)
 	http.HandleFunc("/downloaddb", handleDownloadDBRequest)
+	http.HandleFunc("/usbexporttoggle", legacyEndpoint(handleUSBExportToggle))
+	http.HandleFunc("/debug/pprof/", handleDebugProfRequest)
 	http.HandleFunc("/tiles/tilesets", handleTilesets)
 	http.HandleFunc("/tiles/", handleTile)
+	http.HandleFunc("/nexrad/", handleNexradRequest)
+	http.HandleFunc("/lightning/", handleLightningTileRequest)
+	http.HandleFunc("/getLightning", handleLightningRequest)
 
 	usr, _ := user.Current()
 	addr := managementAddr
@@ -1180,6 +1932,6 @@ func managementInterface() {
 	err := http.ListenAndServe(addr, nil)
 
 	if err != nil {
-		log.Printf("managementInterface ListenAndServe: %s\n", err.Error())
+		logInfof("web", "managementInterface ListenAndServe: %s", err.Error())
 	}
 }
@@ -0,0 +1,543 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mdns.go: mDNS/DNS-SD (zeroconf) advertisement of the outputs, so apps find stratux on any network without assuming
+		192.168.10.1. Services (instance "Stratux", host "<hostname>.local"):
+			_gdl90._udp / _gdl90._tcp               UDP GDL90 outputs (globalSettings.NetworkOutputs) / GDL90TCPPort
+			_flarm-nmea._udp / _flarm-nmea._tcp     UDP FLARM NMEA outputs / FLARMNMEAPort
+			_http._tcp                              web UI
+			_stratux-replay._tcp                    flight replay API of the web server (/getFlightReplay, /setFlightReplay)
+		Answers queries over IPv4 and IPv6 on every interface with its own addresses (A and AAAA) and announces the
+		services when they change (goodbye with TTL 0 for removed ones). Shares the port with avahi (SO_REUSEADDR) if
+		that runs too.
+		Enabled by globalSettings.MDNSEnabled.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	MDNS_PORT           = 5353
+	MDNS_CHECK_INTERVAL = 10 * time.Second
+	MDNS_HOST_TTL       = 120  // s, A/AAAA records
+	MDNS_SERVICE_TTL    = 4500 // s, PTR/SRV/TXT
+	MDNS_INSTANCE       = "Stratux"
+	MDNS_SERVICES_NAME  = "_services._dns-sd._udp.local."
+
+	dnsClassCacheFlush = 0x8000 // unique records in responses
+	dnsClassUnicast    = 0x8000 // unicast response requested in questions
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: MDNS_PORT}
+var mdnsGroup6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: MDNS_PORT}
+
+// mDNS socket of one IP version, the ipv4/ipv6 packet connections with the interface of the packets.
+type mdnsConn interface {
+	ReadFrom(b []byte) (n int, ifIndex int, src net.Addr, err error)
+	WriteTo(b []byte, ifIndex int, dst net.Addr) error
+	JoinGroup(iface *net.Interface) error
+	Group() *net.UDPAddr
+	IPv6() bool
+}
+
+type mdnsConn4 struct {
+	p *ipv4.PacketConn
+}
+
+func (c mdnsConn4) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.p.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c mdnsConn4) WriteTo(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.p.WriteTo(b, &ipv4.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+func (c mdnsConn4) JoinGroup(iface *net.Interface) error { return c.p.JoinGroup(iface, mdnsGroup) }
+func (c mdnsConn4) Group() *net.UDPAddr                  { return mdnsGroup }
+func (c mdnsConn4) IPv6() bool                           { return false }
+
+type mdnsConn6 struct {
+	p *ipv6.PacketConn
+}
+
+func (c mdnsConn6) ReadFrom(b []byte) (int, int, net.Addr, error) {
+	n, cm, src, err := c.p.ReadFrom(b)
+	if cm == nil {
+		return n, 0, src, err
+	}
+	return n, cm.IfIndex, src, err
+}
+
+func (c mdnsConn6) WriteTo(b []byte, ifIndex int, dst net.Addr) error {
+	_, err := c.p.WriteTo(b, &ipv6.ControlMessage{IfIndex: ifIndex}, dst)
+	return err
+}
+
+func (c mdnsConn6) JoinGroup(iface *net.Interface) error { return c.p.JoinGroup(iface, mdnsGroup6) }
+func (c mdnsConn6) Group() *net.UDPAddr                  { return mdnsGroup6 }
+func (c mdnsConn6) IPv6() bool                           { return true }
+
+type mdnsService struct {
+	Type     string // e.g. "_gdl90._udp"
+	Instance string
+	Port     int
+	Txt      []string
+}
+
+func (s mdnsService) typeName() string {
+	return s.Type + ".local."
+}
+
+func (s mdnsService) instanceName() string {
+	return s.Instance + "." + s.typeName()
+}
+
+func (s mdnsService) key() string {
+	return s.instanceName() + ":" + strconv.Itoa(s.Port) + ":" + strings.Join(s.Txt, ",")
+}
+
+// Host name advertised in the A records, "<hostname>.local.".
+func mdnsHostName() string {
+	name, err := os.Hostname()
+	if err != nil || len(name) == 0 {
+		name = "stratux"
+	}
+	return strings.SplitN(name, ".", 2)[0] + ".local."
+}
+
+func managementPort() int {
+	_, port, err := net.SplitHostPort(managementAddr)
+	if p, errP := strconv.Atoi(port); err == nil && errP == nil {
+		return p
+	}
+	return 80
+}
+
+// The services of the current settings.
+func mdnsServices() []mdnsService {
+	services := make([]mdnsService, 0)
+	if !globalSettings.MDNSEnabled {
+		return services
+	}
+	add := func(typ string, port int, txt ...string) {
+		if port > 0 {
+			services = append(services, mdnsService{Type: typ, Port: port, Txt: txt})
+		}
+	}
+	for _, o := range globalSettings.NetworkOutputs {
+		if o.Capability&NETWORK_GDL90_STANDARD != 0 {
+			add("_gdl90._udp", int(o.Port), "protocol=gdl90", "ahrs="+strconv.FormatBool(o.Capability&NETWORK_AHRS_GDL90 != 0))
+		}
+		if o.Capability&NETWORK_FLARM_NMEA != 0 {
+			add("_flarm-nmea._udp", int(o.Port), "protocol=flarm-nmea")
+		}
+	}
+	add("_gdl90._tcp", globalSettings.GDL90TCPPort, "protocol=gdl90", "ahrs=true")
+	add("_flarm-nmea._tcp", globalSettings.FLARMNMEAPort, "protocol=flarm-nmea")
+	web := managementPort()
+	add("_http._tcp", web, "path=/")
+	add("_stratux-replay._tcp", web, "path=/getFlightReplay", "control=/setFlightReplay")
+
+	// Unique instance names: "Stratux", "Stratux (4001)" if there are more of a type
+	count := make(map[string]int)
+	for _, s := range services {
+		count[s.Type]++
+	}
+	for i := range services {
+		services[i].Instance = MDNS_INSTANCE
+		if count[services[i].Type] > 1 {
+			services[i].Instance += fmt.Sprintf(" (%d)", services[i].Port)
+		}
+	}
+	return services
+}
+
+// Name of a record, the names are all ours and short enough.
+func dnsName(name string) dnsmessage.Name {
+	n, _ := dnsmessage.NewName(name)
+	return n
+}
+
+func dnsHeader(name string, typ dnsmessage.Type, unique bool, ttl uint32) dnsmessage.ResourceHeader {
+	class := dnsmessage.ClassINET
+	if unique {
+		class |= dnsClassCacheFlush
+	}
+	return dnsmessage.ResourceHeader{Name: dnsName(name), Type: typ, Class: class, TTL: ttl}
+}
+
+func dnsPTR(name, target string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsHeader(name, dnsmessage.TypePTR, false, ttl), Body: &dnsmessage.PTRResource{PTR: dnsName(target)}}
+}
+
+func dnsSRV(s mdnsService, host string, ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: dnsHeader(s.instanceName(), dnsmessage.TypeSRV, true, ttl),
+		Body: &dnsmessage.SRVResource{Port: uint16(s.Port), Target: dnsName(host)}}
+}
+
+// TXT strings are limited to 255 bytes, longer ones are left out.
+func dnsTXT(s mdnsService, ttl uint32) dnsmessage.Resource {
+	txt := make([]string, 0, len(s.Txt))
+	for _, t := range s.Txt {
+		if len(t) > 255 {
+			logWarnf("mdns", "TXT string of %s too long, left out: %s", s.instanceName(), t)
+			continue
+		}
+		txt = append(txt, t)
+	}
+	if len(txt) == 0 {
+		txt = append(txt, "") // a TXT record has at least one string
+	}
+	return dnsmessage.Resource{Header: dnsHeader(s.instanceName(), dnsmessage.TypeTXT, true, ttl), Body: &dnsmessage.TXTResource{TXT: txt}}
+}
+
+// A or AAAA record of the address.
+func dnsAddress(host string, ip net.IP, ttl uint32) dnsmessage.Resource {
+	if ip4 := ip.To4(); ip4 != nil {
+		var a [4]byte
+		copy(a[:], ip4)
+		return dnsmessage.Resource{Header: dnsHeader(host, dnsmessage.TypeA, true, ttl), Body: &dnsmessage.AResource{A: a}}
+	}
+	var aaaa [16]byte
+	copy(aaaa[:], ip.To16())
+	return dnsmessage.Resource{Header: dnsHeader(host, dnsmessage.TypeAAAA, true, ttl), Body: &dnsmessage.AAAAResource{AAAA: aaaa}}
+}
+
+// Header and questions of a query, no questions for responses.
+func parseMDNSQuery(msg []byte) (dnsmessage.Header, []dnsmessage.Question, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil || h.Response {
+		return h, nil, err
+	}
+	questions, err := p.AllQuestions()
+	return h, questions, err
+}
+
+/*
+mdnsReply().
+
+	Response to the query msg, nil if we have nothing to answer. ips are the addresses of the receiving interface.
+	Multicast responses have ID 0 and no questions (RFC 6762 18.1, 6). Legacy unicast queries (source port other than
+	5353, e.g. dig -p 5353) get the ID and the questions back and short TTLs (RFC 6762 6.7). unicast is set if the
+	first question asks for a unicast response (QU bit).
+*/
+func mdnsReply(msg []byte, legacy bool, services []mdnsService, host string, ips []net.IP) (reply []byte, unicast bool) {
+	h, questions, err := parseMDNSQuery(msg)
+	if err != nil || len(questions) == 0 {
+		return nil, false
+	}
+	answers, additional := mdnsAnswers(questions, services, host, ips)
+	if len(answers) == 0 {
+		return nil, false
+	}
+	resp := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: additional,
+	}
+	if legacy {
+		resp.ID = h.ID
+		resp.Questions = questions
+		for _, records := range [][]dnsmessage.Resource{resp.Answers, resp.Additionals} {
+			for i := range records {
+				records[i].Header.TTL = 10
+				records[i].Header.Class &^= dnsClassCacheFlush
+			}
+		}
+	}
+	reply, err = resp.Pack()
+	if err != nil {
+		logWarnf("mdns", "can't encode the response: %s", err.Error())
+		return nil, false
+	}
+	return reply, uint16(questions[0].Class)&dnsClassUnicast != 0
+}
+
+// Answers and additional records for the questions. ips are the addresses of the receiving interface.
+func mdnsAnswers(questions []dnsmessage.Question, services []mdnsService, host string, ips []net.IP) ([]dnsmessage.Resource, []dnsmessage.Resource) {
+	answers := make([]dnsmessage.Resource, 0)
+	additional := make([]dnsmessage.Resource, 0)
+	added := make(map[string]bool)
+	addTo := func(list *[]dnsmessage.Resource, r dnsmessage.Resource) {
+		key := r.Header.Name.String() + "/" + r.Body.GoString()
+		if !added[key] {
+			added[key] = true
+			*list = append(*list, r)
+		}
+	}
+	addHost := func(list *[]dnsmessage.Resource) {
+		for _, ip := range ips {
+			addTo(list, dnsAddress(host, ip, MDNS_HOST_TTL))
+		}
+	}
+	is := func(q dnsmessage.Question, typ dnsmessage.Type) bool {
+		return q.Type == typ || q.Type == dnsmessage.TypeALL
+	}
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		if name == strings.ToLower(host) {
+			for _, ip := range ips {
+				if (ip.To4() != nil && is(q, dnsmessage.TypeA)) || (ip.To4() == nil && is(q, dnsmessage.TypeAAAA)) {
+					addTo(&answers, dnsAddress(host, ip, MDNS_HOST_TTL))
+				}
+			}
+		}
+		for _, s := range services {
+			if name == MDNS_SERVICES_NAME && is(q, dnsmessage.TypePTR) {
+				addTo(&answers, dnsPTR(MDNS_SERVICES_NAME, s.typeName(), MDNS_SERVICE_TTL))
+			}
+			if name == strings.ToLower(s.typeName()) && is(q, dnsmessage.TypePTR) {
+				addTo(&answers, dnsPTR(s.typeName(), s.instanceName(), MDNS_SERVICE_TTL))
+				addTo(&additional, dnsSRV(s, host, MDNS_SERVICE_TTL))
+				addTo(&additional, dnsTXT(s, MDNS_SERVICE_TTL))
+				addHost(&additional)
+			}
+			if name == strings.ToLower(s.instanceName()) {
+				if is(q, dnsmessage.TypeSRV) {
+					addTo(&answers, dnsSRV(s, host, MDNS_SERVICE_TTL))
+					addHost(&additional)
+				}
+				if is(q, dnsmessage.TypeTXT) {
+					addTo(&answers, dnsTXT(s, MDNS_SERVICE_TTL))
+				}
+			}
+		}
+	}
+	return answers, additional
+}
+
+// All records of the services, for announcements (ttl 0 = goodbye).
+func mdnsAnnouncement(services []mdnsService, host string, ips []net.IP, ttl uint32) []dnsmessage.Resource {
+	records := make([]dnsmessage.Resource, 0)
+	for _, s := range services {
+		records = append(records, dnsPTR(MDNS_SERVICES_NAME, s.typeName(), ttl), dnsPTR(s.typeName(), s.instanceName(), ttl),
+			dnsSRV(s, host, ttl), dnsTXT(s, ttl))
+	}
+	if ttl > 0 && len(services) > 0 {
+		for _, ip := range ips {
+			records = append(records, dnsAddress(host, ip, MDNS_HOST_TTL))
+		}
+	}
+	return records
+}
+
+// IPv4 and IPv6 addresses of the interface with the given index.
+func interfaceIPs(index int) []net.IP {
+	ips := make([]net.IP, 0)
+	iface, err := net.InterfaceByIndex(index)
+	if err != nil {
+		return ips
+	}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok {
+			if ip4 := n.IP.To4(); ip4 != nil {
+				ips = append(ips, ip4)
+			} else {
+				ips = append(ips, n.IP)
+			}
+		}
+	}
+	return ips
+}
+
+// Up, multicast capable interfaces with an address of the IP version.
+func mdnsInterfaces(v6 bool) []net.Interface {
+	result := make([]net.Interface, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagMulticast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		for _, ip := range interfaceIPs(i.Index) {
+			if (ip.To4() == nil) == v6 {
+				result = append(result, i)
+				break
+			}
+		}
+	}
+	return result
+}
+
+func listenMDNS(v6 bool) (mdnsConn, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		})
+		return err
+	}}
+	if v6 {
+		conn, err := lc.ListenPacket(context.Background(), "udp6", fmt.Sprintf("[::]:%d", MDNS_PORT))
+		if err != nil {
+			return nil, err
+		}
+		p := ipv6.NewPacketConn(conn)
+		if err := p.SetControlMessage(ipv6.FlagInterface, true); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		p.SetMulticastHopLimit(255)
+		return mdnsConn6{p}, nil
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", fmt.Sprintf("0.0.0.0:%d", MDNS_PORT))
+	if err != nil {
+		return nil, err
+	}
+	p := ipv4.NewPacketConn(conn)
+	if err := p.SetControlMessage(ipv4.FlagInterface, true); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.SetMulticastTTL(255)
+	return mdnsConn4{p}, nil
+}
+
+/*
+mdnsResponder().
+
+	Joins the mDNS groups on all interfaces (re-checked every MDNS_CHECK_INTERVAL, e.g. for a new WiFi client
+	connection), answers the queries and announces the services when they change. IPv6 is optional, e.g. disabled
+	in the kernel.
+*/
+func mdnsResponder() {
+	var p mdnsConn
+	for p == nil {
+		var err error
+		if p, err = listenMDNS(false); err != nil {
+			logErrorf("mdns", "can't listen on port %d: %s", MDNS_PORT, err.Error())
+			time.Sleep(time.Minute)
+		}
+	}
+	if p6, err := listenMDNS(true); err != nil {
+		logErrorf("mdns", "can't listen on IPv6 port %d: %s", MDNS_PORT, err.Error())
+	} else {
+		go mdnsAnnouncer(p6)
+		go mdnsServe(p6)
+	}
+	go mdnsAnnouncer(p)
+	mdnsServe(p)
+}
+
+func mdnsServe(p mdnsConn) {
+	buf := make([]byte, 9000)
+	for {
+		n, ifIndex, src, err := p.ReadFrom(buf)
+		if err != nil {
+			logErrorf("mdns", "%s", err.Error())
+			return
+		}
+		if ifIndex == 0 {
+			continue
+		}
+		services := mdnsServices()
+		if len(services) == 0 {
+			continue
+		}
+		udpSrc, _ := src.(*net.UDPAddr)
+		legacy := udpSrc != nil && udpSrc.Port != MDNS_PORT
+		reply, unicast := mdnsReply(buf[:n], legacy, services, mdnsHostName(), interfaceIPs(ifIndex))
+		if reply == nil {
+			continue
+		}
+		dst := net.Addr(p.Group())
+		if (legacy || unicast) && udpSrc != nil {
+			dst = src
+		}
+		p.WriteTo(reply, ifIndex, dst)
+	}
+}
+
+// Sends the records to the group on every interface, with the addresses of the interface.
+func mdnsAnnounce(p mdnsConn, services []mdnsService, ttl uint32) {
+	host := mdnsHostName()
+	for _, iface := range mdnsInterfaces(p.IPv6()) {
+		records := mdnsAnnouncement(services, host, interfaceIPs(iface.Index), ttl)
+		if len(records) == 0 {
+			continue
+		}
+		msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: records}
+		if buf, err := msg.Pack(); err == nil {
+			p.WriteTo(buf, iface.Index, p.Group())
+		} else {
+			logWarnf("mdns", "can't encode the announcement: %s", err.Error())
+		}
+	}
+}
+
+func mdnsAnnouncer(p mdnsConn) {
+	joined := make(map[string]bool)
+	announced := make(map[string]mdnsService)
+	for {
+		current := make(map[string]bool)
+		newIface := false
+		for _, iface := range mdnsInterfaces(p.IPv6()) {
+			current[iface.Name] = true
+			if !joined[iface.Name] {
+				i := iface
+				if err := p.JoinGroup(&i); err != nil && !strings.Contains(err.Error(), "address already in use") {
+					logErrorf("mdns", "can't join group on %s: %s", iface.Name, err.Error())
+					continue
+				}
+				newIface = true
+			}
+		}
+		joined = current
+
+		services := make(map[string]mdnsService)
+		for _, s := range mdnsServices() {
+			services[s.key()] = s
+		}
+		removed := make([]mdnsService, 0)
+		added := make([]mdnsService, 0)
+		for k, s := range announced {
+			if _, ok := services[k]; !ok {
+				removed = append(removed, s)
+			}
+		}
+		for k, s := range services {
+			if _, ok := announced[k]; !ok || newIface {
+				added = append(added, s)
+			}
+		}
+		sort.Slice(added, func(i, j int) bool { return added[i].key() < added[j].key() })
+		if len(removed) > 0 {
+			mdnsAnnounce(p, removed, 0)
+		}
+		if len(added) > 0 {
+			// Announced twice, one second apart (RFC 6762 8.3)
+			mdnsAnnounce(p, added, MDNS_SERVICE_TTL)
+			time.Sleep(time.Second)
+			mdnsAnnounce(p, added, MDNS_SERVICE_TTL)
+		}
+		announced = services
+		time.Sleep(MDNS_CHECK_INTERVAL)
+	}
+}
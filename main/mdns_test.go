@@ -0,0 +1,162 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mdns_test.go: Query parsing and the responses of the mDNS responder.
+*/
+
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testMDNSServices = []mdnsService{
+	{Type: "_gdl90._udp", Instance: "Stratux", Port: 4000, Txt: []string{"protocol=gdl90", "ahrs=true"}},
+	{Type: "_http._tcp", Instance: "Stratux", Port: 80, Txt: []string{"path=/", strings.Repeat("x", 300)}},
+}
+
+var testMDNSIPs = []net.IP{net.IPv4(192, 168, 10, 1).To4(), net.ParseIP("fe80::1")}
+
+// A query with the given ID and questions, class IN with the QU bit if unicast is set.
+func makeMDNSQuery(t *testing.T, id uint16, unicast bool, questions ...dnsmessage.Question) []byte {
+	for i := range questions {
+		questions[i].Class = dnsmessage.ClassINET
+		if unicast {
+			questions[i].Class |= dnsClassUnicast
+		}
+	}
+	msg, err := (&dnsmessage.Message{Header: dnsmessage.Header{ID: id}, Questions: questions}).Pack()
+	if err != nil {
+		t.Fatalf("can't pack query: %s", err)
+	}
+	return msg
+}
+
+func TestParseMDNSQuery(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsName("_gdl90._udp.local."), Type: dnsmessage.TypePTR}
+	response, _ := (&dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Questions: []dnsmessage.Question{q}}).Pack()
+	tests := []struct {
+		name      string
+		msg       []byte
+		questions int
+		err       bool
+	}{
+		{"query", makeMDNSQuery(t, 0, false, q), 1, false},
+		{"two questions", makeMDNSQuery(t, 0, false, q, q), 2, false},
+		{"response", response, 0, false},
+		{"truncated", makeMDNSQuery(t, 0, false, q)[:15], 0, true},
+		{"short header", []byte{0, 0, 0}, 0, true},
+	}
+	for _, tt := range tests {
+		_, questions, err := parseMDNSQuery(tt.msg)
+		if (err != nil) != tt.err || len(questions) != tt.questions {
+			t.Errorf("%s: %d questions, err %v; want %d questions, error %t", tt.name, len(questions), err, tt.questions, tt.err)
+		}
+	}
+}
+
+func TestMDNSReply(t *testing.T) {
+	initBenchmark()
+	const host = "stratux.local."
+	tests := []struct {
+		name     string
+		id       uint16
+		unicast  bool
+		legacy   bool
+		question dnsmessage.Question
+		answers  []dnsmessage.Type // nil for no reply
+	}{
+		{"service browsing", 0, false, false, dnsmessage.Question{Name: dnsName(MDNS_SERVICES_NAME), Type: dnsmessage.TypePTR},
+			[]dnsmessage.Type{dnsmessage.TypePTR, dnsmessage.TypePTR}},
+		{"service type, QU", 0, true, false, dnsmessage.Question{Name: dnsName("_gdl90._udp.local."), Type: dnsmessage.TypePTR},
+			[]dnsmessage.Type{dnsmessage.TypePTR}},
+		{"host A, case insensitive", 0, false, false, dnsmessage.Question{Name: dnsName("STRATUX.local."), Type: dnsmessage.TypeA},
+			[]dnsmessage.Type{dnsmessage.TypeA}},
+		{"instance ANY, legacy", 0x1234, false, true, dnsmessage.Question{Name: dnsName("Stratux._http._tcp.local."), Type: dnsmessage.TypeALL},
+			[]dnsmessage.Type{dnsmessage.TypeSRV, dnsmessage.TypeTXT}},
+		{"unknown name", 0, false, false, dnsmessage.Question{Name: dnsName("other.local."), Type: dnsmessage.TypeA}, nil},
+	}
+	for _, tt := range tests {
+		reply, unicast := mdnsReply(makeMDNSQuery(t, tt.id, tt.unicast, tt.question), tt.legacy, testMDNSServices, host, testMDNSIPs)
+		if reply == nil {
+			if tt.answers != nil {
+				t.Errorf("%s: no reply", tt.name)
+			}
+			continue
+		} else if tt.answers == nil {
+			t.Errorf("%s: unexpected reply", tt.name)
+			continue
+		}
+		if unicast != tt.unicast {
+			t.Errorf("%s: unicast %t, want %t", tt.name, unicast, tt.unicast)
+		}
+		var resp dnsmessage.Message
+		if err := resp.Unpack(reply); err != nil {
+			t.Fatalf("%s: can't unpack reply: %s", tt.name, err)
+		}
+		if !resp.Response || !resp.Authoritative {
+			t.Errorf("%s: header %+v", tt.name, resp.Header)
+		}
+		if tt.legacy {
+			// RFC 6762 6.7: ID and questions echoed, short TTLs, no cache flush bit.
+			if resp.ID != tt.id || len(resp.Questions) != 1 {
+				t.Errorf("%s: ID %#x and %d questions, want the query's", tt.name, resp.ID, len(resp.Questions))
+			}
+			for _, r := range append(resp.Answers, resp.Additionals...) {
+				if r.Header.TTL > 10 || r.Header.Class&dnsClassCacheFlush != 0 {
+					t.Errorf("%s: %s TTL %d class %#x", tt.name, r.Header.Name, r.Header.TTL, uint16(r.Header.Class))
+				}
+			}
+		} else if resp.ID != 0 || len(resp.Questions) != 0 {
+			// RFC 6762 18.1, 6: multicast responses have ID 0 and no questions.
+			t.Errorf("%s: ID %#x and %d questions, want 0 and none", tt.name, resp.ID, len(resp.Questions))
+		}
+		got := make([]dnsmessage.Type, 0)
+		for _, r := range resp.Answers {
+			got = append(got, r.Header.Type)
+		}
+		if len(got) != len(tt.answers) {
+			t.Errorf("%s: answers %v, want %v", tt.name, got, tt.answers)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.answers[i] {
+				t.Errorf("%s: answers %v, want %v", tt.name, got, tt.answers)
+				break
+			}
+		}
+	}
+}
+
+func TestDNSTXTLength(t *testing.T) {
+	initBenchmark()
+	tests := []struct {
+		txt  []string
+		want []string
+	}{
+		{[]string{"path=/"}, []string{"path=/"}},
+		{[]string{strings.Repeat("a", 255)}, []string{strings.Repeat("a", 255)}},
+		{[]string{"path=/", strings.Repeat("b", 256)}, []string{"path=/"}},
+		{[]string{strings.Repeat("c", 300)}, []string{""}},
+		{nil, []string{""}},
+	}
+	for _, tt := range tests {
+		r := dnsTXT(mdnsService{Type: "_http._tcp", Instance: "Stratux", Txt: tt.txt}, MDNS_SERVICE_TTL)
+		got := r.Body.(*dnsmessage.TXTResource).TXT
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("dnsTXT(%d strings) = %d strings %.20q, want %.20q", len(tt.txt), len(got), got, tt.want)
+			continue
+		}
+		// The record must survive packing, which fails for strings over 255 bytes.
+		if _, err := (&dnsmessage.Message{Header: dnsmessage.Header{Response: true}, Answers: []dnsmessage.Resource{r}}).Pack(); err != nil {
+			t.Errorf("dnsTXT(%d strings) can't be packed: %s", len(tt.txt), err)
+		}
+	}
+}
@@ -5,6 +5,17 @@
 	as part of this header.
 
 	messagequeue.go: Prioritizing queue for slow network connections
+		Messages are scheduled by priority (lower is more important), FIFO within the same priority. The priorities
+		are grouped into classes (MSGPRIO_*), each queued separately with its own drop accounting, so a burst of
+		FIS-B uplinks can never delay heartbeat, ownship and traffic messages:
+			heartbeat   GDL90 heartbeat, also sent to sleeping clients to detect them waking up
+			ownship     ownship position
+			status      stratux status, FLARM PFLAU, TFR alerts
+			traffic     by threat: critical targets (see computeTrafficPriority()) first, targets without position last
+			aux         attitude and auxiliary NMEA sentences, short lived
+			feed        raw data streams (GPS NMEA, Beast, UAT raw, relayed UAT reports, ASTERIX/SBS)
+			uplink      FIS-B weather, bounded to half of the queue
+		If the queue is full, the least important messages are dropped first, the oldest of them first.
 */
 
 package main
@@ -15,27 +26,80 @@ import (
 	"time"
 )
 
+const (
+	MSGPRIO_HEARTBEAT      = -20
+	MSGPRIO_OWNSHIP        = -10
+	MSGPRIO_STATUS         = -5
+	MSGPRIO_TRAFFIC        = 0  // critical traffic, less threatening targets up to MSGPRIO_TRAFFIC_NOPOS
+	MSGPRIO_TRAFFIC_LEVELS = 20 // threat levels of the targets with position
+	MSGPRIO_TRAFFIC_NOPOS  = MSGPRIO_TRAFFIC + MSGPRIO_TRAFFIC_LEVELS
+	MSGPRIO_AUX            = 30
+	MSGPRIO_FEED           = 40
+	MSGPRIO_UPLINK         = 50
+)
+
+// Class names in scheduling order, and the highest priority of each class.
+var msgClassNames = []string{"heartbeat", "ownship", "status", "traffic", "aux", "feed", "uplink"}
+var msgClassMaxPrio = []int32{MSGPRIO_HEARTBEAT, MSGPRIO_OWNSHIP, MSGPRIO_STATUS, MSGPRIO_TRAFFIC_NOPOS, MSGPRIO_AUX, MSGPRIO_FEED}
+
+// Share of maxSize a class may occupy, the others may use all of it.
+var msgClassShare = map[string]float32{"uplink": 0.5}
+
 type QueueEntry struct {
 	priority   int32
 	outdatedAt time.Time
 	data       interface{}
 }
 
+type messageQueueClass struct {
+	entries  []QueueEntry // sorted by priority, FIFO within a priority
+	maxSize  int
+	sent     uint64
+	outdated uint64 // dropped unsent because they were too old
+	overflow uint64 // dropped unsent because the queue (or the share of the class) was full
+}
+
+type MessageQueueClassStats struct {
+	Class    string
+	Queued   int
+	Sent     uint64
+	Outdated uint64
+	Overflow uint64
+}
 
 type MessageQueue struct {
 	maxSize       int
-	entries       []QueueEntry
+	size          int
+	classes       []messageQueueClass
 	DataAvailable chan bool
 	Closed        bool
 	mutex         sync.Mutex
 }
 
 func NewMessageQueue(maxSize int) *MessageQueue {
-	return &MessageQueue {
-		maxSize: maxSize,
-		entries: make([]QueueEntry, 0),
+	queue := &MessageQueue{
+		maxSize:       maxSize,
+		classes:       make([]messageQueueClass, len(msgClassNames)),
 		DataAvailable: make(chan bool, 1),
 	}
+	for i, name := range msgClassNames {
+		queue.classes[i].entries = make([]QueueEntry, 0)
+		queue.classes[i].maxSize = maxSize
+		if share, ok := msgClassShare[name]; ok {
+			queue.classes[i].maxSize = int(float32(maxSize) * share)
+		}
+	}
+	return queue
+}
+
+// Index of the class of a priority in msgClassNames.
+func msgClass(prio int32) int {
+	for i, maxPrio := range msgClassMaxPrio {
+		if prio <= maxPrio {
+			return i
+		}
+	}
+	return len(msgClassNames) - 1
 }
 
 func (queue *MessageQueue) Put(prio int32, maxAge time.Duration, data interface{}) {
@@ -45,28 +109,25 @@ func (queue *MessageQueue) Put(prio int32, maxAge time.Duration, data interface{
 	queue.mutex.Lock()
 	defer queue.mutex.Unlock()
 
-	timeout := stratuxClock.Time.Add(maxAge)
-	entry := QueueEntry { prio, timeout, data }
-
-	if queue.entries == nil || len(queue.entries) == 0 {
-		queue.entries = make([]QueueEntry, 1)
-		queue.entries[0] = QueueEntry { prio, timeout, data }
+	entry := QueueEntry{prio, stratuxClock.Time.Add(maxAge), data}
+	class := &queue.classes[msgClass(prio)]
+	index := findInsertPosition(class.entries, prio)
+	if index == len(class.entries) {
+		class.entries = append(class.entries, entry)
 	} else {
-		index := queue.findInsertPosition(prio)
-		
-		if index == len(queue.entries) {
-			queue.entries = append(queue.entries, entry)
-		} else {
-			queue.entries = append(queue.entries[:index+1], queue.entries[index:]...)
-			queue.entries[index] = entry
-		}
+		class.entries = append(class.entries[:index+1], class.entries[index:]...)
+		class.entries[index] = entry
 	}
+	queue.size++
 
 	// Allow 10% over-use before we prune, so the pruning is done in batches to save CPU
-	if float32(len(queue.entries)) > float32(queue.maxSize) * 1.1 {
+	if float32(len(class.entries)) > float32(class.maxSize)*1.1 {
+		queue.pruneClass(class, class.maxSize)
+	}
+	if float32(queue.size) > float32(queue.maxSize)*1.1 {
 		queue.prune()
 	}
-	if len(queue.entries) != 0 {
+	if queue.size != 0 {
 		queue.notifyData()
 	}
 }
@@ -75,47 +136,43 @@ func (queue *MessageQueue) PeekFirst() (interface{}, int32) {
 	return queue.getFirst(false)
 }
 
-
 func (queue *MessageQueue) PopFirst() (interface{}, int32) {
 	return queue.getFirst(true)
 }
 
+// Returns the first entry that's not outdated, from the most important class that has one.
 func (queue *MessageQueue) getFirst(remove bool) (interface{}, int32) {
 	queue.mutex.Lock()
 	defer queue.mutex.Unlock()
 
-	index := queue.getFirstUsableIndex()
-	if index < 0 {
-		return nil, 0 // nothing in queue
-	}
-
-	// found one. Strip the queue and return it
-	entry := queue.entries[index]
-	if remove  {
-		queue.entries = queue.entries[index+1:]
-	} else {
-		queue.entries = queue.entries[index:]
-	}
-	return entry.data, entry.priority
-}
-
-// Returns the first entry that's not outdated
-func (queue *MessageQueue) getFirstUsableIndex() int {
-	for i, data := range queue.entries {
-		if data.outdatedAt.Before(stratuxClock.Time) {
-			// entry already timed out..
+	for i := range queue.classes {
+		class := &queue.classes[i]
+		queue.dropOutdatedHead(class)
+		if len(class.entries) == 0 {
 			continue
 		}
-		// found one
-		return i
+		entry := class.entries[0]
+		if remove {
+			class.entries = class.entries[1:]
+			class.sent++
+			queue.size--
+		}
+		return entry.data, entry.priority
 	}
+	return nil, 0 // nothing in queue
+}
 
-	// Nothing current in queue
-	if len(queue.entries) > 0 {
-		queue.entries = make([]QueueEntry, 0)
+// Drops the outdated entries in front of the first usable one.
+func (queue *MessageQueue) dropOutdatedHead(class *messageQueueClass) {
+	n := 0
+	for n < len(class.entries) && class.entries[n].outdatedAt.Before(stratuxClock.Time) {
+		n++
+	}
+	if n > 0 {
+		class.entries = class.entries[n:]
+		class.outdated += uint64(n)
+		queue.size -= n
 	}
-
-	return -1
 }
 
 func (queue *MessageQueue) GetQueueDump(pruneFirst bool) []interface{} {
@@ -125,65 +182,116 @@ func (queue *MessageQueue) GetQueueDump(pruneFirst bool) []interface{} {
 	if pruneFirst {
 		queue.prune()
 	}
-	data := make([]interface{}, len(queue.entries))
-	for i, d := range queue.entries {
-		data[i] = d.data
+	data := make([]interface{}, 0, queue.size)
+	for _, class := range queue.classes {
+		for _, d := range class.entries {
+			data = append(data, d.data)
+		}
 	}
 	return data
 }
 
-// Removes elements from the queue so it fits its maxSize
-// - All outdated elements are discarded
-// - Low priority elements are discarded, starting with the oldest ones
+// Removes elements from the queue so it fits its maxSize. All outdated elements are discarded, then elements of the
+// least important classes, within a class the low priority ones, starting with the oldest ones.
 func (queue *MessageQueue) prune() {
+	usable := 0
+	for i := range queue.classes {
+		usable += queue.pruneClass(&queue.classes[i], queue.classes[i].maxSize)
+	}
+	toBeRemoved := usable - queue.maxSize
+	for i := len(queue.classes) - 1; i >= 0 && toBeRemoved > 0; i-- {
+		class := &queue.classes[i]
+		keep := len(class.entries) - toBeRemoved
+		if keep < 0 {
+			keep = 0
+		}
+		toBeRemoved -= len(class.entries) - keep
+		queue.pruneClass(class, keep)
+	}
+}
+
+// Drops the outdated entries of a class, then the oldest of the lowest priority until at most maxSize are left.
+// Returns the number of entries left.
+func (queue *MessageQueue) pruneClass(class *messageQueueClass, maxSize int) int {
 	// Group into priority categories, so we can then strip the beginning of each category is needed (remove oldest messages)
-	newEntries := make([][]QueueEntry, 0)
-	//npruned := 0
+	categories := make([][]QueueEntry, 0)
 	totalUsable := 0
 	prevPrio := int32(999999999)
-	for _, entry := range queue.entries {
+	for _, entry := range class.entries {
 		if entry.outdatedAt.Before(stratuxClock.Time) {
+			class.outdated++
 			continue // outdated, remove completely
 		}
 		totalUsable++
-		if len(newEntries) == 0 || entry.priority != prevPrio {
+		if len(categories) == 0 || entry.priority != prevPrio {
 			// new prio-category
-			newEntries = append(newEntries, make([]QueueEntry, 0))
+			categories = append(categories, make([]QueueEntry, 0))
 		}
-		newEntries[len(newEntries)-1] = append(newEntries[len(newEntries)-1], entry)
+		categories[len(categories)-1] = append(categories[len(categories)-1], entry)
 		prevPrio = entry.priority
 	}
-	toBeRemoved := totalUsable - queue.maxSize
+	toBeRemoved := totalUsable - maxSize
 	if toBeRemoved > 0 {
-		for i := len(newEntries) - 1; i >= 0; i-- {
-			//fmt.Printf("%p: Pruning %d prio %d entries (%d available)\n", queue, toBeRemoved, newEntries[i][0].priority, len(newEntries[i]))
+		class.overflow += uint64(toBeRemoved)
+		for i := len(categories) - 1; i >= 0; i-- {
 			// From lowerst to highest prio, remove the oldest messages of each category until we have few enough in total
-			if len(newEntries[i]) >= toBeRemoved {
+			if len(categories[i]) >= toBeRemoved {
 				// can remove enough in this category
-				newEntries[i] = newEntries[i][toBeRemoved:]
+				categories[i] = categories[i][toBeRemoved:]
 				break
 			} else {
 				// remove this category, then proceed with next higher prio one
-				toBeRemoved -= len(newEntries[i])
-				newEntries[i] = nil
+				toBeRemoved -= len(categories[i])
+				categories[i] = nil
 			}
 		}
 	}
 
 	// finally, copy everything back to our queue
-	queue.entries = make([]QueueEntry, 0)
-	for _, category := range newEntries {
+	queue.size -= len(class.entries)
+	class.entries = make([]QueueEntry, 0, totalUsable)
+	for _, category := range categories {
 		if category != nil {
-			queue.entries = append(queue.entries, category...)
+			class.entries = append(class.entries, category...)
+		}
+	}
+	queue.size += len(class.entries)
+	return len(class.entries)
+}
+
+// Number of queued entries and of the entries discarded unsent so far.
+func (queue *MessageQueue) Stats() (int, uint64) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	var dropped uint64
+	for _, class := range queue.classes {
+		dropped += class.outdated + class.overflow
+	}
+	return queue.size, dropped
+}
+
+// Queue depth, sent and dropped entries per class.
+func (queue *MessageQueue) ClassStats() []MessageQueueClassStats {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	stats := make([]MessageQueueClassStats, len(queue.classes))
+	for i, class := range queue.classes {
+		stats[i] = MessageQueueClassStats{
+			Class:    msgClassNames[i],
+			Queued:   len(class.entries),
+			Sent:     class.sent,
+			Outdated: class.outdated,
+			Overflow: class.overflow,
 		}
 	}
+	return stats
 }
 
-func (queue *MessageQueue) findInsertPosition(priority int32) int {
-	index := sort.Search(len(queue.entries), func(i int) bool {
+func findInsertPosition(entries []QueueEntry, priority int32) int {
+	index := sort.Search(len(entries), func(i int) bool {
 		// > instead of >= so we get to the first entry that is larger - in order to keep insertion order
 		// for equal-priority messages
-		return queue.entries[i].priority > priority
+		return entries[i].priority > priority
 	})
 
 	return index
@@ -202,4 +310,4 @@ func (queue *MessageQueue) Close() {
 	}
 	queue.Closed = true
 	queue.notifyData()
-}
\ No newline at end of file
+}
@@ -0,0 +1,179 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	metrics.go: Prometheus metrics for fleet and home-lab monitoring, scraped from the web interface port:
+			/metrics                              Prometheus text exposition format
+		Counters are incremented where the events happen (messages decoded per band, I2C read errors), everything else
+		is read from the status, the situation, the traffic list and the output queues when scraped. Go runtime and
+		process metrics are included.
+*/
+
+package main
+
+import (
+	"github.com/b3nn0/stratux/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var metricsBandNames = map[uint]string{
+	MSGCLASS_UAT: "uat",
+	MSGCLASS_ES:  "1090es",
+	MSGCLASS_OGN: "ogn",
+	MSGCLASS_AIS: "ais",
+}
+
+var (
+	metricMessagesDecoded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stratux_messages_decoded_total",
+		Help: "Messages decoded, per band.",
+	}, []string{"band"})
+
+	metricI2CErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "stratux_i2c_errors_total",
+		Help: "Failed reads of the I2C sensors, per sensor (baro, imu, mag).",
+	}, []string{"sensor"})
+
+	descTrafficTargets    = prometheus.NewDesc("stratux_traffic_targets", "Traffic targets received in the last minute, per source.", []string{"source"}, nil)
+	descMessagesPerMinute = prometheus.NewDesc("stratux_messages_last_minute", "Messages received in the last minute, per band.", []string{"band"}, nil)
+	descGPSFixQuality     = prometheus.NewDesc("stratux_gps_fix_quality", "GPS fix quality: 0 = none, 1 = 3D, 2 = SBAS/DGPS.", nil, nil)
+	descGPSValid          = prometheus.NewDesc("stratux_gps_valid", "1 if the GPS position is valid.", nil, nil)
+	descGPSSatellites     = prometheus.NewDesc("stratux_gps_satellites", "GPS satellites, per state (locked, tracked, seen).", []string{"state"}, nil)
+	descGPSAccuracy       = prometheus.NewDesc("stratux_gps_horizontal_accuracy_meters", "Estimated horizontal accuracy of the GPS position.", nil, nil)
+	descCPUTemp           = prometheus.NewDesc("stratux_cpu_temperature_celsius", "CPU temperature.", nil, nil)
+	descDiskFree          = prometheus.NewDesc("stratux_disk_free_bytes", "Free space of the root file system.", nil, nil)
+	descUptime            = prometheus.NewDesc("stratux_uptime_seconds", "Time since stratux started.", nil, nil)
+	descClients           = prometheus.NewDesc("stratux_connected_clients", "Connected network clients.", nil, nil)
+	descNetworkMessages   = prometheus.NewDesc("stratux_network_messages_sent_total", "Messages sent to the network clients.", nil, nil)
+	descNetworkBytes      = prometheus.NewDesc("stratux_network_bytes_sent_total", "Bytes sent to the network clients.", nil, nil)
+	descQueueDepth        = prometheus.NewDesc("stratux_output_queue_depth", "Messages waiting in the queue of an output.", []string{"output"}, nil)
+	descQueueDrops        = prometheus.NewDesc("stratux_output_queue_dropped_total", "Messages dropped unsent (outdated or queue full), per output.", []string{"output"}, nil)
+	descSystemErrors      = prometheus.NewDesc("stratux_system_errors", "System errors shown in the web interface.", nil, nil)
+	descSubsystemUp       = prometheus.NewDesc("stratux_subsystem_up", "1 if the subsystem reported recently, see /status/system.", []string{"subsystem"}, nil)
+	descSensorConnected   = prometheus.NewDesc("stratux_sensor_connected", "1 if the sensor is connected, per sensor (baro, imu, gps).", []string{"sensor"}, nil)
+)
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricMessagesDecoded,
+		metricI2CErrors,
+		stratuxCollector{},
+	)
+	// Export all bands and sensors from the start, not only after the first event
+	for _, band := range metricsBandNames {
+		metricMessagesDecoded.WithLabelValues(band)
+	}
+	for _, sensor := range []string{"baro", "imu", "mag"} {
+		metricI2CErrors.WithLabelValues(sensor)
+	}
+}
+
+func metricsMessageDecoded(class uint) {
+	if band, ok := metricsBandNames[class]; ok {
+		metricMessagesDecoded.WithLabelValues(band).Inc()
+	}
+}
+
+func metricsI2CError(sensor string) {
+	metricI2CErrors.WithLabelValues(sensor).Inc()
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Metrics read from the state of stratux when scraped.
+type stratuxCollector struct{}
+
+func (stratuxCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{descTrafficTargets, descMessagesPerMinute, descGPSFixQuality, descGPSValid,
+		descGPSSatellites, descGPSAccuracy, descCPUTemp, descDiskFree, descUptime, descClients, descNetworkMessages,
+		descNetworkBytes, descQueueDepth, descQueueDrops, descSystemErrors, descSubsystemUp, descSensorConnected} {
+		ch <- d
+	}
+}
+
+func (stratuxCollector) Collect(ch chan<- prometheus.Metric) {
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	counter := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, v, labels...)
+	}
+
+	targets := map[string]int{"1090es": 0, "uat": 0, "ogn": 0, "ais": 0}
+	trafficMutex.Lock()
+	for _, ti := range traffic {
+		if stratuxClock.Since(ti.Last_seen).Minutes() >= 1 {
+			continue
+		}
+		switch ti.Last_source {
+		case TRAFFIC_SOURCE_1090ES:
+			targets["1090es"]++
+		case TRAFFIC_SOURCE_UAT:
+			targets["uat"]++
+		case TRAFFIC_SOURCE_OGN:
+			targets["ogn"]++
+		case TRAFFIC_SOURCE_AIS:
+			targets["ais"]++
+		}
+	}
+	trafficMutex.Unlock()
+	for source, n := range targets {
+		gauge(descTrafficTargets, float64(n), source)
+	}
+
+	gauge(descMessagesPerMinute, float64(globalStatus.UAT_messages_last_minute), "uat")
+	gauge(descMessagesPerMinute, float64(globalStatus.ES_messages_last_minute), "1090es")
+	gauge(descMessagesPerMinute, float64(globalStatus.OGN_messages_last_minute), "ogn")
+	gauge(descMessagesPerMinute, float64(globalStatus.AIS_messages_last_minute), "ais")
+
+	gauge(descGPSFixQuality, float64(mySituation.GPSFixQuality))
+	gauge(descGPSValid, boolGauge(isGPSValid()))
+	gauge(descGPSSatellites, float64(globalStatus.GPS_satellites_locked), "locked")
+	gauge(descGPSSatellites, float64(globalStatus.GPS_satellites_tracked), "tracked")
+	gauge(descGPSSatellites, float64(globalStatus.GPS_satellites_seen), "seen")
+	if isGPSValid() {
+		gauge(descGPSAccuracy, float64(mySituation.GPSHorizontalAccuracy))
+	}
+
+	if globalStatus.CPUTemp != common.InvalidCpuTemp {
+		gauge(descCPUTemp, float64(globalStatus.CPUTemp))
+	}
+	gauge(descDiskFree, float64(globalStatus.DiskBytesFree))
+	gauge(descUptime, float64(globalStatus.Uptime)/1000)
+	gauge(descClients, float64(globalStatus.Connected_Users))
+	counter(descNetworkMessages, float64(globalStatus.NetworkDataMessagesSent))
+	counter(descNetworkBytes, float64(globalStatus.NetworkDataBytesSent))
+	gauge(descSystemErrors, float64(len(globalStatus.Errors)))
+
+	gauge(descSensorConnected, boolGauge(globalStatus.BMPConnected), "baro")
+	gauge(descSensorConnected, boolGauge(globalStatus.IMUConnected), "imu")
+	gauge(descSensorConnected, boolGauge(globalStatus.GPS_connected), "gps")
+
+	netMutex.Lock()
+	for key, c := range clientConnections {
+		// key: "192.168.10.22:4000", "TCP:192.168.10.22:2000" or "/dev/serialout0"
+		depth, dropped := c.MessageQueue().Stats()
+		gauge(descQueueDepth, float64(depth), key)
+		counter(descQueueDrops, float64(dropped), key)
+	}
+	netMutex.Unlock()
+
+	for _, s := range getSubsystemHealth() {
+		gauge(descSubsystemUp, boolGauge(s.OK), s.Name)
+	}
+}
+
+// /metrics
+var handleMetricsRequest = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
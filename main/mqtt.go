@@ -0,0 +1,442 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	mqtt.go: Telemetry publisher for an MQTT broker (Eclipse Paho client), for hangar dashboards, Home Assistant or fleet
+		monitoring. JSON messages below globalSettings.MQTTTopicPrefix, each topic class with its own interval
+		(globalSettings.MQTTIntervals, s, 0 = not published):
+			<prefix>/situation                    GPS position, baro and AHRS attitude
+			<prefix>/traffic                      number of targets, alerts and the closest target
+			<prefix>/status                       system health: CPU temperature, uptime, receivers, message rates, errors
+			<prefix>/online                       "true" while connected, retained. "false" is the last will
+			/getMQTT                              connection state, last error and messages published per class
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	MQTT_KEEPALIVE      = 30 * time.Second
+	MQTT_RETRY_INTERVAL = 30 * time.Second
+	MQTT_TIMEOUT        = 10 * time.Second // connect, PUBACK
+)
+
+var mqttTopicClasses = []string{"situation", "traffic", "status"}
+
+type MQTTSituation struct {
+	Time               time.Time
+	GPSValid           bool
+	Lat                float32
+	Lng                float32
+	AltitudeMSL        float32 // ft
+	GroundSpeed        uint16  // kt
+	TrueCourse         float32
+	VerticalSpeed      float32 // ft/min
+	HorizontalAccuracy float32 // m
+	FixQuality         uint8
+	Satellites         uint16
+	BaroValid          bool
+	PressureAltitude   float32 // ft
+	AHRSValid          bool
+	Pitch              float64
+	Roll               float64
+	Heading            float64 // gyro heading
+	GLoad              float64
+}
+
+type MQTTTrafficTarget struct {
+	Icao_addr   string // hex
+	Tail        string
+	Distance    float64 // m
+	Bearing     float64
+	RelativeAlt int32 // ft
+	AlertLevel  uint8
+}
+
+type MQTTTraffic struct {
+	Targets         int
+	TargetsPosition int // with valid position
+	Alerts          int
+	HighestAlert    uint8              // TRAFFIC_ALERT_*
+	Closest         *MQTTTrafficTarget // null without target with bearing and distance
+}
+
+type MQTTSystemStatus struct {
+	Version                  string
+	Uptime                   int64 // ms
+	CPUTemp                  float32
+	DiskBytesFree            uint64
+	Connected_Users          uint
+	GPS_connected            bool
+	GPS_solution             string
+	GPS_satellites_locked    uint16
+	UAT_messages_last_minute uint
+	ES_messages_last_minute  uint
+	OGN_messages_last_minute uint
+	UAT_traffic_targets      uint16
+	ES_traffic_targets       uint16
+	Errors                   []string
+}
+
+type MQTTStatus struct {
+	Enabled       bool
+	Connected     bool
+	Broker        string
+	Error         string
+	Published     map[string]uint64  // messages per topic class since the connection
+	LastPublished map[string]float64 // s ago per topic class
+}
+
+var mqttStatusMutex sync.Mutex
+var mqttStatus = MQTTStatus{Published: make(map[string]uint64), LastPublished: make(map[string]float64)}
+var mqttLastPublished = make(map[string]time.Time)
+
+func mqttClientID() string {
+	if len(globalSettings.MQTTClientID) > 0 {
+		return globalSettings.MQTTClientID
+	}
+	name, err := os.Hostname()
+	if err != nil || len(name) == 0 {
+		name = "stratux"
+	}
+	return name
+}
+
+func mqttTopic(class string) string {
+	return strings.TrimRight(globalSettings.MQTTTopicPrefix, "/") + "/" + class
+}
+
+// Parses the value of the MQTTIntervals setting, see handleSettingsSetRequest(). Unknown classes are ignored.
+func setMQTTIntervals(val map[string]interface{}) {
+	if globalSettings.MQTTIntervals == nil {
+		globalSettings.MQTTIntervals = make(map[string]int)
+	}
+	for class, v := range val {
+		class = strings.ToLower(strings.TrimSpace(class))
+		interval, ok := v.(float64)
+		if !ok || interval < 0 {
+			continue
+		}
+		for _, c := range mqttTopicClasses {
+			if c == class {
+				globalSettings.MQTTIntervals[class] = int(interval)
+			}
+		}
+	}
+}
+
+func mqttSituation() MQTTSituation {
+	s := MQTTSituation{GPSValid: isGPSValid(), BaroValid: isTempPressValid(), AHRSValid: isAHRSValid()}
+	mySituation.muGPS.Lock()
+	s.Time = mySituation.GPSTime
+	s.Lat = mySituation.GPSLatitude
+	s.Lng = mySituation.GPSLongitude
+	s.AltitudeMSL = mySituation.GPSAltitudeMSL
+	s.GroundSpeed = uint16(mySituation.GPSGroundSpeed)
+	s.TrueCourse = mySituation.GPSTrueCourse
+	s.VerticalSpeed = mySituation.GPSVerticalSpeed
+	s.HorizontalAccuracy = mySituation.GPSHorizontalAccuracy
+	s.FixQuality = mySituation.GPSFixQuality
+	s.Satellites = mySituation.GPSSatellites
+	mySituation.muGPS.Unlock()
+
+	mySituation.muBaro.Lock()
+	s.PressureAltitude = mySituation.BaroPressureAltitude
+	mySituation.muBaro.Unlock()
+
+	mySituation.muAttitude.Lock()
+	s.Pitch = mySituation.AHRSPitch
+	s.Roll = mySituation.AHRSRoll
+	s.Heading = mySituation.AHRSGyroHeading
+	s.GLoad = mySituation.AHRSGLoad
+	mySituation.muAttitude.Unlock()
+	return s
+}
+
+func mqttTraffic() MQTTTraffic {
+	var t MQTTTraffic
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	for _, ti := range traffic {
+		if ti.Duplicate || ti.OwnshipShadow || ti.Hidden {
+			continue
+		}
+		t.Targets++
+		if ti.Position_valid {
+			t.TargetsPosition++
+		}
+		if ti.AlertLevel > 0 {
+			t.Alerts++
+			if ti.AlertLevel > t.HighestAlert {
+				t.HighestAlert = ti.AlertLevel
+			}
+		}
+		if ti.BearingDist_valid && (t.Closest == nil || ti.Distance < t.Closest.Distance) {
+			t.Closest = &MQTTTrafficTarget{
+				Icao_addr:   fmt.Sprintf("%06X", ti.Icao_addr),
+				Tail:        ti.Tail,
+				Distance:    ti.Distance,
+				Bearing:     ti.Bearing,
+				RelativeAlt: ti.RelativeAlt,
+				AlertLevel:  ti.AlertLevel,
+			}
+		}
+	}
+	return t
+}
+
+func mqttSystemStatus() MQTTSystemStatus {
+	return MQTTSystemStatus{
+		Version:                  globalStatus.Version,
+		Uptime:                   globalStatus.Uptime,
+		CPUTemp:                  globalStatus.CPUTemp,
+		DiskBytesFree:            globalStatus.DiskBytesFree,
+		Connected_Users:          globalStatus.Connected_Users,
+		GPS_connected:            globalStatus.GPS_connected,
+		GPS_solution:             globalStatus.GPS_solution,
+		GPS_satellites_locked:    globalStatus.GPS_satellites_locked,
+		UAT_messages_last_minute: globalStatus.UAT_messages_last_minute,
+		ES_messages_last_minute:  globalStatus.ES_messages_last_minute,
+		OGN_messages_last_minute: globalStatus.OGN_messages_last_minute,
+		UAT_traffic_targets:      globalStatus.UAT_traffic_targets_tracking,
+		ES_traffic_targets:       globalStatus.ES_traffic_targets_tracking,
+		Errors:                   append([]string{}, globalStatus.Errors...),
+	}
+}
+
+func mqttPayload(class string) interface{} {
+	switch class {
+	case "situation":
+		return mqttSituation()
+	case "traffic":
+		return mqttTraffic()
+	default:
+		return mqttSystemStatus()
+	}
+}
+
+func mqttSettingsKey() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%s/%t", globalSettings.MQTTBroker, globalSettings.MQTTClientID, globalSettings.MQTTUsername,
+		globalSecrets.MQTTPassword, globalSettings.MQTTTopicPrefix, globalSettings.MQTTTLSInsecure)
+}
+
+func setMQTTStatus(connected bool, err error) {
+	mqttStatusMutex.Lock()
+	defer mqttStatusMutex.Unlock()
+	mqttStatus.Connected = connected
+	if err != nil {
+		mqttStatus.Error = err.Error()
+	} else {
+		mqttStatus.Error = ""
+	}
+	if connected {
+		mqttStatus.Published = make(map[string]uint64)
+		mqttLastPublished = make(map[string]time.Time)
+	}
+}
+
+// globalSettings.MQTTBroker with the default port of the scheme if it has none, e.g. tcp://hangar.local:1883.
+func mqttBrokerURL() (string, error) {
+	u, err := url.Parse(globalSettings.MQTTBroker)
+	if err != nil || len(u.Host) == 0 {
+		return "", fmt.Errorf("invalid broker URL '%s'", globalSettings.MQTTBroker)
+	}
+	if len(u.Port()) == 0 {
+		switch u.Scheme {
+		case "tcp", "mqtt":
+			u.Host = net.JoinHostPort(u.Hostname(), "1883")
+		case "ssl", "tls", "mqtts":
+			u.Host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	}
+	return u.String(), nil
+}
+
+// Publishes and waits for the PUBACK with QoS 1.
+func mqttPublish(client mqtt.Client, topic string, payload []byte, qos byte, retain bool) error {
+	token := client.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		return errors.New("no PUBACK from the broker")
+	}
+	return token.Error()
+}
+
+// Connects to the broker, the reason is sent to lost if the connection is lost later.
+func mqttConnect(lost chan<- error) (mqtt.Client, error) {
+	broker, err := mqttBrokerURL()
+	if err != nil {
+		return nil, err
+	}
+	online := mqttTopic("online")
+	opts := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(mqttClientID()).
+		SetUsername(globalSettings.MQTTUsername).
+		SetPassword(globalSecrets.MQTTPassword).
+		SetKeepAlive(MQTT_KEEPALIVE).
+		SetConnectTimeout(MQTT_TIMEOUT).
+		SetTLSConfig(&tls.Config{InsecureSkipVerify: globalSettings.MQTTTLSInsecure}).
+		SetBinaryWill(online, []byte("false"), 1, true).
+		SetAutoReconnect(false). // mqttManager() reconnects, also after settings changes
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			select {
+			case lost <- err:
+			default:
+			}
+		})
+	client := mqtt.NewClient(opts)
+	token := client.Connect()
+	if !token.WaitTimeout(MQTT_TIMEOUT) {
+		return nil, errors.New("no CONNACK from the broker")
+	}
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+	if err := mqttPublish(client, online, []byte("true"), 1, true); err != nil {
+		client.Disconnect(0)
+		return nil, err
+	}
+	return client, nil
+}
+
+// Publishes the topic classes that are due.
+func mqttPublishDue(client mqtt.Client) error {
+	qos := byte(0)
+	if globalSettings.MQTTQoS > 0 {
+		qos = 1
+	}
+	for _, class := range mqttTopicClasses {
+		interval := globalSettings.MQTTIntervals[class]
+		if interval <= 0 || stratuxClock.Since(mqttLastPublished[class]) < time.Duration(interval)*time.Second {
+			continue
+		}
+		msg, err := json.Marshal(mqttPayload(class))
+		if err != nil {
+			logErrorf("mqtt", "%s: %s", class, err.Error())
+			continue
+		}
+		if err := mqttPublish(client, mqttTopic(class), msg, qos, false); err != nil {
+			return err
+		}
+		mqttStatusMutex.Lock()
+		mqttLastPublished[class] = stratuxClock.Time
+		mqttStatus.Published[class]++
+		mqttStatusMutex.Unlock()
+	}
+	return nil
+}
+
+// Keeps the connection to globalSettings.MQTTBroker while globalSettings.MQTTEnabled, reconnects when it's lost or
+// the settings change.
+func mqttManager() {
+	var client mqtt.Client
+	var lost chan error
+	connected, failed := "", ""
+	lastTry := time.Time{}
+	disconnect := func() {
+		if client != nil {
+			// The client goes offline on purpose, the last will isn't sent
+			mqttPublish(client, mqttTopic("online"), []byte("false"), 0, true)
+			client.Disconnect(250)
+			client = nil
+		}
+		connected = ""
+	}
+	registerSubsystem("mqtt", 30*time.Second)
+	ticker := time.NewTicker(time.Second)
+	for {
+		<-ticker.C
+		subsystemAlive("mqtt")
+		if !globalSettings.MQTTEnabled || len(globalSettings.MQTTBroker) == 0 {
+			if client != nil {
+				disconnect()
+				setMQTTStatus(false, nil)
+			}
+			continue
+		}
+		key := mqttSettingsKey()
+		if client != nil {
+			select {
+			case err := <-lost:
+				logErrorf("mqtt", "connection to %s lost: %s", globalSettings.MQTTBroker, err.Error())
+				setMQTTStatus(false, err)
+				client, connected = nil, ""
+			default:
+				if key != connected {
+					disconnect()
+				}
+			}
+		}
+		if client == nil {
+			if key == failed && time.Since(lastTry) < MQTT_RETRY_INTERVAL {
+				continue
+			}
+			lastTry = time.Now()
+			lost = make(chan error, 1)
+			c, err := mqttConnect(lost)
+			setMQTTStatus(err == nil, err)
+			if err != nil {
+				logErrorf("mqtt", "%s: %s", globalSettings.MQTTBroker, err.Error())
+				failed = key
+				continue
+			}
+			logInfof("mqtt", "connected to %s", globalSettings.MQTTBroker)
+			client, connected, failed = c, key, ""
+		}
+		if err := mqttPublishDue(client); err != nil {
+			logErrorf("mqtt", "publish failed: %s", err.Error())
+			setMQTTStatus(false, err)
+			client.Disconnect(0)
+			client, connected = nil, ""
+			failed, lastTry = key, time.Now()
+		}
+	}
+}
+
+func getMQTTStatus() MQTTStatus {
+	mqttStatusMutex.Lock()
+	defer mqttStatusMutex.Unlock()
+	status := MQTTStatus{
+		Enabled:       globalSettings.MQTTEnabled,
+		Connected:     mqttStatus.Connected,
+		Broker:        globalSettings.MQTTBroker,
+		Error:         mqttStatus.Error,
+		Published:     make(map[string]uint64),
+		LastPublished: make(map[string]float64),
+	}
+	for class, n := range mqttStatus.Published {
+		status.Published[class] = n
+		if t, ok := mqttLastPublished[class]; ok {
+			status.LastPublished[class] = stratuxClock.Since(t).Seconds()
+		}
+	}
+	return status
+}
+
+// AJAX call - /getMQTT. State of the connection to the broker.
+func handleMQTTGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, err := json.Marshal(getMQTTStatus())
+	if err != nil {
+		logErrorf("mqtt", "Error sending MQTT status JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
@@ -13,17 +13,19 @@ import (
 	"bufio"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/tarm/serial"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 
@@ -41,6 +43,12 @@ const (
 	NETWORK_AHRS_GDL90     = 4
 	NETWORK_FLARM_NMEA     = 8
 	NETWORK_POSITION_FFSIM = 16
+	NETWORK_GPS_NMEA_RAW   = 32  // Unmodified NMEA sentences from the GPS receiver(s)
+	NETWORK_AUTOPILOT      = 64  // Experimental attitude/track error output, see autopilot.go
+	NETWORK_BEAST          = 128 // Beast binary 1090 frames, see beastoutput.go
+	NETWORK_UAT_RAW        = 256 // UAT uplink and downlink frames in dump978 text format
+	NETWORK_ASTERIX        = 512  // ASTERIX CAT021 target reports, see surveillanceoutput.go
+	NETWORK_SBS            = 1024 // SBS-1 BaseStation CSV
 	dhcp_lease_file        = "/var/lib/misc/dnsmasq.leases"
 	dhcp_lease_dir         = "/var/lib/misc/"
 	extra_hosts_file       = "/etc/stratux-static-hosts.conf"
@@ -139,26 +147,41 @@ func serialOutWatcher() {
 	for i := 0; i < 10; i++ {
 		serialDevs = append(serialDevs, fmt.Sprintf("/dev/serialout%d", i))
 		serialDevs = append(serialDevs, fmt.Sprintf("/dev/serialout_nmea%d", i))
+		serialDevs = append(serialDevs, fmt.Sprintf("/dev/serialout_gps%d", i))
+		serialDevs = append(serialDevs, fmt.Sprintf("/dev/serialout_ap%d", i))
 	}
 
 	for {
 		select {
 		case <-serialTicker.C:
-			for _, serialDev := range serialDevs {
+			// Plus the outputs configured on other devices, e.g. the GPIO UART
+			devs := serialDevs
+			for dev := range globalSettings.SerialOutputs {
+				if !strings.HasPrefix(dev, "/dev/serialout") {
+					devs = append(devs[:len(devs):len(devs)], dev)
+				}
+			}
+			for _, serialDev := range devs {
 				if _, err := os.Stat(serialDev); !os.IsNotExist(err) { // Check if the device file exists.
 					var config serialConnection
 
 					// Master is globalSettings.SerialOutputs. Once we connect to one, it will be copied to the active connections map
 					if val, ok := globalSettings.SerialOutputs[serialDev]; !ok {
-						proto := uint8(NETWORK_GDL90_STANDARD)
+						proto := uint16(NETWORK_GDL90_STANDARD)
+						baud := 38400
 						if strings.Contains(serialDev, "_nmea") {
 							proto = NETWORK_FLARM_NMEA
+							baud = globalSettings.NMEASerialBaud
+						} else if strings.Contains(serialDev, "_gps") {
+							proto = NETWORK_GPS_NMEA_RAW
+						} else if strings.Contains(serialDev, "_ap") {
+							proto = NETWORK_AUTOPILOT
 						}
 						if globalSettings.SerialOutputs == nil {
 							globalSettings.SerialOutputs = make(map[string]serialConnection)
 						}
-						globalSettings.SerialOutputs[serialDev] = serialConnection{DeviceString: serialDev, Baud: 38400, Capability: proto, Queue: NewMessageQueue(1024)}
-						log.Printf("detected new serial output, setting up now: %s. Default baudrate 38400.\n", serialDev)
+						globalSettings.SerialOutputs[serialDev] = serialConnection{DeviceString: serialDev, Baud: baud, Capability: proto, Queue: NewMessageQueue(1024)}
+						logInfof("network", "detected new serial output, setting up now: %s. Default baudrate %d.", serialDev, baud)
 						config = globalSettings.SerialOutputs[serialDev]
 
 						saveSettings()
@@ -185,12 +208,13 @@ func serialOutWatcher() {
 						cfg := &serial.Config{Name: config.DeviceString, Baud: config.Baud}
 						p, err := serial.OpenPort(cfg)
 						if err != nil {
-							log.Printf("serialout port (%s) err: %s\n", config.DeviceString, err.Error())
+							logInfof("network", "serialout port (%s) err: %s", config.DeviceString, err.Error())
 						} else {
-							log.Printf("opened serialout: Name: %s, Baud: %d\n", config.DeviceString, config.Baud)
+							logInfof("network", "opened serialout: Name: %s, Baud: %d", config.DeviceString, config.Baud)
 							// Save the serial port connection.
 							tmp := config
 							tmp.serialPort = p
+							tmp.Queue = NewMessageQueue(1024) // the one of a previous connection is closed
 							clientConnections[serialDev] = &tmp
 							go connectionWriter(&tmp)
 						}
@@ -202,45 +226,88 @@ func serialOutWatcher() {
 	}
 }
 
-// TCP port 2000 for Airconnect-like NMEA-Out
+// GDL90 stream on globalSettings.GDL90TCPPort, for EFB apps and EFIS bridges that don't take UDP.
+func tcpGDL90OutListener() {
+	tcpOutputListener("GDL90 output", func() int { return globalSettings.GDL90TCPPort }, NETWORK_GDL90_STANDARD|NETWORK_AHRS_GDL90, 1024)
+}
+
+// Airconnect-like FLARM NMEA-Out on globalSettings.FLARMNMEAPort (2000 by default), for XCSoar, SkyDemon & co.
 func tcpNMEAOutListener() {
-	ln, err := net.Listen("tcp", ":2000")
-	if err != nil {
-		fmt.Println(err)
-		return
+	tcpOutputListener("FLARM NMEA output", func() int { return globalSettings.FLARMNMEAPort }, NETWORK_FLARM_NMEA, 1024)
+}
+
+/*
+	tcpOutputListener().
+		Serves the messages with the given capability to TCP clients on the port returned by port() (0 = disabled).
+		The port is re-checked periodically and the listener re-opened if it changed.
+*/
+func tcpOutputListener(name string, port func() int, capability uint16, queueSize int) {
+	var ln net.Listener
+	current := 0
+	for {
+		if p := port(); p != current {
+			if ln != nil {
+				ln.Close()
+				ln = nil
+			}
+			current = p
+			if current > 0 {
+				var err error
+				ln, err = net.Listen("tcp", fmt.Sprintf(":%d", current))
+				if err != nil {
+					logWarnf("network", "%s: can't listen on port %d: %s", name, current, err.Error())
+				} else {
+					logInfof("network", "%s: serving on TCP port %d", name, current)
+					go acceptTCPOutputConnections(ln, capability, queueSize)
+				}
+			}
+		}
+		time.Sleep(5 * time.Second)
 	}
+}
 
+func acceptTCPOutputConnections(ln net.Listener, capability uint16, queueSize int) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			fmt.Println(err)
-			continue
+			return // listener closed
 		}
 		key := "TCP:" + conn.RemoteAddr().String()
 
 		tcpConn := &tcpConnection{
-			conn.(*net.TCPConn),
-			NewMessageQueue(1024),
-			NETWORK_FLARM_NMEA,
-			key,
+			Conn:       conn.(*net.TCPConn),
+			Queue:      NewMessageQueue(queueSize),
+			Capability: capability,
+			Key:        key,
 		}
+		netMutex.Lock()
 		clientConnections[tcpConn.GetConnectionKey()] = tcpConn
+		netMutex.Unlock()
 		go connectionWriter(tcpConn)
 	}
 }
 
+// Raw GPS NMEA stream on globalSettings.GPSPassthroughTCPPort, so other devices can share the stratux GPS.
+func tcpGPSPassthroughListener() {
+	tcpOutputListener("GPS passthrough", func() int { return globalSettings.GPSPassthroughTCPPort }, NETWORK_GPS_NMEA_RAW, 1024)
+}
+
+// Raw UAT frames in dump978 format ("-<hex>;rs=..;ss=..;") on globalSettings.UATRawOutputPort, for uat2json & co.
+func tcpUATRawListener() {
+	tcpOutputListener("UAT raw output", func() int { return globalSettings.UATRawOutputPort }, NETWORK_UAT_RAW, 1024)
+}
 
 /* Server that can be used to feed NMEA data to, e.g. to connect OGN Tracker wirelessly */
 func tcpNMEAInListener() {
 	ln, err := net.Listen("tcp", ":30011")
 	if err != nil {
-		log.Printf(err.Error())
+		logErrorf("network", "%s", err.Error())
 		return
 	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf(err.Error())
+			logErrorf("network", "%s", err.Error())
 			continue
 		}
 		go handleNmeaInConnection(conn)
@@ -291,7 +358,7 @@ func getNetworkStats() {
 				for _, msg := range queueDump {
 					queueBytes += len(msg.([]byte))
 				}
-				log.Printf("On  %s:%d,  Queue length = %d messages / %d bytes\n", netconn.Ip, netconn.Port, len(queueDump), queueBytes)
+				logDebugf("network", "On  %s:%d,  Queue length = %d messages / %d bytes", netconn.Ip, netconn.Port, len(queueDump), queueBytes)
 			}
 			ipAndPort := strings.Split(k, ":")
 			if len(ipAndPort) != 2 {
@@ -310,51 +377,192 @@ func getNetworkStats() {
 	}
 }
 
-// See who has a DHCP lease and make a UDP connection to each of them.
+/*
+	outputInterfaceNets().
+		Local IPv4 addresses (with their networks) of the interface a network output is bound to: an interface name
+		like "eth0", or a local IP. Empty = all interfaces that are up, except loopback.
+*/
+func outputInterfaceNets(iface string) ([]*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	bindIP := net.ParseIP(iface)
+	nets := make([]*net.IPNet, 0)
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || (len(iface) == 0 && i.Flags&net.FlagLoopback != 0) {
+			continue
+		}
+		if len(iface) > 0 && bindIP == nil && i.Name != iface {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok && n.IP.To4() != nil && (bindIP == nil || n.IP.Equal(bindIP)) {
+				nets = append(nets, &net.IPNet{IP: n.IP.To4(), Mask: n.Mask})
+			}
+		}
+	}
+	if len(iface) > 0 && len(nets) == 0 {
+		return nil, fmt.Errorf("no IPv4 address on '%s'", iface)
+	}
+	return nets, nil
+}
+
+// Directed broadcast address of n, nil for point-to-point networks (e.g. WireGuard /32).
+func broadcastAddr(n *net.IPNet) net.IP {
+	ones, bits := n.Mask.Size()
+	if bits != 32 || ones >= 31 {
+		return nil
+	}
+	bcast := make(net.IP, 4)
+	for i := range bcast {
+		bcast[i] = n.IP[i] | ^n.Mask[i]
+	}
+	return bcast
+}
+
+// Local address of the network in nets that contains ip, nil if none does.
+func localIPFor(nets []*net.IPNet, ip string) net.IP {
+	remote := net.ParseIP(ip)
+	for _, n := range nets {
+		if n.Contains(remote) {
+			return n.IP
+		}
+	}
+	return nil
+}
+
+// UDP socket to ipAndPort, with the source address localIP (if set) and bound to the interface iface (if it's a name).
+func dialOutput(ipAndPort string, localIP net.IP, iface string) (*net.UDPConn, error) {
+	d := net.Dialer{}
+	if localIP != nil {
+		d.LocalAddr = &net.UDPAddr{IP: localIP}
+	}
+	if len(iface) > 0 && net.ParseIP(iface) == nil {
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+			})
+			return err
+		}
+	}
+	conn, err := d.Dial("udp", ipAndPort)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+/*
+	refreshConnectedClients().
+		See who has a DHCP lease (or is in the ARP table, or was added manually, see clientmanager.go) and make a UDP
+		connection to each of them, for each of the client's outputs: globalSettings.NetworkOutputs or the ones
+		assigned to the client in globalSettings.NetworkClients.
+		Outputs bound to an interface only send to clients on that interface's networks. Broadcast outputs get one
+		connection per network, sending to its broadcast address.
+*/
 func refreshConnectedClients() {
 	validConnections := make(map[string]bool)
 	t, err := getDHCPLeases()
 	if err != nil {
-		log.Printf("getDHCPLeases(): %s\n", err.Error())
+		logInfof("network", "getDHCPLeases(): %s", err.Error())
 		return
 	}
 	netMutex.Lock()
 	defer netMutex.Unlock()
 
 	dhcpLeases = t
+	addIPv6Neighbors(dhcpLeases)
+	addManualNetworkClients(dhcpLeases)
+
+	connect := func(networkOutput networkConnection, ip string, localIP net.IP, hostname string) {
+		ipAndPort := net.JoinHostPort(ip, strconv.Itoa(int(networkOutput.Port)))
+		validConnections[ipAndPort] = true
+		if _, ok := clientConnections[ipAndPort]; ok {
+			return
+		}
+		logInfof("network", "client connected: %s (%s).", ipAndPort, hostname)
+		outConn, err := dialOutput(ipAndPort, localIP, networkOutput.Interface)
+		if err != nil {
+			logInfof("network", "DialUDP(%s): %s", ipAndPort, err.Error())
+			delete(validConnections, ipAndPort)
+			return
+		}
+		clientConnections[ipAndPort] = &networkConnection{
+			Conn: outConn,
+			Ip: ip,
+			Port: networkOutput.Port,
+			Capability: networkOutput.Capability,
+			Interface: networkOutput.Interface,
+			Broadcast: networkOutput.Broadcast,
+			Queue: NewMessageQueue(1024),
+			rateLimits: networkClientRateLimits(ip),
+			ahrs: networkClientAHRS(ip),
+		}
+		go connectionWriter(clientConnections[ipAndPort])
+	}
+
+	outputNets := make(map[int][]*net.IPNet)
+	for i, networkOutput := range globalSettings.NetworkOutputs {
+		if len(networkOutput.Interface) > 0 || networkOutput.Broadcast {
+			nets, err := outputInterfaceNets(networkOutput.Interface)
+			if err != nil {
+				// e.g. usb0 not plugged in yet. Retried on the next refresh
+				if globalSettings.DEBUG {
+					logDebugf("network", "network output %d: %s", networkOutput.Port, err.Error())
+				}
+				outputNets[i] = nil
+				continue
+			}
+			outputNets[i] = nets
+		}
+		if networkOutput.Broadcast {
+			for _, n := range outputNets[i] {
+				if bcast := broadcastAddr(n); bcast != nil {
+					connect(networkOutput, bcast.String(), n.IP, "broadcast")
+				}
+			}
+			// IPv6-only segments have no broadcast, send to the link-local all-nodes group instead
+			for _, iface := range ipv6OnlyInterfaces(networkOutput.Interface) {
+				connect(networkOutput, "ff02::1%"+iface, nil, "multicast")
+			}
+		}
+	}
 	// Client connected that wasn't before.
 	for ip, hostname := range dhcpLeases {
-		for _, networkOutput := range globalSettings.NetworkOutputs {
-			ipAndPort := ip + ":" + strconv.Itoa(int(networkOutput.Port))
-			if _, ok := clientConnections[ipAndPort]; !ok {
-				log.Printf("client connected: %s:%d (%s).\n", ip, networkOutput.Port, hostname)
-				addr, err := net.ResolveUDPAddr("udp", ipAndPort)
-				if err != nil {
-					log.Printf("ResolveUDPAddr(%s): %s\n", ipAndPort, err.Error())
+		if outputs, ok := networkClientOutputs(ip); ok {
+			for _, networkOutput := range outputs {
+				connect(networkOutput, ip, nil, hostname)
+			}
+			continue
+		}
+		for i, networkOutput := range globalSettings.NetworkOutputs {
+			if networkOutput.Broadcast {
+				continue
+			}
+			var localIP net.IP
+			if len(networkOutput.Interface) > 0 {
+				nets, ok := outputNets[i]
+				if !ok || nets == nil {
 					continue
 				}
-				outConn, err := net.DialUDP("udp", nil, addr)
-				if err != nil {
-					log.Printf("DialUDP(%s): %s\n", ipAndPort, err.Error())
+				if localIP = localIPFor(nets, ip); localIP == nil && !isIPv6OnInterface(ip, networkOutput.Interface) {
 					continue
 				}
-				clientConnections[ipAndPort] = &networkConnection{
-					Conn: outConn,
-					Ip: ip,
-					Port: networkOutput.Port,
-					Capability: networkOutput.Capability,
-					Queue: NewMessageQueue(1024),
-				}
-				go connectionWriter(clientConnections[ipAndPort])
 			}
-			validConnections[ipAndPort] = true
+			connect(networkOutput, ip, localIP, hostname)
 		}
 	}
 	// Client that was connected before that isn't.
 	for ipAndPort, netconn := range clientConnections {
 		if conn, ok := netconn.(*networkConnection); ok {
 			if _, valid := validConnections[ipAndPort]; !valid {
-				log.Printf("removed connection %s.\n", ipAndPort)
+				logInfof("network", "removed connection %s.", ipAndPort)
 				conn.Queue.Close()
 				conn.Conn.Close()
 				delete(clientConnections, ipAndPort)
@@ -363,6 +571,20 @@ func refreshConnectedClients() {
 	}
 }
 
+// Drops all UDP connections and sets them up again, e.g. after globalSettings.NetworkOutputs changed.
+func resetNetworkOutputs() {
+	netMutex.Lock()
+	for ipAndPort, netconn := range clientConnections {
+		if conn, ok := netconn.(*networkConnection); ok {
+			conn.Queue.Close()
+			conn.Conn.Close()
+			delete(clientConnections, ipAndPort)
+		}
+	}
+	netMutex.Unlock()
+	refreshConnectedClients()
+}
+
 func onConnectionClosed(conn connection) {
 	if conn == nil {
 		return
@@ -380,11 +602,11 @@ func collectMessages(conn connection) []byte {
 	for {
 		if conn.IsSleeping() || conn.IsThrottled() {
 			_, prio := conn.MessageQueue().PeekFirst()
-			if conn.IsSleeping() && prio > -10 {
+			if conn.IsSleeping() && prio > MSGPRIO_HEARTBEAT {
 				// If we are sleeping, only send heartbeats do detect a client becoming available
 				return data
 			}
-			if conn.IsThrottled() && prio > 0 {
+			if conn.IsThrottled() && prio > MSGPRIO_TRAFFIC {
 				// if throttled, only send important stuff (position, status, crucial traffic)
 				return data
 			}
@@ -434,13 +656,22 @@ func connectionWriter(connection connection) {
 			totalNetworkMessagesSent++
 			globalStatus.NetworkDataMessagesSent++
 			globalStatus.NetworkDataBytesSent += uint64(written)
+			if nc, ok := connection.(*networkConnection); ok {
+				atomic.AddUint64(&nc.messagesSent, 1)
+				atomic.AddUint64(&nc.bytesSent, uint64(written))
+			}
 			//time.Sleep(532 * time.Millisecond)
 		}
 	}
 }
 
 
-func sendMsg(msg []byte, msgType uint8, maxAge time.Duration, priority int32) {
+func sendMsg(msg []byte, msgType uint16, maxAge time.Duration, priority int32) {
+	sendTrafficMsg(msg, msgType, maxAge, priority, nil)
+}
+
+// Like sendMsg, but only to the connections whose traffic filter accepts ti (see trafficoutputfilter.go). nil = all.
+func sendTrafficMsg(msg []byte, msgType uint16, maxAge time.Duration, priority int32, ti *TrafficInfo) {
 	if (msgType & NETWORK_GDL90_STANDARD) != 0 {
 		// It's a GDL90 message - do ui broadcast.
 		networkGDL90Chan <- msg
@@ -455,10 +686,49 @@ func sendMsg(msg []byte, msgType uint8, maxAge time.Duration, priority int32) {
 		if (conn.Capabilities() & msgType) == 0 {
 			continue
 		}
+		// NMEA outputs may only want a subset of the sentences.
+		if msgType == NETWORK_FLARM_NMEA && !isNMEASentenceSelected(conn, msg) {
+			continue
+		}
+		if ti != nil && !isTrafficSelected(conn, ti) {
+			continue
+		}
+		// Clients with their own AHRS rate and format get it from ahrsOutputSender().
+		if msgType == NETWORK_AHRS_GDL90 && hasOwnAHRSOutput(conn) {
+			continue
+		}
+		if !isRateAllowed(conn, msgType, msg) {
+			continue
+		}
 		conn.MessageQueue().Put(priority, maxAge, msg)
 	}
 }
 
+// Relays a UAT uplink frame, filtered by the product selection of each connection (see uplinkoutputfilter.go).
+func sendUplinkMsg(frame []byte, maxAge time.Duration, priority int32) {
+	msg := makeRelayMessage(MSGTYPE_UPLINK, frame)
+	networkGDL90Chan <- msg
+
+	netMutex.Lock()
+	defer netMutex.Unlock()
+
+	for _, conn := range clientConnections {
+		if (conn.Capabilities() & NETWORK_GDL90_STANDARD) == 0 {
+			continue
+		}
+		connMsg := msg
+		if classes, ok := uplinkOutputFilter(conn); ok {
+			if connMsg = filterUplinkMessage(classes, frame); connMsg == nil {
+				continue
+			}
+		}
+		if !isRateAllowed(conn, NETWORK_GDL90_STANDARD, connMsg) {
+			continue
+		}
+		conn.MessageQueue().Put(priority, maxAge, connMsg)
+	}
+}
+
 func sendGDL90(msg []byte, maxAge time.Duration, priority int32) {
 	sendMsg(msg, NETWORK_GDL90_STANDARD, maxAge, priority)
 }
@@ -482,23 +752,27 @@ func monitorDHCPLeases() {
 	}
 }
 
-func icmpEchoSender(c *icmp.PacketConn) {
+// Pings the clients of the IP version of c.
+func icmpEchoSender(c *icmp.PacketConn, v6 bool) {
+	var echoType icmp.Type = ipv4.ICMPTypeEcho
+	if v6 {
+		echoType = ipv6.ICMPTypeEchoRequest
+	}
 	timer := time.NewTicker(5 * time.Second)
 	for {
 		<-timer.C
 		netMutex.Lock()
 		// Collect IPs.
 		ips := make(map[string]bool)
-		for k, conn := range clientConnections {
-			if _, ok := conn.(*networkConnection); ok {
-				ipAndPort := strings.Split(k, ":")
-				ips[ipAndPort[0]] = true
+		for _, conn := range clientConnections {
+			if netconn, ok := conn.(*networkConnection); ok && !netconn.Broadcast && strings.Contains(netconn.Ip, ":") == v6 {
+				ips[netconn.Ip] = true
 			}
 		}
 		// Send to all IPs.
 		for ip := range ips {
 			wm := icmp.Message{
-				Type: ipv4.ICMPTypeEcho, Code: 0,
+				Type: echoType, Code: 0,
 				Body: &icmp.Echo{
 					ID: os.Getpid() & 0xffff, Seq: 1,
 					Data: []byte("STRATUX"),
@@ -506,11 +780,15 @@ func icmpEchoSender(c *icmp.PacketConn) {
 			}
 			wb, err := wm.Marshal(nil)
 			if err != nil {
-				log.Printf("couldn't send ICMP Echo: %s\n", err.Error())
+				logWarnf("network", "couldn't send ICMP Echo: %s", err.Error())
 				continue
 			}
-			if _, err := c.WriteTo(wb, &net.IPAddr{IP: net.ParseIP(ip)}); err != nil {
-				log.Printf("couldn't send ICMP Echo: %s\n", err.Error())
+			addr, err := net.ResolveIPAddr("ip", ip) // keeps the zone of link-local IPv6 addresses
+			if err != nil {
+				continue
+			}
+			if _, err := c.WriteTo(wb, addr); err != nil {
+				logWarnf("network", "couldn't send ICMP Echo: %s", err.Error())
 				continue
 			}
 			totalNetworkMessagesSent++
@@ -535,9 +813,9 @@ func getNetworkConn(ipAndPort string) *networkConnection {
 func getNetworkConnsByIp(ip string) []*networkConnection {
 	conns := make([]*networkConnection, 0)
 	// Search for any connection with the same IP to match ping responses
-	for key, conn := range clientConnections {
+	for _, conn := range clientConnections {
 		if netconn, ok := conn.(*networkConnection); ok {
-			if strings.HasPrefix(key, ip) {
+			if netconn.Ip == ip {
 				conns = append(conns, netconn)
 			}
 		}
@@ -568,21 +846,34 @@ func closeSerial(dev string) {
 
 // Monitor clients going in/out of sleep mode via ICMP unreachable packets.
 func sleepMonitor() {
-	c, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	go icmpMonitor(true)
+	icmpMonitor(false)
+}
+
+func icmpMonitor(v6 bool) {
+	network, address, proto := "ip4:icmp", "0.0.0.0", 1
+	var echoReply, unreachable icmp.Type = ipv4.ICMPTypeEchoReply, ipv4.ICMPTypeDestinationUnreachable
+	portOffset := 26 // unused (4) + IPv4 header (20) + UDP source port (2)
+	if v6 {
+		network, address, proto = "ip6:ipv6-icmp", "::", 58
+		echoReply, unreachable = ipv6.ICMPTypeEchoReply, ipv6.ICMPTypeDestinationUnreachable
+		portOffset = 46 // unused (4) + IPv6 header (40) + UDP source port (2)
+	}
+	c, err := icmp.ListenPacket(network, address)
 	if err != nil {
-		log.Printf("error listening for udp - sending data to all ports for all connected clients. err: %s", err)
+		logErrorf("network", "error listening for udp - sending data to all ports for all connected clients. err: %s", err)
 		return
 	}
-	go icmpEchoSender(c)
+	go icmpEchoSender(c, v6)
 	defer c.Close()
 	for {
 		buf := make([]byte, 1500)
 		n, peer, err := c.ReadFrom(buf)
 		if err != nil {
-			log.Printf("%s\n", err.Error())
+			logInfof("network", "%s", err.Error())
 			continue
 		}
-		msg, err := icmp.ParseMessage(1, buf[:n])
+		msg, err := icmp.ParseMessage(proto, buf[:n])
 		if err != nil {
 			continue
 		}
@@ -590,7 +881,7 @@ func sleepMonitor() {
 		ip := peer.String()
 
 		// Look for echo replies, mark it as received.
-		if msg.Type == ipv4.ICMPTypeEchoReply {
+		if msg.Type == echoReply {
 			for _, conn := range getNetworkConnsByIp(ip) {
 				conn.LastPingResponse = stratuxClock.Time
 			}
@@ -598,21 +889,21 @@ func sleepMonitor() {
 		}
 
 		// Only deal with ICMP Unreachable packets (since that's what iOS and Android seem to be sending whenever the apps are not available).
-		if msg.Type != ipv4.ICMPTypeDestinationUnreachable {
+		if msg.Type != unreachable {
 			continue
 		}
 		// Packet parsing.
-		mb, err := msg.Body.Marshal(1)
+		mb, err := msg.Body.Marshal(proto)
 		if err != nil {
 			continue
 		}
-		if len(mb) < 28 {
+		if len(mb) < portOffset+2 {
 			continue
 		}
 
 		// The unreachable port.
-		port := (uint16(mb[26]) << 8) | uint16(mb[27])
-		ipAndPort := ip + ":" + strconv.Itoa(int(port))
+		port := (uint16(mb[portOffset]) << 8) | uint16(mb[portOffset+1])
+		ipAndPort := net.JoinHostPort(ip, strconv.Itoa(int(port)))
 		conn := getNetworkConn(ipAndPort)
 		if conn != nil {
 			conn.LastUnreachable = stratuxClock.Time
@@ -646,10 +937,17 @@ func initNetwork() {
 	refreshConnectedClients()
 	go monitorDHCPLeases() // Checks for new UDP connections
 	go sleepMonitor()
+	go keepAliveMonitor()
+	go keepAliveAckListener()
 	go networkStatsCounter()
 	go serialOutWatcher() // Check for new Serial connections
 	go networkOutWatcher() // Pushes to websocket
+	go tcpGDL90OutListener()
 	go tcpNMEAOutListener()
+	go tcpGPSPassthroughListener()
+	go beastOutputListener()
+	go tcpUATRawListener()
+	go sbsOutputListener()
 	go tcpNMEAInListener()
 	go getNetworkStats()
 }
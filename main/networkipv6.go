@@ -0,0 +1,177 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	networkipv6.go: IPv6 clients of the UDP outputs, for routers with IPv6-only client segments.
+		Clients are discovered from the kernel neighbor table (ip -6 neigh), one address per device, and only if the
+		device isn't already a client over IPv4 (DHCP lease or ARP entry with the same MAC), so dual-stack devices
+		don't get every message twice. Link-local addresses are kept with their zone, e.g. "fe80::1%wlan0".
+		Broadcast outputs send to the all-nodes group ff02::1 on interfaces without IPv4 address.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// MACs of the IPv4 clients, from the DHCP leases and the ARP table.
+func ipv4ClientMACs() map[string]bool {
+	macs := make(map[string]bool)
+	if dat, err := ioutil.ReadFile(dhcp_lease_file); err == nil {
+		for _, line := range strings.Split(string(dat), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 4 {
+				macs[strings.ToLower(fields[1])] = true
+			}
+		}
+	}
+	if dat, err := ioutil.ReadFile("/proc/net/arp"); err == nil {
+		for _, line := range strings.Split(string(dat), "\n") {
+			// IP address, HW type, Flags, HW address, Mask, Device
+			if fields := strings.Fields(line); len(fields) >= 6 && fields[3] != "00:00:00:00:00:00" {
+				macs[strings.ToLower(fields[3])] = true
+			}
+		}
+	}
+	return macs
+}
+
+// Parses the output of "ip -6 neigh show" into MAC -> address. Routers and unresolved entries are skipped, a global
+// address is preferred over the link-local one.
+func parseIPv6Neighbors(out string) map[string]string {
+	neighbors := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		// fe80::1c2b:3dff:fe4e:5f60 dev wlan0 lladdr 1e:2b:3d:4e:5f:60 REACHABLE
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil || ip.To4() != nil || ip.IsMulticast() || ip.IsLoopback() {
+			continue
+		}
+		var dev, mac string
+		router := false
+		for i := 1; i < len(fields); i++ {
+			switch fields[i] {
+			case "dev":
+				if i+1 < len(fields) {
+					dev = fields[i+1]
+				}
+			case "lladdr":
+				if i+1 < len(fields) {
+					mac = strings.ToLower(fields[i+1])
+				}
+			case "router":
+				router = true
+			case "FAILED", "INCOMPLETE":
+				mac = ""
+			}
+		}
+		if router || len(mac) == 0 || len(dev) == 0 || dev == "lo" {
+			continue
+		}
+		addr := ip.String()
+		if ip.IsLinkLocalUnicast() {
+			addr += "%" + dev
+		}
+		// Keep the first global address, replace a link-local one
+		if prev, ok := neighbors[mac]; ok && (!strings.Contains(prev, "%") || ip.IsLinkLocalUnicast()) {
+			continue
+		}
+		neighbors[mac] = addr
+	}
+	return neighbors
+}
+
+// Adds the IPv6-only clients to the discovered ones.
+func addIPv6Neighbors(clients map[string]string) {
+	out, err := exec.Command("ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return
+	}
+	ipv4MACs := ipv4ClientMACs()
+	for mac, ip := range parseIPv6Neighbors(string(out)) {
+		if _, ok := clients[ip]; !ipv4MACs[mac] && !ok {
+			clients[ip] = ""
+		}
+	}
+}
+
+// Up, multicast capable interfaces with IPv6 but without IPv4 address (except loopback), restricted to iface if a
+// network output is bound to one.
+func ipv6OnlyInterfaces(iface string) []string {
+	result := make([]string, 0)
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return result
+	}
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagMulticast == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if len(iface) > 0 && i.Name != iface {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		has4, has6 := false, false
+		for _, addr := range addrs {
+			if n, ok := addr.(*net.IPNet); ok {
+				if n.IP.To4() != nil {
+					has4 = true
+				} else {
+					has6 = true
+				}
+			}
+		}
+		if has6 && !has4 {
+			result = append(result, i.Name)
+		}
+	}
+	return result
+}
+
+// True if ip is an IPv6 address reachable over iface: link-local with that zone, or in a network of iface.
+func isIPv6OnInterface(ip string, iface string) bool {
+	addr, zone := ip, ""
+	if i := strings.Index(ip, "%"); i >= 0 {
+		addr, zone = ip[:i], ip[i+1:]
+	}
+	remote := net.ParseIP(addr)
+	if remote == nil || remote.To4() != nil {
+		return false
+	}
+	if len(zone) > 0 {
+		return zone == iface
+	}
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return false
+	}
+	addrs, err := i.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && n.Contains(remote) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses a client IP, IPv4 or IPv6 with an optional zone. nil if it's none.
+func parseClientIP(ip string) net.IP {
+	if i := strings.Index(ip, "%"); i >= 0 && strings.Contains(ip, ":") {
+		ip = ip[:i]
+	}
+	return net.ParseIP(ip)
+}
@@ -5,17 +5,26 @@
 	as part of this header.
 
 	networksettings.go: Management functions for network settings (wpa_supplicant, IP, DHCP)
+		In client mode (WifiModeClient) wlan0 joins one of the WiFiClientNetworks, wifiClientWatchdog() brings up the
+		access point on ap0 as fallback if none of them can be joined and takes it down again once connected.
+		In AP+Client mode a second WiFi adapter (wlan1) is used for the client connection if present, the AP stays on
+		wlan0 with its own channel. Otherwise the onboard adapter runs both (ap0 + wlan0, AP/STA concurrency).
+			/getWiFiStatus                        mode, client connection (SSID, IP, signal) and fallback AP state
 */
 
 package main
 
 import (
-	"log"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -24,8 +33,12 @@ const (
 	WifiModeAp = 0
 	WifiModeDirect = 1
 	WifiModeApClient = 2
+	WifiModeClient = 3
 )
 
+// Time without connection to one of the client networks until the fallback AP is started in WifiModeClient
+const wifiClientFallbackTimeout = 60 * time.Second
+
 // NetworkTemplateParams is passed to the template engine to write settings
 type NetworkTemplateParams struct {
 	WiFiMode         int
@@ -40,6 +53,7 @@ type NetworkTemplateParams struct {
 	WiFiPassPhrase   string
 	WiFiClientNetworks []wifiClientNetwork
 	WiFiInternetPassThroughEnabled bool
+	WiFiSecondAdapter bool // AP+Client with the client connection on wlan1
 }
 type wifiClientNetwork struct {
 	SSID     string
@@ -48,6 +62,22 @@ type wifiClientNetwork struct {
 
 var hasChanged bool
 
+type WiFiStatus struct {
+	Mode          int
+	Connected     bool    // wlan0 is associated with one of the WiFiClientNetworks (WifiModeApClient, WifiModeClient)
+	SSID          string
+	IPAddress     string
+	RSSI          int     // dBm, 0 = unknown
+	ClientIface   string  // interface of the client connection, wlan1 if a second adapter is used
+	FallbackAP    bool    // ap0 started because no client network could be joined (WifiModeClient)
+	LastConnected float64 // s since the client connection was last seen, -1 = never connected
+}
+
+var wifiStatus WiFiStatus
+var wifiStatusMutex sync.Mutex
+var wifiClientLastConnected time.Time
+var wifiClientWaitSince time.Time // connected, started or reconfigured; the fallback AP starts wifiClientFallbackTimeout later
+
 
 func setWifiCountry(countryCode string) {
 	if countryCode != globalSettings.WiFiCountry {
@@ -92,7 +122,7 @@ func setWifiIPAddress(ip string) {
 			hasChanged = true
 		}
 	} else {
-		log.Printf("Ignoring invalid IP Address: " + ip)
+		logWarnf("wifi", "Ignoring invalid IP Address: %s", ip)
 	}
 }
 
@@ -126,6 +156,32 @@ func setWifiClientNetworks(networks []wifiClientNetwork) {
 	}
 }
 
+// Parses the value of the WiFiClientNetworks setting. A network without "Password" keeps the stored one, so the
+// client networks can be changed without sending the credentials again.
+func parseWifiClientNetworks(val []interface{}) []wifiClientNetwork {
+	var networks = make([]wifiClientNetwork, 0)
+	for _, rawNetwork := range val {
+		network, ok := rawNetwork.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ssid, _ := network["SSID"].(string)
+		if ssid == "" {
+			continue
+		}
+		password, ok := network["Password"].(string)
+		if !ok {
+			for _, stored := range globalSettings.WiFiClientNetworks {
+				if stored.SSID == ssid {
+					password = stored.Password
+				}
+			}
+		}
+		networks = append(networks, wifiClientNetwork{ssid, password})
+	}
+	return networks
+}
+
 func setWifiInternetPassthroughEnabled(enabled bool) {
 	if globalSettings.WiFiInternetPassThroughEnabled != enabled {
 		globalSettings.WiFiInternetPassThroughEnabled = enabled;
@@ -133,6 +189,134 @@ func setWifiInternetPassthroughEnabled(enabled bool) {
 	}
 }
 
+func hasSecondWifiAdapter() bool {
+	_, err := os.Stat("/sys/class/net/wlan1")
+	return err == nil
+}
+
+// Interface of the client connection in the given WiFi mode.
+func wifiClientIface(mode int) string {
+	if mode == WifiModeApClient && hasSecondWifiAdapter() {
+		return "wlan1"
+	}
+	return "wlan0"
+}
+
+// Queries the client connection of the interface from wpa_supplicant.
+func wpaClientStatus(iface string) (connected bool, ssid string, ip string, rssi int) {
+	out, err := exec.Command("wpa_cli", "-i", iface, "status").Output()
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "wpa_state":
+			connected = kv[1] == "COMPLETED"
+		case "ssid":
+			ssid = kv[1]
+		case "ip_address":
+			ip = kv[1]
+		}
+	}
+	if !connected {
+		return false, "", "", 0
+	}
+	if out, err = exec.Command("wpa_cli", "-i", iface, "signal_poll").Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "RSSI=") {
+				rssi, _ = strconv.Atoi(strings.TrimSpace(line[5:]))
+			}
+		}
+	}
+	return
+}
+
+func runNetworkCommand(name string, args ...string) {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		logErrorf("wifi", "%s %s: %s %s", name, strings.Join(args, " "), err.Error(), strings.TrimSpace(string(out)))
+	}
+}
+
+// The fallback AP uses the ap0 interface configured in /etc/network/interfaces, as the AP+Client mode does.
+func startFallbackAP() {
+	logInfof("wifi", "no client network found for %s, starting access point", wifiClientFallbackTimeout)
+	runNetworkCommand("iw", "phy0", "interface", "add", "ap0", "type", "__ap")
+	runNetworkCommand("ifup", "ap0")
+}
+
+func stopFallbackAP() {
+	logInfof("wifi", "connected to client network, stopping access point")
+	runNetworkCommand("ifdown", "ap0")
+	runNetworkCommand("ip", "link", "set", "ap0", "down")
+	runNetworkCommand("iw", "dev", "ap0", "del")
+	// dnsmasq only serves the AP, don't leave it running on the client network
+	runNetworkCommand("killall", "dnsmasq")
+}
+
+// Monitors the client connection and starts/stops the fallback AP in WifiModeClient.
+func wifiClientWatchdog() {
+	ticker := time.NewTicker(5 * time.Second)
+	// The network configuration is only written when the settings change. Rewrite it if a second adapter was
+	// plugged in or removed since then.
+	if globalSettings.WiFiMode == WifiModeApClient {
+		interfaces, err := ioutil.ReadFile("/etc/network/interfaces")
+		if err == nil && strings.Contains(string(interfaces), "iface wlan1") != hasSecondWifiAdapter() {
+			logInfof("wifi", "second adapter added or removed, rewriting network configuration")
+			applyNetworkSettings(true, false)
+		}
+	}
+	wifiStatusMutex.Lock()
+	wifiClientWaitSince = time.Now()
+	wifiStatusMutex.Unlock()
+	for {
+		wifiStatusMutex.Lock()
+		mode := globalSettings.WiFiMode
+		fallback := wifiStatus.FallbackAP
+		status := WiFiStatus{Mode: mode, FallbackAP: fallback, LastConnected: -1}
+		if mode == WifiModeClient || mode == WifiModeApClient {
+			status.ClientIface = wifiClientIface(mode)
+			status.Connected, status.SSID, status.IPAddress, status.RSSI = wpaClientStatus(status.ClientIface)
+			if status.Connected {
+				wifiClientLastConnected = time.Now()
+				wifiClientWaitSince = wifiClientLastConnected
+			}
+		}
+		if !wifiClientLastConnected.IsZero() {
+			status.LastConnected = time.Since(wifiClientLastConnected).Seconds()
+		}
+		if mode != WifiModeClient {
+			// the reconfiguration removed ap0 already
+			status.FallbackAP = false
+		} else if status.Connected && fallback {
+			stopFallbackAP()
+			status.FallbackAP = false
+		} else if !status.Connected && !fallback && time.Since(wifiClientWaitSince) > wifiClientFallbackTimeout {
+			startFallbackAP()
+			status.FallbackAP = true
+		}
+		wifiStatus = status
+		wifiStatusMutex.Unlock()
+		<-ticker.C
+	}
+}
+
+// AJAX call - /getWiFiStatus. State of the WiFi client connection and fallback AP.
+func handleWiFiStatusGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	wifiStatusMutex.Lock()
+	statusJSON, err := json.Marshal(&wifiStatus)
+	wifiStatusMutex.Unlock()
+	if err != nil {
+		logErrorf("wifi", "Error sending WiFi status JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
 
 // if onlyWriteFiles is true, we only write the config files. Otherwise we also reconfigure the network
 // Also, if we only write the files, this function runs synchroneously. Otherwise the long-running network reconfiguration is done async.
@@ -144,7 +328,7 @@ func applyNetworkSettings(force bool, onlyWriteFiles bool) {
 
 	// Prepare all template strings and write settings files, then ifdown/ifup wlan0
 	ipAddr := globalSettings.WiFiIPAddress
-	log.Printf("Applying new network settings for IP %s", ipAddr);
+	logInfof("wifi", "Applying new network settings for IP %s", ipAddr);
 	if ipAddr == "" {
 		ipAddr = "192.168.10.1"
 	}
@@ -173,6 +357,7 @@ func applyNetworkSettings(force bool, onlyWriteFiles bool) {
 	tplSettings.WiFiDirectPin = globalSettings.WiFiDirectPin
 	tplSettings.WiFiClientNetworks = globalSettings.WiFiClientNetworks
 	tplSettings.WiFiInternetPassThroughEnabled = globalSettings.WiFiInternetPassThroughEnabled
+	tplSettings.WiFiSecondAdapter = wifiClientIface(tplSettings.WiFiMode) == "wlan1"
 	
 	if tplSettings.WiFiChannel == 0 {
 		tplSettings.WiFiChannel = 1
@@ -190,12 +375,20 @@ func applyNetworkSettings(force bool, onlyWriteFiles bool) {
 		if !onlyWriteFiles {
 			cmd := exec.Command("ifdown", "wlan0")
 			if err := cmd.Start(); err != nil {
-				log.Printf("Error shutting down WiFi: %s\n", err.Error())
+				logErrorf("wifi", "Error shutting down WiFi: %s", err.Error())
 			}
 			if err := cmd.Wait(); err != nil {
-				log.Printf("Error shutting down WiFi: %s\n", err.Error())
+				logErrorf("wifi", "Error shutting down WiFi: %s", err.Error())
+			}
+			if hasSecondWifiAdapter() {
+				runNetworkCommand("ifdown", "wlan1")
 			}
 		}
+		// ifdown removed a fallback AP, give the client connection time to come up before starting it again
+		wifiStatusMutex.Lock()
+		wifiStatus.FallbackAP = false
+		wifiClientWaitSince = time.Now()
+		wifiStatusMutex.Unlock()
 
 		overlayctl("unlock")
 		writeTemplate(STRATUX_HOME + "/cfg/stratux-dnsmasq.conf.template", "/overlay/robase/etc/dnsmasq.d/stratux-dnsmasq.conf", tplSettings)
@@ -207,10 +400,13 @@ func applyNetworkSettings(force bool, onlyWriteFiles bool) {
 		if !onlyWriteFiles {
 			cmd := exec.Command("ifup", "wlan0")
 			if err := cmd.Start(); err != nil {
-				log.Printf("Error starting WiFi: %s\n", err.Error())
+				logErrorf("wifi", "Error starting WiFi: %s", err.Error())
 			}
 			if err := cmd.Wait(); err != nil {
-				log.Printf("Error starting WiFi: %s\n", err.Error())
+				logErrorf("wifi", "Error starting WiFi: %s", err.Error())
+			}
+			if tplSettings.WiFiSecondAdapter {
+				runNetworkCommand("ifup", "wlan1")
 			}
 		}
 	}
@@ -229,20 +425,20 @@ func applyNetworkSettings(force bool, onlyWriteFiles bool) {
 func writeTemplate(tplFile string, outFile string, settings NetworkTemplateParams) {
 	configTemplate, err := template.ParseFiles(tplFile)
 	if err != nil {
-		log.Printf("Network Settings: Unable to read settings template %s: %s", tplFile, err)
+		logWarnf("wifi", "Network Settings: Unable to read settings template %s: %s", tplFile, err)
 		return
 	}
 
 	outputFile, err := os.Create(outFile)
 	defer outputFile.Close()
 	if err != nil {
-		log.Printf("Network Settings: Unable to open output file %s: %s", outFile, err)
+		logWarnf("wifi", "Network Settings: Unable to open output file %s: %s", outFile, err)
 		return
 	}
 
 	err = configTemplate.Execute(outputFile, settings)
 	if err != nil {
-		log.Printf("Network Settings: Unable to execute template substitution %s: %s", outFile, err)
+		logWarnf("wifi", "Network Settings: Unable to execute template substitution %s: %s", outFile, err)
 		return
 	}
 	outputFile.Sync()
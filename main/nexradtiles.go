@@ -0,0 +1,249 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nexradtiles.go: FIS-B NEXRAD (products 63 regional and 64 CONUS) rendered as slippy map tiles.
+		The decoded blocks (32x4 bins each, see uatparse/nexrad.go) of every uplink are kept until they are replaced
+		or older than NEXRAD_MAX_AGE, and rendered on request into transparent 256x256 PNGs in web mercator:
+			/nexrad/<regional|conus>/<z>/<x>/<y>.png   (XYZ scheme, y from the north)
+		Intensities 0 and 1 (below 20 dBZ) are transparent. /nexrad/status returns the number of blocks and the time of
+		the last update of each product.
+		Without FIS-B reception, regional blocks can also come from the internet (see internetweather.go).
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+const (
+	NEXRAD_PRODUCT_REGIONAL = 63
+	NEXRAD_PRODUCT_CONUS    = 64
+	NEXRAD_MAX_AGE          = 30 * time.Minute
+	NEXRAD_TILE_SIZE        = 256
+	NEXRAD_MAX_ZOOM         = 12
+	NEXRAD_BLOCK_COLS       = 32
+	NEXRAD_BLOCK_ROWS       = 4
+)
+
+// Colors of the intensity levels 0-7.
+var nexradColors = [8]color.NRGBA{
+	{},
+	{},
+	{0x00, 0xb0, 0x00, 0xb0}, // 20-30 dBZ
+	{0xf0, 0xe0, 0x00, 0xb0}, // 30-40 dBZ
+	{0xff, 0x90, 0x00, 0xc0}, // 40-45 dBZ
+	{0xe0, 0x00, 0x00, 0xc0}, // 45-50 dBZ
+	{0xa0, 0x00, 0x00, 0xd0}, // 50-55 dBZ
+	{0xe0, 0x00, 0xe0, 0xd0}, // above 55 dBZ
+}
+
+type nexradBlockKey struct {
+	product  uint32
+	scale    int
+	latNorth float64
+	lonWest  float64
+}
+
+type nexradBlock struct {
+	uatparse.NEXRADBlock
+	Received time.Time
+	Source   string // WX_SOURCE_FISB or WX_SOURCE_INTERNET
+}
+
+// Response of /nexrad/status.
+type NexradStatus struct {
+	Blocks     map[string]int
+	Sources    map[string]int // blocks per source
+	LastUpdate map[string]time.Time
+}
+
+var nexradBlocks = make(map[nexradBlockKey]*nexradBlock)
+var nexradLastUpdate = make(map[uint32]time.Time)
+var nexradLastCleanup time.Time
+var nexradMutex = &sync.RWMutex{}
+var nexradEmptyTile = makeEmptyNexradTile()
+
+func nexradProductName(product uint32) string {
+	if product == NEXRAD_PRODUCT_CONUS {
+		return "conus"
+	}
+	return "regional"
+}
+
+// Called for every decoded FIS-B frame from parseInput().
+func updateNexradBlocks(f *uatparse.UATFrame) {
+	if (f.Product_id != NEXRAD_PRODUCT_REGIONAL && f.Product_id != NEXRAD_PRODUCT_CONUS) || len(f.NEXRAD) == 0 {
+		return
+	}
+	nexradMutex.Lock()
+	defer nexradMutex.Unlock()
+	for _, b := range f.NEXRAD {
+		key := nexradBlockKey{b.Radar_Type, b.Scale, b.LatNorth, b.LonWest}
+		nexradBlocks[key] = &nexradBlock{b, stratuxClock.Time, WX_SOURCE_FISB}
+	}
+	nexradLastUpdate[f.Product_id] = time.Now()
+	cleanupNexradBlocks()
+}
+
+// Called with the blocks fetched by internetWeatherUpdater(). Blocks uplinked by FIS-B within
+// INTERNET_WX_FISB_PRIORITY are kept.
+func updateInternetNexradBlocks(blocks []uatparse.NEXRADBlock) {
+	nexradMutex.Lock()
+	defer nexradMutex.Unlock()
+	for _, b := range blocks {
+		key := nexradBlockKey{b.Radar_Type, b.Scale, b.LatNorth, b.LonWest}
+		if old, ok := nexradBlocks[key]; ok && old.Source == WX_SOURCE_FISB && stratuxClock.Since(old.Received) < INTERNET_WX_FISB_PRIORITY {
+			continue
+		}
+		nexradBlocks[key] = &nexradBlock{b, stratuxClock.Time, WX_SOURCE_INTERNET}
+	}
+	nexradLastUpdate[NEXRAD_PRODUCT_REGIONAL] = time.Now()
+	cleanupNexradBlocks()
+}
+
+// Requires nexradMutex.
+func cleanupNexradBlocks() {
+	if stratuxClock.Since(nexradLastCleanup) > time.Minute {
+		for key, b := range nexradBlocks {
+			if stratuxClock.Since(b.Received) > NEXRAD_MAX_AGE {
+				delete(nexradBlocks, key)
+			}
+		}
+		nexradLastCleanup = stratuxClock.Time
+	}
+}
+
+func makeEmptyNexradTile() []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, NEXRAD_TILE_SIZE, NEXRAD_TILE_SIZE)))
+	return buf.Bytes()
+}
+
+// Pixel position of a coordinate in web mercator at zoom z, relative to the tile.
+func nexradTilePixel(lat, lon float64, z, x, y int) (float64, float64) {
+	n := float64(uint(1)<<uint(z)) * NEXRAD_TILE_SIZE
+	lat = math.Max(-85.05, math.Min(85.05, lat))
+	latRad := lat * math.Pi / 180
+	px := (lon + 180) / 360 * n
+	py := (1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n
+	return px - float64(x*NEXRAD_TILE_SIZE), py - float64(y*NEXRAD_TILE_SIZE)
+}
+
+func fillNexradRect(img *image.NRGBA, x0, y0, x1, y1 float64, c color.NRGBA) {
+	r := image.Rect(int(math.Floor(x0)), int(math.Floor(y0)), int(math.Ceil(x1)), int(math.Ceil(y1))).Intersect(img.Bounds())
+	for py := r.Min.Y; py < r.Max.Y; py++ {
+		for px := r.Min.X; px < r.Max.X; px++ {
+			img.SetNRGBA(px, py, c)
+		}
+	}
+}
+
+// Renders the current blocks of a product into tile z/x/y. Returns nil if there is nothing to draw.
+func renderNexradTile(product uint32, z, x, y int) *image.NRGBA {
+	var img *image.NRGBA
+	nexradMutex.RLock()
+	defer nexradMutex.RUnlock()
+	for key, b := range nexradBlocks {
+		if key.product != product || stratuxClock.Since(b.Received) > NEXRAD_MAX_AGE {
+			continue
+		}
+		// Whole block outside of the tile?
+		bx0, by0 := nexradTilePixel(b.LatNorth, b.LonWest, z, x, y)
+		bx1, by1 := nexradTilePixel(b.LatNorth-b.Height, b.LonWest+b.Width, z, x, y)
+		if bx1 < 0 || by1 < 0 || bx0 >= NEXRAD_TILE_SIZE || by0 >= NEXRAD_TILE_SIZE {
+			continue
+		}
+		binWidth := b.Width / NEXRAD_BLOCK_COLS
+		binHeight := b.Height / NEXRAD_BLOCK_ROWS
+		for i, intensity := range b.Intensity {
+			if i >= NEXRAD_BLOCK_COLS*NEXRAD_BLOCK_ROWS {
+				break
+			}
+			if intensity > 7 || nexradColors[intensity].A == 0 {
+				continue
+			}
+			lat := b.LatNorth - float64(i/NEXRAD_BLOCK_COLS)*binHeight
+			lon := b.LonWest + float64(i%NEXRAD_BLOCK_COLS)*binWidth
+			x0, y0 := nexradTilePixel(lat, lon, z, x, y)
+			x1, y1 := nexradTilePixel(lat-binHeight, lon+binWidth, z, x, y)
+			if img == nil {
+				img = image.NewNRGBA(image.Rect(0, 0, NEXRAD_TILE_SIZE, NEXRAD_TILE_SIZE))
+			}
+			fillNexradRect(img, x0, y0, x1, y1, nexradColors[intensity])
+		}
+	}
+	return img
+}
+
+// /nexrad/<product>/<z>/<x>/<y>.png and /nexrad/status
+func handleNexradRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/nexrad/"), "/")
+	if len(parts) == 1 && parts[0] == "status" {
+		handleNexradStatusRequest(w, r)
+		return
+	}
+	if len(parts) != 4 || !strings.HasSuffix(parts[3], ".png") {
+		http.Error(w, "expected /nexrad/<regional|conus>/<z>/<x>/<y>.png", http.StatusNotFound)
+		return
+	}
+	var product uint32
+	switch parts[0] {
+	case "regional":
+		product = NEXRAD_PRODUCT_REGIONAL
+	case "conus":
+		product = NEXRAD_PRODUCT_CONUS
+	default:
+		http.Error(w, "unknown product", http.StatusNotFound)
+		return
+	}
+	z, errZ := strconv.Atoi(parts[1])
+	x, errX := strconv.Atoi(parts[2])
+	y, errY := strconv.Atoi(strings.TrimSuffix(parts[3], ".png"))
+	if errZ != nil || errX != nil || errY != nil || z < 0 || z > NEXRAD_MAX_ZOOM || x < 0 || y < 0 || x >= 1<<uint(z) || y >= 1<<uint(z) {
+		http.Error(w, "invalid tile", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	img := renderNexradTile(product, z, x, y)
+	if img == nil {
+		w.Write(nexradEmptyTile)
+		return
+	}
+	png.Encode(w, img)
+}
+
+func handleNexradStatusRequest(w http.ResponseWriter, r *http.Request) {
+	setJSONHeaders(w)
+	status := NexradStatus{Blocks: make(map[string]int), Sources: make(map[string]int), LastUpdate: make(map[string]time.Time)}
+	nexradMutex.RLock()
+	for key, b := range nexradBlocks {
+		status.Blocks[nexradProductName(key.product)]++
+		status.Sources[b.Source]++
+	}
+	for product, t := range nexradLastUpdate {
+		status.LastUpdate[nexradProductName(product)] = t
+	}
+	nexradMutex.RUnlock()
+	statusJSON, _ := json.Marshal(status)
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
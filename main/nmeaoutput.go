@@ -0,0 +1,187 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	nmeaoutput.go: Per-output NMEA sentence selection and user defined NMEA sentence templates.
+
+	globalSettings.NMEAOutputSentences maps an output to a comma separated list of sentence types it should emit.
+	Outputs are identified as "UDP:<port>" (e.g. "UDP:2000"), "TCP" for the NMEA TCP server ("TCP:GDL90" for the
+	GDL90 one), "BLE" / "SPP" for Bluetooth or the serial device path (e.g. "/dev/serialout_nmea0"). Outputs without an entry emit all sentences except the optional ones (LXWP0).
+	The output profile of a network client (see outputprofiles.go) overrides the selection of the UDP output.
+
+	globalSettings.NMEACustomSentences is a list of Go text/template strings, evaluated once per second against
+	nmeaTemplateData, e.g.
+		$PXYZ,{{printf "%.0f" .BaroPressureAltitude}},{{printf "%.1f" (ftToM .GPSAltitudeMSL)}}
+	The checksum and line ending are appended automatically. The sentence type used for filtering is the first field.
+	alt, speed, vs and pressure convert from ft, kt, ft/min and hPa to the units of the settings (see units.go),
+	clock formats a time as hhmmss in the configured time zone, e.g. {{printf "%.0f" (alt .GPSAltitudeMSL)}}.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Sentences that are only sent to outputs which explicitly select them.
+var nmeaOptionalSentences = map[string]bool{
+	"LXWP0": true,
+}
+
+type nmeaTemplateData struct {
+	SituationData
+	GPSValid       bool
+	BaroValid      bool
+	AHRSValid      bool
+	TrafficTargets int
+}
+
+var nmeaTemplateFuncs = template.FuncMap{
+	"ftToM":    func(ft float32) float32 { return ft * 0.3048 },
+	"ktsToKph": func(kts float64) float64 { return kts * 1.852 },
+	"fpmToMps": func(fpm float32) float32 { return fpm * 0.00508 },
+	"alt":      func(ft interface{}) float64 { return unitAltitude(nmeaFloat(ft)) },
+	"speed":    func(kt interface{}) float64 { return unitSpeed(nmeaFloat(kt)) },
+	"vs":       func(fpm interface{}) float64 { return unitVerticalSpeed(nmeaFloat(fpm)) },
+	"pressure": func(hPa interface{}) float64 { return unitPressure(nmeaFloat(hPa)) },
+	"clock":    func(t time.Time) string { return unitTime(t).Format("150405") },
+}
+
+// Numbers of the template data are float32, float64 or integers.
+func nmeaFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case float32:
+		return float64(n)
+	case float64:
+		return n
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case uint16:
+		return float64(n)
+	}
+	return 0
+}
+
+var nmeaCustomTemplates []*template.Template
+var nmeaCustomTemplatesSource []string
+
+// Returns the key used in globalSettings.NMEAOutputSentences for the given connection.
+func nmeaOutputKey(conn connection) string {
+	switch c := conn.(type) {
+	case *networkConnection:
+		return "UDP:" + strconv.Itoa(int(c.Port))
+	case *tcpConnection:
+		if (c.Capability & NETWORK_GDL90_STANDARD) != 0 {
+			return "TCP:GDL90"
+		}
+		return "TCP"
+	case *serialConnection:
+		return c.DeviceString
+	case *bluetoothConnection:
+		return c.Type
+	}
+	return ""
+}
+
+// Extracts the sentence type from an NMEA string, e.g. "GPRMC" from "$GPRMC,....".
+func nmeaSentenceType(msg []byte) string {
+	if len(msg) < 2 || (msg[0] != '$' && msg[0] != '!') {
+		return ""
+	}
+	end := bytes.IndexAny(msg, ",*")
+	if end < 0 {
+		return ""
+	}
+	return string(msg[1:end])
+}
+
+// Returns true if the given NMEA sentence should be sent to conn.
+func isNMEASentenceSelected(conn connection, msg []byte) bool {
+	sentence := nmeaSentenceType(msg)
+	selection, ok := globalSettings.NMEAOutputSentences[nmeaOutputKey(conn)]
+	if c, isNet := conn.(*networkConnection); isNet {
+		// The output profile of the client comes first
+		if s, hasProfile := networkClientSentences(c.Ip); hasProfile {
+			selection, ok = s, true
+		}
+	}
+	if !ok || len(strings.TrimSpace(selection)) == 0 {
+		return !nmeaOptionalSentences[sentence]
+	}
+	for _, s := range strings.Split(selection, ",") {
+		if strings.EqualFold(strings.TrimSpace(s), sentence) {
+			return true
+		}
+	}
+	return false
+}
+
+// (Re-)parses the custom sentence templates if the settings changed.
+func updateNMEACustomTemplates() {
+	if len(nmeaCustomTemplatesSource) == len(globalSettings.NMEACustomSentences) {
+		changed := false
+		for i, src := range globalSettings.NMEACustomSentences {
+			if nmeaCustomTemplatesSource[i] != src {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+	nmeaCustomTemplates = make([]*template.Template, 0)
+	nmeaCustomTemplatesSource = make([]string, len(globalSettings.NMEACustomSentences))
+	copy(nmeaCustomTemplatesSource, globalSettings.NMEACustomSentences)
+	for i, src := range nmeaCustomTemplatesSource {
+		tmpl, err := template.New("nmea" + strconv.Itoa(i)).Funcs(nmeaTemplateFuncs).Parse(src)
+		if err != nil {
+			addSingleSystemErrorf("nmea-template", "Invalid custom NMEA sentence '%s': %s", src, err.Error())
+			continue
+		}
+		nmeaCustomTemplates = append(nmeaCustomTemplates, tmpl)
+	}
+}
+
+// Evaluates all custom NMEA sentence templates and sends the results to the NMEA outputs. Called once per second.
+func sendCustomNMEASentences() {
+	updateNMEACustomTemplates()
+	if len(nmeaCustomTemplates) == 0 {
+		return
+	}
+	trafficMutex.Lock()
+	numTraffic := len(traffic)
+	trafficMutex.Unlock()
+	data := nmeaTemplateData{
+		SituationData:  getSituationSnapshot(),
+		GPSValid:       isGPSValid(),
+		BaroValid:      isTempPressValid(),
+		AHRSValid:      isAHRSValid(),
+		TrafficTargets: numTraffic,
+	}
+	for _, tmpl := range nmeaCustomTemplates {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			if globalSettings.DEBUG {
+				logDebugf("nmea", "Custom NMEA sentence %s failed: %s", tmpl.Name(), err.Error())
+			}
+			continue
+		}
+		msg := strings.TrimSpace(buf.String())
+		if len(msg) == 0 {
+			continue
+		}
+		if msg[0] != '$' {
+			msg = "$" + msg
+		}
+		sendNetFLARM(appendNmeaChecksum(msg)+"\r\n", time.Second, MSGPRIO_AUX)
+	}
+}
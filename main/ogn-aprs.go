@@ -34,8 +34,17 @@ func authenticate(c net.Conn) {
 			mySituation.GPSLatitude, mySituation.GPSLongitude, 
 			globalSettings.RadarRange*2)   // RadarRange is an int in NM, APRS wants an int in km and 2~=1.852
 	}
-	auth := fmt.Sprintf("user OGNNOCALL pass -1 vers stratux %s %s\r\n",  globalStatus.Version, filter)
-	log.Printf(auth)
+	// Logged in as station if we upload, see aprsupload.go
+	user, pass := "OGNNOCALL", -1
+	station := aprsStationName()
+	if len(station) > 0 {
+		user, pass = station, aprsPasscode(station)
+	}
+	aprsUploadMutex.Lock()
+	aprsUploadLoggedIn = station
+	aprsUploadMutex.Unlock()
+	auth := fmt.Sprintf("user %s pass %d vers stratux %s %s\r\n", user, pass, globalStatus.Version, filter)
+	logInfof("ogn-aprs", "%s", strings.TrimSpace(auth))
 	fmt.Fprintf(c, auth)
 }
 
@@ -87,7 +96,7 @@ func aprsListen() {
 			continue
 		}
 		if globalSettings.DEBUG {
-			log.Printf("aprs connecting...")
+			logDebugf("ogn-aprs", "aprs connecting...")
 		}
 		conn, err := net.Dial("tcp", "aprs.glidernet.org:14580")
 		if err != nil { // Local connection failed.
@@ -100,13 +109,23 @@ func aprsListen() {
 
 		aprsReader := bufio.NewReader(conn)
 
-		log.Printf("APRS successfully connected")
+		logInfof("ogn-aprs", "APRS successfully connected")
 		globalStatus.APRS_connected = true
 
 		// Make sure the exit channel is empty, so we don't exit immediately
 		for len(aprsExitChan) > 0 {
 			<-aprsExitChan
 		}
+		// Uploads queued before we (re)connected are outdated
+		for len(aprsOutgoingMsgChan) > 0 {
+			<-aprsOutgoingMsgChan
+		}
+		beaconTimer := time.NewTicker(time.Minute)
+		lastBeacon := time.Time{}
+		if isAprsUploading() {
+			sendAprsReceiverBeacons()
+			lastBeacon = stratuxClock.Time
+		}
 
 		go func() {
 			scanner := bufio.NewScanner(aprsReader)
@@ -116,12 +135,12 @@ func aprsListen() {
 				case aprsIncomingMsgChan <- temp: // Put in the channel unless it is full
 				default:
 					if globalSettings.DEBUG {
-						log.Println("aprsIncomingMsgChan full. Discarding " + temp)
+						logDebugf("ogn-aprs", "aprsIncomingMsgChan full. Discarding %s", temp)
 					}
 				}
 			}
 			if scanner.Err() != nil {
-				log.Printf("APRS issue: " + scanner.Err().Error())
+				logInfof("ogn-aprs", "APRS issue: %s", scanner.Err().Error())
 			}
 			aprsExitChan <- true
 		}()
@@ -132,7 +151,7 @@ func aprsListen() {
 			case data := <-aprsIncomingMsgChan:
 
 				if globalSettings.DEBUG {
-					log.Printf("%+v\n", data)
+					logDebugf("ogn-aprs", "%+v", data)
 				}
 
 				// APRS,qAS: aircraft beacon
@@ -143,12 +162,12 @@ func aprsListen() {
 						// log.Printf("GW data: " + data)
 					} else {
 						if globalSettings.DEBUG {
-							log.Printf("No match for: " + data)
+							logDebugf("ogn-aprs", "No match for: %s", data)
 						}
 					}
 					continue
 				} else if len(res) == 0 { // no group capture
-					log.Printf("No group capture: " + data)
+					logInfof("ogn-aprs", "No group capture: %s", data)
 				} else if len(res) > 0 && len(res[14]) > 0 {
 					ts := time.Now().UTC()
 					hh, _ := strconv.ParseInt(res[4][:2], 10, 8)
@@ -226,17 +245,35 @@ func aprsListen() {
 
 					if globalSettings.DEBUG {
 						// log.Printf("%+v\n", res)
-						log.Printf("%+v\n", msg)
+						logDebugf("ogn-aprs", "%+v", msg)
 					}
 
+					if isOgnNoTrack(msg.Addr) {
+						continue // owner opted out of tracking in the OGN DDB
+					}
 					importOgnTrafficMessage(msg, data)
 				}
+			case data := <-aprsOutgoingMsgChan:
+				fmt.Fprint(conn, data)
+			case <-beaconTimer.C:
+				aprsUploadMutex.Lock()
+				loggedIn := aprsUploadLoggedIn
+				aprsUploadMutex.Unlock()
+				if aprsStationName() != loggedIn {
+					logInfof("ogn-aprs", "APRS upload settings changed, reconnecting")
+					break loop
+				}
+				if isAprsUploading() && stratuxClock.Since(lastBeacon) >= APRS_UPLOAD_BEACON_INTERVAL {
+					sendAprsReceiverBeacons()
+					lastBeacon = stratuxClock.Time
+				}
 			case <-aprsExitChan:
 				break loop
 			}
 		}
+		beaconTimer.Stop()
 		globalStatus.APRS_connected = false
-		log.Printf("closing connection")
+		logInfof("ogn-aprs", "closing connection")
 		conn.Close()
 		time.Sleep(3 * time.Second)
 	}
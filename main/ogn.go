@@ -4,7 +4,7 @@
 	that can be found in the LICENSE file, herein included
 	as part of this header.
 
-	ogn.go: Routines for reading traffic from ogn-rx-eu
+	ogn.go: Routines for reading traffic from ogn-rx-eu (OGN, FLARM, PilotAware, FANET and ADS-L)
 */
 
 package main
@@ -14,10 +14,8 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"math"
 	"net"
-	"strconv"
 	"strings"
 	"time"
 
@@ -84,7 +82,7 @@ func ognListen() {
 			time.Sleep(3 * time.Second)
 			continue
 		}
-		log.Printf("ogn-rx-eu successfully connected")
+		logInfof("ogn", "ogn-rx-eu successfully connected")
 		ognReadWriter := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
 		globalStatus.OGN_connected = true
 
@@ -100,7 +98,7 @@ func ognListen() {
 				ognIncomingMsgChan <- scanner.Text()
 			}
 			if scanner.Err() != nil {
-				log.Printf("ogn-rx-eu connection lost: " + scanner.Err().Error())
+				logWarnf("ogn", "ogn-rx-eu connection lost: %s", scanner.Err().Error())
 			}
 			ognExitChan <- true
 		}()
@@ -114,25 +112,7 @@ func ognListen() {
 				ognReadWriter.Write([]byte(data))
 				ognReadWriter.Flush()
 			case data := <- ognIncomingMsgChan:
-				var thisMsg msg
-				thisMsg.MessageClass = MSGCLASS_OGN
-				thisMsg.TimeReceived = stratuxClock.Time
-				thisMsg.Data = data
-	
-				var msg OgnMessage
-				err = json.Unmarshal([]byte(data), &msg)
-				if err != nil {
-					log.Printf("Invalid Data from OGN: " + data)
-					continue
-				}
-	
-				if msg.Sys == "status" {
-					importOgnStatusMessage(msg)
-				} else {
-					msgLogAppend(thisMsg)
-					logMsg(thisMsg) // writes to replay logs
-					importOgnTrafficMessage(msg, data)
-				}
+				processOgnMessage(data)
 			case <- pgrmzTimer.C:
 				if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_NONE && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
 					ognOutgoingMsgChan <- makePGRMZString()
@@ -148,7 +128,35 @@ func ognListen() {
 	}
 }
 
+// Handles one JSON line from ogn-rx-eu. Also used by the flight replay (flightreplay.go).
+func processOgnMessage(data string) {
+	var thisMsg msg
+	thisMsg.MessageClass = MSGCLASS_OGN
+	thisMsg.TimeReceived = stratuxClock.Time
+	thisMsg.Data = data
+
+	var msg OgnMessage
+	err := json.Unmarshal([]byte(data), &msg)
+	if err != nil {
+		logWarnf("ogn", "Invalid Data from OGN: %s", data)
+		return
+	}
+
+	if msg.Sys == "status" {
+		importOgnStatusMessage(msg)
+	} else {
+		msgLogAppend(thisMsg)
+		logMsg(thisMsg) // writes to replay logs
+		captureRF(RF_CAPTURE_OGN, msg.SNR_dB, data)
+		importOgnTrafficMessage(msg, data)
+		uploadOgnAprs(msg) // see aprsupload.go
+	}
+}
+
+var ognLastStatus time.Time // ogn-rx-eu's sign of life for sdr_watchdog.go
+
 func importOgnStatusMessage(msg OgnMessage) {
+	ognLastStatus = stratuxClock.Time
 	globalStatus.OGN_noise_db = msg.Bkg_noise_db
 	globalStatus.OGN_gain_db = msg.Gain_db
 	globalStatus.OGN_tx_enabled = msg.Tx_enabled
@@ -159,6 +167,63 @@ func importOgnStatusMessage(msg OgnMessage) {
 	}
 }
 
+// ADS-L position accuracy from the reported GNSS DOP: 95% horizontal error of about DOP * OGN_ADSL_UERE.
+const OGN_ADSL_UERE = 5.0 // m
+
+/*
+	ognAdslIntegrity().
+		NIC and NACp of an ADS-L target. ADS-L transmitters have no certified integrity monitoring, so the NIC
+		assumes a containment radius of twice the estimated accuracy. Unknown (0/0) without a DOP.
+*/
+func ognAdslIntegrity(dop float64) (nic, nacp int) {
+	if dop <= 0 {
+		return 0, 0
+	}
+	accuracy := dop * OGN_ADSL_UERE
+	nacp = int(calculateNACp(float32(accuracy)))
+	switch rc := 2 * accuracy; {
+	case rc < 75:
+		nic = 9
+	case rc < 185.2:
+		nic = 8
+	case rc < 370.4:
+		nic = 7
+	case rc < 1111.2:
+		nic = 6
+	case rc < 1852:
+		nic = 5
+	}
+	return nic, nacp
+}
+
+const (
+	OGN_PAW_DIST_REF = 1000.0 // m at which PilotAware is usually received with OGN_PAW_SNR_REF
+	OGN_PAW_SNR_REF  = 20.0   // dB
+)
+
+/*
+	estimatePawDistance().
+		Distance of a bearingless PilotAware target from the signal level (6dB for double distance), smoothed like
+		estimateDistance() does for 1090. Restarts from the new value if the target wasn't seen for 10 seconds.
+*/
+func estimatePawDistance(ti *TrafficInfo) {
+	dist := OGN_PAW_DIST_REF * math.Pow(2.0, (OGN_PAW_SNR_REF-ti.SignalLevel)/6.0)
+	if ti.DistanceEstimated <= 0 || stratuxClock.Since(ti.Last_seen) > 10*time.Second {
+		ti.DistanceEstimated = dist
+	} else {
+		ti.DistanceEstimated = ti.DistanceEstimated*0.8 + dist*0.2
+	}
+	ti.DistanceEstimatedLastTs = ti.Timestamp
+}
+
+// FANET name messages (as "reg") of targets whose first position hasn't arrived yet, by address.
+type ognPendingName struct {
+	name string
+	time time.Time
+}
+
+var ognPendingNames = make(map[uint32]ognPendingName)
+
 func importOgnTrafficMessage(msg OgnMessage, data string) {
 	var ti TrafficInfo
 	addressBytes, _ := hex.DecodeString(msg.Addr)
@@ -167,6 +232,8 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 
 	// GDL90 only knows 2 address types. ICAO and non-ICAO, so we map to those.
 	// for OGN: 1=ICAO. For us: 0=ICAO, 1="ADS-B with Self-assigned address"
+	// ogn-rx-eu reports the ADS-L address mapping in the same convention, so ADS-L targets with an ICAO address
+	// merge with their ADS-B and FLARM counterparts.
 	addrType := uint8(1) // Non-ICAO Address
 	otherAddrType := uint8(0)
 	if msg.Addr_type == 1 { // ICAO Address
@@ -213,6 +280,9 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 		if hasInfo {
 			traffic[key] = ti
 		}
+		if isLowerQualityUpdate(&existingTi, TRAFFIC_SOURCE_OGN, existingTi.TargetType) {
+			return // FLARM with ICAO address and seen via ADS-B recently -> prefer ADS-B, much less delay
+		}
 		if msg.Time > 0 && !ti.Timestamp.IsZero() {
  			msgtime := time.Unix(msg.Time, 0)
 			if ti.Position_valid && ti.Last_source == TRAFFIC_SOURCE_OGN && msgtime.Before(ti.Timestamp) {
@@ -222,14 +292,36 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 
 	}
 
+	if _, ok := traffic[key]; !ok && msg.Sys == "FNT" && len(msg.Reg) > 0 && msg.Lat_deg == 0 && msg.Lon_deg == 0 {
+		// FANET sends the pilot name in its own message, keep it until the target shows up
+		for addr, pending := range ognPendingNames {
+			if stratuxClock.Since(pending.time) > 10*time.Minute {
+				delete(ognPendingNames, addr)
+			}
+		}
+		ognPendingNames[address] = ognPendingName{msg.Reg, stratuxClock.Time}
+		return
+	}
+
 	// Sometimes there seems to be wildly invalid lat/lons, which can trip over distRect's normailization..
 	if msg.Lat_deg > 360 || msg.Lat_deg < -360 || msg.Lon_deg > 360 || msg.Lon_deg < -360 {
 		return
 	}
 
+	// PilotAware also sends targets without bearing (no position), these become bearingless traffic like Mode S
+	hasPosition := msg.Lat_deg != 0 || msg.Lon_deg != 0
+	if !hasPosition {
+		if msg.Sys != "PAW" || (msg.Alt_msl_m == 0 && msg.Alt_hae_m == 0 && msg.Alt_std_m == 0) {
+			return // without altitude a bearingless target can't be shown either
+		}
+		if ti.Position_valid && stratuxClock.Since(ti.Last_seen) < 10*time.Second {
+			return // we currently have a position for it from elsewhere
+		}
+	}
+
 	// Basic plausibility check:
 	dist, _, _, _ := common.DistRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(msg.Lat_deg), float64(msg.Lon_deg))
-	if (isGPSValid() && dist >= 50000)  || (msg.Lat_deg == 0 && msg.Lon_deg == 0) {
+	if hasPosition && isGPSValid() && dist >= 50000 {
 		// more than 50km away? Ignore. Most likely invalid data
 		return
 	}
@@ -237,9 +329,17 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 	ti.Icao_addr = address
 	ti.Addr_type = addrType
 
+	if pending, ok := ognPendingNames[address]; ok {
+		ti.Tail = pending.name
+		delete(ognPendingNames, address)
+	}
+	if len(msg.Reg) > 0 {
+		ti.Tail = msg.Reg
+	}
 	if len(ti.Tail) == 0 {
 		ti.Tail = getTailNumber(msg.Addr, msg.Sys)
 	}
+	applyOgnDevice(&ti, msg.Addr)
 	ti.Last_source = TRAFFIC_SOURCE_OGN
 	if msg.Time > 0 {
 		if msg.Time < ti.Timestamp.Unix() {
@@ -255,7 +355,7 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 	}
 	ti.Age = time.Now().UTC().Sub(ti.Timestamp).Seconds()
 	if ti.Age > 30 || ti.Age < -2 {
-		log.Printf("Discarding likely invalid OGN target: %s", data)
+		logWarnf("ogn", "Discarding likely invalid OGN target: %s", data)
 		return
 	}
 
@@ -298,18 +398,29 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 		ti.TurnRate = 0
 	}
 	ti.Vvel = int16(msg.Climb_mps * 196.85)
-	ti.Lat = msg.Lat_deg
-	ti.Lng = msg.Lon_deg
-	ti.Track = float32(msg.Track_deg)
-	ti.Speed = uint16(msg.Speed_mps * 1.94384)
-	ti.Speed_valid = true
 	ti.SignalLevel = msg.SNR_dB
+	if msg.Sys == "ADSL" {
+		ti.NIC, ti.NACp = ognAdslIntegrity(msg.DOP)
+	}
 
-	if isGPSValid() {
-		ti.Distance, ti.Bearing = common.Distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
-		ti.BearingDist_valid = true
+	if hasPosition {
+		ti.Lat = msg.Lat_deg
+		ti.Lng = msg.Lon_deg
+		ti.Track = float32(msg.Track_deg)
+		ti.Speed = uint16(msg.Speed_mps * 1.94384)
+		ti.Speed_valid = true
+		if isGPSValid() {
+			ti.Distance, ti.Bearing = common.Distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+			ti.BearingDist_valid = true
+		}
+		ti.Position_valid = true
+	} else {
+		ti.Lat, ti.Lng = 0, 0
+		ti.Speed_valid = false
+		ti.BearingDist_valid = false
+		ti.Position_valid = false
+		estimatePawDistance(&ti)
 	}
-	ti.Position_valid = true
 	ti.ExtrapolatedPosition = false
 	ti.Last_seen = stratuxClock.Time
 	ageMs := int64(ti.Age * 1000)
@@ -317,12 +428,15 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 	ti.Last_alt = ti.Last_seen
 	ti.Last_speed = ti.Last_seen
 
-	emitter, err := strconv.ParseInt(msg.Acft_cat, 16, 8)
-	if len(msg.Acft_cat) == 2 && err == nil {
-		ti.Emitter_category = uint8(emitter)
+	if emitter, ok := parseEmitterCategory(msg.Acft_cat); ok && emitter > 0 {
+		ti.Emitter_category = emitter
 	} else {
 		ti.Emitter_category = nmeaAircraftTypeToGdl90(msg.Acft_type)
 	}
+	if msg.Sys == "FNT" && ti.Emitter_category == 0 {
+		// FANET type "other". FANET is practically only used by paragliders and hang gliders
+		ti.Emitter_category = 12
+	}
 
 	traffic[key] = ti
 	postProcessTraffic(&ti)
@@ -331,42 +445,12 @@ func importOgnTrafficMessage(msg OgnMessage, data string) {
 
 	if globalSettings.DEBUG {
 		txt, _ := json.Marshal(ti)
-		log.Printf("OGN traffic imported: " + string(txt))
-	}
-}
-
-var ognTailNumberCache = make(map[string]string)
-func lookupOgnTailNumber(ognid string) string {
-	if len(ognTailNumberCache) == 0 {
-		log.Printf("Parsing OGN device db")
-		ddb, err := ioutil.ReadFile(STRATUX_HOME + "/ogn/ddb.json")
-		if err != nil {
-			log.Printf("Failed to read OGN device db")
-			return ognid
-		}
-		var data map[string]interface{}
-		err = json.Unmarshal(ddb, &data)
-		if err != nil {
-			log.Printf("Failed to parse OGN device db")
-			return ognid
-		}
-		devlist := data["devices"].([]interface{})
-		for i := 0; i < len(devlist); i++ {
-			dev := devlist[i].(map[string]interface{})
-			ognid := dev["device_id"].(string)
-			tail := dev["registration"].(string)
-			ognTailNumberCache[ognid] = tail
-		}
-		log.Printf("Successfully parsed OGN device db")
-	}
-	if tail, ok := ognTailNumberCache[ognid]; ok {
-		return tail
+		logDebugf("ogn", "OGN traffic imported: %s", string(txt))
 	}
-	return ""
 }
 
 func getTailNumber(ognid string, sys string) string {
-	tail := lookupOgnTailNumber(ognid)
+	tail := ognDeviceName(ognid)
 	if globalSettings.DisplayTrafficSource {
 		if sys == "" {
 			sys = "un"
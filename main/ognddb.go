@@ -0,0 +1,319 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ognddb.go: Device databases for FLARM/OGN targets, which only transmit a device ID. Registration, competition ID
+		and model are looked up in
+			- the OGN Devices Database (DDB, ddb.glidernet.org), which also holds the privacy settings of the owners,
+			- FlarmNet (flarmnet.org, .fln format), for devices that are not in the DDB.
+		Both are refreshed from the internet when they are older than OGN_DDB_MAX_AGE and an uplink is available, or
+		uploaded in the web UI (/uploadOgnDDB). Devices the owner doesn't want tracked ("tracked": "N") are not taken
+		from the OGN APRS feed and not logged, devices that must not be identified ("identified": "N") are shown
+		without registration.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OGN_DDB_URL            = "http://ddb.glidernet.org/download/?j=1&t=1"
+	OGN_FLARMNET_URL       = "https://www.flarmnet.org/static/files/wfn/data.fln"
+	OGN_DDB_FILE           = STRATUX_HOME + "ogn/ddb.json"
+	OGN_FLARMNET_FILE      = STRATUX_HOME + "ogn/flarmnet.fln"
+	OGN_DDB_MAX_AGE        = 7 * 24 * time.Hour
+	OGN_DDB_CHECK_INTERVAL = 1 * time.Hour
+	OGN_DDB_MAX_SIZE       = 64 << 20
+)
+
+type ognDevice struct {
+	Registration string
+	CN           string // competition ID
+	Model        string
+	NoTrack      bool // the owner doesn't want to be tracked
+	NoIdent      bool // the owner doesn't want to be identified
+	FlarmNet     bool // from FlarmNet instead of the DDB
+}
+
+// Response of /getOgnDDB.
+type OgnDDBStatus struct {
+	DDBDevices      int
+	DDBUpdated      time.Time // modification time of the file, zero if missing
+	FlarmNetDevices int
+	FlarmNetUpdated time.Time
+}
+
+var ognDevices = make(map[string]ognDevice) // upper case hex device ID ->
+var ognDDBStatus OgnDDBStatus
+var ognDevicesMutex = &sync.Mutex{}
+
+type ognDDBFile struct {
+	Devices []struct {
+		DeviceID     string `json:"device_id"`
+		Model        string `json:"aircraft_model"`
+		Registration string `json:"registration"`
+		CN           string `json:"cn"`
+		Tracked      string `json:"tracked"`
+		Identified   string `json:"identified"`
+	} `json:"devices"`
+}
+
+func parseOgnDDB(data []byte, devices map[string]ognDevice) (int, error) {
+	var ddb ognDDBFile
+	if err := json.Unmarshal(data, &ddb); err != nil {
+		return 0, err
+	}
+	for _, d := range ddb.Devices {
+		devices[strings.ToUpper(d.DeviceID)] = ognDevice{
+			Registration: strings.TrimSpace(d.Registration),
+			CN:           strings.TrimSpace(d.CN),
+			Model:        strings.TrimSpace(d.Model),
+			NoTrack:      d.Tracked == "N",
+			NoIdent:      d.Identified == "N",
+		}
+	}
+	if len(ddb.Devices) == 0 {
+		return 0, errors.New("no devices")
+	}
+	return len(ddb.Devices), nil
+}
+
+/*
+	parseFlarmNet().
+		.fln: version in the first line, then one hex encoded (latin-1) fixed width record per line:
+		ID (6), owner (21), airfield (21), type (21), registration (7), competition ID (3), frequency (7).
+		Devices already known from the DDB are skipped.
+*/
+func parseFlarmNet(data []byte, devices map[string]ognDevice) (int, error) {
+	count := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		rec, err := hex.DecodeString(strings.TrimSpace(line))
+		if i == 0 || err != nil || len(rec) < 86 {
+			continue
+		}
+		runes := make([]rune, len(rec))
+		for j, b := range rec {
+			runes[j] = rune(b)
+		}
+		field := func(from, to int) string { return strings.TrimSpace(string(runes[from:to])) }
+		id := strings.ToUpper(field(0, 6))
+		count++
+		if _, ok := devices[id]; ok {
+			continue
+		}
+		devices[id] = ognDevice{Registration: field(69, 76), CN: field(76, 79), Model: field(48, 69), FlarmNet: true}
+	}
+	if count == 0 {
+		return 0, errors.New("no devices")
+	}
+	return count, nil
+}
+
+func fileModTime(path string) time.Time {
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// (Re)loads both databases from disk.
+func loadOgnDevices() {
+	devices := make(map[string]ognDevice)
+	var status OgnDDBStatus
+	if data, err := ioutil.ReadFile(OGN_DDB_FILE); err == nil {
+		if status.DDBDevices, err = parseOgnDDB(data, devices); err != nil {
+			logErrorf("ognddb", "Failed to parse OGN device db: %s", err.Error())
+		}
+		status.DDBUpdated = fileModTime(OGN_DDB_FILE)
+	}
+	if data, err := ioutil.ReadFile(OGN_FLARMNET_FILE); err == nil {
+		if status.FlarmNetDevices, err = parseFlarmNet(data, devices); err != nil {
+			logErrorf("ognddb", "Failed to parse FlarmNet db: %s", err.Error())
+		}
+		status.FlarmNetUpdated = fileModTime(OGN_FLARMNET_FILE)
+	}
+	logInfof("ognddb", "Loaded device db: %d OGN DDB, %d FlarmNet devices", status.DDBDevices, status.FlarmNetDevices)
+
+	ognDevicesMutex.Lock()
+	ognDevices = devices
+	ognDDBStatus = status
+	ognDevicesMutex.Unlock()
+}
+
+func lookupOgnDevice(id string) (ognDevice, bool) {
+	ognDevicesMutex.Lock()
+	defer ognDevicesMutex.Unlock()
+	dev, ok := ognDevices[strings.ToUpper(id)]
+	return dev, ok
+}
+
+// Name to show for a device: its competition ID if configured and known, the registration otherwise. "" if unknown.
+func ognDeviceName(id string) string {
+	dev, ok := lookupOgnDevice(id)
+	if !ok || dev.NoIdent {
+		return ""
+	}
+	if globalSettings.OGNDDBShowCN && len(dev.CN) > 0 {
+		return dev.CN
+	}
+	return dev.Registration
+}
+
+func isOgnNoTrack(id string) bool {
+	dev, ok := lookupOgnDevice(id)
+	return ok && dev.NoTrack
+}
+
+// Sets registration and privacy flags of a FLARM/OGN target from the device databases.
+func applyOgnDevice(ti *TrafficInfo, id string) {
+	dev, ok := lookupOgnDevice(id)
+	if !ok {
+		return
+	}
+	ti.noTrack = dev.NoTrack
+	if !dev.NoIdent && len(dev.Registration) > 0 {
+		ti.Reg = dev.Registration
+	}
+}
+
+// Writes a database file, also to the read-only base of the overlay file system, so it persists.
+func writeOgnDeviceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	robase := "/overlay/robase" + path
+	if _, err := os.Stat(filepath.Dir(robase)); err == nil {
+		overlayctl("unlock")
+		err = ioutil.WriteFile(robase, data, 0644)
+		overlayctl("lock")
+		if err != nil {
+			logWarnf("ognddb", "Can't persist %s: %s", path, err.Error())
+		}
+	}
+	return nil
+}
+
+func downloadOgnDeviceFile(url string, parse func([]byte, map[string]ognDevice) (int, error), path string) error {
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, OGN_DDB_MAX_SIZE))
+	if err != nil {
+		return err
+	}
+	if _, err := parse(data, make(map[string]ognDevice)); err != nil {
+		return fmt.Errorf("%s: %s", url, err.Error())
+	}
+	return writeOgnDeviceFile(path, data)
+}
+
+// Downloads the databases that are missing or outdated. Returns true if one was updated.
+func updateOgnDeviceFiles() bool {
+	updated := false
+	files := []struct {
+		url   string
+		path  string
+		parse func([]byte, map[string]ognDevice) (int, error)
+	}{
+		{OGN_DDB_URL, OGN_DDB_FILE, parseOgnDDB},
+		{OGN_FLARMNET_URL, OGN_FLARMNET_FILE, parseFlarmNet},
+	}
+	for _, f := range files {
+		if time.Since(fileModTime(f.path)) < OGN_DDB_MAX_AGE {
+			continue
+		}
+		if err := downloadOgnDeviceFile(f.url, f.parse, f.path); err != nil {
+			if globalSettings.DEBUG {
+				logDebugf("ognddb", "Device db update failed: %s", err.Error()) // no internet most of the time
+			}
+			continue
+		}
+		logInfof("ognddb", "Updated %s", f.path)
+		updated = true
+	}
+	return updated
+}
+
+func ognDDBUpdater() {
+	loadOgnDevices()
+	ticker := time.NewTicker(OGN_DDB_CHECK_INTERVAL)
+	for {
+		if globalSettings.OGNDDBAutoUpdate && updateOgnDeviceFiles() {
+			loadOgnDevices()
+		}
+		<-ticker.C
+	}
+}
+
+// AJAX call - /getOgnDDB. Number of devices and age of the device databases.
+func handleOgnDDBGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	ognDevicesMutex.Lock()
+	statusJSON, err := json.Marshal(ognDDBStatus)
+	ognDevicesMutex.Unlock()
+	if err != nil {
+		logErrorf("ognddb", "Error sending device db JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /uploadOgnDDB. Replaces the OGN DDB (JSON) or FlarmNet (.fln) database with the uploaded file.
+func handleOgnDDBUploadRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	file, _, err := r.FormFile("ddb_file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(file, OGN_DDB_MAX_SIZE))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	path, parse := OGN_FLARMNET_FILE, parseFlarmNet
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		path, parse = OGN_DDB_FILE, parseOgnDDB
+	}
+	count, err := parse(data, make(map[string]ognDevice))
+	if err == nil {
+		err = writeOgnDeviceFile(path, data)
+	}
+	if err != nil {
+		logErrorf("ognddb", "Device db upload from %s failed: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logInfof("ognddb", "%s uploaded %s with %d devices", r.RemoteAddr, path, count)
+	loadOgnDevices()
+	handleOgnDDBGetRequest(w, r)
+}
@@ -0,0 +1,157 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ogntracker.go: OGN tracker (e.g. an ESP32 LoRa board with the OGN tracker firmware) on its own serial port,
+		globalSettings.OGNTrackerDevice. An OGN tracker that is also our GPS is handled in gps.go. We push the
+		ownship position ($GPRMC, $GPGGA and $PGRMZ) once per second for transmission, configure it like the GPS
+		connected tracker ($POGNS with address, aircraft type, stealth and no-track flags from the settings) and
+		read back the traffic it receives ($PFLAA/$PFLAU), its configuration and pressure altitude ($POGNB).
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	OGN_TRACKER_TIMEOUT = 10 * time.Second // without a sentence the tracker is disconnected
+	OGN_TRACKER_RETRY   = 10 * time.Second // between attempts to open the device
+)
+
+var ognTrackerPort *serial.Port
+var ognTrackerLastMsg time.Time // stratuxClock
+var ognTrackerMutex sync.Mutex
+
+func isOgnTrackerDeviceConnected() bool {
+	ognTrackerMutex.Lock()
+	defer ognTrackerMutex.Unlock()
+	return ognTrackerPort != nil && stratuxClock.Since(ognTrackerLastMsg) < OGN_TRACKER_TIMEOUT
+}
+
+// Writes to the tracker on OGNTrackerDevice, if it's open.
+func writeOgnTrackerDevice(msg string) {
+	ognTrackerMutex.Lock()
+	defer ognTrackerMutex.Unlock()
+	if ognTrackerPort == nil {
+		return
+	}
+	if _, err := ognTrackerPort.Write([]byte(msg)); err != nil {
+		logWarnf("ogntracker", "write: %s", err.Error())
+	}
+}
+
+// Ownship position for the tracker to transmit, skipped while we have no fix.
+func makeOgnTrackerPosition() string {
+	if !isGPSValid() {
+		return ""
+	}
+	msg := makeGPRMCString() + makeGPGGAString()
+	// The tracker's own pressure altitude isn't sent back to it.
+	if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_OGNTRACKER {
+		msg += appendNmeaChecksum(fmt.Sprintf("$PGRMZ,%d,f,3", int(mySituation.BaroPressureAltitude))) + "\r\n"
+	}
+	return msg
+}
+
+// Only the tracker sentences, its GPS sentences (if any) must not override ours.
+func processOgnTrackerLine(line string) {
+	l, valid := validateNMEAChecksum(line)
+	if !valid {
+		return
+	}
+	ognTrackerMutex.Lock()
+	ognTrackerLastMsg = stratuxClock.Time
+	ognTrackerMutex.Unlock()
+
+	x := strings.Split(l, ",")
+	switch x[0] {
+	case "PFLAU", "PFLAA":
+		parseFlarmNmeaMessage(x)
+	case "POGNB":
+		parseOgnTrackerPOGNB(x)
+	case "POGNS":
+		if len(x) == 2 && x[1] == "SysStart" {
+			configureOgnTrackerFromSettings() // restarted, keeps the configuration of the web UI
+		} else {
+			parseOgnTrackerPOGNS(x)
+		}
+	}
+}
+
+// Reads the device until it fails or the settings change.
+func readOgnTracker(device string, baud int) {
+	port, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud, ReadTimeout: OGN_TRACKER_TIMEOUT})
+	if err != nil {
+		logWarnf("ogntracker", "%s: %s", device, err.Error())
+		return
+	}
+	logInfof("ogntracker", "reading %s at %d baud", device, baud)
+	ognTrackerMutex.Lock()
+	ognTrackerPort = port
+	ognTrackerLastMsg = stratuxClock.Time
+	ognTrackerMutex.Unlock()
+	writeOgnTrackerDevice(getOgnTrackerConfigQueryString()) // the tracker's configuration goes to the settings
+
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if msg := makeOgnTrackerPosition(); len(msg) > 0 {
+					writeOgnTrackerDevice(msg)
+				}
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(port)
+	for scanner.Scan() {
+		processOgnTrackerLine(scanner.Text())
+		if globalSettings.OGNTrackerDevice != device || globalSettings.OGNTrackerBaud != baud {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		logWarnf("ogntracker", "%s: %s", device, err.Error())
+	}
+	close(done)
+	ognTrackerMutex.Lock()
+	ognTrackerPort = nil
+	ognTrackerMutex.Unlock()
+	port.Close()
+}
+
+// Opens the configured device, reconnects after errors and setting changes.
+func ognTrackerWatcher() {
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			globalStatus.OGNTracker_connected = isOgnTrackerDeviceConnected()
+		}
+	}()
+	for {
+		device := globalSettings.OGNTrackerDevice
+		if len(device) == 0 {
+			time.Sleep(time.Second)
+			continue
+		}
+		readOgnTracker(device, globalSettings.OGNTrackerBaud)
+		if globalSettings.OGNTrackerDevice == device {
+			time.Sleep(OGN_TRACKER_RETRY)
+		}
+	}
+}
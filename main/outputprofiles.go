@@ -0,0 +1,95 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	outputprofiles.go: Canned output profiles for apps that expect a certain port, protocol and sentence set, so users
+		don't have to look up the right combination. A profile is selected per client (NetworkClient.Profile, see
+		clientmanager.go) and replaces its outputs; rate limits of the client override the ones of the profile.
+			/getOutputProfiles                    the available profiles, with the settings to use in the app
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+type OutputProfile struct {
+	ID         string
+	Name       string
+	Setup      string                // what to configure in the app
+	Outputs    []NetworkClientOutput // UDP outputs
+	Sentences  string                // NMEA sentence selection of the FLARM NMEA outputs, see nmeaoutput.go. Empty = default
+	RateLimits map[string]float64    // message class -> messages per second, see serialoutput.go
+}
+
+var outputProfiles = map[string]OutputProfile{
+	"xcsoar": {
+		Name:      "XCSoar",
+		Setup:     "Device: UDP port 4353, driver FLARM. TCP client to port 2000 works as well.",
+		Outputs:   []NetworkClientOutput{{4353, NETWORK_FLARM_NMEA}},
+		Sentences: "GPRMC,GPGGA,PGRMZ,PFLAU,PFLAA",
+	},
+	"lk8000": {
+		Name:      "LK8000",
+		Setup:     "Device A: UDP port 4353, FLARM NMEA (LXWP0 carries the baro altitude). TCP client to port 2000 works as well.",
+		Outputs:   []NetworkClientOutput{{4353, NETWORK_FLARM_NMEA}},
+		Sentences: "GPRMC,GPGGA,PGRMZ,PFLAU,PFLAA,LXWP0",
+	},
+	"skydemon": {
+		Name:       "SkyDemon",
+		Setup:      "GDL90 on UDP port 4000, found automatically. FIS-B uplinks are not used by SkyDemon and not sent.",
+		Outputs:    []NetworkClientOutput{{4000, NETWORK_GDL90_STANDARD}},
+		RateLimits: map[string]float64{"UPLINK": 0},
+	},
+	"seeyou-navigator": {
+		Name:       "SeeYou Navigator",
+		Setup:      "GDL90 device on UDP port 4000, or FLARM NMEA on TCP port 2000.",
+		Outputs:    []NetworkClientOutput{{4000, NETWORK_GDL90_STANDARD}},
+		RateLimits: map[string]float64{"UPLINK": 0},
+	},
+}
+
+// Profile selected for a client, false if it has none (or an unknown one).
+func networkClientProfile(ip string) (OutputProfile, bool) {
+	c, ok := globalSettings.NetworkClients[ip]
+	if !ok || len(c.Profile) == 0 {
+		return OutputProfile{}, false
+	}
+	p, ok := outputProfiles[c.Profile]
+	return p, ok
+}
+
+// NMEA sentence selection of the profile of a client, false if it has none.
+func networkClientSentences(ip string) (string, bool) {
+	if p, ok := networkClientProfile(ip); ok && len(p.Sentences) > 0 {
+		return p.Sentences, true
+	}
+	return "", false
+}
+
+func getOutputProfiles() []OutputProfile {
+	profiles := make([]OutputProfile, 0, len(outputProfiles))
+	for id, p := range outputProfiles {
+		p.ID = id
+		profiles = append(profiles, p)
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// AJAX call - /getOutputProfiles. The profiles that can be assigned to a network client.
+func handleOutputProfilesGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	profilesJSON, err := json.Marshal(getOutputProfiles())
+	if err != nil {
+		logErrorf("outputs", "Error sending output profiles JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", profilesJSON)
+}
@@ -0,0 +1,223 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	ownshipfilter.go: Suppression of ownship shadows. Besides our own transponder (configured Mode S codes, see
+		isOwnshipTrafficInfo()), ground stations rebroadcast us as TIS-B or ADS-R targets, often with a different
+		(track file) address, delayed and with a coarse position. Such targets are compared against our own
+		position, track, speed and pressure altitude every second. Once they agree for OWNSHIP_SHADOW_HITS
+		consecutive checks they are treated as ourselves, until they disagree for OWNSHIP_SHADOW_MISSES checks.
+		Everything suppressed as ownship within the last OWNSHIP_SUPPRESSED_KEEP is listed on /getOwnshipSuppressed
+		together with the reason.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	OWNSHIP_SHADOW_DIST      = 150.0 // m, plus GPS accuracy and the distance flown since the target's position
+	OWNSHIP_SHADOW_LATENCY   = 2.0   // s, ground station latency on top of the target's age
+	OWNSHIP_SHADOW_ALT       = 200.0 // ft, pressure altitude vs. our baro altitude
+	OWNSHIP_SHADOW_ALT_MIXED = 700.0 // ft, pressure vs. GNSS altitude, if we don't have a baro sensor
+	OWNSHIP_SHADOW_TRACK     = 30.0  // deg
+	OWNSHIP_SHADOW_SPEED     = 30.0  // kt
+	OWNSHIP_SHADOW_HITS      = 3
+	OWNSHIP_SHADOW_MISSES    = 5
+	OWNSHIP_SUPPRESSED_KEEP  = 10 * time.Minute
+)
+
+// Entry of /getOwnshipSuppressed.
+type OwnshipSuppression struct {
+	Icao_addr  uint32
+	Addr_type  uint8
+	Tail       string
+	TargetType uint8
+	Reason     string
+	Distance   float64   // m from ownship at the last check, -1 if unknown
+	AltDiff    float64   // ft, -1 if unknown
+	First_seen time.Time // wall clock, UTC
+	Last_seen  time.Time
+	lastSeen   time.Time // stratuxClock time, for the expiry
+}
+
+type ownshipShadowTrack struct {
+	hits   int
+	misses int
+}
+
+// Both are keyed by the traffic key and protected by trafficMutex.
+var ownshipShadowTracks = make(map[uint32]*ownshipShadowTrack)
+var ownshipSuppressed = make(map[uint32]*OwnshipSuppression)
+
+// Why a target with one of our configured addresses or our transponder code is ignored.
+func ownshipAddressReason(ti *TrafficInfo) string {
+	if isOwnTransponderReply(ti) {
+		return "own transponder code"
+	}
+	if c, err := strconv.ParseUint(strings.TrimSpace(globalSettings.OGNAddr), 16, 32); err == nil && uint32(c) == ti.Icao_addr {
+		return "own OGN tracker"
+	}
+	if !ti.Position_valid {
+		return "ownship address, position unknown"
+	}
+	return "ownship address"
+}
+
+// Vertical difference of a target to ownship (ft) and the gate to apply. ok is false if it can't be verified.
+func ownshipAltDiff(ti *TrafficInfo) (diff, gate float64, ok bool) {
+	if ti.Alt == 0 {
+		return 0, 0, false
+	}
+	if ti.AltIsGNSS {
+		return math.Abs(float64(mySituation.GPSHeightAboveEllipsoid) - float64(ti.Alt)), OWNSHIP_SHADOW_ALT, true
+	}
+	if isTempPressValid() {
+		return math.Abs(float64(mySituation.BaroPressureAltitude) - float64(ti.Alt)), OWNSHIP_SHADOW_ALT, true
+	}
+	return math.Abs(float64(mySituation.GPSAltitudeMSL) - float64(ti.Alt)), OWNSHIP_SHADOW_ALT_MIXED, true
+}
+
+/*
+	ownshipShadowMatch().
+		Checks a TIS-B/ADS-R target against our own position, altitude, track and speed. Returns whether it agrees,
+		the distance (m), the vertical difference (ft) and a description for the suppression list.
+*/
+func ownshipShadowMatch(ti *TrafficInfo, age float64) (match bool, dist, altDiff float64, reason string) {
+	dist, _, _, _ = common.DistRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	speed := mySituation.GPSGroundSpeed
+	if ti.Speed_valid {
+		speed = math.Max(speed, float64(ti.Speed))
+	}
+	gate := OWNSHIP_SHADOW_DIST + float64(mySituation.GPSHorizontalAccuracy) + (age+OWNSHIP_SHADOW_LATENCY)*speed*0.514444
+	if dist > gate {
+		return false, dist, -1, ""
+	}
+	altDiff, altGate, ok := ownshipAltDiff(ti)
+	if !ok || altDiff > altGate {
+		return false, dist, altDiff, ""
+	}
+	trkDiff := 0.0
+	if ti.Speed_valid {
+		if math.Abs(float64(ti.Speed)-mySituation.GPSGroundSpeed) > OWNSHIP_SHADOW_SPEED {
+			return false, dist, altDiff, ""
+		}
+		if ti.Speed > 30 && mySituation.GPSGroundSpeed > 30 && isGPSGroundTrackValid() {
+			trkDiff = math.Abs(trackError(float64(ti.Track), float64(mySituation.GPSTrueCourse)))
+			if trkDiff > OWNSHIP_SHADOW_TRACK {
+				return false, dist, altDiff, ""
+			}
+		}
+	}
+	kind := "TIS-B"
+	if ti.TargetType == TARGET_TYPE_ADSR {
+		kind = "ADS-R"
+	}
+	return true, dist, altDiff, fmt.Sprintf("%s shadow: %.0fm, %.0fft, track %.0f° off", kind, dist, altDiff, trkDiff)
+}
+
+// Adds or refreshes an entry of the suppression list. Requires trafficMutex.
+func recordOwnshipSuppression(key uint32, ti *TrafficInfo, reason string, dist, altDiff float64) {
+	s, ok := ownshipSuppressed[key]
+	if !ok {
+		s = &OwnshipSuppression{First_seen: time.Now().UTC()}
+		ownshipSuppressed[key] = s
+		logInfof("ownship", "Suppressing %X (%s) as ownship: %s", ti.Icao_addr, ti.Tail, reason)
+	}
+	s.Icao_addr, s.Addr_type, s.Tail, s.TargetType = ti.Icao_addr, ti.Addr_type, ti.Tail, ti.TargetType
+	s.Reason, s.Distance, s.AltDiff = reason, dist, altDiff
+	s.Last_seen, s.lastSeen = time.Now().UTC(), stratuxClock.Time
+}
+
+/*
+	updateOwnshipShadows().
+		Called from sendTrafficUpdates() with trafficMutex held, sets OwnshipShadow of all targets.
+*/
+func updateOwnshipShadows() {
+	for key := range ownshipShadowTracks {
+		if _, ok := traffic[key]; !ok {
+			delete(ownshipShadowTracks, key)
+		}
+	}
+	for key, s := range ownshipSuppressed {
+		if stratuxClock.Since(s.lastSeen) > OWNSHIP_SUPPRESSED_KEEP {
+			delete(ownshipSuppressed, key)
+		}
+	}
+
+	for key, ti := range traffic {
+		age := stratuxClock.Since(ti.Last_seen).Seconds()
+		candidate := globalSettings.OwnshipShadowFilter && isGPSValid() && ti.Position_valid &&
+			(ti.TargetType == TARGET_TYPE_ADSR || ti.TargetType == TARGET_TYPE_TISB || ti.TargetType == TARGET_TYPE_TISB_S)
+		if !candidate {
+			delete(ownshipShadowTracks, key)
+			if ti.OwnshipShadow {
+				ti.OwnshipShadow = false
+				traffic[key] = ti
+			}
+			continue
+		}
+		if !isTrafficCurrent(&ti, age) {
+			continue // keep the state until it is updated again or timed out
+		}
+
+		track, ok := ownshipShadowTracks[key]
+		if !ok {
+			track = &ownshipShadowTrack{}
+			ownshipShadowTracks[key] = track
+		}
+		match, dist, altDiff, reason := ownshipShadowMatch(&ti, age)
+		if match {
+			track.hits++
+			track.misses = 0
+			if track.hits >= OWNSHIP_SHADOW_HITS {
+				ti.OwnshipShadow = true
+			}
+		} else {
+			track.hits = 0
+			if ti.OwnshipShadow {
+				track.misses++
+				if track.misses >= OWNSHIP_SHADOW_MISSES {
+					ti.OwnshipShadow = false
+					logInfof("ownship", "%X (%s) no longer matches ownship (%.0fm, %.0fft)", ti.Icao_addr, ti.Tail, dist, altDiff)
+				}
+			}
+		}
+		if ti.OwnshipShadow && match {
+			recordOwnshipSuppression(key, &ti, reason, dist, altDiff)
+		}
+		traffic[key] = ti
+	}
+}
+
+// AJAX call - /getOwnshipSuppressed. Targets suppressed as ownship recently, most recent first.
+func handleOwnshipSuppressedRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	trafficMutex.Lock()
+	result := make([]OwnshipSuppression, 0, len(ownshipSuppressed))
+	for _, s := range ownshipSuppressed {
+		result = append(result, *s)
+	}
+	trafficMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].lastSeen.After(result[j].lastSeen) })
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		logErrorf("ownship", "Error sending ownship suppression JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", resultJSON)
+}
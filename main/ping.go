@@ -12,7 +12,6 @@ package main
 import (
 	"bufio"
 	//"fmt"
-	"log"
 	"os"
 	"strings"
 	"sync"
@@ -37,7 +36,7 @@ func initPingSerial() bool {
 	var device string
 	baudrate := int(2000000)
 
-	log.Printf("Configuring Ping ADS-B\n")
+	logInfof("ping", "Configuring Ping ADS-B")
 
 	if _, err := os.Stat("/dev/ping"); err == nil {
 		device = "/dev/ping"
@@ -45,20 +44,20 @@ func initPingSerial() bool {
 		device = "/dev/softrf"
 		baudrate = int(38400)
 	} else {
-		log.Printf("No suitable Ping device found.\n")
+		logInfof("ping", "No suitable Ping device found.")
 		return false
 	}
-	log.Printf("Using %s for Ping\n", device)
+	logInfof("ping", "Using %s for Ping", device)
 
 	// Open port
 	// No timeout specified as Ping does not heartbeat
 	pingSerialConfig = &serial.Config{Name: device, Baud: baudrate}
 	p, err := serial.OpenPort(pingSerialConfig)
 	if err != nil {
-		log.Printf("Error opening serial port: %s\n", err.Error())
+		logErrorf("ping", "Error opening serial port: %s", err.Error())
 		return false
 	}
-	log.Printf("Ping opened serial port")
+	logInfof("ping", "Ping opened serial port")
 
 	// No device configuration is needed, we should be ready
 
@@ -68,14 +67,14 @@ func initPingSerial() bool {
 
 func pingNetworkRepeater() {
 	defer pingWG.Done()
-	log.Println("Entered Ping network repeater ...")
+	logDebugf("ping", "Entered Ping network repeater ...")
 	cmd := exec.Command(STRATUX_HOME + "/bin/dump1090", "--net-only")
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
 	err := cmd.Start()
 	if err != nil {
-		log.Printf("Error executing " + STRATUX_HOME + "/bin/dump1090: %s\n", err)
+		logErrorf("ping", "Error executing %s/bin/dump1090: %s", STRATUX_HOME, err)
 		// don't return immediately, use the proper shutdown procedure
 		shutdownPing = true
 		for {
@@ -88,7 +87,7 @@ func pingNetworkRepeater() {
 		}
 	}
 
-	log.Println("Executed " + cmd.String() + " successfully...")
+	logInfof("ping", "Executed %s successfully...", cmd.String())
 
 	scanStdout := bufio.NewScanner(stdout)
 	scanStderr := bufio.NewScanner(stderr)
@@ -96,13 +95,13 @@ func pingNetworkRepeater() {
 	for {
 		select {
 		case <-closeCh:
-			log.Println("Ping network repeater: shutdown msg received, calling cmd.Process.Kill() ...")
+			logDebugf("ping", "Ping network repeater: shutdown msg received, calling cmd.Process.Kill() ...")
 			err := cmd.Process.Kill()
 			if err != nil {
-				log.Printf("\t couldn't kill dump1090: %s\n", err)
+				logWarnf("ping", "\t couldn't kill dump1090: %s", err)
 			} else {
 				cmd.Wait()
-				log.Println("\t kill successful...")
+				logDebugf("ping", "\t kill successful...")
 			}
 			return
 		default:
@@ -111,7 +110,7 @@ func pingNetworkRepeater() {
 				logDump1090TermMessage(m)
 			}
 			if err := scanStdout.Err(); err != nil {
-				log.Printf("scanStdout error: %s\n", err)
+				logErrorf("ping", "scanStdout error: %s", err)
 			}
 
 			for scanStderr.Scan() {
@@ -122,7 +121,7 @@ func pingNetworkRepeater() {
 				}
 			}
 			if err := scanStderr.Err(); err != nil {
-				log.Printf("scanStderr error: %s\n", err)
+				logErrorf("ping", "scanStderr error: %s", err)
 			}
 
 			time.Sleep(1 * time.Second)
@@ -145,7 +144,7 @@ func pingSerialReader() {
 	defer pingSerialPort.Close()
 	// RCB TODO channel control for terminate
 
-	log.Printf("Starting Ping serial reader")
+	logInfof("ping", "Starting Ping serial reader")
 
 	scanner := bufio.NewScanner(pingSerialPort)
 	for scanner.Scan() && globalStatus.Ping_connected && globalSettings.Ping_Enabled {
@@ -168,7 +167,7 @@ func pingSerialReader() {
 			report := strings.Split(s, ";")
 			//replayLog(s, MSGCLASS_DUMP1090);
 			if dump1090Connection == nil {
-				log.Println("Starting dump1090 network connection")
+				logInfof("ping", "Starting dump1090 network connection")
 				pingNetworkConnection()
 			}
 			if len(report[0]) != 0 && dump1090Connection != nil {
@@ -201,12 +200,12 @@ func pingSerialReader() {
 		}
 	}
 	globalStatus.Ping_connected = false
-	log.Printf("Exiting Ping serial reader")
+	logInfof("ping", "Exiting Ping serial reader")
 	return
 }
 
 func pingShutdown() {
-	log.Println("Entered Ping shutdown() ...")
+	logDebugf("ping", "Entered Ping shutdown() ...")
 	//close(closeCh)
 	//log.Println("Ping shutdown(): calling pingWG.Wait() ...")
 	//pingWG.Wait() // Wait for the goroutine to shutdown
@@ -0,0 +1,265 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	powermanager.go: Automatic shutdown for units left running after a flight. The unit is idle while it doesn't
+		move (GPS ground speed below POWER_MOTION_SPEED and no pressure altitude change, without a GPS fix the motion
+		is unknown and counts as moving) and no client is connected. Serial and Bluetooth outputs count as clients.
+		After globalSettings.AutoShutdownMinutes of idle time, or at the daily globalSettings.AutoShutdownAt (display
+		time zone) if it isn't moving and no serial or Bluetooth output is connected, a POWER_COUNTDOWN starts:
+		globalStatus.PowerCountdown on the /status WebSocket and a warning alert in the status bar. Unless it's
+		cancelled the unit then shuts down, or with POWER_ACTION_SUSPEND only closes the SDRs until it moves or a
+		client connects again.
+			/getPower                             PowerStatus
+			/setPower?action=cancel|suspend|resume POST: cancel the countdown (the idle time starts over),
+			                                      suspend or resume the radios right away
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	POWER_ACTION_SHUTDOWN = "shutdown"
+	POWER_ACTION_SUSPEND  = "suspend"
+
+	POWER_COUNTDOWN       = 60 * time.Second
+	POWER_MOTION_SPEED    = 5.0   // kt, GPS ground speed that counts as moving
+	POWER_MOTION_ALT      = 100.0 // ft, pressure altitude change within POWER_MOTION_ALT_TIME that counts as moving
+	POWER_MOTION_ALT_TIME = time.Minute
+)
+
+type PowerStatus struct {
+	IdleMinutes     int    // globalSettings.AutoShutdownMinutes
+	Action          string // globalSettings.AutoShutdownAction
+	ScheduledAt     string // globalSettings.AutoShutdownAt
+	Moving          bool   // also without GPS fix
+	Clients         uint   // including Outputs
+	Outputs         uint   // serial and Bluetooth outputs
+	IdleSeconds     int
+	Countdown       int    // s until the action, 0 = none pending
+	Reason          string // of the countdown: "idle" or "schedule"
+	RadiosSuspended bool
+}
+
+type powerState struct {
+	lastActive    time.Time
+	deadline      time.Time // of the countdown, zero = none
+	reason        string
+	scheduleDone  string    // date (2006-01-02) the schedule was last triggered or cancelled
+	autoSuspended bool      // radios suspended by the countdown, they are resumed when the unit is used again
+	altRef        float64   // pressure altitude (ft) ...
+	altRefTime    time.Time // ... at this time, zero = no baro
+	altChanged    time.Time // last pressure altitude change of POWER_MOTION_ALT
+}
+
+var power = powerState{lastActive: time.Now()}
+var powerMutex sync.Mutex
+
+// Without GPS fix we can't tell, a unit that lost its fix in flight must not shut down. powerMutex must be held.
+func isPowerMoving() bool {
+	if !isGPSValid() || mySituation.GPSGroundSpeed >= POWER_MOTION_SPEED {
+		return true
+	}
+	return !power.altChanged.IsZero() && time.Since(power.altChanged) < POWER_MOTION_ALT_TIME
+}
+
+// Looks for pressure altitude changes of POWER_MOTION_ALT, called every second. powerMutex must be held.
+func updatePowerAltitude(now time.Time) {
+	if !isTempPressValid() {
+		power.altRefTime = time.Time{}
+		return
+	}
+	alt := float64(mySituation.BaroPressureAltitude)
+	if math.Abs(alt-power.altRef) >= POWER_MOTION_ALT && !power.altRefTime.IsZero() {
+		power.altChanged = now
+		power.altRef, power.altRefTime = alt, now
+	} else if power.altRefTime.IsZero() || now.Sub(power.altRefTime) >= POWER_MOTION_ALT_TIME {
+		power.altRef, power.altRefTime = alt, now
+	}
+}
+
+// Serial and Bluetooth outputs. They don't answer pings like the network clients, an open port counts.
+func countPowerOutputs() uint {
+	netMutex.Lock()
+	defer netMutex.Unlock()
+	var n uint
+	for _, conn := range clientConnections {
+		switch conn.(type) {
+		case *serialConnection, *bluetoothConnection:
+			if !conn.IsSleeping() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// powerMutex must be held.
+func suspendRadios(suspend bool, why string) {
+	power.autoSuspended = false
+	if sdrSuspended == suspend {
+		return
+	}
+	sdrSuspended = suspend
+	globalStatus.RadiosSuspended = suspend
+	if suspend {
+		logInfof("power", "radios suspended: %s", why)
+		raiseAlert("radios-suspended", ALERT_INFO, "power", "Radios suspended: %s", why)
+	} else {
+		logInfof("power", "radios resumed")
+		clearAlert("radios-suspended")
+	}
+}
+
+// Stops the countdown. powerMutex must be held.
+func cancelPowerCountdown(why string) {
+	if power.deadline.IsZero() {
+		return
+	}
+	logInfof("power", "automatic %s cancelled: %s", globalSettings.AutoShutdownAction, why)
+	power.deadline = time.Time{}
+	globalStatus.PowerCountdown = 0
+	clearAlert("autoshutdown")
+}
+
+func getPowerStatus() PowerStatus {
+	outputs := countPowerOutputs()
+	powerMutex.Lock()
+	defer powerMutex.Unlock()
+	return PowerStatus{
+		IdleMinutes:     globalSettings.AutoShutdownMinutes,
+		Action:          globalSettings.AutoShutdownAction,
+		ScheduledAt:     globalSettings.AutoShutdownAt,
+		Moving:          isPowerMoving(),
+		Clients:         globalStatus.Connected_Users + outputs,
+		Outputs:         outputs,
+		IdleSeconds:     int(time.Since(power.lastActive).Seconds()),
+		Countdown:       globalStatus.PowerCountdown,
+		Reason:          power.reason,
+		RadiosSuspended: sdrSuspended,
+	}
+}
+
+// Checks the idle time and the schedule every second, runs the countdown.
+func powerManager() {
+	registerSubsystem("power", 10*time.Second)
+	ticker := time.NewTicker(time.Second)
+	for {
+		<-ticker.C
+		subsystemAlive("power")
+		now := time.Now()
+		outputs := countPowerOutputs()
+
+		powerMutex.Lock()
+		updatePowerAltitude(now)
+		moving := isPowerMoving()
+		if moving || globalStatus.Connected_Users > 0 || outputs > 0 {
+			power.lastActive = now
+			// A network client only holds off the idle shutdown, the schedule is cancelled from the alert. Serial and
+			// Bluetooth outputs don't see the alert, they hold off both.
+			if moving || outputs > 0 || power.reason == "idle" {
+				cancelPowerCountdown("in use again")
+			}
+			if power.autoSuspended {
+				suspendRadios(false, "")
+			}
+		}
+
+		reason := ""
+		idle := now.Sub(power.lastActive)
+		if globalSettings.AutoShutdownMinutes > 0 && idle >= time.Duration(globalSettings.AutoShutdownMinutes)*time.Minute {
+			reason = "idle"
+		}
+		local := unitTime(now)
+		if today := local.Format("2006-01-02"); len(globalSettings.AutoShutdownAt) > 0 && !moving && outputs == 0 &&
+			local.Format("15:04") == globalSettings.AutoShutdownAt && power.scheduleDone != today {
+			power.scheduleDone = today
+			reason = "schedule"
+		}
+		// Suspended radios stay suspended until the unit is used again
+		if reason == "idle" && sdrSuspended && globalSettings.AutoShutdownAction == POWER_ACTION_SUSPEND {
+			reason = ""
+		}
+
+		if len(reason) > 0 && power.deadline.IsZero() {
+			power.deadline = now.Add(POWER_COUNTDOWN)
+			power.reason = reason
+			why := fmt.Sprintf("no motion and no clients for %d min", int(idle.Minutes()))
+			if reason == "schedule" {
+				why = "scheduled at " + globalSettings.AutoShutdownAt
+			}
+			logInfof("power", "automatic %s in %s: %s", globalSettings.AutoShutdownAction, POWER_COUNTDOWN, why)
+			raiseAlert("autoshutdown", ALERT_WARNING, "power", "Automatic %s at %s (%s)", globalSettings.AutoShutdownAction,
+				unitTime(power.deadline).Format("15:04:05"), why)
+		}
+		if !power.deadline.IsZero() {
+			left := power.deadline.Sub(now)
+			globalStatus.PowerCountdown = int(left.Seconds() + 0.5)
+			if left <= 0 {
+				power.deadline = time.Time{}
+				globalStatus.PowerCountdown = 0
+				clearAlert("autoshutdown")
+				if globalSettings.AutoShutdownAction == POWER_ACTION_SUSPEND {
+					suspendRadios(true, "no motion and no clients")
+					power.autoSuspended = true
+				} else {
+					powerMutex.Unlock()
+					logInfof("power", "automatic shutdown")
+					gracefulShutdown()
+					doShutdown()
+					return
+				}
+			}
+		}
+		powerMutex.Unlock()
+	}
+}
+
+// AJAX call - /getPower.
+func handlePowerGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	powerJSON, err := json.Marshal(getPowerStatus())
+	if err != nil {
+		logErrorf("power", "Error sending power JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", powerJSON)
+}
+
+// AJAX call - /setPower?action=cancel|suspend|resume.
+func handlePowerSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	powerMutex.Lock()
+	switch action := r.URL.Query().Get("action"); action {
+	case "cancel":
+		power.lastActive = time.Now()
+		power.scheduleDone = unitTime(time.Now()).Format("2006-01-02")
+		cancelPowerCountdown("by " + r.RemoteAddr)
+	case "suspend":
+		suspendRadios(true, "by "+r.RemoteAddr)
+	case "resume":
+		power.lastActive = time.Now()
+		suspendRadios(false, "")
+	default:
+		powerMutex.Unlock()
+		http.Error(w, fmt.Sprintf("unknown action '%s'", action), http.StatusBadRequest)
+		return
+	}
+	powerMutex.Unlock()
+	handlePowerGetRequest(w, r)
+}
@@ -0,0 +1,146 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	qnhestimate.go: Estimation of the local pressure setting (QNH) from nearby ADS-B traffic that reports both
+		pressure altitude and geometric altitude. The altimeter setting that makes the target's pressure altitude
+		read its MSL altitude is its QNH. Samples of all suitable targets are combined with a median/MAD outlier
+		filter. The result is a cross-check for the METAR altimeter setting, not a replacement: temperature
+		deviations from ISA bias the estimate, which is why only low targets close to us are used.
+
+		Result in mySituation.QNHEstimate (hPa, 0 = no estimate), QNHEstimateConfidence (0-1) and QNHEstimateSamples.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	QNH_MAX_ALT        = 10000   // ft pressure altitude, higher targets are too far off ISA temperature-wise
+	QNH_MAX_DIST       = 92600.0 // m (50nm)
+	QNH_SAMPLE_MAX_AGE = 10 * time.Minute
+	QNH_MIN_SAMPLES    = 3
+	QNH_MIN_PLAUSIBLE  = 900.0  // hPa
+	QNH_MAX_PLAUSIBLE  = 1085.0 // hPa
+)
+
+type qnhSample struct {
+	qnh float64
+	t   time.Time // stratuxClock
+}
+
+var qnhSamples = make(map[uint32]qnhSample)
+
+/*
+	qnhFromAltitudes().
+		Altimeter setting (hPa) at which an altimeter at pressure altitude pressAlt (ft) indicates mslAlt (ft), from
+		the ISA pressure/altitude relationship used by altimeters.
+*/
+func qnhFromAltitudes(pressAlt, mslAlt float64) float64 {
+	const k = 1 / 0.190263
+	p := 1013.25 * math.Pow(1-pressAlt/145366.45, k)
+	return p / math.Pow(1-mslAlt/145366.45, k)
+}
+
+// Collects new samples from the traffic list. Our own geoid separation is used to convert the targets' HAE to MSL.
+func updateQNHSamples() {
+	if !isGPSValid() {
+		return
+	}
+	geoidSep := float64(mySituation.GPSGeoidSep)
+
+	trafficMutex.Lock()
+	for icao, ti := range traffic {
+		if ti.ReceivedMsgs < 30 || ti.AltIsGNSS || ti.Alt <= 0 || ti.Alt > QNH_MAX_ALT || ti.OnGround {
+			continue
+		}
+		if !ti.BearingDist_valid || ti.Distance > QNH_MAX_DIST {
+			continue
+		}
+		if stratuxClock.Since(ti.Last_GnssDiff) > 10*time.Second || stratuxClock.Since(ti.Last_alt) > 10*time.Second {
+			continue
+		}
+		hae := float64(ti.Alt + ti.GnssDiffFromBaroAlt)
+		qnh := qnhFromAltitudes(float64(ti.Alt), hae-geoidSep)
+		if qnh < QNH_MIN_PLAUSIBLE || qnh > QNH_MAX_PLAUSIBLE {
+			continue
+		}
+		qnhSamples[icao] = qnhSample{qnh: qnh, t: stratuxClock.Time}
+	}
+	trafficMutex.Unlock()
+
+	for icao, s := range qnhSamples {
+		if stratuxClock.Since(s.t) > QNH_SAMPLE_MAX_AGE {
+			delete(qnhSamples, icao)
+		}
+	}
+}
+
+func median(x []float64) float64 {
+	s := append([]float64(nil), x...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+/*
+	estimateQNH().
+		Robust average of the current samples: samples further than 3 (scaled) median absolute deviations from
+		the median are dropped, the rest is averaged. Confidence grows with the number of samples (full at 10) and
+		shrinks with their spread (zero at 3 hPa standard deviation).
+*/
+func estimateQNH() (qnh float64, confidence float64, samples int) {
+	values := make([]float64, 0, len(qnhSamples))
+	for _, s := range qnhSamples {
+		values = append(values, s.qnh)
+	}
+	if len(values) < QNH_MIN_SAMPLES {
+		return 0, 0, len(values)
+	}
+
+	med := median(values)
+	deviations := make([]float64, len(values))
+	for i, v := range values {
+		deviations[i] = math.Abs(v - med)
+	}
+	limit := math.Max(3*1.4826*median(deviations), 1.0)
+	inliers := make([]float64, 0, len(values))
+	for _, v := range values {
+		if math.Abs(v-med) <= limit {
+			inliers = append(inliers, v)
+		}
+	}
+	if len(inliers) < QNH_MIN_SAMPLES {
+		return 0, 0, len(inliers)
+	}
+
+	qnh, _ = common.Mean(inliers)
+	stdev, _ := common.Stdev(inliers)
+	confidence = math.Min(float64(len(inliers))/10, 1) * math.Max(1-stdev/3, 0)
+	return qnh, confidence, len(inliers)
+}
+
+func qnhEstimator() {
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		<-ticker.C
+		updateQNHSamples()
+		qnh, confidence, samples := estimateQNH()
+
+		mySituation.muBaro.Lock()
+		mySituation.QNHEstimate = float32(math.Round(qnh*10) / 10)
+		mySituation.QNHEstimateConfidence = float32(math.Round(confidence*100) / 100)
+		mySituation.QNHEstimateSamples = uint16(samples)
+		mySituation.muBaro.Unlock()
+	}
+}
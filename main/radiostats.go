@@ -0,0 +1,130 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	radiostats.go: Per band reception statistics with 24h history (/getRadioStats), to compare antennas and
+		antenna placements objectively. Once a minute, the message count of the last minute, the number of aircraft
+		received and a histogram of their signal levels are recorded per band into a ring buffer.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	RADIOSTATS_INTERVAL   = 1 * time.Minute
+	RADIOSTATS_HISTORY    = 24 * 60 // samples, 24h
+	RADIOSTATS_RSSI_MIN   = -60     // dB, lower edge of the first histogram bucket
+	RADIOSTATS_RSSI_STEP  = 5
+	RADIOSTATS_RSSI_COUNT = 20 // -60..+40 dB, 1090/978 are dBFS (< 0), OGN SNR (> 0)
+)
+
+// Reception statistics of one band in one interval.
+type BandStats struct {
+	Messages uint                       // messages in the interval
+	Aircraft int                        // unique targets received in the interval
+	RSSI     [RADIOSTATS_RSSI_COUNT]int // targets per signal level bucket, see RadioStatsHistory.RSSIBuckets
+}
+
+type RadioStatsSample struct {
+	Time  time.Time // wall clock, UTC
+	UAT   BandStats
+	ES    BandStats
+	OGN   BandStats
+	AIS   BandStats
+	clock time.Time // stratuxClock time, for the age
+}
+
+// Response of /getRadioStats, oldest sample first.
+type RadioStatsHistory struct {
+	IntervalSeconds int
+	RSSIBuckets     []int // lower edges in dB
+	Samples         []RadioStatsSample
+}
+
+var radioStats = make([]RadioStatsSample, 0, RADIOSTATS_HISTORY)
+var radioStatsNext int // ring buffer position once it is full
+var radioStatsMutex = &sync.Mutex{}
+
+func rssiBucket(signal float64) int {
+	b := int((signal - RADIOSTATS_RSSI_MIN) / RADIOSTATS_RSSI_STEP)
+	if b < 0 {
+		return 0
+	}
+	if b >= RADIOSTATS_RSSI_COUNT {
+		return RADIOSTATS_RSSI_COUNT - 1
+	}
+	return b
+}
+
+// Takes a sample of the last interval from the message counters and the traffic list.
+func sampleRadioStats() RadioStatsSample {
+	s := RadioStatsSample{Time: time.Now().UTC(), clock: stratuxClock.Time}
+	s.UAT.Messages = globalStatus.UAT_messages_last_minute
+	s.ES.Messages = globalStatus.ES_messages_last_minute
+	s.OGN.Messages = globalStatus.OGN_messages_last_minute
+	s.AIS.Messages = globalStatus.AIS_messages_last_minute
+
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	for _, ti := range traffic {
+		if stratuxClock.Since(ti.Last_seen) > RADIOSTATS_INTERVAL {
+			continue
+		}
+		var band *BandStats
+		switch ti.Last_source {
+		case TRAFFIC_SOURCE_UAT:
+			band = &s.UAT
+		case TRAFFIC_SOURCE_1090ES:
+			band = &s.ES
+		case TRAFFIC_SOURCE_OGN:
+			band = &s.OGN
+		case TRAFFIC_SOURCE_AIS:
+			band = &s.AIS
+		default:
+			continue
+		}
+		band.Aircraft++
+		band.RSSI[rssiBucket(ti.SignalLevel)]++
+	}
+	return s
+}
+
+func radioStatsCollector() {
+	ticker := time.NewTicker(RADIOSTATS_INTERVAL)
+	for {
+		<-ticker.C
+		s := sampleRadioStats()
+		radioStatsMutex.Lock()
+		if len(radioStats) < RADIOSTATS_HISTORY {
+			radioStats = append(radioStats, s)
+		} else {
+			radioStats[radioStatsNext] = s
+			radioStatsNext = (radioStatsNext + 1) % RADIOSTATS_HISTORY
+		}
+		radioStatsMutex.Unlock()
+	}
+}
+
+// The samples of the last maxAge, oldest first.
+func getRadioStats(maxAge time.Duration) RadioStatsHistory {
+	h := RadioStatsHistory{IntervalSeconds: int(RADIOSTATS_INTERVAL.Seconds())}
+	for i := 0; i < RADIOSTATS_RSSI_COUNT; i++ {
+		h.RSSIBuckets = append(h.RSSIBuckets, RADIOSTATS_RSSI_MIN+i*RADIOSTATS_RSSI_STEP)
+	}
+	radioStatsMutex.Lock()
+	defer radioStatsMutex.Unlock()
+	h.Samples = make([]RadioStatsSample, 0, len(radioStats))
+	for i := 0; i < len(radioStats); i++ {
+		s := radioStats[(radioStatsNext+i)%len(radioStats)]
+		if stratuxClock.Since(s.clock) <= maxAge {
+			h.Samples = append(h.Samples, s)
+		}
+	}
+	return h
+}
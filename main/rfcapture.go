@@ -0,0 +1,344 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	rfcapture.go: Raw capture of the received frames, for decoder bug reports and regression tests. The frames of the
+		enabled bands (globalSettings.RFCaptureUAT, RFCaptureES, RFCaptureOGN) are written to gzip files in
+		rfCaptureDirf, a new one every RF_CAPTURE_FILE_AGE or RF_CAPTURE_FILE_SIZE. One line per frame:
+			2021-06-01T12:00:00.123456Z 978 -12.3 +3c1a5e...;rs=2;ss=128;    dump978 output
+			2021-06-01T12:00:00.234567Z 1090 -20.1 *8d4840d6202cc371c32ce0576098;    AVR, from the dump1090 Beast output
+			2021-06-01T12:00:00.345678Z ogn 12.5 {"sys":"OGN",...}    ogn-rx-eu JSON
+		with the signal level in dB (dBFS for 978/1090, SNR for OGN). The oldest files are deleted once the capture
+		exceeds globalSettings.RFCaptureMaxMB or they are older than RFCaptureMaxAge hours. Replayed flights aren't
+		captured.
+			/getRFCapture                         RFCaptureStatus
+			/downloadRFCapture?file=<name>        one file, all files as zip without file. The current file is
+			                                      finished first, the capture continues in a new one
+			/deleteRFCapture?file=<name>          POST, all files without file
+*/
+
+package main
+
+import (
+	"archive/zip"
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RF_CAPTURE_DIR       = "rfcapture"
+	RF_CAPTURE_FILE_SIZE = 16 * 1024 * 1024 // uncompressed
+	RF_CAPTURE_FILE_AGE  = time.Hour
+	RF_CAPTURE_FLUSH     = 10 * time.Second
+	RF_CAPTURE_QUEUE     = 4096
+
+	RF_CAPTURE_UAT = "978"
+	RF_CAPTURE_ES  = "1090"
+	RF_CAPTURE_OGN = "ogn"
+)
+
+type rfCaptureFrame struct {
+	Time time.Time
+	Band string
+	RSSI float64 // dB
+	Data string
+}
+
+type RFCaptureFile struct {
+	Name     string
+	Size     int64 // compressed
+	Start    time.Time
+	Modified time.Time
+	Current  bool // still being written
+}
+
+type RFCaptureStatus struct {
+	Bands     []string // enabled
+	Frames    uint64   // written since start
+	Dropped   uint64   // frames lost because the writer couldn't keep up
+	TotalSize int64
+	MaxMB     int
+	MaxAge    int // h
+	Files     []RFCaptureFile
+}
+
+type rfCaptureWriter struct {
+	mu      sync.Mutex
+	name    string
+	file    *os.File
+	gz      *gzip.Writer
+	size    int64 // uncompressed bytes written
+	opened  time.Time
+	frames  uint64
+	dropped uint64 // atomic
+}
+
+var rfCaptureDirf string // Set according to OS config.
+var rfCaptureQueue = make(chan rfCaptureFrame, RF_CAPTURE_QUEUE)
+var rfCapture rfCaptureWriter
+var rfCaptureFileName = regexp.MustCompile(`^rf_\d{8}T\d{6}Z\.log\.gz$`)
+
+func rfCaptureEnabled(band string) bool {
+	switch band {
+	case RF_CAPTURE_UAT:
+		return globalSettings.RFCaptureUAT
+	case RF_CAPTURE_ES:
+		return globalSettings.RFCaptureES
+	case RF_CAPTURE_OGN:
+		return globalSettings.RFCaptureOGN
+	}
+	return false
+}
+
+func rfCaptureBands() []string {
+	bands := make([]string, 0)
+	for _, band := range []string{RF_CAPTURE_UAT, RF_CAPTURE_ES, RF_CAPTURE_OGN} {
+		if rfCaptureEnabled(band) {
+			bands = append(bands, band)
+		}
+	}
+	return bands
+}
+
+// Queues a received frame for the capture, if its band is enabled. Never blocks the receiver.
+func captureRF(band string, rssi float64, data string) {
+	if !rfCaptureEnabled(band) || isFlightReplayRunning() {
+		return
+	}
+	select {
+	case rfCaptureQueue <- rfCaptureFrame{time.Now().UTC(), band, rssi, data}:
+	default:
+		atomic.AddUint64(&rfCapture.dropped, 1)
+	}
+}
+
+// AVR representation (*hex;) and signal level (dBFS) of a Beast frame as read by readBeastFrame().
+func beastFrameAVR(frame []byte) (string, float64) {
+	unescaped := make([]byte, 0, len(frame))
+	for i := 2; i < len(frame); i++ {
+		unescaped = append(unescaped, frame[i])
+		if frame[i] == BEAST_ESCAPE {
+			i++ // doubled
+		}
+	}
+	if len(unescaped) < 8 {
+		return "", -999
+	}
+	// 6 bytes timestamp, 1 byte signal (sqrt of the power, 255 = full scale), message
+	rssi := -999.0
+	if sig := unescaped[6]; sig > 0 {
+		rssi = 20 * math.Log10(float64(sig)/255)
+	}
+	return "*" + hex.EncodeToString(unescaped[7:]) + ";", rssi
+}
+
+// Closes the current file. rfCapture.mu must be held.
+func (c *rfCaptureWriter) close() {
+	if c.file == nil {
+		return
+	}
+	if err := c.gz.Close(); err != nil {
+		logErrorf("rfcapture", "%s: %s", c.name, err.Error())
+	}
+	c.file.Close()
+	c.file, c.gz, c.name = nil, nil, ""
+}
+
+// rfCapture.mu must be held.
+func (c *rfCaptureWriter) write(f rfCaptureFrame) error {
+	if c.file == nil {
+		if err := os.MkdirAll(rfCaptureDirf, 0755); err != nil {
+			return err
+		}
+		name := "rf_" + f.Time.Format("20060102T150405Z") + ".log.gz"
+		// Appended as another gzip member if one was started in the same second
+		fp, err := os.OpenFile(filepath.Join(rfCaptureDirf, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		c.name, c.file, c.gz, c.size, c.opened = name, fp, gzip.NewWriter(fp), 0, time.Now()
+		logInfof("rfcapture", "capturing %v to %s", rfCaptureBands(), name)
+	}
+	n, err := fmt.Fprintf(c.gz, "%s %s %.1f %s\n", f.Time.Format("2006-01-02T15:04:05.000000Z"), f.Band, f.RSSI, f.Data)
+	c.size += int64(n)
+	c.frames++
+	if c.size >= RF_CAPTURE_FILE_SIZE {
+		c.close()
+		applyRFCaptureRetention()
+	}
+	return err
+}
+
+func listRFCaptureFiles() []RFCaptureFile {
+	files := make([]RFCaptureFile, 0)
+	infos, _ := ioutil.ReadDir(rfCaptureDirf)
+	for _, fi := range infos {
+		if !rfCaptureFileName.MatchString(fi.Name()) {
+			continue
+		}
+		start, _ := time.Parse("20060102T150405Z", fi.Name()[3:19])
+		files = append(files, RFCaptureFile{Name: fi.Name(), Size: fi.Size(), Start: start, Modified: fi.ModTime(),
+			Current: fi.Name() == rfCapture.name})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name > files[j].Name }) // newest first
+	return files
+}
+
+// Deletes the files beyond globalSettings.RFCaptureMaxAge and RFCaptureMaxMB, oldest first. rfCapture.mu must be held.
+func applyRFCaptureRetention() {
+	var total int64
+	for _, f := range listRFCaptureFiles() {
+		total += f.Size
+		tooOld := globalSettings.RFCaptureMaxAge > 0 && time.Since(f.Modified) > time.Duration(globalSettings.RFCaptureMaxAge)*time.Hour
+		tooBig := globalSettings.RFCaptureMaxMB > 0 && total > int64(globalSettings.RFCaptureMaxMB)*1024*1024
+		if f.Current || (!tooOld && !tooBig) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(rfCaptureDirf, f.Name)); err != nil {
+			logWarnf("rfcapture", "%s", err.Error())
+			continue
+		}
+		total -= f.Size
+		logInfof("rfcapture", "deleted %s", f.Name)
+	}
+}
+
+// Writes the queued frames, flushes and rotates the files.
+func rfCaptureWriterLoop() {
+	ticker := time.NewTicker(RF_CAPTURE_FLUSH)
+	lastErr := time.Time{}
+	for {
+		select {
+		case f := <-rfCaptureQueue:
+			rfCapture.mu.Lock()
+			if err := rfCapture.write(f); err != nil && time.Since(lastErr) > 10*time.Minute {
+				lastErr = time.Now()
+				logErrorf("rfcapture", "%s", err.Error())
+			}
+			rfCapture.mu.Unlock()
+		case <-ticker.C:
+			rfCapture.mu.Lock()
+			if rfCapture.file != nil {
+				if len(rfCaptureBands()) == 0 || time.Since(rfCapture.opened) >= RF_CAPTURE_FILE_AGE {
+					rfCapture.close()
+				} else {
+					rfCapture.gz.Flush()
+				}
+			}
+			applyRFCaptureRetention()
+			rfCapture.mu.Unlock()
+		}
+	}
+}
+
+// Finishes the current file, called on shutdown.
+func closeRFCapture() {
+	rfCapture.mu.Lock()
+	defer rfCapture.mu.Unlock()
+	rfCapture.close()
+}
+
+func getRFCaptureStatus() RFCaptureStatus {
+	rfCapture.mu.Lock()
+	defer rfCapture.mu.Unlock()
+	if rfCapture.gz != nil {
+		rfCapture.gz.Flush() // so the size is current and the file can be downloaded
+	}
+	status := RFCaptureStatus{
+		Bands:   rfCaptureBands(),
+		Frames:  rfCapture.frames,
+		Dropped: atomic.LoadUint64(&rfCapture.dropped),
+		MaxMB:   globalSettings.RFCaptureMaxMB,
+		MaxAge:  globalSettings.RFCaptureMaxAge,
+		Files:   listRFCaptureFiles(),
+	}
+	for _, f := range status.Files {
+		status.TotalSize += f.Size
+	}
+	return status
+}
+
+// AJAX call - /getRFCapture.
+func handleRFCaptureGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, err := json.Marshal(getRFCaptureStatus())
+	if err != nil {
+		logErrorf("rfcapture", "Error sending RF capture JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /downloadRFCapture?file=<name>. All files as zip without file.
+func handleRFCaptureDownloadRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	closeRFCapture() // so it's a complete gzip file, the capture continues in a new one
+	status := getRFCaptureStatus()
+	if name := r.URL.Query().Get("file"); len(name) > 0 {
+		if !rfCaptureFileName.MatchString(name) {
+			http.Error(w, fmt.Sprintf("invalid file '%s'", name), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", "attachment; filename="+name)
+		http.ServeFile(w, r, filepath.Join(rfCaptureDirf, name))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=stratux-rfcapture-%s.zip", time.Now().UTC().Format("20060102-150405")))
+	z := zip.NewWriter(w)
+	defer z.Close()
+	for _, f := range status.Files {
+		fp, err := os.Open(filepath.Join(rfCaptureDirf, f.Name))
+		if err != nil {
+			continue
+		}
+		// Already compressed
+		if zf, err := z.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Store, Modified: f.Modified}); err == nil {
+			io.Copy(zf, fp)
+		}
+		fp.Close()
+	}
+	logInfof("rfcapture", "capture downloaded by %s", r.RemoteAddr)
+}
+
+// AJAX call - /deleteRFCapture?file=<name>. All files without file.
+func handleRFCaptureDeleteRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	name := r.URL.Query().Get("file")
+	if len(name) > 0 && !rfCaptureFileName.MatchString(name) {
+		http.Error(w, fmt.Sprintf("invalid file '%s'", name), http.StatusBadRequest)
+		return
+	}
+	rfCapture.mu.Lock()
+	for _, f := range listRFCaptureFiles() {
+		if len(name) == 0 || f.Name == name {
+			if f.Current {
+				rfCapture.close() // a new one is started with the next frame
+			}
+			os.Remove(filepath.Join(rfCaptureDirf, f.Name))
+		}
+	}
+	rfCapture.mu.Unlock()
+	handleRFCaptureGetRequest(w, r)
+}
@@ -1,3 +1,6 @@
+//go:build !nohw
+// +build !nohw
+
 /*
 	Copyright (c) 2015-2016 Christopher Young
 	Distributable under the terms of The "BSD New" License
@@ -5,13 +8,15 @@
 	as part of this header.
 
 	sdr.go: SDR monitoring, SDR management, data input from UAT/1090ES channels.
+		Requires librtlsdr and libdump978. Build with -tags nohw to use the stubs in sdr_nohw.go instead.
 */
 
 package main
 
 import (
 	"bufio"
-	"log"
+	"fmt"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
@@ -34,6 +39,16 @@ type Device struct {
 	ppm     int
 	serial  string
 	idSet   bool
+	remote  string // host:port of an rtl_tcp server instead of a local dongle, see sdr_remote.go
+
+	gain        int   // tuner gain, tenths of dB
+	gains       []int // gains supported by the tuner (978 only)
+	pendingGain int32 // gain change requested by sdrGainOptimizer(), -1 = none
+	restartCh   chan int
+
+	ppmCal *ppmEstimator // 978 PPM calibration in progress, see sdr_ppm.go
+
+	alive time.Time // last sign of life of the demodulator, see sdr_watchdog.go
 }
 
 // UAT is a 978 MHz device
@@ -60,26 +75,18 @@ var OGNDev *OGN
 // AISDev holds a 162 MHz dongle object
 var AISDev *AIS
 
-type Dump1090TermMessage struct {
-	Text   string
-	Source string
-}
-
-type AISTermMessage struct {
-	Text   string
-	Source string
-}
-
 func (e *ES) read() {
 	defer e.wg.Done()
-	log.Println("Entered ES read() ...")
-	cmd := exec.Command(STRATUX_HOME + "/bin/dump1090", "--fix", "--gain", "37.2", "--net-stratux-port", "30006",  "--net", "--device-index", strconv.Itoa(e.indexID), "--ppm", strconv.Itoa(e.ppm))
+	logDebugf("sdr", "Entered ES read() ...")
+	os.MkdirAll(DUMP1090_JSON_DIR, 0755) // stats.json for the auto gain
+	cmd := exec.Command(STRATUX_HOME + "/bin/dump1090", "--fix", "--gain", fmt.Sprintf("%.1f", float64(e.gain)/10), "--net-stratux-port", "30006",  "--net", "--net-bo-port", strconv.Itoa(ES_BEAST_PORT),
+		"--write-json", DUMP1090_JSON_DIR, "--device-index", strconv.Itoa(e.indexID), "--ppm", strconv.Itoa(e.ppm))
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
 	err := cmd.Start()
 	if err != nil {
-		log.Printf("Error executing " + STRATUX_HOME + "/bin/dump1090: %s\n", err)
+		logErrorf("sdr", "Error executing %s/bin/dump1090: %s", STRATUX_HOME, err)
 		// don't return immediately, use the proper shutdown procedure
 		shutdownES = true
 		for {
@@ -92,9 +99,10 @@ func (e *ES) read() {
 		}
 	}
 
-	log.Println("Executed " + cmd.String() + " successfully...")
+	logInfof("sdr", "Executed %s successfully...", cmd.String())
 
 	done := make(chan bool)
+	var restart int32 // set by the gain change below, atomic
 
 	go func() {
 		for {
@@ -102,12 +110,17 @@ func (e *ES) read() {
 			case <-done:
 				return
 			case <-e.closeCh:
-				log.Println("ES read(): shutdown msg received, calling cmd.Process.Kill() ...")
+				logDebugf("sdr", "ES read(): shutdown msg received, calling cmd.Process.Kill() ...")
 				err := cmd.Process.Kill()
 				if err == nil {
-					log.Println("kill successful...")
+					logDebugf("sdr", "kill successful...")
 				}
 				return
+			case <-e.restartCh:
+				logInfof("sdr", "ES read(): gain changed, restarting dump1090 ...")
+				atomic.StoreInt32(&restart, 1)
+				cmd.Process.Kill()
+				return
 			default:
 				time.Sleep(1 * time.Second)
 			}
@@ -154,11 +167,16 @@ func (e *ES) read() {
 	// the "done" channel, which ensures we don't leak
 	// goroutines...
 	close(done)
+
+	if atomic.LoadInt32(&restart) != 0 && !shutdownES {
+		e.wg.Add(1)
+		go e.read()
+	}
 }
 
 func (u *UAT) read() {
 	defer u.wg.Done()
-	log.Println("Entered UAT read() ...")
+	logDebugf("sdr", "Entered UAT read() ...")
 	var buffer = make([]uint8, rtl.DefaultBufLength)
 
 	for {
@@ -167,7 +185,7 @@ func (u *UAT) read() {
 			nRead, err := u.dev.ReadSync(buffer, rtl.DefaultBufLength)
 			if err != nil {
 				if globalSettings.DEBUG {
-					log.Printf("\tReadSync Failed - error: %s\n", err)
+					logDebugf("sdr", "\tReadSync Failed - error: %s", err)
 				}
 				if shutdownUAT != true {
 					shutdownUAT = true
@@ -176,11 +194,19 @@ func (u *UAT) read() {
 			}
 
 			if nRead > 0 {
+				u.alive = stratuxClock.Time
 				buf := buffer[:nRead]
+				if globalSettings.SDRAutoGain {
+					countClippedSamples(buf)
+				}
+				if u.ppmCal != nil {
+					u.calibratePPM(buf)
+				}
 				godump978.InChan <- buf
 			}
+			u.applyPendingGain()
 		case <-u.closeCh:
-			log.Println("UAT read(): shutdown msg received...")
+			logDebugf("sdr", "UAT read(): shutdown msg received...")
 			return
 		}
 	}
@@ -188,11 +214,11 @@ func (u *UAT) read() {
 
 func (f *OGN) read() {
 	defer f.wg.Done()
-	log.Println("Entered OGN read() ...")
+	logDebugf("sdr", "Entered OGN read() ...")
 
 	// ogn-rx doesn't like the time jumping forward while running.. delay initial startup until we have a valid system time
 	if !isGPSClockValid() {
-		log.Printf("Delaying ogn-rx start until we have a valid GPS time")
+		logInfof("sdr", "Delaying ogn-rx start until we have a valid GPS time")
 		loop: for {
 			select {
 			case <- f.closeCh:
@@ -218,7 +244,7 @@ func (f *OGN) read() {
 
 	err := cmd.Start()
 	if err != nil {
-		log.Printf("OGN: Error executing ogn-rx-eu: %s\n", err)
+		logErrorf("ogn", "Error executing ogn-rx-eu: %s", err)
 		// don't return immediately, use the proper shutdown procedure
 		shutdownOGN = true
 		for {
@@ -231,7 +257,7 @@ func (f *OGN) read() {
 		}
 	}
 
-	log.Println("OGN: Executed ogn-rx-eu successfully...")
+	logInfof("ogn", "Executed ogn-rx-eu successfully...")
 
 	done := make(chan bool)
 
@@ -241,11 +267,11 @@ func (f *OGN) read() {
 			case <-done:
 				return
 			case <-f.closeCh:
-				log.Println("OGN read(): shutdown msg received, calling cmd.Process.Kill() ...")
+				logDebugf("sdr", "OGN read(): shutdown msg received, calling cmd.Process.Kill() ...")
 				autoRestart = false
 				err := cmd.Process.Kill()
 				if err == nil {
-					log.Println("kill successful...")
+					logDebugf("sdr", "kill successful...")
 				}
 				return
 			default:
@@ -264,7 +290,7 @@ func (f *OGN) read() {
 				line, err := reader.ReadString('\n')
 				line = strings.TrimSpace(line)
 				if err == nil  && len(line) > 0 /* && globalSettings.DEBUG */ {
-					log.Println("OGN: ogn-rx-eu stdout: ", line)
+					logInfof("ogn", "ogn-rx-eu stdout: %v", line)
 				}
 			}
 		}
@@ -279,7 +305,7 @@ func (f *OGN) read() {
 			default:
 				line, err := reader.ReadString('\n')
 				if err == nil {
-					log.Println("OGN: ogn-rx-eu stderr: ", strings.TrimSpace(line))
+					logInfof("ogn", "ogn-rx-eu stderr: %v", strings.TrimSpace(line))
 				}
 			}
 		}
@@ -287,7 +313,7 @@ func (f *OGN) read() {
 
 	cmd.Wait()
 
-	log.Println("OGN: ogn-rx-eu terminated...")
+	logInfof("ogn", "ogn-rx-eu terminated...")
 
 	// we get here if A) the ogn-rx-eu process died
 	// on its own or B) cmd.Process.Kill() was called
@@ -298,7 +324,7 @@ func (f *OGN) read() {
 
 	if autoRestart && !shutdownOGN{
 		time.Sleep(5 * time.Second)
-		log.Println("OGN: restarting crashed ogn-rx-eu")
+		logWarnf("ogn", "restarting crashed ogn-rx-eu")
 		f.wg.Add(1)
 		go f.read()
 	}
@@ -306,14 +332,14 @@ func (f *OGN) read() {
 
 func (e *AIS) read() {
 	defer e.wg.Done()
-	log.Println("Entered AIS read() ...")
+	logDebugf("sdr", "Entered AIS read() ...")
 	cmd := exec.Command(STRATUX_HOME + "/bin/rtl_ais", "-T", "-k", "-p", strconv.Itoa(e.ppm), "-d", strconv.Itoa(e.indexID))
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
 
 	err := cmd.Start()
 	if err != nil {
-		log.Printf("Error executing " + STRATUX_HOME + "/bin/rtl_ais: %s\n", err)
+		logErrorf("sdr", "Error executing %s/bin/rtl_ais: %s", STRATUX_HOME, err)
 		// don't return immediately, use the proper shutdown procedure
 		shutdownES = true
 		for {
@@ -326,7 +352,7 @@ func (e *AIS) read() {
 		}
 	}
 
-	log.Println("Executed " + cmd.String() + " successfully...")
+	logInfof("sdr", "Executed %s successfully...", cmd.String())
 
 	done := make(chan bool)
 
@@ -336,13 +362,14 @@ func (e *AIS) read() {
 			case <-done:
 				return
 			case <-e.closeCh:
-				log.Println("AIS read(): shutdown msg received, calling cmd.Process.Kill() ...")
+				logDebugf("sdr", "AIS read(): shutdown msg received, calling cmd.Process.Kill() ...")
 				err := cmd.Process.Kill()
 				if err == nil {
-					log.Println("kill successful...")
+					logDebugf("sdr", "kill successful...")
 				}
 				return
 			default:
+				e.alive = stratuxClock.Time // rtl_ais is still running
 				time.Sleep(1 * time.Second)
 			}
 		}
@@ -390,40 +417,75 @@ func (e *AIS) read() {
 	close(done)
 }
 
-func getPPM(serial string) int {
+// PPM value set in the serial ("stx:<freq>:<ppm>").
+func serialPPM(serial string) (int, bool) {
 	r, err := regexp.Compile("str?a?t?u?x:\\d+:?(-?\\d*)")
 	if err != nil {
-		return globalSettings.PPM
+		return 0, false
 	}
 
 	arr := r.FindStringSubmatch(serial)
 	if arr == nil {
-		return globalSettings.PPM
+		return 0, false
 	}
 
 	ppm, err := strconv.Atoi(arr[1])
 	if err != nil {
-		return globalSettings.PPM
+		return 0, false
+	}
+
+	return ppm, true
+}
+
+// PPM from the serial, the learned correction (see sdr_ppm.go) or the global setting, in this order.
+func getPPM(serial string) int {
+	if ppm, ok := serialPPM(serial); ok {
+		return ppm
 	}
+	if ppm, ok := globalSettings.SDRPPMs[serial]; ok && globalSettings.SDRPPMAutoCal {
+		return ppm
+	}
+	return globalSettings.PPM
+}
 
-	return ppm
+/*
+	setBiasTee().
+		Bias tee (RTL-SDR v3/Blog V4, powers LNAs through the antenna cable) of a dongle that is used by an external
+		program. The state survives closing the device, so it is set before dump1090/ogn-rx-eu/rtl_ais is started.
+*/
+func setBiasTee(indexID int, enable bool) {
+	dev, err := rtl.Open(indexID)
+	if err != nil {
+		logErrorf("sdr", "\tSetBiasTee: Open Failed - error: %s", err)
+		return
+	}
+	defer dev.Close()
+	if err := dev.SetBiasTee(enable); err != nil {
+		logErrorf("sdr", "\tSetBiasTee %t Failed - error: %s", enable, err)
+		return
+	}
+	logInfof("sdr", "\tSetBiasTee %t Successful", enable)
 }
 
 func (e *ES) sdrConfig() (err error) {
 	e.ppm = getPPM(e.serial)
-	log.Printf("===== ES Device Serial: %s PPM %d =====\n", e.serial, e.ppm)
+	e.gain = learnedGain(e.serial, ES_TUNER_GAIN)
+	logInfof("sdr", "===== ES Device Serial: %s PPM %d =====", e.serial, e.ppm)
+	setBiasTee(e.indexID, globalSettings.ES_BiasTee)
 	return
 }
 
 func (f *OGN) sdrConfig() (err error) {
 	f.ppm = getPPM(f.serial)
-	log.Printf("===== OGN Device Serial: %s PPM %d =====\n", f.serial, f.ppm)
+	logInfof("sdr", "===== OGN Device Serial: %s PPM %d =====", f.serial, f.ppm)
+	setBiasTee(f.indexID, globalSettings.OGN_BiasTee)
 	return
 }
 
 func (f *AIS) sdrConfig() (err error) {
 	f.ppm = getPPM(f.serial)
-	log.Printf("===== AIS Device Serial: %s PPM %d =====\n", f.serial, f.ppm)
+	logInfof("sdr", "===== AIS Device Serial: %s PPM %d =====", f.serial, f.ppm)
+	setBiasTee(f.indexID, globalSettings.AIS_BiasTee)
 	return
 }
 
@@ -438,110 +500,125 @@ const (
 )
 
 func (u *UAT) sdrConfig() (err error) {
-	log.Printf("===== UAT Device Name  : %s =====\n", rtl.GetDeviceName(u.indexID))
-	log.Printf("===== UAT Device Serial: %s=====\n", u.serial)
+	logInfof("sdr", "===== UAT Device Name  : %s =====", rtl.GetDeviceName(u.indexID))
+	logInfof("sdr", "===== UAT Device Serial: %s=====", u.serial)
 
 	if u.dev, err = rtl.Open(u.indexID); err != nil {
-		log.Printf("\tUAT Open Failed...\n")
+		logErrorf("sdr", "\tUAT Open Failed...")
 		return
 	}
-	log.Printf("\tGetTunerType: %s\n", u.dev.GetTunerType())
+	logInfof("sdr", "\tGetTunerType: %s", u.dev.GetTunerType())
 
 	//---------- Set Tuner Gain ----------
 	err = u.dev.SetTunerGainMode(true)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetTunerGainMode Failed - error: %s\n", err)
+		logErrorf("sdr", "\tSetTunerGainMode Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tSetTunerGainMode Successful\n")
+	logInfof("sdr", "\tSetTunerGainMode Successful")
 
-	err = u.dev.SetTunerGain(TunerGain)
+	u.gain = learnedGain(u.serial, TunerGain)
+	u.pendingGain = -1
+	if u.gains, err = u.dev.GetTunerGains(); err != nil {
+		logErrorf("sdr", "\tGetTunerGains Failed - error: %s", err) // no auto gain
+	}
+	err = u.dev.SetTunerGain(u.gain)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetTunerGain Failed - error: %s\n", err)
+		logErrorf("sdr", "\tSetTunerGain Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tSetTunerGain Successful\n")
+	logInfof("sdr", "\tSetTunerGain Successful")
 
 	tgain := u.dev.GetTunerGain()
-	log.Printf("\tGetTunerGain: %d\n", tgain)
+	logInfof("sdr", "\tGetTunerGain: %d", tgain)
 
 	//---------- Get/Set Sample Rate ----------
 	err = u.dev.SetSampleRate(SampleRate)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetSampleRate Failed - error: %s\n", err)
+		logErrorf("sdr", "\tSetSampleRate Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tSetSampleRate - rate: %d\n", SampleRate)
+	logInfof("sdr", "\tSetSampleRate - rate: %d", SampleRate)
 
-	log.Printf("\tGetSampleRate: %d\n", u.dev.GetSampleRate())
+	logInfof("sdr", "\tGetSampleRate: %d", u.dev.GetSampleRate())
 
 	//---------- Get/Set Xtal Freq ----------
 	rtlFreq, tunerFreq, err := u.dev.GetXtalFreq()
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tGetXtalFreq Failed - error: %s\n", err)
+		logErrorf("sdr", "\tGetXtalFreq Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tGetXtalFreq - Rtl: %d, Tuner: %d\n", rtlFreq, tunerFreq)
+	logInfof("sdr", "\tGetXtalFreq - Rtl: %d, Tuner: %d", rtlFreq, tunerFreq)
 
 	err = u.dev.SetXtalFreq(NewRTLFreq, NewTunerFreq)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetXtalFreq Failed - error: %s\n", err)
+		logErrorf("sdr", "\tSetXtalFreq Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tSetXtalFreq - Center freq: %d, Tuner freq: %d\n",
+	logInfof("sdr", "\tSetXtalFreq - Center freq: %d, Tuner freq: %d",
 		NewRTLFreq, NewTunerFreq)
 
 	//---------- Get/Set Center Freq ----------
 	err = u.dev.SetCenterFreq(CenterFreq)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetCenterFreq 978MHz Failed, error: %s\n", err)
+		logErrorf("sdr", "\tSetCenterFreq 978MHz Failed, error: %s", err)
 		return
 	}
-	log.Printf("\tSetCenterFreq 978MHz Successful\n")
+	logInfof("sdr", "\tSetCenterFreq 978MHz Successful")
 
-	log.Printf("\tGetCenterFreq: %d\n", u.dev.GetCenterFreq())
+	logInfof("sdr", "\tGetCenterFreq: %d", u.dev.GetCenterFreq())
 
 	//---------- Set Bandwidth ----------
-	log.Printf("\tSetting Bandwidth: %d\n", Bandwidth)
+	logInfof("sdr", "\tSetting Bandwidth: %d", Bandwidth)
 	if err = u.dev.SetTunerBw(Bandwidth); err != nil {
 		u.dev.Close()
-		log.Printf("\tSetTunerBw %d Failed, error: %s\n", Bandwidth, err)
+		logErrorf("sdr", "\tSetTunerBw %d Failed, error: %s", Bandwidth, err)
 		return
 	}
-	log.Printf("\tSetTunerBw %d Successful\n", Bandwidth)
+	logInfof("sdr", "\tSetTunerBw %d Successful", Bandwidth)
 
 	if err = u.dev.ResetBuffer(); err != nil {
 		u.dev.Close()
-		log.Printf("\tResetBuffer Failed - error: %s\n", err)
+		logErrorf("sdr", "\tResetBuffer Failed - error: %s", err)
 		return
 	}
-	log.Printf("\tResetBuffer Successful\n")
+	logInfof("sdr", "\tResetBuffer Successful")
 
 	//---------- Get/Set Freq Correction ----------
 	freqCorr := u.dev.GetFreqCorrection()
-	log.Printf("\tGetFreqCorrection: %d\n", freqCorr)
+	logInfof("sdr", "\tGetFreqCorrection: %d", freqCorr)
 
 	u.ppm = getPPM(u.serial)
 	err = u.dev.SetFreqCorrection(u.ppm)
 	if err != nil {
 		u.dev.Close()
-		log.Printf("\tSetFreqCorrection %d Failed, error: %s\n", u.ppm, err)
+		logErrorf("sdr", "\tSetFreqCorrection %d Failed, error: %s", u.ppm, err)
 		return
 	}
-	log.Printf("\tSetFreqCorrection %d Successful\n", u.ppm)
+	logInfof("sdr", "\tSetFreqCorrection %d Successful", u.ppm)
+	if _, ok := serialPPM(u.serial); !ok && globalSettings.SDRPPMAutoCal {
+		u.ppmCal = newPPMEstimator(SampleRate, CenterFreq)
+	}
+
+	//---------- Set Bias Tee ----------
+	if err := u.dev.SetBiasTee(globalSettings.UAT_BiasTee); err != nil {
+		logErrorf("sdr", "\tSetBiasTee %t Failed - error: %s", globalSettings.UAT_BiasTee, err) // not fatal, most dongles don't have one
+	} else {
+		logInfof("sdr", "\tSetBiasTee %t Successful", globalSettings.UAT_BiasTee)
+	}
 
 	return
 }
 
 // Read from the godump978 channel - on or off.
 func uatReader() {
-	log.Println("Entered uatReader() ...")
+	logDebugf("sdr", "Entered uatReader() ...")
 	for {
 		uat := <-godump978.OutChan
 		o, msgtype := parseInput(uat)
@@ -588,42 +665,42 @@ func (f *AIS) writeID() error {
 }
 
 func (u *UAT) shutdown() {
-	log.Println("Entered UAT shutdown() ...")
+	logDebugf("sdr", "Entered UAT shutdown() ...")
 	close(u.closeCh) // signal to shutdown
-	log.Println("UAT shutdown(): calling u.wg.Wait() ...")
+	logDebugf("sdr", "UAT shutdown(): calling u.wg.Wait() ...")
 	u.wg.Wait() // Wait for the goroutine to shutdown
-	log.Println("UAT shutdown(): u.wg.Wait() returned...")
-	log.Println("UAT shutdown(): closing device ...")
-	u.dev.Close() // preempt the blocking ReadSync call
-	log.Println("UAT shutdown() complete ...")
+	logDebugf("sdr", "UAT shutdown(): u.wg.Wait() returned...")
+	if u.dev != nil {
+		logDebugf("sdr", "UAT shutdown(): closing device ...")
+		u.dev.Close() // preempt the blocking ReadSync call
+	}
+	logDebugf("sdr", "UAT shutdown() complete ...")
 }
 
 func (e *ES) shutdown() {
-	log.Println("Entered ES shutdown() ...")
+	logDebugf("sdr", "Entered ES shutdown() ...")
 	close(e.closeCh) // signal to shutdown
-	log.Println("ES shutdown(): calling e.wg.Wait() ...")
+	logDebugf("sdr", "ES shutdown(): calling e.wg.Wait() ...")
 	e.wg.Wait() // Wait for the goroutine to shutdown
-	log.Println("ES shutdown() complete ...")
+	logDebugf("sdr", "ES shutdown() complete ...")
 }
 
 func (f *OGN) shutdown() {
-	log.Println("Entered OGN shutdown() ...")
+	logDebugf("sdr", "Entered OGN shutdown() ...")
 	close(f.closeCh) // signal to shutdown
-	log.Println("signal shutdown(): calling f.wg.Wait() ...")
+	logDebugf("sdr", "signal shutdown(): calling f.wg.Wait() ...")
 	f.wg.Wait() // Wait for the goroutine to shutdown
-	log.Println("signal shutdown() complete ...")
+	logDebugf("sdr", "signal shutdown() complete ...")
 }
 
 func (f *AIS) shutdown() {
-	log.Println("Entered AIS shutdown() ...")
+	logDebugf("sdr", "Entered AIS shutdown() ...")
 	close(f.closeCh) // signal to shutdown
-	log.Println("signal shutdown(): calling f.wg.Wait() ...")
+	logDebugf("sdr", "signal shutdown(): calling f.wg.Wait() ...")
 	f.wg.Wait() // Wait for the goroutine to shutdown
-	log.Println("signal shutdown() complete ...")
+	logDebugf("sdr", "signal shutdown() complete ...")
 }
 
-var sdrShutdown bool
-
 func sdrKill() {
 	// Send signal to shutdown to sdrWatcher().
 	sdrShutdown = true
@@ -680,7 +757,7 @@ func (r *regexAIS) hasID(serial string) bool {
 func createUATDev(id int, serial string, idSet bool) error {
 	UATDev = &UAT{indexID: id, serial: serial}
 	if err := UATDev.sdrConfig(); err != nil {
-		log.Printf("UATDev.sdrConfig() failed: %s\n", err)
+		logErrorf("sdr", "UATDev.sdrConfig() failed: %s", err)
 		UATDev = nil
 		return err
 	}
@@ -695,13 +772,14 @@ func createUATDev(id int, serial string, idSet bool) error {
 func createESDev(id int, serial string, idSet bool) error {
 	ESDev = &ES{indexID: id, serial: serial}
 	if err := ESDev.sdrConfig(); err != nil {
-		log.Printf("ESDev.sdrConfig() failed: %s\n", err)
+		logErrorf("sdr", "ESDev.sdrConfig() failed: %s", err)
 		ESDev = nil
 		return err
 	}
 	ESDev.wg = &sync.WaitGroup{}
 	ESDev.idSet = idSet
 	ESDev.closeCh = make(chan int)
+	ESDev.restartCh = make(chan int, 1)
 	ESDev.wg.Add(1)
 	go ESDev.read()
 	return nil
@@ -710,7 +788,7 @@ func createESDev(id int, serial string, idSet bool) error {
 func createOGNDev(id int, serial string, idSet bool) error {
 	OGNDev = &OGN{indexID: id, serial: serial}
 	if err := OGNDev.sdrConfig(); err != nil {
-		log.Printf("OGNDev.sdrConfig() failed: %s\n", err)
+		logErrorf("sdr", "OGNDev.sdrConfig() failed: %s", err)
 		OGNDev = nil
 		return err
 	}
@@ -725,7 +803,7 @@ func createOGNDev(id int, serial string, idSet bool) error {
 func createAISDev(id int, serial string, idSet bool) error {
 	AISDev = &AIS{indexID: id, serial: serial}
 	if err := AISDev.sdrConfig(); err != nil {
-		log.Printf("AISDev.sdrConfig() failed: %s\n", err)
+		logErrorf("sdr", "AISDev.sdrConfig() failed: %s", err)
 		AISDev = nil
 		return err
 	}
@@ -737,33 +815,73 @@ func createAISDev(id int, serial string, idSet bool) error {
 	return nil
 }
 
+/*
+	dongleRole().
+		Role of a dongle: assigned in the SDR manager (globalSettings.SDRRoles), from the serial tag, or "" for
+		anonymous dongles. Returns the role and where it came from.
+*/
+func dongleRole(serial string) (string, string) {
+	if role, ok := globalSettings.SDRRoles[serial]; ok {
+		return role, "setting"
+	}
+	switch {
+	case rUAT.hasID(serial):
+		return SDR_ROLE_UAT, "serial"
+	case rES.hasID(serial):
+		return SDR_ROLE_ES, "serial"
+	case rOGN.hasID(serial):
+		return SDR_ROLE_OGN, "serial"
+	case rAIS.hasID(serial):
+		return SDR_ROLE_AIS, "serial"
+	}
+	return "", ""
+}
+
 func configDevices(count int, esEnabled, uatEnabled, ognEnabled, aisEnabled bool) {
-	// once the tagged dongles have been assigned, explicitly range over
+	// once the dongles with a role have been assigned, explicitly range over
 	// the remaining IDs and assign them to any anonymous dongles
 	unusedIDs := make(map[int]string)
+	dongles := make([]SDRDongle, 0)
+	taken := make(map[string]string) // role -> serial of the dongle that has it
+	conflicts := make([]string, 0)
 
-	// loop 1: assign tagged dongles
+	// loop 1: assign dongles with a role
 	for i := 0; i < count; i++ {
-		_, _, s, err := rtl.GetDeviceUsbStrings(i)
-		if err == nil {
-			//FIXME: Trim NULL from the serial. Best done in gortlsdr, but putting this here for now.
-			s = strings.Trim(s, "\x00")
-			// no need to check if createXDev returned an error; if it
-			// failed to config the error is logged and we can ignore
-			// it here so it doesn't get queued up again
-			if uatEnabled && UATDev == nil && rUAT.hasID(s) {
-				createUATDev(i, s, true)
-			} else if esEnabled && ESDev == nil && rES.hasID(s) {
-				createESDev(i, s, true)
-			} else if ognEnabled && OGNDev == nil && rOGN.hasID(s) {
-				createOGNDev(i, s, true)
-			} else if aisEnabled && AISDev == nil && rAIS.hasID(s) {
-				createAISDev(i, s, true)
-			} else {
-				unusedIDs[i] = s
-			}
-		} else {
-			log.Printf("rtl.GetDeviceUsbStrings id %d: %s\n", i, err)
+		m, p, s, err := rtl.GetDeviceUsbStrings(i)
+		if err != nil {
+			logInfof("sdr", "rtl.GetDeviceUsbStrings id %d: %s", i, err)
+			continue
+		}
+		//FIXME: Trim NULL from the serial. Best done in gortlsdr, but putting this here for now.
+		s = strings.Trim(s, "\x00")
+		d := SDRDongle{Index: i, Serial: s, Manufacturer: strings.Trim(m, "\x00"), Product: strings.Trim(p, "\x00")}
+		d.Role, d.RoleSource = dongleRole(s)
+		if first, ok := taken[d.Role]; ok && d.Role != "" && d.Role != SDR_ROLE_OFF {
+			// e.g. two dongles with the same serial - we can't tell them apart, use the first one only
+			d.Conflict = true
+			conflicts = append(conflicts, fmt.Sprintf("%s and %s are both assigned to %s MHz, only the first one is used", first, s, d.Role))
+			dongles = append(dongles, d)
+			continue
+		}
+		taken[d.Role] = s
+		dongles = append(dongles, d)
+
+		// no need to check if createXDev returned an error; if it
+		// failed to config the error is logged and we can ignore
+		// it here so it doesn't get queued up again
+		switch {
+		case d.Role == SDR_ROLE_UAT && uatEnabled && UATDev == nil:
+			createUATDev(i, s, true)
+		case d.Role == SDR_ROLE_ES && esEnabled && ESDev == nil:
+			createESDev(i, s, true)
+		case d.Role == SDR_ROLE_OGN && ognEnabled && OGNDev == nil:
+			createOGNDev(i, s, true)
+		case d.Role == SDR_ROLE_AIS && aisEnabled && AISDev == nil:
+			createAISDev(i, s, true)
+		case d.Role == SDR_ROLE_OFF || d.RoleSource == "setting":
+			// assigned in the SDR manager to something that's disabled: don't use it for anything else
+		default:
+			unusedIDs[i] = s
 		}
 	}
 
@@ -772,9 +890,10 @@ func configDevices(count int, esEnabled, uatEnabled, ognEnabled, aisEnabled bool
 	// dongles are set to the same stratux id and the unconsumed,
 	// non-anonymous, dongle makes it to this loop.
 	for i, s := range unusedIDs {
-		if uatEnabled && !globalStatus.UATRadio_connected && UATDev == nil && !rES.hasID(s) && !rOGN.hasID(s) {
+		role, _ := dongleRole(s)
+		if uatEnabled && !globalStatus.UATRadio_connected && UATDev == nil && role != SDR_ROLE_ES && role != SDR_ROLE_OGN {
 			createUATDev(i, s, false)
-		} else if esEnabled && ESDev == nil && !rUAT.hasID(s) && !rOGN.hasID(s) {
+		} else if esEnabled && ESDev == nil && role != SDR_ROLE_UAT && role != SDR_ROLE_OGN {
 			createESDev(i, s, false)
 		} else if ognEnabled && OGNDev == nil {
 			createOGNDev(i, s, false)
@@ -782,15 +901,40 @@ func configDevices(count int, esEnabled, uatEnabled, ognEnabled, aisEnabled bool
 			createAISDev(i, s, false)
 		}
 	}
+
+	sdrDonglesMutex.Lock()
+	sdrDongles = dongles
+	sdrDonglesMutex.Unlock()
+	if len(conflicts) > 0 {
+		addSingleSystemErrorf("sdrroles", "SDR role conflict: %s. Assign the roles in the SDR manager "+
+			"(dongles with the same serial need a unique serial, see rtl_eeprom).", strings.Join(conflicts, "; "))
+	} else {
+		removeSingleSystemError("sdrroles")
+	}
 }
 
-// to keep our sync primitives synchronized, only exit a read
-// method's goroutine via the close flag channel check, to
-// include catastrophic dongle failures
-var shutdownES bool
-var shutdownUAT bool
-var shutdownOGN bool
-var shutdownAIS bool
+// Dongles of the last configuration, with the role they are currently used for.
+func getSDRDongles() []SDRDongle {
+	sdrDonglesMutex.Lock()
+	dongles := append([]SDRDongle{}, sdrDongles...)
+	sdrDonglesMutex.Unlock()
+	for i := range dongles {
+		d := &dongles[i]
+		if u := UATDev; u != nil && u.dev != nil && u.indexID == d.Index {
+			d.InUse = SDR_ROLE_UAT
+		} else if e := ESDev; e != nil && len(e.remote) == 0 && e.indexID == d.Index {
+			d.InUse = SDR_ROLE_ES
+		} else if f := OGNDev; f != nil && f.indexID == d.Index {
+			d.InUse = SDR_ROLE_OGN
+		} else if f := AISDev; f != nil && f.indexID == d.Index {
+			d.InUse = SDR_ROLE_AIS
+		}
+		if c, ok := getPPMCalibration(d.Serial); ok {
+			d.Calibration = &c
+		}
+	}
+	return dongles
+}
 
 // Watch for config/device changes.
 func sdrWatcher() {
@@ -800,6 +944,10 @@ func sdrWatcher() {
 	prevOGNEnabled := false
 	prevAISEnabled := false
 	prevOGNTXEnabled := false
+	prevUATRemote := ""
+	prevBiasTee := [4]bool{}
+	prevESRemote := ""
+	prevRoles := ""
 
 	// Get the system (RPi) uptime.
 	info := syscall.Sysinfo_t{}
@@ -872,17 +1020,28 @@ func sdrWatcher() {
 			shutdownAIS = false
 		}
 
-		// capture current state
-		esEnabled := globalSettings.ES_Enabled
-		uatEnabled := globalSettings.UAT_Enabled
-		ognEnabled := globalSettings.OGN_Enabled
-		aisEnabled := globalSettings.AIS_Enabled
+		// capture current state. Suspended radios look like all protocols are disabled
+		suspended := sdrSuspended
+		esEnabled := globalSettings.ES_Enabled && !suspended
+		uatEnabled := globalSettings.UAT_Enabled && !suspended
+		ognEnabled := globalSettings.OGN_Enabled && !suspended
+		aisEnabled := globalSettings.AIS_Enabled && !suspended
 		ognTXEnabled := globalSettings.OGNI2CTXEnabled
+		uatRemote := globalSettings.UAT_RemoteSDR
+		esRemote := globalSettings.ES_RemoteSDR
+		biasTee := [4]bool{globalSettings.UAT_BiasTee, globalSettings.ES_BiasTee, globalSettings.OGN_BiasTee, globalSettings.AIS_BiasTee}
+		roles := fmt.Sprint(globalSettings.SDRRoles) // sorted by serial
 		count := rtl.GetDeviceCount()
 		interfaceCount := count
 		if globalStatus.UATRadio_connected {
 			interfaceCount++
 		}
+		if uatEnabled && len(uatRemote) > 0 {
+			interfaceCount++
+		}
+		if esEnabled && len(esRemote) > 0 {
+			interfaceCount++
+		}
 		atomic.StoreUint32(&globalStatus.Devices, uint32(interfaceCount))
 
 		// support up to 3 dongles
@@ -890,9 +1049,11 @@ func sdrWatcher() {
 			count = 3
 		}
 
-		if interfaceCount == prevCount && prevESEnabled == esEnabled && prevUATEnabled == uatEnabled && prevOGNEnabled == ognEnabled && prevAISEnabled == aisEnabled && prevOGNTXEnabled == ognTXEnabled {
+		if interfaceCount == prevCount && prevESEnabled == esEnabled && prevUATEnabled == uatEnabled && prevOGNEnabled == ognEnabled && prevAISEnabled == aisEnabled && prevOGNTXEnabled == ognTXEnabled &&
+			prevUATRemote == uatRemote && prevESRemote == esRemote && prevBiasTee == biasTee && prevRoles == roles && !sdrForceReconfig {
 			continue
 		}
+		sdrForceReconfig = false
 
 		// the device count or the global settings have changed, reconfig
 		if UATDev != nil {
@@ -911,7 +1072,15 @@ func sdrWatcher() {
 			AISDev.shutdown()
 			AISDev = nil
 		}
-		configDevices(count, esEnabled, uatEnabled, ognEnabled, aisEnabled)
+		removeSingleSystemError("sdrremote-978")
+		removeSingleSystemError("sdrremote-1090")
+		if uatEnabled && len(uatRemote) > 0 {
+			createRemoteUATDev(uatRemote)
+		}
+		if esEnabled && len(esRemote) > 0 {
+			createRemoteESDev(esRemote)
+		}
+		configDevices(count, esEnabled && len(esRemote) == 0, uatEnabled && len(uatRemote) == 0, ognEnabled, aisEnabled)
 
 		prevCount = interfaceCount
 		prevUATEnabled = uatEnabled
@@ -919,6 +1088,10 @@ func sdrWatcher() {
 		prevOGNEnabled = ognEnabled
 		prevAISEnabled = aisEnabled
 		prevOGNTXEnabled = ognTXEnabled
+		prevUATRemote = uatRemote
+		prevESRemote = esRemote
+		prevBiasTee = biasTee
+		prevRoles = roles
 
 		countEnabled := 0
 
@@ -946,6 +1119,8 @@ func sdrWatcher() {
 
 func sdrInit() {
 	go sdrWatcher()
+	go sdrGainOptimizer()
+	go sdrHealthWatchdog()
 	go uatReader()
 	go godump978.ProcessDataFromChannel()
 }
@@ -0,0 +1,166 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_autogain.go: Closed-loop tuner gain optimization for the local 978 and 1090 dongles
+		(globalSettings.SDRAutoGain). Every AUTOGAIN_INTERVAL, the message rate and the overload indicator of the
+		last interval are evaluated:
+			978:  fraction of clipped samples (0 or 255), counted in UAT.read().
+			1090: fraction of messages with a signal above -3dBFS ("strong_signals" in dump1090's stats.json).
+		Overloaded -> one gain step down. Otherwise the gain is stepped up as long as the message rate improves,
+		a step that made it worse is reverted and the gain is kept for AUTOGAIN_HOLD before probing again.
+		The message rate also depends on the traffic around us, so the result is only as good as the traffic is
+		steady - steps are small and reverted easily for that reason.
+		The learned gain is stored per dongle serial in globalSettings.SDRGains and used on the next start.
+		The step logic is in sdr_gain.go.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	AUTOGAIN_INTERVAL    = 2 * time.Minute
+	AUTOGAIN_MAX_CLIPPED = 0.001 // 978: fraction of clipped samples
+	AUTOGAIN_MAX_STRONG  = 0.05  // 1090: fraction of messages above -3dBFS
+	DUMP1090_JSON_DIR    = "/run/dump1090"
+)
+
+// R820T tuner gains (tenths of dB), used for the 1090 dongle that is opened by dump1090, not by us.
+var r820tGains = []int{0, 9, 14, 27, 37, 77, 87, 125, 144, 157, 166, 197, 207, 229, 254, 280, 297, 328, 338, 364, 372, 386, 402, 421, 434, 439, 445, 480, 496}
+
+// Sample counters of the 978 dongle, only maintained while auto gain is enabled.
+var uatSampleCount, uatClippedCount uint64
+
+// Learned gain of the dongle with the given serial, def if there is none.
+func learnedGain(serial string, def int) int {
+	if gain, ok := globalSettings.SDRGains[serial]; ok && globalSettings.SDRAutoGain {
+		return gain
+	}
+	return def
+}
+
+// Logs and stores a gain change of the controller, from the gain index prevIdx.
+func storeAutoGain(c *gainController, prevIdx int, rate float64, overloaded bool) {
+	logInfof("sdr", "SDR auto gain %s: %.1fdB -> %.1fdB (%.0f msgs/min, overloaded: %t)", c.name,
+		float64(c.gains[prevIdx])/10, float64(c.gain())/10, rate, overloaded)
+	if globalSettings.SDRGains == nil {
+		globalSettings.SDRGains = make(map[string]int)
+	}
+	globalSettings.SDRGains[c.serial] = c.gain()
+	saveSettings()
+}
+
+// Fraction of the messages received by dump1090 in the last minute that had a signal above -3dBFS.
+func dump1090StrongSignalFraction() (float64, error) {
+	data, err := ioutil.ReadFile(DUMP1090_JSON_DIR + "/stats.json")
+	if err != nil {
+		return 0, err
+	}
+	var stats struct {
+		Last1Min struct {
+			Local struct {
+				Accepted      []int `json:"accepted"`
+				StrongSignals int   `json:"strong_signals"`
+			} `json:"local"`
+		} `json:"last1min"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return 0, err
+	}
+	accepted := 0
+	for _, n := range stats.Last1Min.Local.Accepted {
+		accepted += n
+	}
+	if accepted == 0 {
+		return 0, fmt.Errorf("no messages")
+	}
+	return float64(stats.Last1Min.Local.StrongSignals) / float64(accepted), nil
+}
+
+func sdrGainOptimizer() {
+	var uatCtl, esCtl *gainController
+	ticker := time.NewTicker(AUTOGAIN_INTERVAL)
+	for {
+		<-ticker.C
+		samples, clipped := atomic.SwapUint64(&uatSampleCount, 0), atomic.SwapUint64(&uatClippedCount, 0)
+		if !globalSettings.SDRAutoGain {
+			uatCtl, esCtl = nil, nil
+			continue
+		}
+
+		if u := UATDev; u != nil && u.dev != nil && len(u.gains) > 0 {
+			if uatCtl == nil || uatCtl.serial != u.serial {
+				uatCtl = newGainController("978", u.serial, u.gains, u.gain)
+			} else if samples > 0 {
+				overloaded := float64(clipped)/float64(samples) > AUTOGAIN_MAX_CLIPPED
+				rate, prevIdx := float64(globalStatus.UAT_messages_last_minute), uatCtl.idx
+				if uatCtl.update(rate, overloaded) {
+					storeAutoGain(uatCtl, prevIdx, rate, overloaded)
+					atomic.StoreInt32(&u.pendingGain, int32(uatCtl.gain()))
+				}
+			}
+		} else {
+			uatCtl = nil
+		}
+
+		if e := ESDev; e != nil && len(e.remote) == 0 {
+			if esCtl == nil || esCtl.serial != e.serial {
+				esCtl = newGainController("1090", e.serial, r820tGains, e.gain)
+			} else if strong, err := dump1090StrongSignalFraction(); err == nil {
+				rate, prevIdx, overloaded := float64(globalStatus.ES_messages_last_minute), esCtl.idx, strong > AUTOGAIN_MAX_STRONG
+				if esCtl.update(rate, overloaded) {
+					storeAutoGain(esCtl, prevIdx, rate, overloaded)
+					e.setGain(esCtl.gain())
+				}
+			}
+		} else {
+			esCtl = nil
+		}
+	}
+}
+
+// Counts clipped samples of a 978 buffer for the auto gain.
+func countClippedSamples(buf []uint8) {
+	clipped := uint64(0)
+	for _, s := range buf {
+		if s == 0 || s == 255 {
+			clipped++
+		}
+	}
+	atomic.AddUint64(&uatSampleCount, uint64(len(buf)))
+	atomic.AddUint64(&uatClippedCount, clipped)
+}
+
+// Applies a gain change requested by sdrGainOptimizer(). Called from UAT.read(), which owns the device.
+func (u *UAT) applyPendingGain() {
+	gain := int(atomic.SwapInt32(&u.pendingGain, -1))
+	if gain < 0 {
+		return
+	}
+	if err := u.dev.SetTunerGain(gain); err != nil {
+		logErrorf("sdr", "UAT SetTunerGain %d failed: %s", gain, err)
+		return
+	}
+	u.gain = gain
+}
+
+// Restarts dump1090 with the new gain.
+func (e *ES) setGain(gain int) {
+	e.gain = gain
+	select {
+	case e.restartCh <- 1:
+	default:
+	}
+}
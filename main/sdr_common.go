@@ -0,0 +1,89 @@
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_common.go: SDR related declarations shared by the hardware (sdr.go) and stub (sdr_nohw.go) builds.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type Dump1090TermMessage struct {
+	Text   string
+	Source string
+}
+
+type AISTermMessage struct {
+	Text   string
+	Source string
+}
+
+// to keep our sync primitives synchronized, only exit a read
+// method's goroutine via the close flag channel check, to
+// include catastrophic dongle failures
+var shutdownES bool
+var shutdownUAT bool
+var shutdownOGN bool
+var shutdownAIS bool
+
+var sdrShutdown bool
+var sdrSuspended bool // all dongles are closed until it's cleared again, see powermanager.go
+
+// Dongle roles, also the frequency tags of the serials ("stx:978").
+const (
+	SDR_ROLE_UAT = "978"
+	SDR_ROLE_ES  = "1090"
+	SDR_ROLE_OGN = "868"
+	SDR_ROLE_AIS = "162"
+	SDR_ROLE_OFF = "off"
+)
+
+func isValidSDRRole(role string) bool {
+	switch role {
+	case SDR_ROLE_UAT, SDR_ROLE_ES, SDR_ROLE_OGN, SDR_ROLE_AIS, SDR_ROLE_OFF:
+		return true
+	}
+	return false
+}
+
+// SDRDongle is a connected dongle as shown in the SDR manager (/getSDRs).
+type SDRDongle struct {
+	Index        int
+	Serial       string
+	Manufacturer string
+	Product      string
+	Role         string          // assigned role, "" = any enabled protocol that has no dongle yet
+	RoleSource   string          // "setting" (globalSettings.SDRRoles), "serial" (stx:<freq> tag) or ""
+	InUse        string          // role the dongle is currently used for, "" = unused
+	Conflict     bool            // another dongle has the same role and is used instead
+	Calibration  *PPMCalibration `json:",omitempty"` // last GSM scan, see startPPMCalibration()
+}
+
+// PPMCalibration is the state of the GSM scan (/calibrateSDR) of a dongle.
+type PPMCalibration struct {
+	Serial  string
+	Running bool
+	Band    string // GSM band the correction was measured in
+	PPM     int
+	Error   string // the scan failed, it's not retried until requested again
+	Time    time.Time
+}
+
+// Dongles found during the last configuration, see configDevices().
+var sdrDongles []SDRDongle
+var sdrDonglesMutex = &sync.Mutex{}
+
+// SpectrumScan is the result of scanSpectrum() (/getSpectrum), Power[i] is the average power at Freq[i] in dBFS.
+type SpectrumScan struct {
+	Serial string
+	Gain   float64 // dB
+	BinHz  float64
+	Freq   []float64 // Hz
+	Power  []float64 // dBFS
+}
@@ -0,0 +1,78 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_gain.go: Gain step controller of the SDR auto gain (sdr_autogain.go). No hardware dependencies, the
+		decision is only made from the message rate and the overload indicator of the last interval.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	AUTOGAIN_HOLD         = 30 * time.Minute
+	AUTOGAIN_MIN_IMPROVE  = 1.05 // message rate ratio that counts as an improvement
+	AUTOGAIN_MIN_MESSAGES = 10   // per interval, fewer is no basis for a decision
+)
+
+type gainController struct {
+	name      string
+	serial    string
+	gains     []int
+	idx       int
+	prevIdx   int     // gain index of the previous interval
+	prevRate  float64 // messages per minute in the previous interval
+	holdUntil time.Time
+}
+
+func newGainController(name, serial string, gains []int, gain int) *gainController {
+	sorted := append([]int(nil), gains...)
+	sort.Ints(sorted)
+	c := &gainController{name: name, serial: serial, gains: sorted, prevIdx: -1}
+	for i, g := range sorted { // closest supported gain
+		if i == 0 || absInt(g-gain) < absInt(sorted[c.idx]-gain) {
+			c.idx = i
+		}
+	}
+	return c
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (c *gainController) gain() int {
+	return c.gains[c.idx]
+}
+
+// Evaluates the last interval, returns true if the gain should be changed to c.gain(). See sdr_autogain.go.
+func (c *gainController) update(rate float64, overloaded bool) bool {
+	idx := c.idx
+	switch {
+	case overloaded:
+		if c.idx > 0 {
+			c.idx--
+		}
+		c.holdUntil = stratuxClock.Time.Add(AUTOGAIN_HOLD) // don't probe back up into overload right away
+	case rate < AUTOGAIN_MIN_MESSAGES:
+		// nothing to judge by
+	case c.prevIdx >= 0 && c.prevIdx < c.idx && rate*AUTOGAIN_MIN_IMPROVE < c.prevRate:
+		// the last step up made things worse
+		c.idx = c.prevIdx
+		c.holdUntil = stratuxClock.Time.Add(AUTOGAIN_HOLD)
+	case stratuxClock.Time.After(c.holdUntil) && c.idx < len(c.gains)-1 &&
+		(c.prevIdx < 0 || c.prevIdx == c.idx || rate >= c.prevRate*AUTOGAIN_MIN_IMPROVE):
+		c.idx++
+	}
+	c.prevIdx, c.prevRate = idx, rate
+	return c.idx != idx
+}
@@ -0,0 +1,73 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_gain_test.go: Decisions of the auto gain step controller over a few intervals.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testGains = []int{400, 0, 200, 100, 300} // tenths of dB, unsorted as a tuner may report them
+
+func TestNewGainController(t *testing.T) {
+	tests := map[int]int{0: 0, 140: 100, 160: 200, 250: 200, 1000: 400, -50: 0}
+	for gain, want := range tests {
+		if got := newGainController("978", "stx:978:0", testGains, gain).gain(); got != want {
+			t.Errorf("newGainController(gain %d).gain() = %d, want %d", gain, got, want)
+		}
+	}
+}
+
+func TestGainControllerUpdate(t *testing.T) {
+	initBenchmark()
+	for stratuxClock.Time.IsZero() { // no hold (zero holdUntil) only once the clock has started
+		time.Sleep(10 * time.Millisecond)
+	}
+	type interval struct {
+		rate       float64 // messages per minute
+		overloaded bool
+		gain       int // expected afterwards
+	}
+	tests := []struct {
+		name      string
+		gain      int
+		intervals []interval
+	}{
+		{"climbs while the rate improves", 200, []interval{{100, false, 300}, {110, false, 400}, {120, false, 400}}},
+		{"reverts a step that made it worse", 200, []interval{{100, false, 300}, {80, false, 200}, {100, false, 200}}},
+		{"probes again after a flat interval", 200, []interval{{100, false, 300}, {102, false, 300}, {102, false, 400}}},
+		{"overload steps down", 200, []interval{{500, true, 100}, {500, true, 0}, {500, true, 0}}},
+		{"overload at the lowest gain", 0, []interval{{500, true, 0}, {500, false, 0}}},
+		{"too few messages to judge", 200, []interval{{AUTOGAIN_MIN_MESSAGES - 1, false, 200}, {100, false, 300}}},
+	}
+	for _, tt := range tests {
+		c := newGainController("978", "stx:978:0", testGains, tt.gain)
+		for i, iv := range tt.intervals {
+			before := c.gain()
+			changed := c.update(iv.rate, iv.overloaded)
+			if c.gain() != iv.gain || changed != (before != iv.gain) {
+				t.Errorf("%s, interval %d: gain %d (changed %t), want %d", tt.name, i+1, c.gain(), changed, iv.gain)
+				break
+			}
+		}
+	}
+
+	// The hold after a revert or an overload ends after AUTOGAIN_HOLD.
+	c := newGainController("978", "stx:978:0", testGains, 200)
+	c.update(500, true)
+	c.update(100, false)
+	if c.gain() != 100 {
+		t.Fatalf("gain %d during the hold, want 100", c.gain())
+	}
+	c.holdUntil = stratuxClock.Time.Add(-time.Second)
+	if !c.update(100, false) || c.gain() != 200 {
+		t.Errorf("gain %d after the hold, want 200", c.gain())
+	}
+}
@@ -0,0 +1,51 @@
+//go:build nohw
+// +build nohw
+
+/*
+	Copyright (c) 2015-2016 Christopher Young
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_nohw.go: SDR stubs for builds without librtlsdr/libdump978 (-tags nohw), e.g. for
+		running replay or simulator modes on a development machine.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Device types are empty in this build - no dongle will ever be configured.
+type UAT struct{}
+type ES struct{}
+type OGN struct{}
+type AIS struct{}
+
+var UATDev *UAT
+var ESDev *ES
+var OGNDev *OGN
+var AISDev *AIS
+
+func sdrKill() {
+	sdrShutdown = true
+}
+
+func sdrInit() {
+	logInfof("sdr", "built without SDR support (nohw), no dongles will be used")
+	atomic.StoreUint32(&globalStatus.Devices, 0)
+}
+
+func getSDRDongles() []SDRDongle {
+	return []SDRDongle{}
+}
+
+func scanSpectrum(serial string, startHz, stopHz, binHz float64, gain int) (*SpectrumScan, error) {
+	return nil, errors.New("built without SDR support")
+}
+
+func startPPMCalibration(serial string) error {
+	return errors.New("built without SDR support")
+}
@@ -0,0 +1,191 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_ppm.go: Automatic frequency correction (globalSettings.SDRPPMAutoCal) for dongles that don't have a PPM value
+		in their serial ("stx:<freq>:<ppm>"). The learned correction is stored per dongle serial in
+		globalSettings.SDRPPMs and used on the next start.
+		978:  the frequency offset of received FIS-B uplinks is measured on the IQ samples in UAT.read(). Ground stations
+		      transmit on an accurate frequency, aircraft (short bursts) are not used. The median of PPMCAL_BURSTS
+		      uplinks is applied while running, every start refines the value. The estimator is in sdr_ppmestimator.go.
+		Others (1090/OGN/AIS, opened by external programs): a GSM base station scan with kalibrate-rtl ("kal", if
+		      installed), on request (/calibrateSDR) only, as it takes minutes and needs an idle dongle: set it to
+		      "off" in the SDR manager first. Runs in the background, GSM850 and GSM900 are scanned (in the order
+		      that fits the region), the outcome stays in the dongle's status (SDRDongle.Calibration).
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Outcome of the GSM scans per dongle serial.
+var ppmCalibrations = make(map[string]PPMCalibration)
+var ppmCalibrationsMutex = &sync.Mutex{}
+
+// Applies the result of the 978 calibration. Called from UAT.read(), which owns the device.
+func (u *UAT) calibratePPM(buf []uint8) {
+	offset, ok := u.ppmCal.feed(buf)
+	if !ok {
+		if stratuxClock.Time.After(u.ppmCal.until) {
+			logInfof("sdr", "SDR PPM calibration 978: only %d uplinks received, stopped", len(u.ppmCal.offsets))
+			u.ppmCal = nil
+		}
+		return
+	}
+	u.ppmCal = nil
+	ppm := u.ppm + int(math.Round(offset))
+	logInfof("sdr", "SDR PPM calibration 978: measured %.1f ppm offset, correction %d -> %d", offset, u.ppm, ppm)
+	if ppm != u.ppm {
+		if err := u.dev.SetFreqCorrection(ppm); err != nil {
+			logErrorf("sdr", "\tSetFreqCorrection %d Failed, error: %s", ppm, err)
+			return
+		}
+		u.ppm = ppm
+	}
+	storePPM(u.serial, ppm)
+}
+
+func storePPM(serial string, ppm int) {
+	if globalSettings.SDRPPMs == nil {
+		globalSettings.SDRPPMs = make(map[string]int)
+	}
+	globalSettings.SDRPPMs[serial] = ppm
+	saveSettings()
+}
+
+var kalChannelRegex = regexp.MustCompile(`chan:\s+(\d+)\s+\(.*\)\s+power:\s+([\d.]+)`)
+var kalErrorRegex = regexp.MustCompile(`average absolute error:\s+(-?[\d.]+)\s+ppm`)
+
+// Runs kal with the given arguments, returns the submatches of the lines matching r.
+func runKal(r *regexp.Regexp, args ...string) ([][]string, error) {
+	kal, err := exec.LookPath("kal")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(kal, args...)
+	stdout, _ := cmd.StdoutPipe()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var matches [][]string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if m := r.FindStringSubmatch(scanner.Text()); m != nil {
+			matches = append(matches, m)
+		}
+	}
+	return matches, cmd.Wait()
+}
+
+// GSM bands to scan, the one used in the region first: GSM850 in the Americas, GSM900 elsewhere.
+func kalBands() []string {
+	if isGPSValid() && mySituation.GPSLongitude < -30 {
+		return []string{"GSM850", "GSM900"}
+	}
+	return []string{"GSM900", "GSM850"}
+}
+
+/*
+kalibratePPM().
+
+	Scans for GSM base stations on the dongle and measures the offset on the strongest one. Takes a minute
+	or two per band, the dongle must not be in use. Returns the correction and the band it was measured in.
+*/
+func kalibratePPM(indexID int) (int, string, error) {
+	for _, band := range kalBands() {
+		channels, err := runKal(kalChannelRegex, "-s", band, "-d", strconv.Itoa(indexID))
+		if err != nil {
+			return 0, "", err
+		}
+		best, bestPower := "", 0.0
+		for _, m := range channels {
+			if power, _ := strconv.ParseFloat(m[2], 64); power > bestPower {
+				best, bestPower = m[1], power
+			}
+		}
+		if len(best) == 0 {
+			continue
+		}
+		result, err := runKal(kalErrorRegex, "-c", best, "-d", strconv.Itoa(indexID))
+		if err != nil {
+			return 0, "", err
+		}
+		if len(result) == 0 {
+			return 0, "", fmt.Errorf("no result on %s channel %s", band, best)
+		}
+		ppm, err := strconv.ParseFloat(result[0][1], 64)
+		if err != nil {
+			return 0, "", err
+		}
+		return int(math.Round(ppm)), band, nil
+	}
+	return 0, "", errors.New("no GSM base station found")
+}
+
+func setPPMCalibration(c PPMCalibration) {
+	ppmCalibrationsMutex.Lock()
+	ppmCalibrations[c.Serial] = c
+	ppmCalibrationsMutex.Unlock()
+}
+
+func getPPMCalibration(serial string) (PPMCalibration, bool) {
+	ppmCalibrationsMutex.Lock()
+	defer ppmCalibrationsMutex.Unlock()
+	c, ok := ppmCalibrations[serial]
+	return c, ok
+}
+
+/*
+startPPMCalibration().
+
+	Starts a GSM scan on the idle dongle in the background. The learned correction is used the next time the
+	dongle is assigned to a receiver.
+*/
+func startPPMCalibration(serial string) error {
+	if !globalSettings.SDRPPMAutoCal {
+		return errors.New("automatic frequency correction is disabled")
+	}
+	if _, err := exec.LookPath("kal"); err != nil {
+		return errors.New("kalibrate-rtl (kal) is not installed")
+	}
+	d, err := idleDongle(serial)
+	if err != nil {
+		return err
+	}
+	if len(d.Serial) == 0 {
+		return errors.New("dongle without serial, the correction couldn't be stored")
+	}
+	if c, ok := getPPMCalibration(d.Serial); ok && c.Running {
+		return errors.New("calibration already running")
+	}
+	setPPMCalibration(PPMCalibration{Serial: d.Serial, Running: true, Time: time.Now().UTC()})
+	go func() {
+		logInfof("sdr", "SDR PPM calibration %s: scanning for GSM base stations ...", d.Serial)
+		ppm, band, err := kalibratePPM(d.Index)
+		c := PPMCalibration{Serial: d.Serial, Band: band, PPM: ppm, Time: time.Now().UTC()}
+		if err != nil {
+			logErrorf("sdr", "SDR PPM calibration %s failed: %s", d.Serial, err)
+			c.Error = err.Error()
+		} else {
+			logInfof("sdr", "SDR PPM calibration %s: %d ppm (%s)", d.Serial, ppm, band)
+			storePPM(d.Serial, ppm)
+		}
+		setPPMCalibration(c)
+	}()
+	return nil
+}
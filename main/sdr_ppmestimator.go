@@ -0,0 +1,85 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_ppmestimator.go: Frequency offset measurement on the 978 IQ samples for the automatic PPM correction
+		(sdr_ppm.go). No hardware dependencies, it only sees the sample buffers.
+*/
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	PPMCAL_BURSTS    = 20               // uplinks to average over
+	PPMCAL_MIN_BURST = 5000             // samples (2.4ms), uplinks are 4.2ms long, ADS-B messages < 0.5ms
+	PPMCAL_THRESHOLD = 10.0             // burst power over the average power of the buffer
+	PPMCAL_TIMEOUT   = 15 * time.Minute // no uplinks (e.g. outside the US) - give up
+)
+
+// Frequency offset estimation on bursts of the 978 sample stream.
+type ppmEstimator struct {
+	sampleRate   float64 // Hz
+	centerFreq   float64 // Hz
+	sumRe, sumIm float64 // phase progression of the current burst
+	n            int     // samples in the current burst
+	prevI, prevQ float64
+	offsets      []float64 // ppm per uplink
+	until        time.Time
+}
+
+func newPPMEstimator(sampleRate, centerFreq float64) *ppmEstimator {
+	return &ppmEstimator{sampleRate: sampleRate, centerFreq: centerFreq, until: stratuxClock.Time.Add(PPMCAL_TIMEOUT)}
+}
+
+/*
+feed().
+
+	Processes a buffer of unsigned 8 bit IQ samples. Returns the median correction (ppm, relative to the current
+	one) once PPMCAL_BURSTS uplinks have been measured.
+	During a 2-FSK burst, the average phase change per sample is the frequency offset, as long as the data is
+	about balanced (uplink payloads are mostly FEC and padding, close enough over a 4ms burst).
+*/
+func (p *ppmEstimator) feed(buf []uint8) (float64, bool) {
+	var power float64
+	for i := 0; i+1 < len(buf); i += 2 {
+		re, im := float64(buf[i])-127.5, float64(buf[i+1])-127.5
+		power += re*re + im*im
+	}
+	threshold := power / float64(len(buf)/2) * PPMCAL_THRESHOLD
+
+	for i := 0; i+1 < len(buf); i += 2 {
+		re, im := float64(buf[i])-127.5, float64(buf[i+1])-127.5
+		if re*re+im*im < threshold {
+			p.endBurst()
+			continue
+		}
+		if p.n > 0 { // z[k] * conj(z[k-1])
+			p.sumRe += re*p.prevI + im*p.prevQ
+			p.sumIm += im*p.prevI - re*p.prevQ
+		}
+		p.prevI, p.prevQ = re, im
+		p.n++
+	}
+
+	if len(p.offsets) < PPMCAL_BURSTS {
+		return 0, false
+	}
+	sort.Float64s(p.offsets)
+	return p.offsets[len(p.offsets)/2], true
+}
+
+func (p *ppmEstimator) endBurst() {
+	if p.n >= PPMCAL_MIN_BURST {
+		freq := math.Atan2(p.sumIm, p.sumRe) / (2 * math.Pi) * p.sampleRate
+		// A fast crystal tunes too high, the signal shows up below the center and needs a positive correction.
+		p.offsets = append(p.offsets, -freq/p.centerFreq*1e6)
+	}
+	p.sumRe, p.sumIm, p.n = 0, 0, 0
+}
@@ -0,0 +1,97 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_ppmestimator_test.go: PPM estimation on synthesized 978 sample buffers.
+*/
+
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const (
+	testPPMSampleRate = 2083334
+	testPPMCenterFreq = 978000000
+	testPPMBufSamples = 200000 // uplinks are rare enough in the buffer to stand out from the average
+)
+
+/*
+makeTestPPMBuffer().
+
+	One buffer of 8 bit IQ samples with a 2-FSK burst of n samples starting at sample start (cut off at the end
+	of the buffer), received with a tuner that is off by ppm. The data alternates random bits with their
+	complement, so it is balanced as the estimator expects.
+*/
+func makeTestPPMBuffer(r *rand.Rand, ppm float64, start, n int) []uint8 {
+	buf := make([]uint8, 2*testPPMBufSamples)
+	for i := range buf {
+		buf[i] = 128
+	}
+	offset := -ppm * 1e-6 * testPPMCenterFreq // Hz
+	phase := 0.0
+	bit := false
+	for k := 0; k < n && start+k < testPPMBufSamples; k++ {
+		if k%2 == 0 { // 2 samples per symbol
+			if k%4 == 0 {
+				bit = r.Intn(2) == 1
+			} else {
+				bit = !bit
+			}
+		}
+		dev := 312500.0
+		if !bit {
+			dev = -dev
+		}
+		phase += 2 * math.Pi * (offset + dev) / testPPMSampleRate
+		buf[2*(start+k)] = uint8(math.Round(127.5 + 100*math.Cos(phase)))
+		buf[2*(start+k)+1] = uint8(math.Round(127.5 + 100*math.Sin(phase)))
+	}
+	return buf
+}
+
+func TestPPMEstimator(t *testing.T) {
+	initBenchmark()
+	tests := []struct {
+		name   string
+		ppm    float64
+		start  int // of the burst in the buffer
+		length int // samples
+		ok     bool
+	}{
+		{"no offset", 0, 1000, 8800, true},
+		{"fast crystal", 35, 1000, 8800, true},
+		{"slow crystal", -12.5, 50000, 8800, true},
+		{"burst across buffers", 20, testPPMBufSamples - 4000, 8800, true},
+		{"ADS-B length bursts only", 20, 1000, 1000, false},
+	}
+	for _, tt := range tests {
+		r := rand.New(rand.NewSource(1))
+		p := newPPMEstimator(testPPMSampleRate, testPPMCenterFreq)
+		var offset float64
+		var ok bool
+		for i := 0; i < PPMCAL_BURSTS+1; i++ {
+			buf := makeTestPPMBuffer(r, tt.ppm, tt.start, tt.length)
+			if tt.start+tt.length > testPPMBufSamples { // rest of the burst at the start of the next buffer
+				rest := makeTestPPMBuffer(r, tt.ppm, 0, tt.start+tt.length-testPPMBufSamples)
+				p.feed(buf)
+				buf = rest
+			}
+			offset, ok = p.feed(buf)
+			if ok && i < PPMCAL_BURSTS-1 {
+				t.Errorf("%s: result after %d bursts", tt.name, i+1)
+				break
+			}
+		}
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %t, want %t", tt.name, ok, tt.ok)
+		} else if ok && math.Abs(offset-tt.ppm) > 0.5 {
+			t.Errorf("%s: %.2f ppm, want %.2f", tt.name, offset, tt.ppm)
+		}
+	}
+}
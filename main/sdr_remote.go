@@ -0,0 +1,281 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_remote.go: Remote receivers. The 978 and 1090 chains can use a dongle attached to another machine running
+		rtl_tcp (or SoapySDR's SoapyRemote/rtl_tcp server) instead of a local one, configured as "host:port" in
+		globalSettings.UAT_RemoteSDR / ES_RemoteSDR. Empty = local dongle.
+		978: the IQ stream is fed into godump978 like the samples of a local dongle.
+		1090: the IQ stream is piped into dump1090 (--ifile -), which then demodulates as usual.
+		The connection is re-established automatically (with backoff) while the chain is enabled.
+		OGN is not supported: ogn-rx-eu can only open local dongles.
+
+		rtl_tcp protocol: the server sends a 12 byte header ("RTL0", tuner type, gain count), followed by unsigned
+		8 bit IQ samples. Commands are 5 bytes: command id and a big endian uint32 parameter.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/godump978"
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	RTLTCP_SET_FREQ       = 0x01
+	RTLTCP_SET_SAMPLERATE = 0x02
+	RTLTCP_SET_GAINMODE   = 0x03
+	RTLTCP_SET_GAIN       = 0x04
+	RTLTCP_SET_FREQCORR   = 0x05
+	RTLTCP_SET_BIAS_TEE   = 0x0e // rtl_tcp >= 0.6, ignored by older servers
+
+	REMOTE_SDR_TIMEOUT     = 5 * time.Second // no samples for this long = connection lost
+	REMOTE_SDR_MAX_BACKOFF = 30 * time.Second
+	ES_SAMPLE_RATE         = 2400000 // dump1090's default rate, also assumed for --ifile
+	ES_CENTER_FREQ         = 1090000000
+	ES_TUNER_GAIN          = 372 // 37.2dB, same as for local dongles
+)
+
+type rtlTCPConn struct {
+	conn  net.Conn
+	tuner uint32
+}
+
+func dialRTLTCP(addr string) (*rtlTCPConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, REMOTE_SDR_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 12)
+	conn.SetReadDeadline(time.Now().Add(REMOTE_SDR_TIMEOUT))
+	if _, err := io.ReadFull(conn, header); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if string(header[:4]) != "RTL0" {
+		conn.Close()
+		return nil, errors.New("not an rtl_tcp server")
+	}
+	return &rtlTCPConn{conn: conn, tuner: binary.BigEndian.Uint32(header[4:8])}, nil
+}
+
+func (c *rtlTCPConn) command(cmd byte, param uint32) error {
+	buf := make([]byte, 5)
+	buf[0] = cmd
+	binary.BigEndian.PutUint32(buf[1:], param)
+	c.conn.SetWriteDeadline(time.Now().Add(REMOTE_SDR_TIMEOUT))
+	_, err := c.conn.Write(buf)
+	return err
+}
+
+// Manual gain (tenths of dB), sample rate, center frequency, frequency correction and bias tee.
+func (c *rtlTCPConn) tune(freq, rate uint32, gain int, ppm int, biasTee bool) error {
+	biasTeeParam := uint32(0)
+	if biasTee {
+		biasTeeParam = 1
+	}
+	cmds := [][2]uint32{
+		{RTLTCP_SET_GAINMODE, 1},
+		{RTLTCP_SET_GAIN, uint32(gain)},
+		{RTLTCP_SET_SAMPLERATE, rate},
+		{RTLTCP_SET_FREQ, freq},
+		{RTLTCP_SET_FREQCORR, uint32(int32(ppm))},
+		{RTLTCP_SET_BIAS_TEE, biasTeeParam},
+	}
+	for _, cmd := range cmds {
+		if err := c.command(byte(cmd[0]), cmd[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read that fails if no samples arrive within REMOTE_SDR_TIMEOUT, so stalled connections are detected.
+func (c *rtlTCPConn) Read(p []byte) (int, error) {
+	c.conn.SetReadDeadline(time.Now().Add(REMOTE_SDR_TIMEOUT))
+	return c.conn.Read(p)
+}
+
+func (c *rtlTCPConn) Close() error {
+	return c.conn.Close()
+}
+
+/*
+	connectRemoteSDR().
+		Connects and tunes, retrying with increasing delays until it succeeds or closeCh is closed (returns nil).
+		Connection problems are shown as system error "sdrremote-<name>".
+*/
+func connectRemoteSDR(name, addr string, freq, rate uint32, gain, ppm int, biasTee bool, closeCh chan int) *rtlTCPConn {
+	backoff := time.Second
+	for {
+		c, err := dialRTLTCP(addr)
+		if err == nil {
+			if err = c.tune(freq, rate, gain, ppm, biasTee); err != nil {
+				c.Close()
+			}
+		}
+		if err == nil {
+			logInfof("sdr", "%s: connected to rtl_tcp server %s (tuner type %d)", name, addr, c.tuner)
+			removeSingleSystemError("sdrremote-" + name)
+			return c
+		}
+		logInfof("sdr", "%s: rtl_tcp server %s: %s, retrying in %s", name, addr, err, backoff)
+		addSingleSystemErrorf("sdrremote-"+name, "Remote %s receiver %s not reachable: %s", name, addr, err)
+		select {
+		case <-closeCh:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > REMOTE_SDR_MAX_BACKOFF {
+			backoff = REMOTE_SDR_MAX_BACKOFF
+		}
+	}
+}
+
+// Closes c when closeCh is closed, to interrupt blocking reads. Returns a function to stop watching.
+func closeOnShutdown(c io.Closer, closeCh chan int) func() {
+	done := make(chan bool)
+	go func() {
+		select {
+		case <-closeCh:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+func isClosed(closeCh chan int) bool {
+	select {
+	case <-closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (u *UAT) readRemote() {
+	defer u.wg.Done()
+	logDebugf("sdr", "Entered UAT readRemote() for %s ...", u.remote)
+	for !isClosed(u.closeCh) {
+		c := connectRemoteSDR("978", u.remote, CenterFreq, SampleRate, TunerGain, u.ppm, globalSettings.UAT_BiasTee, u.closeCh)
+		if c == nil {
+			break
+		}
+		stop := closeOnShutdown(c, u.closeCh)
+		for {
+			buffer := make([]uint8, rtl.DefaultBufLength)
+			n, err := io.ReadFull(c, buffer)
+			if n > 0 {
+				godump978.InChan <- buffer[:n]
+			}
+			if err != nil {
+				if !isClosed(u.closeCh) {
+					logInfof("sdr", "978: rtl_tcp server %s: %s, reconnecting", u.remote, err)
+				}
+				break
+			}
+		}
+		stop()
+		c.Close()
+	}
+	logDebugf("sdr", "UAT readRemote(): shutdown msg received...")
+}
+
+func (e *ES) readRemote() {
+	defer e.wg.Done()
+	logDebugf("sdr", "Entered ES readRemote() for %s ...", e.remote)
+	for !isClosed(e.closeCh) {
+		c := connectRemoteSDR("1090", e.remote, ES_CENTER_FREQ, ES_SAMPLE_RATE, ES_TUNER_GAIN, e.ppm, globalSettings.ES_BiasTee, e.closeCh)
+		if c == nil {
+			break
+		}
+		e.runRemoteDump1090(c)
+		c.Close()
+	}
+	logDebugf("sdr", "ES readRemote(): shutdown msg received...")
+}
+
+// Runs dump1090 on the IQ stream of c until the connection is lost, dump1090 dies or closeCh is closed.
+func (e *ES) runRemoteDump1090(c *rtlTCPConn) {
+	cmd := exec.Command(STRATUX_HOME+"/bin/dump1090", "--fix", "--net-stratux-port", "30006", "--net",
+		"--net-bo-port", strconv.Itoa(ES_BEAST_PORT), "--ifile", "-", "--iformat", "UC8")
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		logErrorf("sdr", "Error executing %s/bin/dump1090: %s", STRATUX_HOME, err)
+		select {
+		case <-e.closeCh:
+		case <-time.After(REMOTE_SDR_MAX_BACKOFF):
+		}
+		return
+	}
+	logInfof("sdr", "Executed %s successfully...", cmd.String())
+
+	var outputWg sync.WaitGroup
+	for _, pipe := range []struct {
+		r      io.Reader
+		source string
+	}{{stdout, "stdout"}, {stderr, "stderr"}} {
+		outputWg.Add(1)
+		go func(r io.Reader, source string) {
+			defer outputWg.Done()
+			reader := bufio.NewReader(r)
+			for {
+				line, err := reader.ReadString('\n')
+				if len(line) > 0 {
+					logDump1090TermMessage(Dump1090TermMessage{Text: line, Source: source})
+				}
+				if err != nil {
+					return
+				}
+			}
+		}(pipe.r, pipe.source)
+	}
+
+	stop := closeOnShutdown(c, e.closeCh)
+	_, err := io.Copy(stdin, c)
+	stop()
+	if err != nil && !isClosed(e.closeCh) {
+		logInfof("sdr", "1090: rtl_tcp server %s: %s, reconnecting", e.remote, err)
+	}
+	stdin.Close()
+	cmd.Process.Kill()
+	outputWg.Wait()
+	cmd.Wait()
+}
+
+func createRemoteUATDev(addr string) {
+	UATDev = &UAT{remote: addr, serial: "remote:" + addr}
+	UATDev.ppm = globalSettings.PPM
+	UATDev.wg = &sync.WaitGroup{}
+	UATDev.closeCh = make(chan int)
+	UATDev.wg.Add(1)
+	go UATDev.readRemote()
+}
+
+func createRemoteESDev(addr string) {
+	ESDev = &ES{remote: addr, serial: "remote:" + addr}
+	ESDev.ppm = globalSettings.PPM
+	ESDev.wg = &sync.WaitGroup{}
+	ESDev.closeCh = make(chan int)
+	ESDev.wg.Add(1)
+	go ESDev.readRemote()
+}
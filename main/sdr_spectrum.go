@@ -0,0 +1,190 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_spectrum.go: Spectrum scan / noise floor diagnostic (/getSpectrum). An idle dongle (not used by any of the
+		receivers, e.g. one set to "off" in the SDR manager) sweeps a band and returns the power per frequency bin,
+		to find interference sources (USB 3 / Pi noise, cameras, power supplies) that desensitize the receivers.
+		The dongle is only opened for the duration of the scan. One scan at a time.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/cmplx"
+	"sync"
+
+	rtl "github.com/jpoirier/gortlsdr"
+)
+
+const (
+	SPECTRUM_SAMPLE_RATE = 2400000
+	SPECTRUM_USABLE      = 0.8 // fraction of the sample rate used per step, the edges are attenuated by the filters
+	SPECTRUM_AVERAGE     = 32  // FFTs averaged per step
+	SPECTRUM_MAX_STEPS   = 500 // ~900MHz
+	SPECTRUM_MIN_FREQ    = 24000000
+	SPECTRUM_MAX_FREQ    = 1766000000
+)
+
+var spectrumScanMutex = &sync.Mutex{}
+var spectrumScanRunning bool
+
+// In-place radix-2 FFT, len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ { // bit reversal
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		w := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			wk := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*wk
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				wk *= w
+			}
+		}
+	}
+}
+
+// First connected dongle that is not used by a receiver, or the one with the given serial if it is idle.
+func idleDongle(serial string) (SDRDongle, error) {
+	for _, d := range getSDRDongles() {
+		if len(d.InUse) > 0 || (len(serial) > 0 && d.Serial != serial) {
+			continue
+		}
+		return d, nil
+	}
+	if len(serial) > 0 {
+		return SDRDongle{}, fmt.Errorf("dongle %s not found or in use", serial)
+	}
+	return SDRDongle{}, errors.New("no idle dongle - disable a receiver or set a dongle to \"off\" in the SDR manager")
+}
+
+/*
+	scanSpectrum().
+		Sweeps startHz..stopHz with a resolution of about binHz (rounded to a power of two FFT size) at a fixed
+		tuner gain (tenths of dB). A Hann window keeps strong carriers from leaking into the neighbouring bins.
+*/
+func scanSpectrum(serial string, startHz, stopHz, binHz float64, gain int) (*SpectrumScan, error) {
+	if startHz < SPECTRUM_MIN_FREQ || stopHz > SPECTRUM_MAX_FREQ || stopHz <= startHz {
+		return nil, fmt.Errorf("frequency range must be within %d..%d MHz", SPECTRUM_MIN_FREQ/1000000, SPECTRUM_MAX_FREQ/1000000)
+	}
+	n := 64
+	for n < 8192 && float64(SPECTRUM_SAMPLE_RATE)/float64(n) > binHz {
+		n <<= 1
+	}
+	stepHz := SPECTRUM_SAMPLE_RATE * SPECTRUM_USABLE
+	if steps := math.Ceil((stopHz - startHz) / stepHz); steps > SPECTRUM_MAX_STEPS {
+		return nil, fmt.Errorf("range too wide, max. %.0f MHz", SPECTRUM_MAX_STEPS*stepHz/1e6)
+	}
+
+	spectrumScanMutex.Lock()
+	if spectrumScanRunning {
+		spectrumScanMutex.Unlock()
+		return nil, errors.New("a scan is already running")
+	}
+	spectrumScanRunning = true
+	spectrumScanMutex.Unlock()
+	defer func() {
+		spectrumScanMutex.Lock()
+		spectrumScanRunning = false
+		spectrumScanMutex.Unlock()
+	}()
+
+	d, err := idleDongle(serial)
+	if err != nil {
+		return nil, err
+	}
+	dev, err := rtl.Open(d.Index)
+	if err != nil {
+		return nil, err
+	}
+	defer dev.Close()
+	logInfof("sdr", "spectrum scan: %s, %.1f-%.1f MHz", d.Serial, startHz/1e6, stopHz/1e6)
+
+	if err = dev.SetSampleRate(SPECTRUM_SAMPLE_RATE); err != nil {
+		return nil, err
+	}
+	if err = dev.SetTunerGainMode(true); err != nil {
+		return nil, err
+	}
+	if err = dev.SetTunerGain(gain); err != nil {
+		return nil, err
+	}
+	dev.SetFreqCorrection(getPPM(d.Serial)) // 0 returns an error
+
+	window := make([]float64, n)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(n-1))
+	}
+	bufLen := 2 * n * SPECTRUM_AVERAGE
+	if bufLen%512 != 0 {
+		bufLen += 512 - bufLen%512
+	}
+	buf := make([]uint8, bufLen)
+	x := make([]complex128, n)
+	power := make([]float64, n)
+	binWidth := float64(SPECTRUM_SAMPLE_RATE) / float64(n)
+	usableBins := int(float64(n) * SPECTRUM_USABLE / 2)
+
+	scan := &SpectrumScan{Serial: d.Serial, Gain: float64(dev.GetTunerGain()) / 10, BinHz: binWidth}
+	for center := startHz + stepHz/2; center-stepHz/2 < stopHz; center += stepHz {
+		if err = dev.SetCenterFreq(int(center)); err != nil {
+			return nil, err
+		}
+		dev.ResetBuffer()
+		dev.ReadSync(buf, bufLen) // settling after the retune
+		nRead, err := dev.ReadSync(buf, bufLen)
+		if err != nil {
+			return nil, err
+		}
+		for i := range power {
+			power[i] = 0
+		}
+		ffts := 0
+		for off := 0; off+2*n <= nRead; off += 2 * n {
+			for i := 0; i < n; i++ {
+				re := (float64(buf[off+2*i]) - 127.5) / 127.5
+				im := (float64(buf[off+2*i+1]) - 127.5) / 127.5
+				x[i] = complex(re*window[i], im*window[i])
+			}
+			fft(x)
+			for i, v := range x {
+				power[i] += real(v)*real(v) + imag(v)*imag(v)
+			}
+			ffts++
+		}
+		if ffts == 0 {
+			return nil, errors.New("short read")
+		}
+		// window power gain: sum(w^2) ~ 3/8 n
+		norm := float64(ffts) * float64(n) * float64(n) * 3 / 8
+		for k := -usableBins; k < usableBins; k++ {
+			f := center + float64(k)*binWidth
+			if f < startHz || f > stopHz {
+				continue
+			}
+			p := power[(k+n)%n] / norm
+			scan.Freq = append(scan.Freq, f)
+			scan.Power = append(scan.Power, 10*math.Log10(p+1e-20))
+		}
+	}
+	return scan, nil
+}
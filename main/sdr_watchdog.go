@@ -0,0 +1,256 @@
+//go:build !nohw
+// +build !nohw
+
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	sdr_watchdog.go: Receiver health watchdog for the local dongles. RTL dongles tend to lock up after brownouts:
+		the demodulator (dump1090, ogn-rx-eu, rtl_ais or our own 978 reader) either stops receiving anything or
+		dies and is shut down for good (see the shutdown* flags). Decoded messages say nothing about that, there may
+		just be no traffic around. The demodulators' signs of life (Device.alive) are used instead:
+			978:  samples read from the dongle
+			1090: samples_processed of dump1090's stats.json growing (updated once a minute)
+			868:  ogn-rx-eu's status messages
+			162:  rtl_ais running, it doesn't tell whether it still gets samples
+		A radio is considered stalled when
+			- it showed signs of life since it was started, but none for WATCHDOG_STALL, or
+			- its device was shut down although its protocol is still enabled and the dongle is still connected.
+		The dongle is then USB reset (port power cycle with uhubctl if installed, re-authorization of the USB
+		device otherwise) and all receivers are re-initialized. At most one reset per WATCHDOG_RESET_HOLD per radio.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	WATCHDOG_INTERVAL   = 10 * time.Second
+	WATCHDOG_STALL      = 3 * time.Minute  // without signs of life of the demodulator
+	WATCHDOG_DEAD       = 30 * time.Second // device shut down while enabled
+	WATCHDOG_RESET_HOLD = 10 * time.Minute
+	USB_DEVICES_DIR     = "/sys/bus/usb/devices"
+)
+
+var sdrForceReconfig bool // set by the watchdog, makes sdrWatcher() re-initialize all devices
+
+type radioWatchdog struct {
+	name       string
+	serial     string    // serial of the dongle in use, or last used
+	active     bool      // signs of life since the device was started
+	lastActive time.Time // last sign of life
+	lostSince  time.Time // device shut down while enabled
+	lastReset  time.Time
+}
+
+/*
+	check().
+		Called every WATCHDOG_INTERVAL with the serial of the local device of this radio ("" = none), whether the
+		protocol is enabled and the last sign of life of its demodulator. Returns the serial of a dongle to reset and
+		why.
+*/
+func (w *radioWatchdog) check(serial string, enabled bool, alive time.Time) (string, string) {
+	now := stratuxClock.Time
+	if !enabled {
+		*w = radioWatchdog{name: w.name, lastReset: w.lastReset}
+		return "", ""
+	}
+	if len(serial) == 0 {
+		if len(w.serial) == 0 {
+			return "", "" // never had a device, nothing we can do
+		}
+		if !dongleIdle(w.serial) { // unplugged or assigned to something else
+			*w = radioWatchdog{name: w.name, lastReset: w.lastReset}
+			return "", ""
+		}
+		if w.lostSince.IsZero() {
+			w.lostSince = now
+		}
+		if now.Sub(w.lostSince) < WATCHDOG_DEAD || now.Sub(w.lastReset) < WATCHDOG_RESET_HOLD {
+			return "", ""
+		}
+		w.lostSince = time.Time{}
+		return w.serial, "receiver was shut down"
+	}
+	if serial != w.serial || !w.lostSince.IsZero() { // new device or restarted
+		*w = radioWatchdog{name: w.name, serial: serial, lastReset: w.lastReset, lastActive: now}
+	}
+	if alive.After(w.lastActive) {
+		w.active = true
+		w.lastActive = alive
+		return "", ""
+	}
+	if !w.active || now.Sub(w.lastActive) < WATCHDOG_STALL || now.Sub(w.lastReset) < WATCHDOG_RESET_HOLD {
+		return "", ""
+	}
+	w.active = false
+	return serial, fmt.Sprintf("demodulator without signs of life for %s", now.Sub(w.lastActive).Round(time.Second))
+}
+
+// Samples dump1090 processed since it was started, from its stats.json.
+func dump1090SamplesProcessed() (uint64, error) {
+	data, err := ioutil.ReadFile(DUMP1090_JSON_DIR + "/stats.json")
+	if err != nil {
+		return 0, err
+	}
+	var stats struct {
+		Total struct {
+			Local struct {
+				SamplesProcessed uint64 `json:"samples_processed"`
+			} `json:"local"`
+		} `json:"total"`
+	}
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return 0, err
+	}
+	return stats.Total.Local.SamplesProcessed, nil
+}
+
+// The dongle is connected, not used by any receiver and not switched off in the SDR manager.
+func dongleIdle(serial string) bool {
+	for _, d := range getSDRDongles() {
+		if d.Serial == serial {
+			return len(d.InUse) == 0 && d.Role != SDR_ROLE_OFF
+		}
+	}
+	return false
+}
+
+// sysfs directory of the USB device with the given serial, e.g. "1-1.3". Fails if it isn't unique.
+func usbDeviceBySerial(serial string) (string, error) {
+	paths, _ := filepath.Glob(USB_DEVICES_DIR + "/*/serial")
+	found := ""
+	for _, p := range paths {
+		s, err := ioutil.ReadFile(p)
+		if err != nil || strings.TrimSpace(string(s)) != serial {
+			continue
+		}
+		if len(found) > 0 {
+			return "", fmt.Errorf("serial %s is not unique", serial)
+		}
+		found = filepath.Base(filepath.Dir(p))
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no USB device with serial %s", serial)
+	}
+	return found, nil
+}
+
+// Power cycles the USB port of the device if possible, otherwise makes the kernel re-enumerate it.
+func usbReset(device string) error {
+	if uhubctl, err := exec.LookPath("uhubctl"); err == nil {
+		if i := strings.LastIndex(device, "."); i > 0 {
+			hub, port := device[:i], device[i+1:]
+			out, err := exec.Command(uhubctl, "-l", hub, "-p", port, "-a", "cycle", "-d", "2").CombinedOutput()
+			if err == nil {
+				return nil
+			}
+			logInfof("sdr", "SDR watchdog: uhubctl %s port %s: %s: %s", hub, port, err, strings.TrimSpace(string(out)))
+		}
+	}
+	authorized := USB_DEVICES_DIR + "/" + device + "/authorized"
+	if err := ioutil.WriteFile(authorized, []byte("0"), 0644); err != nil {
+		return err
+	}
+	time.Sleep(2 * time.Second)
+	return ioutil.WriteFile(authorized, []byte("1"), 0644)
+}
+
+/*
+	resetRadio().
+		Shuts down the receiver (if it is still running), resets the dongle and lets sdrWatcher() re-initialize
+		everything, as the dongle might come back with a different index.
+*/
+func resetRadio(name, serial, reason string, shutdown *bool, running func() bool) error {
+	logInfof("sdr", "SDR watchdog %s (%s): %s, resetting dongle", name, serial, reason)
+	if running() {
+		*shutdown = true
+		for i := 0; i < 30 && running(); i++ {
+			time.Sleep(1 * time.Second)
+		}
+	}
+	device, err := usbDeviceBySerial(serial)
+	if err == nil {
+		err = usbReset(device)
+	}
+	time.Sleep(3 * time.Second) // re-enumeration
+	sdrForceReconfig = true
+	if err != nil {
+		return errors.New("USB reset failed: " + err.Error())
+	}
+	return nil
+}
+
+func sdrHealthWatchdog() {
+	uat := &radioWatchdog{name: "978"}
+	es := &radioWatchdog{name: "1090"}
+	ogn := &radioWatchdog{name: "868"}
+	ais := &radioWatchdog{name: "162"}
+
+	var esSamples uint64
+	ticker := time.NewTicker(WATCHDOG_INTERVAL)
+	for {
+		<-ticker.C
+		var uatSerial, esSerial, ognSerial, aisSerial string
+		var uatAlive, esAlive, ognAlive, aisAlive time.Time
+		if u := UATDev; u != nil && len(u.remote) == 0 {
+			uatSerial, uatAlive = u.serial, u.alive
+		}
+		if e := ESDev; e != nil && len(e.remote) == 0 {
+			if samples, err := dump1090SamplesProcessed(); err == nil && samples != esSamples {
+				esSamples = samples
+				e.alive = stratuxClock.Time
+			}
+			esSerial, esAlive = e.serial, e.alive
+		}
+		if f := OGNDev; f != nil {
+			ognSerial, ognAlive = f.serial, ognLastStatus
+		}
+		if f := AISDev; f != nil {
+			aisSerial, aisAlive = f.serial, f.alive
+		}
+
+		radios := []struct {
+			w        *radioWatchdog
+			serial   string
+			enabled  bool
+			alive    time.Time
+			shutdown *bool
+			running  func() bool
+		}{
+			{uat, uatSerial, globalSettings.UAT_Enabled && len(globalSettings.UAT_RemoteSDR) == 0, uatAlive,
+				&shutdownUAT, func() bool { return UATDev != nil }},
+			{es, esSerial, globalSettings.ES_Enabled && len(globalSettings.ES_RemoteSDR) == 0, esAlive,
+				&shutdownES, func() bool { return ESDev != nil }},
+			{ogn, ognSerial, globalSettings.OGN_Enabled, ognAlive,
+				&shutdownOGN, func() bool { return OGNDev != nil }},
+			{ais, aisSerial, globalSettings.AIS_Enabled, aisAlive,
+				&shutdownAIS, func() bool { return AISDev != nil }},
+		}
+		for _, r := range radios {
+			serial, reason := r.w.check(r.serial, r.enabled, r.alive)
+			if len(serial) == 0 {
+				continue
+			}
+			r.w.lastReset = stratuxClock.Time
+			if err := resetRadio(r.w.name, serial, reason, r.shutdown, r.running); err != nil {
+				logInfof("sdr", "SDR watchdog %s (%s): %s", r.w.name, serial, err)
+				addSingleSystemErrorf("sdrwatchdog", "%s receiver stalled (%s), %s", r.w.name, reason, err)
+			} else {
+				removeSingleSystemError("sdrwatchdog")
+			}
+			break // everything is re-initialized, start over
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	secrets.go: Credentials that are kept out of globalSettings. /getSettings, /api/v1/settings and the websockets
+		hand the settings to everybody on the WiFi, so passwords are stored in SECRETS_FILE (root only) instead and
+		can be set through /setSettings, but never read back.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	SECRETS_FILE      = STRATUX_HOME + "cfg/secrets.json"
+	SECRETS_SALT_SIZE = 16
+)
+
+type stratuxSecrets struct {
+	DebugProfPasswordHash string // salted password hash, see secretHash(). Empty = profiling disabled
+	MQTTPassword          string // the broker needs it in clear text
+}
+
+var globalSecrets stratuxSecrets
+var secretsMutex sync.Mutex
+
+// "<salt>$<SHA-256 of salt and password>", both hex.
+func secretHash(password string) string {
+	salt := make([]byte, SECRETS_SALT_SIZE)
+	rand.Read(salt)
+	sum := sha256.Sum256(append(salt, []byte(password)...))
+	return hex.EncodeToString(salt) + "$" + hex.EncodeToString(sum[:])
+}
+
+func secretHashMatches(hash string, password string) bool {
+	parts := strings.SplitN(hash, "$", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, []byte(password)...))
+	return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(parts[1])) == 1
+}
+
+func readSecrets() {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	buf, err := ioutil.ReadFile(SECRETS_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logErrorf("settings", "can't read secrets %s: %s", SECRETS_FILE, err.Error())
+		}
+		return
+	}
+	if err := json.Unmarshal(buf, &globalSecrets); err != nil {
+		logErrorf("settings", "can't read secrets %s: %s", SECRETS_FILE, err.Error())
+	}
+}
+
+func saveSecrets() {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	buf, _ := json.Marshal(&globalSecrets)
+	os.MkdirAll(filepath.Dir(SECRETS_FILE), 0755)
+	if err := ioutil.WriteFile(SECRETS_FILE, buf, 0600); err != nil {
+		addSingleSystemErrorf("save-secrets", "can't save secrets %s: %s", SECRETS_FILE, err.Error())
+		return
+	}
+	// Also to the read-only base of the overlay file system, so they persist
+	robase := "/overlay/robase" + SECRETS_FILE
+	if _, err := os.Stat(filepath.Dir(robase)); err == nil {
+		overlayctl("unlock")
+		if err := ioutil.WriteFile(robase, buf, 0600); err != nil {
+			logErrorf("settings", "can't persist the secrets: %s", err.Error())
+		}
+		overlayctl("lock")
+	}
+}
+
+// Moves passwords that older versions stored in the settings file to the secrets. buf is the settings file.
+func migrateSettingsSecrets(buf []byte) {
+	var legacy struct {
+		DebugProfPassword string
+		MQTTPassword      string
+	}
+	if err := json.Unmarshal(buf, &legacy); err != nil {
+		return
+	}
+	if len(legacy.DebugProfPassword) == 0 && len(legacy.MQTTPassword) == 0 {
+		return
+	}
+	if len(legacy.DebugProfPassword) > 0 && len(globalSecrets.DebugProfPasswordHash) == 0 {
+		globalSecrets.DebugProfPasswordHash = secretHash(legacy.DebugProfPassword)
+	}
+	if len(legacy.MQTTPassword) > 0 && len(globalSecrets.MQTTPassword) == 0 {
+		globalSecrets.MQTTPassword = legacy.MQTTPassword
+	}
+	saveSecrets()
+	// Rewrite the settings file without them
+	saveSettings()
+	logInfof("settings", "moved the passwords from %s to %s", configLocation, SECRETS_FILE)
+}
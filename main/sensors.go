@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
 	"path/filepath"
 	"strings"
@@ -10,8 +9,6 @@ import (
 
 	"github.com/b3nn0/goflying/ahrs"
 	"github.com/b3nn0/goflying/ahrsweb"
-	"github.com/kidoman/embd"
-	_ "github.com/kidoman/embd/host/all"
 	"github.com/ricochet2200/go-disk-usage/du"
 
 	"github.com/b3nn0/stratux/common"
@@ -22,7 +19,9 @@ const (
 	numRetries uint8 = 50
 	calCLimit        = 0.15
 	calDLimit        = 10.0
+)
 
+const (
 	// WHO_AM_I values to differentiate between the different IMUs.
 	MPUREG_WHO_AM_I             = 0x75
 	MPUREG_WHO_AM_I_VAL         = 0x71 // Expected value.
@@ -36,7 +35,6 @@ const (
 )
 
 var (
-	i2cbus           embd.I2CBus
 	myPressureReader sensors.PressureReader
 	myIMUReader      sensors.IMUReader
 	cal              chan (string)
@@ -54,9 +52,9 @@ func initI2CSensors() {
 			go updateAHRSStatus()
 		}
 	}()
-	embd.SetHost(embd.HostRPi, 3)
-	i2cbus = embd.NewI2CBus(1)
-	go pollSensors()
+	if openI2CBus() {
+		go pollSensors()
+	}
 	go sensorAttitudeSender()
 	go updateAHRSStatus()
 }
@@ -79,18 +77,6 @@ func pollSensors() {
 	}
 }
 
-func initPressureSensor() (ok bool) {
-	bmp, err := sensors.NewBMP280(&i2cbus, 100*time.Millisecond)
-	if err == nil {
-		myPressureReader = bmp
-		return true
-	}
-
-	// TODO westphae: make bmp180.go to fit bmp interface
-
-	return false
-}
-
 func tempAndPressureSender() {
 	var (
 		temp     float64
@@ -112,11 +98,13 @@ func tempAndPressureSender() {
 		// Read temperature and pressure altitude.
 		temp, err = myPressureReader.Temperature()
 		if err != nil {
+			metricsI2CError("baro")
 			addSingleSystemErrorf("pressure-sensor-temp-read", "AHRS Error: Couldn't read temperature from sensor: %s", err)
 		}
 		press, err = myPressureReader.Pressure()
 		if press == 0 || err != nil {
 			if err != nil {
+				metricsI2CError("baro")
 				addSingleSystemErrorf("pressure-sensor-pressure-read", "AHRS Error: Couldn't read pressure from sensor: %s", err)
 			}
 			failNum++
@@ -158,43 +146,6 @@ func tempAndPressureSender() {
 	// mySituation.BaroVerticalSpeed = 99999
 }
 
-func initIMU() (ok bool) {
-	// Check if the chip is the ICM-20948 or MPU-9250.
-	v, err := i2cbus.ReadByteFromReg(0x68, ICMREG_WHO_AM_I)
-	if err != nil {
-		log.Printf("Error identifying IMU: %s\n", err.Error())
-		return false
-	}
-	v2, err := i2cbus.ReadByteFromReg(0x68, MPUREG_WHO_AM_I)
-	if err != nil {
-		log.Printf("Error identifying IMU: %s\n", err.Error())
-		return false
-	}
-
-	if v == ICMREG_WHO_AM_I_VAL {
-		log.Println("ICM-20948 detected.")
-		imu, err := sensors.NewICM20948(&i2cbus)
-		if err == nil {
-			myIMUReader = imu
-			return true
-		}
-	} else if v2 == MPUREG_WHO_AM_I_VAL || v2 == MPUREG_WHO_AM_I_VAL_9250 || v2 == MPUREG_WHO_AM_I_VAL_9255 || v2 == MPUREG_WHO_AM_I_VAL_6500 ||
-		v2 == MPUREG_WHO_AM_I_VAL_60X0 || v2 == MPUREG_WHO_AM_I_VAL_UNKNOWN {
-
-		log.Printf("MPU detected (%02x).\n", v2)
-		imu, err := sensors.NewMPU9250(&i2cbus)
-		if err == nil {
-			myIMUReader = imu
-			return true
-		}
-	} else {
-		log.Printf("Could not identify MPU. v=%02x, v2=%02x.\n", v, v2)
-		return false
-	}
-
-	return false
-}
-
 // FIXME: Shoud be moved to managementinterface.go and standardized on management interface port.
 
 func sensorAttitudeSender() {
@@ -252,7 +203,7 @@ func sensorAttitudeSender() {
 			// Process calibration and level requests
 			select {
 			case action := <-cal:
-				log.Printf("AHRS Info: cal received action %s\n", action)
+				logInfof("sensors", "AHRS Info: cal received action %s", action)
 				ahrsCalibrating = true
 				myIMUReader.Read() // Clear out the averages
 				var (
@@ -265,14 +216,14 @@ func sensorAttitudeSender() {
 					cc = math.Sqrt(c1*c1 + c2*c2 + c3*c3)
 					dd = math.Sqrt(d1*d1 + d2*d2 + d3*d3)
 					nTries++
-					log.Printf("AHRS Info: IMU calibration attempt #%d\n", nTries)
+					logInfof("sensors", "AHRS Info: IMU calibration attempt #%d", nTries)
 					if mpuError != nil {
-						log.Printf("AHRS Info: Error reading IMU while calibrating: %s\n", mpuError)
+						logWarnf("sensors", "AHRS Info: Error reading IMU while calibrating: %s", mpuError)
 					} else {
 						if strings.Contains(action, "cal") { // Calibrate gyros
 							globalSettings.D = [3]float64{d1, d2, d3}
 							s.SetCalibrations(nil, &globalSettings.D)
-							log.Printf("AHRS Info: IMU gyro calibration: %3f %3f %3f\n", d1, d2, d3)
+							logInfof("sensors", "AHRS Info: IMU gyro calibration: %3f %3f %3f", d1, d2, d3)
 						}
 						if strings.Contains(action, "level") { // Calibrate accel / level
 							globalSettings.C = [3]float64{c1, c2, c3}
@@ -280,8 +231,8 @@ func sensorAttitudeSender() {
 							globalSettings.SensorQuaternion = *makeOrientationQuaternion(globalSettings.C)
 							s.SetSensorQuaternion(&globalSettings.SensorQuaternion)
 							s.Reset()
-							log.Printf("AHRS Info: IMU accel calibration: %3f %3f %3f\n", c1, c2, c3)
-							log.Printf("AHRS Info: Caged to quaternion %v\n", globalSettings.SensorQuaternion)
+							logInfof("sensors", "AHRS Info: IMU accel calibration: %3f %3f %3f", c1, c2, c3)
+							logInfof("sensors", "AHRS Info: Caged to quaternion %v", globalSettings.SensorQuaternion)
 						}
 						saveSettings()
 					}
@@ -298,10 +249,11 @@ func sensorAttitudeSender() {
 			m.SValid = mpuError == nil
 			m.MValid = magError == nil
 			if mpuError != nil {
-				log.Printf("AHRS Gyro/Accel Error: %s\n", mpuError)
+				metricsI2CError("imu")
+				logErrorf("sensors", "AHRS Gyro/Accel Error: %s", mpuError)
 				failNum++
 				if failNum > numRetries {
-					log.Printf("AHRS Gyro/Accel Error: failed to read %d times, restarting: %s\n",
+					logErrorf("sensors", "AHRS Gyro/Accel Error: failed to read %d times, restarting: %s",
 						failNum-1, mpuError)
 					myIMUReader.Close()
 					globalStatus.IMUConnected = false
@@ -310,8 +262,9 @@ func sensorAttitudeSender() {
 			}
 			failNum = 0
 			if magError != nil {
+				metricsI2CError("mag")
 				if globalSettings.DEBUG {
-					log.Printf("AHRS Magnetometer Error, not using for this run: %s\n", magError)
+					logDebugf("sensors", "AHRS Magnetometer Error, not using for this run: %s", magError)
 				}
 				m.MValid = false
 			}
@@ -319,13 +272,25 @@ func sensorAttitudeSender() {
 			// Make the GPS measurements.
 			m.TW = float64(mySituation.GPSLastGroundTrackTime.UnixNano()/1000) / 1e6
 			m.WValid = isGPSGroundTrackValid()
-			if m.WValid {
+			gnssHeadingValid := isGNSSHeadingValid()
+			if gnssHeadingValid {
+				// Dual-antenna heading: point the AHRS reference along the true heading instead of the track.
+				m.TW = float64(mySituation.GPSLastHeadingTime.UnixNano()/1000) / 1e6
+				m.WValid = true
+				m.W1 = mySituation.GPSGroundSpeed * math.Sin(float64(mySituation.GPSTrueHeading)*ahrs.Deg)
+				m.W2 = mySituation.GPSGroundSpeed * math.Cos(float64(mySituation.GPSTrueHeading)*ahrs.Deg)
+			} else if m.WValid {
 				m.W1 = mySituation.GPSGroundSpeed * math.Sin(float64(mySituation.GPSTrueCourse)*ahrs.Deg)
 				m.W2 = mySituation.GPSGroundSpeed * math.Cos(float64(mySituation.GPSTrueCourse)*ahrs.Deg)
-				if globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
+			}
+			if m.WValid {
+				// Vertical velocity from GNSS, from the baro sensor if there is no GNSS fix.
+				if isGPSValid() {
+					m.W3 = float64(mySituation.GPSVerticalSpeed) * 3600 / 6076.12
+				} else if globalSettings.BMP_Sensor_Enabled && globalStatus.BMPConnected {
 					m.W3 = float64(mySituation.BaroVerticalSpeed * 60 / 6076.12)
 				} else {
-					m.W3 = float64(mySituation.GPSVerticalSpeed) * 3600 / 6076.12
+					m.W3 = 0
 				}
 			}
 
@@ -341,6 +306,9 @@ func sensorAttitudeSender() {
 				mySituation.AHRSGyroHeading = heading
 				if !isAHRSInvalidValue(heading) {
 					mySituation.AHRSGyroHeading /= ahrs.Deg
+				} else if gnssHeadingValid {
+					// Static mode (slow or stationary), the AHRS has no heading reference
+					mySituation.AHRSGyroHeading = float64(mySituation.GPSTrueHeading)
 				}
 
 				// TODO westphae: until magnetometer calibration is performed, no mag heading
@@ -378,7 +346,7 @@ func sensorAttitudeSender() {
 			// Send to AHRS debugging server.
 			if ahrswebListener != nil {
 				if err = ahrswebListener.Send(s.GetState(), m); err != nil {
-					log.Printf("AHRS Error: couldn't write to ahrsweb: %s\n", err)
+					logErrorf("sensors", "AHRS Error: couldn't write to ahrsweb: %s", err)
 					ahrswebListener = nil
 				}
 			}
@@ -442,7 +410,7 @@ func getMinAccelDirection() (i int, err error) {
 	if err != nil {
 		return
 	}
-	log.Printf("AHRS Info: sensor orientation accels %1.3f %1.3f %1.3f\n", a1, a2, a3)
+	logInfof("sensors", "AHRS Info: sensor orientation accels %1.3f %1.3f %1.3f", a1, a2, a3)
 	switch {
 	case math.Abs(a1) > math.Abs(a2) && math.Abs(a1) > math.Abs(a3):
 		if a1 > 0 {
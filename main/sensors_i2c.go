@@ -0,0 +1,91 @@
+//go:build !nohw
+// +build !nohw
+
+package main
+
+import (
+	"time"
+
+	"github.com/kidoman/embd"
+	_ "github.com/kidoman/embd/host/all"
+
+	"github.com/b3nn0/stratux/sensors"
+)
+
+var i2cbus embd.I2CBus
+
+// Opens the RPi I2C bus. Panics on hosts embd doesn't support - initI2CSensors() recovers from that.
+func openI2CBus() bool {
+	embd.SetHost(embd.HostRPi, 3)
+	i2cbus = embd.NewI2CBus(1)
+	return true
+}
+
+// Adapts an embd bus to i2cScanBus.
+type embdScanBus struct {
+	bus embd.I2CBus
+}
+
+func (b embdScanBus) probe(addr byte) error {
+	_, err := b.bus.ReadByte(addr)
+	return err
+}
+
+func (b embdScanBus) readReg(addr, reg byte) (byte, error) {
+	return b.bus.ReadByteFromReg(addr, reg)
+}
+
+// Bus for the I2C scanner (i2cscan.go). The sensor bus is the same instance as i2cbus.
+func openI2CScanBus(bus int) (i2cScanBus, error) {
+	embd.SetHost(embd.HostRPi, 3)
+	return embdScanBus{embd.NewI2CBus(byte(bus))}, nil
+}
+
+func initPressureSensor() (ok bool) {
+	bmp, err := sensors.NewBMP280(&i2cbus, 100*time.Millisecond)
+	if err == nil {
+		myPressureReader = bmp
+		return true
+	}
+
+	// TODO westphae: make bmp180.go to fit bmp interface
+
+	return false
+}
+
+func initIMU() (ok bool) {
+	// Check if the chip is the ICM-20948 or MPU-9250.
+	v, err := i2cbus.ReadByteFromReg(0x68, ICMREG_WHO_AM_I)
+	if err != nil {
+		logErrorf("sensors", "Error identifying IMU: %s", err.Error())
+		return false
+	}
+	v2, err := i2cbus.ReadByteFromReg(0x68, MPUREG_WHO_AM_I)
+	if err != nil {
+		logErrorf("sensors", "Error identifying IMU: %s", err.Error())
+		return false
+	}
+
+	if v == ICMREG_WHO_AM_I_VAL {
+		logInfof("sensors", "ICM-20948 detected.")
+		imu, err := sensors.NewICM20948(&i2cbus)
+		if err == nil {
+			myIMUReader = imu
+			return true
+		}
+	} else if v2 == MPUREG_WHO_AM_I_VAL || v2 == MPUREG_WHO_AM_I_VAL_9250 || v2 == MPUREG_WHO_AM_I_VAL_9255 || v2 == MPUREG_WHO_AM_I_VAL_6500 ||
+		v2 == MPUREG_WHO_AM_I_VAL_60X0 || v2 == MPUREG_WHO_AM_I_VAL_UNKNOWN {
+
+		logInfof("sensors", "MPU detected (%02x).", v2)
+		imu, err := sensors.NewMPU9250(&i2cbus)
+		if err == nil {
+			myIMUReader = imu
+			return true
+		}
+	} else {
+		logWarnf("sensors", "Could not identify MPU. v=%02x, v2=%02x.", v, v2)
+		return false
+	}
+
+	return false
+}
@@ -0,0 +1,26 @@
+//go:build nohw
+// +build nohw
+
+package main
+
+import (
+	"errors"
+)
+
+// Builds without hardware support (-tags nohw) have no I2C bus. Baro/AHRS data can still come from external GPS devices.
+func openI2CBus() bool {
+	logInfof("sensors", "built without I2C support (nohw), not polling for sensors")
+	return false
+}
+
+func openI2CScanBus(bus int) (i2cScanBus, error) {
+	return nil, errors.New("built without I2C support (nohw)")
+}
+
+func initPressureSensor() bool {
+	return false
+}
+
+func initIMU() bool {
+	return false
+}
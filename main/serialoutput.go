@@ -0,0 +1,148 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	serialoutput.go: Per-message-class rate limits of the serial outputs, for panel EFIS (GRT, Dynon, AFS, ...)
+		on slow RS-232 links.
+		Besides the USB serial adapters detected as /dev/serialout* (see serialOutWatcher()), any serial device, e.g.
+		the UART on the GPIO pins (/dev/serial0), can be configured in globalSettings.SerialOutputs with its baud
+		rate and protocol (GDL90, FLARM NMEA or both).
+		A message is only queued for a serial output if its class (serialMessageClasses) is within its rate, so
+		bulk data like FIS-B uplinks can't crowd out traffic. serialConnection.RateLimits sets the messages per
+		second of a class (0 = not sent), classes without an entry get a share of the link (serialRateShares) by
+		the baud rate, e.g. about one uplink per second at 9600 baud. Heartbeats and ownship reports are never
+		limited.
+*/
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	SERIAL_CLASS_HEARTBEAT = "HEARTBEAT"
+	SERIAL_CLASS_OWNSHIP   = "OWNSHIP"
+	SERIAL_CLASS_TRAFFIC   = "TRAFFIC"
+	SERIAL_CLASS_UPLINK    = "UPLINK"
+	SERIAL_CLASS_AHRS      = "AHRS"
+	SERIAL_CLASS_NMEA      = "NMEA"
+	SERIAL_CLASS_OTHER     = "OTHER"
+)
+
+// GDL90 message ID -> class.
+var serialMessageClasses = map[byte]string{
+	0x00:           SERIAL_CLASS_HEARTBEAT,
+	0xCC:           SERIAL_CLASS_HEARTBEAT, // Stratux heartbeat
+	0x53:           SERIAL_CLASS_HEARTBEAT, // Stratux heartbeat 0x5358
+	0x0A:           SERIAL_CLASS_OWNSHIP,
+	0x0B:           SERIAL_CLASS_OWNSHIP, // geometric altitude
+	0x14:           SERIAL_CLASS_TRAFFIC,
+	MSGTYPE_UPLINK: SERIAL_CLASS_UPLINK,
+	0x4C:           SERIAL_CLASS_AHRS,
+}
+
+// Default share of the link and typical message size (bytes) of the limited classes.
+var serialRateShares = map[string]struct {
+	share float64
+	size  int
+}{
+	SERIAL_CLASS_UPLINK:  {0.4, 440},
+	SERIAL_CLASS_TRAFFIC: {0.3, 32},
+	SERIAL_CLASS_AHRS:    {0.1, 30},
+	SERIAL_CLASS_NMEA:    {0.4, 70},
+}
+
+type serialRateBucket struct {
+	tokens  float64
+	updated time.Time // stratuxClock
+}
+
+// Class of a message sent with the given capability.
+func serialMessageClass(msgType uint16, msg []byte) string {
+	if msgType == NETWORK_FLARM_NMEA {
+		return SERIAL_CLASS_NMEA
+	}
+	if (msgType&(NETWORK_GDL90_STANDARD|NETWORK_AHRS_GDL90)) == 0 || len(msg) < 3 || msg[0] != 0x7E {
+		return SERIAL_CLASS_OTHER
+	}
+	if msg[1] == 0x65 { // ForeFlight: 0 = ID, 1 = AHRS
+		if msg[2] == 0x01 {
+			return SERIAL_CLASS_AHRS
+		}
+		return SERIAL_CLASS_OTHER
+	}
+	if class, ok := serialMessageClasses[msg[1]]; ok {
+		return class
+	}
+	return SERIAL_CLASS_OTHER
+}
+
+// Messages per second of a class on a link with the given baud rate and limits, -1 if unlimited.
+func serialRateLimit(baud int, limits map[string]float64, class string) float64 {
+	if class == SERIAL_CLASS_HEARTBEAT || class == SERIAL_CLASS_OWNSHIP {
+		return -1
+	}
+	if limit, ok := limits[class]; ok {
+		return math.Max(limit, 0)
+	}
+	s, ok := serialRateShares[class]
+	if !ok || baud <= 0 {
+		return -1
+	}
+	return float64(baud) / 10 * s.share / float64(s.size) // 10 bits per byte
+}
+
+// Token bucket per class with a burst of one second. Returns false if msg is over the rate of its class.
+// Requires netMutex.
+func isSerialMessageAllowed(buckets map[string]*serialRateBucket, baud int, limits map[string]float64, msgType uint16, msg []byte) bool {
+	class := serialMessageClass(msgType, msg)
+	limit := serialRateLimit(baud, limits, class)
+	if limit < 0 {
+		return true
+	} else if limit == 0 {
+		return false
+	}
+	burst := math.Max(limit, 1)
+	b, ok := buckets[class]
+	if !ok {
+		b = &serialRateBucket{tokens: burst, updated: stratuxClock.Time}
+		buckets[class] = b
+	}
+	b.tokens = math.Min(b.tokens+stratuxClock.Since(b.updated).Seconds()*limit, burst)
+	b.updated = stratuxClock.Time
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// False if msg is over the rate of its class on conn (serial, Bluetooth or a network client with rate limits).
+// Requires netMutex.
+func isRateAllowed(conn connection, msgType uint16, msg []byte) bool {
+	switch c := conn.(type) {
+	case *serialConnection:
+		if c.rateBuckets == nil {
+			c.rateBuckets = make(map[string]*serialRateBucket)
+		}
+		return isSerialMessageAllowed(c.rateBuckets, c.Baud, c.RateLimits, msgType, msg)
+	case *bluetoothConnection:
+		return isSerialMessageAllowed(c.rateBuckets, c.baud, nil, msgType, msg)
+	case *networkConnection:
+		if len(c.rateLimits) == 0 {
+			return true
+		}
+		if c.rateBuckets == nil {
+			c.rateBuckets = make(map[string]*serialRateBucket)
+		}
+		if !isSerialMessageAllowed(c.rateBuckets, 0, c.rateLimits, msgType, msg) {
+			c.rateLimited++
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,529 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	setupwizard.go: Backend of the first-run setup wizard. The web UI walks through the steps in SETUP_STEPS and shows
+		the progress of each, the state is kept in memory until the configuration is written.
+			detect    detect the SDRs, GPS, IMU and baro sensor and suggest a role for each SDR
+			roles     use the (possibly edited) roles, they are active right away so the self-test can check them
+			selftest  check that every device delivers data, runs in the background for up to SETUP_SELFTEST_TIME
+			ownship   ownship ICAO address(es) and callsign
+			apply     write the configuration, globalSettings.SetupCompleted is set from then on
+		/getSetupWizard                       current state
+		/setSetupWizard                       POST {"Action": "detect|roles|selftest|ownship|apply|skip|reset", ...}
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SETUP_SELFTEST_TIME = 20 * time.Second
+
+	SETUP_PENDING = "pending"
+	SETUP_RUNNING = "running"
+	SETUP_DONE    = "done"
+	SETUP_FAILED  = "failed"
+	SETUP_SKIPPED = "skipped"
+
+	// Results of the self-tests. A warning doesn't fail the step, e.g. no traffic in range.
+	SELFTEST_PASS    = "pass"
+	SELFTEST_WARN    = "warn"
+	SELFTEST_FAIL    = "fail"
+	SELFTEST_RUNNING = "running"
+)
+
+var SETUP_STEPS = []string{"detect", "roles", "selftest", "ownship", "apply"}
+
+type SetupStep struct {
+	Name    string
+	Status  string // SETUP_*
+	Message string
+}
+
+type SetupHardware struct {
+	SDRs          []SDRDongle
+	GPSConnected  bool
+	GPSType       string
+	GPSSatellites uint16 // seen
+	GPSFix        bool
+	IMUConnected  bool
+	BaroConnected bool
+}
+
+type SetupSelfTest struct {
+	Name    string // "sdr:<serial>", "gps", "imu" or "baro"
+	Result  string // SELFTEST_*
+	Message string
+}
+
+type SetupWizard struct {
+	Completed       bool   // globalSettings.SetupCompleted
+	Step            string // next step that isn't done, "" when all are
+	Steps           []SetupStep
+	Hardware        SetupHardware
+	RegionUS        bool              // UAT (978 MHz) is only used in the US
+	Roles           map[string]string // dongle serial -> SDR_ROLE_*
+	SelfTests       []SetupSelfTest
+	OwnshipModeS    string
+	OwnshipCallsign string
+}
+
+var setupWizard SetupWizard
+var setupWizardMutex sync.Mutex
+
+func init() {
+	setupReset()
+}
+
+// Starts over. setupWizardMutex must be held, or not be needed yet.
+func setupReset() {
+	setupWizard = SetupWizard{Roles: make(map[string]string), SelfTests: make([]SetupSelfTest, 0)}
+	for _, name := range SETUP_STEPS {
+		setupWizard.Steps = append(setupWizard.Steps, SetupStep{Name: name, Status: SETUP_PENDING})
+	}
+}
+
+func setupSetStep(name, status, format string, args ...interface{}) {
+	for i := range setupWizard.Steps {
+		if setupWizard.Steps[i].Name == name {
+			setupWizard.Steps[i].Status = status
+			setupWizard.Steps[i].Message = fmt.Sprintf(format, args...)
+		}
+	}
+}
+
+func getSetupWizard() SetupWizard {
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	w := setupWizard
+	w.Completed = globalSettings.SetupCompleted
+	w.Step = ""
+	for _, s := range w.Steps {
+		if s.Status != SETUP_DONE && s.Status != SETUP_SKIPPED {
+			w.Step = s.Name
+			break
+		}
+	}
+	w.Steps = append([]SetupStep{}, setupWizard.Steps...)
+	w.SelfTests = append([]SetupSelfTest{}, setupWizard.SelfTests...)
+	w.Roles = make(map[string]string)
+	for serial, role := range setupWizard.Roles {
+		w.Roles[serial] = role
+	}
+	return w
+}
+
+// Same names as on the status page.
+func gpsTypeName(detected uint) string {
+	switch detected & 0x0f {
+	case GPS_TYPE_UART:
+		return "Serial port"
+	case GPS_TYPE_PROLIFIC:
+		return "Prolific USB-serial bridge"
+	case GPS_TYPE_OGNTRACKER:
+		return "OGN Tracker"
+	case GPS_TYPE_UBX6:
+		return "USB u-blox 6 GPS receiver"
+	case GPS_TYPE_UBX7:
+		return "USB u-blox 7 GNSS receiver"
+	case GPS_TYPE_UBX8:
+		return "USB u-blox 8 GNSS receiver"
+	case GPS_TYPE_UBX9:
+		return "USB u-blox 9 GNSS receiver"
+	case GPS_TYPE_SERIAL:
+		return "USB Serial IN"
+	case GPS_TYPE_SOFTRF_DONGLE:
+		return "SoftRF Dongle"
+	case GPS_TYPE_NETWORK:
+		return "Network"
+	}
+	return ""
+}
+
+func detectSetupHardware() SetupHardware {
+	return SetupHardware{
+		SDRs:          getSDRDongles(),
+		GPSConnected:  globalStatus.GPS_connected,
+		GPSType:       gpsTypeName(globalStatus.GPS_detected_type),
+		GPSSatellites: globalStatus.GPS_satellites_seen,
+		GPSFix:        isGPSValid(),
+		IMUConnected:  globalStatus.IMUConnected,
+		BaroConnected: globalStatus.BMPConnected,
+	}
+}
+
+// Position in the contiguous US, Alaska or Hawaii, or the WiFi country set to US if there is no fix.
+func setupRegionUS() bool {
+	if !isGPSValid() {
+		return globalSettings.WiFiCountry == "US"
+	}
+	lat, lon := mySituation.GPSLatitude, mySituation.GPSLongitude
+	return (lat > 24 && lat < 50 && lon > -125 && lon < -66) ||
+		(lat > 51 && lat < 72 && lon > -180 && lon < -129) ||
+		(lat > 18 && lat < 23 && lon > -161 && lon < -154)
+}
+
+// Suggested role per dongle serial. Dongles with a role (serial tag or SDR manager) keep it, dongles that name their
+// band in the product string (e.g. the FlightAware 978/1090 sticks) get that one. The others get the remaining roles
+// in order of usefulness: 1090 first (worldwide), then 978 in the US, 868 (OGN/FLARM) and 162 (AIS). Extra dongles
+// are turned off.
+func suggestSDRRoles(dongles []SDRDongle, us bool) map[string]string {
+	wanted := []string{SDR_ROLE_ES, SDR_ROLE_OGN, SDR_ROLE_AIS}
+	if us {
+		wanted = []string{SDR_ROLE_ES, SDR_ROLE_UAT, SDR_ROLE_OGN, SDR_ROLE_AIS}
+	}
+	take := func(role string) bool {
+		for i, r := range wanted {
+			if r == role {
+				wanted = append(wanted[:i], wanted[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+
+	roles := make(map[string]string)
+	remaining := make([]SDRDongle, 0)
+	for _, d := range dongles {
+		if _, ok := roles[d.Serial]; ok || d.Conflict {
+			continue // same serial twice, can't be told apart
+		}
+		product := strings.ToLower(d.Product)
+		switch {
+		case len(d.Role) > 0:
+			take(d.Role)
+			roles[d.Serial] = d.Role
+		case strings.Contains(product, "1090") && take(SDR_ROLE_ES):
+			roles[d.Serial] = SDR_ROLE_ES
+		case strings.Contains(product, "978") && take(SDR_ROLE_UAT):
+			roles[d.Serial] = SDR_ROLE_UAT
+		default:
+			remaining = append(remaining, d)
+		}
+	}
+	for _, d := range remaining {
+		roles[d.Serial] = SDR_ROLE_OFF
+		if len(wanted) > 0 {
+			roles[d.Serial] = wanted[0]
+			wanted = wanted[1:]
+		}
+	}
+	return roles
+}
+
+// Assigns the roles and enables their protocols. sdrWatcher() picks them up, nothing is saved.
+func activateSDRRoles(roles map[string]string) {
+	newRoles := make(map[string]string)
+	for serial, role := range globalSettings.SDRRoles {
+		newRoles[serial] = role
+	}
+	for serial, role := range roles {
+		newRoles[serial] = role
+		switch role {
+		case SDR_ROLE_UAT:
+			globalSettings.UAT_Enabled = true
+		case SDR_ROLE_ES:
+			globalSettings.ES_Enabled = true
+		case SDR_ROLE_OGN:
+			globalSettings.OGN_Enabled = true
+		case SDR_ROLE_AIS:
+			globalSettings.AIS_Enabled = true
+		}
+	}
+	globalSettings.SDRRoles = newRoles
+}
+
+// One or more comma separated ICAO addresses, 6 hex digits each. Unlike /setSettings invalid ones are an error.
+func parseOwnshipModeS(s string) (string, error) {
+	codes := make([]string, 0)
+	for _, code := range strings.Split(s, ",") {
+		code = strings.ToUpper(strings.TrimSpace(code))
+		if len(code) == 0 {
+			continue
+		}
+		if b, err := hex.DecodeString(code); err != nil || len(b) != 3 {
+			return "", fmt.Errorf("invalid ICAO address '%s', expecting 6 hex digits", code)
+		}
+		codes = append(codes, code)
+	}
+	return strings.Join(codes, ","), nil
+}
+
+// Callsign of the ownship report: up to 8 letters and digits, "" = from the ICAO address (US) or "Stratux".
+func parseOwnshipCallsign(s string) (string, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if len(s) > 8 {
+		return "", errors.New("callsign is longer than 8 characters")
+	}
+	for _, c := range s {
+		if !(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') {
+			return "", fmt.Errorf("invalid character '%c' in callsign, only letters and digits are allowed", c)
+		}
+	}
+	return s, nil
+}
+
+func setupDetect() {
+	setupWizard.Hardware = detectSetupHardware()
+	setupWizard.RegionUS = setupRegionUS()
+	setupWizard.Roles = suggestSDRRoles(setupWizard.Hardware.SDRs, setupWizard.RegionUS)
+	if len(setupWizard.OwnshipModeS) == 0 && globalSettings.OwnshipModeS != "F00000" {
+		setupWizard.OwnshipModeS = globalSettings.OwnshipModeS
+	}
+	if len(setupWizard.OwnshipCallsign) == 0 {
+		setupWizard.OwnshipCallsign = globalSettings.OwnshipCallsign
+	}
+	h := setupWizard.Hardware
+	found := make([]string, 0)
+	if len(h.SDRs) > 0 {
+		found = append(found, fmt.Sprintf("%d SDR(s)", len(h.SDRs)))
+	}
+	if h.GPSConnected {
+		found = append(found, "GPS")
+	}
+	if h.IMUConnected {
+		found = append(found, "IMU")
+	}
+	if h.BaroConnected {
+		found = append(found, "baro")
+	}
+	if len(found) == 0 {
+		setupSetStep("detect", SETUP_DONE, "no hardware found")
+	} else {
+		setupSetStep("detect", SETUP_DONE, "found %s", strings.Join(found, ", "))
+	}
+}
+
+// Result of one self-test from the current state. done: final, no need to wait any longer.
+func setupSelfTestResult(name string) (t SetupSelfTest, done bool) {
+	t.Name = name
+	switch {
+	case strings.HasPrefix(name, "sdr:"):
+		serial := strings.TrimPrefix(name, "sdr:")
+		role := setupWizard.Roles[serial]
+		inUse := ""
+		for _, d := range getSDRDongles() {
+			if d.Serial == serial {
+				inUse = d.InUse
+			}
+		}
+		var msgs uint
+		switch role {
+		case SDR_ROLE_UAT:
+			msgs = globalStatus.UAT_messages_last_minute
+		case SDR_ROLE_ES:
+			msgs = globalStatus.ES_messages_last_minute
+		case SDR_ROLE_OGN:
+			msgs = globalStatus.OGN_messages_last_minute
+		case SDR_ROLE_AIS:
+			msgs = globalStatus.AIS_messages_last_minute
+		}
+		switch {
+		case inUse != role:
+			return SetupSelfTest{name, SELFTEST_FAIL, fmt.Sprintf("dongle not running on %s MHz", role)}, false
+		case msgs == 0:
+			return SetupSelfTest{name, SELFTEST_WARN, "running, no messages received yet: check the antenna (or nothing in range)"}, false
+		}
+		return SetupSelfTest{name, SELFTEST_PASS, fmt.Sprintf("%d messages in the last minute", msgs)}, true
+	case name == "gps":
+		if !globalStatus.GPS_connected || !isGPSConnected() {
+			return SetupSelfTest{name, SELFTEST_FAIL, "no data from the GPS"}, false
+		}
+		if !isGPSValid() {
+			return SetupSelfTest{name, SELFTEST_WARN, fmt.Sprintf("no fix yet, %d satellites seen: needs a clear view of the sky",
+				globalStatus.GPS_satellites_seen)}, false
+		}
+		return SetupSelfTest{name, SELFTEST_PASS, fmt.Sprintf("fix with %d satellites", mySituation.GPSSatellites)}, true
+	case name == "imu":
+		if !globalStatus.IMUConnected || stratuxClock.Since(mySituation.AHRSLastAttitudeTime) > time.Second {
+			return SetupSelfTest{name, SELFTEST_FAIL, "no attitude data from the IMU"}, false
+		}
+		return SetupSelfTest{name, SELFTEST_PASS, fmt.Sprintf("pitch %.0f°, roll %.0f°", mySituation.AHRSPitch, mySituation.AHRSRoll)}, true
+	case name == "baro":
+		if !globalStatus.BMPConnected || stratuxClock.Since(mySituation.BaroLastMeasurementTime) > 2*time.Second {
+			return SetupSelfTest{name, SELFTEST_FAIL, "no data from the pressure sensor"}, false
+		}
+		return SetupSelfTest{name, SELFTEST_PASS, fmt.Sprintf("pressure altitude %.0f ft", mySituation.BaroPressureAltitude)}, true
+	}
+	return SetupSelfTest{name, SELFTEST_FAIL, "unknown test"}, true
+}
+
+// Tests the detected hardware until all pass or SETUP_SELFTEST_TIME is over.
+func setupSelfTest() {
+	setupWizardMutex.Lock()
+	names := make([]string, 0)
+	for serial, role := range setupWizard.Roles {
+		if role != SDR_ROLE_OFF {
+			names = append(names, "sdr:"+serial)
+		}
+	}
+	sort.Strings(names)
+	h := setupWizard.Hardware
+	for _, t := range []struct {
+		name  string
+		found bool
+	}{{"gps", h.GPSConnected}, {"imu", h.IMUConnected}, {"baro", h.BaroConnected}} {
+		if t.found {
+			names = append(names, t.name)
+		}
+	}
+	setupWizard.SelfTests = make([]SetupSelfTest, 0)
+	for _, name := range names {
+		setupWizard.SelfTests = append(setupWizard.SelfTests, SetupSelfTest{name, SELFTEST_RUNNING, ""})
+	}
+	setupWizardMutex.Unlock()
+
+	start := time.Now()
+	for {
+		time.Sleep(time.Second)
+		setupWizardMutex.Lock()
+		allDone := true
+		for i, name := range names {
+			t, done := setupSelfTestResult(name)
+			setupWizard.SelfTests[i] = t
+			allDone = allDone && done
+		}
+		finished := allDone || time.Since(start) >= SETUP_SELFTEST_TIME
+		if finished {
+			failed := 0
+			for _, t := range setupWizard.SelfTests {
+				if t.Result == SELFTEST_FAIL {
+					failed++
+				}
+			}
+			if failed > 0 {
+				setupSetStep("selftest", SETUP_FAILED, "%d of %d tests failed", failed, len(names))
+			} else {
+				setupSetStep("selftest", SETUP_DONE, "%d tests passed", len(names))
+			}
+			logInfof("setup", "self-test: %+v", setupWizard.SelfTests)
+		}
+		setupWizardMutex.Unlock()
+		if finished {
+			return
+		}
+	}
+}
+
+type setupWizardRequest struct {
+	Action          string
+	Roles           map[string]string
+	OwnshipModeS    string
+	OwnshipCallsign string
+}
+
+// Runs one action. The error is for the user (400).
+func setupWizardAction(req setupWizardRequest) error {
+	setupWizardMutex.Lock()
+	defer setupWizardMutex.Unlock()
+	for _, s := range setupWizard.Steps {
+		if s.Name == "selftest" && s.Status == SETUP_RUNNING {
+			return errors.New("self-test is running")
+		}
+	}
+
+	switch req.Action {
+	case "detect":
+		setupDetect()
+	case "roles":
+		for serial, role := range req.Roles {
+			if !isValidSDRRole(role) {
+				return fmt.Errorf("invalid role '%s' for %s", role, serial)
+			}
+			if _, ok := setupWizard.Roles[serial]; !ok {
+				return fmt.Errorf("unknown dongle %s, run detect first", serial)
+			}
+			setupWizard.Roles[serial] = role
+		}
+		activateSDRRoles(setupWizard.Roles)
+		setupSetStep("roles", SETUP_DONE, "%d dongle(s) assigned", len(setupWizard.Roles))
+	case "selftest":
+		setupSetStep("selftest", SETUP_RUNNING, "")
+		go setupSelfTest()
+	case "ownship":
+		codes, err := parseOwnshipModeS(req.OwnshipModeS)
+		if err != nil {
+			return err
+		}
+		callsign, err := parseOwnshipCallsign(req.OwnshipCallsign)
+		if err != nil {
+			return err
+		}
+		setupWizard.OwnshipModeS, setupWizard.OwnshipCallsign = codes, callsign
+		if len(codes) == 0 {
+			setupSetStep("ownship", SETUP_DONE, "no ICAO address: ownship traffic can't be filtered")
+		} else {
+			setupSetStep("ownship", SETUP_DONE, "%s %s", codes, callsign)
+		}
+	case "apply":
+		if len(setupWizard.Roles) > 0 {
+			activateSDRRoles(setupWizard.Roles)
+		}
+		if len(setupWizard.OwnshipModeS) > 0 {
+			globalSettings.OwnshipModeS = setupWizard.OwnshipModeS
+		}
+		globalSettings.OwnshipCallsign = setupWizard.OwnshipCallsign
+		globalSettings.SetupCompleted = true
+		saveSettings()
+		setupSetStep("apply", SETUP_DONE, "configuration saved")
+		logInfof("setup", "configuration written: roles %v, ownship '%s' '%s'", setupWizard.Roles,
+			setupWizard.OwnshipModeS, setupWizard.OwnshipCallsign)
+	case "skip":
+		globalSettings.SetupCompleted = true
+		saveSettings()
+		for _, s := range setupWizard.Steps {
+			if s.Status != SETUP_DONE {
+				setupSetStep(s.Name, SETUP_SKIPPED, "")
+			}
+		}
+	case "reset":
+		setupReset()
+	default:
+		return fmt.Errorf("unknown action '%s'", req.Action)
+	}
+	return nil
+}
+
+// AJAX call - /getSetupWizard. State and progress of the setup wizard.
+func handleSetupWizardGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	wizardJSON, err := json.Marshal(getSetupWizard())
+	if err != nil {
+		logErrorf("setup", "Error sending setup wizard JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", wizardJSON)
+}
+
+// AJAX call - /setSetupWizard. POST {"Action": "...", ...}, responds with the new state.
+func handleSetupWizardSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var req setupWizardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := setupWizardAction(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleSetupWizardGetRequest(w, r)
+}
@@ -0,0 +1,182 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	shmexport.go: Export of the current situation to a POSIX shared memory segment,
+		so co-resident applications (e.g. a local EFIS renderer) can read attitude/GPS
+		at high rate without going through the network stack.
+
+	The segment is /dev/shm/stratux-situation, SHM_SITUATION_SIZE bytes, little endian.
+	All floats are IEEE754. Offsets:
+		 0 uint32  magic "STRX" (0x58525453)
+		 4 uint16  layout version (SHM_SITUATION_VERSION)
+		 6 uint16  segment size in bytes
+		 8 uint32  sequence counter. Odd while an update is being written.
+		12 uint32  flags: bit0 GPS valid, bit1 baro valid, bit2 AHRS valid
+		16 uint64  stratuxClock milliseconds of the last update
+		24 int64   GPS time, unix nanoseconds (0 if unknown)
+		32 float64 GPS latitude, deg
+		40 float64 GPS longitude, deg
+		48 float32 GPS altitude MSL, ft
+		52 float32 GPS height above ellipsoid, ft
+		56 float32 GPS ground speed, kts
+		60 float32 GPS true course, deg
+		64 float32 GPS vertical speed, ft/s
+		68 float32 GPS horizontal accuracy, m
+		72 float32 GPS vertical accuracy, m
+		76 uint8   GPS fix quality
+		77 uint8   GPS NACp
+		78 uint16  GPS satellites used in solution
+		80 float32 baro pressure altitude, ft
+		84 float32 baro vertical speed, ft/min
+		88 float32 baro temperature, deg C
+		92 uint8   baro source type (BARO_TYPE_*)
+		93 uint8   AHRS status
+		94 uint16  reserved
+		96 float32 AHRS pitch, deg
+		100 float32 AHRS roll, deg
+		104 float32 AHRS gyro heading, deg
+		108 float32 AHRS magnetic heading, deg
+		112 float32 AHRS slip/skid, deg
+		116 float32 AHRS turn rate, deg/s
+		120 float32 AHRS G load
+		124 uint32  reserved
+
+	Readers should read the sequence counter, copy the segment, and read the counter again.
+	The copy is consistent if both values are equal and even.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	SHM_SITUATION_FILE     = "/dev/shm/stratux-situation"
+	SHM_SITUATION_MAGIC    = 0x58525453 // "STRX"
+	SHM_SITUATION_VERSION  = 1
+	SHM_SITUATION_SIZE     = 128
+	SHM_SITUATION_INTERVAL = 50 * time.Millisecond
+)
+
+var shmSituation []byte
+var shmSituationSeq uint32
+
+func initSituationShm() error {
+	f, err := os.OpenFile(SHM_SITUATION_FILE, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = f.Truncate(SHM_SITUATION_SIZE); err != nil {
+		return err
+	}
+	mem, err := syscall.Mmap(int(f.Fd()), 0, SHM_SITUATION_SIZE, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	for i := range mem {
+		mem[i] = 0
+	}
+	binary.LittleEndian.PutUint32(mem[0:], SHM_SITUATION_MAGIC)
+	binary.LittleEndian.PutUint16(mem[4:], SHM_SITUATION_VERSION)
+	binary.LittleEndian.PutUint16(mem[6:], SHM_SITUATION_SIZE)
+	shmSituation = mem
+	return nil
+}
+
+func shmPutFloat32(offset int, v float32) {
+	binary.LittleEndian.PutUint32(shmSituation[offset:], math.Float32bits(v))
+}
+
+func shmPutFloat64(offset int, v float64) {
+	binary.LittleEndian.PutUint64(shmSituation[offset:], math.Float64bits(v))
+}
+
+func shmSetSeq(seq uint32) {
+	// Atomic store acts as the write barrier between the sequence counter and the payload.
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&shmSituation[8])), seq)
+}
+
+func updateSituationShm() {
+	var flags uint32
+	if isGPSValid() {
+		flags |= 1
+	}
+	if isTempPressValid() {
+		flags |= 2
+	}
+	if isAHRSValid() {
+		flags |= 4
+	}
+
+	shmSituationSeq++
+	shmSetSeq(shmSituationSeq) // odd: write in progress
+
+	binary.LittleEndian.PutUint32(shmSituation[12:], flags)
+	binary.LittleEndian.PutUint64(shmSituation[16:], stratuxClock.Milliseconds)
+
+	mySituation.muGPS.Lock()
+	var gpsTime int64
+	if !mySituation.GPSTime.IsZero() {
+		gpsTime = mySituation.GPSTime.UnixNano()
+	}
+	binary.LittleEndian.PutUint64(shmSituation[24:], uint64(gpsTime))
+	shmPutFloat64(32, float64(mySituation.GPSLatitude))
+	shmPutFloat64(40, float64(mySituation.GPSLongitude))
+	shmPutFloat32(48, mySituation.GPSAltitudeMSL)
+	shmPutFloat32(52, mySituation.GPSHeightAboveEllipsoid)
+	shmPutFloat32(56, float32(mySituation.GPSGroundSpeed))
+	shmPutFloat32(60, mySituation.GPSTrueCourse)
+	shmPutFloat32(64, mySituation.GPSVerticalSpeed)
+	shmPutFloat32(68, mySituation.GPSHorizontalAccuracy)
+	shmPutFloat32(72, mySituation.GPSVerticalAccuracy)
+	shmSituation[76] = mySituation.GPSFixQuality
+	shmSituation[77] = mySituation.GPSNACp
+	binary.LittleEndian.PutUint16(shmSituation[78:], mySituation.GPSSatellites)
+	mySituation.muGPS.Unlock()
+
+	mySituation.muBaro.Lock()
+	shmPutFloat32(80, mySituation.BaroPressureAltitude)
+	shmPutFloat32(84, mySituation.BaroVerticalSpeed)
+	shmPutFloat32(88, mySituation.BaroTemperature)
+	shmSituation[92] = mySituation.BaroSourceType
+	mySituation.muBaro.Unlock()
+
+	mySituation.muAttitude.Lock()
+	shmSituation[93] = mySituation.AHRSStatus
+	shmPutFloat32(96, float32(mySituation.AHRSPitch))
+	shmPutFloat32(100, float32(mySituation.AHRSRoll))
+	shmPutFloat32(104, float32(mySituation.AHRSGyroHeading))
+	shmPutFloat32(108, float32(mySituation.AHRSMagHeading))
+	shmPutFloat32(112, float32(mySituation.AHRSSlipSkid))
+	shmPutFloat32(116, float32(mySituation.AHRSTurnRate))
+	shmPutFloat32(120, float32(mySituation.AHRSGLoad))
+	mySituation.muAttitude.Unlock()
+
+	shmSituationSeq++
+	shmSetSeq(shmSituationSeq) // even: consistent
+}
+
+// Periodically copies mySituation into the shared memory segment.
+func situationShmExporter() {
+	if err := initSituationShm(); err != nil {
+		logErrorf("shmexport", "can't create %s: %s", SHM_SITUATION_FILE, err.Error())
+		return
+	}
+	logInfof("shmexport", "exporting situation to %s", SHM_SITUATION_FILE)
+	ticker := time.NewTicker(SHM_SITUATION_INTERVAL)
+	for {
+		<-ticker.C
+		updateSituationShm()
+	}
+}
@@ -0,0 +1,244 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	surveillanceoutput.go: Traffic outputs for surveillance tools, Virtual Radar Server and research software:
+		- ASTERIX CAT021 (ADS-B target reports, edition 2.x) over UDP, one record per datagram. Configured as a network
+		  output with the NETWORK_ASTERIX capability, broadcast on the local networks by default
+		  (setting "ASTERIXOutputPort", 0 = disabled).
+		- SBS-1 BaseStation CSV ("MSG,3,..." as dump1090 port 30003) on TCP port globalSettings.SBSOutputPort.
+		All received targets with position are sent once per second while their data is current, except ownship and
+		targets merged into another one (see trafficcorrelation.go). Unlike the EFB outputs, they are not limited to
+		the most threatening targets.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	ASTERIX_CAT021   = 21
+	ASTERIX_SAC      = 0 // data source identification, "local"
+	ASTERIX_SIC      = 1
+	SBS_MAX_AGE      = 5.0 // s, targets without update are not sent (no coasting)
+	SURV_OUT_MAX_AGE = 1 * time.Second
+)
+
+// ASTERIX CAT021 emitter categories (I021/020) by GDL90 emitter category. 1-6 are the same.
+var asterixEmitterCategory = map[uint8]uint8{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 10, 9: 11, 10: 12, 11: 16, 12: 15,
+	14: 13, 15: 14, 17: 20, 18: 21, 19: 22}
+
+func isASTERIXOutputEnabled() bool {
+	for _, o := range globalSettings.NetworkOutputs {
+		if o.Capability&NETWORK_ASTERIX != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the UDP port of the ASTERIX network output, 0 removes it. Interface/broadcast of an existing one are kept.
+func setASTERIXOutputPort(port uint32) {
+	outputs := make([]networkConnection, 0, len(globalSettings.NetworkOutputs)+1)
+	asterix := networkConnection{Capability: NETWORK_ASTERIX, Broadcast: true}
+	for _, o := range globalSettings.NetworkOutputs {
+		if o.Capability&NETWORK_ASTERIX != 0 {
+			asterix = o
+			continue
+		}
+		outputs = append(outputs, o)
+	}
+	if port > 0 {
+		asterix.Port = port
+		outputs = append(outputs, asterix)
+	}
+	globalSettings.NetworkOutputs = outputs
+}
+
+// Seconds since midnight UTC in 1/128 s, as used by the ASTERIX time items.
+func asterixTimeOfDay(t time.Time) []byte {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	v := uint32(t.Sub(midnight).Seconds() * 128)
+	return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+// Callsign in 6 bit ICAO characters (I021/170), 8 characters padded with spaces.
+func asterixIdentification(tail string) []byte {
+	tail = strings.ToUpper(tail)
+	var v uint64
+	for i := 0; i < 8; i++ {
+		var c uint64 = 32 // space
+		if i < len(tail) {
+			switch ch := tail[i]; {
+			case ch >= 'A' && ch <= 'Z':
+				c = uint64(ch-'A') + 1
+			case ch >= '0' && ch <= '9':
+				c = uint64(ch)
+			}
+		}
+		v = v<<6 | c
+	}
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b[2:]
+}
+
+// Mode 3/A code from the decimal representation of the octal squawk (7000 -> 07000 octal).
+func squawkOctal(squawk int) uint16 {
+	var v uint16
+	for i, d := 0, squawk; i < 4; i, d = i+1, d/10 {
+		v |= uint16(d%10&7) << (3 * uint(i))
+	}
+	return v
+}
+
+/*
+	makeASTERIXCat021().
+		One CAT021 data block with a single target report. Data items are given by their field reference number
+		(FRN) of the CAT021 edition 2.x user application profile, the FSPEC is built from the items present.
+*/
+func makeASTERIXCat021(ti TrafficInfo, key uint32) []byte {
+	items := make(map[int][]byte)
+	items[1] = []byte{ASTERIX_SAC, ASTERIX_SIC} // I021/010
+
+	// I021/040 target report descriptor: address type, altitude resolution, first extension with ground bit
+	atp, arc := byte(0), byte(0) // 24 bit ICAO address, 25ft
+	if ti.Addr_type != 0 {
+		atp = 3 // anonymous / non-ICAO
+	}
+	if ti.TargetType != TARGET_TYPE_ADSB {
+		arc = 2 // unknown
+	}
+	var ext byte
+	if ti.OnGround {
+		ext |= 0x40
+	}
+	items[2] = []byte{atp<<5 | arc<<3 | 1, ext}
+
+	items[3] = []byte{byte(key>>8) & 0x0f, byte(key)} // I021/161 track number (12 bit)
+	items[5] = asterixTimeOfDay(ti.Timestamp)         // I021/071 time of applicability for position
+
+	// I021/131 high resolution position, LSB 180/2^30 deg
+	pos := make([]byte, 8)
+	binary.BigEndian.PutUint32(pos[0:], uint32(int32(math.Round(float64(ti.Lat)*(1<<30)/180))))
+	binary.BigEndian.PutUint32(pos[4:], uint32(int32(math.Round(float64(ti.Lng)*(1<<30)/180))))
+	items[7] = pos
+
+	items[11] = []byte{byte(ti.Icao_addr >> 16), byte(ti.Icao_addr >> 8), byte(ti.Icao_addr)} // I021/080
+
+	if ti.Alt != 0 {
+		if ti.AltIsGNSS {
+			v := int16(float64(ti.Alt) / 6.25) // I021/140 geometric height, LSB 6.25ft
+			items[16] = []byte{byte(uint16(v) >> 8), byte(v)}
+		} else {
+			v := int16(ti.Alt / 25) // I021/145 flight level, LSB 1/4 FL
+			items[21] = []byte{byte(uint16(v) >> 8), byte(v)}
+		}
+	}
+	if ti.Squawk != 0 {
+		v := squawkOctal(ti.Squawk) // I021/070
+		items[19] = []byte{byte(v >> 8), byte(v)}
+	}
+	if ti.Speed_valid {
+		if ti.Alt != 0 && !ti.AltIsGNSS {
+			v := uint16(int16(math.Round(float64(ti.Vvel)/6.25))) & 0x7fff // I021/155, 15 bit two's complement
+			items[24] = []byte{byte(v >> 8), byte(v)}
+		}
+		// I021/160 airborne ground vector: speed LSB 2^-14 NM/s (15 bit), track LSB 360/2^16
+		gs := uint32(math.Min(float64(ti.Speed)/3600*(1<<14), 0x7fff))
+		trk := uint32(math.Round(float64(ti.Track)/360*(1<<16))) & 0xffff
+		v := gs<<16 | trk
+		items[26] = []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+	}
+	if len(ti.Tail) > 0 {
+		items[29] = asterixIdentification(ti.Tail) // I021/170
+	}
+	if cat, ok := asterixEmitterCategory[ti.Emitter_category]; ok {
+		items[30] = []byte{cat} // I021/020
+	}
+
+	maxFRN := 0
+	for frn := range items {
+		if frn > maxFRN {
+			maxFRN = frn
+		}
+	}
+	fspec := make([]byte, (maxFRN+6)/7)
+	for frn := range items {
+		fspec[(frn-1)/7] |= 0x80 >> uint((frn-1)%7)
+	}
+	for i := 0; i < len(fspec)-1; i++ {
+		fspec[i] |= 1 // FX
+	}
+
+	record := fspec
+	for frn := 1; frn <= maxFRN; frn++ {
+		record = append(record, items[frn]...)
+	}
+	block := []byte{ASTERIX_CAT021, 0, 0}
+	binary.BigEndian.PutUint16(block[1:], uint16(len(record)+3))
+	return append(block, record...)
+}
+
+// SBS-1 BaseStation messages of a target: identification, position and velocity (and squawk if known).
+func makeSBSMessages(ti TrafficInfo) []byte {
+	hex := fmt.Sprintf("%06X", ti.Icao_addr)
+	if ti.Addr_type != 0 {
+		hex = "~" + hex // non-ICAO address, as dump1090
+	}
+	ts := ti.Timestamp.UTC()
+	now := time.Now().UTC()
+	onGround := "0"
+	if ti.OnGround {
+		onGround = "-1"
+	}
+	// MSG,type,session,aircraft,hex,flight,date gen,time gen,date log,time log, then 12 data fields
+	msg := func(msgType int, fields [12]string) string {
+		return fmt.Sprintf("MSG,%d,1,1,%s,1,%s,%s,%s,%s,%s\r\n", msgType, hex, ts.Format("2006/01/02"), ts.Format("15:04:05.000"),
+			now.Format("2006/01/02"), now.Format("15:04:05.000"), strings.Join(fields[:], ","))
+	}
+
+	var out strings.Builder
+	if len(ti.Tail) > 0 {
+		out.WriteString(msg(1, [12]string{ti.Tail}))
+	}
+	alt := ""
+	if ti.Alt != 0 {
+		alt = fmt.Sprintf("%d", ti.Alt)
+	}
+	out.WriteString(msg(3, [12]string{1: alt, 4: fmt.Sprintf("%.5f", ti.Lat), 5: fmt.Sprintf("%.5f", ti.Lng), 11: onGround}))
+	if ti.Speed_valid {
+		out.WriteString(msg(4, [12]string{2: fmt.Sprintf("%d", ti.Speed), 3: fmt.Sprintf("%.0f", ti.Track), 6: fmt.Sprintf("%d", ti.Vvel)}))
+	}
+	if ti.Squawk != 0 {
+		out.WriteString(msg(6, [12]string{7: fmt.Sprintf("%04d", ti.Squawk), 11: onGround}))
+	}
+	return []byte(out.String())
+}
+
+// Called from sendTrafficUpdates() for every current target with position that isn't ourselves.
+func sendSurveillanceOutputs(ti TrafficInfo, key uint32) {
+	if ti.Age > SBS_MAX_AGE || ti.Last_source == TRAFFIC_SOURCE_AIS {
+		return
+	}
+	if isASTERIXOutputEnabled() {
+		sendMsg(makeASTERIXCat021(ti, key), NETWORK_ASTERIX, SURV_OUT_MAX_AGE, MSGPRIO_FEED)
+	}
+	if globalSettings.SBSOutputPort > 0 {
+		sendMsg(makeSBSMessages(ti), NETWORK_SBS, SURV_OUT_MAX_AGE, MSGPRIO_FEED)
+	}
+}
+
+// SBS-1 output on globalSettings.SBSOutputPort (default 30003).
+func sbsOutputListener() {
+	tcpOutputListener("SBS-1 output", func() int { return globalSettings.SBSOutputPort }, NETWORK_SBS, 4096)
+}
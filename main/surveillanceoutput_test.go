@@ -0,0 +1,172 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	surveillanceoutput_test.go: ASTERIX CAT021 encoding, checked by decoding the data block again.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// Fixed item lengths of the FRNs makeASTERIXCat021() uses, 0 for the extensible I021/040.
+var asterixTestItemLength = map[int]int{1: 2, 2: 0, 3: 2, 5: 3, 7: 8, 11: 3, 16: 2, 19: 2, 21: 2, 24: 2, 26: 4, 29: 6, 30: 1}
+
+// Splits a CAT021 data block into its items by FRN.
+func parseASTERIXCat021(t *testing.T, block []byte) map[int][]byte {
+	if len(block) < 4 || block[0] != ASTERIX_CAT021 || int(binary.BigEndian.Uint16(block[1:])) != len(block) {
+		t.Fatalf("bad data block header % x", block)
+	}
+	rec := block[3:]
+	frns := make([]int, 0)
+	for i := 0; ; i++ {
+		for bit := 0; bit < 7; bit++ {
+			if rec[i]&(0x80>>uint(bit)) != 0 {
+				frns = append(frns, i*7+bit+1)
+			}
+		}
+		if rec[i]&1 == 0 {
+			rec = rec[i+1:]
+			break
+		}
+	}
+	items := make(map[int][]byte)
+	for _, frn := range frns {
+		n, ok := asterixTestItemLength[frn]
+		if !ok {
+			t.Fatalf("unexpected FRN %d", frn)
+		}
+		if n == 0 {
+			for n = 1; rec[n-1]&1 != 0; n++ {
+			}
+		}
+		if len(rec) < n {
+			t.Fatalf("FRN %d: short record", frn)
+		}
+		items[frn], rec = rec[:n], rec[n:]
+	}
+	if len(rec) != 0 {
+		t.Fatalf("%d bytes left after the last item", len(rec))
+	}
+	return items
+}
+
+func TestSquawkOctal(t *testing.T) {
+	tests := map[int]uint16{0: 0, 1200: 01200, 7000: 07000, 7777: 07777, 7500: 07500, 1234: 01234}
+	for squawk, want := range tests {
+		if got := squawkOctal(squawk); got != want {
+			t.Errorf("squawkOctal(%d) = %#o, want %#o", squawk, got, want)
+		}
+	}
+}
+
+func TestASTERIXIdentification(t *testing.T) {
+	tests := []struct {
+		tail string
+		want string // Characters after decoding the 6 bit code.
+	}{
+		{"N12345", "N12345  "},
+		{"dlh4ab", "DLH4AB  "},
+		{"ABCDEFGHIJ", "ABCDEFGH"},
+		{"D-EFGH", "D EFGH  "},
+		{"", "        "},
+	}
+	for _, tt := range tests {
+		b := asterixIdentification(tt.tail)
+		v := uint64(0)
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		got := make([]byte, 8)
+		for i := 7; i >= 0; i, v = i-1, v>>6 {
+			c := byte(v & 0x3f)
+			if c >= 1 && c <= 26 {
+				c += 'A' - 1
+			}
+			got[i] = c
+		}
+		if string(got) != tt.want {
+			t.Errorf("asterixIdentification(%q) decodes to %q, want %q", tt.tail, got, tt.want)
+		}
+	}
+}
+
+func TestMakeASTERIXCat021(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 12, 30, 15, 500000000, time.UTC)
+
+	adsb := TrafficInfo{Icao_addr: 0xA1B2C3, Tail: "N123AB", Lat: 47.4502, Lng: -122.3088, Alt: 3500, Squawk: 1200,
+		Speed: 120, Speed_valid: true, Track: 270, Vvel: -500, Emitter_category: 1, TargetType: TARGET_TYPE_ADSB,
+		Timestamp: ts}
+	items := parseASTERIXCat021(t, makeASTERIXCat021(adsb, 0x1234))
+
+	if !bytes.Equal(items[1], []byte{ASTERIX_SAC, ASTERIX_SIC}) {
+		t.Errorf("I021/010 = % x", items[1])
+	}
+	if !bytes.Equal(items[2], []byte{0x01, 0x00}) {
+		t.Errorf("I021/040 = % x, want ICAO address, 25 ft, airborne", items[2])
+	}
+	if !bytes.Equal(items[3], []byte{0x02, 0x34}) {
+		t.Errorf("I021/161 = % x, want 12 bit track number 0x234", items[3])
+	}
+	if tod := int(items[5][0])<<16 | int(items[5][1])<<8 | int(items[5][2]); tod != (12*3600+30*60+15)*128+64 {
+		t.Errorf("I021/071 = %d/128 s", tod)
+	}
+	lat := float64(int32(binary.BigEndian.Uint32(items[7][0:]))) * 180 / (1 << 30)
+	lng := float64(int32(binary.BigEndian.Uint32(items[7][4:]))) * 180 / (1 << 30)
+	if math.Abs(lat-47.4502) > 1e-6 || math.Abs(lng+122.3088) > 1e-6 {
+		t.Errorf("I021/131 = %.6f,%.6f", lat, lng)
+	}
+	if !bytes.Equal(items[11], []byte{0xA1, 0xB2, 0xC3}) {
+		t.Errorf("I021/080 = % x", items[11])
+	}
+	if fl := int16(binary.BigEndian.Uint16(items[21])); fl != 140 {
+		t.Errorf("I021/145 = %d quarter FL, want 140", fl)
+	}
+	if _, ok := items[16]; ok {
+		t.Errorf("I021/140 sent for a pressure altitude")
+	}
+	if sq := binary.BigEndian.Uint16(items[19]); sq != 01200 {
+		t.Errorf("I021/070 = %#o", sq)
+	}
+	if vv := int16(binary.BigEndian.Uint16(items[24])<<1) >> 1; vv != -80 {
+		t.Errorf("I021/155 = %d, want -80 (x 6.25 ft/min)", vv)
+	}
+	gs := float64(binary.BigEndian.Uint16(items[26][0:])) / (1 << 14) * 3600
+	trk := float64(binary.BigEndian.Uint16(items[26][2:])) * 360 / (1 << 16)
+	if math.Abs(gs-120) > 0.25 || math.Abs(trk-270) > 0.01 {
+		t.Errorf("I021/160 = %.2f kt %.2f deg", gs, trk)
+	}
+	if !bytes.Equal(items[29], asterixIdentification("N123AB")) {
+		t.Errorf("I021/170 = % x", items[29])
+	}
+	if !bytes.Equal(items[30], []byte{1}) {
+		t.Errorf("I021/020 = % x", items[30])
+	}
+
+	// A FLARM glider on the ground, GNSS altitude, no callsign: the optional items must drop out of the FSPEC.
+	flarm := TrafficInfo{Icao_addr: 0x3E1234, Addr_type: 1, Lat: -33.9, Lng: 151.2, Alt: 1000, AltIsGNSS: true,
+		OnGround: true, Emitter_category: 9, Last_source: TRAFFIC_SOURCE_OGN, Timestamp: ts}
+	items = parseASTERIXCat021(t, makeASTERIXCat021(flarm, 7))
+	if !bytes.Equal(items[2], []byte{3<<5 | 2<<3 | 1, 0x40}) {
+		t.Errorf("I021/040 = % x, want non-ICAO, unknown resolution, on ground", items[2])
+	}
+	if h := int16(binary.BigEndian.Uint16(items[16])); h != 160 {
+		t.Errorf("I021/140 = %d, want 160 (x 6.25 ft)", h)
+	}
+	if !bytes.Equal(items[30], []byte{11}) {
+		t.Errorf("I021/020 = % x, want glider", items[30])
+	}
+	for _, frn := range []int{19, 21, 24, 26, 29} {
+		if _, ok := items[frn]; ok {
+			t.Errorf("FRN %d sent without data", frn)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	systemhealth.go: Health of the hardware and of the internal subsystems, sampled every HEALTH_INTERVAL with
+		HEALTH_HISTORY samples of history for the charts in the web UI.
+			CPU temperature and load, memory, Go heap and goroutines
+			throttling and undervoltage flags of the Raspberry Pi firmware (as vcgencmd get_throttled)
+			free space of the root file system, data written to the SD card since boot and its wear level (eMMC only)
+			USB devices
+			subsystems: long running goroutines report with subsystemAlive() and are stalled when they didn't for
+			longer than they registered with registerSubsystem()
+		/status/system                        current values, ?history=1 with the history
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ricochet2200/go-disk-usage/du"
+)
+
+const (
+	HEALTH_INTERVAL = 10 * time.Second
+	HEALTH_HISTORY  = 360 // one hour
+	SD_DEVICE       = "mmcblk0"
+
+	// Bits of get_throttled
+	THROTTLED_UNDERVOLTAGE          = 0x1
+	THROTTLED_FREQ_CAPPED           = 0x2
+	THROTTLED_THROTTLED             = 0x4
+	THROTTLED_SOFT_TEMP_LIMIT       = 0x8
+	THROTTLED_UNDERVOLTAGE_OCCURRED = 0x10000
+	THROTTLED_FREQ_CAPPED_OCCURRED  = 0x20000
+	THROTTLED_THROTTLED_OCCURRED    = 0x40000
+	THROTTLED_SOFT_TEMP_OCCURRED    = 0x80000
+)
+
+type USBDevice struct {
+	Bus          string // sysfs name, e.g. 1-1.3
+	VendorID     string
+	ProductID    string
+	Manufacturer string
+	Product      string
+	Speed        string // Mbit/s
+}
+
+type SubsystemHealth struct {
+	Name      string
+	OK        bool
+	LastAlive float64 // s ago
+	MaxSilent float64 // s
+}
+
+type SystemHealthSample struct {
+	Time          time.Time
+	CPUTemp       float32
+	CPULoad       float64 // 1 minute load average
+	MemUsedPct    float64
+	Throttled     uint32
+	DiskBytesFree uint64
+}
+
+type SystemHealth struct {
+	Time            time.Time
+	CPUTemp         float32
+	CPUTempMin      float32
+	CPUTempMax      float32
+	CPULoad         [3]float64 // 1, 5, 15 minutes
+	CPUCount        int
+	MemTotal        uint64
+	MemAvailable    uint64
+	HeapAlloc       uint64
+	Goroutines      int
+	Throttled       uint32   // raw get_throttled
+	ThrottledNow    []string // flags of Throttled currently set
+	ThrottledBefore []string // flags that were set since boot
+	DiskBytesTotal  uint64
+	DiskBytesFree   uint64
+	SDBytesWritten  uint64 // since boot
+	SDWearPct       int    // 0-100, -1 = unknown (only eMMC reports it)
+	USBDevices      []USBDevice
+	Subsystems      []SubsystemHealth
+	Fan             *FanStatus           // nil if fancontrol isn't running
+	PowerDegraded   bool                 // undervoltage now or recently, see undervoltage.go
+	PowerEvents     []PowerEvent         // changes of the throttling flags since boot
+	History         []SystemHealthSample `json:",omitempty"`
+}
+
+var throttledFlags = []struct {
+	now, before uint32
+	name        string
+}{
+	{THROTTLED_UNDERVOLTAGE, THROTTLED_UNDERVOLTAGE_OCCURRED, "undervoltage"},
+	{THROTTLED_FREQ_CAPPED, THROTTLED_FREQ_CAPPED_OCCURRED, "frequency capped"},
+	{THROTTLED_THROTTLED, THROTTLED_THROTTLED_OCCURRED, "throttled"},
+	{THROTTLED_SOFT_TEMP_LIMIT, THROTTLED_SOFT_TEMP_OCCURRED, "soft temperature limit"},
+}
+
+type subsystemState struct {
+	lastAlive time.Time
+	maxSilent time.Duration
+}
+
+var subsystems = make(map[string]*subsystemState)
+var subsystemsMutex sync.Mutex
+
+var healthHistory []SystemHealthSample
+var healthMutex sync.Mutex
+
+// Registers a long running goroutine. It's stalled if it doesn't call subsystemAlive() for maxSilent.
+func registerSubsystem(name string, maxSilent time.Duration) {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	subsystems[name] = &subsystemState{time.Now(), maxSilent}
+}
+
+func subsystemAlive(name string) {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	if s, ok := subsystems[name]; ok {
+		s.lastAlive = time.Now()
+	}
+}
+
+func getSubsystemHealth() []SubsystemHealth {
+	subsystemsMutex.Lock()
+	defer subsystemsMutex.Unlock()
+	health := make([]SubsystemHealth, 0, len(subsystems))
+	for name, s := range subsystems {
+		silent := time.Since(s.lastAlive)
+		health = append(health, SubsystemHealth{name, silent <= s.maxSilent, silent.Seconds(), s.maxSilent.Seconds()})
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
+
+// Throttling flags of the firmware: sysfs on newer kernels, vcgencmd otherwise. 0 if neither is available.
+func readThrottled() uint32 {
+	var s string
+	if data, err := ioutil.ReadFile("/sys/devices/platform/soc/soc:firmware/get_throttled"); err == nil {
+		s = strings.TrimSpace(string(data))
+	} else if out, err := exec.Command("vcgencmd", "get_throttled").Output(); err == nil {
+		// throttled=0x50005
+		s = strings.TrimPrefix(strings.TrimSpace(string(out)), "throttled=")
+	}
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 32)
+	if err != nil {
+		return 0
+	}
+	return uint32(v)
+}
+
+func throttledNames(throttled uint32) ([]string, []string) {
+	now, before := make([]string, 0), make([]string, 0)
+	for _, f := range throttledFlags {
+		if throttled&f.now != 0 {
+			now = append(now, f.name)
+		}
+		if throttled&f.before != 0 {
+			before = append(before, f.name)
+		}
+	}
+	return now, before
+}
+
+// MemTotal and MemAvailable of /proc/meminfo in bytes.
+func readMemInfo() (uint64, uint64) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0
+	}
+	var total, available uint64
+	for _, line := range strings.Split(string(data), "\n") {
+		// MemTotal:        3884376 kB
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, _ := strconv.ParseUint(fields[1], 10, 64)
+		switch fields[0] {
+		case "MemTotal:":
+			total = v * 1024
+		case "MemAvailable:":
+			available = v * 1024
+		}
+	}
+	return total, available
+}
+
+func readLoadAvg() [3]float64 {
+	var load [3]float64
+	data, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return load
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < 3 && i < len(fields); i++ {
+		load[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+	return load
+}
+
+// Bytes written to the SD card since boot, and its wear level in percent (-1 if it doesn't report it).
+func readSDCardWear() (uint64, int) {
+	var written uint64
+	// Field 7 of the block device stat: sectors written, 512 bytes each
+	if data, err := ioutil.ReadFile("/sys/block/" + SD_DEVICE + "/stat"); err == nil {
+		if fields := strings.Fields(string(data)); len(fields) > 6 {
+			sectors, _ := strconv.ParseUint(fields[6], 10, 64)
+			written = sectors * 512
+		}
+	}
+	wear := -1
+	// eMMC: "0x01 0x02", estimated life time used of the two memory types in steps of 10%
+	if data, err := ioutil.ReadFile("/sys/block/" + SD_DEVICE + "/device/life_time"); err == nil {
+		for _, f := range strings.Fields(string(data)) {
+			if v, err := strconv.ParseUint(strings.TrimPrefix(f, "0x"), 16, 8); err == nil && v >= 1 && v <= 11 {
+				if pct := int(v-1) * 10; pct > wear {
+					wear = pct
+				}
+			}
+		}
+	}
+	return written, wear
+}
+
+func readSysfsString(dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func getUSBDevices() []USBDevice {
+	devices := make([]USBDevice, 0)
+	dirs, _ := filepath.Glob("/sys/bus/usb/devices/*")
+	for _, dir := range dirs {
+		vendor := readSysfsString(dir, "idVendor")
+		// Interfaces (1-1.3:1.0) don't have one. Root hubs (usb1) are listed as well
+		if len(vendor) == 0 {
+			continue
+		}
+		devices = append(devices, USBDevice{
+			Bus:          filepath.Base(dir),
+			VendorID:     vendor,
+			ProductID:    readSysfsString(dir, "idProduct"),
+			Manufacturer: readSysfsString(dir, "manufacturer"),
+			Product:      readSysfsString(dir, "product"),
+			Speed:        readSysfsString(dir, "speed"),
+		})
+	}
+	return devices
+}
+
+func getSystemHealth(withHistory bool) SystemHealth {
+	var memstats runtime.MemStats
+	runtime.ReadMemStats(&memstats)
+	usage := du.NewDiskUsage("/")
+	health := SystemHealth{
+		Time:           time.Now().UTC(),
+		CPUTemp:        globalStatus.CPUTemp,
+		CPUTempMin:     globalStatus.CPUTempMin,
+		CPUTempMax:     globalStatus.CPUTempMax,
+		CPULoad:        readLoadAvg(),
+		CPUCount:       runtime.NumCPU(),
+		HeapAlloc:      memstats.HeapAlloc,
+		Goroutines:     runtime.NumGoroutine(),
+		Throttled:      readThrottled(),
+		DiskBytesTotal: usage.Size(),
+		DiskBytesFree:  usage.Free(),
+		USBDevices:     getUSBDevices(),
+		Subsystems:     getSubsystemHealth(),
+		Fan:            getFanStatus(),
+		PowerDegraded:  isPowerDegraded(),
+		PowerEvents:    getPowerEvents(),
+	}
+	health.MemTotal, health.MemAvailable = readMemInfo()
+	health.ThrottledNow, health.ThrottledBefore = throttledNames(health.Throttled)
+	health.SDBytesWritten, health.SDWearPct = readSDCardWear()
+	if withHistory {
+		healthMutex.Lock()
+		health.History = append([]SystemHealthSample{}, healthHistory...)
+		healthMutex.Unlock()
+	}
+	return health
+}
+
+// Samples the health every HEALTH_INTERVAL into the history. Undervoltage is watched by undervoltageMonitor().
+func systemHealthMonitor() {
+	registerSubsystem("systemhealth", 3*HEALTH_INTERVAL)
+	ticker := time.NewTicker(HEALTH_INTERVAL)
+	for {
+		subsystemAlive("systemhealth")
+		load := readLoadAvg()
+		total, available := readMemInfo()
+		sample := SystemHealthSample{
+			Time:          time.Now().UTC(),
+			CPUTemp:       globalStatus.CPUTemp,
+			CPULoad:       load[0],
+			Throttled:     readThrottled(),
+			DiskBytesFree: globalStatus.DiskBytesFree,
+		}
+		if total > 0 {
+			sample.MemUsedPct = float64(total-available) / float64(total) * 100
+		}
+		healthMutex.Lock()
+		healthHistory = append(healthHistory, sample)
+		if len(healthHistory) > HEALTH_HISTORY {
+			healthHistory = healthHistory[len(healthHistory)-HEALTH_HISTORY:]
+		}
+		healthMutex.Unlock()
+
+		updateFanStatus()
+		<-ticker.C
+	}
+}
+
+// AJAX call - /status/system. ?history=1 includes the samples of the last hour.
+func handleSystemHealthRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	healthJSON, err := json.Marshal(getSystemHealth(r.URL.Query().Get("history") == "1"))
+	if err != nil {
+		logErrorf("health", "Error sending system health JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", healthJSON)
+}
@@ -0,0 +1,98 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	systime.go: Keep track of where the system time came from (RTC, NTP, GPS), and step
+		the system clock from GPS time if it isn't synchronized by NTP.
+*/
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	TIME_SOURCE_NONE = ""
+	TIME_SOURCE_RTC  = "RTC"
+	TIME_SOURCE_NTP  = "NTP"
+	TIME_SOURCE_GPS  = "GPS"
+
+	adjtimexStaUnsync = 0x0040 // STA_UNSYNC from linux/timex.h
+	adjtimexTimeError = 5      // TIME_ERROR return value of adjtimex()
+)
+
+// Last GPS time seen, used to cross-check consecutive GPS times before stepping the clock.
+var lastGPSTimeSample time.Time
+var lastGPSTimeSampleStratuxTime time.Time
+
+// Returns true if the kernel clock is currently disciplined by an NTP daemon (systemd-timesyncd, ntpd, chrony).
+func isNTPSynchronized() bool {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false
+	}
+	return state != adjtimexTimeError && tx.Status&adjtimexStaUnsync == 0
+}
+
+/*
+	setSystemTimeFromGPS().
+		Called for every valid GPS date/time. Steps the system clock to GPS time if it is off by more than 300ms
+		and NTP is not synchronized. To protect against single corrupt sentences, the clock is only set if two
+		consecutive GPS times agree with the stratuxClock time elapsed between them.
+*/
+func setSystemTimeFromGPS(gpsTime time.Time) {
+	prevGPSTime := lastGPSTimeSample
+	prevStratuxTime := lastGPSTimeSampleStratuxTime
+	lastGPSTimeSample = gpsTime
+	lastGPSTimeSampleStratuxTime = stratuxClock.Time
+
+	if isNTPSynchronized() {
+		globalStatus.SystemTimeSource = TIME_SOURCE_NTP
+		return
+	}
+	if prevGPSTime.IsZero() {
+		return
+	}
+	drift := gpsTime.Sub(prevGPSTime.Add(stratuxClock.Since(prevStratuxTime)))
+	if drift > time.Second || drift < -time.Second {
+		logInfof("systime", "GPS time %s inconsistent with previous GPS time (%s off), not setting system time", gpsTime.Format("20060102 15:04:05.000"), drift.String())
+		return
+	}
+
+	if time.Since(gpsTime) > 300*time.Millisecond || time.Since(gpsTime) < -300*time.Millisecond {
+		setStr := gpsTime.Format("20060102 15:04:05.000") + " UTC"
+		logInfof("systime", "setting system time from %s to: '%s'", time.Now().Format("20060102 15:04:05.000"), setStr)
+		if err := exec.Command("date", "-s", setStr).Run(); err != nil {
+			logErrorf("systime", "Set Date failure: %s error", err)
+			return
+		}
+		logInfof("systime", "Time set from GPS. Current time is %v", time.Now())
+	}
+	globalStatus.SystemTimeSource = TIME_SOURCE_GPS
+}
+
+// Determines the initial time source and keeps watching for NTP synchronization, e.g. when an internet uplink becomes available.
+func systemTimeWatcher() {
+	if isNTPSynchronized() {
+		globalStatus.SystemTimeSource = TIME_SOURCE_NTP
+	} else if _, err := os.Stat("/dev/rtc0"); err == nil {
+		globalStatus.SystemTimeSource = TIME_SOURCE_RTC
+	}
+	logInfof("systime", "Initial system time source: '%s'", globalStatus.SystemTimeSource)
+
+	ticker := time.NewTicker(30 * time.Second)
+	for {
+		<-ticker.C
+		if isNTPSynchronized() && globalStatus.SystemTimeSource != TIME_SOURCE_NTP {
+			logInfof("systime", "System time is now synchronized by NTP")
+			globalStatus.SystemTimeSource = TIME_SOURCE_NTP
+		}
+	}
+}
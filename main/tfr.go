@@ -0,0 +1,460 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	tfr.go: FIS-B NOTAMs (product 8: TFR, NOTAM-D and FDC) with their graphical shapes, and TFR penetration alerts.
+		The text and the graphics of a NOTAM are uplinked separately (see uatparse/overlay.go) and merged here by
+		location, report number and year. NOTAMs are dropped when cancelled or not received for NOTAM_MAX_AGE.
+		Polygons are uplinked once per altitude (bottom and top), the records of a shape with the same vertices are
+		merged into one shape from the lowest to the highest altitude. A polygon with one altitude only extends from
+		the surface. AGL altitudes can't be resolved without terrain data: AGL shapes extend from the surface to
+		their top plus TFR_AGL_TERRAIN.
+		Every second the current position and the position projected along the track up to TFR_LOOKAHEAD ahead are
+		checked against the active TFRs (NOTAMs of type TFR or with a shape). Changes of the alert level are
+		published on the /tfralerts websocket and announced by the audio output. While an alert is active, the
+		non-standard GDL90 message 0xCD (see makeTFRAlertMessage()) is sent every second. /getNotams returns all
+		NOTAMs and the current alert.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+	"github.com/b3nn0/stratux/uatparse"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	TFR_ALERT_NONE   = 0
+	TFR_ALERT_AHEAD  = 1 // projected track enters a TFR within TFR_LOOKAHEAD
+	TFR_ALERT_INSIDE = 2
+
+	NOTAM_MAX_AGE      = 60 * time.Minute // not received for this long: dropped
+	NOTAM_MAX_SHAPES   = 32
+	TFR_LOOKAHEAD      = 120.0 // s
+	TFR_LOOKAHEAD_STEP = 10.0  // s
+	TFR_MIN_SPEED      = 30.0  // kt, no projection below
+	TFR_AGL_TERRAIN    = 5000  // ft added to AGL tops
+)
+
+type NotamShape struct {
+	Label     string
+	Geometry  uint8               // uatparse.OVERLAY_*
+	Points    []uatparse.GeoPoint // polygon/polyline vertices, circle center
+	Radius    float64             // nm, circles
+	AltBottom int32               // ft
+	AltTop    int32               // ft
+	AGL       bool
+	Start     time.Time // zero if not given
+	End       time.Time
+}
+
+type Notam struct {
+	Location     string
+	ReportNumber uint16
+	ReportYear   uint16
+	Type         string // "TFR", "D", "FDC", "" if only the graphics were received yet
+	Text         string
+	Shapes       []NotamShape
+	Active       bool // TFR and active now, set in /getNotams
+	Received     time.Time
+	lastSeen     time.Time // stratuxClock
+}
+
+// Published on the /tfralerts websocket when the alert level changes.
+type TFRAlert struct {
+	Level     uint8 // TFR_ALERT_*
+	PrevLevel uint8
+	Notam     string // key of the NOTAM, "" if none
+	Text      string
+	Seconds   int   // to entry, 0 if inside
+	AltBottom int32 // ft, of the entered shape
+	AltTop    int32
+	Timestamp time.Time
+}
+
+// Response of /getNotams.
+type NotamStatus struct {
+	Notams []*Notam
+	Alert  TFRAlert
+}
+
+var notams = make(map[string]*Notam)
+var notamsMutex = &sync.Mutex{}
+var tfrAlert TFRAlert
+var tfrAlertUpdate *uibroadcaster
+
+func notamKey(location string, number, year uint16) string {
+	return fmt.Sprintf("%s %d/%d", strings.TrimSpace(location), number, year)
+}
+
+// NOTAM type from the text ("NOTAM-TFR ...", "NOTAM-D ...", "NOTAM-FDC ...").
+func notamType(text string) string {
+	fields := strings.Fields(text)
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "NOTAM-") {
+		return strings.TrimPrefix(fields[0], "NOTAM-")
+	}
+	if strings.Contains(text, " TFR") || strings.Contains(text, "91.1") {
+		return "TFR"
+	}
+	return "D"
+}
+
+// Applicability of an overlay record ("MM-DD HH:MM", "DD HH:MM" or "HH:MM", UTC) closest to now.
+func parseNotamTime(s string, now time.Time) time.Time {
+	var month, day, hour, min int
+	if n, _ := fmt.Sscanf(s, "%d-%d %d:%d", &month, &day, &hour, &min); n == 4 {
+		best := time.Time{}
+		for _, y := range []int{-1, 0, 1} {
+			t := time.Date(now.Year()+y, time.Month(month), day, hour, min, 0, 0, time.UTC)
+			if best.IsZero() || math.Abs(t.Sub(now).Hours()) < math.Abs(best.Sub(now).Hours()) {
+				best = t
+			}
+		}
+		return best
+	}
+	if n, _ := fmt.Sscanf(s, "%d %d:%d", &day, &hour, &min); n == 3 {
+		return wxDayTime(day, hour, min, now)
+	}
+	if n, _ := fmt.Sscanf(s, "%d:%d", &hour, &min); n == 2 {
+		return fisbTimeOfDay(hour, min, now)
+	}
+	return time.Time{}
+}
+
+// Time of day (UTC) closest to now.
+func fisbTimeOfDay(hour, min int, now time.Time) time.Time {
+	t := time.Date(now.Year(), now.Month(), now.Day(), hour, min, 0, 0, time.UTC)
+	if t.Sub(now) > 12*time.Hour {
+		t = t.AddDate(0, 0, -1)
+	} else if now.Sub(t) > 12*time.Hour {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+func makeNotamShape(r *uatparse.FISBRecord, now time.Time) (NotamShape, bool) {
+	s := NotamShape{Label: r.Label, Geometry: r.Geometry, Points: r.Points, AGL: r.IsAGL()}
+	switch r.Geometry {
+	case uatparse.OVERLAY_POLYGON_MSL, uatparse.OVERLAY_POLYGON_AGL, uatparse.OVERLAY_POLYLINE_MSL, uatparse.OVERLAY_POLYLINE_AGL:
+		s.AltBottom, s.AltTop = math.MaxInt32, math.MinInt32
+		for _, p := range r.Points {
+			if p.Alt < s.AltBottom {
+				s.AltBottom = p.Alt
+			}
+			if p.Alt > s.AltTop {
+				s.AltTop = p.Alt
+			}
+		}
+	case uatparse.OVERLAY_PRISM_MSL, uatparse.OVERLAY_PRISM_AGL:
+		s.AltBottom, s.AltTop = r.AltBottom, r.AltTop
+	default:
+		return s, false
+	}
+	if len(r.Start) > 0 {
+		s.Start = parseNotamTime(r.Start, now)
+	}
+	if len(r.End) > 0 {
+		s.End = parseNotamTime(r.End, now)
+	}
+	return s, len(s.Points) > 0
+}
+
+func sameNotamShapeOutline(a, b *NotamShape) bool {
+	if a.Label != b.Label || a.AGL != b.AGL || a.Radius != b.Radius || len(a.Points) != len(b.Points) {
+		return false
+	}
+	for i := range a.Points {
+		if math.Abs(a.Points[i].Lat-b.Points[i].Lat) > 1e-6 || math.Abs(a.Points[i].Lon-b.Points[i].Lon) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds a shape or merges it into the shape with the same outline. Also used for AIRMETs/SIGMETs (wxadvisories.go).
+func addNotamShape(shapes []NotamShape, s NotamShape) []NotamShape {
+	for i := range shapes {
+		old := &shapes[i]
+		if old.Geometry != s.Geometry || !sameNotamShapeOutline(old, &s) {
+			continue
+		}
+		if s.AltBottom < old.AltBottom {
+			old.AltBottom = s.AltBottom
+		}
+		if s.AltTop > old.AltTop {
+			old.AltTop = s.AltTop
+		}
+		old.Start, old.End = s.Start, s.End
+		return shapes
+	}
+	if len(shapes) < NOTAM_MAX_SHAPES {
+		shapes = append(shapes, s)
+	}
+	return shapes
+}
+
+// Called for every decoded FIS-B frame from parseInput().
+func updateNotams(f *uatparse.UATFrame) {
+	if f.Product_id != 8 || len(f.Records) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	notamsMutex.Lock()
+	defer notamsMutex.Unlock()
+	for i := range f.Records {
+		r := &f.Records[i]
+		key := notamKey(f.LocationIdentifier, r.ReportNumber, r.ReportYear)
+		if r.Format == uatparse.OVERLAY_RECORD_TEXT && r.Cancelled {
+			delete(notams, key)
+			continue
+		}
+		n, ok := notams[key]
+		if !ok {
+			n = &Notam{Location: strings.TrimSpace(f.LocationIdentifier), ReportNumber: r.ReportNumber, ReportYear: r.ReportYear}
+			notams[key] = n
+		}
+		n.Received = now
+		n.lastSeen = stratuxClock.Time
+		switch r.Format {
+		case uatparse.OVERLAY_RECORD_TEXT:
+			n.Text = strings.TrimSpace(r.Text)
+			n.Type = notamType(n.Text)
+		case uatparse.OVERLAY_RECORD_GRAPHICAL:
+			if s, ok := makeNotamShape(r, now); ok {
+				n.Shapes = addNotamShape(n.Shapes, s)
+			}
+		}
+	}
+
+	for key, n := range notams {
+		if stratuxClock.Since(n.lastSeen) > NOTAM_MAX_AGE {
+			delete(notams, key)
+		}
+	}
+}
+
+func isTFR(n *Notam) bool {
+	return n.Type == "TFR" || len(n.Shapes) > 0
+}
+
+func isNotamShapeActive(s *NotamShape, now time.Time) bool {
+	return (s.Start.IsZero() || !now.Before(s.Start)) && (s.End.IsZero() || now.Before(s.End))
+}
+
+// Point in polygon (ray casting, the edges as straight lines in lat/lng).
+func notamPolygonContains(points []uatparse.GeoPoint, lat, lng float64) bool {
+	inside := false
+	for i, j := 0, len(points)-1; i < len(points); j, i = i, i+1 {
+		a, b := points[i], points[j]
+		if (a.Lat > lat) != (b.Lat > lat) && lng < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Whether a position (alt in ft MSL) is inside a shape.
+func notamShapeContains(s *NotamShape, lat, lng, alt float64) bool {
+	bottom, top := float64(s.AltBottom), float64(s.AltTop)
+	if s.AGL {
+		bottom, top = 0, top+TFR_AGL_TERRAIN
+	} else if bottom == top {
+		bottom = 0
+	}
+	if alt < bottom || alt > top {
+		return false
+	}
+	switch s.Geometry {
+	case uatparse.OVERLAY_POLYGON_MSL, uatparse.OVERLAY_POLYGON_AGL:
+		return len(s.Points) >= 3 && notamPolygonContains(s.Points, lat, lng)
+	case uatparse.OVERLAY_PRISM_MSL, uatparse.OVERLAY_PRISM_AGL:
+		dist, _ := common.Distance(lat, lng, s.Points[0].Lat, s.Points[0].Lon)
+		return dist/1852 <= s.Radius
+	}
+	return false
+}
+
+// Most severe alert for ownship's position and projected track. Requires notamsMutex.
+func computeTFRAlert() TFRAlert {
+	alert := TFRAlert{Level: TFR_ALERT_NONE}
+	if !isGPSValid() || len(notams) == 0 {
+		return alert
+	}
+	now := time.Now().UTC()
+	lat, lng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+	alt := float64(mySituation.GPSAltitudeMSL)
+	lookahead := 0.0
+	if mySituation.GPSGroundSpeed >= TFR_MIN_SPEED {
+		lookahead = TFR_LOOKAHEAD
+	}
+	for t := 0.0; t <= lookahead; t += TFR_LOOKAHEAD_STEP {
+		pLat, pLng := lat, lng
+		if t > 0 {
+			pLat, pLng = calcLocationForBearingDistance(lat, lng, float64(mySituation.GPSTrueCourse), mySituation.GPSGroundSpeed*t/3600)
+		}
+		pAlt := alt + float64(mySituation.GPSVerticalSpeed)*t
+		for key, n := range notams {
+			if !isTFR(n) {
+				continue
+			}
+			for i := range n.Shapes {
+				s := &n.Shapes[i]
+				if !isNotamShapeActive(s, now) || !notamShapeContains(s, pLat, pLng, pAlt) {
+					continue
+				}
+				alert.Level = TFR_ALERT_AHEAD
+				if t == 0 {
+					alert.Level = TFR_ALERT_INSIDE
+				}
+				alert.Notam, alert.Text, alert.Seconds = key, n.Text, int(t)
+				alert.AltBottom, alert.AltTop = s.AltBottom, s.AltTop
+				return alert
+			}
+		}
+	}
+	return alert
+}
+
+/*
+makeTFRAlertMessage().
+
+	Non-standard GDL90 message 0xCD, "Stratux TFR alert":
+	Byte 1:      message version (1).
+	Byte 2:      alert level (0 = none, 1 = projected track enters a TFR, 2 = inside a TFR).
+	Bytes 3-4:   seconds to entry.
+	Bytes 5-8:   location identifier of the NOTAM, ASCII, space padded.
+	Bytes 9-10:  report number.
+	Byte 11:     report year.
+	Bytes 12-13: bottom of the shape, 100 ft.
+	Bytes 14-15: top of the shape, 100 ft.
+*/
+func makeTFRAlertMessage(a TFRAlert, n *Notam) []byte {
+	msg := make([]byte, 16)
+	msg[0] = 0xCD
+	msg[1] = 1
+	msg[2] = a.Level
+	msg[3] = byte(a.Seconds >> 8)
+	msg[4] = byte(a.Seconds)
+	copy(msg[5:9], "    ")
+	if n != nil {
+		copy(msg[5:9], n.Location)
+		msg[9] = byte(n.ReportNumber >> 8)
+		msg[10] = byte(n.ReportNumber)
+		msg[11] = byte(n.ReportYear)
+	}
+	msg[12] = byte(uint16(a.AltBottom/100) >> 8)
+	msg[13] = byte(a.AltBottom / 100)
+	msg[14] = byte(uint16(a.AltTop/100) >> 8)
+	msg[15] = byte(a.AltTop / 100)
+	return prepareMessage(msg)
+}
+
+func announceTFRAlert(level uint8) {
+	if !globalSettings.AudioAlerts || gpioSwitchClosed(globalSettings.AudioMutePin) {
+		return
+	}
+	if level == TFR_ALERT_INSIDE {
+		playAnnouncement("inside restricted airspace", TRAFFIC_ALERT_WARNING)
+	} else {
+		playAnnouncement("restricted airspace ahead", TRAFFIC_ALERT_CAUTION)
+	}
+}
+
+// Called every second from heartBeatSender().
+func updateTFRAlerts() {
+	notamsMutex.Lock()
+	alert := computeTFRAlert()
+	prev := tfrAlert
+	if alert.Level != prev.Level || alert.Notam != prev.Notam {
+		alert.PrevLevel = prev.Level
+		alert.Timestamp = time.Now()
+		if alert.Level > TFR_ALERT_NONE {
+			logInfof("tfr", "TFR alert: %s, level %d", alert.Notam, alert.Level)
+		}
+		tfrAlertUpdate.SendJSON(alert)
+		if alert.Level > prev.Level {
+			go announceTFRAlert(alert.Level)
+		}
+	} else {
+		alert.PrevLevel, alert.Timestamp = prev.PrevLevel, prev.Timestamp
+	}
+	tfrAlert = alert
+	var msg []byte
+	if alert.Level > TFR_ALERT_NONE || prev.Level > TFR_ALERT_NONE { // also sent once when the alert ends
+		msg = makeTFRAlertMessage(alert, notams[alert.Notam])
+	}
+	notamsMutex.Unlock()
+
+	if msg != nil {
+		sendGDL90(msg, time.Second, MSGPRIO_STATUS)
+	}
+}
+
+// AJAX call - /getNotams?type=<TFR|D|FDC>. All NOTAMs (of the type) and the current TFR alert.
+func handleNotamsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	typ := strings.ToUpper(r.URL.Query().Get("type"))
+	now := time.Now().UTC()
+	status := NotamStatus{Notams: make([]*Notam, 0)}
+	notamsMutex.Lock()
+	status.Alert = tfrAlert
+	for _, n := range notams {
+		if len(typ) > 0 && n.Type != typ && !(typ == "TFR" && isTFR(n)) {
+			continue
+		}
+		c := *n
+		c.Active = isTFR(n) && len(c.Shapes) == 0
+		for i := range c.Shapes {
+			c.Active = c.Active || isNotamShapeActive(&c.Shapes[i], now)
+		}
+		status.Notams = append(status.Notams, &c)
+	}
+	notamsMutex.Unlock()
+	sort.Slice(status.Notams, func(i, j int) bool {
+		return notamKey(status.Notams[i].Location, status.Notams[i].ReportNumber, status.Notams[i].ReportYear) <
+			notamKey(status.Notams[j].Location, status.Notams[j].ReportNumber, status.Notams[j].ReportYear)
+	})
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("tfr", "Error sending NOTAM JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+/*
+The /tfralerts websocket sends the current TFR alert, then every change.
+*/
+func handleTFRAlertsWS(conn *websocket.Conn) {
+	notamsMutex.Lock()
+	alertJSON, _ := json.Marshal(&tfrAlert)
+	conn.Write(alertJSON)
+	tfrAlertUpdate.AddSocket(conn)
+	notamsMutex.Unlock()
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
+	for {
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if buf[0] != 0 { // Dummy.
+			continue
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
@@ -14,7 +14,6 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
 	"math"
 	"net"
 	"strconv"
@@ -132,6 +131,28 @@ type TrafficInfo struct {
 	DistanceEstimatedLastTs time.Time // Used to compute moving average
 	ReceivedMsgs         uint64    // Number of messages received by this aircraft
 	IsStratux            bool      // Target is equipped with a Stratux that transmits via OGN tracker
+	ThreatScore          float64   // Label declutter hints, see declutter.go
+	LabelPriority        int
+	LabelShow            bool
+	LabelAngle           int
+	RelativeAlt          int32     // Vertical trend relative to ownship, see verticaltrend.go. ft, target minus ownship altitude
+	RelativeVvel         int16     // ft/min, target minus ownship vertical speed
+	CoAltitudeIn         int       // seconds until the target is co-altitude (0 = now), -1 if it won't be within 2 minutes
+	VerticalTrend_valid  bool
+	CPATime              float64   // s to the closest point of approach, 0 if not converging. See trafficalerts.go
+	CPADistance          float64   // m, horizontal distance at the closest point of approach
+	AlertLevel           uint8     // TRAFFIC_ALERT_*
+	Duplicate            bool      // same aircraft as DuplicateOf, which is received from a better source. Not sent out. See trafficcorrelation.go
+	DuplicateOf          uint32    // traffic key of the primary target
+	OwnshipShadow        bool      // TIS-B/ADS-R rebroadcast of ourselves, ignored like ownship. See ownshipfilter.go
+	Symbol               string    // symbology hint from the emitter category, e.g. "glider" or "uav". See emittercategory.go
+	Hidden               bool      // suppressed by a category rule, not sent to the EFB outputs
+	Highlight            bool      // highlighted by a category rule, traffic alert bit set
+	categoryAlert        bool
+	correlationKey       uint32
+	correlationHits      int
+	correlationMisses    int
+	noTrack              bool      // OGN DDB "tracked": "N", not logged. See ognddb.go
 	//FIXME: Rename variables for consistency, especially "Last_".
 }
 
@@ -180,10 +201,34 @@ func convertMetersToFeet(meters float32) float32 {
 	return meters / 0.3048
 }
 
+// Seconds a target of the given source is shown without update if it isn't coasted.
+func trafficTimeout(source uint8) float64 {
+	switch source {
+	case TRAFFIC_SOURCE_1090ES:
+		return float64(globalSettings.ES_TrafficTimeout)
+	case TRAFFIC_SOURCE_UAT:
+		return float64(globalSettings.UAT_TrafficTimeout)
+	case TRAFFIC_SOURCE_OGN:
+		return float64(globalSettings.OGN_TrafficTimeout)
+	}
+	return 6
+}
+
+// Target is recent enough to be sent to the EFBs: dead-reckoned during the coast period, otherwise until the
+// timeout of its source.
+func isTrafficCurrent(ti *TrafficInfo, age float64) bool {
+	if ti.ExtrapolatedPosition {
+		return ti.AgeExtrapolation < 2 && age < float64(globalSettings.TrafficCoastTime)
+	}
+	return age < trafficTimeout(ti.Last_source)
+}
+
 func cleanupOldEntries() {
+	keep := math.Max(60, math.Max(float64(globalSettings.TrafficCoastTime), trafficTimeout(TRAFFIC_SOURCE_1090ES)))
+	keep = math.Max(keep, math.Max(trafficTimeout(TRAFFIC_SOURCE_UAT), trafficTimeout(TRAFFIC_SOURCE_OGN)))
 	for key, ti := range traffic {
 		
-		if ti.Last_source != TRAFFIC_SOURCE_AIS && stratuxClock.Since(ti.Last_seen).Seconds() > 60 { // keep it in the database for up to 60 seconds, so we don't lose tail number, etc...
+		if ti.Last_source != TRAFFIC_SOURCE_AIS && stratuxClock.Since(ti.Last_seen).Seconds() > keep { // keep it in the database for up to 60 seconds, so we don't lose tail number, etc...
 			delete(traffic, key)
 		}
 
@@ -213,7 +258,7 @@ func removeTarget(id uint32) {
 func isOwnshipTrafficInfo(ti TrafficInfo) (isOwnshipInfo bool, shouldIgnore bool) {
 	// First, check if this is our own OGN tracker
 	
-	if (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_OGNTRACKER {
+	if (globalStatus.GPS_detected_type & 0x0f) == GPS_TYPE_OGNTRACKER || isOgnTrackerDeviceConnected() {
 		ognTrackerCodeInt, _ := strconv.ParseUint(globalSettings.OGNAddr, 16, 32)
 		prevTrackerCodeInt, _ := strconv.ParseUint(globalStatus.OGNPrevRandomAddr, 16, 32)
 		if uint32(ognTrackerCodeInt) == ti.Icao_addr || uint32(prevTrackerCodeInt) == ti.Icao_addr {
@@ -267,13 +312,13 @@ func isOwnshipTrafficInfo(ti TrafficInfo) (isOwnshipInfo bool, shouldIgnore bool
 			// Check if the distance to the ti is plausible
 			maxDistMetersIgnore := (timeDiff * speed * 0.514444 + float64(mySituation.GPSHorizontalAccuracy) + 50) * 2
 			if trafficDist > maxDistMetersIgnore {
-				log.Printf("Skipping ownship %s because it's too far away (%fm, speed=%f, max=%f)", ownCode, trafficDist, speed, maxDistMetersIgnore)
+				logInfof("traffic", "Skipping ownship %s because it's too far away (%fm, speed=%f, max=%f)", ownCode, trafficDist, speed, maxDistMetersIgnore)
 				continue
 			}
 			
 			// If we have a pressure sensor, and the pressure altitude of traffic and ownship is too big, skip...
 			if altDiff > 500 {
-				log.Printf("Skipping ownship %s because the altitude is off (%f ft)", ownCode, altDiff)
+				logInfof("traffic", "Skipping ownship %s because the altitude is off (%f ft)", ownCode, altDiff)
 				continue
 			}
 
@@ -284,7 +329,7 @@ func isOwnshipTrafficInfo(ti TrafficInfo) (isOwnshipInfo bool, shouldIgnore bool
 				isOwnshipInfo = true
 			}
 			if globalSettings.DEBUG {
-				log.Printf("Using ownship %s. MaxDistIgnore: %f, maxDistOwnShip: %f, dist: %f, altDiff: %f, speed: %f, timeDiffS: %f, useForInfo: %t",
+				logDebugf("traffic", "Using ownship %s. MaxDistIgnore: %f, maxDistOwnShip: %f, dist: %f, altDiff: %f, speed: %f, timeDiffS: %f, useForInfo: %t",
 					ownCode, maxDistMetersIgnore, maxDistMetersOwnship, trafficDist, altDiff, speed, timeDiff, isOwnshipInfo)
 			}
 			shouldIgnore = true
@@ -292,6 +337,7 @@ func isOwnshipTrafficInfo(ti TrafficInfo) (isOwnshipInfo bool, shouldIgnore bool
 		}
 	}
 	isOwnshipInfo = false
+	shouldIgnore = isOwnTransponderReply(&ti) // Mode C/S replies of our transponder, see transponder.go
 	return
 }
 
@@ -318,13 +364,18 @@ func sendTrafficUpdates() {
 		currAlt = mySituation.GPSAltitudeMSL
 	}
 
+	correlateTraffic()
+	updateOwnshipShadows()
+	updateTrafficLabelHints()
+	updateTrafficVerticalTrends()
+
 	var bestEstimate TrafficInfo
 	var highestAlarmLevel uint8
 	var highestAlarmTraffic TrafficInfo
 
 	if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
-		log.Printf("List of all aircraft being tracked:\n")
-		log.Printf("==================================================================\n")
+		logDebugf("traffic", "List of all aircraft being tracked:")
+		logDebugf("traffic", "==================================================================")
 	}
 	for key, ti := range traffic { // ForeFlight 7.5 chokes at ~1000-2000 messages depending on iDevice RAM. Practical limit likely around ~500 aircraft without filtering.
 		if isGPSValid() && ti.Position_valid {
@@ -342,13 +393,43 @@ func sendTrafficUpdates() {
 		ti.AgeExtrapolation = stratuxClock.Since(ti.Last_extrapolation).Seconds()
 		ti.AgeLastAlt = stratuxClock.Since(ti.Last_alt).Seconds()
 
-		// Keep non-extrapolated traffic for 6 seconds, but extrapolate for 20
-		isCurrent := (ti.ExtrapolatedPosition && ti.AgeExtrapolation < 2 && ti.Age < 25) || (!ti.ExtrapolatedPosition && ti.Age < 6)
+		// Keep non-extrapolated traffic for the timeout of its source, but extrapolate for the coast time
+		isCurrent := isTrafficCurrent(&ti, ti.Age)
 
 		isOwnshipTi, shouldIgnore := isOwnshipTrafficInfo(ti)
+		if shouldIgnore && isCurrent {
+			dist, altDiff := -1.0, -1.0
+			if ti.BearingDist_valid {
+				dist = ti.Distance
+			}
+			if d, _, ok := ownshipAltDiff(&ti); ok {
+				altDiff = d
+			}
+			recordOwnshipSuppression(key, &ti, ownshipAddressReason(&ti), dist, altDiff)
+		}
+		if ti.OwnshipShadow {
+			shouldIgnore = true
+		}
+
+		if isCurrent && !isOwnshipTi && !shouldIgnore && !ti.Duplicate && !ti.noTrack {
+			updateTrafficEncounter(&ti)
+		}
+		if isCurrent && !isOwnshipTi && !shouldIgnore && !ti.noTrack {
+			updateTrafficContact(&ti) // also duplicates, to compare the sources
+			updateDebriefTraffic(&ti)
+		}
+
+		updateTrafficCategory(&ti)
+		prevAlertLevel := ti.AlertLevel
+		relevant := !isOwnshipTi && !shouldIgnore && !ti.Duplicate && !ti.Hidden
+		updateTrafficAlert(&ti, relevant)
+		updateTrafficCategoryAlert(&ti, relevant)
+		if ti.AlertLevel != prevAlertLevel {
+			publishTrafficAlert(ti, prevAlertLevel)
+		}
 
 		// As bearingless targets, we show the closest estimated traffic that is between +-2000ft
-		if !shouldIgnore && !ti.Position_valid && ti.DistanceEstimated > 0 &&
+		if !shouldIgnore && !ti.Hidden && ti.Age < TRAFFIC_BEARINGLESS_MAX_AGE && !ti.Position_valid && ti.DistanceEstimated > 0 &&
 			(bestEstimate.DistanceEstimated == 0 || ti.DistanceEstimated < bestEstimate.DistanceEstimated) {
 			if ti.Alt != 0 && math.Abs(float64(ti.Alt) - float64(currAlt)) < 2000 {
 				bestEstimate = ti
@@ -359,9 +440,9 @@ func sendTrafficUpdates() {
 		if globalSettings.DEBUG && (stratuxClock.Time.Second()%15) == 0 {
 			s_out, err := json.Marshal(ti)
 			if err != nil {
-				log.Printf("Error generating output: %s\n", err.Error())
+				logDebugf("traffic", "Error generating output: %s", err.Error())
 			} else {
-				log.Printf("%X => %s\n", ti.Icao_addr, string(s_out))
+				logDebugf("traffic", "%X => %s", ti.Icao_addr, string(s_out))
 			}
 			// end of debug block
 		}
@@ -370,7 +451,7 @@ func sendTrafficUpdates() {
 		if ti.Age > 2 { // if nothing polls an inactive ti, it won't push to the webUI, and its Age won't update.
 			trafficUpdate.SendJSON(ti)
 		}
-		if !shouldIgnore && isCurrent {
+		if !shouldIgnore && isCurrent && !ti.Duplicate {
 			if float32(ti.Alt) <= currAlt + float32(globalSettings.RadarLimits) * 1.3 && //take 30% more to see moving outs
 			   float32(ti.Alt) >= currAlt - float32(globalSettings.RadarLimits) * 1.3 && // altitude lower than upper boundary
 			   (!ti.Position_valid || ti.Distance<float64(globalSettings.RadarRange) * 1852.0 * 1.3) {    //allow more so that aircraft moves out
@@ -379,16 +460,22 @@ func sendTrafficUpdates() {
 		}
 		if ti.Position_valid && isCurrent { // ... but don't pass stale data to the EFB.
 			//TODO: Coast old traffic? Need to determine how FF, WingX, etc deal with stale targets.
-			logTraffic(ti) // only add to the SQLite log if it's not stale
+			if !ti.noTrack { // owner opted out of tracking in the OGN DDB
+				logTraffic(ti) // only add to the SQLite log if it's not stale
+			}
+
+			if !isOwnshipTi && !shouldIgnore && !ti.Duplicate && !ti.Hidden {
+				sendSurveillanceOutputs(ti, key)
+			}
 
 			if isOwnshipTi {
 				if globalSettings.DEBUG {
-					log.Printf("Ownship target detected for code %X\n", ti.Icao_addr)
+					logDebugf("traffic", "Ownship target detected for code %X", ti.Icao_addr)
 				}
 				OwnshipTrafficInfo = ti
-			} else if !shouldIgnore {
+			} else if !shouldIgnore && !ti.Duplicate && !ti.Hidden && (ti.Highlight || !isTrafficOverLimit(&ti)) {
 				priority := computeTrafficPriority(&ti)
-				sendGDL90(makeTrafficReportMsg(ti), time.Second, priority)
+				sendTrafficMsg(makeTrafficReportMsg(ti), NETWORK_GDL90_STANDARD, time.Second, priority, &ti)
 				thisMsgFLARM, validFLARM, alarmLevel := makeFlarmPFLAAString(ti)
 				if alarmLevel > highestAlarmLevel {
 					highestAlarmLevel = alarmLevel
@@ -403,9 +490,9 @@ func sendTrafficUpdates() {
 				}
 
 				// send traffic message to X-Plane
-				sendXPlane(createXPlaneTrafficMsg(ti.Icao_addr, ti.Lat, ti.Lng, ti.Alt, uint32(ti.Speed), int32(ti.Vvel), ti.OnGround, uint32(ti.Track), trafficCallsign), 1000, priority)
+				sendTrafficMsg(createXPlaneTrafficMsg(ti.Icao_addr, ti.Lat, ti.Lng, ti.Alt, uint32(ti.Speed), int32(ti.Vvel), ti.OnGround, uint32(ti.Track), trafficCallsign), NETWORK_POSITION_FFSIM, 1000, priority, &ti)
 				if validFLARM {
-					sendNetFLARM(thisMsgFLARM, time.Second, priority)
+					sendTrafficMsg([]byte(thisMsgFLARM), NETWORK_FLARM_NMEA, time.Second, priority, &ti)
 				}
 			}
 		}
@@ -421,34 +508,68 @@ func sendTrafficUpdates() {
 					fakeMsg = append(fakeMsg, makeTrafficReportMsg(ti)...)
 				}
 				prio := computeTrafficPriority(&fakeTargets[0])
-				sendGDL90(fakeMsg, time.Second, prio)
+				sendTrafficMsg(fakeMsg, NETWORK_GDL90_STANDARD, time.Second, prio, &bestEstimate)
 			}
 			prio := computeTrafficPriority(&bestEstimate)
-			msg, valid, _ := makeFlarmPFLAAString(bestEstimate)
+			msg, valid, alarmLevel := makeFlarmPFLAAString(bestEstimate)
 			if valid { 
-				sendNetFLARM(msg, time.Second, prio)
+				sendTrafficMsg([]byte(msg), NETWORK_FLARM_NMEA, time.Second, prio, &bestEstimate)
+			}
+			// A close bearingless target is as much of a threat as one we know the position of
+			if alarmLevel > highestAlarmLevel {
+				highestAlarmLevel = alarmLevel
+				highestAlarmTraffic = bestEstimate
 			}
 		}
+		if !globalSettings.EstimateBearinglessDist {
+			sendTrafficMsg(makeBearinglessTrafficReportMsg(bestEstimate), NETWORK_GDL90_STANDARD, time.Second, computeTrafficPriority(&bestEstimate), &bestEstimate)
+		}
 	}
 
 	msgPFLAU := makeFlarmPFLAUString(highestAlarmTraffic)
-	sendNetFLARM(msgPFLAU, time.Second, 0)
+	sendNetFLARM(msgPFLAU, time.Second, MSGPRIO_STATUS)
 }
 
+/*
+	computeTrafficPriority().
+		Queue priority of the messages of a target (lower is more important) from its ThreatScore, so the most
+		threatening targets get through when a client can't take all of them. Critical targets (see
+		isTrafficCritical()) get MSGPRIO_TRAFFIC and are sent even to throttled clients, the others one of
+		MSGPRIO_TRAFFIC_LEVELS levels below it. Targets without position come last. See messagequeue.go.
+*/
 func computeTrafficPriority(ti *TrafficInfo) int32 {
 	if !ti.BearingDist_valid || ti.Alt == 0 {
-		return 9999999
+		return MSGPRIO_TRAFFIC_NOPOS
 	}
-	var myAlt float32
-	if isTempPressValid() {
-		myAlt = mySituation.BaroPressureAltitude
-	} else {
-		myAlt = mySituation.GPSAltitudeMSL
+	if isTrafficCritical(ti) {
+		return MSGPRIO_TRAFFIC
+	}
+	level := 1 + int32((globalSettings.TrafficPrioCritical-ti.ThreatScore)*10)
+	if level >= MSGPRIO_TRAFFIC_LEVELS {
+		level = MSGPRIO_TRAFFIC_LEVELS - 1
 	}
-	altDiff := math.Abs(float64(myAlt) - float64(ti.Alt))
-	// assumes 333ft vertical difference has same priority 1000m horizontal
-	// This will usually produce priorities ranging from around 0-10
-	return int32((altDiff / 3.33 + ti.Distance) / 10000.0)
+	return MSGPRIO_TRAFFIC + level
+}
+
+/*
+	isTrafficCritical().
+		Targets with a ThreatScore of at least globalSettings.TrafficPrioCritical, and targets within
+		globalSettings.TrafficPrioCriticalDist and the altitude band (or ownship altitude unknown), converging or not.
+*/
+func isTrafficCritical(ti *TrafficInfo) bool {
+	if ti.ThreatScore >= globalSettings.TrafficPrioCritical {
+		return true
+	}
+	if !ti.BearingDist_valid || ti.Distance > globalSettings.TrafficPrioCriticalDist*1852.0 {
+		return false
+	}
+	myAlt, myAltValid := threatOwnshipAltitude()
+	return !myAltValid || altitudeBandRelevance(ti, myAlt, myAltValid) >= 1.0
+}
+
+// The target is not among the globalSettings.TrafficMaxTargets most threatening ones (0 = no limit). Critical targets never are.
+func isTrafficOverLimit(ti *TrafficInfo) bool {
+	return globalSettings.TrafficMaxTargets > 0 && ti.LabelPriority > globalSettings.TrafficMaxTargets && !isTrafficCritical(ti)
 }
 
 // Used to tune to our radios. We compare our estimate to real values for ADS-B Traffic.
@@ -549,6 +670,9 @@ func registerTrafficUpdate(ti TrafficInfo) {
 func isTrafficAlertable(ti TrafficInfo) bool {
 	// Set alert bit if possible and traffic is within some threshold
 	// TODO: Could be more intelligent, taking into account headings etc.
+	if ti.Highlight {
+		return true // see emittercategory.go
+	}
 	if !ti.BearingDist_valid {
 		// If not able to calculate the distance to the target, let the alert bit be set always.
 		return true
@@ -561,6 +685,22 @@ func isTrafficAlertable(ti TrafficInfo) bool {
 	return false
 }
 
+/*
+	makeBearinglessTrafficReportMsg().
+		Traffic report for a target without position (Mode S only): GDL90 "no position" convention, lat/lon and
+		NIC/NACp all 0, with altitude. The alert bit is set if the target alerts (see updateTrafficAlert()).
+*/
+func makeBearinglessTrafficReportMsg(ti TrafficInfo) []byte {
+	ti.Lat, ti.Lng = 0, 0
+	ti.NIC, ti.NACp = 0, 0
+	ti.Speed_valid = false
+	msg := makeTrafficReportMsg(ti)
+	if ti.AlertLevel > TRAFFIC_ALERT_NONE {
+		msg[1] |= 0x10
+	}
+	return msg
+}
+
 func makeTrafficReportMsg(ti TrafficInfo) []byte {
 	msg := make([]byte, 28)
 	// See p.16.
@@ -650,10 +790,16 @@ func makeTrafficReportMsg(ti TrafficInfo) []byte {
 	// Position containment / navigational accuracy
 	msg[13] = ((byte(ti.NIC) << 4) & 0xF0) | (byte(ti.NACp) & 0x0F)
 
-	// Horizontal velocity (speed).
-
-	msg[14] = byte((ti.Speed & 0x0FF0) >> 4)
-	msg[15] = byte((ti.Speed & 0x000F) << 4)
+	// Horizontal velocity (speed). 0xFFF = no information available, 0xFFE = 4094kt or more.
+	speed := uint16(0xFFF)
+	if ti.Speed_valid {
+		speed = ti.Speed
+		if speed > 0xFFE {
+			speed = 0xFFE
+		}
+	}
+	msg[14] = byte((speed & 0x0FF0) >> 4)
+	msg[15] = byte((speed & 0x000F) << 4)
 
 	// Vertical velocity.
 	vvel := ti.Vvel / 64 // 64fpm resolution.
@@ -819,7 +965,7 @@ func parseDownlinkReport(s string, signalLevel int) {
 				//opmode_rec_atc_serv = ((frame[26] >> 3) & 0x01) != 0
 			}
 
-			log.Printf("Supplemental UAT Mode Status for %06X: Version = %d; SIL = %d; SDA = %d; NACv = %d; 978 In = %v; 1090 In = %v\n", icao_addr, uat_version, status_sil, status_sda, status_nacv, capability_uat_in, capability_1090_in)
+			logDebugf("traffic", "Supplemental UAT Mode Status for %06X: Version = %d; SIL = %d; SDA = %d; NACv = %d; 978 In = %v; 1090 In = %v", icao_addr, uat_version, status_sil, status_sda, status_nacv, capability_uat_in, capability_1090_in)
 		}
 	}
 
@@ -847,6 +993,9 @@ func parseDownlinkReport(s string, signalLevel int) {
 			ti.TargetType = TARGET_TYPE_ADSR
 		}
 	}
+	if existing, ok := traffic[icao_addr]; ok && isLowerQualityUpdate(&existing, TRAFFIC_SOURCE_UAT, ti.TargetType) {
+		return // e.g. TIS-B/ADS-R of a target we receive directly
+	}
 
 	// This is a hack to show the source of the traffic on moving maps.
 	if globalSettings.DisplayTrafficSource {
@@ -1039,19 +1188,25 @@ func parseDownlinkReport(s string, signalLevel int) {
 }
 
 func esListen() {
+	dump1090Listen("127.0.0.1:30006", func() bool {
+		return globalSettings.ES_Enabled || globalSettings.Ping_Enabled
+	})
+}
+
+// Reads the messages of a dump1090 stratux port while enabled() - also used for the network input, see esinput.go.
+func dump1090Listen(dump1090Addr string, enabled func() bool) {
 	for {
-		if !globalSettings.ES_Enabled && !globalSettings.Ping_Enabled {
+		if !enabled() {
 			time.Sleep(1 * time.Second) // Don't do much unless ES is actually enabled.
 			continue
 		}
-		dump1090Addr := "127.0.0.1:30006"
 		inConn, err := net.Dial("tcp", dump1090Addr)
 		if err != nil { // Local connection failed.
 			time.Sleep(1 * time.Second)
 			continue
 		}
 		rdr := bufio.NewReader(inConn)
-		for globalSettings.ES_Enabled || globalSettings.Ping_Enabled {
+		for enabled() {
 			//log.Printf("ES enabled. Ready to read next message from dump1090\n")
 			buf, err := rdr.ReadString('\n')
 			//log.Printf("String read from dump1090\n")
@@ -1060,324 +1215,335 @@ func esListen() {
 			}
 			buf = strings.Trim(buf, "\r\n")
 
-			// Log the message to the message counter in any case.
-			var thisMsg msg
-			thisMsg.MessageClass = MSGCLASS_ES
-			thisMsg.TimeReceived = stratuxClock.Time
-			thisMsg.Data = buf
-			msgLogAppend(thisMsg)
+			processDump1090Message(buf)
+		}
+		inConn.Close()
+	}
+}
 
-			var eslog esmsg
-			eslog.TimeReceived = stratuxClock.Time
-			eslog.Data = buf
-			logESMsg(eslog) // log raw dump1090:30006 output to SQLite log
+// Processes a message line received from dump1090:30006.
+func processDump1090Message(buf string) {
+	// Log the message to the message counter in any case.
+	var thisMsg msg
+	thisMsg.MessageClass = MSGCLASS_ES
+	thisMsg.TimeReceived = stratuxClock.Time
+	thisMsg.Data = buf
+	msgLogAppend(thisMsg)
+
+	var eslog esmsg
+	eslog.TimeReceived = stratuxClock.Time
+	eslog.Data = buf
+	logESMsg(eslog) // log raw dump1090:30006 output to SQLite log
+
+	var newTi *dump1090Data
+	err := json.Unmarshal([]byte(buf), &newTi)
+	if err != nil {
+		logWarnf("traffic", "can't read ES traffic information from %s: %s", buf, err.Error())
+		return
+	}
 
-			var newTi *dump1090Data
-			err = json.Unmarshal([]byte(buf), &newTi)
-			if err != nil {
-				log.Printf("can't read ES traffic information from %s: %s\n", buf, err.Error())
-				continue
-			}
+	if newTi.Icao_addr == 0x07FFFFFF { // used to signal heartbeat
+		if globalSettings.DEBUG {
+			logDebugf("traffic", "No traffic last 60 seconds. Heartbeat message from dump1090: %s", buf)
+		}
+		return // don't process heartbeat messages
+	}
 
-			if newTi.Icao_addr == 0x07FFFFFF { // used to signal heartbeat
-				if globalSettings.DEBUG {
-					log.Printf("No traffic last 60 seconds. Heartbeat message from dump1090: %s\n", buf)
-				}
-				continue // don't process heartbeat messages
-			}
+	if (newTi.Icao_addr & 0x01000000) != 0 { // bit 25 used by dump1090 to signal non-ICAO address
+		newTi.Icao_addr = newTi.Icao_addr & 0x00FFFFFF
+		if globalSettings.DEBUG {
+			logDebugf("traffic", "Non-ICAO address %X sent by dump1090. This is typical for TIS-B.", newTi.Icao_addr)
+		}
+	}
+	icao := uint32(newTi.Icao_addr)
+	var ti TrafficInfo
 
-			if (newTi.Icao_addr & 0x01000000) != 0 { // bit 25 used by dump1090 to signal non-ICAO address
-				newTi.Icao_addr = newTi.Icao_addr & 0x00FFFFFF
-				if globalSettings.DEBUG {
-					log.Printf("Non-ICAO address %X sent by dump1090. This is typical for TIS-B.\n", newTi.Icao_addr)
-				}
-			}
-			icao := uint32(newTi.Icao_addr)
-			var ti TrafficInfo
+	trafficMutex.Lock()
 
-			trafficMutex.Lock()
+	// Retrieve previous information on this ICAO code.
+	if val, ok := traffic[icao]; ok { // if we've already seen it, copy it in to do updates
+		ti = val
+		//log.Printf("Existing target %X imported for ES update\n", icao)
+	} else {
+		//log.Printf("New target %X created for ES update\n",newTi.Icao_addr)
+		ti.Last_seen = stratuxClock.Time // need to initialize to current stratuxClock so it doesn't get cut before we have a chance to populate a position message
+		ti.Last_alt = stratuxClock.Time  // ditto.
+		ti.Icao_addr = icao
+		ti.ExtrapolatedPosition = false
+		ti.Last_source = TRAFFIC_SOURCE_1090ES
 
-			// Retrieve previous information on this ICAO code.
-			if val, ok := traffic[icao]; ok { // if we've already seen it, copy it in to do updates
-				ti = val
-				//log.Printf("Existing target %X imported for ES update\n", icao)
-			} else {
-				//log.Printf("New target %X created for ES update\n",newTi.Icao_addr)
-				ti.Last_seen = stratuxClock.Time // need to initialize to current stratuxClock so it doesn't get cut before we have a chance to populate a position message
-				ti.Last_alt = stratuxClock.Time  // ditto.
-				ti.Icao_addr = icao
-				ti.ExtrapolatedPosition = false
-				ti.Last_source = TRAFFIC_SOURCE_1090ES
-
-				thisReg, validReg := icao2reg(icao)
-				if validReg {
-					ti.Reg = thisReg
-					ti.Tail = thisReg
-				}
-			}
+		thisReg, validReg := icao2reg(icao)
+		if validReg {
+			ti.Reg = thisReg
+			ti.Tail = thisReg
+		}
+	}
 
-			if newTi.SignalLevel > 0 {
-				power := 10 * math.Log10(newTi.SignalLevel)
-				ti.SignalLevelHist = append(ti.SignalLevelHist, power)
-				if len(ti.SignalLevelHist) > 8 {
-					ti.SignalLevelHist = ti.SignalLevelHist[len(ti.SignalLevelHist)-8:]
-				}
-				ti.SignalLevel = -999
-				for _, level := range(ti.SignalLevelHist) {
-					if level > ti.SignalLevel {
-						ti.SignalLevel = level
-					}
-				}
-			} else {
-				ti.SignalLevel = -999
+	if newTi.SignalLevel > 0 {
+		power := 10 * math.Log10(newTi.SignalLevel)
+		ti.SignalLevelHist = append(ti.SignalLevelHist, power)
+		if len(ti.SignalLevelHist) > 8 {
+			ti.SignalLevelHist = ti.SignalLevelHist[len(ti.SignalLevelHist)-8:]
+		}
+		ti.SignalLevel = -999
+		for _, level := range(ti.SignalLevelHist) {
+			if level > ti.SignalLevel {
+				ti.SignalLevel = level
 			}
+		}
+	} else {
+		ti.SignalLevel = -999
+	}
 
-			// generate human readable summary of message types for debug
-			//TODO: Use for ES message statistics?
-			/*
-				var s1 string
-				if newTi.DF == 17 {
-					s1 = "ADS-B"
-				}
-				if newTi.DF == 18 {
-					s1 = "ADS-R / TIS-B"
-				}
+	// generate human readable summary of message types for debug
+	//TODO: Use for ES message statistics?
+	/*
+		var s1 string
+		if newTi.DF == 17 {
+			s1 = "ADS-B"
+		}
+		if newTi.DF == 18 {
+			s1 = "ADS-R / TIS-B"
+		}
 
-				if newTi.DF == 4 || newTi.DF == 20 {
-					s1 = "Surveillance, Alt. Reply"
-				}
+		if newTi.DF == 4 || newTi.DF == 20 {
+			s1 = "Surveillance, Alt. Reply"
+		}
 
-				if newTi.DF == 5 || newTi.DF == 21 {
-					s1 = "Surveillance, Ident. Reply"
-				}
+		if newTi.DF == 5 || newTi.DF == 21 {
+			s1 = "Surveillance, Ident. Reply"
+		}
 
-				if newTi.DF == 11 {
-					s1 = "All-call Reply"
-				}
+		if newTi.DF == 11 {
+			s1 = "All-call Reply"
+		}
 
-				if newTi.DF == 0 {
-					s1 = "Short Air-Air Surv."
-				}
+		if newTi.DF == 0 {
+			s1 = "Short Air-Air Surv."
+		}
 
-				if newTi.DF == 16 {
-					s1 = "Long Air-Air Surv."
-				}
-			*/
-			//log.Printf("Mode S message from icao=%X, DF=%02d, CA=%02d, TC=%02d (%s)\n", ti.Icao_addr, newTi.DF, newTi.CA, newTi.TypeCode, s1)
+		if newTi.DF == 16 {
+			s1 = "Long Air-Air Surv."
+		}
+	*/
+	//log.Printf("Mode S message from icao=%X, DF=%02d, CA=%02d, TC=%02d (%s)\n", ti.Icao_addr, newTi.DF, newTi.CA, newTi.TypeCode, s1)
 
-			// Altitude will be sent by dump1090 for ES ADS-B/TIS-B (DF=17 and DF=18)
-			// and Mode S messages (DF=0, DF = 4, and DF = 20).
+	// Altitude will be sent by dump1090 for ES ADS-B/TIS-B (DF=17 and DF=18)
+	// and Mode S messages (DF=0, DF = 4, and DF = 20).
 
-			ti.AltIsGNSS = newTi.AltIsGNSS
+	ti.AltIsGNSS = newTi.AltIsGNSS
 
-			if newTi.Alt != nil {
-				ti.Alt = int32(*newTi.Alt)
-				ti.Last_alt = stratuxClock.Time
-			}
+	if newTi.Alt != nil {
+		ti.Alt = int32(*newTi.Alt)
+		ti.Last_alt = stratuxClock.Time
+	}
 
-			if newTi.GnssDiffFromBaroAlt != nil {
-				ti.GnssDiffFromBaroAlt = int32(*newTi.GnssDiffFromBaroAlt) // we can estimate pressure altitude from GNSS height with this parameter!
-				ti.Last_GnssDiff = stratuxClock.Time
-				ti.Last_GnssDiffAlt = ti.Alt
-			}
+	if newTi.GnssDiffFromBaroAlt != nil {
+		ti.GnssDiffFromBaroAlt = int32(*newTi.GnssDiffFromBaroAlt) // we can estimate pressure altitude from GNSS height with this parameter!
+		ti.Last_GnssDiff = stratuxClock.Time
+		ti.Last_GnssDiffAlt = ti.Alt
+	}
 
-			// Position updates are provided only by ES messages (DF=17 and DF=18; multiple TCs)
-			if newTi.Position_valid { // i.e. DF17 or DF18 message decoded successfully by dump1090
-				valid_position := true
-				var lat, lng float32
+	// Position updates are provided only by ES messages (DF=17 and DF=18; multiple TCs)
+	if newTi.Position_valid { // i.e. DF17 or DF18 message decoded successfully by dump1090
+		valid_position := true
+		var lat, lng float32
 
-				if newTi.Lat != nil {
-					lat = float32(*newTi.Lat)
-				} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
-					valid_position = false
-					//log.Printf("Missing latitude in DF=17/18 airborne position message\n")
-				}
+		if newTi.Lat != nil {
+			lat = float32(*newTi.Lat)
+		} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
+			valid_position = false
+			//log.Printf("Missing latitude in DF=17/18 airborne position message\n")
+		}
 
-				if newTi.Lng != nil {
-					lng = float32(*newTi.Lng)
-				} else { //
-					valid_position = false
-					//log.Printf("Missing longitude in DF=17 airborne position message\n")
-				}
+		if newTi.Lng != nil {
+			lng = float32(*newTi.Lng)
+		} else { //
+			valid_position = false
+			//log.Printf("Missing longitude in DF=17 airborne position message\n")
+		}
 
-				if valid_position {
-					ti.Lat = lat
-					ti.Lng = lng
-					if isGPSValid() {
-						ti.Distance, ti.Bearing = common.Distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
-						ti.BearingDist_valid = true
-					}
-					ti.Position_valid = true
-					ti.ExtrapolatedPosition = false
-					ti.Last_seen = stratuxClock.Time // only update "last seen" data on position updates
-				}
-			} else {
-				// Old traffic had no position and update doesn't have a position either -> assume Mode-S only
-				if !ti.Position_valid {
-					ti.Last_seen = ti.Last_alt
-				}
+		if valid_position {
+			ti.Lat = lat
+			ti.Lng = lng
+			if isGPSValid() {
+				ti.Distance, ti.Bearing = common.Distance(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+				ti.BearingDist_valid = true
 			}
+			ti.Position_valid = true
+			ti.ExtrapolatedPosition = false
+			ti.Last_seen = stratuxClock.Time // only update "last seen" data on position updates
+		}
+	} else {
+		// Old traffic had no position and update doesn't have a position either -> assume Mode-S only
+		if !ti.Position_valid {
+			ti.Last_seen = ti.Last_alt
+		}
+	}
 
-			if newTi.Speed_valid { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
-				valid_speed := true
-				var speed uint16
-				var track float32
-
-				if newTi.Track != nil {
-					track = float32(*newTi.Track)
-				} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
-					valid_speed = false
-					//log.Printf("Missing track in DF=17/18 TC19 airborne velocity message\n")
-				}
+	if newTi.Speed_valid { // i.e. DF17 or DF18, TC 19 message decoded successfully by dump1090
+		valid_speed := true
+		var speed uint16
+		var track float32
 
-				if newTi.Speed != nil {
-					speed = uint16(*newTi.Speed)
-				} else { //
-					valid_speed = false
-					//log.Printf("Missing speed in DF=17/18 TC19 airborne velocity message\n")
-				}
+		if newTi.Track != nil {
+			track = float32(*newTi.Track)
+		} else { // dump1090 send a valid message, but Stratux couldn't figure it out for some reason.
+			valid_speed = false
+			//log.Printf("Missing track in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-				if newTi.Vvel != nil {
-					ti.Vvel = int16(*newTi.Vvel)
-				} else { // we'll still make the message without a valid vertical speed.
-					//log.Printf("Missing vertical speed in DF=17/18 TC19 airborne velocity message\n")
-				}
+		if newTi.Speed != nil {
+			speed = uint16(*newTi.Speed)
+		} else { //
+			valid_speed = false
+			//log.Printf("Missing speed in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-				if valid_speed {
-					ti.Track = track
-					ti.Speed = speed
-					ti.Speed_valid = true
-					ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates
-				}
-			} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) { // invalid speed on velocity message only
-				ti.Speed_valid = false
-			}
+		if newTi.Vvel != nil {
+			ti.Vvel = int16(*newTi.Vvel)
+		} else { // we'll still make the message without a valid vertical speed.
+			//log.Printf("Missing vertical speed in DF=17/18 TC19 airborne velocity message\n")
+		}
 
-			// Determine NIC (navigation integrity category) from type code and subtype code
-			if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode >= 5 && newTi.TypeCode <= 22) && (newTi.TypeCode != 19) {
-				nic := 0 // default for unknown or missing NIC
-				switch newTi.TypeCode {
-				case 0, 8, 18, 22:
-					nic = 0
-				case 17:
-					nic = 1
-				case 16:
-					if newTi.SubtypeCode == 1 {
-						nic = 3
-					} else {
-						nic = 2
-					}
-				case 15:
-					nic = 4
-				case 14:
-					nic = 5
-				case 13:
-					nic = 6
-				case 12:
-					nic = 7
-				case 11:
-					if newTi.SubtypeCode == 1 {
-						nic = 9
-					} else {
-						nic = 8
-					}
-				case 10, 21:
-					nic = 10
-				case 9, 20:
-					nic = 11
-				}
-				ti.NIC = nic
+		if valid_speed {
+			ti.Track = track
+			ti.Speed = speed
+			ti.Speed_valid = true
+			ti.Last_speed = stratuxClock.Time // only update "last seen" data on position updates
+		}
+	} else if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode == 19) { // invalid speed on velocity message only
+		ti.Speed_valid = false
+	}
 
-				if (ti.NACp < 7) && (ti.NACp < ti.NIC) {
-					ti.NACp = ti.NIC // initialize to NIC, since NIC is sent with every position report, and not all emitters report NACp.
-				}
+	// Determine NIC (navigation integrity category) from type code and subtype code
+	if ((newTi.DF == 17) || (newTi.DF == 18)) && (newTi.TypeCode >= 5 && newTi.TypeCode <= 22) && (newTi.TypeCode != 19) {
+		nic := 0 // default for unknown or missing NIC
+		switch newTi.TypeCode {
+		case 0, 8, 18, 22:
+			nic = 0
+		case 17:
+			nic = 1
+		case 16:
+			if newTi.SubtypeCode == 1 {
+				nic = 3
+			} else {
+				nic = 2
 			}
-
-			if newTi.NACp != nil {
-				ti.NACp = *newTi.NACp
+		case 15:
+			nic = 4
+		case 14:
+			nic = 5
+		case 13:
+			nic = 6
+		case 12:
+			nic = 7
+		case 11:
+			if newTi.SubtypeCode == 1 {
+				nic = 9
+			} else {
+				nic = 8
 			}
+		case 10, 21:
+			nic = 10
+		case 9, 20:
+			nic = 11
+		}
+		ti.NIC = nic
 
-			if newTi.Emitter_category != nil {
-				ti.Emitter_category = uint8(*newTi.Emitter_category) // validate dump1090 on live traffic
-			}
+		if (ti.NACp < 7) && (ti.NACp < ti.NIC) {
+			ti.NACp = ti.NIC // initialize to NIC, since NIC is sent with every position report, and not all emitters report NACp.
+		}
+	}
 
-			if newTi.Squawk != nil {
-				ti.Squawk = int(*newTi.Squawk) // only provided by Mode S messages, so we don't do this in parseUAT.
-			}
-			// Set the target type. DF=18 messages are sent by ground station, so we look at CA
-			// (repurposed to Control Field in DF18) to determine if it's ADS-R or TIS-B.
-			if newTi.DF == 17 {
-				ti.TargetType = TARGET_TYPE_ADSB
-				ti.Addr_type = 0
-			} else if newTi.DF == 18 {
-				if newTi.CA == 6 {
-					ti.TargetType = TARGET_TYPE_ADSR
-					ti.Addr_type = 2
-				} else if newTi.CA == 2 { // 2 = TIS-B with ICAO address, 5 = TIS-B without ICAO address
-					ti.TargetType = TARGET_TYPE_TISB
-					ti.Addr_type = 2
-				} else if newTi.CA == 5 {
-					ti.TargetType = TARGET_TYPE_TISB
-					ti.Addr_type = 3
-				}
-			}
+	if newTi.NACp != nil {
+		ti.NACp = *newTi.NACp
+	}
 
-			if newTi.OnGround != nil { // DF=11 messages don't report "on ground" status so we need to check for valid values.
-				ti.OnGround = bool(*newTi.OnGround)
-			}
+	if newTi.Emitter_category != nil && *newTi.Emitter_category > 0 {
+		ti.Emitter_category = uint8(*newTi.Emitter_category) // validate dump1090 on live traffic. 0 = no information, keep one known from another source
+	}
 
-			if (newTi.Tail != nil) && ((newTi.DF == 17) || (newTi.DF == 18) || (newTi.DF == 20) || (newTi.DF == 21)) { // DF=17 or DF=18, Type Code 1-4 , DF=20 Altitude Reply (often with Ident in Comm-B) DF=21 Identity Reply
-				ti.Tail = *newTi.Tail
-				ti.Tail = strings.Trim(ti.Tail, " ") // remove extraneous spaces
-			}
+	if newTi.Squawk != nil {
+		ti.Squawk = int(*newTi.Squawk) // only provided by Mode S messages, so we don't do this in parseUAT.
+	}
+	// Set the target type. DF=18 messages are sent by ground station, so we look at CA
+	// (repurposed to Control Field in DF18) to determine if it's ADS-R or TIS-B.
+	if newTi.DF == 17 {
+		ti.TargetType = TARGET_TYPE_ADSB
+		ti.Addr_type = 0
+	} else if newTi.DF == 18 {
+		if newTi.CA == 6 {
+			ti.TargetType = TARGET_TYPE_ADSR
+			ti.Addr_type = 2
+		} else if newTi.CA == 2 { // 2 = TIS-B with ICAO address, 5 = TIS-B without ICAO address
+			ti.TargetType = TARGET_TYPE_TISB
+			ti.Addr_type = 2
+		} else if newTi.CA == 5 {
+			ti.TargetType = TARGET_TYPE_TISB
+			ti.Addr_type = 3
+		}
+		if existing, ok := traffic[icao]; ok && isLowerQualityUpdate(&existing, TRAFFIC_SOURCE_1090ES, ti.TargetType) {
+			trafficMutex.Unlock()
+			return // ADS-R/TIS-B of a target we receive directly
+		}
+	}
 
-			// This is a hack to show the source of the traffic on moving maps.
-
-			if globalSettings.DisplayTrafficSource {
-				type_code := " "
-				switch ti.TargetType {
-				case TARGET_TYPE_ADSB:
-					type_code = "a"
-				case TARGET_TYPE_ADSR:
-					type_code = "r"
-				case TARGET_TYPE_TISB:
-					type_code = "t"
-				}
+	if newTi.OnGround != nil { // DF=11 messages don't report "on ground" status so we need to check for valid values.
+		ti.OnGround = bool(*newTi.OnGround)
+	}
 
-				if len(ti.Tail) == 0 {
-					ti.Tail = "e" + type_code
-				} else if len(ti.Tail) < 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
-					ti.Tail = "e" + type_code + ti.Tail
-				} else if len(ti.Tail) == 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
-					ti.Tail = "e" + type_code + ti.Tail[1:]
-				} else if len(ti.Tail) > 1 { // bounds checking
-					ti.Tail = "e" + type_code + ti.Tail[2:]
+	if (newTi.Tail != nil) && ((newTi.DF == 17) || (newTi.DF == 18) || (newTi.DF == 20) || (newTi.DF == 21)) { // DF=17 or DF=18, Type Code 1-4 , DF=20 Altitude Reply (often with Ident in Comm-B) DF=21 Identity Reply
+		ti.Tail = *newTi.Tail
+		ti.Tail = strings.Trim(ti.Tail, " ") // remove extraneous spaces
+	}
 
-				}
-			}
+	// This is a hack to show the source of the traffic on moving maps.
 
-			if newTi.DF == 17 || newTi.DF == 18 {
-				ti.Last_source = TRAFFIC_SOURCE_1090ES // only update traffic source on ADS-B messages. Prevents source on UAT ADS-B targets with Mode S transponders from "flickering" every time we get an altitude or DF11 update.
-			}
-			ti.Timestamp = newTi.Timestamp // only update "last seen" data on position updates
+	if globalSettings.DisplayTrafficSource {
+		type_code := " "
+		switch ti.TargetType {
+		case TARGET_TYPE_ADSB:
+			type_code = "a"
+		case TARGET_TYPE_ADSR:
+			type_code = "r"
+		case TARGET_TYPE_TISB:
+			type_code = "t"
+		}
 
-			/*
-				s_out, err := json.Marshal(ti)
-				if err != nil {
-					log.Printf("Error generating output: %s\n", err.Error())
-				} else {
-					log.Printf("%X (DF%d) => %s\n", ti.Icao_addr, newTi.DF, string(s_out))
-				}
-			*/
-			postProcessTraffic(&ti)
-			traffic[ti.Icao_addr] = ti // Update information on this ICAO code.
-			registerTrafficUpdate(ti)
-			seenTraffic[ti.Icao_addr] = true // Mark as seen.
-			//log.Printf("%v\n",traffic)
-			trafficMutex.Unlock()
+		if len(ti.Tail) == 0 {
+			ti.Tail = "e" + type_code
+		} else if len(ti.Tail) < 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
+			ti.Tail = "e" + type_code + ti.Tail
+		} else if len(ti.Tail) == 7 && ti.Tail[0] != 'e' && ti.Tail[0] != 'u' {
+			ti.Tail = "e" + type_code + ti.Tail[1:]
+		} else if len(ti.Tail) > 1 { // bounds checking
+			ti.Tail = "e" + type_code + ti.Tail[2:]
 
 		}
 	}
+
+	if newTi.DF == 17 || newTi.DF == 18 {
+		ti.Last_source = TRAFFIC_SOURCE_1090ES // only update traffic source on ADS-B messages. Prevents source on UAT ADS-B targets with Mode S transponders from "flickering" every time we get an altitude or DF11 update.
+	}
+	ti.Timestamp = newTi.Timestamp // only update "last seen" data on position updates
+
+	checkADSBOut(newTi, &ti) // our own transponder, see adsbout.go
+
+	/*
+		s_out, err := json.Marshal(ti)
+		if err != nil {
+			logErrorf("traffic", "Error generating output: %s", err.Error())
+		} else {
+			logInfof("traffic", "%X (DF%d) => %s", ti.Icao_addr, newTi.DF, string(s_out))
+		}
+	*/
+	postProcessTraffic(&ti)
+	traffic[ti.Icao_addr] = ti // Update information on this ICAO code.
+	registerTrafficUpdate(ti)
+	seenTraffic[ti.Icao_addr] = true // Mark as seen.
+	//log.Printf("%v\n",traffic)
+	trafficMutex.Unlock()
 }
 
 func trafficInfoExtrapolator() {
@@ -1385,7 +1551,7 @@ func trafficInfoExtrapolator() {
 		time.Sleep(1 * time.Second)
 		trafficMutex.Lock()
 		for key, ti := range traffic {
-			if ti.Age < 2 || !ti.Position_valid || !ti.Speed_valid {
+			if ti.Age < 2 || !ti.Position_valid || !ti.Speed_valid || ti.Age >= float64(globalSettings.TrafficCoastTime) {
 				continue
 			}
 			extrapolateTraffic(&ti)
@@ -1712,6 +1878,7 @@ func initTraffic() {
 	seenTraffic = make(map[uint32]bool)
 	trafficMutex = &sync.Mutex{}
 	go esListen()
+	go esNetworkInput()
 	go ognListen()
 	go aprsListen()
 	go aisListen()
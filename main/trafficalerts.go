@@ -0,0 +1,183 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficalerts.go: CPA based traffic alert levels. For every target, the time and horizontal distance of the
+		closest point of approach (CPA) with ownship are computed from the relative velocity, the vertical separation
+		at the CPA from the vertical trend (see verticaltrend.go). Targets are classified into advisory, caution and
+		warning levels (the FLARM alarm levels 1-3), either from the predicted CPA or from their current proximity.
+		The alert level is used for the FLARM PFLAA/PFLAU output, every change of the level of a target is published
+		on the /alerts websocket, so EFBs and audio systems can react immediately without parsing all traffic, and
+		announced by our own audio output (see audio.go).
+*/
+
+package main
+
+import (
+	"math"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	TRAFFIC_ALERT_NONE     = 0
+	TRAFFIC_ALERT_ADVISORY = 1
+	TRAFFIC_ALERT_CAUTION  = 2
+	TRAFFIC_ALERT_WARNING  = 3
+
+	TRAFFIC_ALERT_CPA_DIST      = 926.0 // m, closest approaches within this horizontal distance ...
+	TRAFFIC_ALERT_CPA_VERT      = 500.0 // ft, ... and vertical separation alert
+	TRAFFIC_ALERT_WARNING_TIME  = 15.0  // s to CPA
+	TRAFFIC_ALERT_CAUTION_TIME  = 30.0
+	TRAFFIC_ALERT_ADVISORY_TIME = 60.0
+
+	TRAFFIC_BEARINGLESS_MAX_AGE = 15.0 // s, Mode S replies depend on the interrogations of radar stations (rotating every 4-12s)
+)
+
+// Published on the /alerts websocket when the alert level of a target changes.
+type TrafficAlert struct {
+	Icao_addr         uint32
+	Addr_type         uint8
+	Tail              string
+	Level             uint8 // TRAFFIC_ALERT_*
+	PrevLevel         uint8
+	CPATime           float64 // s, 0 if the target doesn't converge
+	CPADistance       float64 // m
+	Distance          float64 // m, estimated for targets without position
+	Bearing           float64 // deg true, only if BearingDist_valid
+	BearingDist_valid bool
+	RelativeVertical  int32     // m, target minus ownship
+	Timestamp         time.Time // wall clock, UTC
+}
+
+var alertUpdate *uibroadcaster
+
+/*
+	computeCPA().
+		north/east is the target position relative to ownship (m). Returns the time (s) and horizontal distance (m) of
+		the closest point of approach, ok is false if the target has no velocity or doesn't converge.
+*/
+func computeCPA(ti *TrafficInfo, north, east float64) (tcpa, dcpa float64, ok bool) {
+	if !ti.Speed_valid || !isGPSGroundTrackValid() {
+		return 0, 0, false
+	}
+	// Relative velocity, m/s
+	myTrk := common.Radians(float64(mySituation.GPSTrueCourse))
+	myGs := mySituation.GPSGroundSpeed * 0.514444
+	trk := common.Radians(float64(ti.Track))
+	gs := float64(ti.Speed) * 0.514444
+	vn := gs*math.Cos(trk) - myGs*math.Cos(myTrk)
+	ve := gs*math.Sin(trk) - myGs*math.Sin(myTrk)
+	v2 := vn*vn + ve*ve
+	if v2 <= 1 {
+		return 0, 0, false
+	}
+	tcpa = -(north*vn + east*ve) / v2
+	if tcpa <= 0 {
+		return 0, 0, false
+	}
+	cn, ce := north+vn*tcpa, east+ve*tcpa
+	return tcpa, math.Sqrt(cn*cn + ce*ce), true
+}
+
+// Alert level of a predicted closest approach, relVertCPA is the vertical separation at the CPA (ft).
+func cpaAlertLevel(tcpa, dcpa, relVertCPA float64) uint8 {
+	if dcpa >= TRAFFIC_ALERT_CPA_DIST || math.Abs(relVertCPA) >= TRAFFIC_ALERT_CPA_VERT {
+		return TRAFFIC_ALERT_NONE
+	}
+	switch {
+	case tcpa <= TRAFFIC_ALERT_WARNING_TIME:
+		return TRAFFIC_ALERT_WARNING
+	case tcpa <= TRAFFIC_ALERT_CAUTION_TIME:
+		return TRAFFIC_ALERT_CAUTION
+	case tcpa <= TRAFFIC_ALERT_ADVISORY_TIME:
+		return TRAFFIC_ALERT_ADVISORY
+	}
+	return TRAFFIC_ALERT_NONE
+}
+
+/*
+	updateTrafficAlert().
+		Sets CPATime, CPADistance and AlertLevel of a target. Called from sendTrafficUpdates() with trafficMutex held,
+		after Distance/Bearing and the vertical trend are updated. Targets without position only get a proximity
+		alert from their estimated distance.
+*/
+func updateTrafficAlert(ti *TrafficInfo, relevant bool) {
+	ti.CPATime, ti.CPADistance, ti.AlertLevel = 0, 0, TRAFFIC_ALERT_NONE
+	if !relevant || ti.Alt == 0 || !isGPSValid() {
+		return
+	}
+	relativeVertical := computeRelativeVertical(*ti)
+	if !ti.Position_valid {
+		if ti.DistanceEstimated > 0 && ti.Age < TRAFFIC_BEARINGLESS_MAX_AGE {
+			ti.AlertLevel = computeAlarmLevel(ti.DistanceEstimated, relativeVertical)
+		}
+		return
+	}
+	if !isTrafficCurrent(ti, ti.Age) {
+		return
+	}
+	ti.AlertLevel = computeAlarmLevel(ti.Distance, relativeVertical)
+
+	_, _, north, east := common.DistRect(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), float64(ti.Lat), float64(ti.Lng))
+	tcpa, dcpa, ok := computeCPA(ti, north, east)
+	if !ok {
+		return
+	}
+	ti.CPATime, ti.CPADistance = tcpa, dcpa
+	relVertCPA := float64(relativeVertical) / 0.3048
+	if ti.VerticalTrend_valid {
+		relVertCPA = float64(ti.RelativeAlt) + float64(ti.RelativeVvel)/60*tcpa
+	}
+	if level := cpaAlertLevel(tcpa, dcpa, relVertCPA); level > ti.AlertLevel {
+		ti.AlertLevel = level
+	}
+}
+
+func makeTrafficAlert(ti TrafficInfo, prevLevel uint8) TrafficAlert {
+	alert := TrafficAlert{
+		Icao_addr:         ti.Icao_addr,
+		Addr_type:         ti.Addr_type,
+		Tail:              ti.Tail,
+		Level:             ti.AlertLevel,
+		PrevLevel:         prevLevel,
+		CPATime:           ti.CPATime,
+		CPADistance:       ti.CPADistance,
+		Distance:          ti.Distance,
+		Bearing:           ti.Bearing,
+		BearingDist_valid: ti.BearingDist_valid,
+		Timestamp:         time.Now().UTC(),
+	}
+	if !ti.Position_valid {
+		alert.Distance = ti.DistanceEstimated
+	}
+	if ti.Alt != 0 {
+		alert.RelativeVertical = computeRelativeVertical(ti)
+	}
+	return alert
+}
+
+// Publishes a change of the alert level of a target.
+func publishTrafficAlert(ti TrafficInfo, prevLevel uint8) {
+	alert := makeTrafficAlert(ti, prevLevel)
+	if alert.Level > prevLevel {
+		logInfof("alerts", "Traffic alert %d for %X (%s): %.0fm, CPA in %.0fs at %.0fm", alert.Level, alert.Icao_addr, alert.Tail,
+			alert.Distance, alert.CPATime, alert.CPADistance)
+	}
+	alertUpdate.SendJSON(alert)
+	queueAudioAlert(alert)
+}
+
+// Currently active alerts, sent to new /alerts websocket clients. Requires trafficMutex.
+func getActiveTrafficAlerts() []TrafficAlert {
+	alerts := make([]TrafficAlert, 0)
+	for _, ti := range traffic {
+		if ti.AlertLevel > TRAFFIC_ALERT_NONE {
+			alerts = append(alerts, makeTrafficAlert(ti, TRAFFIC_ALERT_NONE))
+		}
+	}
+	return alerts
+}
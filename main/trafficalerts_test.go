@@ -0,0 +1,78 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficalerts_test.go: Closest point of approach and alert levels.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// Ownship with a current 3D fix, the given ground track and speed.
+func setTestOwnship(track float32, speed float64, accuracy float32) {
+	initBenchmark()
+	globalStatus.GPS_connected = true
+	mySituation.GPSLastFixLocalTime = stratuxClock.Time
+	mySituation.GPSFixQuality = 1
+	mySituation.GPSHorizontalAccuracy = accuracy
+	mySituation.GPSTrueCourse = track
+	mySituation.GPSGroundSpeed = speed
+}
+
+func TestComputeCPA(t *testing.T) {
+	const kt = 0.514444 // m/s
+	tests := []struct {
+		name        string
+		myTrk       float32
+		myGs        float64
+		accuracy    float32
+		ti          TrafficInfo
+		north, east float64
+		ok          bool
+		tcpa, dcpa  float64
+	}{
+		{"head-on", 0, 100, 5, TrafficInfo{Track: 180, Speed: 100, Speed_valid: true}, 10000, 0, true, 10000 / (200 * kt), 0},
+		{"crossing from the right", 0, 0, 5, TrafficInfo{Track: 270, Speed: 100, Speed_valid: true}, 500, 2000, true, 2000 / (100 * kt), 500},
+		{"overtaking", 90, 80, 5, TrafficInfo{Track: 90, Speed: 120, Speed_valid: true}, 0, -3000, true, 3000 / (40 * kt), 0},
+		{"diverging", 0, 100, 5, TrafficInfo{Track: 0, Speed: 150, Speed_valid: true}, 5000, 0, false, 0, 0},
+		{"same velocity", 45, 100, 5, TrafficInfo{Track: 45, Speed: 100, Speed_valid: true}, 1000, 1000, false, 0, 0},
+		{"no target velocity", 0, 100, 5, TrafficInfo{Track: 180, Speed: 100}, 10000, 0, false, 0, 0},
+		{"no ownship track", 0, 100, 50, TrafficInfo{Track: 180, Speed: 100, Speed_valid: true}, 10000, 0, false, 0, 0},
+	}
+	for _, tt := range tests {
+		setTestOwnship(tt.myTrk, tt.myGs, tt.accuracy)
+		tcpa, dcpa, ok := computeCPA(&tt.ti, tt.north, tt.east)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %t, want %t", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && (math.Abs(tcpa-tt.tcpa) > 0.1 || math.Abs(dcpa-tt.dcpa) > 1) {
+			t.Errorf("%s: CPA in %.1f s at %.0f m, want %.1f s at %.0f m", tt.name, tcpa, dcpa, tt.tcpa, tt.dcpa)
+		}
+	}
+}
+
+func TestCPAAlertLevel(t *testing.T) {
+	tests := []struct {
+		tcpa, dcpa, vert float64
+		want             uint8
+	}{
+		{10, 100, 0, TRAFFIC_ALERT_WARNING},
+		{20, 100, -300, TRAFFIC_ALERT_CAUTION},
+		{45, 900, 400, TRAFFIC_ALERT_ADVISORY},
+		{90, 100, 0, TRAFFIC_ALERT_NONE},                       // Too far ahead.
+		{10, TRAFFIC_ALERT_CPA_DIST, 0, TRAFFIC_ALERT_NONE},    // Passes clear horizontally.
+		{10, 100, -TRAFFIC_ALERT_CPA_VERT, TRAFFIC_ALERT_NONE}, // Passes clear vertically.
+	}
+	for _, tt := range tests {
+		if got := cpaAlertLevel(tt.tcpa, tt.dcpa, tt.vert); got != tt.want {
+			t.Errorf("cpaAlertLevel(%.0f s, %.0f m, %.0f ft) = %d, want %d", tt.tcpa, tt.dcpa, tt.vert, got, tt.want)
+		}
+	}
+}
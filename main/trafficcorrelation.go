@@ -0,0 +1,163 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficcorrelation.go: De-duplication of aircraft seen via several sources at the same time.
+		- Same address (ADS-B, ADS-R and TIS-B of the same ICAO address, OGN/FLARM with ICAO address): the updates end
+		  up in the same target. Updates of a lower quality source are dropped while the target is received from a
+		  better source (see isLowerQualityUpdate()), so the track doesn't jump between the delayed ground station
+		  rebroadcasts and the direct reception.
+		- Different addresses (TIS-B track files, FLARM IDs, PilotAware/FANET, ...): targets that agree in position,
+		  altitude, track and speed for several consecutive seconds are correlated (see correlateTraffic()). The one
+		  of the lower quality source is marked Duplicate and not sent to the EFB, until they disagree again.
+*/
+
+package main
+
+import (
+	"math"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	TRAFFIC_PREFER_TIME    = 5.0   // s, updates of lower quality sources are dropped within this time after a better one
+	TRAFFIC_CORR_DIST      = 300.0 // m, plus the distance flown in the time between the two updates
+	TRAFFIC_CORR_ALT       = 300.0 // ft, both pressure or both GNSS altitude
+	TRAFFIC_CORR_ALT_MIXED = 700.0 // ft, pressure vs. GNSS altitude
+	TRAFFIC_CORR_TRACK     = 30.0  // deg
+	TRAFFIC_CORR_SPEED     = 30.0  // kt
+	TRAFFIC_CORR_HITS      = 3     // consecutive matching checks (1/s) before two targets are merged ...
+	TRAFFIC_CORR_MISSES    = 3     // ... and non-matching ones before they are separated again
+)
+
+/*
+	trafficSourceQuality().
+		Direct ADS-B > FLARM/OGN (direct, but more latency) > ADS-R > TIS-B > anything else.
+*/
+func trafficSourceQuality(source uint8, targetType uint8) int {
+	if source == TRAFFIC_SOURCE_OGN {
+		return 3
+	}
+	switch targetType {
+	case TARGET_TYPE_ADSB:
+		return 4
+	case TARGET_TYPE_ADSR:
+		return 2
+	case TARGET_TYPE_TISB, TARGET_TYPE_TISB_S:
+		return 1
+	}
+	return 0
+}
+
+// The update of the existing target from source/targetType should be dropped, as it was recently updated from a better source.
+func isLowerQualityUpdate(existing *TrafficInfo, source uint8, targetType uint8) bool {
+	if !existing.Position_valid || stratuxClock.Since(existing.Last_seen).Seconds() >= TRAFFIC_PREFER_TIME {
+		return false
+	}
+	return trafficSourceQuality(source, targetType) < trafficSourceQuality(existing.Last_source, existing.TargetType)
+}
+
+// Both targets could be the same aircraft.
+func isSameAircraft(a, b *TrafficInfo) bool {
+	dt := math.Abs(a.Last_seen.Sub(b.Last_seen).Seconds())
+	dist, _, _, _ := common.DistRect(float64(a.Lat), float64(a.Lng), float64(b.Lat), float64(b.Lng))
+	gate := TRAFFIC_CORR_DIST + dt*math.Max(float64(a.Speed), float64(b.Speed))*0.514444
+	if dist > gate {
+		return false
+	}
+	if a.Alt != 0 && b.Alt != 0 {
+		altGate := TRAFFIC_CORR_ALT
+		if a.AltIsGNSS != b.AltIsGNSS {
+			altGate = TRAFFIC_CORR_ALT_MIXED
+		}
+		if math.Abs(float64(a.Alt-b.Alt)) > altGate {
+			return false
+		}
+	}
+	if a.Speed_valid && b.Speed_valid {
+		if math.Abs(float64(a.Speed)-float64(b.Speed)) > TRAFFIC_CORR_SPEED {
+			return false
+		}
+		if a.Speed > 30 && b.Speed > 30 && math.Abs(trackError(float64(a.Track), float64(b.Track))) > TRAFFIC_CORR_TRACK {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	correlateTraffic().
+		Called from sendTrafficUpdates() with trafficMutex held, before the targets are ranked and sent out. Only
+		targets of different source quality are compared: two direct ADS-B or two FLARM targets with different
+		addresses are two aircraft, even when flying in formation.
+*/
+func correlateTraffic() {
+	type candidate struct {
+		key     uint32
+		ti      *TrafficInfo
+		quality int
+	}
+	candidates := make([]candidate, 0, len(traffic))
+	targets := make(map[uint32]*TrafficInfo, len(traffic))
+	for key, ti := range traffic {
+		t := ti
+		targets[key] = &t
+		if ti.Position_valid && isTrafficCurrent(&t, stratuxClock.Since(ti.Last_seen).Seconds()) {
+			candidates = append(candidates, candidate{key, &t, trafficSourceQuality(ti.Last_source, ti.TargetType)})
+		}
+	}
+
+	matched := make(map[uint32]uint32) // lower quality target -> better one
+	for i := range candidates {
+		for j := i + 1; j < len(candidates); j++ {
+			a, b := candidates[i], candidates[j]
+			if a.quality == b.quality || a.ti.Last_source == TRAFFIC_SOURCE_AIS || b.ti.Last_source == TRAFFIC_SOURCE_AIS {
+				continue
+			}
+			if a.quality < b.quality {
+				a, b = b, a
+			}
+			if _, ok := matched[b.key]; !ok && isSameAircraft(a.ti, b.ti) {
+				matched[b.key] = a.key
+			}
+		}
+	}
+
+	for key, ti := range targets {
+		if primary, ok := matched[key]; ok {
+			if ti.correlationKey != primary {
+				ti.correlationKey, ti.correlationHits = primary, 0
+				if ti.Duplicate {
+					ti.Duplicate, ti.DuplicateOf = false, 0 // matches a different target now, start over
+				}
+			}
+			ti.correlationHits++
+			ti.correlationMisses = 0
+			if !ti.Duplicate && ti.correlationHits >= TRAFFIC_CORR_HITS {
+				ti.Duplicate, ti.DuplicateOf = true, primary
+				if p := targets[primary]; len(p.Tail) == 0 && len(ti.Tail) > 0 {
+					p.Tail = ti.Tail
+				}
+			}
+		} else {
+			ti.correlationHits = 0
+			if ti.Duplicate {
+				ti.correlationMisses++
+				if ti.correlationMisses >= TRAFFIC_CORR_MISSES {
+					ti.Duplicate, ti.DuplicateOf = false, 0
+				}
+			}
+		}
+		if ti.Duplicate {
+			if _, exists := traffic[ti.DuplicateOf]; !exists {
+				ti.Duplicate, ti.DuplicateOf = false, 0 // primary timed out
+			}
+		}
+	}
+	for key, ti := range targets {
+		traffic[key] = *ti
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficoutputfilter.go: Per-output traffic filters, e.g. to only send traffic within 15nm and +-5000ft to a slow
+		serial EFIS while the WiFi clients still get everything.
+
+	globalSettings.TrafficOutputFilters maps an output or a client to a TrafficOutputFilter. Keys are the client IP
+	(e.g. "192.168.10.22"), which takes precedence, or the output as in nmeaoutput.go: "UDP:<port>", "TCP" or the
+	serial device path (e.g. "/dev/serialout0"). Outputs without an entry get all targets.
+	The filters apply to the GDL90, FLARM NMEA and X-Plane traffic messages. The web UI always shows all targets.
+*/
+
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+)
+
+type TrafficOutputFilter struct {
+	MaxDistance float64 // nm, 0 = unlimited. Bearingless targets are checked against their estimated distance
+	MaxAltDiff  int     // ft above/below ownship, 0 = unlimited. Targets without altitude always pass
+}
+
+// Client IP of a connection, "" for serial outputs.
+func connectionClientIP(conn connection) string {
+	switch c := conn.(type) {
+	case *networkConnection:
+		return c.Ip
+	case *tcpConnection:
+		// Key is "TCP:<ip>:<port>"
+		if host, _, err := net.SplitHostPort(strings.TrimPrefix(c.Key, "TCP:")); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// Returns the filter configured for conn, by client IP first, then by output.
+func trafficOutputFilter(conn connection) (TrafficOutputFilter, bool) {
+	if len(globalSettings.TrafficOutputFilters) == 0 {
+		return TrafficOutputFilter{}, false
+	}
+	if ip := connectionClientIP(conn); len(ip) > 0 {
+		if f, ok := globalSettings.TrafficOutputFilters[ip]; ok {
+			return f, true
+		}
+	}
+	f, ok := globalSettings.TrafficOutputFilters[nmeaOutputKey(conn)]
+	return f, ok
+}
+
+// Returns true if the traffic messages of ti should be sent to conn.
+func isTrafficSelected(conn connection, ti *TrafficInfo) bool {
+	f, ok := trafficOutputFilter(conn)
+	if !ok {
+		return true
+	}
+	if f.MaxDistance > 0 {
+		dist := ti.DistanceEstimated
+		if ti.Position_valid {
+			dist = ti.Distance
+		}
+		if (ti.Position_valid || dist > 0) && dist > f.MaxDistance*1852 {
+			return false
+		}
+	}
+	if f.MaxAltDiff > 0 && ti.Alt != 0 {
+		currAlt := mySituation.BaroPressureAltitude
+		if currAlt == 99999 { // no valid BaroAlt, same as sendTrafficUpdates()
+			currAlt = mySituation.GPSAltitudeMSL
+		}
+		if math.Abs(float64(ti.Alt)-float64(currAlt)) > float64(f.MaxAltDiff) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,297 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficsim.go: Simulated traffic for testing EFB connectivity, alert zones and audio callouts on the ground.
+		Scenarios are read from TRAFFIC_SIM_FILE, e.g.
+			{"Scenarios": [{"Name": "Head-on", "Duration": 120, "Loop": true, "Targets": [
+				{"Tail": "SIM1", "Emitter_category": 1, "Bearing": 0, "Range": 5, "RelAlt": 0, "Closing": true,
+				 "MissDistance": 0.2, "Speed": 150}]}]}
+		Targets start at the given bearing (deg true), range (nm) and relative altitude (ft) from ownship's position at
+		the start of the scenario and fly straight with the given track or, if "Closing" is set, towards that position.
+		They are fed into the traffic map every second like received targets, so all outputs, alerts and callouts see
+		them, but they are never logged. A scenario is started and stopped in the developer page
+		(/getTrafficSimulation, /setTrafficSimulation).
+		The targets end up on the EFB outputs, so this needs developer mode and is refused (or stopped) as soon as the
+		GPS ground speed exceeds TRAFFIC_SIM_MAX_SPEED, simulated traffic must never be seen in flight.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	TRAFFIC_SIM_FILE      = STRATUX_HOME + "cfg/traffic-scenarios.json"
+	TRAFFIC_SIM_BASE_ADDR = 0xF00000 // default address of the first target, non-ICAO
+	TRAFFIC_SIM_MAX_SPEED = 30.0     // kt, GPS ground speed above which the aircraft may be airborne
+)
+
+type TrafficSimTarget struct {
+	Address          string  // hex, default TRAFFIC_SIM_BASE_ADDR + index
+	Tail             string  // default "SIM<index>"
+	Emitter_category uint8   // GDL90 emitter category
+	Source           string  // "ES" (default), "UAT" or "OGN"
+	Bearing          float64 // deg true from ownship at the start
+	Range            float64 // nm from ownship at the start
+	RelAlt           float64 // ft relative to ownship at the start
+	Track            float64 // deg true, ignored if Closing is set
+	Closing          bool    // fly towards ownship's position at the start
+	MissDistance     float64 // nm, with Closing: pass ownship's position abeam at this distance
+	Speed            float64 // kt
+	Vvel             float64 // ft/min
+	Start            float64 // s after the start of the scenario the target appears
+	Duration         float64 // s the target is transmitting, 0 = until the scenario ends
+}
+
+type TrafficSimScenario struct {
+	Name        string
+	Description string
+	Duration    float64 // s, 0 = until stopped
+	Loop        bool    // restart after Duration
+	Targets     []TrafficSimTarget
+}
+
+// Response of /getTrafficSimulation.
+type TrafficSimStatus struct {
+	Scenarios []TrafficSimScenario
+	Active    string  // name of the running scenario, "" if none
+	Elapsed   float64 // s since the start of the running scenario
+	Error     string  // why TRAFFIC_SIM_FILE couldn't be read
+}
+
+var trafficSimScenario *TrafficSimScenario
+var trafficSimStart time.Time
+var trafficSimOrigin struct{ lat, lng, alt float64 }
+var trafficSimKeys []uint32
+var trafficSimMutex = &sync.Mutex{}
+
+func loadTrafficScenarios() ([]TrafficSimScenario, error) {
+	data, err := ioutil.ReadFile(TRAFFIC_SIM_FILE)
+	if err != nil {
+		return nil, err
+	}
+	var file struct{ Scenarios []TrafficSimScenario }
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.Scenarios, nil
+}
+
+func trafficSimKey(i int, t *TrafficSimTarget) uint32 {
+	addr := uint32(TRAFFIC_SIM_BASE_ADDR + i)
+	if a, err := strconv.ParseUint(t.Address, 16, 24); err == nil && len(t.Address) > 0 {
+		addr = uint32(a)
+	}
+	return 1<<24 | addr // address type 1 (non-ICAO), so it doesn't mix with real targets
+}
+
+// Why synthetic traffic (simulation, flight replay) must not be put on the outputs now, nil if it may.
+func syntheticTrafficAllowed() error {
+	if !globalSettings.DeveloperMode {
+		return fmt.Errorf("only available in developer mode")
+	}
+	if isGPSValid() && mySituation.GPSGroundSpeed > TRAFFIC_SIM_MAX_SPEED {
+		return fmt.Errorf("ground speed %.0f kt, only available on the ground", mySituation.GPSGroundSpeed)
+	}
+	return nil
+}
+
+// Removes the targets of the running scenario and stops it. Requires trafficSimMutex.
+func stopTrafficSimulation() {
+	if trafficSimScenario == nil {
+		return
+	}
+	logInfof("trafficsim", "Stopping traffic simulation '%s'", trafficSimScenario.Name)
+	for _, key := range trafficSimKeys {
+		removeTarget(key)
+	}
+	trafficSimScenario = nil
+	trafficSimKeys = nil
+	removeSingleSystemError("traffic-sim")
+}
+
+// Starts the named scenario around ownship's current position (Oshkosh without GPS, as updateDemoTraffic()).
+func startTrafficSimulation(name string) error {
+	if err := syntheticTrafficAllowed(); err != nil {
+		return err
+	}
+	scenarios, err := loadTrafficScenarios()
+	if err != nil {
+		return err
+	}
+	trafficSimMutex.Lock()
+	defer trafficSimMutex.Unlock()
+	stopTrafficSimulation()
+	for i := range scenarios {
+		if scenarios[i].Name != name {
+			continue
+		}
+		trafficSimOrigin.lat, trafficSimOrigin.lng = 43.99, -88.56
+		if isGPSValid() {
+			trafficSimOrigin.lat, trafficSimOrigin.lng = float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+		}
+		trafficSimOrigin.alt = float64(mySituation.GPSAltitudeMSL)
+		if isTempPressValid() {
+			trafficSimOrigin.alt = float64(mySituation.BaroPressureAltitude)
+		}
+		trafficSimScenario = &scenarios[i]
+		trafficSimStart = stratuxClock.Time
+		trafficSimKeys = make([]uint32, len(trafficSimScenario.Targets))
+		for j := range trafficSimScenario.Targets {
+			trafficSimKeys[j] = trafficSimKey(j, &trafficSimScenario.Targets[j])
+		}
+		logInfof("trafficsim", "Starting traffic simulation '%s' with %d targets", name, len(trafficSimKeys))
+		addSingleSystemErrorf("traffic-sim", "Simulated traffic scenario '%s' is running. Do not use for navigation.", name)
+		return nil
+	}
+	return fmt.Errorf("scenario '%s' not found", name)
+}
+
+// Position and state of a target elapsed seconds after its start.
+func makeTrafficSimTarget(t *TrafficSimTarget, key uint32, index int, elapsed float64) TrafficInfo {
+	var ti TrafficInfo
+	if prev, ok := traffic[key]; ok {
+		ti = prev
+	}
+	lat, lng := calcLocationForBearingDistance(trafficSimOrigin.lat, trafficSimOrigin.lng, t.Bearing, t.Range)
+	track := t.Track
+	if t.Closing {
+		aimLat, aimLng := calcLocationForBearingDistance(trafficSimOrigin.lat, trafficSimOrigin.lng, t.Bearing+90, t.MissDistance)
+		_, track = common.Distance(lat, lng, aimLat, aimLng)
+	}
+	lat, lng = calcLocationForBearingDistance(lat, lng, track, t.Speed*elapsed/3600)
+
+	ti.Icao_addr = key & 0xFFFFFF
+	ti.Addr_type = 1
+	ti.TargetType = TARGET_TYPE_ADSB
+	switch t.Source {
+	case "UAT":
+		ti.Last_source = TRAFFIC_SOURCE_UAT
+	case "OGN":
+		ti.Last_source = TRAFFIC_SOURCE_OGN
+	default:
+		ti.Last_source = TRAFFIC_SOURCE_1090ES
+	}
+	ti.Tail = t.Tail
+	if len(ti.Tail) == 0 {
+		ti.Tail = fmt.Sprintf("SIM%d", index+1)
+	}
+	ti.Emitter_category = t.Emitter_category
+	ti.Lat, ti.Lng = float32(lat), float32(lng)
+	ti.Position_valid = true
+	ti.ExtrapolatedPosition = false
+	ti.Alt = int32(trafficSimOrigin.alt + t.RelAlt + t.Vvel*elapsed/60)
+	ti.AltIsGNSS = false
+	ti.Track = float32(math.Mod(track+360, 360))
+	ti.Speed = uint16(t.Speed)
+	ti.Speed_valid = true
+	ti.Vvel = int16(t.Vvel)
+	ti.OnGround = false
+	ti.NACp, ti.NIC = 8, 8
+	ti.noTrack = true // never logged
+	ti.Timestamp = time.Now()
+	ti.Last_seen = stratuxClock.Time
+	ti.Last_alt = stratuxClock.Time
+	ti.Last_speed = stratuxClock.Time
+	return ti
+}
+
+// Called every second before sendTrafficUpdates(), updates the targets of the running scenario.
+func updateTrafficSimulation() {
+	trafficSimMutex.Lock()
+	defer trafficSimMutex.Unlock()
+	if trafficSimScenario == nil {
+		return
+	}
+	if err := syntheticTrafficAllowed(); err != nil {
+		logInfof("trafficsim", "Traffic simulation: %s", err.Error())
+		stopTrafficSimulation()
+		return
+	}
+	elapsed := stratuxClock.Since(trafficSimStart).Seconds()
+	if trafficSimScenario.Duration > 0 && elapsed > trafficSimScenario.Duration {
+		if !trafficSimScenario.Loop {
+			stopTrafficSimulation()
+			return
+		}
+		for _, key := range trafficSimKeys {
+			removeTarget(key)
+		}
+		trafficSimStart = stratuxClock.Time
+		elapsed = 0
+	}
+
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	for i := range trafficSimScenario.Targets {
+		t := &trafficSimScenario.Targets[i]
+		if elapsed < t.Start || (t.Duration > 0 && elapsed > t.Start+t.Duration) {
+			continue // not transmitting, times out like a real target
+		}
+		key := trafficSimKeys[i]
+		ti := makeTrafficSimTarget(t, key, i, elapsed-t.Start)
+		postProcessTraffic(&ti)
+		traffic[key] = ti
+		registerTrafficUpdate(ti)
+	}
+}
+
+// AJAX call - /getTrafficSimulation. Scenarios in TRAFFIC_SIM_FILE and the running one.
+func handleTrafficSimulationGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	var status TrafficSimStatus
+	scenarios, err := loadTrafficScenarios()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.Scenarios = scenarios
+	trafficSimMutex.Lock()
+	if trafficSimScenario != nil {
+		status.Active = trafficSimScenario.Name
+		status.Elapsed = stratuxClock.Since(trafficSimStart).Seconds()
+	}
+	trafficSimMutex.Unlock()
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("trafficsim", "Error sending traffic simulation JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /setTrafficSimulation?scenario=<name>. Starts the scenario, stops the running one if empty.
+func handleTrafficSimulationSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	var err error
+	if name := r.URL.Query().Get("scenario"); len(name) > 0 {
+		err = startTrafficSimulation(name)
+	} else {
+		trafficSimMutex.Lock()
+		stopTrafficSimulation()
+		trafficSimMutex.Unlock()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleTrafficSimulationGetRequest(w, r)
+}
@@ -0,0 +1,126 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	trafficstream.go: Delta encoded traffic stream of the /traffic websocket. Instead of the full target on every
+		received message, clients get
+			{"Type": "keyframe", "Targets": {"<key>": {<TrafficInfo>}, ...}}
+		when they connect and every TRAFFIC_KEYFRAME_INTERVAL, and in between every TRAFFIC_STREAM_INTERVAL
+			{"Type": "delta", "Targets": {"<key>": {<changed fields only>}, ...}, "Removed": ["<key>", ...]}
+		The key is the hex traffic key (address and address type). A keyframe replaces the client's list of targets,
+		a delta is merged into it. /jsonio still sends the full TrafficInfo objects.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	TRAFFIC_STREAM_INTERVAL   = 500 * time.Millisecond
+	TRAFFIC_KEYFRAME_INTERVAL = 10 * time.Second
+)
+
+type trafficStreamMsg struct {
+	Type    string                            // "keyframe" or "delta"
+	Targets map[string]map[string]interface{} // key -> target (keyframe) or changed fields (delta)
+	Removed []string                          `json:",omitempty"`
+}
+
+var trafficStreamUpdate *uibroadcaster
+var trafficStreamState map[string]map[string]interface{} // what the clients have after the last message, nil if none connected
+var trafficStreamKeyframe time.Time
+var trafficStreamMutex = &sync.Mutex{}
+
+// Current targets as generic JSON objects, so they can be compared field by field.
+func trafficStreamTargets() map[string]map[string]interface{} {
+	trafficMutex.Lock()
+	defer trafficMutex.Unlock()
+	targets := make(map[string]map[string]interface{}, len(traffic))
+	for key, ti := range traffic {
+		tiJSON, err := json.Marshal(&ti)
+		if err != nil {
+			continue
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(tiJSON, &fields); err != nil {
+			continue
+		}
+		targets[strconv.FormatUint(uint64(key), 16)] = fields
+	}
+	return targets
+}
+
+// Builds the next message from the current targets. Requires trafficStreamMutex.
+func makeTrafficStreamMsg() *trafficStreamMsg {
+	current := trafficStreamTargets()
+	if trafficStreamState == nil || stratuxClock.Since(trafficStreamKeyframe) >= TRAFFIC_KEYFRAME_INTERVAL {
+		trafficStreamState = current
+		trafficStreamKeyframe = stratuxClock.Time
+		return &trafficStreamMsg{Type: "keyframe", Targets: current}
+	}
+
+	msg := &trafficStreamMsg{Type: "delta", Targets: make(map[string]map[string]interface{})}
+	for key, fields := range current {
+		prev, ok := trafficStreamState[key]
+		if !ok {
+			msg.Targets[key] = fields
+			continue
+		}
+		changed := make(map[string]interface{})
+		for name, val := range fields {
+			if prevVal, ok := prev[name]; !ok || !reflect.DeepEqual(prevVal, val) {
+				changed[name] = val
+			}
+		}
+		if len(changed) > 0 {
+			msg.Targets[key] = changed
+		}
+	}
+	for key := range trafficStreamState {
+		if _, ok := current[key]; !ok {
+			msg.Removed = append(msg.Removed, key)
+		}
+	}
+	trafficStreamState = current
+	if len(msg.Targets) == 0 && len(msg.Removed) == 0 {
+		return nil
+	}
+	return msg
+}
+
+func trafficStreamSender() {
+	ticker := time.NewTicker(TRAFFIC_STREAM_INTERVAL)
+	for {
+		<-ticker.C
+		trafficStreamMutex.Lock()
+		if trafficStreamUpdate.NumSockets() == 0 {
+			trafficStreamState = nil // nobody listening, start with a keyframe for the next client
+		} else if msg := makeTrafficStreamMsg(); msg != nil {
+			trafficStreamUpdate.SendJSON(msg)
+		}
+		trafficStreamMutex.Unlock()
+	}
+}
+
+// Sends the state the other clients have as keyframe and subscribes the socket to the deltas.
+func addTrafficStreamSocket(conn *websocket.Conn) {
+	trafficStreamMutex.Lock()
+	defer trafficStreamMutex.Unlock()
+	if trafficStreamState == nil {
+		trafficStreamState = trafficStreamTargets()
+		trafficStreamKeyframe = stratuxClock.Time
+	}
+	msgJSON, _ := json.Marshal(&trafficStreamMsg{Type: "keyframe", Targets: trafficStreamState})
+	conn.Write(msgJSON)
+	trafficStreamUpdate.AddSocket(conn)
+}
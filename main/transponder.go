@@ -0,0 +1,329 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	transponder.go: Serial link to the aircraft's Mode S transponder (globalSettings.TransponderDevice). Reads the
+		Mode 3/A code, ident and pressure altitude, depending on globalSettings.TransponderProtocol:
+			TRANSPONDER_PROTOCOL_UCP     uAvionix ping200X, tailBeaconX, skyBeacon: UCP Transponder Status messages
+			                             (GDL90 framing)
+			TRANSPONDER_PROTOCOL_ICARUS  "#AL" altitude encoder sentences, e.g. the encoder port of Trig TT21/TT22
+			                             installations. Pressure altitude only, no code and ident
+		The pressure altitude of the transponder is the one ATC and ADS-B receivers see, it is used as baro source
+		(BARO_TYPE_TRANSPONDER) unless a Stratux baro sensor is connected, which makes the ownship shadow filtering
+		reliable. The code sets the emergency code of the GDL90 ownship report (7500, 7600, 7700) and bearingless
+		Mode C/S targets replying with our discrete code at our altitude are ignored as ownship.
+			/getTransponder                       TransponderStatus
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tarm/serial"
+)
+
+const (
+	TRANSPONDER_PROTOCOL_UCP    = "ucp"
+	TRANSPONDER_PROTOCOL_ICARUS = "icarus"
+
+	TRANSPONDER_TIMEOUT = 5 * time.Second  // without status the transponder is disconnected
+	TRANSPONDER_RETRY   = 10 * time.Second // between attempts to open the device
+
+	UCP_MSG_TRANSPONDER_STATUS = 0x2F
+)
+
+type TransponderStatus struct {
+	Device      string
+	Protocol    string
+	Connected   bool
+	Squawk      int    // Mode 3/A code as 4 digits, e.g. 7000. -1 if unknown
+	Ident       bool   // ident active
+	Mode        string // "off", "standby", "on" or "alt", "" if unknown
+	PressureAlt float32
+	AltValid    bool
+	LastStatus  time.Time
+	Error       string
+}
+
+var transponder = TransponderStatus{Squawk: -1}
+var transponderLastStatus time.Time // stratuxClock
+var transponderMutex sync.Mutex
+
+var icarusAltitudeRegex = regexp.MustCompile(`^#AL\s*([+-]\d{4,5})`)
+
+// Squawk codes that many aircraft use at the same time, useless to recognize ourselves.
+var transponderConspicuityCodes = map[int]bool{0: true, 1000: true, 1200: true, 2000: true, 7000: true}
+
+func isTransponderValid() bool {
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	return transponder.Connected && stratuxClock.Since(transponderLastStatus) < TRANSPONDER_TIMEOUT
+}
+
+// Our Mode 3/A code, -1 if unknown.
+func transponderSquawk() int {
+	if !isTransponderValid() {
+		return -1
+	}
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	return transponder.Squawk
+}
+
+// GDL90 emergency/priority code (ownship report, p.22) of the emergency codes.
+func transponderEmergencyCode() byte {
+	switch transponderSquawk() {
+	case 7700:
+		return 1 // general emergency
+	case 7600:
+		return 4 // no communication
+	case 7500:
+		return 5 // unlawful interference
+	}
+	return 0
+}
+
+// A bearingless target replying with our discrete code at our altitude. Caller holds trafficMutex.
+func isOwnTransponderReply(ti *TrafficInfo) bool {
+	if ti.Position_valid || ti.Alt == 0 {
+		return false
+	}
+	squawk := transponderSquawk()
+	if squawk < 0 || ti.Squawk != squawk || transponderConspicuityCodes[squawk] {
+		return false
+	}
+	diff, gate, ok := ownshipAltDiff(ti)
+	return ok && diff <= gate
+}
+
+// 4 octal digits of the 12 bit Mode 3/A code as a number, e.g. 0xFC0 -> 7700.
+func decodeModeACode(code uint16) int {
+	return int(code>>9&7)*1000 + int(code>>6&7)*100 + int(code>>3&7)*10 + int(code&7)
+}
+
+func setTransponderAltitude(alt float32) {
+	transponder.PressureAlt = alt
+	transponder.AltValid = true
+	if isTempPressValid() && mySituation.BaroSourceType == BARO_TYPE_BMP280 {
+		return // prefer our own sensor
+	}
+	mySituation.muBaro.Lock()
+	if mySituation.BaroSourceType == BARO_TYPE_TRANSPONDER && isTempPressValid() {
+		dt := stratuxClock.Since(mySituation.BaroLastMeasurementTime).Minutes()
+		if dt > 0 {
+			mySituation.BaroVerticalSpeed = 0.7*mySituation.BaroVerticalSpeed + 0.3*(alt-mySituation.BaroPressureAltitude)/float32(dt)
+		}
+	} else {
+		mySituation.BaroVerticalSpeed = 0
+	}
+	mySituation.BaroPressureAltitude = alt
+	mySituation.BaroLastMeasurementTime = stratuxClock.Time
+	mySituation.BaroSourceType = BARO_TYPE_TRANSPONDER
+	mySituation.muBaro.Unlock()
+}
+
+/*
+	UCP Transponder Status (0x2F), after removing the framing and CRC:
+		[1]     bits 7-6 mode (0 off, 1 standby, 2 on, 3 alt), bit 0 ident active
+		[2..3]  Mode 3/A code, 12 bits (4 octal digits), 0xFFFF if not set
+		[4..5]  pressure altitude, 12 bits like the GDL90 traffic report (25 ft, -1000 ft offset), 0xFFF = invalid
+*/
+func parseUCPTransponderStatus(msg []byte) bool {
+	if len(msg) < 6 || msg[0] != UCP_MSG_TRANSPONDER_STATUS {
+		return false
+	}
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	transponder.Mode = []string{"off", "standby", "on", "alt"}[msg[1]>>6]
+	transponder.Ident = msg[1]&0x01 != 0
+	transponder.Squawk = -1
+	if code := uint16(msg[2])<<8 | uint16(msg[3]); code != 0xFFFF {
+		transponder.Squawk = decodeModeACode(code & 0xFFF)
+	}
+	transponder.AltValid = false
+	if alt := (uint16(msg[4])<<8 | uint16(msg[5])) & 0xFFF; alt != 0xFFF && transponder.Mode == "alt" {
+		setTransponderAltitude(float32(alt)*25 - 1000)
+	}
+	return true
+}
+
+// "#AL +01250T+25R1A": pressure altitude in ft.
+func parseIcarusAltitude(line string) bool {
+	m := icarusAltitudeRegex.FindStringSubmatch(line)
+	if m == nil {
+		return false
+	}
+	alt, err := strconv.Atoi(m[1])
+	if err != nil || alt < -1000 || alt > 100000 {
+		return false
+	}
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	setTransponderAltitude(float32(alt))
+	return true
+}
+
+// Splits GDL90 framed messages (0x7E flags, 0x7D escapes, CRC16) from the stream.
+func scanGDL90Frames(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	start := -1
+	for i, b := range data {
+		if b != 0x7E {
+			continue
+		}
+		if start >= 0 && i > start+1 {
+			return i, data[start+1 : i], nil
+		}
+		start = i
+	}
+	if atEOF {
+		return len(data), nil, bufio.ErrFinalToken
+	}
+	if start > 0 {
+		return start, nil, nil // drop the garbage before the flag
+	}
+	return 0, nil, nil
+}
+
+// Unescapes a GDL90 frame and checks its CRC. nil if it's broken.
+func unframeGDL90(frame []byte) []byte {
+	msg := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		if frame[i] == 0x7D && i+1 < len(frame) {
+			i++
+			msg = append(msg, frame[i]^0x20)
+		} else {
+			msg = append(msg, frame[i])
+		}
+	}
+	if len(msg) < 3 {
+		return nil
+	}
+	crc := crcCompute(msg[:len(msg)-2])
+	if byte(crc&0xFF) != msg[len(msg)-2] || byte(crc>>8) != msg[len(msg)-1] {
+		return nil
+	}
+	return msg[:len(msg)-2]
+}
+
+func setTransponderError(err string) {
+	transponderMutex.Lock()
+	transponder.Connected = false
+	transponder.Error = err
+	transponderMutex.Unlock()
+}
+
+// Reads the device until it fails, the settings change or it's silent for TRANSPONDER_TIMEOUT.
+func readTransponder(device string, baud int, protocol string) {
+	port, err := serial.OpenPort(&serial.Config{Name: device, Baud: baud, ReadTimeout: TRANSPONDER_TIMEOUT})
+	if err != nil {
+		setTransponderError(err.Error())
+		return
+	}
+	defer port.Close()
+	logInfof("transponder", "reading %s at %d baud (%s)", device, baud, protocol)
+
+	scanner := bufio.NewScanner(port)
+	if protocol == TRANSPONDER_PROTOCOL_UCP {
+		scanner.Split(scanGDL90Frames)
+	}
+	for scanner.Scan() {
+		ok := false
+		if protocol == TRANSPONDER_PROTOCOL_UCP {
+			if msg := unframeGDL90(scanner.Bytes()); msg != nil {
+				ok = parseUCPTransponderStatus(msg)
+			}
+		} else {
+			ok = parseIcarusAltitude(scanner.Text())
+		}
+		if ok {
+			transponderMutex.Lock()
+			if !transponder.Connected {
+				logInfof("transponder", "connected")
+			}
+			transponder.Connected = true
+			transponder.Error = ""
+			transponder.LastStatus = time.Now().UTC()
+			transponderLastStatus = stratuxClock.Time
+			transponderMutex.Unlock()
+		}
+		if globalSettings.TransponderDevice != device || globalSettings.TransponderBaud != baud ||
+			globalSettings.TransponderProtocol != protocol {
+			setTransponderError("")
+			return
+		}
+	}
+	err = scanner.Err()
+	if err == nil {
+		err = fmt.Errorf("no data for %s", TRANSPONDER_TIMEOUT)
+	}
+	setTransponderError(err.Error())
+	logWarnf("transponder", "%s: %s", device, err.Error())
+}
+
+// Opens the configured device, reconnects after errors and setting changes. Also keeps globalStatus up to date.
+func transponderWatcher() {
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			transponderMutex.Lock()
+			transponder.Device = globalSettings.TransponderDevice
+			transponder.Protocol = globalSettings.TransponderProtocol
+			transponderMutex.Unlock()
+			valid := isTransponderValid()
+			globalStatus.Transponder_connected = valid
+			globalStatus.TransponderSquawk = ""
+			globalStatus.TransponderIdent = false
+			if squawk := transponderSquawk(); valid && squawk >= 0 {
+				transponderMutex.Lock()
+				globalStatus.TransponderSquawk = fmt.Sprintf("%04d", squawk)
+				globalStatus.TransponderIdent = transponder.Ident
+				transponderMutex.Unlock()
+			}
+			setAlert(valid && transponderEmergencyCode() != 0, "transponder-emergency", ALERT_WARNING, "transponder",
+				"Transponder squawking %s", globalStatus.TransponderSquawk)
+		}
+	}()
+	for {
+		device := globalSettings.TransponderDevice
+		if len(device) == 0 {
+			setTransponderError("")
+			time.Sleep(time.Second)
+			continue
+		}
+		readTransponder(device, globalSettings.TransponderBaud, globalSettings.TransponderProtocol)
+		if globalSettings.TransponderDevice == device {
+			time.Sleep(TRANSPONDER_RETRY)
+		}
+	}
+}
+
+func getTransponderStatus() TransponderStatus {
+	transponderMutex.Lock()
+	defer transponderMutex.Unlock()
+	status := transponder
+	status.Connected = status.Connected && stratuxClock.Since(transponderLastStatus) < TRANSPONDER_TIMEOUT
+	status.PressureAlt = float32(math.Round(float64(status.PressureAlt)))
+	return status
+}
+
+// AJAX call - /getTransponder.
+func handleTransponderGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	transponderJSON, err := json.Marshal(getTransponderStatus())
+	if err != nil {
+		logErrorf("transponder", "Error sending transponder JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", transponderJSON)
+}
@@ -51,6 +51,13 @@ func (u *uibroadcaster) AddSocket(sock *websocket.Conn) {
 	u.sockets_mu.Unlock()
 }
 
+// Number of subscribed sockets. Closed ones are only dropped on the next write.
+func (u *uibroadcaster) NumSockets() int {
+	u.sockets_mu.Lock()
+	defer u.sockets_mu.Unlock()
+	return len(u.sockets)
+}
+
 func (u *uibroadcaster) writer() {
 	for {
 		msg := <-u.messages
@@ -0,0 +1,125 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	undervoltage.go: Undervoltage and brownout monitor. The firmware's throttling flags (readThrottled()) are sampled
+		every UNDERVOLTAGE_SAMPLE_INTERVAL, every change is a PowerEvent: logged, kept since boot for /status/system and
+		recorded in the debrief of the current flight. Dips shorter than a sample only show in the sticky "occurred"
+		flags, they are logged as Transient events. While there is undervoltage and for UNDERVOLTAGE_DEGRADED_HOLD after
+		it the power is degraded: the "undervoltage" alert (announced with the audio alerts), globalStatus.PowerDegraded,
+		"Maintenance Req'd" in the GDL90 heartbeat and bit 1 of byte 12 (valid/enabled) of the "SX" status message.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	UNDERVOLTAGE_SAMPLE_INTERVAL = time.Second
+	UNDERVOLTAGE_DEGRADED_HOLD   = 60 * time.Second // after the last undervoltage
+	UNDERVOLTAGE_MAX_EVENTS      = 200
+)
+
+type PowerEvent struct {
+	Time      time.Time
+	Flag      string  // see throttledFlags: "undervoltage", "frequency capped", "throttled", "soft temperature limit"
+	Active    bool    // the flag was set, cleared otherwise
+	Seconds   float64 // how long it was set, on clearing
+	Transient bool    // set and cleared between two samples, only seen by the "occurred" flag
+}
+
+var powerEvents []PowerEvent // since boot
+var powerLastUndervoltage time.Time
+var undervoltageMutex sync.Mutex
+
+// Changes of the flags from the previous sample to the current one. begins holds the time each active flag was set.
+func powerTransitions(prev, cur uint32, begins map[string]time.Time, now time.Time) []PowerEvent {
+	events := make([]PowerEvent, 0)
+	for _, f := range throttledFlags {
+		wasSet, isSet := prev&f.now != 0, cur&f.now != 0
+		switch {
+		case isSet && !wasSet:
+			begins[f.name] = now
+			events = append(events, PowerEvent{Time: now, Flag: f.name, Active: true})
+		case wasSet && !isSet:
+			e := PowerEvent{Time: now, Flag: f.name}
+			if begin, ok := begins[f.name]; ok {
+				e.Seconds = now.Sub(begin).Seconds()
+				delete(begins, f.name)
+			}
+			events = append(events, e)
+		case !isSet && cur&f.before != 0 && prev&f.before == 0:
+			events = append(events, PowerEvent{Time: now, Flag: f.name, Transient: true})
+		}
+	}
+	return events
+}
+
+func recordPowerEvent(e PowerEvent) {
+	switch {
+	case e.Transient:
+		logWarnf("power", "%s occurred between two samples", e.Flag)
+	case e.Active:
+		logWarnf("power", "%s", e.Flag)
+	default:
+		logInfof("power", "%s cleared after %.0f s", e.Flag, e.Seconds)
+	}
+	undervoltageMutex.Lock()
+	powerEvents = append(powerEvents, e)
+	if len(powerEvents) > UNDERVOLTAGE_MAX_EVENTS {
+		powerEvents = powerEvents[len(powerEvents)-UNDERVOLTAGE_MAX_EVENTS:]
+	}
+	undervoltageMutex.Unlock()
+	debriefPowerEvent(e)
+}
+
+func getPowerEvents() []PowerEvent {
+	undervoltageMutex.Lock()
+	defer undervoltageMutex.Unlock()
+	return append([]PowerEvent{}, powerEvents...)
+}
+
+func isPowerDegraded() bool {
+	undervoltageMutex.Lock()
+	defer undervoltageMutex.Unlock()
+	return !powerLastUndervoltage.IsZero() && stratuxClock.Since(powerLastUndervoltage) < UNDERVOLTAGE_DEGRADED_HOLD
+}
+
+// Samples the throttling flags every UNDERVOLTAGE_SAMPLE_INTERVAL. The first sample reports what is set since boot.
+func undervoltageMonitor() {
+	registerSubsystem("undervoltage", 10*UNDERVOLTAGE_SAMPLE_INTERVAL)
+	ticker := time.NewTicker(UNDERVOLTAGE_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+	begins := make(map[string]time.Time)
+	var prev uint32
+	for {
+		subsystemAlive("undervoltage")
+		throttled := readThrottled()
+		undervoltage := throttled&THROTTLED_UNDERVOLTAGE != 0
+		for _, e := range powerTransitions(prev, throttled, begins, time.Now().UTC()) {
+			recordPowerEvent(e)
+			undervoltage = undervoltage || (e.Transient && e.Flag == "undervoltage")
+		}
+		prev = throttled
+
+		wasDegraded := isPowerDegraded()
+		if undervoltage {
+			undervoltageMutex.Lock()
+			powerLastUndervoltage = stratuxClock.Time
+			undervoltageMutex.Unlock()
+		}
+		degraded := isPowerDegraded()
+		globalStatus.PowerDegraded = degraded
+		setAlert(degraded, "undervoltage", ALERT_CRITICAL, "power",
+			"Undervoltage detected: use a stronger power supply and a better cable")
+		if degraded && !wasDegraded && globalSettings.AudioAlerts && !gpioSwitchClosed(globalSettings.AudioMutePin) {
+			go playAnnouncement("Stratux power low", TRAFFIC_ALERT_CAUTION)
+		}
+		<-ticker.C
+	}
+}
@@ -0,0 +1,139 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	units.go: Units and regional settings.
+			globalSettings.UnitAltitude   "ft" or "m", vertical speed in ft/min or m/s along with it
+			globalSettings.UnitSpeed      "kt", "km/h" or "mph"
+			globalSettings.UnitPressure   "hPa" or "inHg"
+			globalSettings.UnitTime       "utc" or "local", local time in globalSettings.TimeZone (IANA name, "" = system)
+		They are used by the web UI, $PGRMZ (which carries its unit) and the unit functions of the custom NMEA templates.
+		The JSON APIs, MQTT, GDL90 and the other NMEA sentences always use their base units (ft, kt, ft/min, hPa, UTC)
+		so apps don't depend on a setting they don't know about.
+			/getUnits                             the units, with the UTC offset of the time zone for the web UI
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	UNIT_TIME_UTC   = "utc"
+	UNIT_TIME_LOCAL = "local"
+)
+
+// Factors from the base unit (ft, kt, hPa).
+var unitsAltitude = map[string]float64{"ft": 1, "m": 0.3048}
+var unitsSpeed = map[string]float64{"kt": 1, "km/h": 1.852, "mph": 1.150779}
+var unitsPressure = map[string]float64{"hPa": 1, "inHg": 0.02953}
+
+type Units struct {
+	Altitude      string
+	Speed         string
+	VerticalSpeed string
+	Pressure      string
+	Time          string
+	TimeZone      string // "" = system time zone
+	UTCOffset     int    // s, of Time right now (0 for UTC)
+}
+
+var unitLocationName string
+var unitLocationCache = time.UTC
+var unitLocationMutex sync.Mutex
+
+func isValidUnit(units map[string]float64, unit string) bool {
+	_, ok := units[unit]
+	return ok
+}
+
+func unitFactor(units map[string]float64, unit string) float64 {
+	if f, ok := units[unit]; ok {
+		return f
+	}
+	return 1
+}
+
+func unitAltitude(ft float64) float64 {
+	return ft * unitFactor(unitsAltitude, globalSettings.UnitAltitude)
+}
+
+func unitSpeed(kt float64) float64 {
+	return kt * unitFactor(unitsSpeed, globalSettings.UnitSpeed)
+}
+
+// ft/min, or m/s with metric altitudes.
+func unitVerticalSpeed(fpm float64) float64 {
+	if globalSettings.UnitAltitude == "m" {
+		return fpm * 0.00508
+	}
+	return fpm
+}
+
+func unitVerticalSpeedName() string {
+	if globalSettings.UnitAltitude == "m" {
+		return "m/s"
+	}
+	return "ft/min"
+}
+
+func unitPressure(hPa float64) float64 {
+	return hPa * unitFactor(unitsPressure, globalSettings.UnitPressure)
+}
+
+// Time zone of the displayed times. Falls back to UTC if globalSettings.TimeZone can't be loaded.
+func unitLocation() *time.Location {
+	if globalSettings.UnitTime != UNIT_TIME_LOCAL {
+		return time.UTC
+	}
+	if len(globalSettings.TimeZone) == 0 {
+		return time.Local
+	}
+	unitLocationMutex.Lock()
+	defer unitLocationMutex.Unlock()
+	if unitLocationName != globalSettings.TimeZone {
+		unitLocationName = globalSettings.TimeZone
+		loc, err := time.LoadLocation(unitLocationName)
+		if err != nil {
+			logWarnf("units", "time zone '%s': %s, using UTC", unitLocationName, err.Error())
+			loc = time.UTC
+		}
+		unitLocationCache = loc
+	}
+	return unitLocationCache
+}
+
+func unitTime(t time.Time) time.Time {
+	return t.In(unitLocation())
+}
+
+func getUnits() Units {
+	_, offset := time.Now().In(unitLocation()).Zone()
+	return Units{
+		Altitude:      globalSettings.UnitAltitude,
+		Speed:         globalSettings.UnitSpeed,
+		VerticalSpeed: unitVerticalSpeedName(),
+		Pressure:      globalSettings.UnitPressure,
+		Time:          globalSettings.UnitTime,
+		TimeZone:      globalSettings.TimeZone,
+		UTCOffset:     offset,
+	}
+}
+
+// AJAX call - /getUnits.
+func handleUnitsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	unitsJSON, err := json.Marshal(getUnits())
+	if err != nil {
+		logErrorf("units", "Error sending units JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", unitsJSON)
+}
@@ -0,0 +1,362 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	updatemanager.go: Signed update bundles and automatic rollback.
+		A bundle (.stxupdate, made by selfupdate/makebundle.sh) is a tar with the update script (update-stratux-*.sh,
+		see selfupdate/makeupdate.sh), manifest.json ({"Version", "Build", "Script", "SHA256"}) and manifest.sig, the
+		base64 Ed25519 signature of manifest.json. It's verified against the public keys in UPDATE_KEYS_FILE (PEM,
+		installed from image/update-keys.pem). Plain update scripts are refused, unless a developer created
+		UPDATE_ALLOW_UNSIGNED_FILE on the boot partition. Without trusted keys no bundle can be installed.
+		The verified script goes to /root of the read-only base (see image/overlayctl) and stratux reboots. The
+		pre-start script backs up /opt/stratux to /opt/stratux.rollback, runs the update and starts the trial: it counts
+		the starts of stratux in UPDATE_TRIAL_FILE and restores the backup after the third one, or when
+		UPDATE_ROLLBACK_FILE exists. updateHealthMonitor() confirms the update once the web interface answered after
+		UPDATE_HEALTH_TIME, or requests the rollback if it didn't within UPDATE_HEALTH_DEADLINE.
+		Only the stratux files (bin, lib, www, ogn) are rolled back, not the system files the update script replaced.
+			/getUpdate                            version, trial, previous version, last result
+			/updateUpload                         bundle or (with the override) update script, form field "update_file"
+			/setUpdate?action=download            POST {"URL": "..."}: download a bundle and install it
+			/setUpdate?action=rollback            POST: restore the previous version
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	UPDATE_DIR                 = "/boot/StratuxUpdates"
+	UPDATE_TRIAL_FILE          = UPDATE_DIR + "/trial"    // starts of stratux since the update, written by the pre-start script
+	UPDATE_ROLLBACK_FILE       = UPDATE_DIR + "/rollback" // rollback requested
+	UPDATE_RESULT_FILE         = UPDATE_DIR + "/result"   // outcome of the last update
+	UPDATE_INFO_FILE           = UPDATE_DIR + "/info.json"
+	UPDATE_ALLOW_UNSIGNED_FILE = UPDATE_DIR + "/allow-unsigned" // developer override, accept plain update scripts
+	UPDATE_KEYS_FILE           = STRATUX_HOME + "cfg/update-keys.pem"
+	UPDATE_SCRIPT_TMP          = "/overlay/robase/root/TMP_update-stratux-v.sh"
+	UPDATE_SCRIPT              = "/overlay/robase/root/update-stratux-v.sh"
+	UPDATE_BACKUP_DIR          = "/opt/stratux.rollback"
+	UPDATE_HEALTH_TIME         = 2 * time.Minute
+	UPDATE_HEALTH_DEADLINE     = 10 * time.Minute
+	UPDATE_MANIFEST_MAX        = 64 * 1024
+	UPDATE_DOWNLOAD_TIME       = 15 * time.Minute
+)
+
+type updateManifest struct {
+	Version string
+	Build   string
+	Script  string // name of the update script in the bundle
+	SHA256  string // hex
+}
+
+// Written when an update is installed, so the state survives the reboot.
+type updateInfo struct {
+	Previous  string // version before the update
+	Installed string // version of the update, empty for an unsigned script
+	Signed    bool
+	Time      time.Time
+}
+
+type UpdateStatus struct {
+	Version         string
+	Build           string
+	SignedOnly      bool // plain update scripts are refused (no UPDATE_ALLOW_UNSIGNED_FILE)
+	Trial           bool // update not confirmed yet
+	TrialStarts     int
+	RollbackPending bool
+	CanRollback     bool // a backup of the previous version exists
+	Previous        string
+	Installed       string
+	Signed          bool
+	Time            time.Time
+	Result          string
+}
+
+// Developer override: needs access to the SD card, can't be set through the web interface.
+func updateUnsignedAllowed() bool {
+	_, err := os.Stat(UPDATE_ALLOW_UNSIGNED_FILE)
+	return err == nil
+}
+
+func updateTrustedKeys() ([]ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(UPDATE_KEYS_FILE)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keys := make([]ed25519.PublicKey, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", UPDATE_KEYS_FILE, err.Error())
+		}
+		if key, ok := pub.(ed25519.PublicKey); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Writes the update script to UPDATE_SCRIPT_TMP, returns its SHA-256.
+func writeUpdateScript(r io.Reader) (string, error) {
+	fi, err := os.OpenFile(UPDATE_SCRIPT_TMP, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return "", err
+	}
+	defer fi.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(fi, hash), r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), fi.Sync()
+}
+
+// Unpacks a bundle and verifies it. The script is left in UPDATE_SCRIPT_TMP.
+func readUpdateBundle(r io.Reader, keys []ed25519.PublicKey) (updateManifest, error) {
+	var manifest updateManifest
+	var manifestData, sig []byte
+	scripts := make(map[string]string) // name -> SHA-256
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return manifest, fmt.Errorf("not an update bundle: %s", err.Error())
+		}
+		name := path.Base(hdr.Name)
+		switch {
+		case name == "manifest.json":
+			manifestData, err = ioutil.ReadAll(io.LimitReader(tr, UPDATE_MANIFEST_MAX))
+		case name == "manifest.sig":
+			sig, err = ioutil.ReadAll(io.LimitReader(tr, UPDATE_MANIFEST_MAX))
+		case strings.HasPrefix(name, "update") && strings.HasSuffix(name, ".sh") && len(scripts) == 0:
+			scripts[name], err = writeUpdateScript(tr)
+		}
+		if err != nil {
+			return manifest, err
+		}
+	}
+	if manifestData == nil || sig == nil {
+		return manifest, errors.New("bundle without manifest or signature")
+	}
+	sigRaw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return manifest, fmt.Errorf("invalid signature: %s", err.Error())
+	}
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, manifestData, sigRaw) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return manifest, errors.New("signature doesn't match any trusted key")
+	}
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %s", err.Error())
+	}
+	hash, ok := scripts[manifest.Script]
+	if !ok {
+		return manifest, fmt.Errorf("bundle doesn't contain %s", manifest.Script)
+	}
+	if !strings.EqualFold(hash, manifest.SHA256) {
+		return manifest, errors.New("update script doesn't match the manifest")
+	}
+	return manifest, nil
+}
+
+// Installs a bundle, or a plain update script with the developer override. Reboots on success.
+func installUpdate(r io.Reader, script bool, source string) error {
+	keys, err := updateTrustedKeys()
+	if err != nil {
+		return err
+	}
+	overlayctl("unlock")
+	info := updateInfo{Previous: stratuxVersion, Time: time.Now().UTC()}
+	if script {
+		if !updateUnsignedAllowed() {
+			return errors.New("only signed update bundles are accepted")
+		}
+		logWarnf("update", "installing an unsigned update script, %s exists", UPDATE_ALLOW_UNSIGNED_FILE)
+		if _, err := writeUpdateScript(r); err != nil {
+			return err
+		}
+	} else {
+		if len(keys) == 0 {
+			return fmt.Errorf("no trusted keys in %s to verify the bundle", UPDATE_KEYS_FILE)
+		}
+		manifest, err := readUpdateBundle(r, keys)
+		if err != nil {
+			os.Remove(UPDATE_SCRIPT_TMP)
+			return err
+		}
+		info.Installed, info.Signed = manifest.Version, true
+	}
+	if err := os.Rename(UPDATE_SCRIPT_TMP, UPDATE_SCRIPT); err != nil {
+		return err
+	}
+	os.MkdirAll(UPDATE_DIR, 0755)
+	os.Remove(UPDATE_ROLLBACK_FILE)
+	if infoJSON, err := json.Marshal(info); err == nil {
+		ioutil.WriteFile(UPDATE_INFO_FILE, infoJSON, 0644)
+	}
+	logInfof("update", "%s uploaded %s for update (signed: %t, version: %s).", source, UPDATE_SCRIPT, info.Signed, info.Installed)
+	overlayctl("disable")
+	go delayReboot()
+	return nil
+}
+
+func getUpdateStatus() UpdateStatus {
+	status := UpdateStatus{Version: stratuxVersion, Build: stratuxBuild}
+	status.SignedOnly = !updateUnsignedAllowed()
+	if starts, err := ioutil.ReadFile(UPDATE_TRIAL_FILE); err == nil {
+		status.Trial = true
+		status.TrialStarts, _ = strconv.Atoi(strings.TrimSpace(string(starts)))
+	}
+	if _, err := os.Stat(UPDATE_ROLLBACK_FILE); err == nil {
+		status.RollbackPending = true
+	}
+	if _, err := os.Stat(UPDATE_BACKUP_DIR + "/bin/gen_gdl90"); err == nil {
+		status.CanRollback = true
+	}
+	var info updateInfo
+	if infoJSON, err := ioutil.ReadFile(UPDATE_INFO_FILE); err == nil && json.Unmarshal(infoJSON, &info) == nil {
+		status.Previous, status.Installed, status.Signed, status.Time = info.Previous, info.Installed, info.Signed, info.Time
+	}
+	if result, err := ioutil.ReadFile(UPDATE_RESULT_FILE); err == nil {
+		status.Result = strings.TrimSpace(string(result))
+	}
+	return status
+}
+
+// The pre-start script restores the backup on the next start.
+func requestUpdateRollback(reason string) error {
+	if err := ioutil.WriteFile(UPDATE_ROLLBACK_FILE, []byte(reason+"\n"), 0644); err != nil {
+		return err
+	}
+	logInfof("update", "rollback requested: %s", reason)
+	go doRestartApp()
+	return nil
+}
+
+// Confirms an update in trial once the web interface answered after UPDATE_HEALTH_TIME.
+func updateHealthMonitor() {
+	if _, err := os.Stat(UPDATE_TRIAL_FILE); err != nil {
+		return
+	}
+	logInfof("update", "%s in trial, health check in %s", stratuxVersion, UPDATE_HEALTH_TIME)
+	started := time.Now()
+	time.Sleep(UPDATE_HEALTH_TIME)
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := "http://" + net.JoinHostPort("127.0.0.1", strconv.Itoa(managementPort())) + "/getStatus"
+	for {
+		resp, err := client.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				break
+			}
+			err = fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		if time.Since(started) > UPDATE_HEALTH_DEADLINE {
+			requestUpdateRollback("health check failed: " + err.Error())
+			return
+		}
+		time.Sleep(30 * time.Second)
+	}
+	if err := os.Remove(UPDATE_TRIAL_FILE); err != nil {
+		logErrorf("update", "can't confirm the update: %s", err.Error())
+		return
+	}
+	ioutil.WriteFile(UPDATE_RESULT_FILE, []byte(fmt.Sprintf("%s installed, health check passed\n", stratuxVersion)), 0644)
+	logInfof("update", "%s confirmed", stratuxVersion)
+}
+
+// AJAX call - /getUpdate.
+func handleUpdateGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, err := json.Marshal(getUpdateStatus())
+	if err != nil {
+		logErrorf("update", "Error sending update status JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /setUpdate?action=download|rollback.
+func handleUpdateSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	switch r.URL.Query().Get("action") {
+	case "rollback":
+		if !getUpdateStatus().CanRollback {
+			http.Error(w, "no previous version to roll back to", http.StatusConflict)
+			return
+		}
+		if err := requestUpdateRollback("requested by " + r.RemoteAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case "download":
+		var req struct {
+			URL string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !strings.HasPrefix(req.URL, "http") {
+			http.Error(w, "URL required", http.StatusBadRequest)
+			return
+		}
+		client := &http.Client{Timeout: UPDATE_DOWNLOAD_TIME}
+		resp, err := client.Get(req.URL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			http.Error(w, fmt.Sprintf("download failed: HTTP %d", resp.StatusCode), http.StatusBadGateway)
+			return
+		}
+		// Downloads must be signed bundles
+		if err := installUpdate(resp.Body, false, r.RemoteAddr+" ("+req.URL+")"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	handleUpdateGetRequest(w, r)
+}
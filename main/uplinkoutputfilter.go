@@ -0,0 +1,83 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	uplinkoutputfilter.go: Per-client selection of the FIS-B products relayed in GDL90 uplink messages, e.g. text
+		reports only to a device on a slow link, or no CONUS NEXRAD to an EFB that doesn't show it.
+
+	globalSettings.UplinkOutputFilters maps a client IP (takes precedence) or an output (as TrafficOutputFilters) to
+	a comma separated list of product classes (uplinkProductClasses), e.g. "TEXT,NEXRAD_REGIONAL,NOTAM". Outputs
+	without an entry or with an empty list get every uplink unchanged, "NONE" sends no FIS-B at all.
+	Before an uplink is queued for a filtered client, the info frames of products not selected are removed
+	(uatparse.FilterUplink()) and the uplink is dropped if nothing is left. Other info frames (TIS-B/ADS-R
+	management) are always kept. The web UI and the weather stores always get everything.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+// FIS-B product id -> product class.
+var uplinkProductClasses = map[uint32]string{
+	8:   "NOTAM",
+	11:  "AIRMET",
+	12:  "SIGMET",
+	13:  "SUA",
+	14:  "AIRMET", // G-AIRMET
+	15:  "SIGMET", // CWA
+	63:  "NEXRAD_REGIONAL",
+	64:  "NEXRAD_CONUS",
+	70:  "ICING",
+	71:  "ICING",
+	84:  "CLOUD_TOPS",
+	90:  "TURBULENCE",
+	91:  "TURBULENCE",
+	103: "LIGHTNING",
+	413: "TEXT", // METAR, TAF, PIREP, winds aloft
+}
+
+func uplinkProductClass(productId uint32) string {
+	if class, ok := uplinkProductClasses[productId]; ok {
+		return class
+	}
+	return "OTHER"
+}
+
+// Returns the selected product classes for conn, by client IP first, then by output. False if everything is sent.
+func uplinkOutputFilter(conn connection) (map[string]bool, bool) {
+	if len(globalSettings.UplinkOutputFilters) == 0 {
+		return nil, false
+	}
+	selection, ok := "", false
+	if ip := connectionClientIP(conn); len(ip) > 0 {
+		selection, ok = globalSettings.UplinkOutputFilters[ip]
+	}
+	if !ok {
+		selection, ok = globalSettings.UplinkOutputFilters[nmeaOutputKey(conn)]
+	}
+	if !ok || len(strings.TrimSpace(selection)) == 0 {
+		return nil, false
+	}
+	classes := make(map[string]bool)
+	for _, c := range strings.Split(selection, ",") {
+		classes[strings.ToUpper(strings.TrimSpace(c))] = true
+	}
+	return classes, true
+}
+
+// The GDL90 uplink message of frame with only the selected products, nil if none of them is in it.
+func filterUplinkMessage(classes map[string]bool, frame []byte) []byte {
+	filtered := uatparse.FilterUplink(frame, func(productId uint32) bool {
+		return classes[uplinkProductClass(productId)]
+	})
+	if filtered == nil {
+		return nil
+	}
+	return makeRelayMessage(MSGTYPE_UPLINK, filtered)
+}
@@ -0,0 +1,144 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	usbexport.go: USB mass-storage export of the log files. While active, the data log is closed and a read-only
+		FAT image with a snapshot of the log directory is exposed to a computer connected to the USB OTG port
+		through the g_mass_storage gadget. Needs a Pi with OTG support (Zero, 4 via USB-C) and "dtoverlay=dwc2"
+		in config.txt, as well as mkfs.vfat and mcopy (dosfstools, mtools).
+
+		Toggled with /usbexporttoggle from the web UI, or by holding the power button (see pwrbtn).
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	USB_EXPORT_IMAGE_FILE = "/var/cache/stratux-usbexport.img"
+	USB_EXPORT_MIN_SIZE   = 32 * 1024 * 1024
+)
+
+var usbExportMutex sync.Mutex
+
+// Used by dataLogWatchdog(): the data log must stay closed while its files are exported.
+func isUSBExportActive() bool {
+	return globalStatus.USBExportActive
+}
+
+func runUSBExportCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s %s", name, err.Error(), string(out))
+	}
+	return nil
+}
+
+func makeUSBExportImage() error {
+	files, err := ioutil.ReadDir(logDirf)
+	if err != nil {
+		return err
+	}
+	var size int64
+	paths := make([]string, 0)
+	for _, f := range files {
+		if f.Mode().IsRegular() {
+			size += f.Size()
+			paths = append(paths, filepath.Join(logDirf, f.Name()))
+		}
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no log files in %s", logDirf)
+	}
+	size = size + size/10 + 4*1024*1024 // FAT overhead
+	if size < USB_EXPORT_MIN_SIZE {
+		size = USB_EXPORT_MIN_SIZE
+	}
+
+	os.Remove(USB_EXPORT_IMAGE_FILE)
+	img, err := os.Create(USB_EXPORT_IMAGE_FILE)
+	if err != nil {
+		return err
+	}
+	err = img.Truncate(size)
+	img.Close()
+	if err != nil {
+		return err
+	}
+	if err := runUSBExportCommand("mkfs.vfat", "-n", "STRATUXLOGS", USB_EXPORT_IMAGE_FILE); err != nil {
+		return err
+	}
+	args := append([]string{"-i", USB_EXPORT_IMAGE_FILE, "-p", "-m"}, paths...)
+	return runUSBExportCommand("mcopy", append(args, "::/")...)
+}
+
+func startUSBExport() error {
+	usbExportMutex.Lock()
+	defer usbExportMutex.Unlock()
+	if globalStatus.USBExportActive {
+		return nil
+	}
+	globalStatus.USBExportActive = true
+	// Wait for dataLogWatchdog() to close the database, so the snapshot is consistent.
+	for i := 0; dataLogStarted && i < 100; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	syscall.Sync()
+
+	err := makeUSBExportImage()
+	if err == nil {
+		err = runUSBExportCommand("modprobe", "g_mass_storage", "file="+USB_EXPORT_IMAGE_FILE, "ro=1", "removable=1")
+	}
+	if err != nil {
+		os.Remove(USB_EXPORT_IMAGE_FILE)
+		globalStatus.USBExportActive = false
+		addSingleSystemErrorf("usb-export", "USB log export failed: %s", err.Error())
+		return err
+	}
+	removeSingleSystemError("usb-export")
+	logInfof("usbexport", "USB log export active")
+	return nil
+}
+
+func stopUSBExport() error {
+	usbExportMutex.Lock()
+	defer usbExportMutex.Unlock()
+	if !globalStatus.USBExportActive {
+		return nil
+	}
+	err := runUSBExportCommand("modprobe", "-r", "g_mass_storage")
+	if err != nil {
+		logInfof("usbexport", "USB log export: %s", err.Error())
+	}
+	os.Remove(USB_EXPORT_IMAGE_FILE)
+	globalStatus.USBExportActive = false // data logging resumes
+	logInfof("usbexport", "USB log export stopped")
+	return err
+}
+
+// AJAX call - /usbexporttoggle. Starts or stops the USB mass-storage export.
+func handleUSBExportToggle(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if globalStatus.USBExportActive {
+		err = stopUSBExport()
+	} else {
+		err = startUSBExport()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%t\n", globalStatus.USBExportActive)
+}
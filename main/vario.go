@@ -0,0 +1,355 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	vario.go: Variometer for gliders without a dedicated vario. The climb rate blends the baro vertical speed
+		(smooth, but lagging) with the vertical acceleration of the AHRS (fast, but drifting) in a complementary
+		filter. It is sent in $LXWP0 and played as the usual vario tone on globalSettings.AudioDevice
+		(globalSettings.AudioVario): beeps rising in pitch and rate with the climb above AudioVarioDeadBandHigh, a
+		continuous low tone for sink below AudioVarioDeadBandLow, silence in between and on the ground.
+		While circling, the thermal assistant collects the climb by GPS track in THERMAL_SECTORS sectors over the last
+		THERMAL_HISTORY and suggests the direction to shift the circle to, towards the strongest lift.
+			/getThermal                           ThermalAssistant
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	VARIO_RATE          = 10   // Hz, blending filter
+	VARIO_TIME_CONSTANT = 1.0  // s, below the accelerometer counts, above the baro
+	VARIO_MIN_GS        = 15.0 // kt, the audio vario is silent below (on the ground)
+
+	VARIO_CLIMB_FREQ      = 600.0  // Hz at 0 m/s
+	VARIO_CLIMB_FREQ_STEP = 120.0  // Hz per m/s
+	VARIO_CLIMB_FREQ_MAX  = 1800.0 // Hz
+	VARIO_SINK_FREQ       = 400.0  // Hz at 0 m/s
+	VARIO_SINK_FREQ_STEP  = 40.0   // Hz per m/s
+	VARIO_SINK_FREQ_MIN   = 200.0  // Hz
+	VARIO_PERIOD_MAX      = 0.6    // s between the beeps at 0 m/s
+	VARIO_PERIOD_MIN      = 0.15   // s, at VARIO_PERIOD_STEP*3 m/s
+	VARIO_PERIOD_STEP     = 0.09   // s per m/s
+	VARIO_SINK_LENGTH     = 0.5    // s of continuous tone per sample
+
+	THERMAL_SECTORS       = 12
+	THERMAL_HISTORY       = 60 * time.Second // climb samples used for the sectors, 2-3 circles
+	THERMAL_MIN_TURN_RATE = 4.0              // deg/s, less is straight flight
+	THERMAL_CIRCLING_TIME = 15 * time.Second // turning that long in the same direction is circling
+	THERMAL_EXIT_TIME     = 10 * time.Second // straight flight that long ends circling
+	THERMAL_LAG           = 2.0              // s, the vario shows the lift met this much earlier on the circle
+	THERMAL_MIN_SECTORS   = 8                // sectors with samples needed for a suggestion
+)
+
+type ThermalSector struct {
+	Heading int     // deg true, center of the sector
+	Climb   float64 // m/s, average
+	Samples int
+}
+
+type ThermalAssistant struct {
+	Vario          float64 // m/s, blended climb rate
+	VarioValid     bool
+	AccelBlended   bool // the AHRS vertical acceleration is used, only baro/GPS otherwise
+	Circling       bool
+	TurnDirection  int     // 1 right, -1 left, 0 straight
+	TurnRate       float64 // deg/s, from the GPS track
+	CirclingSince  time.Time
+	AverageClimb   float64 // m/s since circling began
+	Sectors        []ThermalSector
+	ShiftValid     bool
+	ShiftDirection float64 // deg true, move the circle this way
+	ShiftClimb     float64 // m/s, best sector above the average of the circle
+}
+
+type thermalSample struct {
+	t     time.Time // stratuxClock
+	track float64   // deg true, corrected by THERMAL_LAG
+	climb float64   // m/s
+}
+
+var thermal ThermalAssistant
+var thermalSamples []thermalSample
+var thermalTurnStart time.Time     // stratuxClock, begin of the current turn
+var thermalStraightStart time.Time // stratuxClock, begin of the current straight flight
+var thermalCirclingDir int         // 1 right, -1 left
+var thermalClimbSum float64
+var thermalClimbCount int
+var thermalMutex sync.Mutex
+
+// Blended climb rate in m/s.
+func varioClimb() (float64, bool) {
+	thermalMutex.Lock()
+	defer thermalMutex.Unlock()
+	return thermal.Vario, thermal.VarioValid
+}
+
+// Vertical acceleration in m/s² (0 in level flight) from the load factor and the attitude.
+func ahrsVerticalAccel() (float64, bool) {
+	if !isAHRSValid() || isAHRSInvalidValue(mySituation.AHRSGLoad) || isAHRSInvalidValue(mySituation.AHRSRoll) ||
+		isAHRSInvalidValue(mySituation.AHRSPitch) {
+		return 0, false
+	}
+	n := mySituation.AHRSGLoad * math.Cos(mySituation.AHRSRoll*math.Pi/180) * math.Cos(mySituation.AHRSPitch*math.Pi/180)
+	return (n - 1) * 9.80665, true
+}
+
+// One step of the complementary filter, vs in m/s.
+func blendVario(vario, baroVs, accel, dt float64, accelValid bool) float64 {
+	if !accelValid {
+		accel = 0
+	}
+	k := VARIO_TIME_CONSTANT / (VARIO_TIME_CONSTANT + dt)
+	return k*(vario+accel*dt) + (1-k)*baroVs
+}
+
+// Adds a sample to the thermal assistant, once per second.
+func updateThermal(climb float64, track float64, turnRate float64) {
+	now := stratuxClock.Time
+	dir := 0
+	if turnRate > THERMAL_MIN_TURN_RATE {
+		dir = 1
+	} else if turnRate < -THERMAL_MIN_TURN_RATE {
+		dir = -1
+	}
+	if dir == 0 {
+		if thermalStraightStart.IsZero() {
+			thermalStraightStart = now
+		}
+		thermalTurnStart = time.Time{}
+	} else {
+		if thermal.TurnDirection != dir || thermalTurnStart.IsZero() {
+			thermalTurnStart = now
+		}
+		thermalStraightStart = time.Time{}
+	}
+	thermal.TurnDirection = dir
+	thermal.TurnRate = turnRate
+
+	if !thermal.Circling && dir != 0 && now.Sub(thermalTurnStart) >= THERMAL_CIRCLING_TIME {
+		thermal.Circling = true
+		thermal.CirclingSince = time.Now().UTC()
+		thermalCirclingDir = dir
+		thermalSamples = thermalSamples[:0]
+		thermalClimbSum, thermalClimbCount = 0, 0
+	} else if thermal.Circling && dir == 0 && now.Sub(thermalStraightStart) >= THERMAL_EXIT_TIME {
+		thermal.Circling = false
+		thermal.CirclingSince = time.Time{}
+		thermal.ShiftValid = false
+	}
+	if !thermal.Circling {
+		return
+	}
+
+	// Reversed turns keep the thermal, only the samples of the new direction are comparable.
+	if dir != 0 && dir != thermalCirclingDir && now.Sub(thermalTurnStart) >= THERMAL_CIRCLING_TIME {
+		thermalCirclingDir = dir
+		thermalSamples = thermalSamples[:0]
+	}
+	thermalClimbSum += climb
+	thermalClimbCount++
+	thermal.AverageClimb = thermalClimbSum / float64(thermalClimbCount)
+
+	track = math.Mod(track-turnRate*THERMAL_LAG+720, 360)
+	thermalSamples = append(thermalSamples, thermalSample{now, track, climb})
+	for len(thermalSamples) > 0 && now.Sub(thermalSamples[0].t) > THERMAL_HISTORY {
+		thermalSamples = thermalSamples[1:]
+	}
+	computeThermalSectors()
+}
+
+/*
+	computeThermalSectors().
+		Averages the samples by sector. Flying through the best lift on track h, the aircraft is 90° to the outside
+		of the circle from its center: at h-90 in a right turn, at h+90 in a left turn. The circle is moved that way.
+*/
+func computeThermalSectors() {
+	sum := make([]float64, THERMAL_SECTORS)
+	count := make([]int, THERMAL_SECTORS)
+	width := 360.0 / THERMAL_SECTORS
+	for _, s := range thermalSamples {
+		i := int(math.Mod(s.track+width/2, 360)/width) % THERMAL_SECTORS
+		sum[i] += s.climb
+		count[i]++
+	}
+
+	thermal.Sectors = make([]ThermalSector, THERMAL_SECTORS)
+	mean, sectors := 0.0, 0
+	for i := range thermal.Sectors {
+		thermal.Sectors[i].Heading = int(float64(i) * width)
+		thermal.Sectors[i].Samples = count[i]
+		if count[i] > 0 {
+			thermal.Sectors[i].Climb = sum[i] / float64(count[i])
+			mean += thermal.Sectors[i].Climb
+			sectors++
+		}
+	}
+	thermal.ShiftValid = false
+	if sectors < THERMAL_MIN_SECTORS {
+		return
+	}
+	mean /= float64(sectors)
+
+	var x, y, best float64
+	for _, s := range thermal.Sectors {
+		if s.Samples == 0 {
+			continue
+		}
+		x += (s.Climb - mean) * math.Sin(float64(s.Heading)*math.Pi/180)
+		y += (s.Climb - mean) * math.Cos(float64(s.Heading)*math.Pi/180)
+		best = math.Max(best, s.Climb-mean)
+	}
+	if x == 0 && y == 0 {
+		return
+	}
+	bestTrack := math.Atan2(x, y) * 180 / math.Pi
+	thermal.ShiftDirection = math.Mod(math.Round(bestTrack-90*float64(thermalCirclingDir))+720, 360)
+	thermal.ShiftClimb = best
+	thermal.ShiftValid = true
+}
+
+// Runs the filter at VARIO_RATE and the thermal assistant once per second.
+func varioUpdater() {
+	ticker := time.NewTicker(time.Second / VARIO_RATE)
+	defer ticker.Stop()
+	var vario, lastTrack float64
+	var lastTrackValid bool
+	tick := 0
+	for {
+		<-ticker.C
+		tick++
+		vs, vsValid := ownshipVerticalSpeed()
+		accel, accelValid := ahrsVerticalAccel()
+
+		thermalMutex.Lock()
+		if vsValid {
+			vario = blendVario(vario, vs*0.00508, accel, 1.0/VARIO_RATE, accelValid)
+		} else {
+			vario = 0
+		}
+		thermal.Vario = math.Round(vario*100) / 100
+		thermal.VarioValid = vsValid
+		thermal.AccelBlended = vsValid && accelValid
+
+		if tick%VARIO_RATE == 0 {
+			if vsValid && isGPSGroundTrackValid() {
+				track := float64(mySituation.GPSTrueCourse)
+				turnRate := 0.0
+				if lastTrackValid {
+					turnRate = math.Mod(track-lastTrack+540, 360) - 180
+				}
+				lastTrack, lastTrackValid = track, true
+				updateThermal(vario, track, turnRate)
+			} else {
+				lastTrackValid = false
+				thermal.Circling = false
+				thermal.TurnDirection = 0
+				thermal.ShiftValid = false
+			}
+		}
+		thermalMutex.Unlock()
+	}
+}
+
+// Appends a sine of freq Hz for tone samples followed by silence up to total samples, 16 bit PCM.
+func appendVarioTone(pcm []byte, freq float64, tone, total int) []byte {
+	for i := 0; i < total; i++ {
+		var v int16
+		if i < tone {
+			fade := math.Min(1, math.Min(float64(i), float64(tone-i))/200) // no clicks
+			v = int16(math.Sin(2*math.Pi*freq*float64(i)/AUDIO_SAMPLE_RATE) * fade * 16000)
+		}
+		pcm = append(pcm, byte(v), byte(uint16(v)>>8))
+	}
+	return pcm
+}
+
+/*
+	varioToneWav().
+		One cycle of the vario tone for the climb rate (m/s): a beep and the pause in climb, a continuous tone in
+		sink. nil inside the dead band.
+*/
+func varioToneWav(climb, deadBandLow, deadBandHigh float64) []byte {
+	var pcm []byte
+	switch {
+	case climb > deadBandHigh:
+		freq := math.Min(VARIO_CLIMB_FREQ+VARIO_CLIMB_FREQ_STEP*climb, VARIO_CLIMB_FREQ_MAX)
+		period := math.Max(VARIO_PERIOD_MAX-VARIO_PERIOD_STEP*climb, VARIO_PERIOD_MIN)
+		total := int(period * AUDIO_SAMPLE_RATE)
+		pcm = appendVarioTone(make([]byte, 0, total*2), freq, total/2, total)
+	case climb < deadBandLow:
+		freq := math.Max(VARIO_SINK_FREQ+VARIO_SINK_FREQ_STEP*climb, VARIO_SINK_FREQ_MIN)
+		total := int(VARIO_SINK_LENGTH * AUDIO_SAMPLE_RATE)
+		pcm = appendVarioTone(make([]byte, 0, total*2), freq, total, total)
+	default:
+		return nil
+	}
+	return append(makeWavHeader(len(pcm)), pcm...)
+}
+
+// Plays the vario tone cycle by cycle. Announcements (audioMutex) wait at most one cycle.
+func audioVario() {
+	for {
+		if !globalSettings.AudioVario || gpioSwitchClosed(globalSettings.AudioMutePin) ||
+			!isGPSValid() || mySituation.GPSGroundSpeed < VARIO_MIN_GS {
+			time.Sleep(time.Second)
+			continue
+		}
+		climb, valid := varioClimb()
+		var wav []byte
+		if valid {
+			wav = varioToneWav(climb, globalSettings.AudioVarioDeadBandLow, globalSettings.AudioVarioDeadBandHigh)
+		}
+		if wav == nil {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+		audioMutex.Lock()
+		err := playWav(wav)
+		audioMutex.Unlock()
+		if err != nil {
+			logInfof("vario", "Audio vario: %s", err)
+			addSingleSystemErrorf("audio-vario", "Audio vario: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		removeSingleSystemError("audio-vario")
+	}
+}
+
+func getThermalAssistant() ThermalAssistant {
+	thermalMutex.Lock()
+	defer thermalMutex.Unlock()
+	t := thermal
+	t.Sectors = append([]ThermalSector(nil), thermal.Sectors...)
+	if !t.Circling {
+		t.Sectors = nil
+	}
+	t.TurnRate = math.Round(t.TurnRate*10) / 10
+	t.AverageClimb = math.Round(t.AverageClimb*100) / 100
+	t.ShiftClimb = math.Round(t.ShiftClimb*100) / 100
+	for i := range t.Sectors {
+		t.Sectors[i].Climb = math.Round(t.Sectors[i].Climb*100) / 100
+	}
+	return t
+}
+
+// AJAX call - /getThermal.
+func handleThermalGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	thermalJSON, err := json.Marshal(getThermalAssistant())
+	if err != nil {
+		logErrorf("vario", "Error sending thermal JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", thermalJSON)
+}
@@ -0,0 +1,99 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	verticaltrend.go: Ownship climb/descent trend and vertical trend of the traffic relative to ownship.
+		The ownship vertical speed comes from the baro sensor if available, from GPS otherwise. It is used to predict
+		the ownship altitude 30 and 60 seconds ahead (mySituation.PredictedAlt30s/60s), and, together with the
+		target's vertical speed, to predict when a target will be co-altitude (TrafficInfo.CoAltitudeIn).
+		Instantaneous altitude differences say little about a target climbing or descending into our altitude.
+*/
+
+package main
+
+import (
+	"math"
+)
+
+const (
+	VERTICAL_TREND_HORIZON = 120.0 // s, co-altitude predictions further ahead are not reported
+	VERTICAL_TREND_CO_ALT  = 100.0 // ft, targets vertically closer than this are co-altitude
+)
+
+// Ownship vertical speed (ft/min), from the baro sensor if available, from GPS otherwise.
+func ownshipVerticalSpeed() (float64, bool) {
+	if isTempPressValid() && mySituation.BaroSourceType != BARO_TYPE_NONE && mySituation.BaroSourceType != BARO_TYPE_ADSBESTIMATE {
+		return float64(mySituation.BaroVerticalSpeed), true
+	}
+	if isGPSValid() {
+		return float64(mySituation.GPSVerticalSpeed) * 60, true
+	}
+	return 0, false
+}
+
+// Ownship altitude (ft) comparable to the target's altitude: pressure altitude, or GPS HAE for targets reporting GNSS altitude.
+// Without a pressure altitude, GPS MSL altitude is used as an approximation.
+func ownshipAltitudeFor(ti *TrafficInfo) (float64, bool) {
+	if ti.AltIsGNSS {
+		return float64(mySituation.GPSHeightAboveEllipsoid), isGPSValid()
+	}
+	if isTempPressValid() {
+		return float64(mySituation.BaroPressureAltitude), true
+	}
+	return float64(mySituation.GPSAltitudeMSL), isGPSValid()
+}
+
+func updateOwnshipVerticalTrend() {
+	vs, vsValid := ownshipVerticalSpeed()
+	alt, altValid := float64(mySituation.BaroPressureAltitude), isTempPressValid()
+	if !altValid {
+		alt, altValid = float64(mySituation.GPSAltitudeMSL), isGPSValid()
+	}
+
+	mySituation.muBaro.Lock()
+	mySituation.OwnshipVerticalSpeed = float32(vs)
+	mySituation.PredictedAlt_valid = vsValid && altValid
+	if mySituation.PredictedAlt_valid {
+		mySituation.PredictedAlt30s = float32(alt + vs/2)
+		mySituation.PredictedAlt60s = float32(alt + vs)
+	} else {
+		mySituation.PredictedAlt30s = 0
+		mySituation.PredictedAlt60s = 0
+	}
+	mySituation.muBaro.Unlock()
+}
+
+/*
+	updateTrafficVerticalTrends().
+		Called from sendTrafficUpdates() with trafficMutex held, before the targets are sent out.
+*/
+func updateTrafficVerticalTrends() {
+	updateOwnshipVerticalTrend()
+	ownVs, ownVsValid := ownshipVerticalSpeed()
+
+	for key, ti := range traffic {
+		ti.RelativeAlt, ti.RelativeVvel, ti.CoAltitudeIn, ti.VerticalTrend_valid = 0, 0, -1, false
+		ownAlt, ownAltValid := ownshipAltitudeFor(&ti)
+		if ti.Alt != 0 && ownAltValid && ownVsValid {
+			relAlt := float64(ti.Alt) - ownAlt
+			relVs := -ownVs
+			if ti.Speed_valid {
+				relVs += float64(ti.Vvel)
+			}
+			ti.RelativeAlt = int32(relAlt)
+			ti.RelativeVvel = int16(math.Max(math.Min(relVs, math.MaxInt16), math.MinInt16))
+			ti.VerticalTrend_valid = true
+
+			if math.Abs(relAlt) <= VERTICAL_TREND_CO_ALT {
+				ti.CoAltitudeIn = 0
+			} else if relAlt*relVs < 0 { // converging
+				if t := math.Abs(relAlt) / math.Abs(relVs) * 60; t <= VERTICAL_TREND_HORIZON {
+					ti.CoAltitudeIn = int(t + 0.5)
+				}
+			}
+		}
+		traffic[key] = ti
+	}
+}
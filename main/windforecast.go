@@ -0,0 +1,527 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	windforecast.go: Gridded wind and thermal forecast from Open-Meteo (DWD ICON over Europe) for glide computers,
+		downloaded before the flight while internet is available.
+		With WindForecast enabled, the forecast of the next WIND_FORECAST_DAYS for a grid of up to
+		WIND_FORECAST_GRID_MAX x WIND_FORECAST_GRID_MAX points over WindForecastRegion ("south,west,north,east" in
+		degrees, or WIND_FORECAST_RANGE around ownship if empty) is downloaded when it is older than
+		WIND_FORECAST_MAX_AGE, the region changed or ownship left it. Per point and hour it has the wind and
+		temperature at the pressure levels windForecastLevels (altitude from the geopotential height) and at 10 m,
+		the top of the boundary layer as thermal top and CAPE. The download is kept in WIND_FORECAST_FILE, so it
+		survives a restart in flight.
+			/getWindForecast[?lat=&lng=&alt=]     state, and the forecast of the closest grid point and hour at
+			                                      ownship's (or the given) position and altitude
+			/updateWindForecast                   download now (POST)
+			/windforecast.json                    the whole grid
+			/windforecast.csv                     the whole grid, one line per point, hour and level
+		The wind at ownship is also sent in the wind fields of the LXWP0 sentence (see makeLXWP0String()), which
+		XCSoar and LK8000 take as external wind with the LX driver.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	WIND_FORECAST_URL = "https://api.open-meteo.com/v1/forecast?latitude=%s&longitude=%s&hourly=%s" +
+		"&wind_speed_unit=kn&timeformat=unixtime&forecast_days=%d"
+	WIND_FORECAST_FILE           = STRATUX_HOME + "forecast/wind.json"
+	WIND_FORECAST_DAYS           = 2
+	WIND_FORECAST_MAX_AGE        = 6 * time.Hour
+	WIND_FORECAST_CHECK_INTERVAL = 15 * time.Minute
+	WIND_FORECAST_RANGE          = 100 // nm around ownship without WindForecastRegion
+	WIND_FORECAST_MAX_SPAN       = 10  // deg, of the region in latitude and longitude
+	WIND_FORECAST_GRID_MAX       = 12  // points per axis
+	WIND_FORECAST_GRID_MIN_STEP  = 0.1 // deg
+	WIND_FORECAST_MAX_SIZE       = 16 << 20
+)
+
+// Pressure levels of the forecast, hPa.
+var windForecastLevels = []int{1000, 925, 850, 700, 600, 500, 400}
+
+// Forecast of one grid point at one hour.
+type WindForecastHour struct {
+	Time       time.Time
+	Winds      []WxWindsLevel // lowest first, the levels above ground only
+	ThermalTop int            // ft MSL, top of the boundary layer, 0 if unknown
+	CAPE       int            // J/kg
+}
+
+type WindForecastPoint struct {
+	Lat       float64 // of the model grid point
+	Lng       float64
+	Elevation int // ft MSL
+	Hours     []WindForecastHour
+}
+
+// /windforecast.json
+type WindForecast struct {
+	Region     [4]float64 // south, west, north, east
+	Downloaded time.Time
+	Points     []WindForecastPoint
+}
+
+// Forecast at a position, altitude and time.
+type WindForecastWind struct {
+	Lat         float64 // of the grid point
+	Lng         float64
+	Distance    float64 // nm
+	Time        time.Time
+	Alt         float64  // ft MSL
+	Dir         float64  // deg true
+	Speed       float64  // kt
+	Temperature *float64 `json:",omitempty"` // deg C
+	ThermalTop  int      // ft MSL
+	CAPE        int      // J/kg
+}
+
+// Response of /getWindForecast.
+type WindForecastStatus struct {
+	Enabled     bool
+	Region      [4]float64
+	Downloaded  time.Time
+	Points      int
+	From        time.Time
+	To          time.Time
+	Downloading bool
+	LastError   string
+	Wind        *WindForecastWind `json:",omitempty"`
+}
+
+// Open-Meteo forecast API, one location.
+type openMeteoForecast struct {
+	Latitude  float64               `json:"latitude"`
+	Longitude float64               `json:"longitude"`
+	Elevation float64               `json:"elevation"`
+	Hourly    map[string][]*float64 `json:"hourly"`
+}
+
+// WIND_FORECAST_FILE, the region requested and the response as downloaded.
+type windForecastFile struct {
+	Region     [4]float64
+	Downloaded time.Time
+	Response   json.RawMessage
+}
+
+var windForecast *WindForecast
+var windForecastStatus WindForecastStatus
+var windForecastMutex = &sync.Mutex{}
+var windForecastDownloadMutex = &sync.Mutex{}
+
+// Region to download: WindForecastRegion, or around ownship.
+func windForecastRegion() ([4]float64, error) {
+	var region [4]float64
+	if len(strings.TrimSpace(globalSettings.WindForecastRegion)) == 0 {
+		if !isGPSValid() {
+			return region, errors.New("no region set and no GPS position")
+		}
+		region[0], region[1], region[2], region[3] = internetWxBBox(float64(mySituation.GPSLatitude),
+			float64(mySituation.GPSLongitude), WIND_FORECAST_RANGE)
+		return region, nil
+	}
+	fields := strings.Split(globalSettings.WindForecastRegion, ",")
+	if len(fields) != 4 {
+		return region, fmt.Errorf("invalid region %q, expected south,west,north,east", globalSettings.WindForecastRegion)
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return region, fmt.Errorf("invalid region %q: %s", globalSettings.WindForecastRegion, err.Error())
+		}
+		region[i] = v
+	}
+	if region[0] < -90 || region[2] > 90 || region[0] > region[2] || region[1] < -180 || region[3] > 180 || region[1] > region[3] {
+		return region, fmt.Errorf("invalid region %q", globalSettings.WindForecastRegion)
+	}
+	if region[2]-region[0] > WIND_FORECAST_MAX_SPAN || region[3]-region[1] > WIND_FORECAST_MAX_SPAN {
+		return region, fmt.Errorf("region %q larger than %d deg", globalSettings.WindForecastRegion, WIND_FORECAST_MAX_SPAN)
+	}
+	return region, nil
+}
+
+// Grid coordinates along one axis of the region.
+func windForecastAxis(min, max float64) []float64 {
+	n := int(math.Min(math.Floor((max-min)/WIND_FORECAST_GRID_MIN_STEP)+1, WIND_FORECAST_GRID_MAX))
+	if n < 2 {
+		return []float64{(min + max) / 2}
+	}
+	axis := make([]float64, n)
+	for i := range axis {
+		axis[i] = min + (max-min)*float64(i)/float64(n-1)
+	}
+	return axis
+}
+
+func windForecastURL(region [4]float64) string {
+	lats, lngs := make([]string, 0), make([]string, 0)
+	for _, lat := range windForecastAxis(region[0], region[2]) {
+		for _, lng := range windForecastAxis(region[1], region[3]) {
+			lats = append(lats, strconv.FormatFloat(lat, 'f', 3, 64))
+			lngs = append(lngs, strconv.FormatFloat(lng, 'f', 3, 64))
+		}
+	}
+	vars := []string{"wind_speed_10m", "wind_direction_10m", "temperature_2m", "boundary_layer_height", "cape"}
+	for _, p := range windForecastLevels {
+		for _, v := range []string{"wind_speed", "wind_direction", "temperature", "geopotential_height"} {
+			vars = append(vars, fmt.Sprintf("%s_%dhPa", v, p))
+		}
+	}
+	return fmt.Sprintf(WIND_FORECAST_URL, strings.Join(lats, ","), strings.Join(lngs, ","), strings.Join(vars, ","),
+		WIND_FORECAST_DAYS)
+}
+
+// Converts a downloaded forecast. Open-Meteo returns an array for several locations, an object for one.
+func parseWindForecast(f *windForecastFile) (*WindForecast, error) {
+	var locations []openMeteoForecast
+	if err := json.Unmarshal(f.Response, &locations); err != nil {
+		var location openMeteoForecast
+		if err := json.Unmarshal(f.Response, &location); err != nil {
+			return nil, err
+		}
+		locations = []openMeteoForecast{location}
+	}
+	forecast := &WindForecast{Region: f.Region, Downloaded: f.Downloaded, Points: make([]WindForecastPoint, 0)}
+	for _, l := range locations {
+		times := l.Hourly["time"]
+		if len(times) == 0 {
+			continue
+		}
+		value := func(name string, i int) (float64, bool) {
+			values := l.Hourly[name]
+			if i >= len(values) || values[i] == nil {
+				return 0, false
+			}
+			return *values[i], true
+		}
+		p := WindForecastPoint{Lat: l.Latitude, Lng: l.Longitude, Elevation: int(math.Round(l.Elevation / 0.3048))}
+		for i, t := range times {
+			if t == nil {
+				continue
+			}
+			h := WindForecastHour{Time: time.Unix(int64(*t), 0).UTC(), Winds: make([]WxWindsLevel, 0)}
+			level := func(suffix string, altM float64) {
+				speed, okSpeed := value("wind_speed_"+suffix, i)
+				dir, okDir := value("wind_direction_"+suffix, i)
+				if !okSpeed || !okDir || altM < l.Elevation {
+					return
+				}
+				w := WxWindsLevel{Alt: int(math.Round(altM / 0.3048)), Dir: int(math.Round(dir)) % 360, Speed: int(math.Round(speed))}
+				temp, ok := value("temperature_"+suffix, i)
+				if suffix == "10m" {
+					temp, ok = value("temperature_2m", i)
+				}
+				if ok {
+					t := int(math.Round(temp))
+					w.Temperature = &t
+				}
+				h.Winds = append(h.Winds, w)
+			}
+			level("10m", l.Elevation+10)
+			for _, hPa := range windForecastLevels {
+				if altM, ok := value(fmt.Sprintf("geopotential_height_%dhPa", hPa), i); ok {
+					level(fmt.Sprintf("%dhPa", hPa), altM)
+				}
+			}
+			sort.Slice(h.Winds, func(a, b int) bool { return h.Winds[a].Alt < h.Winds[b].Alt })
+			if blh, ok := value("boundary_layer_height", i); ok {
+				h.ThermalTop = int(math.Round((l.Elevation + blh) / 0.3048))
+			}
+			if cape, ok := value("cape", i); ok {
+				h.CAPE = int(math.Round(cape))
+			}
+			p.Hours = append(p.Hours, h)
+		}
+		forecast.Points = append(forecast.Points, p)
+	}
+	if len(forecast.Points) == 0 {
+		return nil, errors.New("no forecast in the response")
+	}
+	return forecast, nil
+}
+
+// Sets the forecast and the status from it. Requires windForecastMutex.
+func setWindForecast(forecast *WindForecast) {
+	windForecast = forecast
+	windForecastStatus.Region = forecast.Region
+	windForecastStatus.Downloaded = forecast.Downloaded
+	windForecastStatus.Points = len(forecast.Points)
+	windForecastStatus.From, windForecastStatus.To = time.Time{}, time.Time{}
+	for _, p := range forecast.Points {
+		if len(p.Hours) == 0 {
+			continue
+		}
+		if from := p.Hours[0].Time; windForecastStatus.From.IsZero() || from.Before(windForecastStatus.From) {
+			windForecastStatus.From = from
+		}
+		if to := p.Hours[len(p.Hours)-1].Time; to.After(windForecastStatus.To) {
+			windForecastStatus.To = to
+		}
+	}
+}
+
+func loadWindForecast() {
+	data, err := ioutil.ReadFile(WIND_FORECAST_FILE)
+	if err != nil {
+		return
+	}
+	var f windForecastFile
+	err = json.Unmarshal(data, &f)
+	var forecast *WindForecast
+	if err == nil {
+		forecast, err = parseWindForecast(&f)
+	}
+	if err != nil {
+		logErrorf("winds", "Failed to parse wind forecast: %s", err.Error())
+		return
+	}
+	logInfof("winds", "Loaded wind forecast from %s: %d points", f.Downloaded.Format(time.RFC3339), len(forecast.Points))
+	windForecastMutex.Lock()
+	setWindForecast(forecast)
+	windForecastMutex.Unlock()
+}
+
+// Downloads the forecast of the current region and stores it.
+func downloadWindForecast() error {
+	windForecastDownloadMutex.Lock()
+	defer windForecastDownloadMutex.Unlock()
+	region, err := windForecastRegion()
+	if err != nil {
+		return err
+	}
+	windForecastMutex.Lock()
+	windForecastStatus.Downloading = true
+	windForecastMutex.Unlock()
+	defer func() {
+		windForecastMutex.Lock()
+		windForecastStatus.Downloading = false
+		windForecastMutex.Unlock()
+	}()
+
+	url := windForecastURL(region)
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("open-meteo.com: %s", resp.Status)
+	}
+	f := windForecastFile{Region: region, Downloaded: time.Now().UTC()}
+	if f.Response, err = ioutil.ReadAll(io.LimitReader(resp.Body, WIND_FORECAST_MAX_SIZE)); err != nil {
+		return err
+	}
+	forecast, err := parseWindForecast(&f)
+	if err != nil {
+		return fmt.Errorf("open-meteo.com: %s", err.Error())
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(WIND_FORECAST_FILE), 0755)
+	if err := writeOgnDeviceFile(WIND_FORECAST_FILE, data); err != nil {
+		return err
+	}
+	logInfof("winds", "Downloaded wind forecast: %d points", len(forecast.Points))
+	windForecastMutex.Lock()
+	setWindForecast(forecast)
+	windForecastMutex.Unlock()
+	return nil
+}
+
+// The forecast is missing, old, or not for the current region.
+func isWindForecastOutdated() bool {
+	windForecastMutex.Lock()
+	forecast := windForecast
+	windForecastMutex.Unlock()
+	if forecast == nil || time.Since(forecast.Downloaded) > WIND_FORECAST_MAX_AGE {
+		return true
+	}
+	if len(strings.TrimSpace(globalSettings.WindForecastRegion)) > 0 {
+		region, err := windForecastRegion()
+		return err == nil && region != forecast.Region
+	}
+	if !isGPSValid() {
+		return false
+	}
+	lat, lng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+	return lat < forecast.Region[0] || lng < forecast.Region[1] || lat > forecast.Region[2] || lng > forecast.Region[3]
+}
+
+func updateWindForecast() error {
+	err := downloadWindForecast()
+	windForecastMutex.Lock()
+	windForecastStatus.LastError = ""
+	if err != nil {
+		windForecastStatus.LastError = err.Error()
+	}
+	windForecastMutex.Unlock()
+	return err
+}
+
+func windForecastUpdater() {
+	loadWindForecast()
+	ticker := time.NewTicker(WIND_FORECAST_CHECK_INTERVAL)
+	for {
+		if globalSettings.WindForecast && isWindForecastOutdated() {
+			if err := updateWindForecast(); err != nil && globalSettings.DEBUG {
+				logDebugf("winds", "Wind forecast update failed: %s", err.Error()) // no internet most of the time
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// Forecast of the grid point closest to a position and of the hour closest to t, nil if the position is outside of
+// the region or t outside of the forecast.
+func getWindForecast(lat, lng, alt float64, t time.Time) *WindForecastWind {
+	windForecastMutex.Lock()
+	defer windForecastMutex.Unlock()
+	if windForecast == nil {
+		return nil
+	}
+	r := windForecast.Region
+	margin := WIND_FORECAST_GRID_MIN_STEP
+	if lat < r[0]-margin || lng < r[1]-margin || lat > r[2]+margin || lng > r[3]+margin {
+		return nil
+	}
+	var best *WindForecastPoint
+	bestDist := math.MaxFloat64
+	for i := range windForecast.Points {
+		p := &windForecast.Points[i]
+		if dist, _ := common.Distance(lat, lng, p.Lat, p.Lng); dist < bestDist {
+			best, bestDist = p, dist
+		}
+	}
+	var hour *WindForecastHour
+	for i := range best.Hours {
+		if d := t.Sub(best.Hours[i].Time); d > -30*time.Minute && d <= 30*time.Minute {
+			hour = &best.Hours[i]
+			break
+		}
+	}
+	if hour == nil || len(hour.Winds) == 0 {
+		return nil
+	}
+	w := &WindForecastWind{Lat: best.Lat, Lng: best.Lng, Distance: bestDist / 1852, Time: hour.Time, Alt: alt,
+		ThermalTop: hour.ThermalTop, CAPE: hour.CAPE}
+	w.Dir, w.Speed, w.Temperature = interpolateWxWinds(hour.Winds, alt)
+	return w
+}
+
+// Forecast at ownship's position and altitude, nil if there is none.
+func getOwnshipWindForecast() *WindForecastWind {
+	if !globalSettings.WindForecast || !isGPSValid() {
+		return nil
+	}
+	return getWindForecast(float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude),
+		float64(mySituation.GPSAltitudeMSL), time.Now().UTC())
+}
+
+// AJAX call - /getWindForecast[?lat=&lng=&alt=]. State of the download and the forecast at ownship's (or the given)
+// position and altitude.
+func handleWindForecastGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	q := r.URL.Query()
+	lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+	lng, errLng := strconv.ParseFloat(q.Get("lng"), 64)
+	alt, errAlt := strconv.ParseFloat(q.Get("alt"), 64)
+	if (errLat != nil || errLng != nil) && isGPSValid() {
+		lat, lng, errLat, errLng = float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude), nil, nil
+	}
+	if errAlt != nil {
+		alt = float64(mySituation.GPSAltitudeMSL)
+	}
+	var wind *WindForecastWind
+	if errLat == nil && errLng == nil {
+		wind = getWindForecast(lat, lng, alt, time.Now().UTC())
+	}
+	windForecastMutex.Lock()
+	status := windForecastStatus
+	windForecastMutex.Unlock()
+	status.Enabled = globalSettings.WindForecast
+	status.Wind = wind
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("winds", "Error sending wind forecast JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /updateWindForecast. Downloads the forecast of the current region now.
+func handleWindForecastUpdateRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := updateWindForecast(); err != nil {
+		logErrorf("winds", "Wind forecast download from %s failed: %s", r.RemoteAddr, err.Error())
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	handleWindForecastGetRequest(w, r)
+}
+
+// /windforecast.json and /windforecast.csv, the whole grid.
+func handleWindForecastDataRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	windForecastMutex.Lock()
+	forecast := windForecast
+	windForecastMutex.Unlock()
+	if forecast == nil {
+		http.Error(w, "no wind forecast downloaded", http.StatusNotFound)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		fmt.Fprintf(w, "time,lat,lon,elevation_ft,alt_ft,wind_dir,wind_speed_kt,temp_c,thermal_top_ft,cape\n")
+		for _, p := range forecast.Points {
+			for _, h := range p.Hours {
+				for _, l := range h.Winds {
+					temp := ""
+					if l.Temperature != nil {
+						temp = strconv.Itoa(*l.Temperature)
+					}
+					fmt.Fprintf(w, "%s,%.4f,%.4f,%d,%d,%d,%d,%s,%d,%d\n", h.Time.Format(time.RFC3339), p.Lat, p.Lng,
+						p.Elevation, l.Alt, l.Dir, l.Speed, temp, h.ThermalTop, h.CAPE)
+				}
+			}
+		}
+		return
+	}
+
+	setJSONHeaders(w)
+	forecastJSON, err := json.Marshal(forecast)
+	if err != nil {
+		logErrorf("winds", "Error sending wind forecast JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", forecastJSON)
+}
@@ -0,0 +1,214 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	windsaloft.go: Decoding of the FIS-B winds and temperatures aloft forecast (text product "WINDS", FB format) into
+		per-station tables, and the wind interpolated at ownship's altitude.
+			WINDS ABI 061200Z  FT 3000 6000 9000 12000 18000 24000 30000 34000 39000 2220 2426+13 2531+07 ...
+		Groups are DDSS (3000 ft, no temperature), DDSS+TT / DDSS-TT, or DDSSTT above 24000 ft (temperature always
+		negative). Directions 51-86 mean speeds of 100 kt and more, 9900 is light and variable. Levels below the
+		station elevation are left out of a row, so missing groups are the lowest levels.
+		The tables are WxReports of type WINDS (/getWeatherReports?type=WINDS&nearest=3). /getWindsAloft returns the
+		wind of the closest station at ownship's altitude (or ?lat=&lng=&alt=), interpolated between the levels above
+		and below.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+)
+
+const (
+	WX_WINDS_MAX_AGE = 12 * time.Hour // after the time of the data
+)
+
+// Forecast at one altitude.
+type WxWindsLevel struct {
+	Alt         int  // ft MSL
+	Dir         int  // deg true, -1 = light and variable
+	Speed       int  // kt
+	Temperature *int `json:",omitempty"` // deg C
+}
+
+// Response of /getWindsAloft.
+type WxWindsAloft struct {
+	Station     string
+	Distance    float64 // nm
+	Time        time.Time
+	Alt         float64  // ft MSL
+	Dir         float64  // deg true
+	Speed       float64  // kt
+	Temperature *float64 `json:",omitempty"` // deg C
+}
+
+var wxWindsLevelRe = regexp.MustCompile(`^(\d{2})(\d{2})(?:([+-]\d{2})|(\d{2}))?$`)
+
+// One group of a winds aloft row.
+func parseWxWindsGroup(s string, alt int) (WxWindsLevel, bool) {
+	l := WxWindsLevel{Alt: alt}
+	m := wxWindsLevelRe.FindStringSubmatch(s)
+	if m == nil {
+		return l, false
+	}
+	dir, speed := wxAtoi(m[1]), wxAtoi(m[2])
+	if dir == 99 {
+		l.Dir, l.Speed = -1, 0
+	} else {
+		if dir > 50 {
+			dir -= 50
+			speed += 100
+		}
+		l.Dir, l.Speed = dir*10, speed
+	}
+	if len(m[3]) > 0 {
+		t, _ := strconv.Atoi(m[3])
+		l.Temperature = &t
+	} else if len(m[4]) > 0 {
+		t := -wxAtoi(m[4])
+		l.Temperature = &t
+	}
+	return l, true
+}
+
+// Levels of a winds aloft report, the tokens after the time.
+func parseWxWinds(tokens []string) []WxWindsLevel {
+	i := 0
+	for i < len(tokens) && tokens[i] != "FT" {
+		i++
+	}
+	i++
+	alts := make([]int, 0)
+	for ; i < len(tokens); i++ {
+		alt, err := strconv.Atoi(tokens[i])
+		if err != nil || alt < 1000 || (len(alts) > 0 && alt <= alts[len(alts)-1]) {
+			break
+		}
+		alts = append(alts, alt)
+	}
+	groups := make([]string, 0)
+	for ; i < len(tokens); i++ {
+		if wxWindsLevelRe.MatchString(tokens[i]) {
+			groups = append(groups, tokens[i])
+		}
+	}
+	if len(groups) > len(alts) {
+		groups = groups[len(groups)-len(alts):]
+	}
+	alts = alts[len(alts)-len(groups):] // missing groups are the lowest levels
+	levels := make([]WxWindsLevel, 0)
+	for j, g := range groups {
+		if l, ok := parseWxWindsGroup(g, alts[j]); ok {
+			levels = append(levels, l)
+		}
+	}
+	return levels
+}
+
+// Wind of a table at an altitude, vector interpolated between the levels above and below.
+func interpolateWxWinds(levels []WxWindsLevel, alt float64) (dir, speed float64, temp *float64) {
+	if len(levels) == 0 {
+		return 0, 0, nil
+	}
+	windVector := func(l WxWindsLevel) (float64, float64) {
+		if l.Dir < 0 {
+			return 0, 0
+		}
+		rad := common.Radians(float64(l.Dir))
+		return float64(l.Speed) * math.Sin(rad), float64(l.Speed) * math.Cos(rad)
+	}
+	lo, hi := levels[0], levels[len(levels)-1]
+	for i := 0; i < len(levels)-1; i++ {
+		if alt >= float64(levels[i].Alt) && alt <= float64(levels[i+1].Alt) {
+			lo, hi = levels[i], levels[i+1]
+			break
+		}
+	}
+	if alt < float64(levels[0].Alt) {
+		hi = lo
+	}
+	f := 0.0
+	if hi.Alt != lo.Alt {
+		f = (alt - float64(lo.Alt)) / float64(hi.Alt-lo.Alt)
+	}
+	x0, y0 := windVector(lo)
+	x1, y1 := windVector(hi)
+	x, y := x0+(x1-x0)*f, y0+(y1-y0)*f
+	speed = math.Hypot(x, y)
+	dir = math.Mod(common.Degrees(math.Atan2(x, y))+360, 360)
+	if lo.Temperature != nil && hi.Temperature != nil {
+		t := float64(*lo.Temperature) + float64(*hi.Temperature-*lo.Temperature)*f
+		temp = &t
+	} else if lo.Temperature != nil {
+		t := float64(*lo.Temperature)
+		temp = &t
+	} else if hi.Temperature != nil {
+		t := float64(*hi.Temperature)
+		temp = &t
+	}
+	return dir, speed, temp
+}
+
+// Wind at a position from the closest station, nil if there is none.
+func getWindsAloft(lat, lng, alt float64) *WxWindsAloft {
+	wxReportsMutex.Lock()
+	defer wxReportsMutex.Unlock()
+	var best *WxReport
+	bestDist := math.MaxFloat64
+	for _, r := range getWxReports("WINDS", nil) {
+		if len(r.Winds) == 0 {
+			continue
+		}
+		dist, _ := common.Distance(lat, lng, r.Lat, r.Lng)
+		if dist < bestDist {
+			report := r
+			best, bestDist = &report, dist
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	w := &WxWindsAloft{Station: best.Station, Distance: bestDist / 1852, Time: best.Time, Alt: alt}
+	w.Dir, w.Speed, w.Temperature = interpolateWxWinds(best.Winds, alt)
+	return w
+}
+
+// AJAX call - /getWindsAloft[?lat=&lng=&alt=]. Wind at ownship's (or the given) position and altitude.
+func handleWindsAloftRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	q := r.URL.Query()
+	lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+	lng, errLng := strconv.ParseFloat(q.Get("lng"), 64)
+	if errLat != nil || errLng != nil {
+		if !isGPSValid() {
+			http.Error(w, "no GPS position, lat/lng required", http.StatusBadRequest)
+			return
+		}
+		lat, lng = float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+	}
+	alt, err := strconv.ParseFloat(q.Get("alt"), 64)
+	if err != nil {
+		alt = float64(mySituation.GPSAltitudeMSL)
+	}
+	winds := getWindsAloft(lat, lng, alt)
+	if winds == nil {
+		http.Error(w, "no winds aloft received", http.StatusNotFound)
+		return
+	}
+	windsJSON, err := json.Marshal(winds)
+	if err != nil {
+		logErrorf("winds", "Error sending winds aloft JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", windsJSON)
+}
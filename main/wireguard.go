@@ -0,0 +1,419 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wireguard.go: WireGuard tunnel (wg0) for remote access to the web UI, e.g. from home while the aircraft is in the
+		hangar with LTE. Stratux connects to the peers (typically one server at home with a public endpoint) and keeps
+		the tunnel open through NAT, nothing is exposed on the LTE interface itself.
+		The private key is generated on first use and kept in WIREGUARD_KEY_FILE, not in the settings, so it is never
+		sent by /getSettings. Needs the kernel module and wireguard-tools (wg).
+			/getWireGuard                         status: public key, interface address, peers with last handshake
+			/setWireGuard?action=regenerate       new key pair (the peers need the new public key)
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	WIREGUARD_IFACE          = "wg0"
+	WIREGUARD_KEY_FILE       = STRATUX_HOME + "cfg/wireguard.key"
+	WIREGUARD_KEEPALIVE      = 25 // s, default PersistentKeepalive, keeps the NAT mapping of the LTE router open
+	WIREGUARD_RETRY_INTERVAL = time.Minute
+	WIREGUARD_RERESOLVE_AGE  = 3 * time.Minute // re-resolve the endpoint (dynamic DNS at home) without handshake for this long
+)
+
+type WireGuardPeer struct {
+	Name       string
+	PublicKey  string
+	Endpoint   string // host:port, empty = the peer connects to us (needs WireGuardListenPort)
+	AllowedIPs string // comma separated CIDRs, e.g. "10.99.0.1/32"
+	Keepalive  int    // s, 0 = WIREGUARD_KEEPALIVE
+}
+
+type WireGuardPeerStatus struct {
+	Name            string
+	PublicKey       string
+	Endpoint        string  // current endpoint address
+	LatestHandshake float64 // s ago, -1 = never
+	RxBytes         uint64
+	TxBytes         uint64
+}
+
+type WireGuardStatus struct {
+	Enabled    bool
+	Up         bool
+	PublicKey  string
+	Address    string
+	ListenPort int
+	Error      string
+	Peers      []WireGuardPeerStatus
+}
+
+var wireguardMutex sync.Mutex
+var wireguardError string
+var wireguardRestart = make(chan struct{}, 1)
+
+func wgKeyValid(key string) bool {
+	k, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+	return err == nil && len(k) == 32
+}
+
+// Private key from WIREGUARD_KEY_FILE, a new one is generated (and persisted) if there is none or regenerate is set.
+func wireguardPrivateKey(regenerate bool) (string, error) {
+	if !regenerate {
+		if key, err := ioutil.ReadFile(WIREGUARD_KEY_FILE); err == nil && wgKeyValid(string(key)) {
+			return strings.TrimSpace(string(key)), nil
+		}
+	}
+	out, err := exec.Command("wg", "genkey").Output()
+	if err != nil {
+		return "", fmt.Errorf("wg genkey: %s", err.Error())
+	}
+	key := strings.TrimSpace(string(out))
+	if !wgKeyValid(key) {
+		return "", errors.New("wg genkey: invalid key")
+	}
+	os.MkdirAll(filepath.Dir(WIREGUARD_KEY_FILE), 0755)
+	if err := ioutil.WriteFile(WIREGUARD_KEY_FILE, []byte(key+"\n"), 0600); err != nil {
+		return "", err
+	}
+	// Also to the read-only base of the overlay file system, so it persists
+	robase := "/overlay/robase" + WIREGUARD_KEY_FILE
+	if _, err := os.Stat(filepath.Dir(robase)); err == nil {
+		overlayctl("unlock")
+		if err := ioutil.WriteFile(robase, []byte(key+"\n"), 0600); err != nil {
+			logErrorf("wireguard", "can't persist the key: %s", err.Error())
+		}
+		overlayctl("lock")
+	}
+	logInfof("wireguard", "generated a new key pair")
+	return key, nil
+}
+
+func wireguardPublicKey(privateKey string) (string, error) {
+	cmd := exec.Command("wg", "pubkey")
+	cmd.Stdin = strings.NewReader(privateKey + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("wg pubkey: %s", err.Error())
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Parses the value of the WireGuardPeers setting, see handleSettingsSetRequest(). Peers with an invalid key or
+// allowed IPs are skipped.
+func parseWireGuardPeers(val []interface{}) []WireGuardPeer {
+	peers := make([]WireGuardPeer, 0)
+	for _, raw := range val {
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := WireGuardPeer{}
+		p.Name, _ = m["Name"].(string)
+		p.PublicKey, _ = m["PublicKey"].(string)
+		p.Endpoint, _ = m["Endpoint"].(string)
+		p.AllowedIPs, _ = m["AllowedIPs"].(string)
+		keepalive, _ := m["Keepalive"].(float64)
+		p.Keepalive = int(keepalive)
+		p.Name = strings.TrimSpace(p.Name)
+		p.PublicKey = strings.TrimSpace(p.PublicKey)
+		p.Endpoint = strings.TrimSpace(p.Endpoint)
+		if !wgKeyValid(p.PublicKey) {
+			logWarnf("wireguard", "WireGuardPeers: invalid public key of '%s'", p.Name)
+			continue
+		}
+		if len(p.Endpoint) > 0 {
+			if _, _, err := net.SplitHostPort(p.Endpoint); err != nil {
+				logWarnf("wireguard", "WireGuardPeers: invalid endpoint '%s': %s", p.Endpoint, err.Error())
+				continue
+			}
+		}
+		allowed := make([]string, 0)
+		for _, cidr := range strings.Split(p.AllowedIPs, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if _, _, err := net.ParseCIDR(cidr); err == nil {
+				allowed = append(allowed, cidr)
+			} else if len(cidr) > 0 {
+				logWarnf("wireguard", "WireGuardPeers: invalid allowed IPs '%s' of '%s'", cidr, p.Name)
+			}
+		}
+		p.AllowedIPs = strings.Join(allowed, ", ")
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Configuration in "wg setconf" format.
+func wireguardConfig(privateKey string) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[Interface]\nPrivateKey = %s\n", privateKey)
+	if globalSettings.WireGuardListenPort > 0 {
+		fmt.Fprintf(&b, "ListenPort = %d\n", globalSettings.WireGuardListenPort)
+	}
+	for _, p := range globalSettings.WireGuardPeers {
+		fmt.Fprintf(&b, "\n[Peer]\nPublicKey = %s\n", p.PublicKey)
+		if len(p.AllowedIPs) > 0 {
+			fmt.Fprintf(&b, "AllowedIPs = %s\n", p.AllowedIPs)
+		}
+		if len(p.Endpoint) > 0 {
+			keepalive := p.Keepalive
+			if keepalive <= 0 {
+				keepalive = WIREGUARD_KEEPALIVE
+			}
+			fmt.Fprintf(&b, "Endpoint = %s\nPersistentKeepalive = %d\n", p.Endpoint, keepalive)
+		}
+	}
+	return b.String()
+}
+
+func runWireGuardCommand(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %s", name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func stopWireGuard() {
+	if _, err := net.InterfaceByName(WIREGUARD_IFACE); err == nil {
+		runWireGuardCommand("ip", "link", "del", WIREGUARD_IFACE)
+		logInfof("wireguard", "%s removed", WIREGUARD_IFACE)
+	}
+}
+
+// Creates wg0 with the current settings. Routes are added for allowed IPs outside the interface network, except
+// default routes: the tunnel is for remote access only, the internet connection stays as it is.
+func startWireGuard() error {
+	stopWireGuard()
+	privateKey, err := wireguardPrivateKey(false)
+	if err != nil {
+		return err
+	}
+	_, ifaceNet, err := net.ParseCIDR(globalSettings.WireGuardAddress)
+	if err != nil {
+		return fmt.Errorf("invalid address '%s'", globalSettings.WireGuardAddress)
+	}
+	if err := runWireGuardCommand("ip", "link", "add", WIREGUARD_IFACE, "type", "wireguard"); err != nil {
+		return err
+	}
+	conf, err := ioutil.TempFile("", "wg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(conf.Name())
+	conf.WriteString(wireguardConfig(privateKey))
+	conf.Close()
+	if err := runWireGuardCommand("wg", "setconf", WIREGUARD_IFACE, conf.Name()); err != nil {
+		// e.g. the endpoint can't be resolved yet, no internet connection
+		stopWireGuard()
+		return err
+	}
+	if err := runWireGuardCommand("ip", "address", "add", globalSettings.WireGuardAddress, "dev", WIREGUARD_IFACE); err != nil {
+		stopWireGuard()
+		return err
+	}
+	if err := runWireGuardCommand("ip", "link", "set", WIREGUARD_IFACE, "up"); err != nil {
+		stopWireGuard()
+		return err
+	}
+	for _, p := range globalSettings.WireGuardPeers {
+		for _, cidr := range strings.Split(p.AllowedIPs, ",") {
+			ip, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+			if err != nil || ifaceNet.Contains(ip) {
+				continue
+			}
+			if ones, _ := n.Mask.Size(); ones == 0 {
+				logInfof("wireguard", "not routing %s through the tunnel", n.String())
+				continue
+			}
+			if err := runWireGuardCommand("ip", "route", "replace", n.String(), "dev", WIREGUARD_IFACE); err != nil {
+				logErrorf("wireguard", "%s", err.Error())
+			}
+		}
+	}
+	logInfof("wireguard", "%s up with %s, %d peer(s)", WIREGUARD_IFACE, globalSettings.WireGuardAddress, len(globalSettings.WireGuardPeers))
+	return nil
+}
+
+func wireguardSettingsKey() string {
+	peers, _ := json.Marshal(globalSettings.WireGuardPeers)
+	return fmt.Sprintf("%s/%d/%s", globalSettings.WireGuardAddress, globalSettings.WireGuardListenPort, peers)
+}
+
+func setWireGuardError(err error) {
+	wireguardMutex.Lock()
+	defer wireguardMutex.Unlock()
+	if err != nil {
+		wireguardError = err.Error()
+	} else {
+		wireguardError = ""
+	}
+}
+
+// Parses "wg show wg0 dump": the interface line, then one line per peer (public key, preshared key, endpoint,
+// allowed IPs, latest handshake, rx, tx, keepalive).
+func wireguardPeerStatus() ([]WireGuardPeerStatus, error) {
+	out, err := exec.Command("wg", "show", WIREGUARD_IFACE, "dump").Output()
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, p := range globalSettings.WireGuardPeers {
+		names[p.PublicKey] = p.Name
+	}
+	peers := make([]WireGuardPeerStatus, 0)
+	for i, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if i == 0 || len(fields) < 7 {
+			continue
+		}
+		p := WireGuardPeerStatus{Name: names[fields[0]], PublicKey: fields[0], LatestHandshake: -1}
+		if fields[2] != "(none)" {
+			p.Endpoint = fields[2]
+		}
+		if t, _ := strconv.ParseInt(fields[4], 10, 64); t > 0 {
+			p.LatestHandshake = time.Since(time.Unix(t, 0)).Seconds()
+		}
+		p.RxBytes, _ = strconv.ParseUint(fields[5], 10, 64)
+		p.TxBytes, _ = strconv.ParseUint(fields[6], 10, 64)
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+// Sets the endpoints of the peers without recent handshake again, so a changed (dynamic DNS) address is resolved.
+func reresolveWireGuardEndpoints() {
+	status, err := wireguardPeerStatus()
+	if err != nil {
+		return
+	}
+	for _, p := range globalSettings.WireGuardPeers {
+		if len(p.Endpoint) == 0 {
+			continue
+		}
+		for _, s := range status {
+			if s.PublicKey == p.PublicKey && (s.LatestHandshake < 0 || s.LatestHandshake > WIREGUARD_RERESOLVE_AGE.Seconds()) {
+				runWireGuardCommand("wg", "set", WIREGUARD_IFACE, "peer", p.PublicKey, "endpoint", p.Endpoint)
+			}
+		}
+	}
+}
+
+// Keeps wg0 up while globalSettings.WireGuardEnabled, reconfigures it when the settings change.
+func wireguardManager() {
+	running, failed := "", ""
+	lastTry := time.Time{}
+	for {
+		restart := false
+		select {
+		case <-wireguardRestart:
+			restart = true
+			running = ""
+		case <-time.After(5 * time.Second):
+		}
+		if !globalSettings.WireGuardEnabled {
+			if len(running) > 0 {
+				stopWireGuard()
+				running = ""
+			}
+			continue
+		}
+		key := wireguardSettingsKey()
+		if key == running {
+			if _, err := net.InterfaceByName(WIREGUARD_IFACE); err == nil {
+				reresolveWireGuardEndpoints()
+				continue
+			}
+			running = ""
+		}
+		if !restart && key == failed && time.Since(lastTry) < WIREGUARD_RETRY_INTERVAL {
+			continue
+		}
+		lastTry = time.Now()
+		err := startWireGuard()
+		setWireGuardError(err)
+		if err != nil {
+			logErrorf("wireguard", "%s", err.Error())
+			failed = key
+			continue
+		}
+		running, failed = key, ""
+	}
+}
+
+func getWireGuardStatus() WireGuardStatus {
+	status := WireGuardStatus{
+		Enabled:    globalSettings.WireGuardEnabled,
+		Address:    globalSettings.WireGuardAddress,
+		ListenPort: globalSettings.WireGuardListenPort,
+		Peers:      make([]WireGuardPeerStatus, 0),
+	}
+	// The public key is needed to configure the peers before the tunnel is enabled, generate the key pair now
+	if _, err := exec.LookPath("wg"); err == nil {
+		if key, err := wireguardPrivateKey(false); err == nil {
+			status.PublicKey, _ = wireguardPublicKey(key)
+		}
+	}
+	if peers, err := wireguardPeerStatus(); err == nil {
+		status.Up = true
+		status.Peers = peers
+	}
+	wireguardMutex.Lock()
+	status.Error = wireguardError
+	wireguardMutex.Unlock()
+	return status
+}
+
+// AJAX call - /getWireGuard. Status of the tunnel and the public key to configure on the peers.
+func handleWireGuardGetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	statusJSON, err := json.Marshal(getWireGuardStatus())
+	if err != nil {
+		logErrorf("wireguard", "Error sending WireGuard status JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
+
+// AJAX call - /setWireGuard?action=regenerate. Generates a new key pair and restarts the tunnel with it.
+func handleWireGuardSetRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("action") != "regenerate" {
+		http.Error(w, "unknown action", http.StatusBadRequest)
+		return
+	}
+	if _, err := wireguardPrivateKey(true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case wireguardRestart <- struct{}{}:
+	default:
+	}
+	handleWireGuardGetRequest(w, r)
+}
@@ -0,0 +1,277 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wxadvisories.go: FIS-B AIRMETs (product 11), SIGMETs (12), G-AIRMETs (14) and CWAs (15) with their areas, and
+		alerts when ownship's track crosses an icing, turbulence or IFR area.
+		The products are overlays like the NOTAMs (see tfr.go, uatparse/overlay.go): text and graphics are merged by
+		product, location, report number and year, the shapes of an area are merged from its lowest to its highest
+		altitude. The hazard of a G-AIRMET area is its object element, the one of the other products is taken from
+		the text (wxAdvisoryHazardWords). Advisories are dropped when cancelled or not received for
+		WX_ADVISORY_MAX_AGE.
+		Every second, the current position and the position projected along the track at the current altitude
+		for up to WX_ADVISORY_LOOKAHEAD are checked against the areas of the alerting hazards that are valid when
+		the position is reached. /getWxAdvisories returns the advisories and the current alerts.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/uatparse"
+)
+
+const (
+	WX_ADVISORY_MAX_AGE        = 60 * time.Minute // not received for this long: dropped
+	WX_ADVISORY_LOOKAHEAD      = 1800.0           // s
+	WX_ADVISORY_LOOKAHEAD_STEP = 60.0             // s
+
+	WX_HAZARD_ICING      = "ICING"
+	WX_HAZARD_TURBULENCE = "TURBULENCE"
+	WX_HAZARD_IFR        = "IFR"
+	WX_HAZARD_MTN_OBSCN  = "MTN_OBSCN"
+	WX_HAZARD_LLWS       = "LLWS"
+	WX_HAZARD_SFC_WIND   = "SFC_WIND"
+	WX_HAZARD_FRZLVL     = "FRZLVL"
+	WX_HAZARD_CONVECTIVE = "CONVECTIVE"
+)
+
+var wxAdvisoryProducts = map[uint32]string{
+	11: "AIRMET",
+	12: "SIGMET",
+	14: "G-AIRMET",
+	15: "CWA",
+}
+
+// Object elements of G-AIRMET areas, DO-358.
+var wxAdvisoryElementHazards = map[uint8]string{
+	1: WX_HAZARD_TURBULENCE,
+	2: WX_HAZARD_LLWS,
+	3: WX_HAZARD_SFC_WIND,
+	4: WX_HAZARD_ICING,
+	5: WX_HAZARD_FRZLVL,
+	6: WX_HAZARD_IFR,
+	7: WX_HAZARD_MTN_OBSCN,
+}
+
+// Hazards in the text of AIRMETs/SIGMETs/CWAs, the first match wins.
+var wxAdvisoryHazardWords = []struct {
+	word   string
+	hazard string
+}{
+	{"CONVECTIVE", WX_HAZARD_CONVECTIVE},
+	{" TS", WX_HAZARD_CONVECTIVE},
+	{"ICE", WX_HAZARD_ICING},
+	{"ICG", WX_HAZARD_ICING},
+	{"TURB", WX_HAZARD_TURBULENCE},
+	{"IFR", WX_HAZARD_IFR},
+	{"MTN OBSC", WX_HAZARD_MTN_OBSCN},
+	{"LLWS", WX_HAZARD_LLWS},
+	{"SFC WND", WX_HAZARD_SFC_WIND},
+	{"FRZLVL", WX_HAZARD_FRZLVL},
+}
+
+// Hazards that are alerted on.
+var wxAdvisoryAlertHazards = map[string]bool{
+	WX_HAZARD_ICING:      true,
+	WX_HAZARD_TURBULENCE: true,
+	WX_HAZARD_IFR:        true,
+	WX_HAZARD_MTN_OBSCN:  true,
+}
+
+type WxAdvisory struct {
+	Product      string // AIRMET, SIGMET, G-AIRMET, CWA
+	Location     string
+	ReportNumber uint16
+	ReportYear   uint16
+	Hazard       string // WX_HAZARD_*, "" if unknown
+	Text         string
+	Shapes       []NotamShape
+	Active       bool // an area is valid now, set in /getWxAdvisories
+	Received     time.Time
+	lastSeen     time.Time // stratuxClock
+}
+
+// Ownship's position or projected track inside the area of an advisory.
+type WxAdvisoryAlert struct {
+	Advisory  string // key of the advisory
+	Product   string
+	Hazard    string
+	Seconds   int   // until the area is entered, 0 if inside
+	AltBottom int32 // ft, of the entered area
+	AltTop    int32
+	AGL       bool
+}
+
+// Response of /getWxAdvisories.
+type WxAdvisoryStatus struct {
+	Advisories []*WxAdvisory
+	Alerts     []WxAdvisoryAlert
+}
+
+var wxAdvisories = make(map[string]*WxAdvisory)
+var wxAdvisoryAlerts = make([]WxAdvisoryAlert, 0)
+var wxAdvisoriesMutex = &sync.Mutex{}
+
+func wxAdvisoryKey(product, location string, number, year uint16) string {
+	return product + " " + notamKey(location, number, year)
+}
+
+func wxAdvisoryTextHazard(text string) string {
+	text = " " + strings.ToUpper(text)
+	for _, w := range wxAdvisoryHazardWords {
+		if strings.Contains(text, w.word) {
+			return w.hazard
+		}
+	}
+	return ""
+}
+
+// Called for every decoded FIS-B frame from parseInput().
+func updateWxAdvisories(f *uatparse.UATFrame) {
+	product, ok := wxAdvisoryProducts[f.Product_id]
+	if !ok || len(f.Records) == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	wxAdvisoriesMutex.Lock()
+	defer wxAdvisoriesMutex.Unlock()
+	for i := range f.Records {
+		r := &f.Records[i]
+		key := wxAdvisoryKey(product, f.LocationIdentifier, r.ReportNumber, r.ReportYear)
+		if r.Format == uatparse.OVERLAY_RECORD_TEXT && r.Cancelled {
+			delete(wxAdvisories, key)
+			continue
+		}
+		a, ok := wxAdvisories[key]
+		if !ok {
+			a = &WxAdvisory{Product: product, Location: strings.TrimSpace(f.LocationIdentifier), ReportNumber: r.ReportNumber,
+				ReportYear: r.ReportYear}
+			wxAdvisories[key] = a
+		}
+		a.Received = now
+		a.lastSeen = stratuxClock.Time
+		switch r.Format {
+		case uatparse.OVERLAY_RECORD_TEXT:
+			a.Text = strings.TrimSpace(r.Text)
+			if hazard := wxAdvisoryTextHazard(a.Text); len(hazard) > 0 && product != "G-AIRMET" {
+				a.Hazard = hazard
+			}
+		case uatparse.OVERLAY_RECORD_GRAPHICAL:
+			if product == "G-AIRMET" {
+				a.Hazard = wxAdvisoryElementHazards[r.Element]
+			}
+			if s, ok := makeNotamShape(r, now); ok {
+				a.Shapes = addNotamShape(a.Shapes, s)
+			}
+		}
+	}
+
+	for key, a := range wxAdvisories {
+		if stratuxClock.Since(a.lastSeen) > WX_ADVISORY_MAX_AGE {
+			delete(wxAdvisories, key)
+		}
+	}
+}
+
+// Advisory areas of the alerting hazards on ownship's position and projected track, the earliest one per
+// advisory. Requires wxAdvisoriesMutex.
+func computeWxAdvisoryAlerts() []WxAdvisoryAlert {
+	alerts := make([]WxAdvisoryAlert, 0)
+	if !isGPSValid() || len(wxAdvisories) == 0 {
+		return alerts
+	}
+	now := time.Now().UTC()
+	lat, lng := float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+	alt := float64(mySituation.GPSAltitudeMSL)
+	lookahead := 0.0
+	if mySituation.GPSGroundSpeed >= TFR_MIN_SPEED {
+		lookahead = WX_ADVISORY_LOOKAHEAD
+	}
+	alerted := make(map[string]bool)
+	for t := 0.0; t <= lookahead; t += WX_ADVISORY_LOOKAHEAD_STEP {
+		pLat, pLng := lat, lng
+		if t > 0 {
+			pLat, pLng = calcLocationForBearingDistance(lat, lng, float64(mySituation.GPSTrueCourse), mySituation.GPSGroundSpeed*t/3600)
+		}
+		pTime := now.Add(time.Duration(t) * time.Second)
+		for key, a := range wxAdvisories {
+			if alerted[key] || !wxAdvisoryAlertHazards[a.Hazard] {
+				continue
+			}
+			for i := range a.Shapes {
+				s := &a.Shapes[i]
+				if !isNotamShapeActive(s, pTime) || !notamShapeContains(s, pLat, pLng, alt) {
+					continue
+				}
+				alerts = append(alerts, WxAdvisoryAlert{Advisory: key, Product: a.Product, Hazard: a.Hazard, Seconds: int(t),
+					AltBottom: s.AltBottom, AltTop: s.AltTop, AGL: s.AGL})
+				alerted[key] = true
+				break
+			}
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].Seconds < alerts[j].Seconds })
+	return alerts
+}
+
+// Called every second from heartBeatSender().
+func updateWxAdvisoryAlerts() {
+	wxAdvisoriesMutex.Lock()
+	defer wxAdvisoriesMutex.Unlock()
+	alerts := computeWxAdvisoryAlerts()
+	prev := make(map[string]bool)
+	for _, a := range wxAdvisoryAlerts {
+		prev[a.Advisory] = true
+	}
+	for _, a := range alerts {
+		if !prev[a.Advisory] {
+			logInfof("weather", "Weather advisory alert: %s (%s), %ds", a.Advisory, a.Hazard, a.Seconds)
+		}
+	}
+	wxAdvisoryAlerts = alerts
+}
+
+// AJAX call - /getWxAdvisories?product=<AIRMET|SIGMET|G-AIRMET|CWA>&hazard=<ICING|...>. All advisories (of the
+// product/hazard) and the current alerts.
+func handleWxAdvisoriesRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	product := strings.ToUpper(r.URL.Query().Get("product"))
+	hazard := strings.ToUpper(r.URL.Query().Get("hazard"))
+	now := time.Now().UTC()
+	status := WxAdvisoryStatus{Advisories: make([]*WxAdvisory, 0)}
+	wxAdvisoriesMutex.Lock()
+	status.Alerts = wxAdvisoryAlerts
+	for _, a := range wxAdvisories {
+		if (len(product) > 0 && a.Product != product) || (len(hazard) > 0 && a.Hazard != hazard) {
+			continue
+		}
+		c := *a
+		c.Active = false
+		for i := range c.Shapes {
+			c.Active = c.Active || isNotamShapeActive(&c.Shapes[i], now)
+		}
+		status.Advisories = append(status.Advisories, &c)
+	}
+	wxAdvisoriesMutex.Unlock()
+	sort.Slice(status.Advisories, func(i, j int) bool {
+		return wxAdvisoryKey(status.Advisories[i].Product, status.Advisories[i].Location, status.Advisories[i].ReportNumber, status.Advisories[i].ReportYear) <
+			wxAdvisoryKey(status.Advisories[j].Product, status.Advisories[j].Location, status.Advisories[j].ReportNumber, status.Advisories[j].ReportYear)
+	})
+
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		logErrorf("weather", "Error sending weather advisory JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", statusJSON)
+}
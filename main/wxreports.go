@@ -0,0 +1,623 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	wxreports.go: Decoding of the FIS-B text products METAR/SPECI, TAF, PIREP and WINDS (see windsaloft.go) into
+		structured reports. Reports are kept until they expire (METAR/SPECI WX_METAR_MAX_AGE after the observation, TAF
+		at the end of its validity, PIREP WX_PIREP_MAX_AGE after the report, WINDS WX_WINDS_MAX_AGE after the time of
+		the data) and can be queried with
+			/getWeatherReports?ident=KOSH[,KATW]&type=METAR       reports of stations, optionally of one type
+			/getWeatherReports?nearest=5&type=METAR[&lat=..&lng=..]  reports of the stations closest to ownship (or lat/lng)
+		New and updated reports are sent on the /wxreports websocket, all current ones when a client connects.
+		FIS-B doesn't tell where a station is. Station positions are read from WX_STATIONS_FILE ("ident,lat,lng" per line)
+		if it exists, otherwise the position of the ground station that uplinked the report is used (LocationSource).
+		Reports fetched from the internet (see internetweather.go) are stored the same way, Source tells them apart.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/b3nn0/stratux/common"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	WX_STATIONS_FILE = STRATUX_HOME + "cfg/wxstations.csv"
+	WX_METAR_MAX_AGE = 2 * time.Hour
+	WX_PIREP_MAX_AGE = 90 * time.Minute
+	WX_TAF_MAX_AGE   = 30 * time.Hour // if the validity can't be decoded
+)
+
+// Cloud layer, ft AGL.
+type WxCloudLayer struct {
+	Cover  string // FEW, SCT, BKN, OVC, VV
+	Height int
+	Type   string `json:",omitempty"` // CB, TCU
+}
+
+// Observed (METAR) or forecast (TAF) conditions.
+type WxConditions struct {
+	WindDir        int     // deg true, -1 = variable
+	WindSpeed      int     // kt
+	WindGust       int     // kt, 0 = none
+	Visibility     float64 // SM, -1 = unknown. 10 for CAVOK, P6SM is 6
+	Weather        []string
+	Clouds         []WxCloudLayer
+	Ceiling        int     // ft AGL, lowest broken/overcast/obscured layer, -1 = none
+	Temperature    *int    `json:",omitempty"` // deg C
+	Dewpoint       *int    `json:",omitempty"`
+	Altimeter      float64 // inHg, 0 = unknown
+	FlightCategory string  // VFR, MVFR, IFR, LIFR, "" if unknown
+}
+
+// Forecast period of a TAF.
+type WxForecast struct {
+	Change string // "" (base forecast), FM, BECMG, TEMPO, PROB30, PROB40, PROB30 TEMPO, ...
+	From   time.Time
+	To     time.Time
+	WxConditions
+}
+
+type WxPirep struct {
+	Urgent       bool   // UUA
+	Location     string // /OV
+	FlightLevel  int    // /FL, ft MSL. 0 = unknown
+	AircraftType string // /TP
+	Sky          string // /SK
+	Weather      string // /WX
+	Temperature  *int   `json:",omitempty"` // /TA, deg C
+	Wind         string // /WV
+	Turbulence   string // /TB
+	Icing        string // /IC
+	Remarks      string // /RM
+}
+
+type WxReport struct {
+	Type           string // METAR, SPECI, TAF, PIREP, WINDS
+	Station        string
+	Time           time.Time // observation, issue or report time
+	Expires        time.Time
+	Raw            string
+	Lat            float64
+	Lng            float64
+	LocationSource string         // "station" (WX_STATIONS_FILE or internet weather) or "tower"
+	Source         string         // WX_SOURCE_FISB or WX_SOURCE_INTERNET
+	Metar          *WxConditions  `json:",omitempty"` // METAR, SPECI
+	Taf            []WxForecast   `json:",omitempty"`
+	Pirep          *WxPirep       `json:",omitempty"`
+	Winds          []WxWindsLevel `json:",omitempty"`
+	FlightCategory string         // of the METAR, or of the TAF period valid now
+	Received       time.Time
+	Distance       float64 `json:",omitempty"` // nm, only in /getWeatherReports?nearest
+}
+
+var wxReports = make(map[string]*WxReport) // type + station (+ text for PIREPs) -> report
+var wxStations map[string][2]float64
+var wxReportsMutex = &sync.Mutex{}
+var wxReportUpdate *uibroadcaster
+
+var (
+	wxWindRe     = regexp.MustCompile(`^(\d{3}|VRB)(\d{2,3})(?:G(\d{2,3}))?(KT|MPS)$`)
+	wxVisRe      = regexp.MustCompile(`^([PM])?(?:(\d+)|(\d)/(\d{1,2}))SM$`)
+	wxCloudRe    = regexp.MustCompile(`^(FEW|SCT|BKN|OVC|VV)(\d{3}|///)(CB|TCU)?$`)
+	wxTempRe     = regexp.MustCompile(`^(M?\d{2})/(M?\d{2})?$`)
+	wxWeatherRe  = regexp.MustCompile(`^(?:-|\+|VC)?(?:MI|PR|BC|DR|BL|SH|TS|FZ)?(?:DZ|RA|SN|SG|IC|PL|GR|GS|UP|BR|FG|FU|VA|DU|SA|HZ|PY|PO|SQ|FC|SS|DS)*$`)
+	wxTimeRe     = regexp.MustCompile(`^(\d{2})(\d{2})(\d{2})Z$`)
+	wxPeriodRe   = regexp.MustCompile(`^(\d{2})(\d{2})/(\d{2})(\d{2})$`)
+	wxFromRe     = regexp.MustCompile(`^FM(\d{2})(\d{2})(\d{2})$`)
+	wxProbRe     = regexp.MustCompile(`^PROB(\d{2})$`)
+	wxPirepFLRe  = regexp.MustCompile(`^(\d{3})`)
+	wxPirepTmpRe = regexp.MustCompile(`^(M|-)?(\d{1,2})`)
+)
+
+// Time of day/hour/minute in the month of now (or the one before/after, whichever is closest).
+func wxDayTime(day, hour, min int, now time.Time) time.Time {
+	best := time.Time{}
+	for _, m := range []int{-1, 0, 1} {
+		t := time.Date(now.Year(), now.Month()+time.Month(m), day, hour, min, 0, 0, time.UTC)
+		if t.Day() != day && hour < 24 {
+			continue // day doesn't exist in that month
+		}
+		if best.IsZero() || math.Abs(t.Sub(now).Hours()) < math.Abs(best.Sub(now).Hours()) {
+			best = t
+		}
+	}
+	return best
+}
+
+func wxAtoi(s string) int {
+	neg := strings.HasPrefix(s, "M") || strings.HasPrefix(s, "-")
+	v, _ := strconv.Atoi(strings.TrimLeft(s, "M-"))
+	if neg {
+		return -v
+	}
+	return v
+}
+
+/*
+parseWxConditions().
+
+	Decodes the wind, visibility, weather, cloud, temperature and altimeter groups of a METAR or TAF period.
+	Unknown groups are ignored.
+*/
+func parseWxConditions(tokens []string) WxConditions {
+	c := WxConditions{Visibility: -1, Ceiling: -1, Weather: make([]string, 0), Clouds: make([]WxCloudLayer, 0)}
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if m := wxWindRe.FindStringSubmatch(tok); m != nil {
+			c.WindDir = -1
+			if m[1] != "VRB" {
+				c.WindDir = wxAtoi(m[1])
+			}
+			c.WindSpeed = wxAtoi(m[2])
+			c.WindGust = wxAtoi(m[3])
+			if m[4] == "MPS" {
+				c.WindSpeed = int(float64(c.WindSpeed)*1.94384 + 0.5)
+				c.WindGust = int(float64(c.WindGust)*1.94384 + 0.5)
+			}
+			continue
+		}
+		// "1 1/2SM" is split into two tokens
+		if whole, err := strconv.Atoi(tok); err == nil && len(tok) == 1 && i+1 < len(tokens) && strings.Contains(tokens[i+1], "/") {
+			if m := wxVisRe.FindStringSubmatch(tokens[i+1]); m != nil && len(m[3]) > 0 {
+				c.Visibility = float64(whole) + float64(wxAtoi(m[3]))/float64(wxAtoi(m[4]))
+				i++
+				continue
+			}
+		}
+		if m := wxVisRe.FindStringSubmatch(tok); m != nil {
+			if len(m[2]) > 0 {
+				c.Visibility = float64(wxAtoi(m[2]))
+			} else if d := wxAtoi(m[4]); d > 0 {
+				c.Visibility = float64(wxAtoi(m[3])) / float64(d)
+			}
+			continue
+		}
+		if len(tok) == 4 && c.Visibility < 0 {
+			if v, err := strconv.Atoi(tok); err == nil { // metric, 9999 = 10km or more
+				c.Visibility = math.Round(float64(v)/1609.34*100) / 100
+				continue
+			}
+		}
+		switch tok {
+		case "CAVOK":
+			c.Visibility = 10
+			continue
+		case "SKC", "CLR", "NSC", "NCD", "NSW":
+			continue
+		}
+		if m := wxCloudRe.FindStringSubmatch(tok); m != nil {
+			layer := WxCloudLayer{Cover: m[1], Height: wxAtoi(m[2]) * 100, Type: m[3]}
+			c.Clouds = append(c.Clouds, layer)
+			if (layer.Cover == "BKN" || layer.Cover == "OVC" || layer.Cover == "VV") && m[2] != "///" && (c.Ceiling < 0 || layer.Height < c.Ceiling) {
+				c.Ceiling = layer.Height
+			}
+			continue
+		}
+		if m := wxTempRe.FindStringSubmatch(tok); m != nil {
+			t := wxAtoi(m[1])
+			c.Temperature = &t
+			if len(m[2]) > 0 {
+				d := wxAtoi(m[2])
+				c.Dewpoint = &d
+			}
+			continue
+		}
+		if len(tok) == 5 && (tok[0] == 'A' || tok[0] == 'Q') {
+			if v, err := strconv.Atoi(tok[1:]); err == nil {
+				if tok[0] == 'A' {
+					c.Altimeter = float64(v) / 100
+				} else {
+					c.Altimeter = math.Round(float64(v)*0.02953*100) / 100
+				}
+				continue
+			}
+		}
+		if len(tok) >= 2 && wxWeatherRe.MatchString(tok) {
+			c.Weather = append(c.Weather, tok)
+		}
+	}
+	c.FlightCategory = wxFlightCategory(c.Ceiling, c.Visibility)
+	return c
+}
+
+// FAA flight category from ceiling (ft, -1 = none) and visibility (SM, -1 = unknown).
+func wxFlightCategory(ceiling int, visibility float64) string {
+	if visibility < 0 && ceiling < 0 {
+		return ""
+	}
+	switch {
+	case (ceiling >= 0 && ceiling < 500) || (visibility >= 0 && visibility < 1):
+		return "LIFR"
+	case (ceiling >= 0 && ceiling < 1000) || (visibility >= 0 && visibility < 3):
+		return "IFR"
+	case (ceiling >= 0 && ceiling <= 3000) || (visibility >= 0 && visibility <= 5):
+		return "MVFR"
+	}
+	return "VFR"
+}
+
+// tokens start after station and time, the remarks are not decoded.
+func parseMetar(tokens []string) *WxConditions {
+	for i, tok := range tokens {
+		if tok == "RMK" {
+			tokens = tokens[:i]
+			break
+		}
+	}
+	c := parseWxConditions(tokens)
+	return &c
+}
+
+// tokens start after station and issue time, with the validity period.
+func parseTaf(tokens []string, now time.Time) ([]WxForecast, time.Time, time.Time) {
+	var validFrom, validTo time.Time
+	period := func(tok string) (time.Time, time.Time, bool) {
+		m := wxPeriodRe.FindStringSubmatch(tok)
+		if m == nil {
+			return time.Time{}, time.Time{}, false
+		}
+		return wxDayTime(wxAtoi(m[1]), wxAtoi(m[2]), 0, now), wxDayTime(wxAtoi(m[3]), wxAtoi(m[4]), 0, now), true
+	}
+	if len(tokens) > 0 {
+		if from, to, ok := period(tokens[0]); ok {
+			validFrom, validTo = from, to
+			tokens = tokens[1:]
+		}
+	}
+
+	forecasts := make([]WxForecast, 0)
+	cur := WxForecast{From: validFrom, To: validTo}
+	var groups []string
+	flush := func() {
+		cur.WxConditions = parseWxConditions(groups)
+		forecasts = append(forecasts, cur)
+		groups = nil
+	}
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+		if tok == "RMK" {
+			break
+		}
+		if m := wxFromRe.FindStringSubmatch(tok); m != nil {
+			flush()
+			cur = WxForecast{Change: "FM", From: wxDayTime(wxAtoi(m[1]), wxAtoi(m[2]), wxAtoi(m[3]), now), To: validTo}
+			continue
+		}
+		if tok == "BECMG" || tok == "TEMPO" || wxProbRe.MatchString(tok) {
+			flush()
+			cur = WxForecast{Change: tok}
+			if wxProbRe.MatchString(tok) && i+1 < len(tokens) && tokens[i+1] == "TEMPO" {
+				cur.Change += " TEMPO"
+				i++
+			}
+			if i+1 < len(tokens) {
+				if from, to, ok := period(tokens[i+1]); ok {
+					cur.From, cur.To = from, to
+					i++
+				}
+			}
+			continue
+		}
+		groups = append(groups, tok)
+	}
+	flush()
+
+	// FM groups end where the next one starts
+	for i := range forecasts {
+		if forecasts[i].Change != "FM" && forecasts[i].Change != "" {
+			continue
+		}
+		for j := i + 1; j < len(forecasts); j++ {
+			if forecasts[j].Change == "FM" {
+				forecasts[i].To = forecasts[j].From
+				break
+			}
+		}
+	}
+	return forecasts, validFrom, validTo
+}
+
+// Flight category of the TAF at time t: the base/FM period, replaced by BECMG and worsened by TEMPO/PROB periods.
+func wxTafFlightCategory(forecasts []WxForecast, t time.Time) string {
+	rank := map[string]int{"": -1, "VFR": 0, "MVFR": 1, "IFR": 2, "LIFR": 3}
+	valid := func(f *WxForecast) bool {
+		return f.From.IsZero() || (!t.Before(f.From) && (f.To.IsZero() || t.Before(f.To)))
+	}
+	cat := ""
+	for i := range forecasts {
+		f := &forecasts[i]
+		if f.FlightCategory == "" {
+			continue
+		}
+		switch f.Change {
+		case "", "FM":
+			if valid(f) {
+				cat = f.FlightCategory
+			}
+		case "BECMG": // persists after the change
+			if !f.From.IsZero() && !t.Before(f.From) {
+				cat = f.FlightCategory
+			}
+		default:
+			if valid(f) && rank[f.FlightCategory] > rank[cat] {
+				cat = f.FlightCategory
+			}
+		}
+	}
+	return cat
+}
+
+// PIREP after the station and time, e.g. "UA /OV OSH270010 /TM 1753 /FL080 /TP C172 /TB LGT".
+func parsePirep(text string) *WxPirep {
+	p := &WxPirep{}
+	fields := strings.Split(text, "/")
+	p.Urgent = strings.Contains(fields[0], "UUA")
+	for _, f := range fields[1:] {
+		f = strings.TrimSpace(f)
+		if len(f) < 2 {
+			continue
+		}
+		val := strings.TrimSpace(f[2:])
+		switch f[:2] {
+		case "OV":
+			p.Location = val
+		case "FL":
+			if m := wxPirepFLRe.FindStringSubmatch(val); m != nil {
+				p.FlightLevel = wxAtoi(m[1]) * 100
+			}
+		case "TP":
+			p.AircraftType = val
+		case "SK":
+			p.Sky = val
+		case "WX":
+			p.Weather = val
+		case "TA":
+			if m := wxPirepTmpRe.FindStringSubmatch(val); m != nil {
+				t := wxAtoi(m[2])
+				if len(m[1]) > 0 {
+					t = -t
+				}
+				p.Temperature = &t
+			}
+		case "WV":
+			p.Wind = val
+		case "TB":
+			p.Turbulence = val
+		case "IC":
+			p.Icing = val
+		case "RM":
+			p.Remarks = val
+		}
+	}
+	return p
+}
+
+/*
+decodeWxReport().
+
+	Decodes a FIS-B text report "<type> <station> <ddhhmmZ> <text>". Returns nil for other products.
+*/
+func decodeWxReport(msg string, now time.Time) *WxReport {
+	msg = strings.TrimRight(strings.TrimSpace(msg), "=")
+	tokens := strings.Fields(msg)
+	if len(tokens) < 4 {
+		return nil
+	}
+	r := &WxReport{Type: tokens[0], Station: tokens[1], Raw: msg, Received: stratuxClock.Time}
+	switch r.Type {
+	case "METAR", "SPECI", "TAF", "TAF.AMD", "PIREP", "WINDS":
+	default:
+		return nil
+	}
+	if m := wxTimeRe.FindStringSubmatch(tokens[2]); m != nil {
+		r.Time = wxDayTime(wxAtoi(m[1]), wxAtoi(m[2]), wxAtoi(m[3]), now)
+	} else {
+		r.Time = now
+	}
+
+	switch r.Type {
+	case "METAR", "SPECI":
+		r.Metar = parseMetar(tokens[3:])
+		r.FlightCategory = r.Metar.FlightCategory
+		r.Expires = r.Time.Add(WX_METAR_MAX_AGE)
+	case "TAF", "TAF.AMD":
+		r.Type = "TAF"
+		forecasts, _, validTo := parseTaf(tokens[3:], now)
+		r.Taf = forecasts
+		r.FlightCategory = wxTafFlightCategory(forecasts, now)
+		r.Expires = validTo
+		if validTo.IsZero() {
+			r.Expires = r.Time.Add(WX_TAF_MAX_AGE)
+		}
+	case "PIREP":
+		r.Pirep = parsePirep(strings.Join(tokens[3:], " "))
+		r.Expires = r.Time.Add(WX_PIREP_MAX_AGE)
+	case "WINDS":
+		r.Winds = parseWxWinds(tokens[3:])
+		r.Expires = r.Time.Add(WX_WINDS_MAX_AGE)
+	}
+	return r
+}
+
+// Reads WX_STATIONS_FILE once. Requires wxReportsMutex.
+func loadWxStations() {
+	if wxStations != nil {
+		return
+	}
+	wxStations = make(map[string][2]float64)
+	f, err := os.Open(WX_STATIONS_FILE)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) < 3 {
+			continue
+		}
+		lat, errLat := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		lng, errLng := strconv.ParseFloat(strings.TrimSpace(fields[2]), 64)
+		if errLat == nil && errLng == nil {
+			wxStations[strings.ToUpper(strings.TrimSpace(fields[0]))] = [2]float64{lat, lng}
+		}
+	}
+	logInfof("weather", "Read %d weather station positions from %s", len(wxStations), WX_STATIONS_FILE)
+}
+
+// Called from registerADSBTextMessageReceived() for every FIS-B text report.
+func registerWxReport(msg string, towerLat, towerLng float64) {
+	now := time.Now().UTC()
+	r := decodeWxReport(msg, now)
+	if r == nil {
+		return
+	}
+	wxReportsMutex.Lock()
+	defer wxReportsMutex.Unlock()
+	loadWxStations()
+	r.Lat, r.Lng, r.LocationSource = towerLat, towerLng, "tower"
+	if pos, ok := wxStations[r.Station]; ok {
+		r.Lat, r.Lng, r.LocationSource = pos[0], pos[1], "station"
+	}
+	r.Source = WX_SOURCE_FISB
+	storeWxReport(r, now)
+}
+
+// Adds or updates a decoded report and drops the expired ones. Requires wxReportsMutex.
+func storeWxReport(r *WxReport, now time.Time) {
+	key := r.Type + " " + r.Station
+	if r.Type == "PIREP" {
+		key += " " + r.Raw
+	}
+	if prev, ok := wxReports[key]; ok && prev.Raw == r.Raw {
+		prev.Received = r.Received // repeated uplink of the same report
+		return
+	} else if ok && prev.Time.After(r.Time) {
+		return
+	}
+	wxReports[key] = r
+	wxReportUpdate.SendJSON(r)
+
+	for k, old := range wxReports {
+		if now.After(old.Expires) {
+			delete(wxReports, k)
+		}
+	}
+}
+
+// Current reports matching type ("" = all) and ident (nil = all). Requires wxReportsMutex.
+func getWxReports(reportType string, idents map[string]bool) []WxReport {
+	now := time.Now().UTC()
+	reports := make([]WxReport, 0)
+	for _, r := range wxReports {
+		if now.After(r.Expires) || (len(reportType) > 0 && r.Type != reportType) || (idents != nil && !idents[r.Station]) {
+			continue
+		}
+		report := *r
+		if report.Type == "TAF" {
+			report.FlightCategory = wxTafFlightCategory(report.Taf, now)
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// AJAX call - /getWeatherReports?ident=<ident,...>|nearest=<n>[&lat=&lng=]&type=<METAR|SPECI|TAF|PIREP>
+func handleWeatherReportsRequest(w http.ResponseWriter, r *http.Request) {
+	setNoCache(w)
+	setJSONHeaders(w)
+	q := r.URL.Query()
+	reportType := strings.ToUpper(q.Get("type"))
+	var idents map[string]bool
+	if len(q.Get("ident")) > 0 {
+		idents = make(map[string]bool)
+		for _, id := range strings.Split(strings.ToUpper(q.Get("ident")), ",") {
+			idents[strings.TrimSpace(id)] = true
+		}
+	}
+
+	wxReportsMutex.Lock()
+	reports := getWxReports(reportType, idents)
+	wxReportsMutex.Unlock()
+
+	if n, err := strconv.Atoi(q.Get("nearest")); err == nil && n > 0 {
+		lat, errLat := strconv.ParseFloat(q.Get("lat"), 64)
+		lng, errLng := strconv.ParseFloat(q.Get("lng"), 64)
+		if errLat != nil || errLng != nil {
+			if !isGPSValid() {
+				http.Error(w, "no GPS position, lat/lng required", http.StatusBadRequest)
+				return
+			}
+			lat, lng = float64(mySituation.GPSLatitude), float64(mySituation.GPSLongitude)
+		}
+		for i := range reports {
+			dist, _ := common.Distance(lat, lng, reports[i].Lat, reports[i].Lng)
+			reports[i].Distance = dist / 1852
+		}
+		sort.Slice(reports, func(i, j int) bool { return reports[i].Distance < reports[j].Distance })
+		// n stations, with all their reports of the type
+		stations := make(map[string]bool)
+		for i := range reports {
+			if !stations[reports[i].Station] && len(stations) == n {
+				reports = reports[:i]
+				break
+			}
+			stations[reports[i].Station] = true
+		}
+	} else {
+		sort.Slice(reports, func(i, j int) bool {
+			if reports[i].Station != reports[j].Station {
+				return reports[i].Station < reports[j].Station
+			}
+			return reports[i].Time.After(reports[j].Time)
+		})
+	}
+
+	reportsJSON, err := json.Marshal(reports)
+	if err != nil {
+		logErrorf("weather", "Error sending weather reports JSON data: %s", err.Error())
+	}
+	fmt.Fprintf(w, "%s\n", reportsJSON)
+}
+
+/*
+The /wxreports websocket sends all current decoded reports, then new ones as they are received.
+*/
+func handleWxReportsWS(conn *websocket.Conn) {
+	wxReportsMutex.Lock()
+	for _, report := range getWxReports("", nil) {
+		reportJSON, _ := json.Marshal(&report)
+		conn.Write(reportJSON)
+	}
+	wxReportUpdate.AddSocket(conn)
+	wxReportsMutex.Unlock()
+
+	// Connection closes when function returns. Since uibroadcast is writing and we don't need to read anything (for now), just keep it busy.
+	for {
+		buf := make([]byte, 1024)
+		_, err := conn.Read(buf)
+		if err != nil {
+			break
+		}
+		if buf[0] != 0 { // Dummy.
+			continue
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
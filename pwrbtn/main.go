@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -19,6 +20,13 @@ const (
 	description = "monitor power button presses"
 
 	defaultPin = 22
+
+	pollInterval = 50 * time.Millisecond
+	// The button has to be pressed (and released) at least this long to count, contact bounce and noise are ignored.
+	debounceTime = 150 * time.Millisecond
+	// Holding the button at least this long toggles the USB log export instead of shutting down.
+	longPressTime       = 3 * time.Second
+	defaultUSBExportURL = "http://localhost/usbexporttoggle"
 )
 
 func handleCommand(service daemon.Daemon, command string) (string, error) {
@@ -40,6 +48,7 @@ func handleCommand(service daemon.Daemon, command string) (string, error) {
 
 func main() {
 	btnPin := flag.Int("pin", defaultPin, "power button pin (BCM numbering)")
+	usbExportURL := flag.String("usbexport", defaultUSBExportURL, "URL to toggle the USB log export on a long press, empty to disable")
 	flag.Parse()
 
 	service, err := daemon.New(name, description, daemon.SystemDaemon)
@@ -66,27 +75,55 @@ func main() {
 	pin := rpio.Pin(*btnPin)
 	pin.Input()
 	pin.PullUp()
-	pin.Detect(rpio.AnyEdge)
 
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, os.Interrupt, os.Kill, syscall.SIGTERM)
 
-	ticker := time.NewTicker(time.Second)
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 
+	pressed, lastRead := false, false // debounced and last read state
+	var lastChange, pressedSince time.Time
+	longPressHandled := false
 	for {
 		select {
 		case killSignal := <-interrupt:
 			fmt.Println("Got signal:", killSignal)
 			return
 		case <-ticker.C:
-			if pin.EdgeDetected() {
-				fmt.Println("Button press detected, shutting down...")
-				syscall.Sync()
-				if err := exec.Command("systemctl", "poweroff").Run(); err != nil {
-					log.Println(err)
+			if read := pin.Read() == rpio.Low; read != lastRead {
+				lastRead, lastChange = read, time.Now()
+			}
+			if lastRead != pressed && time.Since(lastChange) >= debounceTime {
+				pressed = lastRead
+				if pressed {
+					pressedSince, longPressHandled = lastChange, false
+				} else if !longPressHandled {
+					shutdown() // short press
 				}
 			}
+			if pressed && !longPressHandled && len(*usbExportURL) > 0 && time.Since(pressedSince) >= longPressTime {
+				fmt.Println("Long button press detected, toggling USB log export...")
+				toggleUSBExport(*usbExportURL)
+				longPressHandled = true
+			}
 		}
 	}
 }
+
+func shutdown() {
+	fmt.Println("Button press detected, shutting down...")
+	syscall.Sync()
+	if err := exec.Command("systemctl", "poweroff").Run(); err != nil {
+		log.Println(err)
+	}
+}
+
+func toggleUSBExport(url string) {
+	resp, err := http.Post(url, "text/plain", nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	resp.Body.Close()
+}
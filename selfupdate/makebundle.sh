@@ -0,0 +1,36 @@
+#!/bin/bash
+
+# Signs an update script made by makeupdate.sh and packs it into an update bundle (see main/updatemanager.go).
+#   ./makebundle.sh ../work/update-stratux-v1.6r1-eu033-1a2b3c4d5e.sh ~/stratux-update-key.pem
+# The key is an Ed25519 private key:
+#   openssl genpkey -algorithm ed25519 -out stratux-update-key.pem
+# Its public key goes to image/update-keys.pem, so the images and updates trust it:
+#   openssl pkey -in stratux-update-key.pem -pubout >> ../image/update-keys.pem
+
+set -e
+
+if [ $# -ne 2 ]; then
+	echo "usage: $0 <update-stratux-*.sh> <ed25519 private key>"
+	exit 1
+fi
+
+SCRIPT=$(realpath $1)
+KEY=$(realpath $2)
+SCRIPT_NAME=$(basename $SCRIPT)
+# update-stratux-<version>-<build>.sh
+VERSION=$(echo $SCRIPT_NAME | sed -e 's/^update-stratux-//' -e 's/-[0-9a-f]*\.sh$//')
+BUILD=$(echo $SCRIPT_NAME | sed -e 's/^.*-\([0-9a-f]*\)\.sh$/\1/')
+SHA256=$(sha256sum $SCRIPT | cut -d' ' -f1)
+
+WORK=$(mktemp -d)
+trap "rm -rf $WORK" EXIT
+cp $SCRIPT $WORK/
+cd $WORK
+echo -n "{\"Version\":\"${VERSION}\",\"Build\":\"${BUILD}\",\"Script\":\"${SCRIPT_NAME}\",\"SHA256\":\"${SHA256}\"}" > manifest.json
+openssl pkeyutl -sign -inkey $KEY -rawin -in manifest.json | base64 -w0 > manifest.sig
+OUTF="$(dirname $SCRIPT)/${SCRIPT_NAME%.sh}.stxupdate"
+tar cf $OUTF manifest.json manifest.sig $SCRIPT_NAME
+
+echo
+echo "$OUTF ready."
+echo
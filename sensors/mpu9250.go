@@ -1,3 +1,6 @@
+//go:build !nohw
+// +build !nohw
+
 // Package sensors provides a stratux interface to sensors used for AHRS calculations.
 package sensors
 
@@ -0,0 +1,193 @@
+package uatparse
+
+import (
+	"math"
+	"strings"
+	"time"
+)
+
+// Encoding of FIS-B products into uplink frames, the reverse of DecodeUplink(). Used to emulate the 978 uplink
+// for weather from other sources. Only what the decoder understands is generated: unsegmented APDUs with the
+// hours/minutes time format, text (product 413) and RLE NEXRAD blocks.
+
+const (
+	UPLINK_HEADER_BYTES   = 8
+	UPLINK_APP_DATA_BYTES = UPLINK_FRAME_DATA_BYTES - UPLINK_HEADER_BYTES
+	INFO_FRAME_MAX_BYTES  = UPLINK_APP_DATA_BYTES - 2 // Payload of one info frame filling the whole uplink.
+	APDU_HEADER_BYTES     = 4                         // t_opt 0.
+)
+
+// Packs text into DLAC, 4 characters into 3 bytes. Characters that don't exist in DLAC become spaces.
+func dlac_encode(s string) []byte {
+	s = strings.ToUpper(s)
+	chars := make([]byte, 0, len(s)+3)
+	for i := 0; i < len(s); i++ {
+		ch := strings.IndexByte(dlac_alpha, s[i])
+		if ch < 0 || s[i] == '\t' {
+			ch = strings.IndexByte(dlac_alpha, ' ')
+		}
+		chars = append(chars, byte(ch))
+	}
+	for len(chars)%4 != 0 {
+		chars = append(chars, 0) // ETX.
+	}
+	ret := make([]byte, 0, len(chars)/4*3)
+	for i := 0; i < len(chars); i += 4 {
+		ret = append(ret, chars[i]<<2|chars[i+1]>>4, chars[i+1]<<4|chars[i+2]>>2, chars[i+2]<<6|chars[i+3])
+	}
+	return ret
+}
+
+// Info frame (frame type 0, FIS-B) with an APDU of the given product.
+func encodeInfoFrame(product_id uint32, t time.Time, fisb_data []byte) []byte {
+	length := APDU_HEADER_BYTES + len(fisb_data)
+	ret := make([]byte, 2+length)
+	ret[0] = byte(length >> 1)
+	ret[1] = byte(length&0x01) << 7 // Frame type 0.
+	apdu := ret[2:]
+	apdu[0] = byte(product_id>>6) & 0x1f // a_f, g_f, p_f not set.
+	apdu[1] = byte(product_id&0x3f) << 2 // s_f not set, t_opt 0.
+	apdu[2] = byte(t.Hour())<<2 | byte(t.Minute())>>4
+	apdu[3] = byte(t.Minute()&0x0f) << 4
+	copy(apdu[APDU_HEADER_BYTES:], fisb_data)
+	return ret
+}
+
+// Text reports (product 413) as info frames. The reports are separated by record separators, as many as fit are
+// put into one frame. Reports longer than a frame are truncated.
+func EncodeTextFrames(reports []string, t time.Time) [][]byte {
+	ret := make([][]byte, 0)
+	max_chars := (INFO_FRAME_MAX_BYTES - APDU_HEADER_BYTES) / 3 * 4
+	text := ""
+	for _, r := range reports {
+		r = strings.TrimSpace(r)
+		if len(r)+1 > max_chars {
+			r = r[:max_chars-1]
+		}
+		if len(text)+len(r)+1 > max_chars {
+			ret = append(ret, encodeInfoFrame(413, t, dlac_encode(text)))
+			text = ""
+		}
+		text += r + "\x1E"
+	}
+	if len(text) > 0 {
+		ret = append(ret, encodeInfoFrame(413, t, dlac_encode(text)))
+	}
+	return ret
+}
+
+// Block number and hemisphere of the scale 0 block with the given north-west corner, the reverse of
+// block_location(). False beyond 60 degrees, where blocks are twice as wide.
+func NexradBlockNumber(lat_north, lon_west float64) (int, bool, bool) {
+	ns_flag := lat_north <= 0
+	ring := math.Round(lat_north/BLOCK_HEIGHT) - 1
+	if ns_flag {
+		ring = math.Round(-lat_north / BLOCK_HEIGHT)
+	}
+	if lon_west < 0 {
+		lon_west += 360
+	}
+	col := math.Round(lon_west / BLOCK_WIDTH)
+	block_num := int(ring)*BLOCKS_PER_RING + int(col)
+	if ring < 0 || col >= BLOCKS_PER_RING || block_num >= BLOCK_THRESHOLD {
+		return 0, false, false
+	}
+	return block_num, ns_flag, true
+}
+
+// One NEXRAD block (scale 0, 32x4 bins) as an RLE encoded info frame of the given product (63 or 64).
+func EncodeNexradFrame(product_id uint32, b NEXRADBlock, t time.Time) ([]byte, bool) {
+	block_num, ns_flag, ok := NexradBlockNumber(b.LatNorth, b.LonWest)
+	if !ok || b.Scale != 0 {
+		return nil, false
+	}
+	fisb_data := []byte{0x80 | byte(block_num>>16)&0x0f, byte(block_num >> 8), byte(block_num)}
+	if ns_flag {
+		fisb_data[0] |= 0x40
+	}
+	for i := 0; i < len(b.Intensity); {
+		intensity := b.Intensity[i] & 0x07
+		n := 1
+		for i+n < len(b.Intensity) && n < 32 && b.Intensity[i+n]&0x07 == intensity {
+			n++
+		}
+		fisb_data = append(fisb_data, byte(n-1)<<3|byte(intensity))
+		i += n
+	}
+	return encodeInfoFrame(product_id, t, fisb_data), true
+}
+
+// Packs info frames into uplink frames (UPLINK_FRAME_DATA_BYTES, as in dump978 output after the '+') with the
+// given ground station position.
+func EncodeUplinks(lat, lon float64, frames [][]byte) [][]byte {
+	if lat < 0 {
+		lat += 180
+	}
+	if lon < 0 {
+		lon += 360
+	}
+	raw_lat := uint32(lat*16777216.0/360.0) & 0x7fffff
+	raw_lon := uint32(lon*16777216.0/360.0) & 0xffffff
+	newUplink := func() []byte {
+		u := make([]byte, UPLINK_FRAME_DATA_BYTES)
+		u[0] = byte(raw_lat >> 15)
+		u[1] = byte(raw_lat >> 7)
+		u[2] = byte(raw_lat<<1) | byte(raw_lon>>23)
+		u[3] = byte(raw_lon >> 15)
+		u[4] = byte(raw_lon >> 7)
+		u[5] = byte(raw_lon<<1) | 0x01 // Position valid.
+		u[6] = 0x20                    // Application data valid.
+		return u
+	}
+
+	ret := make([][]byte, 0)
+	var u []byte
+	pos := 0
+	for _, f := range frames {
+		if len(f) > UPLINK_APP_DATA_BYTES {
+			continue
+		}
+		if u == nil || pos+len(f) > UPLINK_APP_DATA_BYTES {
+			u = newUplink()
+			ret = append(ret, u)
+			pos = 0
+		}
+		copy(u[UPLINK_HEADER_BYTES+pos:], f)
+		pos += len(f)
+	}
+	return ret
+}
+
+// North-west corner and size of a block, see block_location().
+func NexradBlockLocation(block_num int, ns_flag bool, scale_factor int) (float64, float64, float64, float64) {
+	return block_location(block_num, ns_flag, scale_factor)
+}
+
+// Removes the FIS-B info frames of the products keep() rejects from an uplink frame, other info frames are kept.
+// Returns nil if no info frame is left.
+func FilterUplink(frame []byte, keep func(product_id uint32) bool) []byte {
+	if len(frame) < UPLINK_FRAME_DATA_BYTES || frame[6]&0x20 == 0 {
+		return frame // No application data.
+	}
+	ret := make([]byte, UPLINK_FRAME_DATA_BYTES)
+	copy(ret, frame[:UPLINK_HEADER_BYTES])
+	app_data := frame[UPLINK_HEADER_BYTES:UPLINK_FRAME_DATA_BYTES]
+	pos, out, kept := 0, UPLINK_HEADER_BYTES, 0
+	for pos+2 <= len(app_data) {
+		frame_length := int(app_data[pos])<<1 | int(app_data[pos+1])>>7
+		frame_type := app_data[pos+1] & 0x0f
+		if frame_length == 0 || pos+2+frame_length > len(app_data) {
+			break
+		}
+		if frame_type != 0 || frame_length < 2 || keep((uint32(app_data[pos+2])&0x1f)<<6|uint32(app_data[pos+3])>>2) {
+			copy(ret[out:], app_data[pos:pos+2+frame_length])
+			out += 2 + frame_length
+			kept++
+		}
+		pos += 2 + frame_length
+	}
+	if kept == 0 {
+		return nil
+	}
+	return ret
+}
@@ -0,0 +1,188 @@
+/*
+	Copyright (c) 2021 Stratux Developers
+	Distributable under the terms of The "BSD New" License
+	that can be found in the LICENSE file, herein included
+	as part of this header.
+
+	encode_test.go: Round trips of the uplink encoder through the decoder.
+*/
+
+package uatparse
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Decodes an encoded uplink the way it would arrive from dump978.
+func decodeEncodedUplink(t *testing.T, u []byte) *UATMsg {
+	msg, err := New("+" + hex.EncodeToString(u) + ";rs=0;ss=100")
+	if err != nil {
+		t.Fatalf("New: %s", err)
+	}
+	if err := msg.DecodeUplink(); err != nil {
+		t.Fatalf("DecodeUplink: %s", err)
+	}
+	return msg
+}
+
+func TestDLACEncode(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"METAR KSEA", "METAR KSEA"},
+		{"lower case", "LOWER CASE"},
+		{"TAB\tAND~TILDE", "TAB AND TILDE"}, // Tab has no place in the encoding, '~' is not in DLAC.
+		{"ABC", "ABC"},                      // Padded with ETX.
+		{"", ""},
+	}
+	for _, tt := range tests {
+		enc := dlac_encode(tt.in)
+		if len(enc)%3 != 0 {
+			t.Errorf("dlac_encode(%q): %d bytes, not a multiple of 3", tt.in, len(enc))
+		}
+		got := dlac_decode(enc, uint32(len(enc)))
+		if got = strings.TrimRight(got, "\x03"); got != tt.want {
+			t.Errorf("dlac_encode(%q) decodes to %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeTextRoundTrip(t *testing.T) {
+	ts := time.Date(2021, 6, 1, 17, 42, 0, 0, time.UTC)
+	long := strings.Repeat("X", 600)
+	tests := []struct {
+		name    string
+		reports []string
+		frames  int
+	}{
+		{"single", []string{"METAR KSEA 011753Z 18005KT 10SM FEW040 18/09 A3001"}, 1},
+		{"several in one frame", []string{"METAR KBFI 011753Z 00000KT 10SM CLR 19/08 A3002", "TAF KPAE 011720Z 0118/0218 VRB03KT P6SM SKC"}, 1},
+		{"overflow into a second frame", []string{long[:400], long[:200]}, 2},
+	}
+	for _, tt := range tests {
+		frames := EncodeTextFrames(tt.reports, ts)
+		if len(frames) != tt.frames {
+			t.Errorf("%s: %d info frames, want %d", tt.name, len(frames), tt.frames)
+		}
+		got := make([]string, 0)
+		for _, u := range EncodeUplinks(47.5, -122.3, frames) {
+			msg := decodeEncodedUplink(t, u)
+			for _, f := range msg.Frames {
+				if f.Product_id != 413 || f.FISB_hours != 17 || f.FISB_minutes != 42 {
+					t.Errorf("%s: product %d at %02d:%02d, want 413 at 17:42", tt.name, f.Product_id, f.FISB_hours, f.FISB_minutes)
+				}
+			}
+			reports, _ := msg.GetTextReports()
+			for _, r := range reports {
+				if r = strings.TrimRight(r, "\x03"); len(r) > 0 {
+					got = append(got, r)
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.reports) {
+			t.Errorf("%s: decoded %q, want %q", tt.name, got, tt.reports)
+		}
+	}
+}
+
+func TestEncodeUplinksPosition(t *testing.T) {
+	frames := EncodeTextFrames([]string{"TEST"}, time.Now())
+	for _, pos := range [][2]float64{{47.5, -122.3}, {-33.9, 151.2}, {0, 0}, {64.8, -147.7}} {
+		uplinks := EncodeUplinks(pos[0], pos[1], frames)
+		if len(uplinks) != 1 {
+			t.Fatalf("%v: %d uplinks, want 1", pos, len(uplinks))
+		}
+		msg := decodeEncodedUplink(t, uplinks[0])
+		if math.Abs(msg.Lat-pos[0]) > 0.001 || math.Abs(msg.Lon-pos[1]) > 0.001 {
+			t.Errorf("station %v decodes to %.4f,%.4f", pos, msg.Lat, msg.Lon)
+		}
+	}
+}
+
+func TestNexradBlockNumber(t *testing.T) {
+	for _, bn := range []int{0, 1, 449, 450, 12345, 200000, BLOCK_THRESHOLD - 1} {
+		for _, ns := range []bool{false, true} {
+			lat, lon, _, _ := block_location(bn, ns, 0)
+			got, gotNS, ok := NexradBlockNumber(lat, lon)
+			if !ok || got != bn || gotNS != ns {
+				t.Errorf("block %d (south %t) at %.4f,%.4f: got %d (south %t, ok %t)", bn, ns, lat, lon, got, gotNS, ok)
+			}
+		}
+	}
+	if _, _, ok := NexradBlockNumber(65, -150); ok {
+		t.Errorf("NexradBlockNumber accepted a wide block above 60 degrees")
+	}
+}
+
+func TestEncodeNexradRoundTrip(t *testing.T) {
+	lat, lon, _, _ := block_location(123456, false, 0)
+	intensity := make([]uint16, 128)
+	for i := 40; i < 90; i++ {
+		intensity[i] = uint16(i/10) % 8
+	}
+	b := NEXRADBlock{Scale: 0, LatNorth: lat, LonWest: lon, Intensity: intensity}
+
+	frame, ok := EncodeNexradFrame(64, b, time.Now())
+	if !ok {
+		t.Fatalf("EncodeNexradFrame failed")
+	}
+	msg := decodeEncodedUplink(t, EncodeUplinks(lat, lon, [][]byte{frame})[0])
+	if len(msg.Frames) != 1 || len(msg.Frames[0].NEXRAD) != 1 {
+		t.Fatalf("decoded %d frames, want one NEXRAD block", len(msg.Frames))
+	}
+	got := msg.Frames[0].NEXRAD[0]
+	if got.Radar_Type != 64 || got.LatNorth != lat || got.LonWest != lon {
+		t.Errorf("block decodes as product %d at %.4f,%.4f, want 64 at %.4f,%.4f", got.Radar_Type, got.LatNorth, got.LonWest, lat, lon)
+	}
+	if !reflect.DeepEqual(got.Intensity, intensity) {
+		t.Errorf("intensity decodes as %v, want %v", got.Intensity, intensity)
+	}
+
+	if _, ok := EncodeNexradFrame(64, NEXRADBlock{Scale: 1, LatNorth: lat, LonWest: lon}, time.Now()); ok {
+		t.Errorf("EncodeNexradFrame accepted a scale 1 block")
+	}
+}
+
+func TestFilterUplink(t *testing.T) {
+	lat, lon, _, _ := block_location(1000, false, 0)
+	nexrad, _ := EncodeNexradFrame(63, NEXRADBlock{LatNorth: lat, LonWest: lon, Intensity: make([]uint16, 128)}, time.Now())
+	text := EncodeTextFrames([]string{"NOTAM"}, time.Now())[0]
+	u := EncodeUplinks(lat, lon, [][]byte{nexrad, text})[0]
+
+	tests := []struct {
+		name string
+		keep func(uint32) bool
+		want []uint32 // Products left, nil for no uplink.
+	}{
+		{"keep all", func(uint32) bool { return true }, []uint32{63, 413}},
+		{"drop text", func(p uint32) bool { return p != 413 }, []uint32{63}},
+		{"drop nexrad", func(p uint32) bool { return p != 63 }, []uint32{413}},
+		{"drop all", func(uint32) bool { return false }, nil},
+	}
+	for _, tt := range tests {
+		filtered := FilterUplink(u, tt.keep)
+		if filtered == nil {
+			if tt.want != nil {
+				t.Errorf("%s: uplink dropped, want products %v", tt.name, tt.want)
+			}
+			continue
+		}
+		var got []uint32
+		for _, f := range decodeEncodedUplink(t, filtered).Frames {
+			got = append(got, f.Product_id)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: products %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	noAppData := make([]byte, UPLINK_FRAME_DATA_BYTES)
+	if got := FilterUplink(noAppData, func(uint32) bool { return false }); !reflect.DeepEqual(got, noAppData) {
+		t.Errorf("uplink without application data was changed")
+	}
+}
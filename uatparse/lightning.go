@@ -0,0 +1,44 @@
+package uatparse
+
+// FIS-B lightning (product 103). The product uses the block grid of NEXRAD (see block_location()), every bin has
+// a strike count and a polarity. Only RLE blocks carry strikes: each byte is a run of (byte >> 4) + 1 bins with
+// the polarity in bit 3 (1 = positive) and the strike count code in bits 0-2 (LIGHTNING_STRIKES). Empty blocks
+// (bitmap format) have nothing to decode.
+
+// Lower bound of the number of strikes of each count code.
+var LIGHTNING_STRIKES = [8]int{0, 1, 2, 3, 6, 11, 16, 21}
+
+type LightningStrike struct {
+	Lat      float64 // Center of the bin.
+	Lon      float64
+	Count    uint8 // Strike count code, see LIGHTNING_STRIKES.
+	Positive bool
+}
+
+func (f *UATFrame) decodeLightningFrame() {
+	if len(f.FISB_data) < 4 || (f.FISB_data[0]&0x80) == 0 {
+		return // Short read or empty block.
+	}
+	ns_flag := (f.FISB_data[0] & 0x40) != 0
+	scale_factor := (int(f.FISB_data[0]) & 0x30) >> 4
+	block_num := ((int(f.FISB_data[0]) & 0x0f) << 16) | (int(f.FISB_data[1]) << 8) | int(f.FISB_data[2])
+	lat_north, lon_west, height, width := block_location(block_num, ns_flag, scale_factor)
+	bin_height, bin_width := height/4, width/32
+
+	bin := 0
+	for _, v := range f.FISB_data[3:] {
+		count := v & 0x07
+		positive := (v & 0x08) != 0
+		for run := int(v>>4) + 1; run > 0 && bin < 128; run-- {
+			if count > 0 {
+				f.Lightning = append(f.Lightning, LightningStrike{
+					Lat:      lat_north - (float64(bin/32)+0.5)*bin_height,
+					Lon:      lon_west + (float64(bin%32)+0.5)*bin_width,
+					Count:    count,
+					Positive: positive,
+				})
+			}
+			bin++
+		}
+	}
+}
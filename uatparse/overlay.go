@@ -0,0 +1,229 @@
+package uatparse
+
+import (
+	"strconv"
+	"strings"
+)
+
+// FIS-B overlay products (8 NOTAM/TFR, 11 AIRMET, 12 SIGMET, 13 SUA, ...), DO-358 / Aero_FISB_ProdDef_Rev4.pdf.
+// Unlike decodeAirmet(), every record of the APDU is decoded and nothing is read beyond the frame.
+
+const (
+	// Record formats.
+	OVERLAY_RECORD_TEXT      = 2 // Unformatted DLAC text.
+	OVERLAY_RECORD_GRAPHICAL = 8 // Graphical overlay.
+
+	// Geometry overlay options of graphical records.
+	OVERLAY_POLYGON_MSL  = 3 // Extended range 3D polygon.
+	OVERLAY_POLYGON_AGL  = 4
+	OVERLAY_POLYLINE_MSL = 5 // Extended range 3D polyline.
+	OVERLAY_POLYLINE_AGL = 6
+	OVERLAY_PRISM_MSL    = 7 // Extended range circular prism.
+	OVERLAY_PRISM_AGL    = 8
+	OVERLAY_POINT_AGL    = 9 // Extended range 3D point.
+	OVERLAY_POINT_MSL    = 10
+)
+
+// One record of an overlay product. The text (record format 2) and the graphics (record format 8) of a report are
+// sent in separate APDUs and belong together by location identifier, report number and report year.
+type FISBRecord struct {
+	Format       uint8 // OVERLAY_RECORD_TEXT or OVERLAY_RECORD_GRAPHICAL.
+	ReportNumber uint16
+	ReportYear   uint16
+	Cancelled    bool // Text record status.
+
+	Text string // Text records.
+
+	// Graphical records.
+	Label     string     // Object label, numeric labels as decimal.
+	Element   uint8      // Object element.
+	Geometry  uint8      // OVERLAY_* geometry option, 0 if none.
+	Points    []GeoPoint // Vertices, center of a circular prism. Alt in ft.
+	Radius    float64    // nm, circular prism.
+	AltBottom int32      // ft, circular prism.
+	AltTop    int32      // ft, circular prism.
+	Start     string     // Applicability, airmetParseDate() format. "" if not given.
+	End       string
+}
+
+func (r *FISBRecord) IsAGL() bool {
+	return r.Geometry == OVERLAY_POLYGON_AGL || r.Geometry == OVERLAY_POLYLINE_AGL || r.Geometry == OVERLAY_PRISM_AGL ||
+		r.Geometry == OVERLAY_POINT_AGL
+}
+
+// 19 bit longitude, 19 bit latitude, 10 bit altitude (100 ft). Polygons, polylines and points.
+func overlayVertex(b []byte) GeoPoint {
+	lng_raw := (int32(b[0]) << 11) | (int32(b[1]) << 3) | ((int32(b[2]) & 0xE0) >> 5)
+	lat_raw := ((int32(b[2]) & 0x1F) << 14) | (int32(b[3]) << 6) | ((int32(b[4]) & 0xFC) >> 2)
+	alt_raw := ((int32(b[4]) & 0x03) << 8) | int32(b[5])
+	lat, lng := airmetLatLng(lat_raw, lng_raw, false)
+	return GeoPoint{Lat: lat, Lon: lng, Alt: alt_raw * 100}
+}
+
+// Number of bytes of a date in the given date/time format.
+func overlayDateLength(date_time_format uint8) int {
+	switch date_time_format {
+	case 1: // Month, Day, Hours, Minutes.
+		return 4
+	case 2: // Day, Hours, Minutes.
+		return 3
+	case 3: // Hours, Minutes.
+		return 2
+	}
+	return 0
+}
+
+// Record format 2. Returns the record and its length, false if it is truncated.
+func decodeOverlayTextRecord(b []byte) (FISBRecord, int, bool) {
+	var r FISBRecord
+	if len(b) < 5 {
+		return r, 0, false
+	}
+	record_length := int(b[0])<<8 | int(b[1])
+	if record_length < 5 || record_length > len(b) {
+		return r, 0, false
+	}
+	r.Format = OVERLAY_RECORD_TEXT
+	r.ReportNumber = (uint16(b[2]) << 6) | ((uint16(b[3]) & 0xFC) >> 2)
+	r.ReportYear = ((uint16(b[3]) & 0x03) << 5) | ((uint16(b[4]) & 0xF8) >> 3)
+	r.Cancelled = (b[4] & 0x04) == 0
+	r.Text = dlac_decode(b[5:], uint32(record_length-5))
+	return r, record_length, true
+}
+
+// Record format 8. Returns the record and its length, false if it is truncated or has unknown contents.
+func decodeOverlayGraphicalRecord(b []byte) (FISBRecord, int, bool) {
+	var r FISBRecord
+	if len(b) < 5 {
+		return r, 0, false
+	}
+	record_length := int(b[0])<<2 | int(b[1]&0xC0)>>6
+	if record_length < 5 || record_length > len(b) {
+		return r, 0, false
+	}
+	r.Format = OVERLAY_RECORD_GRAPHICAL
+	r.ReportNumber = ((uint16(b[1]) & 0x3F) << 8) | uint16(b[2])
+	r.ReportYear = (uint16(b[3]) & 0xFE) >> 1
+	d := b[5:record_length]
+	if b[4]&0x01 == 0 { // Numeric label.
+		if len(d) < 2 {
+			return r, 0, false
+		}
+		r.Label = strconv.Itoa(int(d[0])<<8 | int(d[1]))
+		d = d[2:]
+	} else {
+		if len(d) < 9 {
+			return r, 0, false
+		}
+		r.Label = strings.Trim(dlac_decode(d, 9), "\x03 ")
+		d = d[9:]
+	}
+
+	if len(d) < 2 {
+		return r, 0, false
+	}
+	qualifier_flag := (d[0] & 0x40) >> 6
+	r.Element = d[0] & 0x1F
+	d = d[2:] // Object type and status.
+	if qualifier_flag != 0 {
+		if len(d) < 3 {
+			return r, 0, false
+		}
+		d = d[3:]
+	}
+
+	if len(d) < 2 {
+		return r, 0, false
+	}
+	record_applicability_options := (d[0] & 0xC0) >> 6
+	date_time_format := (d[0] & 0x30) >> 4
+	r.Geometry = d[0] & 0x0F
+	vertices := int(d[1]&0x3F) + 1
+	d = d[2:]
+
+	date_len := overlayDateLength(date_time_format)
+	if record_applicability_options&0x01 != 0 { // Start time (WEF).
+		if len(d) < date_len {
+			return r, 0, false
+		}
+		r.Start = airmetParseDate(d, date_time_format)
+		d = d[date_len:]
+	}
+	if record_applicability_options&0x02 != 0 { // End time (TIL).
+		if len(d) < date_len {
+			return r, 0, false
+		}
+		r.End = airmetParseDate(d, date_time_format)
+		d = d[date_len:]
+	}
+
+	switch r.Geometry {
+	case OVERLAY_POLYGON_MSL, OVERLAY_POLYGON_AGL, OVERLAY_POLYLINE_MSL, OVERLAY_POLYLINE_AGL:
+		if len(d) < 6*vertices {
+			return r, 0, false
+		}
+		for i := 0; i < vertices; i++ {
+			r.Points = append(r.Points, overlayVertex(d[6*i:]))
+		}
+	case OVERLAY_POINT_AGL, OVERLAY_POINT_MSL:
+		if len(d) < 6 {
+			return r, 0, false
+		}
+		r.Points = []GeoPoint{overlayVertex(d)}
+	case OVERLAY_PRISM_MSL, OVERLAY_PRISM_AGL:
+		if len(d) < 14 {
+			return r, 0, false
+		}
+		lng_bot_raw := (int32(d[0]) << 10) | (int32(d[1]) << 2) | ((int32(d[2]) & 0xC0) >> 6)
+		lat_bot_raw := ((int32(d[2]) & 0x3F) << 12) | (int32(d[3]) << 4) | ((int32(d[4]) & 0xF0) >> 4)
+		alt_bot_raw := (int32(d[9]) & 0xFE) >> 1
+		alt_top_raw := ((int32(d[9]) & 0x01) << 6) | ((int32(d[10]) & 0xFC) >> 2)
+		r_lng_raw := ((int32(d[10]) & 0x03) << 7) | ((int32(d[11]) & 0xFE) >> 1)
+		r_lat_raw := ((int32(d[11]) & 0x01) << 8) | int32(d[12])
+		lat, lng := airmetLatLng(lat_bot_raw, lng_bot_raw, true)
+		r.AltBottom = alt_bot_raw * 5
+		r.AltTop = alt_top_raw * 500
+		r.Points = []GeoPoint{{Lat: lat, Lon: lng, Alt: r.AltBottom}}
+		// Circular if both radii are equal, use the larger one for ellipses.
+		r.Radius = float64(r_lng_raw) * 0.2
+		if r_lat_raw > r_lng_raw {
+			r.Radius = float64(r_lat_raw) * 0.2
+		}
+	default:
+		r.Geometry = 0 // Unknown or low resolution geometry, only the identification is used.
+	}
+	return r, record_length, true
+}
+
+// Decodes the records of an overlay product into f.Records.
+func (f *UATFrame) decodeOverlay() {
+	if f.s_f || len(f.FISB_data) < 6 {
+		return // Segmented APDUs are not supported.
+	}
+	record_format := (f.FISB_data[0] & 0xF0) >> 4
+	record_count := int(f.FISB_data[1]&0xF0) >> 4
+	f.RecordFormat = record_format
+	f.LocationIdentifier = strings.Trim(dlac_decode(f.FISB_data[2:], 3), "\x03 ")
+
+	d := f.FISB_data[6:]
+	for i := 0; i < record_count && len(d) > 0; i++ {
+		var r FISBRecord
+		var n int
+		var ok bool
+		switch record_format {
+		case OVERLAY_RECORD_TEXT:
+			r, n, ok = decodeOverlayTextRecord(d)
+		case OVERLAY_RECORD_GRAPHICAL:
+			r, n, ok = decodeOverlayGraphicalRecord(d)
+		}
+		if !ok {
+			return
+		}
+		f.Records = append(f.Records, r)
+		d = d[n:]
+	}
+	if len(f.Records) > 0 {
+		f.ReportNumber, f.ReportYear = f.Records[0].ReportNumber, f.Records[0].ReportYear
+		f.ReportStart, f.ReportEnd = f.Records[0].Start, f.Records[0].End
+	}
+}
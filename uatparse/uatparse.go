@@ -62,8 +62,14 @@ type UATFrame struct {
 	ReportStart        string
 	ReportEnd          string
 
+	// Overlay products (NOTAM/TFR).
+	Records []FISBRecord
+
 	// For NEXRAD.
 	NEXRAD []NEXRADBlock
+
+	// Lightning, bins with strikes.
+	Lightning []LightningStrike
 }
 
 type UATMsg struct {
@@ -416,7 +422,7 @@ func (f *UATFrame) decodeAirmet() {
 			}
 		case 9: // Extended Range 3D Point (AGL). p.47.
 			if len(record_data) < 6 {
-				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range 3D Point. Should be 6 bytes; % seen.\n", len(record_data))
+				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range 3D Point. Should be 6 bytes; %d seen.\n", len(record_data))
 			} else {
 				lng_raw := (int32(record_data[0]) << 11) | (int32(record_data[1]) << 3) | (int32(record_data[2]) & 0xE0 >> 5)
 				lat_raw := ((int32(record_data[2]) & 0x1F) << 14) | (int32(record_data[3]) << 6) | ((int32(record_data[4]) & 0xFC) >> 2)
@@ -436,7 +442,7 @@ func (f *UATFrame) decodeAirmet() {
 			}
 		case 7, 8: // Extended Range Circular Prism (7 = MSL, 8 = AGL)
 			if len(record_data) < 14 {
-				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range Circular Prism. Should be 14 bytes; % seen.\n", len(record_data))
+				fmt.Fprintf(ioutil.Discard, "invalid data: Extended Range Circular Prism. Should be 14 bytes; %d seen.\n", len(record_data))
 			} else {
 
 				lng_bot_raw := (int32(record_data[0]) << 10) | (int32(record_data[1]) << 2) | (int32(record_data[2]) & 0xC0 >> 6)
@@ -499,12 +505,16 @@ func (f *UATFrame) decodeInfoFrame() {
 	switch f.Product_id {
 	case 413:
 		f.decodeTextFrame()
+	case 8, 11, 12, 14, 15: // NOTAM (TFR, NOTAM-D, FDC), AIRMET, SIGMET, G-AIRMET, CWA.
+		f.decodeOverlay()
 		/*
 			case 8, 11, 13:
 				f.decodeAirmet()
 		*/
 	case 63, 64:
 		f.decodeNexradFrame()
+	case 103:
+		f.decodeLightningFrame()
 
 	default:
 		fmt.Fprintf(ioutil.Discard, "don't know what to do with product id: %d\n", f.Product_id)
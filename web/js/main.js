@@ -10,29 +10,82 @@ var URL_DELETELOGFILE       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/deletelogfil
 var URL_DEV_TOGGLE_GET      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/develmodetoggle";
 var URL_DOWNLOADAHRSLOGFILES = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadahrslogs";
 var URL_DOWNLOADDB          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloaddb";
+var URL_USBEXPORTTOGGLE     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/usbexporttoggle";
+var URL_TRAFFIC_SIM_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getTrafficSimulation";
+var URL_TRAFFIC_SIM_SET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setTrafficSimulation";
+var URL_I2C_SCAN_GET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getI2CScan";
+var URL_FLIGHTS_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getFlights";
+var URL_FLIGHT_DOWNLOAD     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadFlight";
+var URL_FLIGHT_DELETE       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/deleteFlight";
+var URL_DEBRIEF_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getDebrief";
+var URL_RFCAPTURE_GET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getRFCapture";
+var URL_RFCAPTURE_DOWNLOAD  = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadRFCapture";
+var URL_RFCAPTURE_DELETE    = URL_HOST_PROTOCOL + URL_HOST_BASE + "/deleteRFCapture";
+var URL_ADSBOUT_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getADSBOut";
+var URL_ADSBOUT_RESET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/resetADSBOut";
+var URL_FLIGHT_REPLAY_GET   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getFlightReplay";
+var URL_FLIGHT_REPLAY_SET   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setFlightReplay";
 var URL_DOWNLOADLOGFILE     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/downloadlog";
+var URL_LOG_LEVELS_GET      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getLogLevels";
+var URL_LOG_LEVEL_SET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setLogLevel";
 var URL_GMETER_RESET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/resetGMeter";
 var URL_REBOOT              = URL_HOST_PROTOCOL + URL_HOST_BASE + "/reboot";
 var URL_RESTARTAPP          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/restart";
+var URL_AUDIO_TEST          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/testAudio";
 var URL_SATELLITES_GET      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSatellites";
+var URL_SDRS_GET            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSDRs";
+var URL_SDR_CALIBRATE       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/calibrateSDR";
 var URL_SETTINGS_GET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSettings";
 var URL_SETTINGS_SET        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setSettings";
 var URL_SHUTDOWN            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/shutdown";
 var URL_STATUS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getStatus";
+var URL_SYSTEM_HEALTH_GET   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/status/system";
+var URL_UNITS_GET           = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getUnits";
+var URL_ALERTS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getAlerts";
+var URL_ALERT_ACK           = URL_HOST_PROTOCOL + URL_HOST_BASE + "/ackAlert";
+var URL_POWER_GET           = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getPower";
+var URL_POWER_SET           = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setPower";
 var URL_TOWERS_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getTowers";
+var URL_FISB_STATUS_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getFISBStatus";
+var URL_OGN_DDB_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getOgnDDB";
+var URL_OGN_DDB_UPLOAD      = URL_HOST_PROTOCOL + URL_HOST_BASE + "/uploadOgnDDB";
+var URL_INTERNET_WX_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getInternetWeather";
+var URL_WIND_FORECAST_GET   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getWindForecast";
+var URL_WIND_FORECAST_UPDATE = URL_HOST_PROTOCOL + URL_HOST_BASE + "/updateWindForecast";
+var URL_NETWORK_CLIENTS_GET = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getNetworkClients";
+var URL_OUTPUT_PROFILES_GET = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getOutputProfiles";
+var URL_WIFI_STATUS_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getWiFiStatus";
+var URL_WIREGUARD_GET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getWireGuard";
+var URL_WIREGUARD_SET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setWireGuard";
+var URL_MQTT_GET            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getMQTT";
+var URL_API_AUTH            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/api/v1/auth";
+var URL_API_TOKENS          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/api/v1/auth/tokens";
+var URL_BLUETOOTH_GET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getBluetooth";
+var URL_BLUETOOTH_SET       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setBluetooth";
+var URL_OWNSHIP_SUPPRESSED_GET = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getOwnshipSuppressed";
 var URL_UPDATE_UPLOAD       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/updateUpload";
+var URL_UPDATE_GET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getUpdate";
+var URL_UPDATE_SET          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/setUpdate";
 var URL_GET_SITUATION       = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getSituation";
 var URL_GET_TILESETS        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/tiles/tilesets";
 var URL_GET_TILE            = URL_HOST_PROTOCOL + URL_HOST_BASE + "/tiles";
+var URL_NEXRAD_TILES        = URL_HOST_PROTOCOL + URL_HOST_BASE + "/nexrad";
+var URL_LIGHTNING_TILES     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/lightning";
+var URL_WINDS_ALOFT_GET     = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getWindsAloft";
+var URL_THERMAL_GET         = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getThermal";
+var URL_GET_NOTAMS          = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getNotams";
+var URL_GET_WX_ADVISORIES   = URL_HOST_PROTOCOL + URL_HOST_BASE + "/getWxAdvisories";
 var URL_GET_STYLE           = URL_HOST_PROTOCOL + URL_HOST_BASE + "/mapdata/styles"
 
 
 var URL_DEVELOPER_WS        = "ws://" + URL_HOST_BASE + "/developer";
 var URL_GPS_WS              = "ws://" + URL_HOST_BASE + "/situation";
+var URL_SATELLITES_WS       = "ws://" + URL_HOST_BASE + "/satellites";
 var URL_STATUS_WS           = "ws://" + URL_HOST_BASE + "/status";
 var URL_TRAFFIC_WS          = "ws://" + URL_HOST_BASE + "/traffic";
 var URL_WEATHER_WS          = "ws://" + URL_HOST_BASE + "/weather";
 var URL_RADAR_WS            = "ws://" + URL_HOST_BASE + "/radar";
+var URL_SYSTEM_ALERTS_WS    = "ws://" + URL_HOST_BASE + "/systemalerts";
 
 // define the module with dependency on mobile-angular-ui
 //var app = angular.module('stratux', ['ngRoute', 'mobile-angular-ui', 'mobile-angular-ui.gestures', 'appControllers']);
@@ -41,6 +94,36 @@ var appControllers = angular.module('appControllers', []);
 //cutoff value to remove targets out of the list, keep in sync with the value in traffic.go for cleanUpOldEntries, keep it just below cutoff value in traffic.go
 let TRAFFIC_MAX_AGE_SECONDS = 59;
 let TRAFFIC_AIS_MAX_AGE_SECONDS = 60*15;
+
+// Display units, see main/units.go. Values of the APIs are in ft, kt, ft/min, hPa and UTC
+var stratuxUnits = {Altitude: 'ft', Speed: 'kt', VerticalSpeed: 'ft/min', Pressure: 'hPa', Time: 'utc', TimeZone: '', UTCOffset: 0};
+
+function unitAltitude(ft) {
+	return stratuxUnits.Altitude === 'm' ? ft * 0.3048 : ft;
+}
+
+function unitSpeed(kt) {
+	var factors = {'kt': 1, 'km/h': 1.852, 'mph': 1.150779};
+	return kt * (factors[stratuxUnits.Speed] || 1);
+}
+
+function unitVerticalSpeed(fpm) {
+	return stratuxUnits.Altitude === 'm' ? fpm * 0.00508 : fpm;
+}
+
+function unitPressure(hPa) {
+	return stratuxUnits.Pressure === 'inHg' ? hPa * 0.02953 : hPa;
+}
+
+// hh:mm:ss of a time (ms since epoch), "Z" suffix for UTC
+function unitTimeString(epoc) {
+	var local = stratuxUnits.Time === 'local';
+	var d = new Date(epoc + (local ? stratuxUnits.UTCOffset * 1000 : 0));
+	var pad = function (val) {
+		return (val < 10 ? "0" + val : "" + val);
+	};
+	return pad(d.getUTCHours()) + ":" + pad(d.getUTCMinutes()) + ":" + pad(d.getUTCSeconds()) + (local ? "" : "Z");
+}
 let TARGET_TYPE_AIS = 5;
 
 app.config(function ($stateProvider, $urlRouterProvider) {
@@ -81,6 +164,12 @@ app.config(function ($stateProvider, $urlRouterProvider) {
 			controller: 'LogsCtrl',
 			reloadOnSearch: false
 		})
+		.state('debrief', {
+			url: '/debrief/:id',
+			templateUrl: 'plates/debrief.html',
+			controller: 'DebriefCtrl',
+			reloadOnSearch: false
+		})
 		.state('settings', {
 			url: '/settings',
 			templateUrl: 'plates/settings.html',
@@ -108,6 +197,23 @@ app.config(function ($stateProvider, $urlRouterProvider) {
 	$urlRouterProvider.otherwise('/');
 });
 
+// Sends the API token of this browser (Settings, Management API) with the requests to stratux, see main/api.go
+var API_TOKEN_STORAGE_KEY = 'stratuxAPIToken';
+app.config(function ($httpProvider) {
+	$httpProvider.interceptors.push(function () {
+		return {
+			request: function (config) {
+				var token = window.localStorage.getItem(API_TOKEN_STORAGE_KEY);
+				var local = config.url.indexOf(URL_HOST_PROTOCOL + URL_HOST_BASE + '/') === 0 || config.url.charAt(0) === '/';
+				if (token && local) {
+					config.headers['Authorization'] = 'Bearer ' + token;
+				}
+				return config;
+			}
+		};
+	});
+});
+
 
 app.run(function ($transform) {
 	window.$transform = $transform;
@@ -128,6 +234,60 @@ app.controller('MainCtrl', function ($scope, $http) {
         //Second function handles error
     });	
 
+    $scope.Units = stratuxUnits;
+    $scope.updateUnits = function () {
+        $http.get(URL_UNITS_GET).then(function (response) {
+            angular.extend(stratuxUnits, angular.fromJson(response.data));
+        });
+    };
+    $scope.updateUnits();
+
+    // System alerts in the status bar of every page, see main/alertmanager.go. The socket starts with the active ones
+    var systemAlerts = {};
+    var severityOrder = {'critical': 0, 'warning': 1, 'info': 2};
+    $scope.SystemAlertList = [];
+
+    function updateSystemAlertList() {
+        $scope.SystemAlertList = Object.keys(systemAlerts).map(function (id) {
+            return systemAlerts[id];
+        }).filter(function (a) {
+            return !a.Acknowledged;
+        }).sort(function (a, b) {
+            return severityOrder[a.Severity] - severityOrder[b.Severity];
+        });
+    }
+
+    function connectSystemAlerts() {
+        var socket = new WebSocket(URL_SYSTEM_ALERTS_WS);
+        socket.onopen = function () {
+            systemAlerts = {};
+        };
+        socket.onmessage = function (msg) {
+            var alert = JSON.parse(msg.data);
+            if (alert.Active) {
+                systemAlerts[alert.ID] = alert;
+            } else {
+                delete systemAlerts[alert.ID];
+            }
+            updateSystemAlertList();
+            $scope.$apply();
+        };
+        socket.onclose = function () {
+            setTimeout(connectSystemAlerts, 5000);
+        };
+    }
+    connectSystemAlerts();
+
+    // Hides the alert until it's raised again with another severity
+    $scope.ackSystemAlert = function (id) {
+        $http.post(URL_ALERT_ACK + '?id=' + encodeURIComponent(id));
+    };
+
+    // Overrides the automatic shutdown, the idle time starts over
+    $scope.cancelAutoShutdown = function () {
+        $http.post(URL_POWER_SET + '?action=cancel');
+    };
+
     $scope.updateTheme = function(darkMode) {
         if(darkMode != $scope.DarkMode) {
             // console.log("Updating theme, use dark mode?", darkMode);
@@ -265,6 +425,31 @@ app.controller('MainCtrl', function ($scope, $http) {
 		}
 	};
 
+	// Merges a message of the delta encoded /traffic websocket into state (key -> target).
+	// Returns copies of the targets that changed.
+	const applyTrafficStream = (state, message) => {
+		let updated = [];
+		if (message.Type === 'keyframe') {
+			for (let key in state) {
+				if (message.Targets[key] === undefined)
+					delete state[key];
+			}
+		}
+		for (let key in message.Targets) {
+			if (message.Type === 'keyframe' || state[key] === undefined) {
+				state[key] = message.Targets[key];
+			} else {
+				Object.assign(state[key], message.Targets[key]);
+			}
+			updated.push(Object.assign({}, state[key]));
+		}
+		if (message.Removed) {
+			for (let key of message.Removed)
+				delete state[key];
+		}
+		return updated;
+	};
+
 	const getAircraftCategory = (aircraft) => {
 		const category = {
 			1: 'Light',
@@ -309,6 +494,10 @@ app.controller('MainCtrl', function ($scope, $http) {
 			return isTrafficAged(craft, targetVar);
 		},
 
+		applyTrafficStream: (state, message) => {
+			return applyTrafficStream(state, message);
+		},
+
 		getTransportColor: (craft) => {
 			if (craft.TargetType === TARGET_TYPE_AIS) {
 				return getVesselColor(craft);
@@ -0,0 +1,90 @@
+angular.module('appControllers').controller('DebriefCtrl', DebriefCtrl); // get the main module contollers set
+DebriefCtrl.$inject = ['$scope', '$state', '$stateParams', '$http', '$interval']; // Inject my dependencies
+
+var DEBRIEF_BAND_COLORS = {'UAT': '#337ab7', '1090ES': '#d9534f', 'OGN': '#5cb85c', 'AIS': '#f0ad4e'};
+var DEBRIEF_ALERT_LEVELS = ['', 'Advisory', 'Caution', 'Warning'];
+
+// create our controller function with all necessary logic
+function DebriefCtrl($scope, $state, $stateParams, $http, $interval) {
+	$scope.$parent.helppage = 'plates/debrief-help.html';
+
+	$scope.Debrief = null;
+	$scope.Error = '';
+	$scope.RangeMax = 0; // NM, outer ring of the range polar
+	$scope.RangePolygons = [];
+
+	function rangePolygons(ranges) {
+		var max = 0;
+		ranges.forEach(function (r) {
+			r.MaxDistance.forEach(function (d) {
+				max = Math.max(max, d / 1852);
+			});
+		});
+		// round up to a nice ring distance
+		var step = max > 100 ? 50 : (max > 20 ? 10 : 5);
+		$scope.RangeMax = Math.max(step, Math.ceil(max / step) * step);
+		return ranges.map(function (r) {
+			var sector = 360 / r.MaxDistance.length;
+			var points = r.MaxDistance.map(function (d, i) {
+				var a = (i + 0.5) * sector * Math.PI / 180;
+				var len = d / 1852 / $scope.RangeMax * 100;
+				return (len * Math.sin(a)).toFixed(1) + ',' + (-len * Math.cos(a)).toFixed(1);
+			});
+			return {Band: r.Band, Targets: r.Targets, Color: DEBRIEF_BAND_COLORS[r.Band] || '#777', Points: points.join(' ')};
+		});
+	}
+
+	function getDebrief() {
+		$http.get(URL_DEBRIEF_GET + '?id=' + $stateParams.id).
+		then(function (response) {
+			$scope.Debrief = angular.fromJson(response.data);
+			$scope.RangePolygons = rangePolygons($scope.Debrief.Range || []);
+			$scope.Error = '';
+		}, function (response) {
+			$scope.Error = response.data || 'No connection';
+		});
+	}
+
+	$scope.timeString = function (t) {
+		return unitTimeString(new Date(t).getTime());
+	};
+
+	$scope.durationString = function (seconds) {
+		var m = Math.floor(seconds / 60);
+		return (m > 0 ? m + ' min ' : '') + Math.round(seconds % 60) + ' s';
+	};
+
+	$scope.encounterName = function (e) {
+		return e.Tail || e.Reg || e.Icao_addr.toString(16).toUpperCase();
+	};
+
+	$scope.encounterAltitude = function (e) {
+		if (!e.AltitudeValid)
+			return '-';
+		var alt = Math.round(unitAltitude(e.RelativeAltitude));
+		return (alt > 0 ? '+' : '') + alt + ' ' + stratuxUnits.Altitude;
+	};
+
+	$scope.alertLevelName = function (level) {
+		return DEBRIEF_ALERT_LEVELS[level] || '';
+	};
+
+	$scope.dropoutSeconds = function (dropouts) {
+		var total = 0;
+		(dropouts || []).forEach(function (d) {
+			total += d.Seconds;
+		});
+		return total;
+	};
+
+	// the debrief of the current flight is updated while it's recorded
+	var updateDebrief = $interval(function () {
+		if ($scope.Debrief && $scope.Debrief.Live)
+			getDebrief();
+	}, (10 * 1000), 0, true);
+	getDebrief();
+
+	$state.get('debrief').onExit = function () {
+		$interval.cancel(updateDebrief);
+	};
+}
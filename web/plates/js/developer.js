@@ -64,6 +64,7 @@ function DeveloperCtrl($rootScope, $scope, $state, $http, $interval) {
             $scope.UAT_OTHER_total = status.UAT_OTHER_total;
             $scope.Logfile_Size = humanFileSize(status.Logfile_Size);
             $scope.AHRS_LogFiles_Size = humanFileSize(status.AHRS_LogFiles_Size);
+			$scope.USBExportActive = status.USBExportActive;
 			// Errors array.
 			if (status.Errors.length > 0) {
 				$scope.visible_errors = true;
@@ -146,6 +147,15 @@ function DeveloperCtrl($rootScope, $scope, $state, $http, $interval) {
         });
     };
 
+	$scope.postUSBExportToggle = function () {
+		$http.post(URL_USBEXPORTTOGGLE).
+		then(function (response) {
+			// do nothing, state is updated by the status websocket
+		}, function (response) {
+			// do nothing
+		});
+	};
+
 	$scope.postDownloadDB = function () {
 		$http.post(URL_DOWNLOADDB).
 		then(function (response) {
@@ -156,6 +166,86 @@ function DeveloperCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	$scope.LogLevelNames = ['debug', 'info', 'warn', 'error'];
+	$scope.LogLevels = {};
+
+	function getLogLevels() {
+		$http.get(URL_LOG_LEVELS_GET).
+		then(function (response) {
+			$scope.LogLevels = angular.fromJson(response.data);
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	// Sets the level of a subsystem, the default level if sub is empty. An empty level removes the one of the subsystem
+	$scope.setLogLevel = function (sub, level) {
+		$http.post(URL_LOG_LEVEL_SET, angular.toJson({Subsystem: sub, Level: level})).
+		then(function (response) {
+			$scope.LogLevels = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Log level: ' + response.data);
+			getLogLevels();
+		});
+	};
+
+	getLogLevels();
+
+	$scope.TrafficSim = {};
+
+	function getTrafficSimulation() {
+		$http.get(URL_TRAFFIC_SIM_GET).
+		then(function (response) {
+			$scope.TrafficSim = angular.fromJson(response.data);
+			if (!$scope.TrafficSimScenario && $scope.TrafficSim.Scenarios && $scope.TrafficSim.Scenarios.length > 0)
+				$scope.TrafficSimScenario = $scope.TrafficSim.Scenarios[0].Name;
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	$scope.trafficSimDescription = function (name) {
+		var scenarios = $scope.TrafficSim.Scenarios || [];
+		for (var i = 0; i < scenarios.length; i++) {
+			if (scenarios[i].Name === name)
+				return scenarios[i].Description;
+		}
+		return '';
+	};
+
+	// Starts the scenario, stops the running one if name is empty
+	$scope.postTrafficSimulation = function (name) {
+		$http.post(URL_TRAFFIC_SIM_SET + '?scenario=' + encodeURIComponent(name)).
+		then(function (response) {
+			$scope.TrafficSim = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Traffic simulation: ' + response.data);
+		});
+	};
+
+	// refresh the simulation state every 5 seconds
+	var updateTrafficSim = $interval(getTrafficSimulation, (5 * 1000), 0, true);
+	getTrafficSimulation();
+
+	$scope.I2CScan = null;
+
+	// Scans the I2C buses, the server limits the rate
+	$scope.getI2CScan = function () {
+		$scope.I2CScanning = true;
+		$http.get(URL_I2C_SCAN_GET).
+		then(function (response) {
+			$scope.I2CScan = angular.fromJson(response.data);
+			$scope.I2CScanning = false;
+		}, function (response) {
+			$scope.I2CScanning = false;
+			alert('I2C scan: ' + response.data);
+		});
+	};
+
+	$state.get('developer').onExit = function () {
+		$interval.cancel(updateTrafficSim);
+	};
+
 	connect($scope); // connect - opens a socket and listens for messages
 
 }
@@ -150,7 +150,7 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
             $scope.map_opacity = 1;
             $scope.map_mark_opacity = 1;
         }
-        $scope.gps_vertical_accuracy = (situation.GPSVerticalAccuracy*3.2808).toFixed(1); // accuracy is in meters, need to display in ft
+        $scope.gps_vertical_accuracy = unitAltitude(situation.GPSVerticalAccuracy*3.2808).toFixed(1); // accuracy is in meters, displayed in the altitude unit
         if ($scope.gps_vertical_accuracy > 9999) {
             $scope.gps_vertical_accuracy = "\u221e";
             $scope.gps_alt = "--";
@@ -165,11 +165,11 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
 
         $scope.gps_lat = situation.GPSLatitude.toFixed(5); // result is string
         $scope.gps_lon = situation.GPSLongitude.toFixed(5); // result is string
-        $scope.gps_alt = situation.GPSAltitudeMSL.toFixed(1);
-        $scope.gps_height_above_ellipsoid = situation.GPSHeightAboveEllipsoid.toFixed(1);
+        $scope.gps_alt = unitAltitude(situation.GPSAltitudeMSL).toFixed(1);
+        $scope.gps_height_above_ellipsoid = unitAltitude(situation.GPSHeightAboveEllipsoid).toFixed(1);
         $scope.gps_track = situation.GPSTrueCourse.toFixed(1);
-        $scope.gps_speed = situation.GPSGroundSpeed.toFixed(1);
-        $scope.gps_vert_speed = situation.GPSVerticalSpeed.toFixed(1);
+        $scope.gps_speed = unitSpeed(situation.GPSGroundSpeed).toFixed(1);
+        $scope.gps_vert_speed = unitVerticalSpeed(situation.GPSVerticalSpeed).toFixed(1);
         if ($scope.gps_lat == 0 && $scope.gps_lon == 0) {
             $scope.gps_lat = "--";
             $scope.gps_lon = "--";
@@ -188,7 +188,7 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         $scope.press_time = Date.parse(situation.BaroLastMeasurementTime);
         $scope.gps_time = Date.parse(situation.GPSLastGPSTimeStratuxTime);
         if ($scope.gps_time - $scope.press_time < 1000) {
-            $scope.ahrs_alt = Math.round(situation.BaroPressureAltitude.toFixed(0));
+            $scope.ahrs_alt = Math.round(unitAltitude(situation.BaroPressureAltitude));
         } else {
             $scope.ahrs_alt = "---";
         }
@@ -333,14 +333,25 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
         statusCal.innerText = "Error";
     }
 
-    function getSatellites() {
-        // Simple GET request example (note: response is asynchronous)
-        $http.get(URL_SATELLITES_GET).
-        then(function (response) {
-            loadSatellites(response.data);
-        }, function (response) {
-            $scope.raw_data = "error getting satellite data";
-        });
+    // satellite list, pushed once per second
+    function connectSatellites($scope) {
+        if (($scope === undefined) || ($scope === null))
+            return; // we are getting called once after clicking away from the gps page
+
+        var satSocket = new WebSocket(URL_SATELLITES_WS);
+        $scope.satSocket = satSocket;
+
+        satSocket.onclose = function (msg) {
+            if ($scope.satSocket === satSocket) {
+                delete $scope.satSocket;
+                setTimeout(function() {connectSatellites($scope);}, 1000);
+            }
+        };
+
+        satSocket.onmessage = function (msg) {
+            loadSatellites(angular.fromJson(msg.data));
+            $scope.$apply();
+        };
     }
 
     function setSatellite(obj, new_satellite) {
@@ -367,11 +378,93 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
             $scope.data_list.push(new_satellite); // add to start of array
             //}
         }
-        // $scope.$apply();
+        loadSkyPlot(satellites);
     }
 
-    // refresh satellite info once each second (aka polling)
-    var updateSatellites = $interval(getSatellites, 1000, 0, false);
+    var SKY_COLORS = {'GPS': '#337ab7', 'SBAS': '#888888', 'GLONASS': '#d9534f', 'Galileo': '#5cb85c', 'BeiDou': '#f0ad4e', 'QZSS': '#9b59b6'};
+
+    // Sky plot: north up, zenith in the center, horizon at r = 80. Filled if used in the solution.
+    function loadSkyPlot(satellites) {
+        $scope.sky_satellites = [];
+        $scope.sky_constellations = {};
+        for (var key in satellites) {
+            var sat = satellites[key];
+            if (sat.Elevation < 0 || sat.Azimuth < 0)
+                continue; // position unknown
+            var r = 80 * (90 - sat.Elevation) / 90;
+            var a = sat.Azimuth * Math.PI / 180;
+            var color = SKY_COLORS[sat.Constellation] || '#888888';
+            $scope.sky_constellations[sat.Constellation] = color;
+            $scope.sky_satellites.push({
+                id: sat.SatelliteID,
+                x: (r * Math.sin(a)).toFixed(1),
+                y: (-r * Math.cos(a)).toFixed(1),
+                radius: sat.Signal < 1 ? 3 : 3 + Math.min(sat.Signal, 50) / 10, // bigger with stronger signal
+                color: color,
+                fill: sat.InSolution ? color : 'none'
+            });
+        }
+    }
+    connectSatellites($scope);
+
+    // FIS-B winds aloft at our altitude, forecasts change slowly
+    function getWindsAloft() {
+        $http.get(URL_WINDS_ALOFT_GET).
+        then(function (response) {
+            var winds = response.data;
+            $scope.winds_aloft = Math.round(winds.Dir) + '\u00b0 @ ' + Math.round(unitSpeed(winds.Speed)) + ' ' + stratuxUnits.Speed;
+            if (winds.Temperature !== undefined)
+                $scope.winds_aloft += ', ' + Math.round(winds.Temperature) + '\u00b0C';
+            $scope.winds_aloft_station = winds.Station + ', ' + Math.round(winds.Distance) + ' NM';
+        }, function (response) {
+            $scope.winds_aloft = '---';
+            $scope.winds_aloft_station = '';
+        });
+    }
+    getWindsAloft();
+    var updateWindsAloft = $interval(getWindsAloft, 30000, 0, false);
+
+    // Point of the thermal polar, deg true clockwise from north, north up.
+    function thermalPoint(deg, r) {
+        var a = deg * Math.PI / 180;
+        return (r * Math.sin(a)).toFixed(1) + ',' + (-r * Math.cos(a)).toFixed(1);
+    }
+
+    // Blended vario and climb by track while circling (thermal assistant)
+    function getThermal() {
+        $http.get(URL_THERMAL_GET).
+        then(function (response) {
+            var thermal = response.data;
+            $scope.thermal = thermal;
+            $scope.thermal_vario = thermal.VarioValid ? thermal.Vario.toFixed(1) : '---';
+            $scope.thermal_sectors = [];
+            var sectors = thermal.Sectors || [];
+            var maxClimb = 0.5;
+            for (var i = 0; i < sectors.length; i++) {
+                maxClimb = Math.max(maxClimb, Math.abs(sectors[i].Climb));
+            }
+            var width = sectors.length > 0 ? 360 / sectors.length : 0;
+            for (var i = 0; i < sectors.length; i++) {
+                if (sectors[i].Samples === 0)
+                    continue;
+                var r = 80 * Math.abs(sectors[i].Climb) / maxClimb;
+                $scope.thermal_sectors.push({
+                    path: 'M0,0 L' + thermalPoint(sectors[i].Heading - width / 2, r) + ' A' + r.toFixed(1) + ',' + r.toFixed(1) +
+                        ' 0 0,1 ' + thermalPoint(sectors[i].Heading + width / 2, r) + ' Z',
+                    fill: sectors[i].Climb >= 0 ? '#5cb85c' : '#d9534f'
+                });
+            }
+            var shift = thermalPoint(thermal.ShiftDirection, 60).split(',');
+            $scope.thermal_shift_x = shift[0];
+            $scope.thermal_shift_y = shift[1];
+        }, function (response) {
+            $scope.thermal = {};
+            $scope.thermal_vario = '---';
+            $scope.thermal_sectors = [];
+        });
+    }
+    getThermal();
+    var updateThermal = $interval(getThermal, 1000, 0, false);
 
     $state.get('gps').onEnter = function () {
         // everything gets handled correctly by the controller
@@ -385,8 +478,14 @@ function GPSCtrl($rootScope, $scope, $state, $http, $interval) {
             $scope.socket.close();
             $scope.socket = null;
         }
+        if (($scope.satSocket !== undefined) && ($scope.satSocket !== null)) {
+            var satSocket = $scope.satSocket;
+            $scope.satSocket = null;
+            satSocket.close();
+        }
         // stop polling for gps/ahrs status
-        $interval.cancel(updateSatellites);
+        $interval.cancel(updateWindsAloft);
+        $interval.cancel(updateThermal);
     };
 
     // GPS/AHRS Controller tasks go here
@@ -1,11 +1,146 @@
 angular.module('appControllers').controller('LogsCtrl', LogsCtrl);      // get the main module contollers set
-LogsCtrl.$inject = ['$scope', '$state', '$http'];                                   // Inject my dependencies
+LogsCtrl.$inject = ['$scope', '$state', '$http', '$interval'];                                   // Inject my dependencies
 
 // create our controller function with all necessary logic
-function LogsCtrl($scope, $state, $http) {
+function LogsCtrl($scope, $state, $http, $interval) {
 	$scope.$parent.helppage = 'plates/logs-help.html';
 
 	// just a couple environment variables that may bve useful for dev/debugging but otherwise not significant
 	$scope.userAgent = navigator.userAgent;
     $scope.deviceViewport = 'screen = ' + window.screen.width + ' x ' + window.screen.height;
+
+	$scope.FlightReplay = {};
+	$scope.FlightReplaySpeed = 1;
+
+	function getFlightReplay() {
+		$http.get(URL_FLIGHT_REPLAY_GET).
+		then(function (response) {
+			$scope.FlightReplay = angular.fromJson(response.data);
+			if (!$scope.FlightReplaySession && $scope.FlightReplay.Sessions.length > 0)
+				$scope.FlightReplaySession = $scope.FlightReplay.Sessions[0].StartupID;
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	$scope.flightReplayLabel = function (s) {
+		var start = new Date(s.Start);
+		var minutes = Math.round((new Date(s.End) - start) / 60000);
+		return start.toLocaleString() + ' (' + minutes + ' min, ' + (s.UAT + s.ES + s.OGN + s.AIS) + ' messages)';
+	};
+
+	// Starts the replay of the session, stops the running one if id is 0
+	$scope.postFlightReplay = function (id) {
+		$http.post(URL_FLIGHT_REPLAY_SET + '?session=' + id + '&speed=' + $scope.FlightReplaySpeed).
+		then(function (response) {
+			$scope.FlightReplay = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Flight replay: ' + response.data);
+		});
+	};
+
+	$scope.Flights = [];
+
+	function getFlights() {
+		$http.get(URL_FLIGHTS_GET).
+		then(function (response) {
+			$scope.Flights = angular.fromJson(response.data);
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	$scope.flightLabel = function (f) {
+		var start = new Date(f.Start);
+		var minutes = Math.round((new Date(f.End) - start) / 60000);
+		return start.toLocaleDateString() + ' ' + unitTimeString(start.getTime()) + ' (' + minutes + ' min, ' +
+			(f.Distance / 1852).toFixed(0) + ' NM)';
+	};
+
+	$scope.flightDownloadURL = function (f, format) {
+		return URL_FLIGHT_DOWNLOAD + '?id=' + f.ID + '&format=' + format;
+	};
+
+	$scope.deleteFlight = function (f) {
+		if (!confirm('Delete the flight ' + $scope.flightLabel(f) + '?'))
+			return;
+		$http.post(URL_FLIGHT_DELETE + '?id=' + f.ID).
+		then(function (response) {
+			$scope.Flights = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Delete flight: ' + response.data);
+		});
+	};
+
+	getFlights();
+
+	$scope.RFCapture = {};
+	$scope.RFCaptureDownloadURL = URL_RFCAPTURE_DOWNLOAD;
+
+	function getRFCapture() {
+		$http.get(URL_RFCAPTURE_GET).
+		then(function (response) {
+			$scope.RFCapture = angular.fromJson(response.data);
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	$scope.deleteRFCapture = function () {
+		if (!confirm('Delete all RF capture files?'))
+			return;
+		$http.post(URL_RFCAPTURE_DELETE).
+		then(function (response) {
+			$scope.RFCapture = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Delete RF capture: ' + response.data);
+		});
+	};
+
+	$scope.ADSBOut = {};
+
+	function getADSBOut() {
+		$http.get(URL_ADSBOUT_GET).
+		then(function (response) {
+			$scope.ADSBOut = angular.fromJson(response.data);
+		}, function (response) {
+			// do nothing
+		});
+	}
+
+	$scope.resetADSBOut = function () {
+		$http.post(URL_ADSBOUT_RESET).
+		then(function (response) {
+			$scope.ADSBOut = angular.fromJson(response.data);
+		}, function (response) {
+			alert('Reset ADS-B Out check: ' + response.data);
+		});
+	};
+
+	$scope.squawkString = function (squawk) {
+		return ('000' + squawk).slice(-4);
+	};
+
+	$scope.percent = function (count, total) {
+		return total > 0 ? Math.round(count * 100 / total) : 0;
+	};
+
+	$scope.altitudeDiff = function (ft) {
+		var alt = Math.round(unitAltitude(ft));
+		return (alt > 0 ? '+' : '') + alt + ' ' + stratuxUnits.Altitude;
+	};
+
+	// refresh the replay state every 5 seconds
+	var updateFlightReplay = $interval(function () {
+		getFlightReplay();
+		getRFCapture();
+		getADSBOut();
+	}, (5 * 1000), 0, true);
+	getFlightReplay();
+	getRFCapture();
+	getADSBOut();
+
+	$state.get('logs').onExit = function () {
+		$interval.cancel(updateFlightReplay);
+	};
 }
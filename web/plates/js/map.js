@@ -25,6 +25,133 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 		})
 	});
 
+	// FIS-B NEXRAD rendered by Stratux
+	let nexradRegional = new ol.layer.Tile({
+		title: 'NEXRAD Regional (FIS-B)',
+		type: 'overlay',
+		visible: false,
+		opacity: 0.7,
+		source: new ol.source.XYZ({
+			url: URL_NEXRAD_TILES + '/regional/{z}/{x}/{y}.png',
+			maxZoom: 12
+		})
+	});
+	let nexradConus = new ol.layer.Tile({
+		title: 'NEXRAD CONUS (FIS-B)',
+		type: 'overlay',
+		visible: false,
+		opacity: 0.7,
+		source: new ol.source.XYZ({
+			url: URL_NEXRAD_TILES + '/conus/{z}/{x}/{y}.png',
+			maxZoom: 12
+		})
+	});
+	let lightning = new ol.layer.Tile({
+		title: 'Lightning (FIS-B)',
+		type: 'overlay',
+		visible: false,
+		source: new ol.source.XYZ({
+			url: URL_LIGHTNING_TILES + '/{z}/{x}/{y}.png',
+			maxZoom: 12
+		})
+	});
+
+	// FIS-B TFRs, filled while active, the one alerting in a darker red
+	let tfrSource = new ol.source.Vector();
+	let tfrLayer = new ol.layer.Vector({
+		title: 'TFRs (FIS-B)',
+		type: 'overlay',
+		source: tfrSource,
+		zIndex: 8
+	});
+	$scope.tfrAlert = { Level: 0 };
+
+	function tfrStyle(notam) {
+		let fill = 'rgba(255, 0, 0, 0.05)';
+		if (notam.key === $scope.tfrAlert.Notam && $scope.tfrAlert.Level > 0)
+			fill = 'rgba(200, 0, 0, 0.4)';
+		else if (notam.Active)
+			fill = 'rgba(255, 0, 0, 0.2)';
+		return new ol.style.Style({
+			stroke: new ol.style.Stroke({color: 'red', width: 2, lineDash: notam.Active ? undefined : [6, 6]}),
+			fill: new ol.style.Fill({color: fill})
+		});
+	}
+
+	// Polygon or circle of a NOTAM/advisory shape, null for other geometries
+	function shapeGeometry(shape) {
+		if (shape.Geometry === 3 || shape.Geometry === 4) {
+			let ring = shape.Points.map(p => ol.proj.fromLonLat([p.Lon, p.Lat]));
+			ring.push(ring[0]);
+			return new ol.geom.Polygon([ring]);
+		} else if (shape.Geometry === 7 || shape.Geometry === 8) {
+			let center = shape.Points[0];
+			// web mercator is stretched by 1/cos(lat)
+			let radius = shape.Radius * 1852 / Math.cos(center.Lat * Math.PI / 180);
+			return new ol.geom.Circle(ol.proj.fromLonLat([center.Lon, center.Lat]), radius);
+		}
+		return null;
+	}
+
+	function updateTFRs() {
+		$http.get(URL_GET_NOTAMS + '?type=TFR').then(function(response) {
+			let status = angular.fromJson(response.data);
+			$scope.tfrAlert = status.Alert;
+			tfrSource.clear();
+			for (let notam of status.Notams) {
+				notam.key = notam.Location + ' ' + notam.ReportNumber + '/' + notam.ReportYear;
+				for (let shape of notam.Shapes || []) {
+					let geom = shapeGeometry(shape);
+					if (!geom)
+						continue;
+					let feature = new ol.Feature({ geometry: geom, name: notam.Text });
+					feature.setStyle(tfrStyle(notam));
+					tfrSource.addFeature(feature);
+				}
+			}
+		});
+	}
+
+	// FIS-B AIRMETs/SIGMETs of the alerting hazards, the ones alerting filled
+	let wxAdvisorySource = new ol.source.Vector();
+	let wxAdvisoryLayer = new ol.layer.Vector({
+		title: 'AIRMET/SIGMET (FIS-B)',
+		type: 'overlay',
+		source: wxAdvisorySource,
+		zIndex: 7
+	});
+	let wxAdvisoryColors = { ICING: '0, 0, 255', TURBULENCE: '255, 140, 0', IFR: '200, 0, 200', MTN_OBSCN: '150, 75, 0' };
+	$scope.wxAdvisoryAlerts = [];
+
+	function updateWxAdvisories() {
+		$http.get(URL_GET_WX_ADVISORIES).then(function(response) {
+			let status = angular.fromJson(response.data);
+			$scope.wxAdvisoryAlerts = status.Alerts;
+			let alerting = {};
+			for (let alert of status.Alerts)
+				alerting[alert.Advisory] = true;
+			wxAdvisorySource.clear();
+			for (let advisory of status.Advisories) {
+				let color = wxAdvisoryColors[advisory.Hazard];
+				if (!color || !advisory.Active)
+					continue;
+				let key = advisory.Product + ' ' + advisory.Location + ' ' + advisory.ReportNumber + '/' + advisory.ReportYear;
+				let style = new ol.style.Style({
+					stroke: new ol.style.Stroke({color: 'rgb(' + color + ')', width: 2}),
+					fill: new ol.style.Fill({color: 'rgba(' + color + (alerting[key] ? ', 0.3)' : ', 0.05)')})
+				});
+				for (let shape of advisory.Shapes || []) {
+					let geom = shapeGeometry(shape);
+					if (!geom)
+						continue;
+					let feature = new ol.Feature({ geometry: geom, name: advisory.Text });
+					feature.setStyle(style);
+					wxAdvisorySource.addFeature(feature);
+				}
+			}
+		});
+	}
+
 	// Dynamic MBTiles layers
 	$http.get(URL_GET_TILESETS).then(function(response) {
 		var tilesets = angular.fromJson(response.data);
@@ -120,6 +247,11 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 		layers: [
 			osm,
 			openaip,
+			nexradConus,
+			nexradRegional,
+			lightning,
+			wxAdvisoryLayer,
+			tfrLayer,
 			aircraftSymbolsLayer,
 			aircraftTrailsLayer
 		],
@@ -288,10 +420,10 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 		if (aircraft.Tail.length > 0)
 			text.push(aircraft.Tail);
 		if (aircraft.TargetType !== TARGET_TYPE_AIS) {
-			text.push(aircraft.Alt + 'ft');
+			text.push(Math.round(unitAltitude(aircraft.Alt)) + stratuxUnits.Altitude);
 		}
 		if (aircraft.Speed_valid && aircraft.Speed>0.1)
-			text.push(aircraft.Speed + 'kt')
+			text.push(Math.round(unitSpeed(aircraft.Speed)) + stratuxUnits.Speed)
 		aircraft.marker.getStyle().getText().setText(text.join('\n'));
 	}
 
@@ -328,9 +460,17 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 		return false;
 	}
 
+	$scope.trafficState = {}; // key -> target, see craftService.applyTrafficStream()
+
 	$scope.onMessage = function(msg) {
-		let aircraft = JSON.parse(msg.data);
-		if (!aircraft.Position_valid || craftService.isTrafficAged(aircraft)) {
+		let targets = craftService.applyTrafficStream($scope.trafficState, JSON.parse(msg.data));
+		for (let aircraft of targets) {
+			$scope.onAircraft(aircraft);
+		}
+	}
+
+	$scope.onAircraft = function(aircraft) {
+		if (!aircraft.Position_valid || aircraft.Duplicate || aircraft.OwnshipShadow || craftService.isTrafficAged(aircraft)) {
 			return;
 		}
 		aircraft.receivedTs = Date.now();
@@ -489,6 +629,9 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 		}
 		// stop stale traffic cleanup
 		$interval.cancel($scope.update);
+		$interval.cancel(updateNexrad);
+		$interval.cancel(updateTFRInterval);
+		$interval.cancel(updateWxAdvisoriesInterval);
 	}
 
 
@@ -497,4 +640,19 @@ function MapCtrl($rootScope, $scope, $state, $http, $interval, craftService) {
 
 	$interval($scope.update, 1000);
 
+	// reload the NEXRAD tiles every minute, regional NEXRAD is uplinked every 2.5 minutes
+	var updateNexrad = $interval(function () {
+		nexradRegional.getSource().refresh();
+		nexradConus.getSource().refresh();
+		lightning.getSource().refresh();
+	}, 60 * 1000);
+
+	// TFRs and the TFR alert
+	updateTFRs();
+	var updateTFRInterval = $interval(updateTFRs, 5 * 1000);
+
+	// AIRMETs/SIGMETs and their alerts
+	updateWxAdvisories();
+	var updateWxAdvisoriesInterval = $interval(updateWxAdvisories, 10 * 1000);
+
 }
@@ -47,20 +47,6 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 	$scope.data_list = [];
 	$scope.data_list_invalid = [];
 
-	function utcTimeString(epoc) {
-		var time = '';
-		var val;
-		var d = new Date(epoc);
-		val = d.getUTCHours();
-		time += (val < 10 ? '0' + val : '' + val);
-		val = d.getUTCMinutes();
-		time += ':' + (val < 10 ? '0' + val : '' + val);
-		val = d.getUTCSeconds();
-		time += ':' + (val < 10 ? '0' + val : '' + val);
-		time += 'Z';
-		return time;
-	}
-
 	function radiansRel(angle) {  //adopted from equations.go
 		if (angle > 180) angle = angle - 360;
 		if (angle <= -180) angle = angle + 360;
@@ -109,7 +95,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		$scope.$apply();
 	}
 
-	function speaktraffic(altitudeDiff, direction) {
+	function speaktraffic(altitudeDiff, direction, coAltitudeIn) {
 		if ((soundType == 0) || (soundType == 2)) {
 			var feet = altitudeDiff * 100;
 			var sign = 'plus';
@@ -117,6 +103,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			var txt = 'Traffic ';
 			if (direction) txt += direction + ' o\'clock ';
 			txt += sign + ' ' + Math.abs(feet) + ' feet';
+			if ((coAltitudeIn > 0) && (coAltitudeIn <= 60)) txt += ', co-altitude in ' + coAltitudeIn + ' seconds';
 			var utterOn = new SpeechSynthesisUtterance(txt);
 			utterOn.lang = 'en-US';
 			utterOn.rate = 1.1;
@@ -124,6 +111,21 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		}
 	}
 
+	var cabinAltitudeAlert = 0;   // last announced cabin altitude alert threshold
+	function checkCabinAltitude(alert) {
+		if (alert === undefined) return;
+		if (alert > cabinAltitudeAlert && soundType != 3) {
+			if ((soundType == 0) || (soundType == 1)) sound_alert.play();
+			if ((soundType == 0) || (soundType == 2)) {
+				var utterOn = new SpeechSynthesisUtterance('Cabin altitude ' + alert + ' feet');
+				utterOn.lang = 'en-US';
+				utterOn.rate = 1.1;
+				synth.speak(utterOn);
+			}
+		}
+		cabinAltitudeAlert = alert;
+	}
+
 	function checkCollisionVector(traffic) {
 		var doUpdate = 0;                                             //1 if update has to be done;
 		var altDiff;                                                  //difference of altitude to my altitude
@@ -150,7 +152,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 				doUpdate = 1;
 				if (distcirc <= (DisplayRadius / 2)) {
 					if (!traffic.alarms) traffic.alarms = 0;
-					if ((traffic.alarms < MaxSpeechAlarms) && (altDiffValid == 1)) speaktraffic(altDiff, null);
+					if ((traffic.alarms < MaxSpeechAlarms) && (altDiffValid == 1)) speaktraffic(altDiff, null, traffic.coaltin);
 					if ((traffic.alarms < MaxAlarms) && ((soundType == 0) || (soundType == 1))) sound_alert.play();  // play alarmtone max times
 					traffic.alarms = traffic.alarms + 1;
 				} else {
@@ -244,7 +246,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 					var oclock = Math.round(alpha / 30);
 					if (oclock <= 0) oclock += 12;
 					//console.log("Distx %d Disty %d GPSCourse %f alpha-Course %f oclock %f\n", distx, disty, GPSCourse, alpha, oclock);
-					speaktraffic(altDiff, oclock);
+					speaktraffic(altDiff, oclock, traffic.coaltin);
 				}
 				if ((traffic.alarms < MaxAlarms) && ((soundType == 0) || (soundType == 1))) sound_alert.play();  // play alarmtone max times
 				traffic.alarms = traffic.alarms + 1;
@@ -269,7 +271,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			if (traffic.vspeed < 0) pfeil = '\u2193';
 			traffic.planetextOut = radar.rScreen.text(vorzeichen + Math.abs(altDiff) + pfeil).move(distx + 17, disty - 10).rotate(GPSCourse, distx, disty).addClass('textPlaneOut');
 			traffic.planetext = radar.rScreen.text(vorzeichen + Math.abs(altDiff) + pfeil).move(distx + 17, disty - 10).rotate(GPSCourse, distx, disty).addClass('textPlane');
-			traffic.planespeed = radar.rScreen.text(traffic.nspeed + 'kts').move(distx + 17, disty).rotate(GPSCourse, distx, disty).addClass('textPlaneSmall');
+			traffic.planespeed = radar.rScreen.text(traffic.nspeed + stratuxUnits.Speed).move(distx + 17, disty).rotate(GPSCourse, distx, disty).addClass('textPlaneSmall');
 			traffic.planetail = radar.rScreen.text(traffic.tail).move(distx + 17, disty + 10).rotate(GPSCourse, distx, disty).addClass('textPlaneReg');
 			if ( showTraces ) {
 			  if (!traffic.trace) {
@@ -300,7 +302,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			timeLack = timestamp - new_traffic.timeVal;
 		}
 		new_traffic.timeVal = timestamp;
-		new_traffic.time = utcTimeString(timestamp);
+		new_traffic.time = unitTimeString(timestamp);
 		new_traffic.signal = obj.SignalLevel;
 		new_traffic.distance_estimated = obj.DistanceEstimated;
 
@@ -310,13 +312,14 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 		new_traffic.altitude = n;
 
 		if (obj.Speed_valid) {
-			new_traffic.nspeed = Math.round(obj.Speed / 5) * 5;
+			new_traffic.nspeed = Math.round(unitSpeed(obj.Speed) / 5) * 5;
 			new_traffic.heading = Math.round(obj.Track / 5) * 5;
 		} else {
 			new_traffic.nspeed = '-';
 			new_traffic.heading = '---';
 		}
 		new_traffic.vspeed = Math.round(obj.Vvel / 100) * 100
+		new_traffic.coaltin = obj.VerticalTrend_valid ? obj.CoAltitudeIn : -1;  // seconds until co-altitude
 
 
 		new_traffic.Last_seen = Date.parse(obj.Last_seen);
@@ -495,6 +498,7 @@ function RadarCtrl($rootScope, $scope, $state, $http, $interval) {
 			$scope.SecondsFast = (tempClock - tempLocalClock) / 1000;
 
 			$scope.GPS_connected = globalStatus.GPS_connected;
+			checkCabinAltitude(globalStatus.CabinAltitudeAlert);
 			var boardtemp = globalStatus.CPUTemp;
 			if (boardtemp != undefined) {
 				/* boardtemp is celcius to tenths */
@@ -1,9 +1,9 @@
 angular.module('appControllers').controller('SettingsCtrl', SettingsCtrl); // get the main module controllers set
-SettingsCtrl.$inject = ['$rootScope', '$scope', '$state', '$location', '$window', '$http']; // Inject my dependencies
+SettingsCtrl.$inject = ['$rootScope', '$scope', '$state', '$location', '$window', '$http', '$interval']; // Inject my dependencies
 
 
 // create our controller function with all necessary logic
-function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
+function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http, $interval) {
 	$scope.countryCodes = {
 		"":"Unspecified",
 		"AD":"Andorra",
@@ -261,21 +261,28 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 	$scope.$parent.helppage = 'plates/settings-help.html';
 
 	var toggles = ['UAT_Enabled', 'ES_Enabled', 'OGN_Enabled', 'AIS_Enabled', 'Ping_Enabled', 'OGNI2CTXEnabled', 'GPS_Enabled', 'IMU_Sensor_Enabled',
-		'BMP_Sensor_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog', 'AHRSLog', 'PersistentLogging', 'GDL90MSLAlt_Enabled', 'EstimateBearinglessDist', 'DarkMode'];
+		'BMP_Sensor_Enabled', 'DisplayTrafficSource', 'DEBUG', 'ReplayLog', 'ReplayLogBufferFlight', 'FlightRecorder_Enabled', 'AHRSLog', 'PersistentLogging', 'GDL90MSLAlt_Enabled', 'GDL90PressureAltFromGPS', 'EstimateBearinglessDist', 'DarkMode',
+		'GNSS_GPS', 'GNSS_GLONASS', 'GNSS_Galileo', 'GNSS_BeiDou', 'GNSS_SBAS', 'GPSMovingBase', 'AutopilotOutput', 'SDRAutoGain', 'SDRPPMAutoCal',
+		'UAT_BiasTee', 'ES_BiasTee', 'OGN_BiasTee', 'AIS_BiasTee', 'AudioAlerts', 'AudioChimes', 'AudioVario', 'OwnshipShadowFilter',
+		'OGNDDBAutoUpdate', 'OGNDDBShowCN', 'APRSUpload', 'InternetWeather', 'WindForecast', 'BluetoothEnabled', 'MDNSEnabled', 'ForeFlightAnnounce',
+		'WireGuardEnabled', 'MQTTEnabled', 'MQTTTLSInsecure'];
 
 	var settings = {};
 	for (var i = 0; i < toggles.length; i++) {
 		settings[toggles[i]] = undefined;
 	}
 	$scope.update_files = '';
+	$scope.ddb_files = '';
 
 	$http.get(URL_STATUS_GET).then(function(response) {
 		var status = angular.fromJson(response.data);
 		var gpsHardwareCode = (status.GPS_detected_type & 0x0f);
-		if (gpsHardwareCode == 3 || status.OGN_tx_enabled)
+		if (gpsHardwareCode == 3 || status.OGN_tx_enabled || status.OGNTracker_connected)
 			$scope.hasOgnTracker = true;
 		else
 			$scope.hasOgnTracker = false;
+		$scope.APRS_connected = status.APRS_connected;
+		$scope.APRS_uploaded = status.APRS_uploaded;
 	});
 
 	function loadSettings(data) {
@@ -283,12 +290,24 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		// consider using angular.extend()
 		$scope.rawSettings = angular.toJson(data, true);
 		$scope.visible_serialout = false;
+		$scope.visible_serialout_nmea = false;
 		if ((settings.SerialOutputs !== undefined) && (settings.SerialOutputs !== null)) {
 			for (var k in settings.SerialOutputs) {
-				$scope.Baud = settings.SerialOutputs[k].Baud;
-				$scope.visible_serialout = true;
+				if (settings.SerialOutputs[k].Capability === 8) { // FLARM NMEA, see NETWORK_FLARM_NMEA
+					$scope.visible_serialout_nmea = true;
+				} else {
+					$scope.Baud = settings.SerialOutputs[k].Baud;
+					$scope.visible_serialout = true;
+				}
 			}
 		}
+		$scope.NMEASerialBaud = settings.NMEASerialBaud;
+		$scope.MDNSEnabled = settings.MDNSEnabled;
+		$scope.ForeFlightAnnounce = settings.ForeFlightAnnounce;
+		$scope.ForeFlightName = settings.ForeFlightName;
+		$scope.ForeFlightInternetPolicy = settings.ForeFlightInternetPolicy;
+		$scope.GDL90TCPPort = settings.GDL90TCPPort;
+		$scope.FLARMNMEAPort = settings.FLARMNMEAPort;
 
 		$scope.DarkMode = settings.DarkMode;
 
@@ -303,20 +322,95 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		$scope.IMU_Sensor_Enabled = settings.IMU_Sensor_Enabled;
 		$scope.BMP_Sensor_Enabled = settings.BMP_Sensor_Enabled;
 		$scope.DisplayTrafficSource = settings.DisplayTrafficSource;
+		$scope.OwnshipShadowFilter = settings.OwnshipShadowFilter;
+		$scope.OGNDDBAutoUpdate = settings.OGNDDBAutoUpdate;
+		$scope.APRSUpload = settings.APRSUpload;
+		$scope.APRSStationName = settings.APRSStationName;
+		$scope.OGNDDBShowCN = settings.OGNDDBShowCN;
+		$scope.InternetWeather = settings.InternetWeather;
+		$scope.InternetWeatherRange = settings.InternetWeatherRange;
+		$scope.WindForecast = settings.WindForecast;
+		$scope.WindForecastRegion = settings.WindForecastRegion;
+		$scope.WireGuardEnabled = settings.WireGuardEnabled;
+		$scope.WireGuardAddress = settings.WireGuardAddress;
+		$scope.WireGuardListenPort = settings.WireGuardListenPort;
+		$scope.WireGuardPeers = angular.copy(settings.WireGuardPeers || []);
+		$scope.MQTTEnabled = settings.MQTTEnabled;
+		$scope.MQTTBroker = settings.MQTTBroker;
+		$scope.MQTTClientID = settings.MQTTClientID;
+		$scope.MQTTUsername = settings.MQTTUsername;
+		$scope.MQTTPassword = '';
+		$scope.MQTTPasswordSet = settings.MQTTPasswordSet;
+		$scope.MQTTTopicPrefix = settings.MQTTTopicPrefix;
+		$scope.MQTTQoS = settings.MQTTQoS;
+		$scope.MQTTTLSInsecure = settings.MQTTTLSInsecure;
+		$scope.MQTTIntervals = angular.copy(settings.MQTTIntervals || {});
+		$scope.BluetoothEnabled = settings.BluetoothEnabled;
+		$scope.BluetoothName = settings.BluetoothName;
+		$scope.BluetoothBLEOutput = settings.BluetoothBLEOutput;
+		$scope.BluetoothSPPOutput = settings.BluetoothSPPOutput;
 		$scope.DEBUG = settings.DEBUG;
 		$scope.ReplayLog = settings.ReplayLog;
+		$scope.ReplayLogWriteInterval = settings.ReplayLogWriteInterval;
+		$scope.ReplayLogBufferFlight = settings.ReplayLogBufferFlight;
+		$scope.FlightRecorder_Enabled = settings.FlightRecorder_Enabled;
+		$scope.FlightRecorderInterval = settings.FlightRecorderInterval;
+		$scope.DebriefEncounterDistance = settings.DebriefEncounterDistance;
+		$scope.DebriefEncounterAltitude = settings.DebriefEncounterAltitude;
+		$scope.RFCaptureUAT = settings.RFCaptureUAT;
+		$scope.RFCaptureES = settings.RFCaptureES;
+		$scope.RFCaptureOGN = settings.RFCaptureOGN;
+		$scope.RFCaptureMaxMB = settings.RFCaptureMaxMB;
+		$scope.RFCaptureMaxAge = settings.RFCaptureMaxAge;
 		$scope.AHRSLog = settings.AHRSLog;
 		$scope.PersistentLogging = settings.PersistentLogging;
 
 		$scope.PPM = settings.PPM;
+		$scope.SDRAutoGain = settings.SDRAutoGain;
+		$scope.SDRPPMAutoCal = settings.SDRPPMAutoCal;
+		$scope.UAT_BiasTee = settings.UAT_BiasTee;
+		$scope.ES_BiasTee = settings.ES_BiasTee;
+		$scope.OGN_BiasTee = settings.OGN_BiasTee;
+		$scope.AIS_BiasTee = settings.AIS_BiasTee;
+		$scope.UAT_RemoteSDR = settings.UAT_RemoteSDR;
+		$scope.ES_RemoteSDR = settings.ES_RemoteSDR;
+		$scope.ES_NetInput = settings.ES_NetInput;
+		$scope.ES_NetInputFormat = settings.ES_NetInputFormat;
 		$scope.AltitudeOffset = settings.AltitudeOffset;
 		$scope.WatchList = settings.WatchList;
 		$scope.OwnshipModeS = settings.OwnshipModeS;
+		$scope.TransponderDevice = settings.TransponderDevice;
+		$scope.TransponderBaud = settings.TransponderBaud;
+		$scope.TransponderProtocol = settings.TransponderProtocol;
 		$scope.DeveloperMode = settings.DeveloperMode;
 		$scope.GLimits = settings.GLimits;
 		$scope.GDL90MSLAlt_Enabled = settings.GDL90MSLAlt_Enabled;
 		$scope.EstimateBearinglessDist = settings.EstimateBearinglessDist
+		$scope.GDL90PressureAltFromGPS = settings.GDL90PressureAltFromGPS;
+		$scope.GeoidSource = settings.GeoidSource;
+		$scope.UnitAltitude = settings.UnitAltitude;
+		$scope.UnitSpeed = settings.UnitSpeed;
+		$scope.UnitPressure = settings.UnitPressure;
+		$scope.UnitTime = settings.UnitTime;
+		$scope.TimeZone = settings.TimeZone;
+		$scope.AutoShutdownMinutes = settings.AutoShutdownMinutes;
+		$scope.AutoShutdownAction = settings.AutoShutdownAction;
+		$scope.AutoShutdownAt = settings.AutoShutdownAt;
 		$scope.StaticIps = settings.StaticIps;
+		$scope.NetworkOutputs = settings.NetworkOutputs;
+		$scope.SerialOutputs = [];
+		for (var dev in settings.SerialOutputs) {
+			var out = settings.SerialOutputs[dev];
+			var limits = out.RateLimits || {};
+			$scope.SerialOutputs.push({ 'Device': dev, 'Baud': out.Baud, 'Capability': out.Capability,
+				'Uplinks': limits.UPLINK, 'Traffic': limits.TRAFFIC, 'AHRS': limits.AHRS });
+		}
+		$scope.SDRRoles = settings.SDRRoles || {};
+		$scope.NMEASelections = [];
+		for (var output in settings.NMEAOutputSentences) {
+			$scope.NMEASelections.push({ 'Output': output, 'Sentences': settings.NMEAOutputSentences[output] });
+		}
+		$scope.NMEACustomSentences = (settings.NMEACustomSentences || []).join('\n');
 
 		$scope.WiFiCountry = settings.WiFiCountry;
 		$scope.WiFiSSID = settings.WiFiSSID;
@@ -339,8 +433,62 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		$scope.OGNPilot = settings.OGNPilot;
 		$scope.OGNReg = settings.OGNReg;
 		$scope.OGNTxPower = settings.OGNTxPower;
+		$scope.OGNStealth = settings.OGNStealth;
+		$scope.OGNNoTrack = settings.OGNNoTrack;
+		$scope.OGNTrackerDevice = settings.OGNTrackerDevice;
+		$scope.OGNTrackerBaud = settings.OGNTrackerBaud;
 
 		$scope.PWMDutyMin = settings.PWMDutyMin;
+		$scope.FanControlMode = settings.FanControlMode;
+		$scope.FanCurveText = (settings.FanCurve || []).map(function (p) {
+			return p.Temp + ':' + p.Duty;
+		}).join(', ');
+		$scope.FanHysteresis = settings.FanHysteresis;
+		$scope.FanSpinUpDuty = settings.FanSpinUpDuty;
+		$scope.FanTachPin = settings.FanTachPin;
+		$scope.FanTachPulses = settings.FanTachPulses;
+		$scope.GPSPassthroughTCPPort = settings.GPSPassthroughTCPPort;
+		$scope.BeastOutputPort = settings.BeastOutputPort;
+		$scope.UATRawOutputPort = settings.UATRawOutputPort;
+		$scope.SBSOutputPort = settings.SBSOutputPort;
+		$scope.ASTERIXOutputPort = 0;
+		for (var i = 0; settings.NetworkOutputs && i < settings.NetworkOutputs.length; i++) {
+			if (settings.NetworkOutputs[i].Capability & 512) // NETWORK_ASTERIX
+				$scope.ASTERIXOutputPort = settings.NetworkOutputs[i].Port;
+		}
+		$scope.TrafficCoastTime = settings.TrafficCoastTime;
+		$scope.ES_TrafficTimeout = settings.ES_TrafficTimeout;
+		$scope.UAT_TrafficTimeout = settings.UAT_TrafficTimeout;
+		$scope.OGN_TrafficTimeout = settings.OGN_TrafficTimeout;
+		$scope.TrafficMaxTargets = settings.TrafficMaxTargets;
+		$scope.TrafficPrioAltBand = settings.TrafficPrioAltBand;
+		$scope.TrafficPrioAltMax = settings.TrafficPrioAltMax;
+		$scope.TrafficPrioCPATime = settings.TrafficPrioCPATime;
+		$scope.TrafficPrioCritical = settings.TrafficPrioCritical;
+		$scope.TrafficPrioCriticalDist = settings.TrafficPrioCriticalDist;
+		$scope.GNSS_GPS = settings.GNSS_GPS;
+		$scope.GNSS_GLONASS = settings.GNSS_GLONASS;
+		$scope.GNSS_Galileo = settings.GNSS_Galileo;
+		$scope.GNSS_BeiDou = settings.GNSS_BeiDou;
+		$scope.GNSS_SBAS = settings.GNSS_SBAS;
+		$scope.GNSS_NavRate = settings.GNSS_NavRate;
+		$scope.GPSMovingBase = settings.GPSMovingBase;
+		$scope.GPSMovingBaseHeadingOffset = settings.GPSMovingBaseHeadingOffset;
+		$scope.DebugProfPassword = '';
+		$scope.DebugProfPasswordSet = settings.DebugProfPasswordSet;
+		$scope.AutopilotOutput = settings.AutopilotOutput;
+		$scope.AutopilotEnablePin = settings.AutopilotEnablePin;
+		$scope.AudioAlerts = settings.AudioAlerts;
+		$scope.AudioDevice = settings.AudioDevice;
+		$scope.AudioAlertLevel = settings.AudioAlertLevel;
+		$scope.AudioVerbosity = settings.AudioVerbosity;
+		$scope.AudioVolume = settings.AudioVolume;
+		$scope.AudioChimes = settings.AudioChimes;
+		$scope.AudioMutePin = settings.AudioMutePin;
+		$scope.AudioVario = settings.AudioVario;
+		$scope.AudioVarioDeadBandLow = settings.AudioVarioDeadBandLow;
+		$scope.AudioVarioDeadBandHigh = settings.AudioVarioDeadBandHigh;
+		$scope.CabinAltitudeAlerts = settings.CabinAltitudeAlerts;
 
 		// Update theme
 		$scope.$parent.updateTheme($scope.DarkMode);
@@ -365,7 +513,7 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 
 	function setSettings(msg) {
 		// Simple POST request example (note: response is asynchronous)
-		$http.post(URL_SETTINGS_SET, msg).
+		return $http.post(URL_SETTINGS_SET, msg).
 		then(function (response) {
 			loadSettings(response.data);
 			// $scope.$apply();
@@ -380,6 +528,20 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 
 	getSettings();
 
+	function getSDRs() {
+		$http.get(URL_SDRS_GET).
+		then(function (response) {
+			$scope.SDRs = response.data;
+			$scope.SDRs.forEach(function (sdr) {
+				sdr.NewRole = sdr.RoleSource === 'setting' ? sdr.Role : '';
+			});
+		}, function (response) {
+			$scope.SDRs = [];
+		});
+	}
+
+	getSDRs();
+
 	// Reset all settings from a button on the page
 	$scope.resetSettings = function () {
 		getSettings();
@@ -415,6 +577,123 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateNetworkOutputs = function () {
+		var outputs = $scope.NetworkOutputs.map(function (output) {
+			return {
+				'Port': output.Port,
+				'Capability': output.Capability,
+				'Interface': output.Interface === undefined || output.Interface === null ? '' : output.Interface,
+				'Broadcast': output.Broadcast === true
+			};
+		});
+		setSettings(angular.toJson({ 'NetworkOutputs': outputs }));
+	};
+
+	// Protocols of the serial outputs, see NETWORK_* in network.go.
+	$scope.serialProtocols = [
+		{ name: 'GDL90', capability: 1 },
+		{ name: 'GDL90 + AHRS', capability: 5 },
+		{ name: 'FLARM NMEA', capability: 8 },
+		{ name: 'GDL90 + FLARM NMEA', capability: 9 }
+	];
+
+	$scope.updateSerialOutputs = function () {
+		var outputs = {};
+		$scope.SerialOutputs.forEach(function (output) {
+			var limits = {};
+			['Uplinks', 'Traffic', 'AHRS'].forEach(function (key, i) {
+				var v = parseFloat(output[key]);
+				if (!isNaN(v) && v >= 0)
+					limits[['UPLINK', 'TRAFFIC', 'AHRS'][i]] = v;
+			});
+			outputs[output.Device] = {
+				'Baud': parseInt(output.Baud),
+				'Capability': parseInt(output.Capability),
+				'RateLimits': limits
+			};
+		});
+		setSettings(angular.toJson({ 'SerialOutputs': outputs }));
+	};
+
+	$scope.addSerialOutput = function () {
+		var dev = ($scope.newSerialOutput || '').trim();
+		if (dev.indexOf('/dev/') !== 0) {
+			alert('serial device must be a /dev/ path, e.g. /dev/serial0');
+			return;
+		}
+		$scope.SerialOutputs.push({ 'Device': dev, 'Baud': 38400, 'Capability': 1 });
+		$scope.newSerialOutput = '';
+		$scope.updateSerialOutputs();
+	};
+
+	$scope.removeSerialOutput = function (dev) {
+		var outputs = {};
+		outputs[dev] = null;
+		$scope.SerialOutputs = $scope.SerialOutputs.filter(function (output) { return output.Device !== dev; });
+		setSettings(angular.toJson({ 'SerialOutputs': outputs }));
+	};
+
+	$scope.addNMEASelection = function () {
+		var output = ($scope.newNMEAOutput || '').trim();
+		if (output.length === 0)
+			return;
+		$scope.NMEASelections.push({ 'Output': output, 'Sentences': '' });
+		$scope.newNMEAOutput = '';
+	};
+
+	$scope.removeNMEASelection = function (index) {
+		$scope.NMEASelections.splice(index, 1);
+	};
+
+	$scope.updateNMEASentences = function () {
+		var selections = {};
+		$scope.NMEASelections.forEach(function (selection) {
+			if ((selection.Sentences || '').trim().length > 0)
+				selections[selection.Output] = selection.Sentences;
+		});
+		var templates = ($scope.NMEACustomSentences || '').split('\n').filter(function (t) { return t.trim().length > 0; });
+		setSettings(angular.toJson({ 'NMEAOutputSentences': selections, 'NMEACustomSentences': templates }));
+	};
+
+	$scope.updateRemoteSDR = function (key) {
+		var addr = $scope[key];
+		if (addr === undefined || addr === null) {
+			addr = '';
+		}
+		if (addr !== settings[key]) {
+			settings[key] = addr;
+			var newsettings = {};
+			newsettings[key] = addr;
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	// SDR manager: '' = role from the serial tag / automatic. The dongles are reconfigured right away.
+	$scope.updateSDRRole = function (sdr) {
+		var roles = angular.copy($scope.SDRRoles);
+		if (sdr.NewRole === '') {
+			delete roles[sdr.Serial];
+		} else {
+			roles[sdr.Serial] = sdr.NewRole;
+		}
+		setSettings(angular.toJson({ 'SDRRoles': roles }));
+		setTimeout(getSDRs, 5000);
+	};
+
+	$scope.refreshSDRs = function () {
+		getSDRs();
+	};
+
+	// GSM scan for the PPM correction, takes a few minutes. The dongle must be idle ("Off").
+	$scope.calibrateSDR = function (sdr) {
+		$http.post(URL_SDR_CALIBRATE + '?serial=' + encodeURIComponent(sdr.Serial)).
+		then(function (response) {
+			getSDRs();
+		}, function (response) {
+			sdr.CalibrationError = response.data;
+		});
+	};
+
 	$scope.updatePWMDutyMin = function() {
 		settings['PWMDutyMin'] = 0;
 		if ($scope.PWMDutyMin !== undefined && $scope.PWMDutyMin !== null) {
@@ -426,6 +705,234 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	}
 
+	$scope.updateFanSetting = function (key) {
+		var value = $scope[key];
+		if (value === undefined || value === null || value === settings[key]) {
+			return;
+		}
+		settings[key] = (key === 'FanControlMode') ? value : parseFloat(value);
+		var newsettings = {};
+		newsettings[key] = settings[key];
+		setSettings(angular.toJson(newsettings));
+	};
+
+	// "45:0, 50:30" -> [{Temp: 45, Duty: 0}, {Temp: 50, Duty: 30}]
+	$scope.updateFanCurve = function () {
+		var curve = [];
+		($scope.FanCurveText || '').split(',').forEach(function (point) {
+			var parts = point.split(':');
+			var temp = parseFloat(parts[0]), duty = parseFloat(parts[1]);
+			if (parts.length === 2 && !isNaN(temp) && !isNaN(duty)) {
+				curve.push({ 'Temp': temp, 'Duty': duty });
+			}
+		});
+		if (curve.length === 0 || angular.toJson(curve) === angular.toJson(settings['FanCurve'])) {
+			return;
+		}
+		settings['FanCurve'] = curve;
+		setSettings(angular.toJson({ 'FanCurve': curve }));
+	};
+
+	$scope.updateForeFlightName = function () {
+		var name = ($scope.ForeFlightName || '').trim();
+		if (name.length === 0 || name.length > 8 || name === settings['ForeFlightName']) {
+			return;
+		}
+		settings['ForeFlightName'] = name;
+		setSettings(angular.toJson({ 'ForeFlightName': name }));
+	};
+
+	$scope.updateForeFlightInternetPolicy = function () {
+		var policy = parseInt($scope.ForeFlightInternetPolicy);
+		if (policy !== settings['ForeFlightInternetPolicy']) {
+			settings['ForeFlightInternetPolicy'] = policy;
+			setSettings(angular.toJson({ 'ForeFlightInternetPolicy': policy }));
+		}
+	};
+
+	$scope.updateNMEASerialBaud = function () {
+		var baud = parseInt($scope.NMEASerialBaud);
+		if (baud > 0 && baud !== settings['NMEASerialBaud']) {
+			settings['NMEASerialBaud'] = baud;
+			var newsettings = {
+				'NMEASerialBaud': baud
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	$scope.updateGDL90TCPPort = function() {
+		settings['GDL90TCPPort'] = 0;
+		if ($scope.GDL90TCPPort !== undefined && $scope.GDL90TCPPort !== null) {
+			settings['GDL90TCPPort'] = parseInt($scope.GDL90TCPPort);
+			var newsettings = {
+				'GDL90TCPPort': settings['GDL90TCPPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateFLARMNMEAPort = function() {
+		settings['FLARMNMEAPort'] = 0;
+		if ($scope.FLARMNMEAPort !== undefined && $scope.FLARMNMEAPort !== null) {
+			settings['FLARMNMEAPort'] = parseInt($scope.FLARMNMEAPort);
+			var newsettings = {
+				'FLARMNMEAPort': settings['FLARMNMEAPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateGPSPassthroughTCPPort = function() {
+		settings['GPSPassthroughTCPPort'] = 0;
+		if ($scope.GPSPassthroughTCPPort !== undefined && $scope.GPSPassthroughTCPPort !== null) {
+			settings['GPSPassthroughTCPPort'] = parseInt($scope.GPSPassthroughTCPPort);
+			var newsettings = {
+				'GPSPassthroughTCPPort': settings['GPSPassthroughTCPPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateTrafficSetting = function (key) {
+		var value = $scope[key];
+		if (value === undefined || value === null || value < 0 || value === settings[key]) {
+			return;
+		}
+		settings[key] = parseFloat(value);
+		var newsettings = {};
+		newsettings[key] = settings[key];
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateBeastOutputPort = function() {
+		settings['BeastOutputPort'] = 0;
+		if ($scope.BeastOutputPort !== undefined && $scope.BeastOutputPort !== null) {
+			settings['BeastOutputPort'] = parseInt($scope.BeastOutputPort);
+			var newsettings = {
+				'BeastOutputPort': settings['BeastOutputPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateUATRawOutputPort = function() {
+		settings['UATRawOutputPort'] = 0;
+		if ($scope.UATRawOutputPort !== undefined && $scope.UATRawOutputPort !== null) {
+			settings['UATRawOutputPort'] = parseInt($scope.UATRawOutputPort);
+			var newsettings = {
+				'UATRawOutputPort': settings['UATRawOutputPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateSBSOutputPort = function() {
+		settings['SBSOutputPort'] = 0;
+		if ($scope.SBSOutputPort !== undefined && $scope.SBSOutputPort !== null) {
+			settings['SBSOutputPort'] = parseInt($scope.SBSOutputPort);
+			var newsettings = {
+				'SBSOutputPort': settings['SBSOutputPort']
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateASTERIXOutputPort = function() {
+		if ($scope.ASTERIXOutputPort !== undefined && $scope.ASTERIXOutputPort !== null) {
+			var newsettings = {
+				'ASTERIXOutputPort': parseInt($scope.ASTERIXOutputPort)
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.updateGNSSNavRate = function() {
+		if ($scope.GNSS_NavRate !== undefined && $scope.GNSS_NavRate !== null) {
+			var rate = parseInt($scope.GNSS_NavRate);
+			if (rate >= 1 && rate <= 10 && rate !== settings['GNSS_NavRate']) {
+				settings['GNSS_NavRate'] = rate;
+				var newsettings = {
+					'GNSS_NavRate': rate
+				};
+				setSettings(angular.toJson(newsettings));
+			}
+		}
+	}
+
+	$scope.updateGPSMovingBaseHeadingOffset = function() {
+		if ($scope.GPSMovingBaseHeadingOffset !== undefined && $scope.GPSMovingBaseHeadingOffset !== null) {
+			var offset = parseFloat($scope.GPSMovingBaseHeadingOffset);
+			if (!isNaN(offset) && offset !== settings['GPSMovingBaseHeadingOffset']) {
+				settings['GPSMovingBaseHeadingOffset'] = offset;
+				var newsettings = {
+					'GPSMovingBaseHeadingOffset': offset
+				};
+				setSettings(angular.toJson(newsettings));
+			}
+		}
+	}
+
+	$scope.updateAutopilotEnablePin = function() {
+		if ($scope.AutopilotEnablePin !== undefined && $scope.AutopilotEnablePin !== null) {
+			var pin = parseInt($scope.AutopilotEnablePin);
+			if (pin >= 0 && pin <= 27 && pin !== settings['AutopilotEnablePin']) {
+				settings['AutopilotEnablePin'] = pin;
+				var newsettings = {
+					'AutopilotEnablePin': pin
+				};
+				setSettings(angular.toJson(newsettings));
+			}
+		}
+	}
+
+	$scope.updateAudioDevice = function() {
+		if ($scope.AudioDevice !== undefined && $scope.AudioDevice !== null && $scope.AudioDevice !== settings['AudioDevice']) {
+			settings['AudioDevice'] = $scope.AudioDevice;
+			var newsettings = {
+				'AudioDevice': $scope.AudioDevice
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
+	// The sink threshold is negative, updateTrafficSetting() only takes positive values.
+	$scope.updateVarioDeadBand = function (key) {
+		var value = $scope[key];
+		if (value === undefined || value === null || value === settings[key]) {
+			return;
+		}
+		settings[key] = parseFloat(value);
+		var newsettings = {};
+		newsettings[key] = settings[key];
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.testAudio = function () {
+		$http.post(URL_AUDIO_TEST).
+		then(function (response) {
+			// do nothing
+		}, function (response) {
+			// do nothing
+		});
+	};
+
+	// Write-only: the password is never sent back, only whether one is set
+	$scope.updateDebugProfPassword = function() {
+		if ($scope.DebugProfPassword) {
+			var newsettings = {
+				'DebugProfPassword': $scope.DebugProfPassword
+			};
+			$scope.DebugProfPassword = '';
+			setSettings(angular.toJson(newsettings));
+		}
+	}
+
+	$scope.clearDebugProfPassword = function() {
+		$scope.DebugProfPassword = '';
+		setSettings(angular.toJson({ 'DebugProfPassword': '' }));
+	}
+
 	$scope.updateBaud = function () {
 		settings["Baud"] = 0;
 		if (($scope.Baud !== undefined) && ($scope.Baud !== null)) {
@@ -463,6 +970,39 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateTransponder = function () {
+		var device = ($scope.TransponderDevice || '').trim();
+		var baud = parseInt($scope.TransponderBaud);
+		if (device === settings.TransponderDevice && baud === settings.TransponderBaud && $scope.TransponderProtocol === settings.TransponderProtocol)
+			return;
+		settings.TransponderDevice = device;
+		settings.TransponderBaud = baud;
+		settings.TransponderProtocol = $scope.TransponderProtocol;
+		setSettings(angular.toJson({
+			"TransponderDevice": device,
+			"TransponderBaud": baud,
+			"TransponderProtocol": $scope.TransponderProtocol
+		}));
+	};
+
+	$scope.updateOgnTrackerDevice = function () {
+		var device = ($scope.OGNTrackerDevice || '').trim();
+		var baud = parseInt($scope.OGNTrackerBaud);
+		if (device === settings.OGNTrackerDevice && baud === settings.OGNTrackerBaud)
+			return;
+		settings.OGNTrackerDevice = device;
+		settings.OGNTrackerBaud = baud;
+		setSettings(angular.toJson({ "OGNTrackerDevice": device, "OGNTrackerBaud": baud }));
+	};
+
+	$scope.updateAPRSStationName = function () {
+		var name = ($scope.APRSStationName || '').trim();
+		if (name !== settings.APRSStationName && (name === '' || /^[A-Za-z0-9]{3,9}$/.test(name))) {
+			settings.APRSStationName = name;
+			setSettings(angular.toJson({ "APRSStationName": name }));
+		}
+	};
+
 	$scope.updatestaticips = function () {
 		if ($scope.StaticIps !== settings.StaticIps) {
 			var newsettings = {
@@ -473,6 +1013,93 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		}
 	};
 
+	$scope.updateESNetInputFormat = function () {
+		setSettings(angular.toJson({ 'ES_NetInputFormat': $scope.ES_NetInputFormat }));
+	};
+
+	$scope.updateGeoidSource = function () {
+		var newsettings = {
+			"GeoidSource": $scope.GeoidSource
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	// Display units of the whole web UI, reloaded by MainCtrl
+	$scope.updateUnits = function () {
+		var newsettings = {
+			"UnitAltitude": $scope.UnitAltitude,
+			"UnitSpeed": $scope.UnitSpeed,
+			"UnitPressure": $scope.UnitPressure,
+			"UnitTime": $scope.UnitTime,
+			"TimeZone": $scope.TimeZone
+		};
+		setSettings(angular.toJson(newsettings)).then(function () {
+			$scope.$parent.updateUnits();
+		});
+	};
+
+	$scope.updateReplayLogWriteInterval = function () {
+		var interval = parseInt($scope.ReplayLogWriteInterval);
+		if (!isNaN(interval) && interval >= 1 && interval <= 600 && interval !== settings.ReplayLogWriteInterval) {
+			setSettings(angular.toJson({ "ReplayLogWriteInterval": interval }));
+		}
+	};
+
+	$scope.updateFlightRecorderInterval = function () {
+		var interval = parseInt($scope.FlightRecorderInterval);
+		if (!isNaN(interval) && interval >= 1 && interval <= 60 && interval !== settings.FlightRecorderInterval) {
+			setSettings(angular.toJson({ "FlightRecorderInterval": interval }));
+		}
+	};
+
+	$scope.updateDebriefEncounter = function () {
+		var distance = parseFloat($scope.DebriefEncounterDistance);
+		var altitude = parseInt($scope.DebriefEncounterAltitude);
+		if (isNaN(distance) || distance < 0.1 || distance > 10 || isNaN(altitude) || altitude < 100 || altitude > 5000)
+			return;
+		if (distance !== settings.DebriefEncounterDistance || altitude !== settings.DebriefEncounterAltitude) {
+			setSettings(angular.toJson({ "DebriefEncounterDistance": distance, "DebriefEncounterAltitude": altitude }));
+		}
+	};
+
+	$scope.updateRFCapture = function () {
+		var newsettings = {
+			"RFCaptureUAT": $scope.RFCaptureUAT,
+			"RFCaptureES": $scope.RFCaptureES,
+			"RFCaptureOGN": $scope.RFCaptureOGN
+		};
+		var maxMB = parseInt($scope.RFCaptureMaxMB);
+		if (!isNaN(maxMB) && maxMB >= 0)
+			newsettings.RFCaptureMaxMB = maxMB;
+		var maxAge = parseInt($scope.RFCaptureMaxAge);
+		if (!isNaN(maxAge) && maxAge >= 0)
+			newsettings.RFCaptureMaxAge = maxAge;
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updateAutoShutdown = function () {
+		var minutes = parseInt($scope.AutoShutdownMinutes);
+		var newsettings = {
+			"AutoShutdownMinutes": isNaN(minutes) || minutes < 0 ? 0 : minutes,
+			"AutoShutdownAction": $scope.AutoShutdownAction,
+			"AutoShutdownAt": $scope.AutoShutdownAt || ""
+		};
+		setSettings(angular.toJson(newsettings));
+	};
+
+	$scope.updatecabinaltitudealerts = function () {
+		if ($scope.CabinAltitudeAlerts !== settings.CabinAltitudeAlerts) {
+			var thresholds = [];
+			angular.forEach($scope.CabinAltitudeAlerts, function (ft) {
+				if (parseInt(ft) > 0) thresholds.push(parseInt(ft));
+			});
+			var newsettings = {
+				"CabinAltitudeAlerts": thresholds
+			};
+			setSettings(angular.toJson(newsettings));
+		}
+	};
+
 	$scope.updatealtitudeoffset = function () {
 		if ($scope.AltitudeOffset !== undefined && $scope.AltitudeOffset !== null && $scope.AltitudeOffset !== settings["AltitudeOffset"]) {
 			settings["AltitudeOffset"] = parseInt($scope.AltitudeOffset);
@@ -519,6 +1146,457 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 		});
 	};
 
+	function loadOgnDDB(data) {
+		var ddb = angular.fromJson(data);
+		var fmt = function (t) {
+			var d = new Date(Date.parse(t));
+			return d.getUTCFullYear() > 1 ? d.toISOString().substring(0, 10) : "none";
+		};
+		ddb.DDBUpdated = fmt(ddb.DDBUpdated);
+		ddb.FlarmNetUpdated = fmt(ddb.FlarmNetUpdated);
+		$scope.OgnDDB = ddb;
+	}
+
+	$http.get(URL_OGN_DDB_GET).then(function (response) {
+		loadOgnDDB(response.data);
+	});
+
+	$http.get(URL_INTERNET_WX_GET).then(function (response) {
+		var status = angular.fromJson(response.data);
+		var d = new Date(Date.parse(status.LastFetch));
+		status.LastFetchTime = d.getUTCFullYear() > 1 ? d.toISOString().substring(11, 16) + 'Z' : '';
+		$scope.InternetWx = status;
+	});
+
+	// Regions for the wind forecast, "south,west,north,east".
+	$scope.windForecastRegions = [
+		{ name: 'Around my position', region: '' },
+		{ name: 'Alps', region: '45.0,5.5,48.5,16.5' },
+		{ name: 'Germany', region: '47.2,5.8,55.1,15.1' },
+		{ name: 'France', region: '42.3,-4.8,51.1,8.3' },
+		{ name: 'United Kingdom', region: '49.9,-8.2,58.7,1.8' },
+		{ name: 'Poland/Czechia', region: '48.5,12.0,54.9,24.2' },
+		{ name: 'Spain', region: '36.0,-9.3,43.8,3.3' },
+		{ name: 'Scandinavia (south)', region: '55.3,5.0,63.0,15.0' }
+	];
+
+	function loadWindForecast(data) {
+		var status = angular.fromJson(data);
+		var d = new Date(Date.parse(status.Downloaded));
+		status.DownloadedTime = d.getUTCFullYear() > 1 ? d.toISOString().substring(0, 16).replace('T', ' ') + 'Z' : '';
+		if (status.Wind) {
+			$scope.WindForecastSpeed = unitSpeed(status.Wind.Speed);
+			$scope.WindForecastThermalTop = unitAltitude(status.Wind.ThermalTop);
+		}
+		$scope.WindForecastStatus = status;
+	}
+
+	$http.get(URL_WIND_FORECAST_GET).then(function (response) {
+		loadWindForecast(response.data);
+	});
+
+	$scope.selectWindForecastRegion = function (region) {
+		$scope.WindForecastRegion = region;
+		$scope.updateWindForecastRegion();
+	};
+
+	$scope.updateWindForecastRegion = function () {
+		var region = ($scope.WindForecastRegion || '').replace(/\s/g, '');
+		if (region === settings['WindForecastRegion']) {
+			return;
+		}
+		settings['WindForecastRegion'] = region;
+		$scope.WindForecastRegion = region;
+		setSettings(angular.toJson({ 'WindForecastRegion': region }));
+	};
+
+	$scope.downloadWindForecast = function () {
+		$scope.downloading_forecast = true;
+		$http.post(URL_WIND_FORECAST_UPDATE).then(function (response) {
+			$scope.downloading_forecast = false;
+			loadWindForecast(response.data);
+		}, function (response) {
+			$scope.downloading_forecast = false;
+			alert("wind forecast download failed: " + response.data);
+		});
+	};
+
+	// Network clients (see clientmanager.go), statistics refreshed while the page is open.
+	$scope.clientModes = [
+		{ name: 'Default outputs', mode: 'default' },
+		{ name: 'App profile', mode: 'profile' },
+		{ name: 'Custom outputs', mode: 'custom' },
+		{ name: 'Nothing', mode: 'none' }
+	];
+
+	// Canned outputs for apps (see outputprofiles.go)
+	$scope.OutputProfiles = [];
+	$http.get(URL_OUTPUT_PROFILES_GET).then(function (response) {
+		$scope.OutputProfiles = angular.fromJson(response.data);
+	});
+
+	$scope.outputProfile = function (id) {
+		for (var i = 0; i < $scope.OutputProfiles.length; i++) {
+			if ($scope.OutputProfiles[i].ID === id)
+				return $scope.OutputProfiles[i];
+		}
+		return null;
+	};
+
+	$scope.protocolName = function (capability) {
+		for (var i = 0; i < $scope.serialProtocols.length; i++) {
+			if ($scope.serialProtocols[i].capability === capability)
+				return $scope.serialProtocols[i].name;
+		}
+		return 'capability ' + capability;
+	};
+
+	function refreshNetworkClients() {
+		$http.get(URL_NETWORK_CLIENTS_GET).then(function (response) {
+			$scope.NetworkClientStats = angular.fromJson(response.data);
+		});
+		$http.get(URL_WIFI_STATUS_GET).then(function (response) {
+			$scope.WiFiStatus = angular.fromJson(response.data);
+		});
+	}
+	refreshNetworkClients();
+	var updateNetworkClients = $interval(refreshNetworkClients, 2000);
+	$scope.$on('$destroy', function () {
+		$interval.cancel(updateNetworkClients);
+	});
+
+	$scope.editNetworkClient = function (ip, manual) {
+		var config = (settings.NetworkClients || {})[ip] || {};
+		var limits = config.RateLimits || {};
+		var mode = 'default';
+		if (config.Profile)
+			mode = 'profile';
+		else if (config.Outputs !== undefined && config.Outputs !== null)
+			mode = config.Outputs.length > 0 ? 'custom' : 'none';
+		$scope.clientEdit = {
+			'IP': ip,
+			'Name': config.Name || '',
+			'Manual': config.Manual === true || manual === true,
+			'Mode': mode,
+			'Profile': config.Profile || ($scope.OutputProfiles.length > 0 ? $scope.OutputProfiles[0].ID : ''),
+			'Outputs': (config.Outputs || []).map(function (o) {
+				return { 'Port': o.Port, 'Capability': o.Capability };
+			}),
+			'Uplinks': limits.UPLINK,
+			'Traffic': limits.TRAFFIC,
+			'AHRS': limits.AHRS,
+			'NMEA': limits.NMEA,
+			'AHRSFormat': config.AHRS ? config.AHRS.Format : '',
+			'AHRSRate': config.AHRS ? config.AHRS.Rate : 10,
+			'AHRSHeading': config.AHRS ? config.AHRS.Heading : true
+		};
+	};
+
+	// AHRS message flavors of a client, see ahrsoutput.go. '' = the default messages.
+	$scope.ahrsFormats = [
+		{ 'id': '', 'name': 'Default (Levil + ForeFlight)' },
+		{ 'id': 'foreflight', 'name': 'ForeFlight AHRS (0x65)' },
+		{ 'id': 'levil', 'name': 'Levil/iLevil AHRS (0x4C)' },
+		{ 'id': 'dynon', 'name': 'Dynon SkyView ADAHRS' }
+	];
+
+	$scope.addClientOutput = function () {
+		$scope.clientEdit.Outputs.push({ 'Port': 4000, 'Capability': 1 });
+	};
+
+	$scope.removeClientOutput = function (index) {
+		$scope.clientEdit.Outputs.splice(index, 1);
+	};
+
+	$scope.saveNetworkClient = function () {
+		var edit = $scope.clientEdit;
+		var limits = {};
+		['Uplinks', 'Traffic', 'AHRS', 'NMEA'].forEach(function (key, i) {
+			var v = parseFloat(edit[key]);
+			if (!isNaN(v) && v >= 0)
+				limits[['UPLINK', 'TRAFFIC', 'AHRS', 'NMEA'][i]] = v;
+		});
+		var outputs = null;
+		if (edit.Mode === 'none') {
+			outputs = [];
+		} else if (edit.Mode === 'custom') {
+			outputs = edit.Outputs.filter(function (o) {
+				return parseInt(o.Port) > 0;
+			}).map(function (o) {
+				return { 'Port': parseInt(o.Port), 'Capability': parseInt(o.Capability) };
+			});
+		}
+		var clients = {};
+		var profile = edit.Mode === 'profile' ? edit.Profile : '';
+		var ahrs = null;
+		if (edit.AHRSFormat) {
+			var rate = parseInt(edit.AHRSRate);
+			ahrs = { 'Format': edit.AHRSFormat, 'Rate': isNaN(rate) ? 10 : rate, 'Heading': edit.AHRSHeading === true };
+		}
+		clients[edit.IP] = { 'Name': edit.Name, 'Manual': edit.Manual, 'Profile': profile, 'Outputs': outputs, 'RateLimits': limits,
+			'AHRS': ahrs };
+		setSettings(angular.toJson({ 'NetworkClients': clients }));
+		$scope.clientEdit = null;
+	};
+
+	$scope.removeNetworkClient = function (ip) {
+		var clients = {};
+		clients[ip] = null;
+		setSettings(angular.toJson({ 'NetworkClients': clients }));
+		$scope.clientEdit = null;
+	};
+
+	$scope.addNetworkClient = function () {
+		var ip = ($scope.newNetworkClient || '').trim();
+		if (!/^(\d{1,3}\.){3}\d{1,3}$/.test(ip) && !/^[0-9a-fA-F:]*:[0-9a-fA-F:]*(%[\w.-]+)?$/.test(ip)) {
+			alert('client must be an IP address, e.g. 192.168.10.20 or 2001:db8::20');
+			return;
+		}
+		$scope.newNetworkClient = '';
+		$scope.editNetworkClient(ip, true);
+	};
+
+	// Protocols of the Bluetooth outputs, as the serial ones.
+	$scope.bluetoothProtocols = [{ name: 'Off', capability: 0 }].concat($scope.serialProtocols);
+
+	function loadBluetooth(data) {
+		var status = angular.fromJson(data);
+		var until = new Date(Date.parse(status.PairingUntil));
+		status.Pairing = until.getTime() > Date.now();
+		status.PairingUntilTime = status.Pairing ? until.toLocaleTimeString() : '';
+		$scope.BluetoothStatus = status;
+	}
+
+	$scope.refreshBluetooth = function () {
+		$http.get(URL_BLUETOOTH_GET).then(function (response) {
+			loadBluetooth(response.data);
+		});
+	};
+	$scope.refreshBluetooth();
+
+	$scope.updateBluetoothName = function () {
+		var name = ($scope.BluetoothName || '').trim();
+		if (name.length === 0 || name === settings['BluetoothName']) {
+			return;
+		}
+		settings['BluetoothName'] = name;
+		setSettings(angular.toJson({ 'BluetoothName': name }));
+	};
+
+	$scope.updateBluetoothOutputs = function () {
+		setSettings(angular.toJson({
+			'BluetoothBLEOutput': parseInt($scope.BluetoothBLEOutput),
+			'BluetoothSPPOutput': parseInt($scope.BluetoothSPPOutput)
+		}));
+	};
+
+	function setBluetooth(query) {
+		$http.post(URL_BLUETOOTH_SET + query).then(function (response) {
+			loadBluetooth(response.data);
+		}, function (response) {
+			alert("Bluetooth: " + response.data);
+		});
+	}
+
+	$scope.allowBluetoothPairing = function () {
+		setBluetooth('?action=pair');
+	};
+
+	$scope.removeBluetoothDevice = function (address) {
+		if (confirm('Remove ' + address + '?')) {
+			setBluetooth('?action=remove&address=' + encodeURIComponent(address));
+		}
+	};
+
+	function loadWireGuard(data) {
+		$scope.WireGuardStatus = angular.fromJson(data);
+	}
+
+	$scope.refreshWireGuard = function () {
+		$http.get(URL_WIREGUARD_GET).then(function (response) {
+			loadWireGuard(response.data);
+		});
+	};
+	$scope.refreshWireGuard();
+
+	$scope.wireGuardPeerStatus = function (peer) {
+		var peers = ($scope.WireGuardStatus && $scope.WireGuardStatus.Peers) || [];
+		for (var i = 0; i < peers.length; i++) {
+			if (peers[i].PublicKey === peer.PublicKey)
+				return peers[i];
+		}
+		return null;
+	};
+
+	$scope.addWireGuardPeer = function () {
+		$scope.WireGuardPeers.push({ 'Name': '', 'PublicKey': '', 'Endpoint': '', 'AllowedIPs': '', 'Keepalive': 0 });
+	};
+
+	$scope.removeWireGuardPeer = function (index) {
+		$scope.WireGuardPeers.splice(index, 1);
+	};
+
+	$scope.updateWireGuard = function (peers) {
+		var newsettings = {};
+		var address = ($scope.WireGuardAddress || '').trim();
+		if (address.length > 0 && address !== settings['WireGuardAddress'])
+			newsettings['WireGuardAddress'] = address;
+		var port = parseInt($scope.WireGuardListenPort);
+		if (!isNaN(port) && port !== settings['WireGuardListenPort'])
+			newsettings['WireGuardListenPort'] = port;
+		if (peers === true)
+			newsettings['WireGuardPeers'] = $scope.WireGuardPeers;
+		if (Object.keys(newsettings).length > 0) {
+			setSettings(angular.toJson(newsettings));
+			setTimeout($scope.refreshWireGuard, 2000);
+		}
+	};
+
+	$scope.regenerateWireGuardKey = function () {
+		if (!confirm('Generate a new key? The peers have to be configured with the new public key.'))
+			return;
+		$http.post(URL_WIREGUARD_SET + '?action=regenerate').then(function (response) {
+			loadWireGuard(response.data);
+		}, function (response) {
+			alert("WireGuard: " + response.data);
+		});
+	};
+
+	$scope.MQTTTopicClasses = ['situation', 'traffic', 'status'];
+
+	$scope.refreshMQTT = function () {
+		$http.get(URL_MQTT_GET).then(function (response) {
+			$scope.MQTTStatus = angular.fromJson(response.data);
+		});
+	};
+	$scope.refreshMQTT();
+
+	function loadAPIAuth(data) {
+		var auth = angular.fromJson(data);
+		$scope.APIAuthEnabled = auth.Enabled;
+		$scope.APILegacyOpen = auth.LegacyOpen;
+		$scope.APITokens = auth.Tokens;
+	}
+
+	function apiFailed(response) {
+		$scope.APIError = (response.data && response.data.Error) || ('Error ' + response.status);
+		$scope.refreshAPIAuth();
+	}
+
+	$scope.APIBrowserToken = window.localStorage.getItem(API_TOKEN_STORAGE_KEY) || '';
+
+	$scope.refreshAPIAuth = function () {
+		$http.get(URL_API_AUTH).then(function (response) {
+			loadAPIAuth(response.data);
+		}, function (response) {
+			$scope.APIError = (response.data && response.data.Error) || ('Error ' + response.status);
+		});
+	};
+	$scope.refreshAPIAuth();
+
+	$scope.updateAPIAuth = function () {
+		$scope.APIError = '';
+		$http.post(URL_API_AUTH, angular.toJson({ 'Enabled': $scope.APIAuthEnabled, 'LegacyOpen': $scope.APILegacyOpen })).then(function (response) {
+			loadAPIAuth(response.data);
+		}, apiFailed);
+	};
+
+	$scope.createAPIToken = function () {
+		var name = ($scope.APITokenName || '').trim();
+		if (name.length === 0) {
+			return;
+		}
+		$scope.APIError = '';
+		$http.post(URL_API_TOKENS, angular.toJson({ 'Name': name })).then(function (response) {
+			$scope.APINewToken = response.data.Token;
+			$scope.APITokenName = '';
+			if (!$scope.APIBrowserToken) {
+				// The first token is used by this browser, so enabling the authentication doesn't lock it out
+				$scope.APIBrowserToken = response.data.Token;
+				$scope.updateAPIBrowserToken();
+			}
+			$scope.refreshAPIAuth();
+		}, apiFailed);
+	};
+
+	$scope.deleteAPIToken = function (name) {
+		$scope.APIError = '';
+		$http.delete(URL_API_TOKENS + '/' + encodeURIComponent(name)).then(function (response) {
+			loadAPIAuth(response.data);
+		}, apiFailed);
+	};
+
+	$scope.updateAPIBrowserToken = function () {
+		var token = ($scope.APIBrowserToken || '').trim();
+		if (token.length > 0) {
+			window.localStorage.setItem(API_TOKEN_STORAGE_KEY, token);
+		} else {
+			window.localStorage.removeItem(API_TOKEN_STORAGE_KEY);
+		}
+		$scope.refreshAPIAuth();
+	};
+
+	$scope.clearMQTTPassword = function () {
+		$scope.MQTTPassword = '';
+		setSettings(angular.toJson({ 'MQTTPassword': '' }));
+	};
+
+	$scope.updateMQTT = function () {
+		var intervals = {};
+		$scope.MQTTTopicClasses.forEach(function (c) {
+			var interval = parseInt($scope.MQTTIntervals[c]);
+			intervals[c] = isNaN(interval) || interval < 0 ? 0 : interval;
+		});
+		var newsettings = {
+			'MQTTBroker': ($scope.MQTTBroker || '').trim(),
+			'MQTTClientID': ($scope.MQTTClientID || '').trim(),
+			'MQTTUsername': $scope.MQTTUsername || '',
+			'MQTTTopicPrefix': ($scope.MQTTTopicPrefix || '').trim(),
+			'MQTTQoS': parseInt($scope.MQTTQoS) || 0,
+			'MQTTIntervals': intervals
+		};
+		// Write-only, only sent when a new one is typed
+		if ($scope.MQTTPassword) {
+			newsettings['MQTTPassword'] = $scope.MQTTPassword;
+			$scope.MQTTPassword = '';
+		}
+		setSettings(angular.toJson(newsettings));
+		setTimeout($scope.refreshMQTT, 3000);
+	};
+
+	$scope.setDDBFile = function (files) {
+		$scope.ddb_files = files;
+		$scope.$apply();
+	};
+
+	$scope.uploadDDBFile = function () {
+		var file = $scope.ddb_files[0];
+		if (file === undefined || file === null) {
+			alert ("device database file not selected");
+			return;
+		}
+		var fd = new FormData();
+		fd.append("ddb_file", file);
+		$scope.uploading_ddb = true;
+		$scope.$apply();
+
+		$http.post(URL_OGN_DDB_UPLOAD, fd, {
+			withCredentials: true,
+			headers: {
+				'Content-Type': undefined
+			},
+			transformRequest: angular.identity
+		}).then(function (response) {
+			$scope.uploading_ddb = false;
+			$scope.ddb_files = '';
+			loadOgnDDB(response.data);
+		}, function (response) {
+			$scope.uploading_ddb = false;
+			$scope.ddb_files = '';
+			alert("upload failed: " + response.data);
+		});
+	};
+
 	$scope.setUploadFile = function (files) {
 		$scope.update_files = files;
 		$scope.$apply();
@@ -539,12 +1617,16 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 			return;
 		}
 		var filename = file.name;
-		// check for expected file naming convention
-		var re = /^update.*\.sh$/;
+		// check for expected file naming convention: signed bundle or plain update script
+		var re = /^update.*\.(sh|stxupdate)$/;
 		if (!re.exec(filename)) {
 			alert ("file does not appear to be an update");
 			return;
 		}
+		if ($scope.UpdateStatus && $scope.UpdateStatus.SignedOnly && /\.sh$/.exec(filename)) {
+			alert ("only signed update bundles (.stxupdate) are accepted");
+			return;
+		}
 
 		fd.append("update_file", file);
 		$scope.uploading_update = true;
@@ -563,11 +1645,45 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 			$scope.$apply();
 		}).error(function (data) {
 			$scope.uploading_update = false;
-			alert("error");
+			alert("error: " + data);
 			$scope.$apply();
 		});
 	};
 
+	$scope.refreshUpdateStatus = function () {
+		$http.get(URL_UPDATE_GET).then(function (response) {
+			$scope.UpdateStatus = angular.fromJson(response.data);
+		});
+	};
+	$scope.refreshUpdateStatus();
+
+	$scope.downloadUpdate = function () {
+		var url = ($scope.UpdateURL || '').trim();
+		if (url.length === 0) {
+			return;
+		}
+		$scope.downloading_update = true;
+		$http.post(URL_UPDATE_SET + '?action=download', angular.toJson({ 'URL': url })).then(function (response) {
+			$scope.downloading_update = false;
+			alert("success. wait 5 minutes and refresh home page to verify new version.");
+			window.location.replace("/");
+		}, function (response) {
+			$scope.downloading_update = false;
+			alert("update failed: " + response.data);
+		});
+	};
+
+	$scope.rollbackUpdate = function () {
+		if (!confirm("Restore " + ($scope.UpdateStatus.Previous || "the previous version") + "? Stratux restarts.")) {
+			return;
+		}
+		$http.post(URL_UPDATE_SET + '?action=rollback').then(function (response) {
+			$scope.UpdateStatus = angular.fromJson(response.data);
+		}, function (response) {
+			alert("rollback failed: " + response.data);
+		});
+	};
+
 	$scope.setOrientation = function(action) {
 		// console.log("sending " + action + " message.");
 		$http.post(URL_AHRS_ORIENT, action).
@@ -650,6 +1766,7 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 			case 0: return "AP";
 			case 1: return "WiFi-Direct";
 			case 2: return "AP+Client";
+			case 3: return "Client";
 		}
 		return "???";
 	}
@@ -661,7 +1778,9 @@ function SettingsCtrl($rootScope, $scope, $state, $location, $window, $http) {
 			"OGNAcftType": parseInt($scope.OGNAcftType),
 			"OGNPilot": $scope.OGNPilot,
 			"OGNReg": $scope.OGNReg,
-			"OGNTxPower": $scope.OGNTxPower
+			"OGNTxPower": $scope.OGNTxPower,
+			"OGNStealth": $scope.OGNStealth,
+			"OGNNoTrack": $scope.OGNNoTrack
 		};
 		setSettings(angular.toJson(newsettings));
 
@@ -770,7 +1889,9 @@ angular.module('appControllers')
 			require: 'ngModel',
 			link: function(scope, element, attr, ctrl) {
 				function ipListValidation(value) {
-					var r = "(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)";
+					var r4 = "(?:(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)\.){3}(?:25[0-5]|2[0-4][0-9]|[01]?[0-9][0-9]?)";
+					var r6 = "[0-9a-fA-F:]*:[0-9a-fA-F:]*(?:%[\\w.-]+)?"; // IPv6, link-local with zone (fe80::1%wlan0)
+					var r = "(?:" + r4 + "|" + r6 + ")";
 					var valid = (new RegExp("^(" + r + "( " + r + ")*|)$", "g")).test(value);
 					ctrl.$setValidity('ipList', valid);
 					if (valid) {
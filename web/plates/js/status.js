@@ -45,6 +45,9 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 			$scope.Build = status.Build.substr(0, 10);
 			$scope.Devices = status.Devices;
 			$scope.Ping_connected = status.Ping_connected;
+			$scope.Transponder_connected = status.Transponder_connected;
+			$scope.TransponderSquawk = status.TransponderSquawk;
+			$scope.TransponderIdent = status.TransponderIdent;
 			$scope.Connected_Users = status.Connected_Users;
 			$scope.UAT_messages_last_minute = status.UAT_messages_last_minute;
 			$scope.UAT_messages_max = status.UAT_messages_max;
@@ -60,6 +63,11 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 			$scope.GPS_satellites_tracked = status.GPS_satellites_tracked;
 			$scope.GPS_satellites_seen = status.GPS_satellites_seen;
 			$scope.GPS_solution = status.GPS_solution;
+			$scope.SystemTimeSource = status.SystemTimeSource || "Unknown";
+			$scope.CabinAltitude = status.CabinAltitude;
+			$scope.CabinAltitudeAlert = status.CabinAltitudeAlert;
+			$scope.CabinAltitudeDisplay = Math.round(unitAltitude(status.CabinAltitude));
+			$scope.CabinAltitudeAlertDisplay = Math.round(unitAltitude(status.CabinAltitudeAlert));
 			$scope.OGN_noise_db = status.OGN_noise_db;
 			$scope.OGN_gain_db = status.OGN_gain_db;
 			$scope.OGN_Status_url = "http://" + window.location.hostname + ":8082/rf-spectro.jpg";
@@ -82,6 +90,8 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 					break;
 				default:
 					$scope.GPS_position_accuracy = ", " + status.GPS_position_accuracy.toFixed(1) + " m";
+					if (status.GPS_degraded)
+						$scope.GPS_position_accuracy += " (degraded: " + status.GPS_degraded_reason + ")";
 			}
 			var gpsHardwareCode = (status.GPS_detected_type & 0x0f);
 			var tempGpsHardwareString = "Not installed";
@@ -121,6 +131,8 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 			}
 			$scope.GPS_hardware = tempGpsHardwareString;
 			$scope.GPS_NetworkRemoteIp = status.GPS_NetworkRemoteIp;
+			$scope.GPS_config_status = status.GPS_config_status;
+			$scope.Autopilot_status = status.Autopilot_status;
 			var gpsProtocol = (status.GPS_detected_type >> 4);
 			var tempGpsProtocolString = "Not communicating";
 			switch(gpsProtocol) {
@@ -220,6 +232,61 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 		});
 	};
 
+	function toMiB(bytes) {
+		return Math.round(bytes / 1048576);
+	}
+
+	function getSystemHealth() {
+		$http.get(URL_SYSTEM_HEALTH_GET + '?history=1').
+		then(function (response) {
+			var health = angular.fromJson(response.data);
+			$scope.Health = health;
+			$scope.HealthMemTotal = toMiB(health.MemTotal);
+			$scope.HealthMemUsed = toMiB(health.MemTotal - health.MemAvailable);
+			$scope.HealthDiskTotal = toMiB(health.DiskBytesTotal);
+			$scope.HealthDiskFree = toMiB(health.DiskBytesFree);
+			$scope.HealthSDWritten = toMiB(health.SDBytesWritten);
+			// Undervoltage/throttling changes, newest first
+			$scope.HealthPowerEvents = (health.PowerEvents || []).slice(-10).reverse().map(function (e) {
+				var what = e.Transient ? 'short dip' : (e.Active ? 'began' : 'ended after ' + Math.round(e.Seconds) + ' s');
+				return { Time: new Date(e.Time).toLocaleTimeString(), Text: e.Flag + ' ' + what, Active: e.Active || e.Transient };
+			});
+
+			// CPU temperature chart, one point per sample scaled to the 360x40 box
+			var temps = (health.History || []).map(function (s) { return s.CPUTemp; }).filter(function (t) { return t > -99; });
+			if (temps.length < 2) {
+				$scope.HealthTempPoints = '';
+				return;
+			}
+			var min = Math.min.apply(null, temps);
+			var max = Math.max.apply(null, temps);
+			var range = Math.max(max - min, 1);
+			$scope.HealthTempMin = min;
+			$scope.HealthTempMax = max;
+			$scope.HealthTempPoints = temps.map(function (t, i) {
+				return (i * 360 / (temps.length - 1)).toFixed(1) + ',' + (38 - (t - min) * 36 / range).toFixed(1);
+			}).join(' ');
+		}, function (response) {
+			// nop
+		});
+	}
+
+	function getAlertHistory() {
+		$http.get(URL_ALERTS_GET).
+		then(function (response) {
+			$scope.AlertHistory = angular.fromJson(response.data).History;
+		}, function (response) {
+			// nop
+		});
+	}
+
+	getSystemHealth();
+	getAlertHistory();
+	var updateSystemHealth = $interval(function () {
+		getSystemHealth();
+		getAlertHistory();
+	}, (10 * 1000), 0, false);
+
 	// periodically get the tower list
 	var updateTowers = $interval(function () {
 		// refresh tower count once each 5 seconds (aka polling)
@@ -245,6 +312,7 @@ function StatusCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 			$scope.socket = null;
 		}
 		$interval.cancel(updateTowers);
+		$interval.cancel(updateSystemHealth);
 	};
 
     $scope.VersionClick = function() {
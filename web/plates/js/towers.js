@@ -57,9 +57,19 @@ function TowersCtrl($rootScope, $scope, $state, $http, $interval) {
 		});
 	};
 
+	function getFISBStatus() {
+		$http.get(URL_FISB_STATUS_GET).
+		then(function (response) {
+			$scope.fisb_products = response.data.Products;
+		}, function (response) {
+			$scope.fisb_products = [];
+		});
+	};
+
 	var updateTowers = $interval(function () {
 		// refresh tower list once every 5 seconds (aka polling)
 		getTowers();
+		getFISBStatus();
 	}, (2 * 1000), 0, false);
 
 	$state.get('towers').onEnter = function () {
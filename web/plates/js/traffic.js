@@ -8,25 +8,13 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 	$scope.$parent.helppage = 'plates/traffic-help.html';
 	$scope.data_list = [];
 	$scope.data_list_invalid = [];
+	$scope.suppressed_list = [];
 
 	$scope.$parent.esStyleColor = craftService.getTrafficSourceColor(1);
 	$scope.$parent.uatStyleColor = craftService.getTrafficSourceColor(2);
 	$scope.$parent.ognStyleColor = craftService.getTrafficSourceColor(4);
 	$scope.$parent.aisStyleColor = craftService.getTrafficSourceColor(5);
 	
-	function utcTimeString(epoc) {
-		var time = "";
-		var val;
-		var d = new Date(epoc);
-		val = d.getUTCHours();
-		time += (val < 10 ? "0" + val : "" + val);
-		val = d.getUTCMinutes();
-		time += ":" + (val < 10 ? "0" + val : "" + val);
-		val = d.getUTCSeconds();
-		time += ":" + (val < 10 ? "0" + val : "" + val);
-		time += "Z";
-		return time;
-	}	
 /*
 
 	function dmsString(val) {
@@ -77,9 +65,9 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 		new_traffic.addr_type = obj.Addr_type;
 		new_traffic.lat = dmsString(obj.Lat);
 		new_traffic.lon = dmsString(obj.Lng);
-		var n = Math.round(obj.Alt / 25) * 25;
+		var n = Math.round(unitAltitude(obj.Alt) / 25) * 25;
 		new_traffic.alt = n.toString().replace(/\B(?=(\d{3})+(?!\d))/g, ",");
-		var s = Math.round(obj.Speed / 5) * 5;
+		var s = Math.round(unitSpeed(obj.Speed) / 5) * 5;
 		if (obj.Speed_valid) {
 			new_traffic.speed = s.toString();
 			new_traffic.heading = Math.round(obj.Track / 5) * 5;
@@ -87,9 +75,9 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 			new_traffic.speed = "---";
 			new_traffic.heading = "---";
 		}
-		new_traffic.vspeed = Math.round(obj.Vvel / 100) * 100
+		new_traffic.vspeed = stratuxUnits.Altitude === 'm' ? Math.round(unitVerticalSpeed(obj.Vvel) * 2) / 2 : Math.round(obj.Vvel / 100) * 100
 		var timestamp = Date.parse(obj.Timestamp);
-		new_traffic.time = utcTimeString(timestamp);
+		new_traffic.time = unitTimeString(timestamp);
 		new_traffic.Age = obj.Age;
 		new_traffic.AgeLastAlt = obj.AgeLastAlt;
 		new_traffic.bearing = Math.round(obj.Bearing); // degrees true 
@@ -97,6 +85,8 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 		new_traffic.distEst = obj.DistanceEstimated / 1852;
 		new_traffic.trafficColor = craftService.getTransportColor(obj);
 		new_traffic.category = craftService.getCategory(obj);
+		new_traffic.hidden = obj.Hidden; // category rules, see emittercategory.go
+		new_traffic.highlight = obj.Highlight;
 		if (new_traffic.TargetType ===  TARGET_TYPE_AIS) {
 			new_traffic.addr_symb = '\uD83D\uDEA2';
 		} else {
@@ -120,6 +110,8 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 	}
 
 
+	var trafficState = {}; // key -> target, see craftService.applyTrafficStream()
+
 	function connect($scope) {
 		if (($scope === undefined) || ($scope === null))
 			return; // we are getting called once after clicking away from the status page
@@ -151,54 +143,57 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 
 		socket.onmessage = function (msg) {
 			//console.log('Received traffic update.')
-			var message = JSON.parse(msg.data);
 			$scope.raw_data = angular.toJson(msg.data, true);
-
-			// we need to use an array so AngularJS can perform sorting; it also means we need to loop to find an aircraft in the traffic set
-			var validIdx = -1;
-			var invalidIdx = -1;
-			for (var i = 0, len = $scope.data_list.length; i < len; i++) {
-				if (isSameAircraft($scope.data_list[i].icao_int, $scope.data_list[i].addr_type, message.Icao_addr, message.Addr_type)) {
-					setAircraft(message, $scope.data_list[i]);
-					validIdx = i;
-					break;
-				}
-			}
-			
-			for (var i = 0, len = $scope.data_list_invalid.length; i < len; i++) {
-				if (isSameAircraft($scope.data_list_invalid[i].icao_int, $scope.data_list_invalid[i].addr_type, message.Icao_addr, message.Addr_type)) {
-					setAircraft(message, $scope.data_list_invalid[i]);
-					invalidIdx = i;
-					break;
-				}
-			}
-			
-			if ((validIdx < 0) && (message.Position_valid)) {
-				var new_traffic = {};
-				setAircraft(message, new_traffic);
-				$scope.data_list.unshift(new_traffic); // add to start of valid array.
+			var targets = craftService.applyTrafficStream(trafficState, JSON.parse(msg.data));
+			for (var i = 0; i < targets.length; i++) {
+				updateAircraft(targets[i]);
 			}
+			$scope.$apply();
+		};
+	}
 
-			if ((invalidIdx < 0) && (!message.Position_valid)) {
-				var new_traffic = {};
-				setAircraft(message, new_traffic);
-				$scope.data_list_invalid.unshift(new_traffic); // add to start of invalid array.
+	function updateAircraft(message) {
+		// we need to use an array so AngularJS can perform sorting; it also means we need to loop to find an aircraft in the traffic set
+		var validIdx = -1;
+		var invalidIdx = -1;
+		for (var i = 0, len = $scope.data_list.length; i < len; i++) {
+			if (isSameAircraft($scope.data_list[i].icao_int, $scope.data_list[i].addr_type, message.Icao_addr, message.Addr_type)) {
+				setAircraft(message, $scope.data_list[i]);
+				validIdx = i;
+				break;
 			}
-
-			// Handle the negative cases of those above - where an aircraft moves from "valid" to "invalid" or vice-versa.
-			if ((validIdx >= 0) && !message.Position_valid) {
-				// Position is not valid any more. Remove from "valid" table.
-				$scope.data_list.splice(validIdx, 1);
+		}
+		
+		for (var i = 0, len = $scope.data_list_invalid.length; i < len; i++) {
+			if (isSameAircraft($scope.data_list_invalid[i].icao_int, $scope.data_list_invalid[i].addr_type, message.Icao_addr, message.Addr_type)) {
+				setAircraft(message, $scope.data_list_invalid[i]);
+				invalidIdx = i;
+				break;
 			}
+		}
+		
+		if ((validIdx < 0) && (message.Position_valid)) {
+			var new_traffic = {};
+			setAircraft(message, new_traffic);
+			$scope.data_list.unshift(new_traffic); // add to start of valid array.
+		}
 
-			if ((invalidIdx >= 0) && message.Position_valid) {
-				// Position is now valid. Remove from "invalid" table.
-				$scope.data_list_invalid.splice(invalidIdx, 1);
-			}
+		if ((invalidIdx < 0) && (!message.Position_valid)) {
+			var new_traffic = {};
+			setAircraft(message, new_traffic);
+			$scope.data_list_invalid.unshift(new_traffic); // add to start of invalid array.
+		}
 
-			$scope.$apply();
+		// Handle the negative cases of those above - where an aircraft moves from "valid" to "invalid" or vice-versa.
+		if ((validIdx >= 0) && !message.Position_valid) {
+			// Position is not valid any more. Remove from "valid" table.
+			$scope.data_list.splice(validIdx, 1);
+		}
 
-		};
+		if ((invalidIdx >= 0) && message.Position_valid) {
+			// Position is now valid. Remove from "invalid" table.
+			$scope.data_list_invalid.splice(invalidIdx, 1);
+		}
 	}
 
 	var getClock = $interval(function () {
@@ -226,6 +221,28 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 	}, 500, 0, false);
 		
 
+	function getSuppressed() {
+		$http.get(URL_OWNSHIP_SUPPRESSED_GET).
+		then(function (response) {
+			var list = angular.fromJson(response.data);
+			for (var i = 0; i < list.length; i++) {
+				var s = list[i];
+				s.icao = s.Icao_addr.toString(16).toUpperCase();
+				s.tail = (s.Tail && s.Tail.trim().length > 0) ? s.Tail : "[--N/A--]";
+				s.AltDiffDisplay = unitAltitude(s.AltDiff).toFixed(0);
+				s.since = unitTimeString(Date.parse(s.First_seen));
+				s.last = unitTimeString(Date.parse(s.Last_seen));
+			}
+			$scope.suppressed_list = list;
+		}, function (response) {
+			// nop
+		});
+	}
+
+	// refresh the ownship suppression list every 5 seconds
+	var updateSuppressed = $interval(getSuppressed, (5 * 1000), 0, true);
+	getSuppressed();
+
 	// perform cleanup every 10 seconds
 	var clearStaleTraffic = $interval(function () {
 		// remove stale aircraft = anything more than cutoff seconds without a position update
@@ -258,6 +275,7 @@ function TrafficCtrl($rootScope, $scope, $state, $http, $interval, craftService)
 		}
 		// stop stale traffic cleanup
 		$interval.cancel(clearStaleTraffic);
+		$interval.cancel(updateSuppressed);
 	};
 
 	// Traffic Controller tasks
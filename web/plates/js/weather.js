@@ -133,6 +133,7 @@ function WeatherCtrl($rootScope, $scope, $state, $http, $interval) {
 
 		data_item.flight_condition = parseFlightCondition(obj.Type, obj.Data);
 		data_item.location = obj.Location;
+		data_item.source = obj.Source;
 		s = obj.Time;
 		// data_item.time = s.substring(0, 2) + '-' + s.substring(2, 4) + ':' + s.substring(4, 6) + 'Z';
 		// we may not get an accurate base time on the stratux device so we use the device time as our base